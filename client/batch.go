@@ -0,0 +1,126 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// A Batch accumulates operations to be sent in a single round trip
+// via KV.Run or KV.Send, reducing the cost of issuing many small
+// requests. Operations execute in the order added and at the same
+// timestamp, so a key may be written at most once per batch. The
+// batch is split by the node into one request per range addressed.
+//
+// Execution stops at the first operation which fails; the effects of
+// earlier operations are not undone. Batches which require atomicity
+// should be run within a transaction. A batch may be sent only once.
+type Batch struct {
+	requests []storage.Request
+}
+
+// Len returns the number of operations in the batch.
+func (b *Batch) Len() int {
+	return len(b.requests)
+}
+
+// Get adds a read of the value at key. Its response is a
+// *storage.GetResponse.
+func (b *Batch) Get(key storage.Key) {
+	b.requests = append(b.requests, &storage.GetRequest{Key: key})
+}
+
+// Put adds a write of value at key. Its response is a
+// *storage.PutResponse.
+func (b *Batch) Put(key storage.Key, value []byte) {
+	b.requests = append(b.requests, &storage.PutRequest{
+		Key:   key,
+		Value: storage.Value{Bytes: value},
+	})
+}
+
+// ConditionalPut adds a write of value at key conditional on the
+// existing value equaling expValue, or on there being no existing
+// value if expValue is nil. Its response is a
+// *storage.ConditionalPutResponse.
+func (b *Batch) ConditionalPut(key storage.Key, value, expValue []byte) {
+	args := &storage.ConditionalPutRequest{
+		Key:   key,
+		Value: storage.Value{Bytes: value},
+	}
+	if expValue != nil {
+		args.ExpValue = &storage.Value{Bytes: expValue}
+	}
+	b.requests = append(b.requests, args)
+}
+
+// Increment adds an increment of the integer value at key by inc.
+// Its response is a *storage.IncrementResponse.
+func (b *Batch) Increment(key storage.Key, inc int64) {
+	b.requests = append(b.requests, &storage.IncrementRequest{Key: key, Increment: inc})
+}
+
+// Delete adds a deletion of the value at key. Its response is a
+// *storage.DeleteResponse.
+func (b *Batch) Delete(key storage.Key) {
+	b.requests = append(b.requests, &storage.DeleteRequest{Key: key})
+}
+
+// DeleteRange adds a deletion of the values at keys from start
+// (inclusive) to end (exclusive), up to max values if max is
+// positive. Its response is a *storage.DeleteRangeResponse.
+func (b *Batch) DeleteRange(start, end storage.Key, max int64) {
+	b.requests = append(b.requests, &storage.DeleteRangeRequest{
+		StartKey:           start,
+		EndKey:             end,
+		MaxEntriesToDelete: max,
+	})
+}
+
+// Scan adds a read of up to max key-value pairs with keys from start
+// (inclusive) to end (exclusive). Its response is a
+// *storage.ScanResponse.
+func (b *Batch) Scan(start, end storage.Key, max int64) {
+	b.requests = append(b.requests, &storage.ScanRequest{
+		StartKey:   start,
+		EndKey:     end,
+		MaxResults: max,
+	})
+}
+
+// Send sends the operations of b as a single batch request and
+// returns a channel which receives the reply without waiting for it.
+// Independent batches may be pipelined by sending each before
+// receiving any of their replies. b must not be modified until the
+// reply is received. An empty batch isn't sent.
+func (c *KV) Send(b *Batch) <-chan *storage.BatchResponse {
+	if b.Len() == 0 {
+		replyChan := make(chan *storage.BatchResponse, 1)
+		replyChan <- &storage.BatchResponse{}
+		return replyChan
+	}
+	return c.db.Batch(&storage.BatchRequest{Requests: b.requests})
+}
+
+// Run sends the operations of b as a single batch request and waits
+// for the reply. It returns the responses to the operations, in the
+// order they were added, and the error of the first operation which
+// failed, if any. On error, only the responses of the operations
+// which executed are returned.
+func (c *KV) Run(b *Batch) ([]storage.Response, error) {
+	reply := <-c.Send(b)
+	return reply.Responses, reply.Error
+}
@@ -0,0 +1,132 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// TestBatchRun verifies that the operations of a batch execute in
+// order and their responses are returned in the same order.
+func TestBatchRun(t *testing.T) {
+	db := NewKV(NewHTTPDB(startServer(), nil))
+	prefix := testPrefix("batch")
+	key := func(suffix string) storage.Key { return storage.MakeKey(prefix, storage.Key(suffix)) }
+	b := &Batch{}
+	b.Put(key("a"), []byte("a"))
+	b.ConditionalPut(key("b"), []byte("b"), nil)
+	b.Increment(key("c"), 3)
+	b.Get(key("a"))
+	b.Scan(prefix, storage.PrefixEndKey(prefix), 10)
+	responses, err := db.Run(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != b.Len() {
+		t.Fatalf("expected %d responses; got %d", b.Len(), len(responses))
+	}
+	if ir := responses[2].(*storage.IncrementResponse); ir.NewValue != 3 {
+		t.Errorf("expected increment to 3; got %d", ir.NewValue)
+	}
+	if gr := responses[3].(*storage.GetResponse); !bytes.Equal(gr.Value.Bytes, []byte("a")) {
+		t.Errorf("expected \"a\"; got %q", gr.Value.Bytes)
+	}
+	if sr := responses[4].(*storage.ScanResponse); len(sr.Rows) != 3 {
+		t.Errorf("expected 3 rows; got %v", sr.Rows)
+	}
+
+	// Keys written by one batch may be deleted by the next.
+	b = &Batch{}
+	b.Delete(key("a"))
+	b.DeleteRange(key("b"), key("z"), 0)
+	if responses, err = db.Run(b); err != nil {
+		t.Fatal(err)
+	}
+	if dr := responses[1].(*storage.DeleteRangeResponse); dr.NumDeleted != 2 {
+		t.Errorf("expected 2 deletions; got %d", dr.NumDeleted)
+	}
+	if rows, err := db.Scan(prefix, storage.PrefixEndKey(prefix), 10); err != nil || len(rows) != 0 {
+		t.Errorf("expected no rows; got %v, %v", rows, err)
+	}
+
+	// Execution stops at the first failed operation.
+	b = &Batch{}
+	b.Put(key("d"), []byte("d"))
+	b.ConditionalPut(key("c"), []byte("e"), []byte("wrong"))
+	b.Put(key("e"), []byte("e"))
+	responses, err = db.Run(b)
+	if _, ok := err.(*storage.ConditionFailedError); !ok {
+		t.Errorf("expected condition failed error; got %v", err)
+	}
+	if len(responses) != 2 {
+		t.Errorf("expected 2 executed responses; got %d", len(responses))
+	}
+	if v, err := db.Get(key("e")); err != nil || v != nil {
+		t.Errorf("expected no value after failed operation; got %q, %v", v, err)
+	}
+
+	// Empty batches succeed without a round trip.
+	if responses, err := db.Run(&Batch{}); err != nil || len(responses) != 0 {
+		t.Errorf("expected no responses; got %v, %v", responses, err)
+	}
+}
+
+// TestBatchPipeline verifies that independent batches may be sent
+// before any of their replies are received.
+func TestBatchPipeline(t *testing.T) {
+	db := NewKV(NewHTTPDB(startServer(), nil))
+	var replies []<-chan *storage.BatchResponse
+	for i := 0; i < 10; i++ {
+		b := &Batch{}
+		for j := 0; j < 10; j++ {
+			b.Put(storage.Key(fmt.Sprintf("pipeline-%02d-%02d", i, j)), []byte("v"))
+		}
+		replies = append(replies, db.Send(b))
+	}
+	for i, replyChan := range replies {
+		if reply := <-replyChan; reply.Error != nil {
+			t.Errorf("%d: %v", i, reply.Error)
+		}
+	}
+	rows, err := db.Scan(storage.Key("pipeline-"), storage.Key("pipeline-z"), 1000)
+	if err != nil || len(rows) != 100 {
+		t.Errorf("expected 100 rows; got %d, %v", len(rows), err)
+	}
+}
+
+// TestBatchInTransaction verifies that batches run within a
+// transaction are committed with it.
+func TestBatchInTransaction(t *testing.T) {
+	db := NewKV(NewHTTPDB(startServer(), nil))
+	err := db.RunTransaction(&kv.TransactionOptions{}, func(txn *KV) error {
+		b := &Batch{}
+		b.Put(storage.Key("batch-txn-a"), []byte("a"))
+		b.Put(storage.Key("batch-txn-b"), []byte("b"))
+		_, err := txn.Run(b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get(storage.Key("batch-txn-b")); err != nil || !bytes.Equal(v, []byte("b")) {
+		t.Errorf("expected committed value; got %q, %v", v, err)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+/*
+Package client provides a Go client for Cockroach. Applications embed
+it to read and write the key-value map of a cluster via any of its
+nodes, rather than issuing RPCs themselves.
+
+An HTTPDB implements the asynchronous kv.DB interface by sending
+requests to a node's HTTP endpoint for Go clients. Connections are
+pooled. Requests which fail to reach the node, or which fail with
+errors classified as retryable (see util.Retryable), are retried with
+jittered exponential backoff. A KV wraps a kv.DB with synchronous methods and runs
+transactions:
+
+	db := client.NewKV(client.NewHTTPDB("localhost:8080", nil))
+	if err := db.Put(storage.Key("a"), []byte("1")); err != nil {
+	  ...
+	}
+	err := db.RunTransaction(&kv.TransactionOptions{}, func(txn *client.KV) error {
+	  v, err := txn.Get(storage.Key("a"))
+	  if err != nil {
+	    return err
+	  }
+	  return txn.Put(storage.Key("b"), v)
+	})
+
+The function passed to RunTransaction may be retried and so must be
+idempotent.
+
+Many small operations may be sent in a single round trip by adding
+them to a Batch and running it via KV.Run. KV.Send returns without
+waiting for the reply, so that independent batches may be pipelined.
+
+To debug slow requests, set Trace in the header of a request sent via
+the asynchronous API. The reply's header then carries a storage.Trace
+describing the range and replica which executed the request, the
+holder of the range's leader lease, the number of attempts and the
+time spent in each phase.
+*/
+package client
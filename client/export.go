@@ -0,0 +1,265 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cockroachdb/cockroach/hlc"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// ExportManifestName is the name of the manifest file of an export
+// directory.
+const ExportManifestName = "MANIFEST"
+
+const defaultExportChunkRows = 10000
+
+// An ExportManifest describes an export of a key span to a directory.
+// It's written to the directory as JSON after each chunk, so an
+// interrupted export can be resumed from the end of its last chunk.
+type ExportManifest struct {
+	StartKey  storage.Key     // First key of the span (inclusive)
+	EndKey    storage.Key     // Last key of the span (exclusive)
+	Timestamp hlc.HLTimestamp // Timestamp of the values exported
+	// MinTimestamp is zero for full exports. Incremental exports hold
+	// only the keys written or deleted after MinTimestamp.
+	MinTimestamp hlc.HLTimestamp
+	Chunks       []ExportChunk // Chunks written, in key order
+	Complete     bool          // True once the whole span is exported
+}
+
+// An ExportChunk describes a file of an export holding the rows with
+// keys from StartKey (inclusive) to EndKey (exclusive).
+type ExportChunk struct {
+	Name     string      // File name, relative to the export directory
+	StartKey storage.Key // First key of the chunk's span (inclusive)
+	EndKey   storage.Key // Last key of the chunk's span (exclusive)
+	Rows     int64       // Number of rows in the chunk
+	Checksum string      // Hex-encoded SHA-256 of the file
+}
+
+// ExportOptions configure an export.
+type ExportOptions struct {
+	// Timestamp is the timestamp at which the span is read. Zero
+	// selects the current time. It's ignored when resuming an export,
+	// which continues at the timestamp of its manifest.
+	Timestamp hlc.HLTimestamp
+	// MinTimestamp, if not zero, selects an incremental export of the
+	// keys written or deleted after it, typically the timestamp of a
+	// previous export. Deletions are exported as rows marked Deleted.
+	// MinTimestamp must be within the GC TTL of the span's
+	// zones, so that deletions since haven't been garbage collected.
+	MinTimestamp hlc.HLTimestamp
+	// ChunkRows is the maximum number of rows per chunk. Zero selects
+	// a default.
+	ChunkRows int64
+	// Progress, if not nil, is invoked with the manifest after each
+	// chunk is written.
+	Progress func(*ExportManifest)
+}
+
+// Export writes the key-value pairs with keys from start (inclusive)
+// to end (exclusive), as of a fixed timestamp, to chunk files in dir
+// described by a manifest. Each chunk is a sequence of rows, each
+// encoded as the uvarint length of its key, the key, the uvarint
+// length of its value plus one, or zero for deletions, and the value.
+// If dir already holds the manifest of an interrupted export of the
+// same span and minimum timestamp, the export resumes after its last
+// chunk. The timestamp must remain within the GC TTL of the span's
+// zones for the export to complete.
+func Export(c *KV, dir string, start, end storage.Key, opts ExportOptions) (*ExportManifest, error) {
+	if opts.ChunkRows <= 0 {
+		opts.ChunkRows = defaultExportChunkRows
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	manifest, err := ReadExportManifest(dir)
+	if os.IsNotExist(err) {
+		manifest = &ExportManifest{
+			StartKey:     start,
+			EndKey:       end,
+			Timestamp:    opts.Timestamp,
+			MinTimestamp: opts.MinTimestamp,
+		}
+		if manifest.Timestamp == (hlc.HLTimestamp{}) {
+			manifest.Timestamp = c.clock.Now()
+		}
+	} else if err != nil {
+		return nil, err
+	} else if !bytes.Equal(manifest.StartKey, start) || !bytes.Equal(manifest.EndKey, end) {
+		return nil, util.Errorf("%s holds an export of [%q, %q), not [%q, %q)",
+			dir, manifest.StartKey, manifest.EndKey, start, end)
+	} else if manifest.MinTimestamp != opts.MinTimestamp {
+		return nil, util.Errorf("%s holds an export since %+v, not %+v", dir, manifest.MinTimestamp, opts.MinTimestamp)
+	}
+
+	for !manifest.Complete {
+		chunkStart := manifest.StartKey
+		if n := len(manifest.Chunks); n > 0 {
+			chunkStart = manifest.Chunks[n-1].EndKey
+		}
+		reply := <-c.db.Scan(&storage.ScanRequest{
+			RequestHeader: storage.RequestHeader{Timestamp: manifest.Timestamp},
+			StartKey:      chunkStart,
+			EndKey:        manifest.EndKey,
+			MaxResults:    opts.ChunkRows,
+			MinTimestamp:  manifest.MinTimestamp,
+		})
+		if reply.Error != nil {
+			return nil, reply.Error
+		}
+		chunk := ExportChunk{
+			Name:     fmt.Sprintf("%06d.chunk", len(manifest.Chunks)),
+			StartKey: chunkStart,
+			EndKey:   manifest.EndKey,
+			Rows:     int64(len(reply.Rows)),
+		}
+		if chunk.Rows == opts.ChunkRows {
+			chunk.EndKey = storage.MakeKey(reply.Rows[chunk.Rows-1].Key, storage.Key{0})
+		} else {
+			manifest.Complete = true
+		}
+		if chunk.Checksum, err = writeExportChunk(filepath.Join(dir, chunk.Name), reply.Rows); err != nil {
+			return nil, err
+		}
+		manifest.Chunks = append(manifest.Chunks, chunk)
+		if err := writeExportManifest(dir, manifest); err != nil {
+			return nil, err
+		}
+		if opts.Progress != nil {
+			opts.Progress(manifest)
+		}
+	}
+	return manifest, nil
+}
+
+// ReadExportManifest reads the manifest of the export in dir. The
+// error satisfies os.IsNotExist if dir holds no manifest.
+func ReadExportManifest(dir string) (*ExportManifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, ExportManifestName))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &ExportManifest{}
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return nil, util.Errorf("unable to decode manifest of %s: %v", dir, err)
+	}
+	return manifest, nil
+}
+
+// ReadExportChunk reads the rows of chunk from the export in dir,
+// verifying the chunk's checksum.
+func ReadExportChunk(dir string, chunk ExportChunk) ([]storage.KeyValue, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, chunk.Name))
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(b); hex.EncodeToString(sum[:]) != chunk.Checksum {
+		return nil, util.Errorf("checksum mismatch of chunk %s", chunk.Name)
+	}
+	r := bytes.NewReader(b)
+	var rows []storage.KeyValue
+	for r.Len() > 0 {
+		key, err := readExportField(r, false)
+		if err != nil {
+			return nil, util.Errorf("unable to decode chunk %s: %v", chunk.Name, err)
+		}
+		value, err := readExportField(r, true)
+		if err != nil {
+			return nil, util.Errorf("unable to decode chunk %s: %v", chunk.Name, err)
+		}
+		rows = append(rows, storage.KeyValue{Key: key, Value: storage.Value{Bytes: value}, Deleted: value == nil})
+	}
+	if int64(len(rows)) != chunk.Rows {
+		return nil, util.Errorf("expected %d rows in chunk %s; got %d", chunk.Rows, chunk.Name, len(rows))
+	}
+	return rows, nil
+}
+
+// readExportField reads a uvarint length-prefixed field from r. If
+// nullable is true, the length is incremented by one and zero
+// encodes nil.
+func readExportField(r *bytes.Reader, nullable bool) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if nullable {
+		if n == 0 {
+			return nil, nil
+		}
+		n--
+	}
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	field := make([]byte, n)
+	_, err = io.ReadFull(r, field)
+	return field, err
+}
+
+// writeExportChunk writes rows to the file at path and returns the
+// file's hex-encoded SHA-256.
+func writeExportChunk(path string, rows []storage.KeyValue) (string, error) {
+	var buf bytes.Buffer
+	var lenBuf [binary.MaxVarintLen64]byte
+	for _, row := range rows {
+		buf.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(row.Key)))])
+		buf.Write(row.Key)
+		var valueLen uint64
+		if !row.Deleted {
+			valueLen = uint64(len(row.Value.Bytes)) + 1
+		}
+		buf.Write(lenBuf[:binary.PutUvarint(lenBuf[:], valueLen)])
+		buf.Write(row.Value.Bytes)
+	}
+	if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// writeExportManifest writes manifest to dir.
+func writeExportManifest(dir string, manifest *ExportManifest) error {
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, ExportManifestName), b)
+}
+
+// writeFileAtomic writes b to a temporary file renamed to path, so an
+// interrupted write doesn't leave a partial file at path.
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,177 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// readExport returns the rows of all chunks of the export in dir.
+func readExport(t *testing.T, dir string, manifest *ExportManifest) []storage.KeyValue {
+	var rows []storage.KeyValue
+	for _, chunk := range manifest.Chunks {
+		chunkRows, err := ReadExportChunk(dir, chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, chunkRows...)
+	}
+	return rows
+}
+
+// TestExport verifies that a span is exported in chunks as of the
+// export's timestamp, that an interrupted export resumes after its
+// last chunk, and that corrupted chunks are detected.
+func TestExport(t *testing.T) {
+	db := NewKV(NewHTTPDB(startServer(), nil))
+	prefix := testPrefix("export")
+	key := func(suffix string) storage.Key { return storage.MakeKey(prefix, storage.Key(suffix)) }
+	for i := 0; i < 8; i++ {
+		if err := db.Put(key(fmt.Sprint(i)), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	timestamp := db.clock.Now()
+	// Writes after the export's timestamp aren't exported.
+	if err := db.Put(key("0"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(key("8"), []byte("v8")); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start, end := prefix, storage.PrefixEndKey(prefix)
+	opts := ExportOptions{Timestamp: timestamp, ChunkRows: 3}
+	manifest, err := Export(db, dir, start, end, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.Complete || len(manifest.Chunks) != 3 {
+		t.Fatalf("expected complete export in 3 chunks; got %+v", manifest)
+	}
+	rows := readExport(t, dir, manifest)
+	if len(rows) != 8 {
+		t.Fatalf("expected 8 rows; got %d", len(rows))
+	}
+	for i, row := range rows {
+		if expValue := []byte(fmt.Sprintf("v%d", i)); !bytes.Equal(row.Value.Bytes, expValue) {
+			t.Errorf("%d: expected value %q; got %q", i, expValue, row.Value.Bytes)
+		}
+	}
+
+	// Truncate the manifest to its first chunk, as if the export was
+	// interrupted; resuming it writes the same chunks.
+	interrupted := *manifest
+	interrupted.Chunks = manifest.Chunks[:1]
+	interrupted.Complete = false
+	if err := writeExportManifest(dir, &interrupted); err != nil {
+		t.Fatal(err)
+	}
+	var progress int
+	opts.Progress = func(*ExportManifest) { progress++ }
+	resumed, err := Export(db, dir, start, end, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress != 2 {
+		t.Errorf("expected 2 chunks written on resumption; got %d", progress)
+	}
+	if !reflect.DeepEqual(resumed, manifest) {
+		t.Errorf("expected resumed manifest %+v; got %+v", manifest, resumed)
+	}
+	if reread, err := ReadExportManifest(dir); err != nil || !reflect.DeepEqual(reread, manifest) {
+		t.Errorf("expected manifest %+v; got %+v, %v", manifest, reread, err)
+	}
+
+	// A manifest of a different span isn't resumed.
+	if _, err := Export(db, dir, start, key("5"), opts); err == nil {
+		t.Error("expected error resuming export of a different span")
+	}
+
+	// Corrupted chunks fail their checksum.
+	path := filepath.Join(dir, manifest.Chunks[1].Name)
+	if err := ioutil.WriteFile(path, []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadExportChunk(dir, manifest.Chunks[1]); err == nil {
+		t.Error("expected checksum mismatch of corrupted chunk")
+	}
+}
+
+// TestIncrementalExport verifies that an export since the timestamp
+// of a full export holds only the keys written or deleted since.
+func TestIncrementalExport(t *testing.T) {
+	db := NewKV(NewHTTPDB(startServer(), nil))
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(storage.Key("incr-"+key), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start, end := storage.Key("incr-"), storage.Key("incr-z")
+	full, err := Export(db, filepath.Join(dir, "full"), start, end, ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put(storage.Key("incr-b"), []byte("")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(storage.Key("incr-c")); err != nil {
+		t.Fatal(err)
+	}
+	incrDir := filepath.Join(dir, "incr")
+	incr, err := Export(db, incrDir, start, end, ExportOptions{MinTimestamp: full.Timestamp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if incr.MinTimestamp != full.Timestamp || !full.Timestamp.Less(incr.Timestamp) {
+		t.Errorf("expected export from %+v; got %+v to %+v", full.Timestamp, incr.MinTimestamp, incr.Timestamp)
+	}
+	rows := readExport(t, incrDir, incr)
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 rows; got %+v", rows)
+	}
+	// The empty value and the deletion are distinguished.
+	if !bytes.Equal(rows[0].Key, storage.Key("incr-b")) || rows[0].Deleted || len(rows[0].Value.Bytes) != 0 {
+		t.Errorf("expected empty value of \"incr-b\"; got %q=%q", rows[0].Key, rows[0].Value.Bytes)
+	}
+	if !bytes.Equal(rows[1].Key, storage.Key("incr-c")) || !rows[1].Deleted {
+		t.Errorf("expected deletion of \"incr-c\"; got %q=%q", rows[1].Key, rows[1].Value.Bytes)
+	}
+
+	// The incremental export isn't resumed as a full export.
+	if _, err := Export(db, incrDir, start, end, ExportOptions{}); err == nil {
+		t.Error("expected error resuming incremental export as a full export")
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// DefaultRetryOptions are the options used to retry requests which
+// fail with retryable errors, unless otherwise specified via Options.
+var DefaultRetryOptions = util.RetryOptions{
+	Backoff:     50 * time.Millisecond,
+	MaxBackoff:  5 * time.Second,
+	Constant:    2,
+	MaxAttempts: 8,
+	UseJitter:   true,
+}
+
+// defaultMaxIdleConns is the default number of idle connections to
+// the node kept for reuse.
+const defaultMaxIdleConns = 16
+
+// Options customize the behavior of an HTTPDB.
+type Options struct {
+	// User is the user on whose behalf requests are made. Defaults
+	// to kv.AnonymousUser.
+	User string
+	// Retry specifies how requests which fail with retryable errors
+	// are retried. The zero value selects DefaultRetryOptions. The
+	// options' Stopper is replaced by the DB's, so that retries are
+	// abandoned when the DB is closed.
+	Retry util.RetryOptions
+	// MaxIdleConns is the maximum number of idle connections to the
+	// node kept for reuse. Zero selects a default.
+	MaxIdleConns int
+}
+
+// An httpSendError indicates that a request failed to reach the node
+// or the node failed to process it. Such requests may be retried.
+type httpSendError struct {
+	error
+}
+
+// CanRetry implements the Retryable interface.
+func (h httpSendError) CanRetry() bool { return true }
+
+// An HTTPDB is a kv.DB which sends requests to a Cockroach node via
+// the node's HTTP endpoints for Go clients (see kv.DBPrefix). The
+// node routes each request to the ranges it addresses. Connections to
+// the node are pooled and reused by concurrent requests. Requests
+// failing with retryable errors are retried with backoff.
+type HTTPDB struct {
+	addr      string // Base URL of the node, e.g. "http://localhost:8080"
+	user      string
+	retryOpts util.RetryOptions
+	client    *http.Client
+	stopper   *util.Stopper // Abandons retries on Close
+}
+
+// NewHTTPDB returns a DB which sends requests to the node at addr,
+// either a URL or a host:port pair. opts may be nil to use defaults.
+func NewHTTPDB(addr string, opts *Options) *HTTPDB {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	db := &HTTPDB{
+		addr:      strings.TrimSuffix(addr, "/"),
+		user:      opts.User,
+		retryOpts: opts.Retry,
+		stopper:   util.NewStopper(),
+	}
+	if db.user == "" {
+		db.user = kv.AnonymousUser
+	}
+	if db.retryOpts == (util.RetryOptions{}) {
+		db.retryOpts = DefaultRetryOptions
+	}
+	db.retryOpts.Stopper = db.stopper
+	maxIdleConns := opts.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
+	db.client = &http.Client{
+		Transport: &http.Transport{MaxIdleConnsPerHost: maxIdleConns},
+	}
+	return db
+}
+
+// Close abandons the retries of requests in progress and closes idle
+// connections to the node.
+func (db *HTTPDB) Close() {
+	db.stopper.Stop()
+	db.client.Transport.(*http.Transport).CloseIdleConnections()
+}
+
+// post sends args to the node's endpoint for method and decodes the
+// response into reply.
+func (db *HTTPDB) post(method string, args storage.Request, reply storage.Response) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(args); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", db.addr+kv.DBPrefix+method, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", kv.GobContentType)
+	req.Header.Set(kv.UserHeader, db.user)
+	resp, err := db.client.Do(req)
+	if err != nil {
+		return httpSendError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		err := util.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return httpSendError{err}
+		}
+		return err
+	}
+	if err := gob.NewDecoder(resp.Body).Decode(reply); err != nil {
+		return httpSendError{util.Errorf("unable to decode %s reply: %v", method, err)}
+	}
+	return nil
+}
+
+// send sends args to the node and returns a channel of the same
+// type as reply which receives the reply. Errors are returned in the
+// reply's header.
+//
+// Requests which fail to reach the node are retried according to the
+// DB's retry options, as are non-transactional requests whose reply
+// carries a retryable error, such as a storage.NotLeaderError or
+// storage.TransactionPushError. Errors of transactional requests are
+// left to the transaction's coordinator; see kv.RunTransaction.
+//
+// If the request doesn't specify a client command ID, one is
+// generated so that retries are executed at most once. If the request
+// asks for a trace, the total time spent is added to it.
+func (db *HTTPDB) send(method string, args storage.Request, reply storage.Response) interface{} {
+	if header := args.Header(); header.CmdID.IsEmpty() {
+		header.CmdID = storage.ClientCmdID{
+			WallTime: time.Now().UnixNano(),
+			Random:   rand.Int63(),
+		}
+	}
+	chanVal := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, reflect.TypeOf(reply)), 1)
+
+	go func() {
+		start := time.Now()
+		retryOpts := db.retryOpts
+		retryOpts.Tag = fmt.Sprintf("sending %s to %s", method, db.addr)
+		attempts, err := util.RetryOnError(retryOpts, func() error {
+			// Decode into a fresh reply on each attempt.
+			reflect.ValueOf(reply).Elem().Set(reflect.Zero(reflect.TypeOf(reply).Elem()))
+			if err := db.post(method, args, reply); err != nil {
+				return err
+			}
+			if args.Header().Txn == nil {
+				return reply.Header().Error
+			}
+			return nil
+		})
+		if attempts > 1 {
+			log.New("client").V(1).Infof("%s to %s took %d attempts", method, db.addr, attempts)
+		}
+		if err != nil {
+			reply.Header().Error = err
+		}
+		if trace := storage.ReplyTrace(args, reply); trace != nil {
+			trace.AddPhase(storage.TraceClient, start)
+		}
+		chanVal.Send(reflect.ValueOf(reply))
+	}()
+
+	return chanVal.Interface()
+}
+
+// unsupported returns a channel of the same type as reply which
+// receives reply with an error indicating method can't be invoked by
+// clients.
+func unsupported(method string, reply storage.Response) interface{} {
+	chanVal := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, reflect.TypeOf(reply)), 1)
+	reply.Header().Error = util.Errorf("%s is not supported by clients", method)
+	chanVal.Send(reflect.ValueOf(reply))
+	return chanVal.Interface()
+}
+
+// Contains determines whether the KV map contains the specified key.
+func (db *HTTPDB) Contains(args *storage.ContainsRequest) <-chan *storage.ContainsResponse {
+	return db.send("Contains", args, &storage.ContainsResponse{}).(chan *storage.ContainsResponse)
+}
+
+// Get fetches the value for a key from the KV map.
+func (db *HTTPDB) Get(args *storage.GetRequest) <-chan *storage.GetResponse {
+	return db.send("Get", args, &storage.GetResponse{}).(chan *storage.GetResponse)
+}
+
+// Put sets the value for a key in the KV map.
+func (db *HTTPDB) Put(args *storage.PutRequest) <-chan *storage.PutResponse {
+	return db.send("Put", args, &storage.PutResponse{}).(chan *storage.PutResponse)
+}
+
+// ConditionalPut sets the value for a key if the existing value
+// matches the value specified in the request.
+func (db *HTTPDB) ConditionalPut(args *storage.ConditionalPutRequest) <-chan *storage.ConditionalPutResponse {
+	return db.send("ConditionalPut", args, &storage.ConditionalPutResponse{}).(chan *storage.ConditionalPutResponse)
+}
+
+// Increment increments the value at the specified key.
+func (db *HTTPDB) Increment(args *storage.IncrementRequest) <-chan *storage.IncrementResponse {
+	return db.send("Increment", args, &storage.IncrementResponse{}).(chan *storage.IncrementResponse)
+}
+
+// Delete removes the value for the specified key.
+func (db *HTTPDB) Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResponse {
+	return db.send("Delete", args, &storage.DeleteResponse{}).(chan *storage.DeleteResponse)
+}
+
+// DeleteRange removes all values for keys which fall between
+// args.StartKey and args.EndKey.
+func (db *HTTPDB) DeleteRange(args *storage.DeleteRangeRequest) <-chan *storage.DeleteRangeResponse {
+	return db.send("DeleteRange", args, &storage.DeleteRangeResponse{}).(chan *storage.DeleteRangeResponse)
+}
+
+// Scan fetches the values for all keys which fall between
+// args.StartKey and args.EndKey.
+func (db *HTTPDB) Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse {
+	return db.send("Scan", args, &storage.ScanResponse{}).(chan *storage.ScanResponse)
+}
+
+// ReverseScan fetches the values for keys which fall between
+// args.StartKey and args.EndKey in descending key order.
+func (db *HTTPDB) ReverseScan(args *storage.ReverseScanRequest) <-chan *storage.ReverseScanResponse {
+	return db.send("ReverseScan", args, &storage.ReverseScanResponse{}).(chan *storage.ReverseScanResponse)
+}
+
+// EndTransaction commits or aborts a transaction.
+func (db *HTTPDB) EndTransaction(args *storage.EndTransactionRequest) <-chan *storage.EndTransactionResponse {
+	return db.send("EndTransaction", args, &storage.EndTransactionResponse{}).(chan *storage.EndTransactionResponse)
+}
+
+// Batch sends a batch of requests in a single round trip.
+func (db *HTTPDB) Batch(args *storage.BatchRequest) <-chan *storage.BatchResponse {
+	return db.send("Batch", args, &storage.BatchResponse{}).(chan *storage.BatchResponse)
+}
+
+// AdminSplit is not supported by clients.
+func (db *HTTPDB) AdminSplit(args *storage.AdminSplitRequest) <-chan *storage.AdminSplitResponse {
+	return unsupported("AdminSplit", &storage.AdminSplitResponse{}).(chan *storage.AdminSplitResponse)
+}
+
+// AdminMerge is not supported by clients.
+func (db *HTTPDB) AdminMerge(args *storage.AdminMergeRequest) <-chan *storage.AdminMergeResponse {
+	return unsupported("AdminMerge", &storage.AdminMergeResponse{}).(chan *storage.AdminMergeResponse)
+}
+
+// AccumulateTS adds to a time series.
+func (db *HTTPDB) AccumulateTS(args *storage.AccumulateTSRequest) <-chan *storage.AccumulateTSResponse {
+	return db.send("AccumulateTS", args, &storage.AccumulateTSResponse{}).(chan *storage.AccumulateTSResponse)
+}
+
+// ReapQueue scans and deletes messages from a recipient message
+// queue.
+func (db *HTTPDB) ReapQueue(args *storage.ReapQueueRequest) <-chan *storage.ReapQueueResponse {
+	return db.send("ReapQueue", args, &storage.ReapQueueResponse{}).(chan *storage.ReapQueueResponse)
+}
+
+// EnqueueUpdate enqueues an update for eventual execution.
+func (db *HTTPDB) EnqueueUpdate(args *storage.EnqueueUpdateRequest) <-chan *storage.EnqueueUpdateResponse {
+	return db.send("EnqueueUpdate", args, &storage.EnqueueUpdateResponse{}).(chan *storage.EnqueueUpdateResponse)
+}
+
+// EnqueueMessage enqueues a message for delivery to an inbox.
+func (db *HTTPDB) EnqueueMessage(args *storage.EnqueueMessageRequest) <-chan *storage.EnqueueMessageResponse {
+	return db.send("EnqueueMessage", args, &storage.EnqueueMessageResponse{}).(chan *storage.EnqueueMessageResponse)
+}
+
+// InternalPushTxn is not supported by clients.
+func (db *HTTPDB) InternalPushTxn(args *storage.InternalPushTxnRequest) <-chan *storage.InternalPushTxnResponse {
+	return unsupported("InternalPushTxn", &storage.InternalPushTxnResponse{}).(chan *storage.InternalPushTxnResponse)
+}
+
+// InternalResolveIntent resolves the write intent of a transaction
+// coordinated by the client.
+func (db *HTTPDB) InternalResolveIntent(args *storage.InternalResolveIntentRequest) <-chan *storage.InternalResolveIntentResponse {
+	return db.send("InternalResolveIntent", args, &storage.InternalResolveIntentResponse{}).(chan *storage.InternalResolveIntentResponse)
+}
+
+// InternalHeartbeatTxn heartbeats the record of a transaction
+// coordinated by the client.
+func (db *HTTPDB) InternalHeartbeatTxn(args *storage.InternalHeartbeatTxnRequest) <-chan *storage.InternalHeartbeatTxnResponse {
+	return db.send("InternalHeartbeatTxn", args, &storage.InternalHeartbeatTxnResponse{}).(chan *storage.InternalHeartbeatTxnResponse)
+}
+
+// InternalSnapshot is not supported by clients.
+func (db *HTTPDB) InternalSnapshot(args *storage.InternalSnapshotRequest) <-chan *storage.InternalSnapshotResponse {
+	return unsupported("InternalSnapshot", &storage.InternalSnapshotResponse{}).(chan *storage.InternalSnapshotResponse)
+}
+
+// InternalChecksum is not supported by clients.
+func (db *HTTPDB) InternalChecksum(args *storage.InternalChecksumRequest) <-chan *storage.InternalChecksumResponse {
+	return unsupported("InternalChecksum", &storage.InternalChecksumResponse{}).(chan *storage.InternalChecksumResponse)
+}
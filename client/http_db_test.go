@@ -0,0 +1,163 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"encoding/gob"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+var testRetryOptions = util.RetryOptions{
+	Backoff:     1 * time.Millisecond,
+	MaxBackoff:  1 * time.Millisecond,
+	Constant:    2,
+	MaxAttempts: 3,
+}
+
+// TestHTTPDBRetry verifies that requests failing with server errors
+// are retried, up to the maximum number of attempts.
+func TestHTTPDBRetry(t *testing.T) {
+	backend, err := url.Parse(startServer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(backend)
+	var failures, attempts int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	db := NewHTTPDB(s.URL, &Options{Retry: testRetryOptions})
+	defer db.Close()
+
+	// Two failures are retried.
+	atomic.StoreInt32(&failures, 2)
+	reply := <-db.Put(&storage.PutRequest{Key: storage.Key("retry"), Value: storage.Value{Bytes: []byte("v")}})
+	if reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	if a := atomic.LoadInt32(&attempts); a != 3 {
+		t.Errorf("expected 3 attempts; got %d", a)
+	}
+
+	// Three exhaust the maximum attempts.
+	atomic.StoreInt32(&failures, 3)
+	reply = <-db.Put(&storage.PutRequest{Key: storage.Key("retry"), Value: storage.Value{Bytes: []byte("v")}})
+	if _, ok := reply.Error.(*util.RetryMaxAttemptsError); !ok {
+		t.Errorf("expected max attempts error; got %v", reply.Error)
+	}
+}
+
+// TestHTTPDBRetryableReply verifies that non-transactional requests
+// whose replies carry retryable errors are retried, while permanent
+// errors and the errors of transactional requests are returned.
+func TestHTTPDBRetryableReply(t *testing.T) {
+	var attempts int32
+	var mu sync.Mutex // Protects replyErr
+	var replyErr error
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reply := &storage.GetResponse{}
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			mu.Lock()
+			reply.Error = replyErr
+			mu.Unlock()
+		}
+		w.Header().Set("Content-Type", kv.GobContentType)
+		if err := gob.NewEncoder(w).Encode(reply); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer s.Close()
+	db := NewHTTPDB(s.URL, &Options{Retry: testRetryOptions})
+	defer db.Close()
+
+	testCases := []struct {
+		err      error
+		txn      *storage.Transaction
+		expErr   bool
+		attempts int32
+	}{
+		{&storage.NotLeaderError{RangeID: 1}, nil, false, 3},
+		{&storage.TransactionPushError{}, nil, false, 3},
+		{&storage.NotLeaderError{RangeID: 1}, &storage.Transaction{}, true, 1},
+		{&storage.ReadTooOldError{}, nil, true, 1},
+	}
+	for i, test := range testCases {
+		atomic.StoreInt32(&attempts, 0)
+		mu.Lock()
+		replyErr = test.err
+		mu.Unlock()
+		reply := <-db.Get(&storage.GetRequest{
+			RequestHeader: storage.RequestHeader{Txn: test.txn},
+			Key:           storage.Key("a"),
+		})
+		if (reply.Error != nil) != test.expErr {
+			t.Errorf("%d: expected error %t; got %v", i, test.expErr, reply.Error)
+		}
+		if a := atomic.LoadInt32(&attempts); a != test.attempts {
+			t.Errorf("%d: expected %d attempts; got %d", i, test.attempts, a)
+		}
+	}
+}
+
+// TestHTTPDBUnsupported verifies that methods not exposed to clients
+// fail without contacting the node.
+func TestHTTPDBUnsupported(t *testing.T) {
+	db := NewHTTPDB("localhost:0", nil)
+	if reply := <-db.AdminSplit(&storage.AdminSplitRequest{}); reply.Error == nil {
+		t.Error("expected error for unsupported method")
+	}
+	if reply := <-db.InternalPushTxn(&storage.InternalPushTxnRequest{}); reply.Error == nil {
+		t.Error("expected error for unsupported method")
+	}
+}
+
+// TestHTTPDBTrace verifies that traced requests include the time
+// spent by the client in their trace.
+func TestHTTPDBTrace(t *testing.T) {
+	db := NewHTTPDB(startServer(), nil)
+	defer db.Close()
+	reply := <-db.Get(&storage.GetRequest{
+		RequestHeader: storage.RequestHeader{Trace: true},
+		Key:           storage.Key("trace"),
+	})
+	if reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	if reply.Trace == nil || len(reply.Trace.Phases) != 2 ||
+		reply.Trace.Phases[0].Name != storage.TraceExecute || reply.Trace.Phases[1].Name != storage.TraceClient {
+		t.Errorf("expected execute and client phases; got %+v", reply.Trace)
+	}
+	if reply := <-db.Get(&storage.GetRequest{Key: storage.Key("trace")}); reply.Trace != nil {
+		t.Errorf("expected no trace; got %s", reply.Trace)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+const (
+	defaultImportBatchSize   = 1000
+	defaultImportConcurrency = 4
+)
+
+// ImportOptions configure an import of delimited rows.
+type ImportOptions struct {
+	// Comma is the field delimiter. Zero selects ','.
+	Comma rune
+	// Lines selects line-delimited input: each line is split at every
+	// delimiter, without the quoting rules of CSV, so fields may contain
+	// quotes verbatim but not delimiters or newlines.
+	Lines bool
+	// Prefix is prepended to the key of each row.
+	Prefix storage.Key
+	// KeyColumn and ValueColumn are the zero-based indexes of the fields
+	// holding the key and the value of each row.
+	KeyColumn, ValueColumn int
+	// BatchSize is the number of rows written per batch. Zero selects
+	// a default.
+	BatchSize int
+	// Concurrency is the number of batches written in parallel. Zero
+	// selects a default.
+	Concurrency int
+	// Progress, if not nil, is invoked with the cumulative statistics
+	// of the import after each batch is written. It may be invoked
+	// concurrently.
+	Progress func(ImportStats)
+}
+
+// ImportStats count the rows written by an import.
+type ImportStats struct {
+	Rows    int64 // Rows written
+	Bytes   int64 // Bytes of keys and values written
+	Batches int64 // Batches written
+}
+
+// Import reads delimited rows from r and writes the value of each row
+// at its key via c, in batches written by parallel workers. Batches
+// aren't transactional: on error, the rows of batches already written
+// remain. Rows aren't written in order, so if a key occurs in more
+// than one row, which of its values is written is undefined. Import
+// returns the statistics of the rows written and the first error
+// encountered, if any.
+func Import(c *KV, r io.Reader, opts ImportOptions) (ImportStats, error) {
+	if opts.Comma == 0 {
+		opts.Comma = ','
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultImportBatchSize
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultImportConcurrency
+	}
+	if opts.KeyColumn < 0 || opts.ValueColumn < 0 {
+		return ImportStats{}, util.Errorf("invalid key column %d or value column %d", opts.KeyColumn, opts.ValueColumn)
+	}
+
+	var stats ImportStats
+	var errOnce sync.Once
+	var firstErr error
+	done := make(chan struct{})
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			close(done)
+		})
+	}
+
+	type importBatch struct {
+		b     *Batch
+		bytes int64
+	}
+	batches := make(chan importBatch, opts.Concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ib := range batches {
+				if _, err := c.Run(ib.b); err != nil {
+					fail(err)
+					return
+				}
+				cur := ImportStats{
+					Rows:    atomic.AddInt64(&stats.Rows, int64(ib.b.Len())),
+					Bytes:   atomic.AddInt64(&stats.Bytes, ib.bytes),
+					Batches: atomic.AddInt64(&stats.Batches, 1),
+				}
+				if opts.Progress != nil {
+					opts.Progress(cur)
+				}
+			}
+		}()
+	}
+
+	// send queues the batch for writing, returning false if the import
+	// failed.
+	send := func(ib importBatch) bool {
+		select {
+		case <-done:
+			return false
+		default:
+		}
+		select {
+		case batches <- ib:
+			return true
+		case <-done:
+			return false
+		}
+	}
+
+	readRow := newRowReader(r, opts)
+	cur := importBatch{b: &Batch{}}
+	// A key may be written at most once per batch, so a repeated key
+	// starts a new batch.
+	keys := map[string]struct{}{}
+	for row := 1; ; row++ {
+		fields, err := readRow()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fail(util.Errorf("row %d: %v", row, err))
+			break
+		}
+		if len(fields) <= opts.KeyColumn || len(fields) <= opts.ValueColumn {
+			fail(util.Errorf("row %d: expected at least %d fields; got %d",
+				row, maxInt(opts.KeyColumn, opts.ValueColumn)+1, len(fields)))
+			break
+		}
+		key := make(storage.Key, 0, len(opts.Prefix)+len(fields[opts.KeyColumn]))
+		key = append(append(key, opts.Prefix...), fields[opts.KeyColumn]...)
+		if _, ok := keys[string(key)]; ok || cur.b.Len() >= opts.BatchSize {
+			if !send(cur) {
+				break
+			}
+			cur = importBatch{b: &Batch{}}
+			keys = map[string]struct{}{}
+		}
+		value := []byte(fields[opts.ValueColumn])
+		cur.b.Put(key, value)
+		cur.bytes += int64(len(key) + len(value))
+		keys[string(key)] = struct{}{}
+	}
+	if cur.b.Len() > 0 {
+		send(cur)
+	}
+	close(batches)
+	wg.Wait()
+	return stats, firstErr
+}
+
+// newRowReader returns a function which reads the fields of the next
+// row from r, returning io.EOF at the end of the input.
+func newRowReader(r io.Reader, opts ImportOptions) func() ([]string, error) {
+	if !opts.Lines {
+		cr := csv.NewReader(r)
+		cr.Comma = opts.Comma
+		cr.FieldsPerRecord = -1
+		return cr.Read
+	}
+	scanner := bufio.NewScanner(r)
+	comma := string(opts.Comma)
+	return func() ([]string, error) {
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		return strings.Split(scanner.Text(), comma), nil
+	}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,111 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// TestImport verifies that rows of CSV and line-delimited input are
+// written at their prefixed keys in batches, and that progress is
+// reported after each batch.
+func TestImport(t *testing.T) {
+	db := NewKV(NewHTTPDB(startServer(), nil))
+
+	var csvRows []string
+	for i := 0; i < 25; i++ {
+		csvRows = append(csvRows, fmt.Sprintf("%d,k%02d,\"v,%d\"", i, i, i))
+	}
+	var mu sync.Mutex
+	var progress []ImportStats
+	stats, err := Import(db, strings.NewReader(strings.Join(csvRows, "\n")), ImportOptions{
+		Prefix:      storage.Key("import-csv-"),
+		KeyColumn:   1,
+		ValueColumn: 2,
+		BatchSize:   10,
+		Concurrency: 2,
+		Progress: func(s ImportStats) {
+			mu.Lock()
+			defer mu.Unlock()
+			progress = append(progress, s)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Rows != 25 || stats.Batches != 3 {
+		t.Errorf("expected 25 rows in 3 batches; got %+v", stats)
+	}
+	if len(progress) != 3 || progress[2] != stats {
+		t.Errorf("expected progress after each of 3 batches ending at %+v; got %+v", stats, progress)
+	}
+	rows, err := db.Scan(storage.Key("import-csv-"), storage.Key("import-csv-z"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 25 {
+		t.Fatalf("expected 25 rows; got %d", len(rows))
+	}
+	for i, row := range rows {
+		if expKey := storage.Key(fmt.Sprintf("import-csv-k%02d", i)); !bytes.Equal(row.Key, expKey) {
+			t.Errorf("%d: expected key %q; got %q", i, expKey, row.Key)
+		}
+		if expValue := []byte(fmt.Sprintf("v,%d", i)); !bytes.Equal(row.Value.Bytes, expValue) {
+			t.Errorf("%d: expected value %q; got %q", i, expValue, row.Value.Bytes)
+		}
+	}
+
+	// Line-delimited fields aren't unquoted, and a repeated key starts
+	// a new batch.
+	input := "a\t\"1\"\nb\t2\na\t3\n"
+	stats, err = Import(db, strings.NewReader(input), ImportOptions{
+		Comma:       '\t',
+		Lines:       true,
+		Prefix:      storage.Key("import-lines-"),
+		ValueColumn: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Rows != 3 || stats.Batches != 2 {
+		t.Errorf("expected 3 rows in 2 batches; got %+v", stats)
+	}
+	if value, err := db.Get(storage.Key("import-lines-b")); err != nil || !bytes.Equal(value, []byte("2")) {
+		t.Errorf("expected \"2\"; got %q, %v", value, err)
+	}
+}
+
+// TestImportErrors verifies that rows missing the key or value column
+// fail the import.
+func TestImportErrors(t *testing.T) {
+	db := NewKV(NewHTTPDB(startServer(), nil))
+	_, err := Import(db, strings.NewReader("a,1\nb\n"), ImportOptions{
+		Prefix:      storage.Key("import-err-"),
+		ValueColumn: 1,
+	})
+	if err == nil || !strings.Contains(err.Error(), "row 2") {
+		t.Errorf("expected error at row 2; got %v", err)
+	}
+	if value, err := db.Get(storage.Key("import-err-a")); err != nil || value != nil {
+		t.Errorf("expected no rows written; got %q, %v", value, err)
+	}
+}
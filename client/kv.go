@@ -0,0 +1,128 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"github.com/cockroachdb/cockroach/hlc"
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// A KV provides synchronous methods to read and write the key-value
+// map via an underlying kv.DB, usually an HTTPDB.
+type KV struct {
+	db    kv.DB
+	clock *hlc.HLClock // Clock used to timestamp transactions
+}
+
+// NewKV returns a KV which sends requests via db.
+func NewKV(db kv.DB) *KV {
+	return &KV{db: db, clock: hlc.NewHLClock(hlc.UnixNano)}
+}
+
+// DB returns the underlying DB, for access to its asynchronous API.
+func (c *KV) DB() kv.DB {
+	return c.db
+}
+
+// Get returns the value at key, or nil if there's none.
+func (c *KV) Get(key storage.Key) ([]byte, error) {
+	reply := <-c.db.Get(&storage.GetRequest{Key: key})
+	if reply.Error != nil {
+		return nil, reply.Error
+	}
+	return reply.Value.Bytes, nil
+}
+
+// Put sets the value at key.
+func (c *KV) Put(key storage.Key, value []byte) error {
+	return (<-c.db.Put(&storage.PutRequest{
+		Key:   key,
+		Value: storage.Value{Bytes: value},
+	})).Error
+}
+
+// ConditionalPut sets the value at key if its existing value equals
+// expValue, or if there's no existing value and expValue is nil.
+// Otherwise, a *storage.ConditionFailedError is returned.
+func (c *KV) ConditionalPut(key storage.Key, value, expValue []byte) error {
+	args := &storage.ConditionalPutRequest{
+		Key:   key,
+		Value: storage.Value{Bytes: value},
+	}
+	if expValue != nil {
+		args.ExpValue = &storage.Value{Bytes: expValue}
+	}
+	return (<-c.db.ConditionalPut(args)).Error
+}
+
+// Increment adds inc to the integer value at key, which is treated
+// as zero if there's no value, and returns the new value.
+func (c *KV) Increment(key storage.Key, inc int64) (int64, error) {
+	reply := <-c.db.Increment(&storage.IncrementRequest{Key: key, Increment: inc})
+	return reply.NewValue, reply.Error
+}
+
+// Delete removes the value at key.
+func (c *KV) Delete(key storage.Key) error {
+	return (<-c.db.Delete(&storage.DeleteRequest{Key: key})).Error
+}
+
+// DeleteRange removes the values at keys from start (inclusive) to
+// end (exclusive), up to max values if max is positive. Returns the
+// number of values removed.
+func (c *KV) DeleteRange(start, end storage.Key, max int64) (int64, error) {
+	reply := <-c.db.DeleteRange(&storage.DeleteRangeRequest{
+		StartKey:           start,
+		EndKey:             end,
+		MaxEntriesToDelete: max,
+	})
+	return reply.NumDeleted, reply.Error
+}
+
+// Scan returns up to max key-value pairs with keys from start
+// (inclusive) to end (exclusive), in key order. max must be positive.
+func (c *KV) Scan(start, end storage.Key, max int64) ([]storage.KeyValue, error) {
+	reply := <-c.db.Scan(&storage.ScanRequest{
+		StartKey:   start,
+		EndKey:     end,
+		MaxResults: max,
+	})
+	return reply.Rows, reply.Error
+}
+
+// ReverseScan returns up to max key-value pairs with keys from start
+// (inclusive) to end (exclusive), in descending key order; that is,
+// the last max keys before end. max must be positive.
+func (c *KV) ReverseScan(start, end storage.Key, max int64) ([]storage.KeyValue, error) {
+	reply := <-c.db.ReverseScan(&storage.ReverseScanRequest{
+		StartKey:   start,
+		EndKey:     end,
+		MaxResults: max,
+	})
+	return reply.Rows, reply.Error
+}
+
+// RunTransaction runs retryable in a transaction, which is committed
+// if retryable returns nil. All requests sent via the KV supplied to
+// retryable are part of the transaction. Transactions which conflict
+// with others are retried with backoff, so retryable must be
+// idempotent. See kv.RunTransaction for details.
+func (c *KV) RunTransaction(opts *kv.TransactionOptions, retryable func(txn *KV) error) error {
+	return kv.RunTransaction(c.db, c.clock, opts, func(db kv.DB) error {
+		return retryable(&KV{db: db, clock: c.clock})
+	})
+}
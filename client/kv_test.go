@@ -0,0 +1,160 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/hlc"
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+var (
+	testServer *httptest.Server
+	once       sync.Once
+	keySeq     int64 // Distinguishes the prefixes of testPrefix
+)
+
+// startServer starts an HTTP server for Go clients backed by a local
+// range spanning the entire keyspace and returns its URL.
+func startServer() string {
+	once.Do(func() {
+		meta := storage.RangeMetadata{
+			RangeID:  1,
+			StartKey: storage.KeyMin,
+			EndKey:   storage.KeyMax,
+		}
+		rng := storage.NewRange(meta, hlc.NewHLClock(hlc.UnixNano), storage.NewInMem(storage.Attributes{}, 1<<30), nil, nil, nil)
+		rng.Start()
+		mux := http.NewServeMux()
+		mux.Handle(kv.DBPrefix, kv.NewDBServer(kv.NewLocalDB(rng)))
+		testServer = httptest.NewServer(mux)
+	})
+	return testServer.URL
+}
+
+// testPrefix returns a key prefix named name which is unique to this
+// run of the test, so that reruns (e.g. with -count) don't find the
+// state left in the shared server by earlier runs. No other prefix
+// returned by testPrefix begins with it.
+func testPrefix(name string) storage.Key {
+	return storage.Key(fmt.Sprintf("%s-%d/", name, atomic.AddInt64(&keySeq, 1)))
+}
+
+// TestKVOperations verifies each of the synchronous KV operations.
+func TestKVOperations(t *testing.T) {
+	db := NewKV(NewHTTPDB(startServer(), nil))
+
+	if err := db.Put(storage.Key("ops-a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get(storage.Key("ops-a")); err != nil || !bytes.Equal(v, []byte("1")) {
+		t.Errorf("expected \"1\"; got %q, %v", v, err)
+	}
+	if v, err := db.Get(storage.Key("ops-missing")); err != nil || v != nil {
+		t.Errorf("expected no value; got %q, %v", v, err)
+	}
+
+	// Conditional puts succeed only if the expected value matches.
+	if err := db.ConditionalPut(storage.Key("ops-a"), []byte("2"), []byte("1")); err != nil {
+		t.Error(err)
+	}
+	if err := db.ConditionalPut(storage.Key("ops-a"), []byte("3"), []byte("1")); err == nil {
+		t.Error("expected condition failure")
+	} else if _, ok := err.(*storage.ConditionFailedError); !ok {
+		t.Errorf("expected condition failed error; got %v", err)
+	}
+	if err := db.ConditionalPut(storage.Key("ops-b"), []byte("b"), nil); err != nil {
+		t.Error(err)
+	}
+
+	for i, inc := range []int64{5, -2} {
+		expected := []int64{5, 3}[i]
+		if val, err := db.Increment(storage.Key("ops-c"), inc); err != nil || val != expected {
+			t.Errorf("%d: expected %d; got %d, %v", i, expected, val, err)
+		}
+	}
+
+	rows, err := db.Scan(storage.Key("ops-"), storage.Key("ops-z"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || !bytes.Equal(rows[0].Key, storage.Key("ops-a")) ||
+		!bytes.Equal(rows[2].Key, storage.Key("ops-c")) {
+		t.Errorf("unexpected scan result: %v", rows)
+	}
+	rows, err = db.ReverseScan(storage.Key("ops-"), storage.Key("ops-c"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || !bytes.Equal(rows[0].Key, storage.Key("ops-b")) {
+		t.Errorf("unexpected reverse scan result: %v", rows)
+	}
+
+	if err := db.Delete(storage.Key("ops-a")); err != nil {
+		t.Error(err)
+	}
+	if n, err := db.DeleteRange(storage.Key("ops-"), storage.Key("ops-z"), 0); err != nil || n != 2 {
+		t.Errorf("expected 2 deletions; got %d, %v", n, err)
+	}
+	if rows, err := db.Scan(storage.Key("ops-"), storage.Key("ops-z"), 10); err != nil || len(rows) != 0 {
+		t.Errorf("expected no rows; got %v, %v", rows, err)
+	}
+}
+
+// TestKVRunTransaction verifies that the writes of a committed
+// transaction are visible and those of an aborted one aren't.
+func TestKVRunTransaction(t *testing.T) {
+	db := NewKV(NewHTTPDB(startServer(), nil))
+	if err := db.Put(storage.Key("txn-a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	err := db.RunTransaction(&kv.TransactionOptions{}, func(txn *KV) error {
+		v, err := txn.Get(storage.Key("txn-a"))
+		if err != nil {
+			return err
+		}
+		return txn.Put(storage.Key("txn-b"), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get(storage.Key("txn-b")); err != nil || !bytes.Equal(v, []byte("a")) {
+		t.Errorf("expected committed value; got %q, %v", v, err)
+	}
+
+	abortErr := util.Errorf("abort")
+	err = db.RunTransaction(&kv.TransactionOptions{}, func(txn *KV) error {
+		if err := txn.Put(storage.Key("txn-c"), []byte("c")); err != nil {
+			return err
+		}
+		return abortErr
+	})
+	if err != abortErr {
+		t.Errorf("expected %v; got %v", abortErr, err)
+	}
+	if v, err := db.Get(storage.Key("txn-c")); err != nil || v != nil {
+		t.Errorf("expected no value for aborted write; got %q, %v", v, err)
+	}
+}
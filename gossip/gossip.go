@@ -37,11 +37,16 @@ the system with minimal total hops. The algorithm is as follows:
       received in maxWaitForNewGossip, client is closed. If node has no
       outgoing connections, goto #1.
 
-   b. If any gossip was received at > maxToleratedHops and num
-      connected peers < maxPeers, choose random peer from those
-      originating info > maxToleratedHops, start it, and goto #2.
+   b. If any gossip was received at > maxToleratedHops, or older than
+      maxToleratedLatency, and num connected peers < maxPeers, choose
+      random peer from those originating such info, start it, and
+      goto #2. If num connected peers >= maxPeers, close the least
+      useful peer instead.
 
-   c. If sentinelGossip is missing or expired, node is considered
+   c. While num incoming and outgoing connections > maxConns, close
+      the least useful outgoing peer.
+
+   d. If sentinelGossip is missing or expired, node is considered
       partitioned; goto #1.
 
  3 On connect, if node has too many connected clients, gossip requests
@@ -59,13 +64,14 @@ import (
 	"flag"
 	"math"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/cockroachdb/cockroach/rpc"
 	"github.com/cockroachdb/cockroach/util"
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 var (
@@ -79,6 +85,12 @@ var (
 	GossipInterval = flag.Duration(
 		"gossip_interval", 2*time.Second,
 		"approximate interval (time.Duration) for gossiping new information to peers")
+	// GossipMaxConns caps the number of incoming and outgoing gossip
+	// connections of a node by default (see SetMaxConns). The least
+	// useful outgoing clients are closed to stay within the cap.
+	GossipMaxConns = flag.Int(
+		"gossip_max_conns", 2*MaxPeers,
+		"maximum number of incoming and outgoing gossip connections per node")
 )
 
 const (
@@ -108,6 +120,7 @@ type Gossip struct {
 	hasConnected bool               // Set first time network is connected
 	isBootstrap  bool               // True if this node is a bootstrap host
 	*server                         // Embedded gossip RPC server
+	maxConns     int                // Cap on incoming and outgoing connections
 	bootstraps   *addrSet           // Bootstrap host addresses
 	outgoing     *addrSet           // Set of outgoing client addresses
 	clientsMu    sync.Mutex         // Mutex protects the clients map
@@ -115,6 +128,7 @@ type Gossip struct {
 	disconnected chan *client       // Channel of disconnected clients
 	exited       chan error         // Channel to signal exit
 	stalled      *sync.Cond         // Indicates bootstrap is required
+	stopper      *util.Stopper      // Stops the initialization check
 }
 
 // New creates an instance of a gossip node.
@@ -122,10 +136,13 @@ func New() *Gossip {
 	g := &Gossip{
 		Connected:    make(chan struct{}),
 		server:       newServer(*GossipInterval),
+		maxConns:     *GossipMaxConns,
 		bootstraps:   newAddrSet(MaxPeers),
 		outgoing:     newAddrSet(MaxPeers),
 		clients:      map[string]*client{},
 		disconnected: make(chan *client, MaxPeers),
+		exited:       make(chan error, 1),
+		stopper:      util.NewStopper(),
 	}
 	g.stalled = sync.NewCond(&g.mu)
 	return g
@@ -149,6 +166,14 @@ func (g *Gossip) SetInterval(interval time.Duration) {
 	g.interval = interval
 }
 
+// SetMaxConns sets the cap on the node's incoming and outgoing gossip
+// connections.
+func (g *Gossip) SetMaxConns(maxConns int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.maxConns = maxConns
+}
+
 // AddInfo adds or updates an info object. Returns an error if info
 // couldn't be added.
 func (g *Gossip) AddInfo(key string, val interface{}, ttl time.Duration) error {
@@ -172,6 +197,16 @@ func (g *Gossip) GetInfo(key string) (interface{}, error) {
 	return nil, util.Errorf("key %q does not exist or has expired", key)
 }
 
+// RegisterCallback registers method to be invoked whenever the info
+// at key is added or updated, locally or by gossip from a peer, and
+// once upon registration if the info exists. Callbacks run in their
+// own goroutines and should fetch the current value via GetInfo.
+func (g *Gossip) RegisterCallback(key string, method Callback) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.is.registerCallback(key, method)
+}
+
 // GetGroupInfos returns a slice of info values from specified group,
 // or an error if group is not registered.
 func (g *Gossip) GetGroupInfos(prefix string) ([]interface{}, error) {
@@ -188,6 +223,22 @@ func (g *Gossip) GetGroupInfos(prefix string) ([]interface{}, error) {
 	return values, nil
 }
 
+// GetGroupPrefixes returns the prefixes of all registered groups
+// which begin with prefix. Groups registered by other nodes are
+// included once they've been gossiped to this node.
+func (g *Gossip) GetGroupPrefixes(prefix string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var prefixes []string
+	for groupPrefix := range g.is.Groups {
+		if strings.HasPrefix(groupPrefix, prefix) {
+			prefixes = append(prefixes, groupPrefix)
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
 // RegisterGroup registers a new group with info store. Returns an
 // error if the group was already registered.
 func (g *Gossip) RegisterGroup(prefix string, limit int, typeOf GroupType) error {
@@ -234,7 +285,7 @@ func (g *Gossip) Start(rpcServer *rpc.Server) {
 	g.server.start(rpcServer) // serve gossip protocol
 	go g.bootstrap()          // bootstrap gossip client
 	go g.manage()             // manage gossip clients
-	go g.maybeWarnAboutInit()
+	g.stopper.RunWorker(g.maybeWarnAboutInit)
 }
 
 // Stop shuts down the gossip server. Returns a channel which signals
@@ -243,6 +294,7 @@ func (g *Gossip) Start(rpcServer *rpc.Server) {
 func (g *Gossip) Stop() <-chan error {
 	// Set server's closed boolean and exit server.
 	g.stop()
+	g.stopper.Stop()
 	// Wake up bootstrap goroutine so it can exit.
 	g.stalled.Signal()
 	// Close all outgoing clients.
@@ -265,6 +317,48 @@ func (g *Gossip) maxToleratedHops() uint32 {
 	return uint32(math.Ceil(math.Log(float64(nodeCount))/math.Log(float64(MaxPeers))))*2 + 1
 }
 
+// maxToleratedLatency computes the maximum age, in nanoseconds, at
+// which infos should arrive when the gossip network is optimally
+// configured: roughly a gossip interval per tolerated hop.
+func (g *Gossip) maxToleratedLatency() int64 {
+	return int64(g.maxToleratedHops()) * int64(g.interval)
+}
+
+// clientCount returns the number of outgoing clients which haven't
+// been closed, though they may still be connecting.
+func (g *Gossip) clientCount() int {
+	g.clientsMu.Lock()
+	defer g.clientsMu.Unlock()
+	return len(g.clients)
+}
+
+// hasClientSpace returns whether another outgoing client may be
+// started within the caps on peers and connections. The caller must
+// hold g.mu.
+func (g *Gossip) hasClientSpace() bool {
+	clients := g.clientCount()
+	return clients < MaxPeers && clients+g.incoming.len() < g.maxConns
+}
+
+// cullClients closes the least useful outgoing clients while the
+// node's connections exceed the cap. The caller must hold g.mu.
+func (g *Gossip) cullClients() {
+	for excess := g.clientCount() + g.incoming.len() - g.maxConns; excess > 0; excess-- {
+		open := g.outgoing.filter(func(a net.Addr) bool {
+			g.clientsMu.Lock()
+			defer g.clientsMu.Unlock()
+			_, ok := g.clients[a.String()]
+			return ok
+		})
+		addr := g.is.leastUseful(open)
+		if addr == nil {
+			return
+		}
+		log.New("gossip").Infof("closing least useful client %+v to stay within %d connections", addr, g.maxConns)
+		g.closeClient(addr)
+	}
+}
+
 // hasIncoming returns whether the server has an incoming gossip
 // client matching the provided address.
 func (g *Gossip) hasIncoming(addr net.Addr) bool {
@@ -284,7 +378,7 @@ func (g *Gossip) parseBootstrapAddresses() {
 			addr = strings.TrimSpace(addr)
 			tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
 			if err != nil {
-				glog.Errorf("invalid gossip bootstrap address %s: %s", addr, err)
+				log.New("gossip").Errorf("invalid gossip bootstrap address %s: %s", addr, err)
 				continue
 			}
 			g.bootstraps.addAddr(tcpAddr)
@@ -292,7 +386,7 @@ func (g *Gossip) parseBootstrapAddresses() {
 	}
 	// If we have no bootstrap hosts, fatal exit.
 	if g.bootstraps.len() == 0 {
-		glog.Fatalf("no hosts specified for gossip network (use -gossip)")
+		log.New("gossip").Fatalf("no hosts specified for gossip network (use -gossip)")
 	}
 	// Remove our own node address.
 	if g.bootstraps.hasAddr(g.is.NodeAddr) {
@@ -317,15 +411,26 @@ func (g *Gossip) filterExtant(addrs *addrSet) *addrSet {
 // sentinel gossip info is not available. After a successful bootstrap
 // connection, this method will block on the stalled condvar, which
 // receives notifications that gossip network connectivity has been
-// lost and requires re-bootstrapping.
+// lost and requires re-bootstrapping. Bootstrap attempts are retried
+// at most once per gossip interval, until gossip is stopped.
 //
 // This method will block and should be run via goroutine.
 func (g *Gossip) bootstrap() {
 	g.parseBootstrapAddresses()
-	for {
+	g.mu.Lock()
+	retryOpts := util.RetryOptions{
+		Tag:        "gossip bootstrap",
+		Backoff:    g.interval,
+		MaxBackoff: g.interval,
+		Constant:   1,
+		Stopper:    g.stopper,
+	}
+	g.mu.Unlock()
+	util.RetryWithBackoff(retryOpts, func() (bool, error) {
 		g.mu.Lock()
+		defer g.mu.Unlock()
 		if g.closed {
-			break
+			return true, nil
 		}
 		// Find list of available bootstrap hosts.
 		avail := g.filterExtant(g.bootstraps)
@@ -336,15 +441,15 @@ func (g *Gossip) bootstrap() {
 			if !haveClients || !haveSentinel {
 				// Select a bootstrap address at random and start client.
 				addr := avail.selectRandom()
-				glog.Infof("bootstrapping gossip protocol using host %+v", addr)
+				log.New("gossip").Infof("bootstrapping gossip protocol using host %+v", addr)
 				g.startClient(addr)
 			}
 		}
 
 		// Block until we need bootstrapping again.
 		g.stalled.Wait()
-		g.mu.Unlock()
-	}
+		return g.closed, nil
+	})
 }
 
 // manage manages outgoing clients. Periodically, the infostore is
@@ -365,7 +470,7 @@ func (g *Gossip) manage() {
 		case c := <-g.disconnected:
 			g.mu.Lock()
 			if c.err != nil {
-				glog.Infof("client disconnected: %s", c.err)
+				log.New("gossip").Infof("client disconnected: %s", c.err)
 			}
 			g.outgoing.removeAddr(c.addr)
 
@@ -381,11 +486,11 @@ func (g *Gossip) manage() {
 		case <-checkTimeout:
 			g.mu.Lock()
 			// Check whether the graph needs to be tightened to
-			// accommodate distant infos.
-			distant := g.filterExtant(g.is.distant(g.maxToleratedHops()))
+			// accommodate distant or stale infos.
+			distant := g.filterExtant(g.is.distant(g.maxToleratedHops(), g.maxToleratedLatency()))
 			if distant.len() > 0 {
 				// If we have space, start a client immediately.
-				if g.outgoing.len() < MaxPeers {
+				if g.hasClientSpace() {
 					g.startClient(distant.selectRandom())
 				} else {
 					// Otherwise, find least useful peer and close it. Make sure
@@ -393,11 +498,12 @@ func (g *Gossip) manage() {
 					// connected.
 					addr := g.is.leastUseful(g.outgoing)
 					if addr != nil {
-						glog.Infof("closing least useful client %+v to tighten network graph", addr)
+						log.New("gossip").Infof("closing least useful client %+v to tighten network graph", addr)
 						g.closeClient(addr)
 					}
 				}
 			}
+			g.cullClients()
 		}
 
 		// If there are no outgoing hosts or sentinel gossip is missing,
@@ -406,16 +512,17 @@ func (g *Gossip) manage() {
 		hasSentinel := g.is.getInfo(KeySentinel) != nil
 		if g.filterExtant(g.bootstraps).len() > 0 {
 			if g.outgoing.len()+g.incoming.len() == 0 {
-				glog.Infof("no connections; signaling bootstrap")
+				log.New("gossip").Infof("no connections; signaling bootstrap")
 				g.stalled.Signal()
 			} else if !hasSentinel {
-				glog.Warningf("missing sentinel gossip %s; assuming partition and reconnecting", KeySentinel)
+				log.New("gossip").Warningf("missing sentinel gossip %s; assuming partition and reconnecting", KeySentinel)
 				g.stalled.Signal()
 			}
 		}
 
 		// The exit condition.
 		if g.closed && g.outgoing.len() == 0 {
+			g.mu.Unlock()
 			break
 		}
 		g.mu.Unlock()
@@ -436,13 +543,18 @@ func (g *Gossip) manage() {
 // connected, and whether the node itself is a bootstrap host, but
 // there is still no sentinel gossip.
 func (g *Gossip) maybeWarnAboutInit() {
-	time.Sleep(5 * time.Second)
+	select {
+	case <-time.After(5 * time.Second):
+	case <-g.stopper.ShouldStop():
+		return
+	}
 	retryOptions := util.RetryOptions{
 		Tag:         "check cluster initialization",
 		Backoff:     5 * time.Second,  // first backoff at 5s
 		MaxBackoff:  60 * time.Second, // max backoff is 60s
 		Constant:    2,                // doubles
 		MaxAttempts: 0,                // indefinite retries
+		Stopper:     g.stopper,        // until gossip is stopped
 	}
 	util.RetryWithBackoff(retryOptions, func() (bool, error) {
 		g.mu.Lock()
@@ -456,7 +568,7 @@ func (g *Gossip) maybeWarnAboutInit() {
 		// Otherwise, if all bootstrap hosts are connected and this
 		// node is a bootstrap host, warn.
 		if allConnected && g.isBootstrap {
-			glog.Warningf("connected to gossip but missing sentinel. Has the cluster been initialized? " +
+			log.New("gossip").Warningf("connected to gossip but missing sentinel. Has the cluster been initialized? " +
 				"Use \"cockroach init\" to initialize.")
 		}
 		return false, nil
@@ -19,9 +19,13 @@ package gossip
 
 import (
 	"fmt"
+	"net"
+	"reflect"
 	"testing"
 	"time"
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 const (
@@ -36,7 +40,7 @@ func isNetworkConnected(nodes map[string]*Gossip) bool {
 		for infoKey := range nodes {
 			_, err := node.GetInfo(infoKey)
 			if err != nil {
-				glog.Infof("error: %v", err)
+				log.New("gossip").Infof("error: %v", err)
 				return false
 			}
 		}
@@ -97,6 +101,128 @@ func TestGossipInfoStore(t *testing.T) {
 	}
 }
 
+// TestGossipCallbacks verifies that callbacks are invoked upon
+// registration for existing infos and on each update, and that they
+// report whether the info's contents changed.
+func TestGossipCallbacks(t *testing.T) {
+	g := New()
+	g.AddInfo("a", int64(1), time.Hour)
+	type update struct {
+		key     string
+		changed bool
+	}
+	updates := make(chan update, 10)
+	callback := func(key string, contentsChanged bool) {
+		updates <- update{key, contentsChanged}
+	}
+	g.RegisterCallback("a", callback)
+	g.RegisterCallback("b", callback)
+
+	expect := func(expected update) {
+		select {
+		case u := <-updates:
+			if u != expected {
+				t.Errorf("expected update %+v; got %+v", expected, u)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for update %+v", expected)
+		}
+	}
+	expect(update{"a", true})
+	g.AddInfo("a", int64(1), time.Hour)
+	expect(update{"a", false})
+	g.AddInfo("b", int64(2), time.Hour)
+	expect(update{"b", true})
+	g.AddInfo("c", int64(3), time.Hour)
+	select {
+	case u := <-updates:
+		t.Errorf("unexpected update %+v", u)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// TestGossipStop verifies that a gossip instance signals its exit
+// when stopped and that infos can still be read from it afterwards.
+func TestGossipStop(t *testing.T) {
+	s := rpc.NewServer(util.CreateTestAddr("tcp"))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	g := New()
+	g.SetBootstrap([]net.Addr{s.Addr()})
+	g.Start(s)
+	g.AddInfo("i", int64(1), time.Hour)
+	select {
+	case <-g.Stop():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for gossip instance to exit")
+	}
+
+	// Give the bootstrap goroutine time to notice it was stopped.
+	for i := 0; i < 10; i++ {
+		done := make(chan struct{})
+		go func() {
+			g.GetInfo("i")
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("timed out reading info from stopped gossip instance")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestGossipCullClients verifies that the least useful outgoing
+// clients are closed while a node's connections exceed the cap.
+func TestGossipCullClients(t *testing.T) {
+	g := New()
+	g.SetMaxConns(2)
+	addrs := []testAddr{"<addr1>", "<addr2>", "<addr3>"}
+	for i, addr := range addrs {
+		g.outgoing.addAddr(addr)
+		g.clients[addr.String()] = newClient(addr)
+		// Peer i has passed us i+1 infos.
+		for j := 0; j <= i; j++ {
+			inf := g.is.newInfo(fmt.Sprintf("%d-%d", i, j), int64(j), time.Hour)
+			inf.peerAddr = addr
+			g.is.addInfo(inf)
+		}
+	}
+	g.incoming.addAddr(testAddr("<incoming>"))
+	if g.hasClientSpace() {
+		t.Error("expected no space for another client")
+	}
+
+	g.mu.Lock()
+	g.cullClients()
+	g.mu.Unlock()
+	if count := g.clientCount(); count != 1 {
+		t.Fatalf("expected 1 remaining client; got %d", count)
+	}
+	if _, ok := g.clients[addrs[2].String()]; !ok {
+		t.Errorf("expected most useful client %s to remain", addrs[2])
+	}
+}
+
+// TestGossipGroupPrefixes verifies that registered groups are
+// listed by prefix.
+func TestGossipGroupPrefixes(t *testing.T) {
+	g := New()
+	for _, prefix := range []string{"cap-b", "cap-a", "other"} {
+		g.RegisterGroup(prefix, 3, MaxGroup)
+	}
+	prefixes := g.GetGroupPrefixes("cap-")
+	if !reflect.DeepEqual(prefixes, []string{"cap-a", "cap-b"}) {
+		t.Errorf("expected [cap-a cap-b]; got %v", prefixes)
+	}
+	if prefixes := g.GetGroupPrefixes("none"); len(prefixes) != 0 {
+		t.Errorf("expected no prefixes; got %v", prefixes)
+	}
+}
+
 // TestGossipGroupsInfoStore verifies gossiping of groups via the
 // gossip instance infostore.
 func TestGossipGroupsInfoStore(t *testing.T) {
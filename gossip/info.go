@@ -22,7 +22,7 @@ import (
 	"strings"
 
 	"github.com/cockroachdb/cockroach/util"
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 // info is the basic unit of information traded over the gossip
@@ -39,6 +39,7 @@ type info struct {
 	NodeAddr  net.Addr // Originating node in "host:port" format
 	peerAddr  net.Addr // Proximate peer which passed us the info
 	seq       int64    // Sequence number for incremental updates
+	latency   int64    // Age on arrival from peerAddr (nanos); zero if local
 }
 
 // infoPrefix returns the text preceding the last period within
@@ -64,7 +65,7 @@ func (i *info) less(b *info) bool {
 		if ord, ok := i.Val.(util.Ordered); ok {
 			return ord.Less(b.Val.(util.Ordered))
 		}
-		glog.Fatalf("unhandled info value type: %s", t)
+		log.New("gossip").Fatalf("unhandled info value type: %s", t)
 	}
 	return false
 }
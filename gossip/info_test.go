@@ -54,16 +54,16 @@ func TestPrefix(t *testing.T) {
 
 func TestSort(t *testing.T) {
 	infos := infoSlice{
-		{"a", 3.0, 0, 0, 0, emptyAddr, emptyAddr, 0},
-		{"b", 1.0, 0, 0, 0, emptyAddr, emptyAddr, 0},
-		{"c", 2.1, 0, 0, 0, emptyAddr, emptyAddr, 0},
-		{"d", 2.0, 0, 0, 0, emptyAddr, emptyAddr, 0},
-		{"e", -1.0, 0, 0, 0, emptyAddr, emptyAddr, 0},
+		{Key: "a", Val: 3.0, NodeAddr: emptyAddr, peerAddr: emptyAddr},
+		{Key: "b", Val: 1.0, NodeAddr: emptyAddr, peerAddr: emptyAddr},
+		{Key: "c", Val: 2.1, NodeAddr: emptyAddr, peerAddr: emptyAddr},
+		{Key: "d", Val: 2.0, NodeAddr: emptyAddr, peerAddr: emptyAddr},
+		{Key: "e", Val: -1.0, NodeAddr: emptyAddr, peerAddr: emptyAddr},
 	}
 
 	// Verify forward sort.
 	sort.Sort(infos)
-	last := &info{"last", -math.MaxFloat64, 0, 0, 0, emptyAddr, emptyAddr, 0}
+	last := &info{Key: "last", Val: -math.MaxFloat64, NodeAddr: emptyAddr, peerAddr: emptyAddr}
 	for _, i := range infos {
 		if i.less(last) {
 			t.Errorf("info val %v not increasing", i.Val)
@@ -73,7 +73,7 @@ func TestSort(t *testing.T) {
 
 	// Verify reverse sort.
 	sort.Sort(sort.Reverse(infos))
-	last = &info{"last", math.MaxFloat64, 0, 0, 0, emptyAddr, emptyAddr, 0}
+	last = &info{Key: "last", Val: math.MaxFloat64, NodeAddr: emptyAddr, peerAddr: emptyAddr}
 	for _, i := range infos {
 		if !i.less(last) {
 			t.Errorf("info val %v not decreasing", i.Val)
@@ -84,7 +84,7 @@ func TestSort(t *testing.T) {
 
 func TestExpired(t *testing.T) {
 	now := time.Now().UnixNano()
-	i := info{"a", float64(1), now, now + int64(time.Millisecond), 0, emptyAddr, emptyAddr, 0}
+	i := info{Key: "a", Val: float64(1), Timestamp: now, TTLStamp: now + int64(time.Millisecond), NodeAddr: emptyAddr, peerAddr: emptyAddr}
 	if i.expired(now) {
 		t.Error("premature expiration")
 	}
@@ -99,7 +99,7 @@ func TestIsFresh(t *testing.T) {
 	addr1 := testAddr("<test-addr1>")
 	addr2 := testAddr("<test-addr2>")
 	addr3 := testAddr("<test-addr3>")
-	i := info{"a", float64(1), now, now + int64(time.Millisecond), 0, addr1, addr2, seq}
+	i := info{Key: "a", Val: float64(1), Timestamp: now, TTLStamp: now + int64(time.Millisecond), NodeAddr: addr1, peerAddr: addr2, seq: seq}
 	if !i.isFresh(addr3, seq-1) {
 		t.Error("info should be fresh:", i)
 	}
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"math"
 	"net"
+	"reflect"
 	"sync"
 	"time"
 
@@ -39,13 +40,19 @@ import (
 //
 // infoStores are not thread safe.
 type infoStore struct {
-	Infos    infoMap  // Map from key to info
-	Groups   groupMap // Map from key prefix to groups of infos
-	NodeAddr net.Addr // Address of node owning this info store: "host:port"
-	MaxSeq   int64    // Maximum sequence number inserted
-	seqGen   int64    // Sequence generator incremented each time info is added
+	Infos     infoMap               // Map from key to info
+	Groups    groupMap              // Map from key prefix to groups of infos
+	NodeAddr  net.Addr              // Address of node owning this info store: "host:port"
+	MaxSeq    int64                 // Maximum sequence number inserted
+	seqGen    int64                 // Sequence generator incremented each time info is added
+	callbacks map[string][]Callback // Callbacks by info key; see registerCallback
 }
 
+// Callback is a method invoked when the info at key is added or
+// updated. contentsChanged is false if the info's value is unchanged,
+// as when an info is re-gossiped before it expires.
+type Callback func(key string, contentsChanged bool)
+
 // monotonicUnixNano returns a monotonically increasing value for
 // nanoseconds in Unix time. Since equal times are ignored with
 // updates to infos, we're careful to avoid incorrectly ignoring a
@@ -107,9 +114,10 @@ var (
 // in "host:port" format.
 func newInfoStore(nodeAddr net.Addr) *infoStore {
 	return &infoStore{
-		Infos:    infoMap{},
-		Groups:   groupMap{},
-		NodeAddr: nodeAddr,
+		Infos:     infoMap{},
+		Groups:    groupMap{},
+		NodeAddr:  nodeAddr,
+		callbacks: map[string][]Callback{},
 	}
 }
 
@@ -195,7 +203,8 @@ func (is *infoStore) addInfo(i *info) error {
 	}
 	// Only replace an existing info if new timestamp is greater, or if
 	// timestamps are equal, but new hops is smaller.
-	if existingInfo, ok := is.Infos[i.Key]; ok {
+	existingInfo, ok := is.Infos[i.Key]
+	if ok {
 		if i.Timestamp < existingInfo.Timestamp ||
 			(i.Timestamp == existingInfo.Timestamp && i.Hops >= existingInfo.Hops) {
 			return util.Errorf("info %+v older than current group info %+v", i, existingInfo)
@@ -206,9 +215,27 @@ func (is *infoStore) addInfo(i *info) error {
 	if i.seq > is.MaxSeq {
 		is.MaxSeq = i.seq
 	}
+	contentsChanged := !ok || !reflect.DeepEqual(existingInfo.Val, i.Val)
+	for _, method := range is.callbacks[i.Key] {
+		go method(i.Key, contentsChanged)
+	}
 	return nil
 }
 
+// registerCallback registers method to be invoked whenever the
+// non-group info at key is added or updated, whether locally or by
+// combining a delta from a peer. If the info already exists, method
+// is also invoked once upon registration. Callbacks are invoked in
+// their own goroutines, so they may access the info store's owner;
+// as such, they may run out of order and should fetch the info's
+// current value rather than assume the order of updates.
+func (is *infoStore) registerCallback(key string, method Callback) {
+	is.callbacks[key] = append(is.callbacks[key], method)
+	if is.getInfo(key) != nil {
+		go method(key, true)
+	}
+}
+
 // infoCount returns the count of infos stored in groups and the
 // non-group infos map. This is really just an approximation as
 // we don't check whether infos are expired.
@@ -280,9 +307,11 @@ func (is *infoStore) visitInfos(visitGroup func(*group) error, visitInfo func(*i
 // combine combines an incremental delta with the current infoStore.
 // The sequence numbers on all info objects are reset using the info
 // store's sequence generator. All hop distances on infos are
-// incremented to indicate they've arrived from an external source.
+// incremented to indicate they've arrived from an external source,
+// and the infos' latencies are set to their age on arrival.
 // Returns the count of "fresh" infos in the provided delta.
 func (is *infoStore) combine(delta *infoStore) int {
+	now := time.Now().UnixNano()
 	// combine group info. If the group doesn't yet exist, register
 	// it. Extract the infos from the group and combine them
 	// one-by-one using addInfo.
@@ -299,6 +328,11 @@ func (is *infoStore) combine(delta *infoStore) int {
 		i.seq = is.seqGen
 		i.Hops++
 		i.peerAddr = delta.NodeAddr
+		// Clocks of the originator which are ahead of ours don't make
+		// infos fresher than local ones.
+		if i.latency = now - i.Timestamp; i.latency < 0 {
+			i.latency = 0
+		}
 		if is.addInfo(i) == nil {
 			freshCount++
 		}
@@ -337,11 +371,12 @@ func (is *infoStore) delta(addr net.Addr, seq int64) *infoStore {
 }
 
 // distant returns an addrSet of node addresses for gossip peers which
-// originated infos with info.Hops > maxHops.
-func (is *infoStore) distant(maxHops uint32) *addrSet {
+// originated infos with info.Hops > maxHops, or which arrived staler
+// than maxLatency (nanos).
+func (is *infoStore) distant(maxHops uint32, maxLatency int64) *addrSet {
 	addrMap := make(map[string]net.Addr)
 	is.visitInfos(nil, func(i *info) error {
-		if i.Hops > maxHops {
+		if i.Hops > maxHops || i.latency > maxLatency {
 			addrMap[i.NodeAddr.String()] = i.NodeAddr
 		}
 		return nil
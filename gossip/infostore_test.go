@@ -427,13 +427,46 @@ func TestInfoStoreDistant(t *testing.T) {
 	}
 
 	for i := 0; i < len(addrs); i++ {
-		addrs := is.distant(uint32(i))
+		addrs := is.distant(uint32(i), math.MaxInt64)
 		if addrs.len() != 3-i {
 			t.Errorf("%d addresses (not %d) should be over maxHops = %d", 3-i, addrs.len(), i)
 		}
 	}
 }
 
+// TestInfoStoreStale verifies that combined infos record their age
+// on arrival and that originators of infos which arrived staler than
+// maxLatency are selected as distant.
+func TestInfoStoreStale(t *testing.T) {
+	addrs := []testAddr{
+		"<addr1>",
+		"<addr2>",
+	}
+	delta := newInfoStore(addrs[0])
+	// Infos originated a minute and a millisecond ago, at one hop.
+	for i, age := range []time.Duration{time.Minute, time.Millisecond} {
+		inf := delta.newInfo(fmt.Sprintf("b.%d", i), float64(i), time.Hour)
+		inf.Timestamp -= int64(age)
+		inf.NodeAddr = addrs[i]
+		delta.addInfo(inf)
+	}
+	is := newInfoStore(emptyAddr)
+	if fresh := is.combine(delta); fresh != 2 {
+		t.Fatalf("expected 2 fresh infos; got %d", fresh)
+	}
+	if latency := is.getInfo("b.0").latency; latency < int64(time.Minute) {
+		t.Errorf("expected latency of at least a minute; got %s", time.Duration(latency))
+	}
+
+	stale := is.distant(math.MaxUint32, int64(time.Second))
+	if stale.len() != 1 || !stale.hasAddr(addrs[0]) {
+		t.Errorf("expected only %s to be stale; got %v", addrs[0], stale.asSlice())
+	}
+	if stale := is.distant(math.MaxUint32, int64(time.Hour)); stale.len() != 0 {
+		t.Errorf("expected no stale infos within an hour; got %v", stale.asSlice())
+	}
+}
+
 // TestLeastUseful verifies that the least-contributing peer address
 // can be determined.
 func TestLeastUseful(t *testing.T) {
@@ -21,6 +21,13 @@ import "strconv"
 
 // Constants for gossip keys.
 const (
+	// KeyAcctUsagePrefix is the key prefix for gossiping the usage of
+	// each store's ranges by accounting prefix. The suffix is "."
+	// followed by <hex node ID>-<hex store ID>, so that all records
+	// belong to a single gossip group. The value is a
+	// storage.StoreAcctUsage struct.
+	KeyAcctUsagePrefix = "acct-usage"
+
 	// KeyClusterID is the unique UUID for this Cockroach cluster.
 	// The value is a string UUID for the cluster.
 	KeyClusterID = "cluster-id"
@@ -36,7 +43,8 @@ const (
 
 	// KeyMaxAvailCapacityPrefix is the key prefix for gossiping available
 	// store capacity. The suffix is composed of:
-	// <datacenter>-<hex node ID>-<hex store ID>. The value is a
+	// <attributes>.<hex node ID>-<hex store ID>, where the store's
+	// sorted attributes name its gossip group. The value is a
 	// storage.StoreDescriptor struct.
 	KeyMaxAvailCapacityPrefix = "max-avail-capacity-"
 
@@ -46,6 +54,12 @@ const (
 	//   number of node ids being gossiped.
 	KeyNodeCount = "node-count"
 
+	// KeyNodeLivenessPrefix is the key prefix for gossiping node
+	// liveness records. The suffix is "." followed by the hexadecimal
+	// node ID, so that all records belong to a single gossip group.
+	// The value is a storage.NodeLiveness struct.
+	KeyNodeLivenessPrefix = "liveness"
+
 	// KeyNodeIDPrefix is the key prefix for gossiping node id
 	// addresses. The actual key is suffixed with the hexadecimal
 	// representation of the node id and the value is the host:port
@@ -58,11 +72,38 @@ const (
 
 	// KeyFirstRangeMetadata is the metadata for the "first" range. The
 	// "first" range contains the meta1 key range, the first level of
-	// the bi-level key addressing scheme. The value is a slice of
-	// storage.Replica structs.
+	// the bi-level key addressing scheme. The value is the range's
+	// storage.RangeDescriptor, gossipped by its raft leader.
 	KeyFirstRangeMetadata = "first-range"
 )
 
+// MakeAcctUsageKey returns the gossip key for the accounting usage
+// of the specified store.
+func MakeAcctUsageKey(nodeID, storeID int32) string {
+	return KeyAcctUsagePrefix + "." + strconv.FormatInt(int64(nodeID), 16) +
+		"-" + strconv.FormatInt(int64(storeID), 16)
+}
+
+// MakeMaxAvailCapacityGroup returns the gossip group prefix for the
+// capacities of stores with the specified sorted attributes.
+func MakeMaxAvailCapacityGroup(attrs string) string {
+	return KeyMaxAvailCapacityPrefix + attrs
+}
+
+// MakeMaxAvailCapacityKey returns the gossip key for the capacity of
+// the specified store. The key belongs to the group returned by
+// MakeMaxAvailCapacityGroup for the store's attributes.
+func MakeMaxAvailCapacityKey(attrs string, nodeID, storeID int32) string {
+	return MakeMaxAvailCapacityGroup(attrs) + "." + strconv.FormatInt(int64(nodeID), 16) +
+		"-" + strconv.FormatInt(int64(storeID), 16)
+}
+
+// MakeNodeLivenessKey returns the gossip key for the liveness record
+// of the specified node.
+func MakeNodeLivenessKey(nodeID int32) string {
+	return KeyNodeLivenessPrefix + "." + strconv.FormatInt(int64(nodeID), 16)
+}
+
 // MakeNodeIDGossipKey returns the gossip key for node ID info.
 func MakeNodeIDGossipKey(nodeID int32) string {
 	return KeyNodeIDPrefix + strconv.FormatInt(int64(nodeID), 16)
@@ -25,7 +25,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/rpc"
 	"github.com/cockroachdb/cockroach/util"
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 // init seeds the random number generator for non-determinism across
@@ -55,14 +55,14 @@ func init() {
 func SimulateNetwork(nodeCount int, network string, gossipInterval time.Duration,
 	simCallback func(cycle int, nodes map[string]*Gossip) bool) {
 
-	glog.Infof("simulating network with %d nodes", nodeCount)
+	log.New("gossip").Infof("simulating network with %d nodes", nodeCount)
 	servers := make([]*rpc.Server, nodeCount)
 	addrs := make([]net.Addr, nodeCount)
 	for i := 0; i < nodeCount; i++ {
 		addr := util.CreateTestAddr(network)
 		servers[i] = rpc.NewServer(addr)
 		if err := servers[i].Start(); err != nil {
-			glog.Fatal(err)
+			log.New("gossip").Fatalf("%v", err)
 		}
 		addrs[i] = servers[i].Addr()
 	}
@@ -23,6 +23,7 @@ package hlc
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cockroachdb/cockroach/util"
@@ -50,7 +51,13 @@ type HLTimestamp struct {
 // Less implements the util.Ordered interface, allowing
 // the comparison of timestamps.
 func (t HLTimestamp) Less(s HLTimestamp) bool {
-	return t.WallTime < s.WallTime && t.Logical < s.Logical
+	return t.WallTime < s.WallTime || (t.WallTime == s.WallTime && t.Logical < s.Logical)
+}
+
+// Next returns the timestamp with the next later logical clock
+// value. It's the smallest timestamp which sorts after t.
+func (t HLTimestamp) Next() HLTimestamp {
+	return HLTimestamp{WallTime: t.WallTime, Logical: t.Logical + 1}
 }
 
 // HLClock is a hybrid logical clock. Objects of this
@@ -86,6 +93,40 @@ func (m *ManualClock) UnixNano() int64 {
 	return int64(*m)
 }
 
+// SkewedClock is a physical clock which runs a configurable
+// offset ahead of (or, if negative, behind) an underlying
+// physical clock. It's used to simulate a node whose clock
+// is skewed relative to the rest of a cluster. The skew may
+// be changed while the clock is in use.
+type SkewedClock struct {
+	physicalClock func() int64
+	skew          int64 // Accessed atomically
+}
+
+// NewSkewedClock creates a clock reading the given physical
+// clock, initially without skew.
+func NewSkewedClock(physicalClock func() int64) *SkewedClock {
+	return &SkewedClock{physicalClock: physicalClock}
+}
+
+// SetSkew sets the offset of the clock from the underlying
+// physical clock.
+func (s *SkewedClock) SetSkew(skew time.Duration) {
+	atomic.StoreInt64(&s.skew, int64(skew))
+}
+
+// Skew returns the offset of the clock from the underlying
+// physical clock.
+func (s *SkewedClock) Skew() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.skew))
+}
+
+// UnixNano returns the underlying physical clock's timestamp
+// offset by the skew.
+func (s *SkewedClock) UnixNano() int64 {
+	return s.physicalClock() + atomic.LoadInt64(&s.skew)
+}
+
 // UnixNano returns the local machine's physical nanosecond
 // unix epoch timestamp as a convenience to create a HLC via
 // c := hlc.NewHLClock(hlc.UnixNano).
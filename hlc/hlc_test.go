@@ -119,6 +119,28 @@ func TestHLClock(t *testing.T) {
 	c.Now()
 }
 
+// TestHLTimestampLess verifies timestamps are ordered by wall time
+// and then by logical clock.
+func TestHLTimestampLess(t *testing.T) {
+	ordered := []HLTimestamp{
+		{WallTime: 0, Logical: 0},
+		{WallTime: 0, Logical: 1},
+		{WallTime: 1, Logical: 0},
+		{WallTime: 1, Logical: 5},
+		{WallTime: 2, Logical: 0},
+	}
+	for i := range ordered {
+		for j := range ordered {
+			if ordered[i].Less(ordered[j]) != (i < j) {
+				t.Errorf("expected %+v.Less(%+v) == %t", ordered[i], ordered[j], i < j)
+			}
+		}
+		if next := ordered[i].Next(); !ordered[i].Less(next) {
+			t.Errorf("expected %+v < %+v", ordered[i], next)
+		}
+	}
+}
+
 // TestSetMaxDrift ensures that checking received timestamps
 // for excessive drifts works correctly.
 func TestSetMaxDrift(t *testing.T) {
@@ -148,6 +170,64 @@ func TestSetMaxDrift(t *testing.T) {
 	}
 }
 
+// TestSkewedClock verifies that a skewed clock is offset from its
+// underlying physical clock and that hybrid clocks reading it
+// compensate for skew within the max drift, while rejecting
+// timestamps from clocks skewed beyond it.
+func TestSkewedClock(t *testing.T) {
+	var m ManualClock = 1000
+	skewed := NewSkewedClock(m.UnixNano)
+	if skewed.UnixNano() != 1000 || skewed.Skew() != 0 {
+		t.Fatalf("expected new skewed clock to read physical clock; got %d", skewed.UnixNano())
+	}
+	skewed.SetSkew(-100)
+	if skewed.UnixNano() != 900 || skewed.Skew() != -100 {
+		t.Fatalf("expected clock to run 100ns behind; got %d", skewed.UnixNano())
+	}
+
+	// The local clock reads the unskewed physical clock; the remote
+	// one runs ahead by the skew.
+	local := NewHLClock(m.UnixNano)
+	local.SetMaxDrift(50)
+	remote := NewHLClock(skewed.UnixNano)
+	testCases := []struct {
+		skew time.Duration
+		ok   bool
+	}{
+		{-100, true},
+		{0, true},
+		{50, true},
+		{51, false},
+		{1000, false},
+	}
+	for i, test := range testCases {
+		m++
+		skewed.SetSkew(test.skew)
+		before := local.Timestamp()
+		rt := remote.Now()
+		ts, err := local.Update(rt)
+		if !test.ok {
+			// The clock must fail safe, leaving its state unaltered.
+			if err == nil {
+				t.Errorf("%d: expected skew of %s to be rejected", i, test.skew)
+			}
+			if local.Timestamp() != before {
+				t.Errorf("%d: expected clock not to be altered; %+v != %+v", i, local.Timestamp(), before)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: unexpected error for skew of %s: %v", i, test.skew, err)
+			continue
+		}
+		// Events on the local clock must be ordered after the remote
+		// event, even though the local physical clock lags behind.
+		if !rt.Less(ts) || !rt.Less(local.Now()) {
+			t.Errorf("%d: expected local clock %+v to compensate for remote timestamp %+v", i, ts, rt)
+		}
+	}
+}
+
 // ExampleManualClock shows how a manual clock can be
 // used as a physical clock. This is useful for testing.
 func ExampleManualClock() {
@@ -21,15 +21,19 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"math/rand"
 	"net"
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/hlc"
 	"github.com/cockroachdb/cockroach/rpc"
 	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/util"
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/metrics"
 )
 
 // A DB interface provides asynchronous methods to access a key value store.
@@ -37,15 +41,25 @@ type DB interface {
 	Contains(args *storage.ContainsRequest) <-chan *storage.ContainsResponse
 	Get(args *storage.GetRequest) <-chan *storage.GetResponse
 	Put(args *storage.PutRequest) <-chan *storage.PutResponse
+	ConditionalPut(args *storage.ConditionalPutRequest) <-chan *storage.ConditionalPutResponse
 	Increment(args *storage.IncrementRequest) <-chan *storage.IncrementResponse
 	Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResponse
 	DeleteRange(args *storage.DeleteRangeRequest) <-chan *storage.DeleteRangeResponse
 	Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse
+	ReverseScan(args *storage.ReverseScanRequest) <-chan *storage.ReverseScanResponse
 	EndTransaction(args *storage.EndTransactionRequest) <-chan *storage.EndTransactionResponse
+	Batch(args *storage.BatchRequest) <-chan *storage.BatchResponse
+	AdminSplit(args *storage.AdminSplitRequest) <-chan *storage.AdminSplitResponse
+	AdminMerge(args *storage.AdminMergeRequest) <-chan *storage.AdminMergeResponse
 	AccumulateTS(args *storage.AccumulateTSRequest) <-chan *storage.AccumulateTSResponse
 	ReapQueue(args *storage.ReapQueueRequest) <-chan *storage.ReapQueueResponse
 	EnqueueUpdate(args *storage.EnqueueUpdateRequest) <-chan *storage.EnqueueUpdateResponse
 	EnqueueMessage(args *storage.EnqueueMessageRequest) <-chan *storage.EnqueueMessageResponse
+	InternalPushTxn(args *storage.InternalPushTxnRequest) <-chan *storage.InternalPushTxnResponse
+	InternalResolveIntent(args *storage.InternalResolveIntentRequest) <-chan *storage.InternalResolveIntentResponse
+	InternalHeartbeatTxn(args *storage.InternalHeartbeatTxnRequest) <-chan *storage.InternalHeartbeatTxnResponse
+	InternalSnapshot(args *storage.InternalSnapshotRequest) <-chan *storage.InternalSnapshotResponse
+	InternalChecksum(args *storage.InternalChecksumRequest) <-chan *storage.InternalChecksumResponse
 }
 
 // GetI fetches the value at the specified key and deserializes it
@@ -54,13 +68,13 @@ type DB interface {
 // value. The first result parameter is "ok": true if a value was
 // found for the requested key; false otherwise. An error is returned
 // on error fetching from underlying storage or deserializing value.
-func GetI(db DB, key storage.Key, value interface{}) (bool, int64, error) {
+func GetI(db DB, key storage.Key, value interface{}) (bool, hlc.HLTimestamp, error) {
 	gr := <-db.Get(&storage.GetRequest{Key: key})
 	if gr.Error != nil {
-		return false, 0, gr.Error
+		return false, hlc.HLTimestamp{}, gr.Error
 	}
 	if len(gr.Value.Bytes) == 0 {
-		return false, 0, nil
+		return false, hlc.HLTimestamp{}, nil
 	}
 	if err := gob.NewDecoder(bytes.NewBuffer(gr.Value.Bytes)).Decode(value); err != nil {
 		return true, gr.Value.Timestamp, err
@@ -69,22 +83,31 @@ func GetI(db DB, key storage.Key, value interface{}) (bool, int64, error) {
 }
 
 // PutI sets the given key to the serialized byte string of the value
-// provided. Uses current time and default expiration.
+// provided. The write is timestamped by the node which executes it
+// and uses the default expiration.
 func PutI(db DB, key storage.Key, value interface{}) error {
 	var buf bytes.Buffer
 	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
 		return err
 	}
 	pr := <-db.Put(&storage.PutRequest{
-		Key: key,
-		Value: storage.Value{
-			Bytes:     buf.Bytes(),
-			Timestamp: time.Now().UnixNano(),
-		},
+		Key:   key,
+		Value: storage.Value{Bytes: buf.Bytes()},
 	})
 	return pr.Error
 }
 
+// Increment atomically adds inc to the varint encoded int64 value at
+// the specified key and returns the new value. A missing key is
+// treated as zero. Suitable for counters and ID generators.
+func Increment(db DB, key storage.Key, inc int64) (int64, error) {
+	ir := <-db.Increment(&storage.IncrementRequest{
+		Key:       key,
+		Increment: inc,
+	})
+	return ir.NewValue, ir.Error
+}
+
 // BootstrapRangeDescriptor sets meta1 and meta2 values for KeyMax,
 // using the provided replica.
 func BootstrapRangeDescriptor(db DB, replica storage.Replica) error {
@@ -150,17 +173,18 @@ func BootstrapConfigs(db DB) error {
 }
 
 // UpdateRangeDescriptor updates the range locations metadata for the
-// range specified by the meta parameter. This always involves a write
-// to "meta2", and may require a write to "meta1", in the event that
-// meta.EndKey is a "meta2" key (prefixed by KeyMeta2Prefix).
+// range specified by the meta parameter. The record is written to the
+// range addressing key for meta.EndKey; see storage.RangeMetaKey. This
+// is a "meta2" key, or a "meta1" key in the event that meta.EndKey is
+// a "meta2" key (prefixed by KeyMeta2Prefix). The first range, if it
+// ends in the "meta1" keyspace, is located via gossip and has no
+// record.
 func UpdateRangeDescriptor(db DB, meta storage.RangeMetadata, locations storage.RangeDescriptor) error {
-	// TODO(spencer): a lot more work here to actually implement this.
-
-	// Write meta2.
-	if err := PutI(db, storage.MakeKey(storage.KeyMeta2Prefix, meta.EndKey), locations); err != nil {
-		return err
+	metaKey := storage.RangeMetaKey(meta.EndKey)
+	if len(metaKey) == 0 {
+		return nil
 	}
-	return nil
+	return PutI(db, metaKey, locations)
 }
 
 // A DistDB provides methods to access Cockroach's monolithic,
@@ -176,7 +200,12 @@ type DistDB struct {
 	// rangeCache caches replica metadata for key ranges. The cache is
 	// filled while servicing read and write requests to the key value
 	// store.
-	rangeCache util.LRUCache
+	rangeCache *rangeDescriptorCache
+	// leaderCache caches the leader replica of ranges, learned from
+	// replicas which aren't the leader.
+	leaderCache *leaderCache
+	// stopper abandons the retries of requests in progress on Close.
+	stopper *util.Stopper
 }
 
 // Default constants for timeouts.
@@ -185,6 +214,22 @@ const (
 	defaultRPCTimeout      = 15 * time.Second
 	retryBackoff           = 1 * time.Second
 	maxRetryBackoff        = 30 * time.Second
+	// rangeCacheSize is the maximum number of range descriptors
+	// cached by a DistDB.
+	rangeCacheSize = 1 << 20
+	// leaderCacheSize is the maximum number of range leaders cached
+	// by a DistDB.
+	leaderCacheSize = 1 << 20
+)
+
+// Metrics exported by all DistDBs of the process.
+var (
+	requestCount     = metrics.DefaultRegistry.Counter("kv_requests")
+	errorCount       = metrics.DefaultRegistry.Counter("kv_request_errors")
+	attemptCount     = metrics.DefaultRegistry.Counter("kv_rpc_attempts")
+	lookupLatency    = metrics.DefaultRegistry.Histogram("kv_range_lookup_latency_ns", metrics.LatencyBuckets)
+	requestLatency   = metrics.DefaultRegistry.Histogram("kv_request_latency_ns", metrics.LatencyBuckets)
+	parallelRunCount = metrics.DefaultRegistry.Counter("kv_batch_parallel_runs")
 )
 
 // A firstRangeMissingErr indicates that the first range has not yet
@@ -209,7 +254,20 @@ func (n noNodeAddrsAvailErr) CanRetry() bool { return true }
 // NewDB returns a key-value datastore client which connects to the
 // Cockroach cluster via the supplied gossip instance.
 func NewDB(gossip *gossip.Gossip) *DistDB {
-	return &DistDB{gossip: gossip}
+	db := &DistDB{
+		gossip:      gossip,
+		leaderCache: newLeaderCache(leaderCacheSize),
+		stopper:     util.NewStopper(),
+	}
+	db.rangeCache = newRangeDescriptorCache(db.lookupRangeMetadata, rangeCacheSize)
+	return db
+}
+
+// Close abandons the retries of requests in progress, which return
+// a util.RetryStoppedError. Requests made after Close are attempted
+// once.
+func (db *DistDB) Close() {
+	db.stopper.Stop()
 }
 
 func (db *DistDB) nodeIDToAddr(nodeID int32) (net.Addr, error) {
@@ -221,43 +279,75 @@ func (db *DistDB) nodeIDToAddr(nodeID int32) (net.Addr, error) {
 	return info.(net.Addr), nil
 }
 
-// lookupRangeMetadataFirstLevel issues an InternalRangeLookup request
-// to the first-level range metadata table. This always chooses from
-// amongst the first range metadata replicas (these are gossipped).
-func (db *DistDB) lookupRangeMetadataFirstLevel(key storage.Key) (*storage.RangeDescriptor, error) {
+// getFirstRangeDescriptor returns the gossipped descriptor of the
+// first range, which contains all "meta1" range addressing records.
+func (db *DistDB) getFirstRangeDescriptor() (*storage.RangeDescriptor, error) {
 	info, err := db.gossip.GetInfo(gossip.KeyFirstRangeMetadata)
 	if err != nil {
 		return nil, firstRangeMissingErr{err}
 	}
-	replicas := info.(storage.RangeDescriptor).Replicas
-	metadataKey := storage.MakeKey(storage.KeyMeta1Prefix, key)
-	args := &storage.InternalRangeLookupRequest{Key: metadataKey}
-	replyChan := make(chan *storage.InternalRangeLookupResponse, len(replicas))
-	if err = db.sendRPC(replicas, "Node.InternalRangeLookup", args, replyChan); err != nil {
-		return nil, err
-	}
-	reply := <-replyChan
-	return &reply.Range, nil
+	desc := info.(storage.RangeDescriptor)
+	return &desc, nil
 }
 
-// lookupRangeMetadata first looks up the specified key in the first
-// level of range metadata and then looks up the specified key in the
-// second level of range metadata to yield the set of replicas where
-// the key resides. This process is retried in a loop until the key's
-// replicas are located or a non-retryable error is encountered.
-func (db *DistDB) lookupRangeMetadata(key storage.Key) (*storage.RangeDescriptor, error) {
-	firstLevelMeta, err := db.lookupRangeMetadataFirstLevel(key)
+// lookupRangeMetadata returns the descriptor of the range containing
+// key (or the keys just before it, if reverse), along with the key of
+// the addressing record it was read from.
+// The range addressing record for key (see storage.RangeMetaKey) is
+// looked up via an InternalRangeLookup request to the range which
+// contains it, which is itself located recursively through the range
+// cache: "meta2" records are located via "meta1" records, which
+// reside in the first range. The first range is located via gossip.
+//
+// If the lookup fails, the descriptor of the range holding the
+// addressing record is evicted so it's looked up anew on retry. A
+// failed "meta1" lookup is retried immediately against the first
+// range descriptor currently gossipped, which supersedes the cached
+// descriptor if the first range's replicas have changed.
+func (db *DistDB) lookupRangeMetadata(key storage.Key, reverse bool) (storage.Key, *storage.RangeDescriptor, error) {
+	metadataKey := storage.RangeMetaKey(key)
+	if len(metadataKey) == 0 {
+		desc, err := db.getFirstRangeDescriptor()
+		return nil, desc, err
+	}
+	// The range holding the addressing record is that containing the
+	// record's key, even for reverse lookups.
+	metaDesc, err := db.rangeCache.LookupRangeDescriptor(metadataKey, false)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	reply, err := db.rangeLookup(metaDesc, metadataKey, reverse)
+	if err != nil {
+		db.rangeCache.EvictCachedRangeDescriptor(metadataKey, false)
+		if len(storage.RangeMetaKey(metadataKey)) != 0 {
+			return nil, nil, err
+		}
+		firstDesc, gErr := db.getFirstRangeDescriptor()
+		if gErr != nil {
+			return nil, nil, err
+		}
+		log.New("kv").V(1).Infof("meta1 lookup of %q failed: %v; retrying via gossipped first range", key, err)
+		if reply, err = db.rangeLookup(firstDesc, metadataKey, reverse); err != nil {
+			return nil, nil, err
+		}
 	}
-	metadataKey := storage.MakeKey(storage.KeyMeta2Prefix, key)
-	args := &storage.InternalRangeLookupRequest{Key: metadataKey}
-	replyChan := make(chan *storage.InternalRangeLookupResponse, len(firstLevelMeta.Replicas))
-	if err = db.sendRPC(firstLevelMeta.Replicas, "Node.InternalRangeLookup", args, replyChan); err != nil {
+	return reply.EndKey, &reply.Range, nil
+}
+
+// rangeLookup sends an InternalRangeLookup request for metadataKey to
+// the replicas of the range described by desc.
+func (db *DistDB) rangeLookup(desc *storage.RangeDescriptor, metadataKey storage.Key,
+	reverse bool) (*storage.InternalRangeLookupResponse, error) {
+	args := &storage.InternalRangeLookupRequest{Key: metadataKey, Reverse: reverse}
+	replyChan := make(chan *storage.InternalRangeLookupResponse, len(desc.Replicas))
+	if err := db.sendRPC(desc.Replicas, "Node.InternalRangeLookup", args, replyChan); err != nil {
 		return nil, err
 	}
 	reply := <-replyChan
-	return &reply.Range, nil
+	if reply.Error != nil {
+		return nil, reply.Error
+	}
+	return reply, nil
 }
 
 // sendRPC sends one or more RPCs to replicas from the supplied
@@ -274,7 +364,7 @@ func (db *DistDB) sendRPC(replicas []storage.Replica, method string, args, reply
 	for _, replica := range replicas {
 		addr, err := db.nodeIDToAddr(replica.NodeID)
 		if err != nil {
-			glog.V(1).Infof("node %d address is not gossipped", replica.NodeID)
+			log.New("kv").V(1).Infof("node %d address is not gossipped", replica.NodeID)
 			continue
 		}
 		// Copy the args value and set the replica in the header.
@@ -294,43 +384,157 @@ func (db *DistDB) sendRPC(replicas []storage.Replica, method string, args, reply
 	return rpc.Send(argsMap, method, replyChanI, rpcOpts)
 }
 
+// sendToRange sends the RPC to the leader of the range described by
+// desc if it's cached, or otherwise to any of the range's replicas,
+// and returns the reply, a value of type replyType. Follower reads
+// (see storage.IsFollowerRead) are sent to any replica regardless,
+// unless they've been redirected to the leader by a replica unable to
+// serve them.
+func (db *DistDB) sendToRange(desc *storage.RangeDescriptor, method string, args interface{},
+	replyType reflect.Type, redirected bool) (reflect.Value, error) {
+	replicas := desc.Replicas
+	leader, cached := db.leaderCache.Lookup(desc.StartKey)
+	if cached && !redirected && storage.IsFollowerRead(method, args.(storage.Request).Header(), time.Now()) {
+		cached = false
+	}
+	if cached {
+		replicas = []storage.Replica{leader}
+	}
+	replyChan := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, replyType), len(replicas))
+	if err := db.sendRPC(replicas, method, args, replyChan.Interface()); err != nil {
+		if cached {
+			// The leader may be unavailable; try all replicas next time.
+			db.leaderCache.Evict(desc.StartKey)
+		}
+		return reflect.Value{}, err
+	}
+	reply, _ := replyChan.Recv()
+	return reply, nil
+}
+
 // routeRPC looks up the appropriate range based on the supplied key
 // and sends the RPC according to the specified options. routeRPC
 // sends asynchronously and returns a channel which receives the reply
 // struct when the call is complete. Returns a channel of the same
 // type as "reply".
+//
+// The RPC is sent to the range's leader, if known. A reply with a
+// NotLeaderError is resent at once to the leader it names, if any,
+// and otherwise retried with backoff. A reply with a
+// RangeKeyMismatchError for key means the cached range descriptor is
+// stale; it's evicted and the RPC retried. A reply with an
+// OverloadedError is retried with backoff. Other errors in the reply
+// are returned to the caller.
+//
+// If the request doesn't specify a client command ID, one is
+// generated so that retries of the RPC are executed at most once.
+// The number of attempts and the time spent on range lookups and RPCs
+// are added to the request's trace. Requests slower than the threshold
+// of storage.SlowRequests are collected there with their traces; the
+// trace is returned in the reply only if the request asked for it.
 func (db *DistDB) routeRPC(key storage.Key, method string, args, reply interface{}) interface{} {
+	header := args.(storage.Request).Header()
+	if header.CmdID.IsEmpty() {
+		header.CmdID = storage.ClientCmdID{
+			WallTime: time.Now().UnixNano(),
+			Random:   rand.Int63(),
+		}
+	}
+	// Every request is traced so that slow requests can be collected;
+	// the trace is only returned if the caller asked for it.
+	traceRequested := header.Trace
+	header.Trace = true
 	chanVal := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, reflect.TypeOf(reply)), 1)
 
+	requestCount.Inc(1)
 	go func() {
+		start := time.Now()
+		defer requestLatency.UpdateSince(start)
 		retryOpts := util.RetryOptions{
 			Tag:         fmt.Sprintf("routing %s rpc", method),
 			Backoff:     retryBackoff,
 			MaxBackoff:  maxRetryBackoff,
 			Constant:    2,
 			MaxAttempts: 0, // retry indefinitely
+			UseJitter:   true,
+			Stopper:     db.stopper,
 		}
+		// Reverse scans address the range containing the keys before key.
+		_, reverse := args.(*storage.ReverseScanRequest)
+		var replyVal reflect.Value
+		var lookupTime, rpcTime time.Duration // Phases of a trace
+		attempts := 0
 		err := util.RetryWithBackoff(retryOpts, func() (bool, error) {
-			rangeMeta, err := db.lookupRangeMetadata(key)
-			if err == nil {
-				err = db.sendRPC(rangeMeta.Replicas, method, args, chanVal.Interface())
+			start := time.Now()
+			desc, err := db.rangeCache.LookupRangeDescriptor(key, reverse)
+			lookupTime += time.Since(start)
+			lookupLatency.UpdateSince(start)
+			redirected := false
+			for err == nil {
+				attempts++
+				attemptCount.Inc(1)
+				start = time.Now()
+				replyVal, err = db.sendToRange(desc, method, args, reflect.TypeOf(reply), redirected)
+				rpcTime += time.Since(start)
+				if err != nil {
+					break
+				}
+				nlErr, ok := replyVal.Interface().(storage.Response).Header().Error.(*storage.NotLeaderError)
+				if !ok {
+					break
+				}
+				if nlErr.Leader == nil || redirected {
+					db.leaderCache.Evict(desc.StartKey)
+					log.New("kv").Warningf("failed to invoke %s: %v", method, nlErr)
+					return false, nil
+				}
+				db.leaderCache.Update(desc.StartKey, *nlErr.Leader)
+				redirected = true
 			}
 			if err != nil {
-				// If retryable, allow outer loop to retry.
-				if retryErr, ok := err.(util.Retryable); ok && retryErr.CanRetry() {
-					glog.Warningf("failed to invoke %s: %v", method, err)
+				// If retryable, allow outer loop to retry. Errors sending
+				// to the range's replicas may indicate the cached range
+				// descriptor is stale, so evict it first.
+				if util.IsRetryable(err) {
+					log.New("kv").Warningf("failed to invoke %s: %v", method, err)
+					db.rangeCache.EvictCachedRangeDescriptor(key, reverse)
 					return false, nil
 				}
-				// TODO(spencer): check error here; we need to clear this
-				// segment of range cache and retry if the range wasn't found.
+				return true, err
 			}
-			return true, err
+			replyErr := replyVal.Interface().(storage.Response).Header().Error
+			if rkErr, ok := replyErr.(*storage.RangeKeyMismatchError); ok && bytes.Equal(rkErr.RequestKey, key) {
+				log.New("kv").Warningf("failed to invoke %s: %v", method, rkErr)
+				db.rangeCache.EvictCachedRangeDescriptor(key, reverse)
+				return false, nil
+			}
+			if oErr, ok := replyErr.(*storage.OverloadedError); ok {
+				log.New("kv").Warningf("failed to invoke %s: %v", method, oErr)
+				return false, nil
+			}
+			return true, nil
 		})
 		if err != nil {
-			replyVal := reflect.ValueOf(reply)
+			replyVal = reflect.ValueOf(reply)
 			reflect.Indirect(replyVal).FieldByName("Error").Set(reflect.ValueOf(err))
-			chanVal.Send(replyVal)
 		}
+		if replyVal.Interface().(storage.Response).Header().Error != nil {
+			errorCount.Inc(1)
+		}
+		replyHeader := replyVal.Interface().(storage.Response).Header()
+		trace := storage.ReplyTrace(args.(storage.Request), replyVal.Interface().(storage.Response))
+		trace.Attempts = attempts
+		trace.Phases = append(trace.Phases,
+			storage.TracePhase{Name: storage.TraceLookup, Duration: lookupTime},
+			storage.TracePhase{Name: storage.TraceRPC, Duration: rpcTime})
+		if storage.SlowRequests.Record(method, start, trace) {
+			log.New("kv").Warningf("slow request %s took %s: %s", method, time.Since(start), trace)
+		}
+		if !traceRequested {
+			header.Trace = false
+			replyHeader.Trace = nil
+		}
+		chanVal.Send(replyVal)
 	}()
 
 	return chanVal.Interface()
@@ -354,6 +558,12 @@ func (db *DistDB) Put(args *storage.PutRequest) <-chan *storage.PutResponse {
 		args, &storage.PutResponse{}).(chan *storage.PutResponse)
 }
 
+// ConditionalPut .
+func (db *DistDB) ConditionalPut(args *storage.ConditionalPutRequest) <-chan *storage.ConditionalPutResponse {
+	return db.routeRPC(args.Key, "Node.ConditionalPut",
+		args, &storage.ConditionalPutResponse{}).(chan *storage.ConditionalPutResponse)
+}
+
 // Increment .
 func (db *DistDB) Increment(args *storage.IncrementRequest) <-chan *storage.IncrementResponse {
 	return db.routeRPC(args.Key, "Node.Increment",
@@ -366,26 +576,516 @@ func (db *DistDB) Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResp
 		args, &storage.DeleteResponse{}).(chan *storage.DeleteResponse)
 }
 
-// DeleteRange .
+// DeleteRange deletes the keys in a span which may cross range
+// boundaries. See Scan for how the span is split among ranges.
 func (db *DistDB) DeleteRange(args *storage.DeleteRangeRequest) <-chan *storage.DeleteRangeResponse {
-	// TODO(spencer): range of keys.
-	return db.routeRPC(args.StartKey, "Node.DeleteRange",
-		args, &storage.DeleteRangeResponse{}).(chan *storage.DeleteRangeResponse)
+	replyChan := make(chan *storage.DeleteRangeResponse, 1)
+	go func() {
+		replyChan <- db.deleteRange(args)
+	}()
+	return replyChan
 }
 
-// Scan .
+// deleteRange implements DeleteRange. The parts of a
+// non-transactional deletion are executed at the timestamp of the
+// first, as for scan.
+func (db *DistDB) deleteRange(args *storage.DeleteRangeRequest) *storage.DeleteRangeResponse {
+	reply := &storage.DeleteRangeResponse{}
+	part := *args
+	part.CmdID = spanCmdID(args.CmdID)
+	for i := int64(0); ; i++ {
+		partArgs := part
+		partArgs.CmdID.Random += i
+		partReply := <-db.routeRPC(partArgs.StartKey, "Node.DeleteRange",
+			&partArgs, &storage.DeleteRangeResponse{}).(chan *storage.DeleteRangeResponse)
+		reply.NumDeleted += partReply.NumDeleted
+		reply.ResumeKey = partReply.ResumeKey
+		if i == 0 {
+			reply.Timestamp = partReply.Timestamp
+		}
+		mergeSpanReply(args, reply, partReply)
+		if reply.Error != nil {
+			return reply
+		}
+		if args.MaxEntriesToDelete > 0 && reply.NumDeleted >= args.MaxEntriesToDelete {
+			return reply
+		}
+		if !continueSpan(reply.ResumeKey, args.EndKey) {
+			reply.ResumeKey = nil
+			return reply
+		}
+		part.StartKey = reply.ResumeKey
+		if args.MaxEntriesToDelete > 0 {
+			part.MaxEntriesToDelete = args.MaxEntriesToDelete - reply.NumDeleted
+		}
+		if partReply.Txn != nil {
+			part.Txn = partReply.Txn
+		}
+		if part.Txn == nil {
+			part.Timestamp = reply.Timestamp
+		}
+	}
+}
+
+// Scan scans a span which may cross range boundaries. The scan is
+// sent to the range containing the start key, which truncates it to
+// its own bounds and returns the key at which to continue. The
+// remainder of the span is sent to the following ranges in turn, so
+// that rows are returned in key order, until the span is exhausted
+// or the rows returned by all ranges reach MaxResults or MaxBytes,
+// in which case the reply's ResumeKey is the key at which to resume
+// the scan. Since the remainder is addressed by the resume key
+// returned by the range which executed the previous part, scans are
+// split correctly even if the cached range descriptors are stale.
 func (db *DistDB) Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse {
-	// TODO(spencer): range of keys.
-	return nil
+	replyChan := make(chan *storage.ScanResponse, 1)
+	go func() {
+		replyChan <- db.scan(args)
+	}()
+	return replyChan
+}
+
+// scan implements Scan. Each part of the scan is given a distinct
+// client command ID, derived from that of the scan. The parts of a
+// non-transactional scan, including a bounded-staleness one, are read
+// at the timestamp of the first, so that the rows returned form a
+// consistent snapshot of the span.
+func (db *DistDB) scan(args *storage.ScanRequest) *storage.ScanResponse {
+	reply := &storage.ScanResponse{}
+	part := *args
+	part.CmdID = spanCmdID(args.CmdID)
+	for i := int64(0); ; i++ {
+		partArgs := part
+		partArgs.CmdID.Random += i
+		partReply := <-db.routeRPC(partArgs.StartKey, "Node.Scan",
+			&partArgs, &storage.ScanResponse{}).(chan *storage.ScanResponse)
+		reply.Rows = append(reply.Rows, partReply.Rows...)
+		reply.ResumeKey = partReply.ResumeKey
+		if i == 0 {
+			reply.Timestamp = partReply.Timestamp
+		}
+		mergeSpanReply(args, reply, partReply)
+		if reply.Error != nil {
+			return reply
+		}
+		if storage.ScanLimitReached(args, reply.Rows) {
+			return reply
+		}
+		if !continueSpan(reply.ResumeKey, args.EndKey) {
+			reply.ResumeKey = nil
+			return reply
+		}
+		part.StartKey = reply.ResumeKey
+		limitScan(&part, args, reply.Rows)
+		if partReply.Txn != nil {
+			part.Txn = partReply.Txn
+		}
+		if part.Txn == nil || part.MaxStaleness > 0 {
+			part.MaxStaleness = 0
+			part.Timestamp = reply.Timestamp
+		}
+	}
+}
+
+// ReverseScan scans a span which may cross range boundaries in
+// descending key order. The scan is sent to the range containing the
+// keys just before the end key, which truncates it to its own bounds
+// and returns the key at which to continue. The remainder of the span
+// is sent to the preceding ranges in turn, as for Scan.
+func (db *DistDB) ReverseScan(args *storage.ReverseScanRequest) <-chan *storage.ReverseScanResponse {
+	replyChan := make(chan *storage.ReverseScanResponse, 1)
+	go func() {
+		replyChan <- db.reverseScan(args)
+	}()
+	return replyChan
+}
+
+// reverseScan implements ReverseScan in the manner of scan.
+func (db *DistDB) reverseScan(args *storage.ReverseScanRequest) *storage.ReverseScanResponse {
+	reply := &storage.ReverseScanResponse{}
+	part := *args
+	part.CmdID = spanCmdID(args.CmdID)
+	for i := int64(0); ; i++ {
+		partArgs := part
+		partArgs.CmdID.Random += i
+		partReply := <-db.routeRPC(storage.ReverseScanKey(&partArgs), "Node.ReverseScan",
+			&partArgs, &storage.ReverseScanResponse{}).(chan *storage.ReverseScanResponse)
+		reply.Rows = append(reply.Rows, partReply.Rows...)
+		reply.ResumeKey = partReply.ResumeKey
+		if i == 0 {
+			reply.Timestamp = partReply.Timestamp
+		}
+		mergeSpanReply(args, reply, partReply)
+		if reply.Error != nil {
+			return reply
+		}
+		if storage.ReverseScanLimitReached(args, reply.Rows) {
+			return reply
+		}
+		if len(reply.ResumeKey) == 0 || bytes.Compare(reply.ResumeKey, args.StartKey) <= 0 {
+			reply.ResumeKey = nil
+			return reply
+		}
+		part.EndKey = reply.ResumeKey
+		part.MaxResults, part.MaxBytes = remainingLimits(args.MaxResults, args.MaxBytes, reply.Rows)
+		if partReply.Txn != nil {
+			part.Txn = partReply.Txn
+		}
+		if part.Txn == nil || part.MaxStaleness > 0 {
+			part.MaxStaleness = 0
+			part.Timestamp = reply.Timestamp
+		}
+	}
+}
+
+// limitScan sets the limits of part, the remainder of the scan args,
+// to those of args less the rows already returned.
+func limitScan(part, args *storage.ScanRequest, rows []storage.KeyValue) {
+	part.MaxResults, part.MaxBytes = remainingLimits(args.MaxResults, args.MaxBytes, rows)
+}
+
+// remainingLimits returns the limits of a scan, maxResults and
+// maxBytes, less the rows already returned. Zero limits are left
+// unlimited.
+func remainingLimits(maxResults, maxBytes int64, rows []storage.KeyValue) (int64, int64) {
+	if maxResults > 0 {
+		maxResults -= int64(len(rows))
+	}
+	if maxBytes > 0 {
+		for i := range rows {
+			maxBytes -= rows[i].Size()
+		}
+	}
+	return maxResults, maxBytes
+}
+
+// spanCmdID returns the client command ID from which the IDs of the
+// parts of a request spanning ranges are derived, generating one if
+// the request doesn't specify it.
+func spanCmdID(cmdID storage.ClientCmdID) storage.ClientCmdID {
+	if cmdID.IsEmpty() {
+		cmdID = storage.ClientCmdID{
+			WallTime: time.Now().UnixNano(),
+			Random:   rand.Int63(),
+		}
+	}
+	return cmdID
+}
+
+// continueSpan returns whether the part of a span starting at
+// resumeKey remains to be sent. An empty endKey denotes the end of
+// the key space.
+func continueSpan(resumeKey, endKey storage.Key) bool {
+	if len(resumeKey) == 0 {
+		return false
+	}
+	return len(endKey) == 0 || bytes.Compare(resumeKey, endKey) < 0
+}
+
+// mergeSpanReply merges the error, transaction and trace of the reply
+// to a part of a request spanning ranges into the request's reply.
+func mergeSpanReply(args storage.Request, reply, partReply storage.Response) {
+	header, partHeader := reply.Header(), partReply.Header()
+	header.Error = partHeader.Error
+	if partHeader.Txn != nil {
+		header.Txn = partHeader.Txn
+	}
+	if trace := storage.ReplyTrace(args, reply); trace != nil {
+		trace.Merge(partHeader.Trace)
+	}
 }
 
 // EndTransaction .
 func (db *DistDB) EndTransaction(args *storage.EndTransactionRequest) <-chan *storage.EndTransactionResponse {
-	// TODO(spencer): multiple keys here...
-	return db.routeRPC(args.Keys[0], "Node.EndTransaction",
+	// The transaction record is stored in the range containing the
+	// transaction's anchor key.
+	return db.routeRPC(args.Txn.Key, "Node.EndTransaction",
 		args, &storage.EndTransactionResponse{}).(chan *storage.EndTransactionResponse)
 }
 
+// Batch sends a batch of requests. Each run of consecutive requests
+// addressing keys in the same range is sent to that range as a batch
+// of its own, in order, or concurrently if the runs are independent
+// of one another. Only the requests of each run are executed
+// atomically. As for a batch sent to a single range, execution of
+// runs sent in order stops at the first failed request. Scans and
+// range deletions which extend beyond the range of their run are
+// continued in the following ranges before the next run is sent. The
+// traces of the runs, if requested, are merged into the batch's.
+func (db *DistDB) Batch(args *storage.BatchRequest) <-chan *storage.BatchResponse {
+	replyChan := make(chan *storage.BatchResponse, 1)
+	go func() {
+		replyChan <- db.sendBatch(args)
+	}()
+	return replyChan
+}
+
+// sendBatch implements Batch. The batch of each run is given a
+// distinct client command ID, derived from that of the batch, so
+// that runs sent to the same range aren't mistaken for retries of
+// one another. If the runs are independent (see independentRuns),
+// they're sent concurrently, so that the latency of a batch spanning
+// ranges is that of its slowest run rather than the sum of all.
+// Execution then doesn't stop at the first failed request: the runs
+// following it are executed regardless, though their responses
+// aren't returned.
+func (db *DistDB) sendBatch(args *storage.BatchRequest) *storage.BatchResponse {
+	if args.CmdID.IsEmpty() {
+		args.CmdID = storage.ClientCmdID{
+			WallTime: time.Now().UnixNano(),
+			Random:   rand.Int63(),
+		}
+	}
+	if runs := db.independentRuns(args.Requests); len(runs) > 1 {
+		return db.sendRunsConcurrently(args, runs)
+	}
+	reply := &storage.BatchResponse{}
+	db.sendRuns(args, args.Requests, args.CmdID, reply)
+	return reply
+}
+
+// sendRuns sends the runs of requests, a part of the batch args, in
+// order, adding the responses to reply. The batch of the i-th run
+// sent is given the client command ID cmdID incremented by i.
+func (db *DistDB) sendRuns(args *storage.BatchRequest, requests []storage.Request,
+	cmdID storage.ClientCmdID, reply *storage.BatchResponse) {
+	remaining := requests
+	for i := int64(0); len(remaining) > 0; i++ {
+		n := db.sameRangeCount(remaining)
+		runArgs := &storage.BatchRequest{RequestHeader: args.RequestHeader, Requests: remaining[:n]}
+		runArgs.CmdID = cmdID
+		runArgs.CmdID.Random += i
+		runReply := <-db.routeRPC(storage.BatchKey(remaining[0]), "Node.Batch",
+			runArgs, &storage.BatchResponse{}).(chan *storage.BatchResponse)
+		if runReply.Txn != nil {
+			reply.Txn = runReply.Txn
+		}
+		if trace := storage.ReplyTrace(args, reply); trace != nil {
+			trace.Merge(runReply.Trace)
+		}
+		if _, ok := runReply.Error.(*storage.RangeKeyMismatchError); ok && len(runReply.Responses) > 1 {
+			// The cached descriptor of the range was stale: the range no
+			// longer contains the failed request's key, though it
+			// executed the requests before it. Send the rest anew.
+			executed := len(runReply.Responses) - 1
+			reply.Responses = append(reply.Responses, runReply.Responses[:executed]...)
+			db.rangeCache.EvictCachedRangeDescriptor(storage.BatchKey(remaining[0]), false)
+			if reply.Error = db.continueSpans(args, remaining[:executed], runReply.Responses[:executed], reply); reply.Error != nil {
+				return
+			}
+			remaining = remaining[executed:]
+			continue
+		}
+		reply.Responses = append(reply.Responses, runReply.Responses...)
+		if runReply.Error != nil {
+			reply.Error = runReply.Error
+			return
+		}
+		if reply.Error = db.continueSpans(args, remaining[:n], runReply.Responses, reply); reply.Error != nil {
+			return
+		}
+		remaining = remaining[n:]
+	}
+}
+
+// independentRuns splits requests into runs of consecutive requests
+// addressing the same range, according to the range descriptor
+// cache, and returns the runs if they may be sent concurrently. Runs
+// are independent if each addresses a distinct range, so that no two
+// runs address the same keys, and none contains a scan, range
+// deletion or transaction end, whose effects extend beyond their run's
+// range. Returns nil otherwise.
+func (db *DistDB) independentRuns(requests []storage.Request) [][]storage.Request {
+	for _, req := range requests {
+		switch req.(type) {
+		case *storage.ScanRequest, *storage.DeleteRangeRequest, *storage.EndTransactionRequest:
+			return nil
+		}
+	}
+	var runs [][]storage.Request
+	ranges := map[string]struct{}{}
+	for remaining := requests; len(remaining) > 0; {
+		desc, err := db.rangeCache.LookupRangeDescriptor(storage.BatchKey(remaining[0]), false)
+		if err != nil {
+			return nil
+		}
+		if _, ok := ranges[string(desc.StartKey)]; ok {
+			return nil
+		}
+		ranges[string(desc.StartKey)] = struct{}{}
+		n := db.sameRangeCount(remaining)
+		runs = append(runs, remaining[:n])
+		remaining = remaining[n:]
+	}
+	return runs
+}
+
+// sendRunsConcurrently sends each of the independent runs of the
+// batch args concurrently and assembles their responses in order, up
+// to and including those of the first failed run. The runs are sent
+// via sendRuns, which resends the remainder of a run whose range
+// descriptor proves stale; each is given a distinct range of client
+// command IDs.
+func (db *DistDB) sendRunsConcurrently(args *storage.BatchRequest, runs [][]storage.Request) *storage.BatchResponse {
+	parallelRunCount.Inc(int64(len(runs)))
+	replies := make([]*storage.BatchResponse, len(runs))
+	var wg sync.WaitGroup
+	cmdID := args.CmdID
+	for i, run := range runs {
+		replies[i] = &storage.BatchResponse{}
+		wg.Add(1)
+		go func(run []storage.Request, cmdID storage.ClientCmdID, runReply *storage.BatchResponse) {
+			defer wg.Done()
+			db.sendRuns(args, run, cmdID, runReply)
+		}(run, cmdID, replies[i])
+		cmdID.Random += int64(len(run))
+	}
+	wg.Wait()
+
+	reply := &storage.BatchResponse{}
+	for _, runReply := range replies {
+		reply.Txn = mergeTxn(reply.Txn, runReply.Txn)
+		if trace := storage.ReplyTrace(args, reply); trace != nil {
+			trace.Merge(runReply.Trace)
+		}
+		reply.Responses = append(reply.Responses, runReply.Responses...)
+		if runReply.Error != nil {
+			reply.Error = runReply.Error
+			break
+		}
+	}
+	return reply
+}
+
+// mergeTxn merges the transactions returned by concurrently sent
+// requests. The result is the transaction with the later timestamp,
+// with the greater of the two priorities and a final status if either
+// has one.
+func mergeTxn(a, b *storage.Transaction) *storage.Transaction {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	txn := *a
+	if a.Timestamp.Less(b.Timestamp) {
+		txn = *b
+	}
+	txn.Priority = maxPriority(a.Priority, b.Priority)
+	if txn.Status == storage.PENDING {
+		if a.Status != storage.PENDING {
+			txn.Status = a.Status
+		} else {
+			txn.Status = b.Status
+		}
+	}
+	return &txn
+}
+
+// continueSpans sends the remainder of each Scan and DeleteRange
+// among requests which extends beyond the range which executed it to
+// the following ranges, merging the replies into the request's
+// response. The remainders are sent before any subsequent run of the
+// batch, preserving the batch's order. As on the range, they inherit
+// the batch's timestamp and latest transaction unless they specify
+// their own.
+func (db *DistDB) continueSpans(args *storage.BatchRequest, requests []storage.Request,
+	responses []storage.Response, reply *storage.BatchResponse) error {
+	inherit := func(header *storage.RequestHeader) {
+		header.CmdID = storage.ClientCmdID{}
+		if header.Timestamp == (hlc.HLTimestamp{}) {
+			header.Timestamp = args.Timestamp
+		}
+		if header.Txn == nil {
+			header.Txn = reply.Txn
+			if header.Txn == nil {
+				header.Txn = args.Txn
+			}
+		}
+	}
+	for i, req := range requests {
+		var partReply storage.Response
+		switch t := req.(type) {
+		case *storage.ScanRequest:
+			resp := responses[i].(*storage.ScanResponse)
+			if storage.ScanLimitReached(t, resp.Rows) || !continueSpan(resp.ResumeKey, t.EndKey) {
+				continue
+			}
+			part := *t
+			part.StartKey = resp.ResumeKey
+			limitScan(&part, t, resp.Rows)
+			inherit(&part.RequestHeader)
+			scanReply := db.scan(&part)
+			resp.Rows = append(resp.Rows, scanReply.Rows...)
+			resp.ResumeKey = scanReply.ResumeKey
+			partReply = scanReply
+		case *storage.DeleteRangeRequest:
+			resp := responses[i].(*storage.DeleteRangeResponse)
+			if (t.MaxEntriesToDelete > 0 && resp.NumDeleted >= t.MaxEntriesToDelete) || !continueSpan(resp.ResumeKey, t.EndKey) {
+				continue
+			}
+			part := *t
+			part.StartKey = resp.ResumeKey
+			if t.MaxEntriesToDelete > 0 {
+				part.MaxEntriesToDelete = t.MaxEntriesToDelete - resp.NumDeleted
+			}
+			inherit(&part.RequestHeader)
+			deleteReply := db.deleteRange(&part)
+			resp.NumDeleted += deleteReply.NumDeleted
+			resp.ResumeKey = deleteReply.ResumeKey
+			partReply = deleteReply
+		default:
+			continue
+		}
+		header := responses[i].Header()
+		header.Error = partReply.Header().Error
+		if txn := partReply.Header().Txn; txn != nil {
+			header.Txn = txn
+			reply.Txn = txn
+		}
+		if header.Error != nil {
+			return header.Error
+		}
+	}
+	return nil
+}
+
+// sameRangeCount returns the number of leading requests which
+// address keys in the same range as the first, according to the
+// range descriptor cache. If a descriptor can't be looked up, all
+// requests are counted: those outside the first request's range are
+// resent on failure.
+func (db *DistDB) sameRangeCount(requests []storage.Request) int {
+	desc, err := db.rangeCache.LookupRangeDescriptor(storage.BatchKey(requests[0]), false)
+	if err != nil {
+		return len(requests)
+	}
+	for i := 1; i < len(requests); i++ {
+		d, err := db.rangeCache.LookupRangeDescriptor(storage.BatchKey(requests[i]), false)
+		if err != nil {
+			return len(requests)
+		}
+		if !bytes.Equal(d.StartKey, desc.StartKey) {
+			return i
+		}
+	}
+	return len(requests)
+}
+
+// AdminSplit splits the range containing args.Key.
+func (db *DistDB) AdminSplit(args *storage.AdminSplitRequest) <-chan *storage.AdminSplitResponse {
+	return db.routeRPC(args.Key, "Node.AdminSplit",
+		args, &storage.AdminSplitResponse{}).(chan *storage.AdminSplitResponse)
+}
+
+// AdminMerge merges the range containing args.Key with the
+// subsequent range.
+func (db *DistDB) AdminMerge(args *storage.AdminMergeRequest) <-chan *storage.AdminMergeResponse {
+	return db.routeRPC(args.Key, "Node.AdminMerge",
+		args, &storage.AdminMergeResponse{}).(chan *storage.AdminMergeResponse)
+}
+
 // AccumulateTS is used to efficiently accumulate a time series of
 // int64 quantities representing discrete subtimes. For example, a
 // key/value might represent a minute of data. Each would contain 60
@@ -416,3 +1116,46 @@ func (db *DistDB) EnqueueMessage(args *storage.EnqueueMessageRequest) <-chan *st
 	return db.routeRPC(args.Inbox, "Node.EnqueueMessage",
 		args, &storage.EnqueueMessageResponse{}).(chan *storage.EnqueueMessageResponse)
 }
+
+// InternalPushTxn is used internally to push the transaction whose
+// record is stored at args.Key.
+func (db *DistDB) InternalPushTxn(args *storage.InternalPushTxnRequest) <-chan *storage.InternalPushTxnResponse {
+	return db.routeRPC(args.Key, "Node.InternalPushTxn",
+		args, &storage.InternalPushTxnResponse{}).(chan *storage.InternalPushTxnResponse)
+}
+
+// InternalResolveIntent is used internally to resolve the write
+// intent at args.Key.
+func (db *DistDB) InternalResolveIntent(args *storage.InternalResolveIntentRequest) <-chan *storage.InternalResolveIntentResponse {
+	return db.routeRPC(args.Key, "Node.InternalResolveIntent",
+		args, &storage.InternalResolveIntentResponse{}).(chan *storage.InternalResolveIntentResponse)
+}
+
+// InternalHeartbeatTxn is used internally to heartbeat the record
+// of the transaction anchored at args.Key.
+func (db *DistDB) InternalHeartbeatTxn(args *storage.InternalHeartbeatTxnRequest) <-chan *storage.InternalHeartbeatTxnResponse {
+	return db.routeRPC(args.Key, "Node.InternalHeartbeatTxn",
+		args, &storage.InternalHeartbeatTxnResponse{}).(chan *storage.InternalHeartbeatTxnResponse)
+}
+
+// InternalSnapshot is used internally to send a range snapshot to the
+// replica specified in the request header. Unlike other requests, it
+// isn't routed by key: the replica isn't yet part of the range.
+func (db *DistDB) InternalSnapshot(args *storage.InternalSnapshotRequest) <-chan *storage.InternalSnapshotResponse {
+	replyChan := make(chan *storage.InternalSnapshotResponse, 1)
+	if err := db.sendRPC([]storage.Replica{args.Replica}, "Node.InternalSnapshot", args, replyChan); err != nil {
+		replyChan <- &storage.InternalSnapshotResponse{ResponseHeader: storage.ResponseHeader{Error: err}}
+	}
+	return replyChan
+}
+
+// InternalChecksum is used internally to request the checksum of a
+// range's data from the replica specified in the request header. It
+// isn't routed by key, which would address the range's leader.
+func (db *DistDB) InternalChecksum(args *storage.InternalChecksumRequest) <-chan *storage.InternalChecksumResponse {
+	replyChan := make(chan *storage.InternalChecksumResponse, 1)
+	if err := db.sendRPC([]storage.Replica{args.Replica}, "Node.InternalChecksum", args, replyChan); err != nil {
+		replyChan <- &storage.InternalChecksumResponse{ResponseHeader: storage.ResponseHeader{Error: err}}
+	}
+	return replyChan
+}
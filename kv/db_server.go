@@ -0,0 +1,109 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// DBPrefix is the prefix for the endpoints used by Go clients to send
+// KV requests. A request is POSTed to DBPrefix followed by the name of
+// the DB method, with the gob-encoded request as body; the reply is
+// returned gob encoded. Errors executing the request are returned in
+// the reply's header.
+const DBPrefix = "/kv/db/"
+
+// allowedDBMethods lists the DB methods which may be invoked via
+// DBPrefix. InternalResolveIntent and InternalHeartbeatTxn are
+// included so that clients may coordinate transactions (see
+// RunTransaction); they require the user's write permission on the
+// addressed key.
+var allowedDBMethods = map[string]struct{}{
+	"Contains":              struct{}{},
+	"Get":                   struct{}{},
+	"Put":                   struct{}{},
+	"ConditionalPut":        struct{}{},
+	"Increment":             struct{}{},
+	"Delete":                struct{}{},
+	"DeleteRange":           struct{}{},
+	"Scan":                  struct{}{},
+	"ReverseScan":           struct{}{},
+	"EndTransaction":        struct{}{},
+	"Batch":                 struct{}{},
+	"AccumulateTS":          struct{}{},
+	"ReapQueue":             struct{}{},
+	"EnqueueUpdate":         struct{}{},
+	"EnqueueMessage":        struct{}{},
+	"InternalResolveIntent": struct{}{},
+	"InternalHeartbeatTxn":  struct{}{},
+}
+
+// A DBServer serves KV requests sent by Go clients to DBPrefix,
+// executing them via an underlying DB.
+type DBServer struct {
+	db DB // Key-value database client
+}
+
+// NewDBServer allocates and returns a new server.
+func NewDBServer(db DB) *DBServer {
+	return &DBServer{db: db}
+}
+
+// ServeHTTP decodes the request, invokes the DB method named by the
+// URL path and encodes the reply. Requests are made on behalf of the
+// user named by the UserHeader; any user set in the request itself is
+// overwritten.
+func (s *DBServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	method := strings.TrimPrefix(r.URL.Path, DBPrefix)
+	if _, ok := allowedDBMethods[method]; !ok {
+		http.Error(w, "unsupported method: "+method, http.StatusNotFound)
+		return
+	}
+	fn := reflect.ValueOf(s.db).MethodByName(method)
+	args := reflect.New(fn.Type().In(0).Elem())
+	defer r.Body.Close()
+	if err := gob.NewDecoder(r.Body).Decode(args.Interface()); err != nil {
+		http.Error(w, "unable to decode request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	args.Interface().(storage.Request).Header().User = requestHeader(r).User
+
+	replyVal, _ := fn.Call([]reflect.Value{args})[0].Recv()
+	reply := replyVal.Interface().(storage.Response)
+	reply.Header().Error = storage.WireError(reply.Header().Error)
+	if br, ok := reply.(*storage.BatchResponse); ok {
+		for _, resp := range br.Responses {
+			resp.Header().Error = storage.WireError(resp.Header().Error)
+		}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(reply); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", GobContentType)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,74 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/http"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// doDB sends args to the DB server endpoint for method and decodes
+// the reply into reply.
+func doDB(method string, args storage.Request, reply storage.Response, t *testing.T) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(args); err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{"Content-Type": {GobContentType}}
+	body := doREST("POST", DBPrefix+method, &buf, header, http.StatusOK, t)
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(reply); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDBServer verifies that requests sent to the DB server are
+// executed and their replies, including typed errors, returned.
+func TestDBServer(t *testing.T) {
+	key := storage.Key("db-server")
+	pr := &storage.PutResponse{}
+	doDB("Put", &storage.PutRequest{Key: key, Value: storage.Value{Bytes: []byte("value")}}, pr, t)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	gr := &storage.GetResponse{}
+	doDB("Get", &storage.GetRequest{Key: key}, gr, t)
+	if gr.Error != nil || string(gr.Value.Bytes) != "value" {
+		t.Errorf("expected value; got %q, %v", gr.Value.Bytes, gr.Error)
+	}
+	cr := &storage.ConditionalPutResponse{}
+	doDB("ConditionalPut", &storage.ConditionalPutRequest{
+		Key:      key,
+		Value:    storage.Value{Bytes: []byte("new")},
+		ExpValue: &storage.Value{Bytes: []byte("wrong")},
+	}, cr, t)
+	if _, ok := cr.Error.(*storage.ConditionFailedError); !ok {
+		t.Errorf("expected condition failed error; got %v", cr.Error)
+	}
+}
+
+// TestDBServerMethods verifies that only POSTs of allowed methods are
+// accepted.
+func TestDBServerMethods(t *testing.T) {
+	doREST("GET", DBPrefix+"Get", nil, nil, http.StatusMethodNotAllowed, t)
+	for _, method := range []string{"AdminSplit", "InternalPushTxn", "InternalSnapshot", "Foo"} {
+		doREST("POST", DBPrefix+method, bytes.NewReader(nil), nil, http.StatusNotFound, t)
+	}
+	doREST("POST", DBPrefix+"Get", bytes.NewReader([]byte("not gob")), nil, http.StatusBadRequest, t)
+}
@@ -0,0 +1,69 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"sync"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// An IDAllocator allocates unique, monotonically increasing IDs from
+// a sequence generator stored at a system key. To avoid a round trip
+// to the key's range for every ID, IDs are reserved in blocks by
+// incrementing the generator by the block size; allocations are then
+// served from the cached block until it's exhausted. IDs left in a
+// cached block when the allocator is discarded are never used.
+type IDAllocator struct {
+	idKey     storage.Key
+	db        DB
+	blockSize int64
+
+	mu     sync.Mutex
+	nextID int64 // Next ID to allocate from the cached block
+	maxID  int64 // Last ID in the cached block
+}
+
+// NewIDAllocator creates a new ID allocator which increments the
+// specified key in blocks of size blockSize.
+func NewIDAllocator(idKey storage.Key, db DB, blockSize int64) (*IDAllocator, error) {
+	if blockSize < 1 {
+		return nil, util.Errorf("block size must be positive: %d", blockSize)
+	}
+	return &IDAllocator{
+		idKey:     idKey,
+		db:        db,
+		blockSize: blockSize,
+	}, nil
+}
+
+// Allocate returns the next available ID, reserving a new block of
+// IDs first if the cached block is exhausted.
+func (ia *IDAllocator) Allocate() (int64, error) {
+	ia.mu.Lock()
+	defer ia.mu.Unlock()
+	if ia.nextID == 0 || ia.nextID > ia.maxID {
+		maxID, err := Increment(ia.db, ia.idKey, ia.blockSize)
+		if err != nil {
+			return 0, util.Errorf("unable to allocate block of %d IDs from %q: %v", ia.blockSize, ia.idKey, err)
+		}
+		ia.nextID, ia.maxID = maxID-ia.blockSize+1, maxID
+	}
+	id := ia.nextID
+	ia.nextID++
+	return id, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// TestIDAllocator verifies IDs are allocated in order from blocks
+// and that separate allocators sharing a key never hand out the
+// same ID.
+func TestIDAllocator(t *testing.T) {
+	s := startServer()
+	key := testKey("id-alloc")
+	ia, err := NewIDAllocator(key, s.db, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 25; i++ {
+		id, err := ia.Allocate()
+		if err != nil || id != i {
+			t.Errorf("expected ID %d; got %d, %v", i, id, err)
+		}
+	}
+	// The third block should have been reserved in full.
+	if val, err := Increment(s.db, key, 0); err != nil || val != 30 {
+		t.Errorf("expected generator at 30; got %d, %v", val, err)
+	}
+
+	// Allocate concurrently from two allocators.
+	ia2, err := NewIDAllocator(key, s.db, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	seen := map[int64]bool{}
+	var wg sync.WaitGroup
+	for _, a := range []*IDAllocator{ia, ia, ia2, ia2} {
+		wg.Add(1)
+		go func(a *IDAllocator) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				id, err := a.Allocate()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				if seen[id] {
+					t.Errorf("ID %d allocated twice", id)
+				}
+				seen[id] = true
+				mu.Unlock()
+			}
+		}(a)
+	}
+	wg.Wait()
+}
+
+// TestIDAllocatorBlockSize verifies non-positive block sizes are
+// rejected.
+func TestIDAllocatorBlockSize(t *testing.T) {
+	for _, size := range []int64{0, -1} {
+		if _, err := NewIDAllocator(storage.Key("id-alloc"), nil, size); err == nil {
+			t.Errorf("expected error for block size %d", size)
+		}
+	}
+}
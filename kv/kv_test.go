@@ -18,16 +18,21 @@
 package kv
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"sync"
+	"sync/atomic"
+	"testing"
 
+	"github.com/cockroachdb/cockroach/hlc"
 	"github.com/cockroachdb/cockroach/storage"
 )
 
 var (
 	server *kvTestServer
 	once   sync.Once
+	keySeq int64 // Distinguishes the keys of testKey
 )
 
 type kvTestServer struct {
@@ -44,11 +49,44 @@ func startServer() *kvTestServer {
 			EndKey:   storage.KeyMax,
 		}
 		server = &kvTestServer{}
-		server.db = NewLocalDB(storage.NewRange(meta, storage.NewInMem(storage.Attributes{}, 1<<30), nil, nil))
+		rng := storage.NewRange(meta, hlc.NewHLClock(hlc.UnixNano), storage.NewInMem(storage.Attributes{}, 1<<30), nil, nil, nil)
+		rng.Start()
+		server.db = NewLocalDB(rng)
 		server.rest = NewRESTServer(server.db)
-		server.httpServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			server.rest.HandleAction(w, r)
-		}))
+		mux := http.NewServeMux()
+		mux.HandleFunc(KVKeyPrefix, server.rest.HandleAction)
+		mux.HandleFunc(KVRangePath, server.rest.HandleRangeAction)
+		mux.HandleFunc(KVCounterPrefix, server.rest.HandleCounterAction)
+		mux.HandleFunc(KVBatchPath, server.rest.HandleBatchAction)
+		mux.Handle(DBPrefix, NewDBServer(server.db))
+		server.httpServer = httptest.NewServer(mux)
 	})
 	return server
 }
+
+// testKey returns a key named name which is unique to this run of the
+// test, so that reruns (e.g. with -count) don't find the state left in
+// the shared server by earlier runs.
+func testKey(name string) storage.Key {
+	return storage.Key(fmt.Sprintf("%s-%d", name, atomic.AddInt64(&keySeq, 1)))
+}
+
+// TestIncrement verifies the Increment helper.
+func TestIncrement(t *testing.T) {
+	s := startServer()
+	key := testKey("counter")
+	for i, inc := range []int64{1, 10, -3} {
+		expected := []int64{1, 11, 8}[i]
+		val, err := Increment(s.db, key, inc)
+		if err != nil || val != expected {
+			t.Errorf("%d: expected %d; got %d, %v", i, expected, val, err)
+		}
+	}
+	pr := <-s.db.Put(&storage.PutRequest{Key: storage.Key("not-a-counter"), Value: storage.Value{Bytes: []byte{0xff}}})
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	if _, err := Increment(s.db, storage.Key("not-a-counter"), 1); err == nil {
+		t.Error("expected error incrementing non-integer value")
+	}
+}
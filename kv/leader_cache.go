@@ -0,0 +1,72 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"sync"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// A leaderCache caches the replica holding the leader lease of each
+// range, keyed by the range's start key, so that requests may be sent
+// directly to the leader. Entries are learned from NotLeaderErrors
+// returned by other replicas and are evicted in LRU order once the
+// cache is full.
+type leaderCache struct {
+	mu    sync.Mutex
+	cache *util.UnorderedCache
+}
+
+// leaderCacheMetrics counts the hits and misses of leader caches.
+var leaderCacheMetrics = util.NewCacheMetrics("kv_leader_cache")
+
+// newLeaderCache returns a cache of the leaders of at most size
+// ranges.
+func newLeaderCache(size int) *leaderCache {
+	return &leaderCache{cache: util.NewUnorderedCache(util.CacheConfig{
+		MaxEntries: size,
+		Metrics:    leaderCacheMetrics,
+	})}
+}
+
+// Lookup returns the cached leader of the range starting at startKey
+// and true, or false if no leader is cached.
+func (lc *leaderCache) Lookup(startKey storage.Key) (storage.Replica, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if v, ok := lc.cache.Get(string(startKey)); ok {
+		return v.(storage.Replica), true
+	}
+	return storage.Replica{}, false
+}
+
+// Update caches leader as the leader of the range starting at
+// startKey.
+func (lc *leaderCache) Update(startKey storage.Key, leader storage.Replica) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.cache.Add(string(startKey), leader)
+}
+
+// Evict removes the cached leader of the range starting at startKey,
+// if any.
+func (lc *leaderCache) Evict(startKey storage.Key) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.cache.Del(string(startKey))
+}
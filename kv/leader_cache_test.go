@@ -0,0 +1,53 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// TestLeaderCache verifies leaders are cached by range start key
+// and may be replaced and evicted.
+func TestLeaderCache(t *testing.T) {
+	lc := newLeaderCache(2)
+	if _, ok := lc.Lookup(storage.Key("a")); ok {
+		t.Error("expected no leader in empty cache")
+	}
+	r1 := storage.Replica{NodeID: 1, StoreID: 1, RangeID: 1}
+	r2 := storage.Replica{NodeID: 2, StoreID: 2, RangeID: 1}
+	lc.Update(storage.Key("a"), r1)
+	if l, ok := lc.Lookup(storage.Key("a")); !ok || l.NodeID != r1.NodeID {
+		t.Errorf("expected leader %+v; got %+v, %t", r1, l, ok)
+	}
+	lc.Update(storage.Key("a"), r2)
+	if l, ok := lc.Lookup(storage.Key("a")); !ok || l.NodeID != r2.NodeID {
+		t.Errorf("expected leader %+v; got %+v, %t", r2, l, ok)
+	}
+	lc.Evict(storage.Key("a"))
+	if _, ok := lc.Lookup(storage.Key("a")); ok {
+		t.Error("expected leader to be evicted")
+	}
+
+	// Least recently used leaders are evicted once the cache is full.
+	for _, key := range []string{"a", "b", "c"} {
+		lc.Update(storage.Key(key), r1)
+	}
+	if _, ok := lc.Lookup(storage.Key("a")); ok {
+		t.Error("expected least recently used leader to be evicted")
+	}
+}
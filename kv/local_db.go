@@ -21,6 +21,7 @@ import (
 	"reflect"
 
 	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
 )
 
 // A LocalDB provides methods to access only a local, in-memory key
@@ -30,94 +31,173 @@ type LocalDB struct {
 	rng *storage.Range
 }
 
-// NewLocalDB returns a local-only KV DB for direct access to a store.
+// NewLocalDB returns a local-only KV DB for direct access to a
+// store. The range must have been started via Range.Start().
 func NewLocalDB(rng *storage.Range) *LocalDB {
 	return &LocalDB{rng: rng}
 }
 
-// invokeMethod sends the specified RPC asynchronously and returns a
-// channel which receives the reply struct when the call is
+// executeCmd executes the specified command against the local range,
+// via either Range.ReadOnlyCmd() or Range.ReadWriteCmd(), and returns
+// a channel which receives the reply struct when the call is
 // complete. Returns a channel of the same type as "reply".
-func (db *LocalDB) invokeMethod(method string, args, reply interface{}) interface{} {
+func (db *LocalDB) executeCmd(method string, args, reply interface{}) interface{} {
 	chanVal := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, reflect.TypeOf(reply)), 1)
-	replyVal := reflect.ValueOf(reply)
-	reflect.ValueOf(db.rng).MethodByName(method).Call([]reflect.Value{
-		reflect.ValueOf(args),
-		replyVal,
-	})
-	chanVal.Send(replyVal)
+	// The error, if any, is also set in the reply.
+	if storage.IsReadOnly(method) {
+		db.rng.ReadOnlyCmd(method, args, reply)
+	} else {
+		<-db.rng.ReadWriteCmd(method, args, reply)
+	}
+	chanVal.Send(reflect.ValueOf(reply))
 
 	return chanVal.Interface()
 }
 
 // Contains passes through to local range.
 func (db *LocalDB) Contains(args *storage.ContainsRequest) <-chan *storage.ContainsResponse {
-	return db.invokeMethod("Contains",
+	return db.executeCmd("Contains",
 		args, &storage.ContainsResponse{}).(chan *storage.ContainsResponse)
 }
 
 // Get passes through to local range.
 func (db *LocalDB) Get(args *storage.GetRequest) <-chan *storage.GetResponse {
-	return db.invokeMethod("Get",
+	return db.executeCmd("Get",
 		args, &storage.GetResponse{}).(chan *storage.GetResponse)
 }
 
 // Put passes through to local range.
 func (db *LocalDB) Put(args *storage.PutRequest) <-chan *storage.PutResponse {
-	return db.invokeMethod("Put",
+	return db.executeCmd("Put",
 		args, &storage.PutResponse{}).(chan *storage.PutResponse)
 }
 
+// ConditionalPut passes through to local range.
+func (db *LocalDB) ConditionalPut(args *storage.ConditionalPutRequest) <-chan *storage.ConditionalPutResponse {
+	return db.executeCmd("ConditionalPut",
+		args, &storage.ConditionalPutResponse{}).(chan *storage.ConditionalPutResponse)
+}
+
 // Increment passes through to local range.
 func (db *LocalDB) Increment(args *storage.IncrementRequest) <-chan *storage.IncrementResponse {
-	return db.invokeMethod("Increment",
+	return db.executeCmd("Increment",
 		args, &storage.IncrementResponse{}).(chan *storage.IncrementResponse)
 }
 
 // Delete passes through to local range.
 func (db *LocalDB) Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResponse {
-	return db.invokeMethod("Delete",
+	return db.executeCmd("Delete",
 		args, &storage.DeleteResponse{}).(chan *storage.DeleteResponse)
 }
 
 // DeleteRange passes through to local range.
 func (db *LocalDB) DeleteRange(args *storage.DeleteRangeRequest) <-chan *storage.DeleteRangeResponse {
-	return db.invokeMethod("DeleteRange",
+	return db.executeCmd("DeleteRange",
 		args, &storage.DeleteRangeResponse{}).(chan *storage.DeleteRangeResponse)
 }
 
 // Scan passes through to local range.
 func (db *LocalDB) Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse {
-	return db.invokeMethod("Scan",
+	return db.executeCmd("Scan",
 		args, &storage.ScanResponse{}).(chan *storage.ScanResponse)
 }
 
+// ReverseScan passes through to local range.
+func (db *LocalDB) ReverseScan(args *storage.ReverseScanRequest) <-chan *storage.ReverseScanResponse {
+	return db.executeCmd("ReverseScan",
+		args, &storage.ReverseScanResponse{}).(chan *storage.ReverseScanResponse)
+}
+
 // EndTransaction passes through to local range.
 func (db *LocalDB) EndTransaction(args *storage.EndTransactionRequest) <-chan *storage.EndTransactionResponse {
-	return db.invokeMethod("EndTransaction",
+	return db.executeCmd("EndTransaction",
 		args, &storage.EndTransactionResponse{}).(chan *storage.EndTransactionResponse)
 }
 
+// Batch passes through to local range.
+func (db *LocalDB) Batch(args *storage.BatchRequest) <-chan *storage.BatchResponse {
+	return db.executeCmd("Batch",
+		args, &storage.BatchResponse{}).(chan *storage.BatchResponse)
+}
+
+// AdminSplit splits the local range. The range must have been
+// created by a store, as splits create new ranges.
+func (db *LocalDB) AdminSplit(args *storage.AdminSplitRequest) <-chan *storage.AdminSplitResponse {
+	replyChan := make(chan *storage.AdminSplitResponse, 1)
+	reply := &storage.AdminSplitResponse{}
+	db.rng.AdminSplit(args, reply)
+	replyChan <- reply
+	return replyChan
+}
+
+// AdminMerge merges the local range with the subsequent range. The
+// range must have been created by a store.
+func (db *LocalDB) AdminMerge(args *storage.AdminMergeRequest) <-chan *storage.AdminMergeResponse {
+	replyChan := make(chan *storage.AdminMergeResponse, 1)
+	reply := &storage.AdminMergeResponse{}
+	db.rng.AdminMerge(args, reply)
+	replyChan <- reply
+	return replyChan
+}
+
 // AccumulateTS passes through to local range.
 func (db *LocalDB) AccumulateTS(args *storage.AccumulateTSRequest) <-chan *storage.AccumulateTSResponse {
-	return db.invokeMethod("AccumulateTS",
+	return db.executeCmd("AccumulateTS",
 		args, &storage.AccumulateTSResponse{}).(chan *storage.AccumulateTSResponse)
 }
 
 // ReapQueue passes through to local range.
 func (db *LocalDB) ReapQueue(args *storage.ReapQueueRequest) <-chan *storage.ReapQueueResponse {
-	return db.invokeMethod("ReapQueue",
+	return db.executeCmd("ReapQueue",
 		args, &storage.ReapQueueResponse{}).(chan *storage.ReapQueueResponse)
 }
 
 // EnqueueUpdate passes through to local range.
 func (db *LocalDB) EnqueueUpdate(args *storage.EnqueueUpdateRequest) <-chan *storage.EnqueueUpdateResponse {
-	return db.invokeMethod("EnqueueUpdate",
+	return db.executeCmd("EnqueueUpdate",
 		args, &storage.EnqueueUpdateResponse{}).(chan *storage.EnqueueUpdateResponse)
 }
 
 // EnqueueMessage passes through to local range.
 func (db *LocalDB) EnqueueMessage(args *storage.EnqueueMessageRequest) <-chan *storage.EnqueueMessageResponse {
-	return db.invokeMethod("EnqueueMessage",
+	return db.executeCmd("EnqueueMessage",
 		args, &storage.EnqueueMessageResponse{}).(chan *storage.EnqueueMessageResponse)
 }
+
+// InternalPushTxn passes through to local range.
+func (db *LocalDB) InternalPushTxn(args *storage.InternalPushTxnRequest) <-chan *storage.InternalPushTxnResponse {
+	return db.executeCmd("InternalPushTxn",
+		args, &storage.InternalPushTxnResponse{}).(chan *storage.InternalPushTxnResponse)
+}
+
+// InternalResolveIntent passes through to local range.
+func (db *LocalDB) InternalResolveIntent(args *storage.InternalResolveIntentRequest) <-chan *storage.InternalResolveIntentResponse {
+	return db.executeCmd("InternalResolveIntent",
+		args, &storage.InternalResolveIntentResponse{}).(chan *storage.InternalResolveIntentResponse)
+}
+
+// InternalHeartbeatTxn passes through to local range.
+func (db *LocalDB) InternalHeartbeatTxn(args *storage.InternalHeartbeatTxnRequest) <-chan *storage.InternalHeartbeatTxnResponse {
+	return db.executeCmd("InternalHeartbeatTxn",
+		args, &storage.InternalHeartbeatTxnResponse{}).(chan *storage.InternalHeartbeatTxnResponse)
+}
+
+// InternalSnapshot isn't supported by LocalDB, which has no access to
+// other stores.
+func (db *LocalDB) InternalSnapshot(args *storage.InternalSnapshotRequest) <-chan *storage.InternalSnapshotResponse {
+	replyChan := make(chan *storage.InternalSnapshotResponse, 1)
+	replyChan <- &storage.InternalSnapshotResponse{
+		ResponseHeader: storage.ResponseHeader{Error: util.Error("LocalDB cannot send snapshots")},
+	}
+	return replyChan
+}
+
+// InternalChecksum isn't supported by LocalDB, which has no access to
+// other stores.
+func (db *LocalDB) InternalChecksum(args *storage.InternalChecksumRequest) <-chan *storage.InternalChecksumResponse {
+	replyChan := make(chan *storage.InternalChecksumResponse, 1)
+	replyChan <- &storage.InternalChecksumResponse{
+		ResponseHeader: storage.ResponseHeader{Error: util.Error("LocalDB cannot request checksums")},
+	}
+	return replyChan
+}
@@ -0,0 +1,154 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"sync"
+
+	"code.google.com/p/biogo.store/llrb"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// rangeLookupFunc looks up the descriptor of the range containing
+// key or, if reverse is true, the range containing the keys just
+// before key (see storage.ReverseScanRequest). It returns the key of the range addressing record the
+// descriptor was read from, or nil if the descriptor wasn't read from
+// an addressing record (as is the case for the first range, which is
+// located via gossip). Descriptors without a record key aren't cached.
+type rangeLookupFunc func(key storage.Key, reverse bool) (storage.Key, *storage.RangeDescriptor, error)
+
+// A rangeCacheKey is the key of a cached range descriptor: the key of
+// the range addressing record it was read from. Since addressing
+// records are keyed by the range's end key (see storage.RangeMetaKey),
+// the entry for the range containing a key K is the first entry with
+// a record key greater than RangeMetaKey(K), and the entry for the
+// range containing the keys just before K is the first entry with a
+// record key greater than or equal to it.
+type rangeCacheKey storage.Key
+
+// Compare implements the llrb.Comparable interface for cache keys.
+func (a rangeCacheKey) Compare(b llrb.Comparable) int {
+	return bytes.Compare(a, b.(rangeCacheKey))
+}
+
+// A rangeDescriptorCache caches range descriptors read from range
+// addressing records, so that requests don't have to look up the
+// addressing records of their key on every invocation. Descriptors
+// are evicted in LRU order once the cache is full. Cached descriptors
+// become stale when ranges split, merge or change replicas; callers
+// evict the descriptor for a key on errors which indicate the
+// descriptor is stale, and look it up anew.
+type rangeDescriptorCache struct {
+	lookupFn rangeLookupFunc
+
+	mu         sync.Mutex
+	rangeCache *util.OrderedCache // Keyed by rangeCacheKey
+}
+
+// rangeCacheMetrics counts the hits and misses of range descriptor
+// caches.
+var rangeCacheMetrics = util.NewCacheMetrics("kv_range_cache")
+
+// newRangeDescriptorCache returns a cache of at most size range
+// descriptors, using lookupFn to look up descriptors on cache misses.
+func newRangeDescriptorCache(lookupFn rangeLookupFunc, size int) *rangeDescriptorCache {
+	return &rangeDescriptorCache{
+		lookupFn: lookupFn,
+		rangeCache: util.NewOrderedCache(util.CacheConfig{
+			MaxEntries: size,
+			Metrics:    rangeCacheMetrics,
+		}),
+	}
+}
+
+// LookupRangeDescriptor returns the descriptor of the range which
+// contains key or, if reverse is true, the keys just before key, from
+// the cache if possible. On a cache miss, the descriptor is looked up
+// and added to the cache.
+func (rdc *rangeDescriptorCache) LookupRangeDescriptor(key storage.Key, reverse bool) (*storage.RangeDescriptor, error) {
+	rdc.mu.Lock()
+	desc := rdc.getCachedRangeDescriptorLocked(key, reverse)
+	rdc.mu.Unlock()
+	if desc != nil {
+		return desc, nil
+	}
+
+	metaKey, desc, err := rdc.lookupFn(key, reverse)
+	if err != nil {
+		return nil, err
+	}
+	if len(metaKey) > 0 {
+		rdc.mu.Lock()
+		rdc.rangeCache.Add(rangeCacheKey(metaKey), desc)
+		rdc.mu.Unlock()
+	}
+	return desc, nil
+}
+
+// EvictCachedRangeDescriptor removes the cached descriptor of the
+// range containing key or, if reverse is true, the keys just before
+// key, if any.
+func (rdc *rangeDescriptorCache) EvictCachedRangeDescriptor(key storage.Key, reverse bool) {
+	rdc.mu.Lock()
+	defer rdc.mu.Unlock()
+	if entry := rdc.getCachedEntryLocked(key, reverse); entry != nil {
+		rdc.rangeCache.Del(entry.Key)
+	}
+}
+
+// getCachedRangeDescriptorLocked returns the cached descriptor of
+// the range containing key (or the keys before it, if reverse) and
+// marks it as recently used, or returns nil if there is none. The
+// cache's mutex must be held.
+func (rdc *rangeDescriptorCache) getCachedRangeDescriptorLocked(key storage.Key, reverse bool) *storage.RangeDescriptor {
+	entry := rdc.getCachedEntryLocked(key, reverse)
+	if entry == nil {
+		rdc.rangeCache.Metrics.Misses.Inc(1)
+		return nil
+	}
+	desc, _ := rdc.rangeCache.Get(entry.Key)
+	return desc.(*storage.RangeDescriptor)
+}
+
+// getCachedEntryLocked returns the cached entry for the range
+// containing key (or the keys before it, if reverse), or nil if there
+// is none. The cache's mutex must be held.
+func (rdc *rangeDescriptorCache) getCachedEntryLocked(key storage.Key, reverse bool) *util.CacheEntry {
+	metaKey := storage.RangeMetaKey(key)
+	if len(metaKey) == 0 {
+		return nil
+	}
+	ceilKey := storage.MakeKey(metaKey, storage.Key{0})
+	if reverse {
+		ceilKey = metaKey
+	}
+	entry := rdc.rangeCache.Ceil(rangeCacheKey(ceilKey))
+	if entry == nil {
+		return nil
+	}
+	// The entry must be an addressing record at the same level as
+	// metaKey and its range must start at or before key (strictly
+	// before, if reverse).
+	if !bytes.HasPrefix(entry.Key.(rangeCacheKey), metaKey[:len(storage.KeyMeta1Prefix)]) {
+		return nil
+	}
+	if c := bytes.Compare(entry.Value.(*storage.RangeDescriptor).StartKey, key); c > 0 || (reverse && c == 0) {
+		return nil
+	}
+	return entry
+}
@@ -0,0 +1,156 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// testRangeLookup is a rangeLookupFunc over a fixed set of split
+// keys, which counts the number of lookups.
+type testRangeLookup struct {
+	splitKeys []storage.Key // Sorted; the last must be KeyMax
+	lookups   int
+}
+
+func (tl *testRangeLookup) lookup(key storage.Key, reverse bool) (storage.Key, *storage.RangeDescriptor, error) {
+	tl.lookups++
+	startKey := storage.KeyMin
+	for _, endKey := range tl.splitKeys {
+		if c := bytes.Compare(key, endKey); c < 0 || (reverse && c == 0) {
+			return storage.RangeMetaKey(endKey), &storage.RangeDescriptor{StartKey: startKey}, nil
+		}
+		startKey = endKey
+	}
+	panic("key not contained in any range")
+}
+
+// TestRangeCacheLookupAndEvict verifies that range descriptors are
+// cached after lookup, that lookups of keys in a cached range don't
+// miss, and that evicted descriptors are looked up anew.
+func TestRangeCacheLookupAndEvict(t *testing.T) {
+	tl := &testRangeLookup{splitKeys: []storage.Key{storage.Key("a"), storage.Key("c"), storage.KeyMax}}
+	rdc := newRangeDescriptorCache(tl.lookup, 10)
+
+	testCases := []struct {
+		key       storage.Key
+		expStart  storage.Key
+		expLookup int
+	}{
+		{storage.Key("b"), storage.Key("a"), 1},
+		{storage.Key("a"), storage.Key("a"), 1},
+		{storage.Key("bzzz"), storage.Key("a"), 1},
+		{storage.Key("c"), storage.Key("c"), 2},
+		{storage.Key("z"), storage.Key("c"), 2},
+		{storage.Key("0"), storage.KeyMin, 3},
+		{storage.Key("b"), storage.Key("a"), 3},
+	}
+	for i, test := range testCases {
+		desc, err := rdc.LookupRangeDescriptor(test.key, false)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if !bytes.Equal(desc.StartKey, test.expStart) {
+			t.Errorf("%d: expected start key %q; got %q", i, test.expStart, desc.StartKey)
+		}
+		if tl.lookups != test.expLookup {
+			t.Errorf("%d: expected %d lookups; got %d", i, test.expLookup, tl.lookups)
+		}
+	}
+
+	// Evicting the range containing "b" forces a new lookup, while
+	// other ranges remain cached.
+	rdc.EvictCachedRangeDescriptor(storage.Key("bb"), false)
+	if _, err := rdc.LookupRangeDescriptor(storage.Key("d"), false); err != nil || tl.lookups != 3 {
+		t.Errorf("expected cached lookup of \"d\"; got %d lookups, err %v", tl.lookups, err)
+	}
+	if _, err := rdc.LookupRangeDescriptor(storage.Key("b"), false); err != nil || tl.lookups != 4 {
+		t.Errorf("expected lookup of \"b\" after eviction; got %d lookups, err %v", tl.lookups, err)
+	}
+}
+
+// TestRangeCacheReverseLookup verifies that reverse lookups find the
+// range containing the keys before the key looked up, sharing cached
+// descriptors with forward lookups.
+func TestRangeCacheReverseLookup(t *testing.T) {
+	tl := &testRangeLookup{splitKeys: []storage.Key{storage.Key("a"), storage.Key("c"), storage.KeyMax}}
+	rdc := newRangeDescriptorCache(tl.lookup, 10)
+
+	testCases := []struct {
+		key       storage.Key
+		reverse   bool
+		expStart  storage.Key
+		expLookup int
+	}{
+		{storage.Key("c"), true, storage.Key("a"), 1},
+		{storage.Key("b"), false, storage.Key("a"), 1},
+		{storage.Key("b"), true, storage.Key("a"), 1},
+		{storage.Key("c"), false, storage.Key("c"), 2},
+		{storage.KeyMax, true, storage.Key("c"), 2},
+		{storage.Key("a"), true, storage.KeyMin, 3},
+	}
+	for i, test := range testCases {
+		desc, err := rdc.LookupRangeDescriptor(test.key, test.reverse)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if !bytes.Equal(desc.StartKey, test.expStart) {
+			t.Errorf("%d: expected start key %q; got %q", i, test.expStart, desc.StartKey)
+		}
+		if tl.lookups != test.expLookup {
+			t.Errorf("%d: expected %d lookups; got %d", i, test.expLookup, tl.lookups)
+		}
+	}
+
+	// Evicting the range before "c" leaves the range containing it.
+	rdc.EvictCachedRangeDescriptor(storage.Key("c"), true)
+	if _, err := rdc.LookupRangeDescriptor(storage.Key("c"), false); err != nil || tl.lookups != 3 {
+		t.Errorf("expected cached lookup of \"c\"; got %d lookups, err %v", tl.lookups, err)
+	}
+	if _, err := rdc.LookupRangeDescriptor(storage.Key("b"), false); err != nil || tl.lookups != 4 {
+		t.Errorf("expected lookup of \"b\" after eviction; got %d lookups, err %v", tl.lookups, err)
+	}
+}
+
+// TestRangeCacheLRUEviction verifies that the least recently used
+// descriptor is evicted once the cache is full.
+func TestRangeCacheLRUEviction(t *testing.T) {
+	tl := &testRangeLookup{splitKeys: []storage.Key{storage.Key("a"), storage.Key("c"), storage.KeyMax}}
+	rdc := newRangeDescriptorCache(tl.lookup, 2)
+
+	for _, key := range []string{"b", "d", "b", "0"} {
+		if _, err := rdc.LookupRangeDescriptor(storage.Key(key), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tl.lookups != 3 {
+		t.Fatalf("expected 3 lookups; got %d", tl.lookups)
+	}
+	// The range containing "d" was least recently used and must have
+	// been evicted.
+	if _, err := rdc.LookupRangeDescriptor(storage.Key("d"), false); err != nil || tl.lookups != 4 {
+		t.Errorf("expected lookup of evicted range; got %d lookups, err %v", tl.lookups, err)
+	}
+	if _, err := rdc.LookupRangeDescriptor(storage.Key("0"), false); err != nil || tl.lookups != 4 {
+		t.Errorf("expected cached lookup; got %d lookups, err %v", tl.lookups, err)
+	}
+	if l := rdc.rangeCache.Len(); l != 2 {
+		t.Errorf("expected 2 cached entries; got %d", l)
+	}
+}
@@ -18,12 +18,17 @@
 package kv
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
+	"github.com/cockroachdb/cockroach/hlc"
 	"github.com/cockroachdb/cockroach/storage"
 )
 
@@ -31,8 +36,100 @@ const (
 	// KVKeyPrefix is the prefix for RESTful endpoints used to
 	// interact directly with the key-value datastore.
 	KVKeyPrefix = "/db/"
+	// AsOfParam is the query parameter which specifies, for GET
+	// requests, the wall time in nanoseconds since the Unix epoch at
+	// which to read the key.
+	AsOfParam = "as_of"
+
+	// KVRangePath is the RESTful endpoint used to scan (GET) or delete
+	// (DELETE) the keys between the StartParam and EndParam query
+	// parameters, up to LimitParam keys.
+	KVRangePath = "/db-range"
+	// KVCounterPrefix is the prefix for RESTful endpoints used to read
+	// (GET) or increment (POST, PUT) integer counters. The increment
+	// is given in the request body and defaults to 1.
+	KVCounterPrefix = "/db-counter/"
+	// KVBatchPath is the RESTful endpoint used to execute a batch of
+	// operations (POST) in a single round trip. All operations must
+	// address keys in the same range. Operations execute at the same
+	// timestamp, so a key may be written at most once per batch.
+	KVBatchPath = "/db-batch"
+
+	// StartParam is the query parameter specifying the first key of a
+	// range. It defaults to the first key.
+	StartParam = "start"
+	// EndParam is the query parameter specifying the end of a range,
+	// exclusive. It defaults to the end of the keyspace.
+	EndParam = "end"
+	// LimitParam is the query parameter limiting the number of keys
+	// scanned or deleted. Zero (the default) for no limit.
+	LimitParam = "limit"
+	// KeysOnlyParam is the query parameter which, if "true", scans
+	// return keys without their values.
+	KeysOnlyParam = "keys_only"
+
+	// JSONContentType is the content type of JSON-encoded bodies, the
+	// default for the range, counter and batch endpoints. Keys and
+	// values are base64 encoded, as for all byte slices in JSON.
+	JSONContentType = "application/json"
+	// GobContentType is the content type of gob-encoded bodies,
+	// suitable for Go clients.
+	GobContentType = "application/x-gob"
+
+	// UserHeader is the HTTP header naming the user on whose behalf a
+	// request is made. Access to keys is subject to the user's
+	// permissions; see storage.PermConfig.
+	UserHeader = "X-Cockroach-User"
+	// AnonymousUser is the user of requests which don't specify one.
+	AnonymousUser = "anonymous"
 )
 
+// A RESTKeyValue is a key and its value as returned by range scans.
+type RESTKeyValue struct {
+	Key   []byte
+	Value []byte `json:",omitempty"`
+}
+
+// A RESTRange is the response to a range scan or deletion. Deletions
+// only report the number of keys deleted.
+type RESTRange struct {
+	Rows       []RESTKeyValue `json:",omitempty"`
+	NumDeleted int64          `json:",omitempty"`
+}
+
+// A RESTCounter is the value of a counter.
+type RESTCounter struct {
+	Key   []byte
+	Value int64
+}
+
+// A RESTOp is a single operation within a batch. Op is one of "get",
+// "put", "delete" or "increment".
+type RESTOp struct {
+	Op        string
+	Key       []byte
+	Value     []byte `json:",omitempty"` // Value to put
+	Increment int64  `json:",omitempty"` // Increment to apply
+}
+
+// A RESTBatch is a batch of operations sent to KVBatchPath.
+type RESTBatch struct {
+	Ops []RESTOp
+}
+
+// A RESTResult is the result of a single operation within a batch.
+// Value is set by gets of existing keys and NewValue by increments.
+type RESTResult struct {
+	Value    []byte `json:",omitempty"`
+	NewValue int64  `json:",omitempty"`
+}
+
+// A RESTBatchResponse holds the results of a batch's operations, in
+// the order of the operations.
+type RESTBatchResponse struct {
+	Results []RESTResult
+}
+
 // A RESTServer provides a RESTful HTTP API to interact with
 // an underlying key-value store.
 type RESTServer struct {
@@ -59,8 +156,221 @@ func (s *RESTServer) HandleAction(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func dbKey(path string) (storage.Key, error) {
-	result, err := url.QueryUnescape(strings.TrimPrefix(path, KVKeyPrefix))
+// HandleRangeAction scans or deletes the range of keys specified by
+// the request's query parameters.
+func (s *RESTServer) HandleRangeAction(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	start, end := storage.Key(q.Get(StartParam)), storage.Key(q.Get(EndParam))
+	if len(start) == 0 {
+		start = storage.KeyMin
+	}
+	if len(end) == 0 {
+		end = storage.KeyMax
+	}
+	var limit int64
+	if l := q.Get(LimitParam); l != "" {
+		var err error
+		if limit, err = strconv.ParseInt(l, 10, 64); err != nil || limit < 0 {
+			http.Error(w, fmt.Sprintf("invalid %s %q", LimitParam, l), http.StatusBadRequest)
+			return
+		}
+	}
+
+	resp := &RESTRange{}
+	switch r.Method {
+	case "GET":
+		sr := <-s.db.Scan(&storage.ScanRequest{RequestHeader: requestHeader(r), StartKey: start, EndKey: end, MaxResults: limit,
+			KeysOnly: q.Get(KeysOnlyParam) == "true"})
+		if sr.Error != nil {
+			writeError(w, sr.Error)
+			return
+		}
+		for _, kv := range sr.Rows {
+			resp.Rows = append(resp.Rows, RESTKeyValue{Key: kv.Key, Value: kv.Value.Bytes})
+		}
+	case "DELETE":
+		dr := <-s.db.DeleteRange(&storage.DeleteRangeRequest{RequestHeader: requestHeader(r), StartKey: start, EndKey: end, MaxEntriesToDelete: limit})
+		if dr.Error != nil {
+			writeError(w, dr.Error)
+			return
+		}
+		resp.NumDeleted = dr.NumDeleted
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	writeBody(w, r, resp)
+}
+
+// HandleCounterAction reads or increments the counter addressed by
+// the request path.
+func (s *RESTServer) HandleCounterAction(w http.ResponseWriter, r *http.Request) {
+	key, err := dbKey(r.URL.Path, KVCounterPrefix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var inc int64
+	switch r.Method {
+	case "GET":
+		// Incrementing by zero reads the counter.
+	case "PUT", "POST":
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer r.Body.Close()
+		inc = 1
+		if incStr := strings.TrimSpace(string(b)); incStr != "" {
+			if inc, err = strconv.ParseInt(incStr, 10, 64); err != nil {
+				http.Error(w, fmt.Sprintf("invalid increment %q", incStr), http.StatusBadRequest)
+				return
+			}
+		}
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	ir := <-s.db.Increment(&storage.IncrementRequest{RequestHeader: requestHeader(r), Key: key, Increment: inc})
+	if ir.Error != nil {
+		writeError(w, ir.Error)
+		return
+	}
+	writeBody(w, r, &RESTCounter{Key: key, Value: ir.NewValue})
+}
+
+// HandleBatchAction executes the batch of operations in the request
+// body.
+func (s *RESTServer) HandleBatchAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	batch := &RESTBatch{}
+	if err := readBody(r, batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	args := &storage.BatchRequest{RequestHeader: requestHeader(r)}
+	for i, op := range batch.Ops {
+		if len(op.Key) == 0 {
+			http.Error(w, fmt.Sprintf("operation %d: empty key not allowed", i), http.StatusBadRequest)
+			return
+		}
+		var req storage.Request
+		switch op.Op {
+		case "get":
+			req = &storage.GetRequest{Key: op.Key}
+		case "put":
+			req = &storage.PutRequest{Key: op.Key, Value: storage.Value{Bytes: op.Value}}
+		case "delete":
+			req = &storage.DeleteRequest{Key: op.Key}
+		case "increment":
+			req = &storage.IncrementRequest{Key: op.Key, Increment: op.Increment}
+		default:
+			http.Error(w, fmt.Sprintf("operation %d: unknown op %q", i, op.Op), http.StatusBadRequest)
+			return
+		}
+		args.Requests = append(args.Requests, req)
+	}
+	if len(args.Requests) == 0 {
+		writeBody(w, r, &RESTBatchResponse{})
+		return
+	}
+	br := <-s.db.Batch(args)
+	if br.Error != nil {
+		writeError(w, br.Error)
+		return
+	}
+	resp := &RESTBatchResponse{Results: make([]RESTResult, len(br.Responses))}
+	for i, reply := range br.Responses {
+		if err := reply.Header().Error; err != nil {
+			writeError(w, err)
+			return
+		}
+		switch t := reply.(type) {
+		case *storage.GetResponse:
+			resp.Results[i].Value = t.Value.Bytes
+		case *storage.IncrementResponse:
+			resp.Results[i].NewValue = t.NewValue
+		}
+	}
+	writeBody(w, r, resp)
+}
+
+// requestHeader returns the header for KV requests made on behalf of
+// the user of the HTTP request.
+func requestHeader(r *http.Request) storage.RequestHeader {
+	user := r.Header.Get(UserHeader)
+	if user == "" {
+		user = AnonymousUser
+	}
+	return storage.RequestHeader{User: user}
+}
+
+// writeError writes the error returned by a KV request with an HTTP
+// status appropriate to its type.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err.(type) {
+	case *storage.PermissionError:
+		status = http.StatusForbidden
+	case *storage.ReadTooOldError:
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// contentType returns the content type of the request body: gob if
+// specified, otherwise JSON.
+func contentType(r *http.Request) string {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), GobContentType) {
+		return GobContentType
+	}
+	return JSONContentType
+}
+
+// readBody decodes the request body into v according to the
+// request's content type.
+func readBody(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	var err error
+	if contentType(r) == GobContentType {
+		err = gob.NewDecoder(r.Body).Decode(v)
+	} else {
+		err = json.NewDecoder(r.Body).Decode(v)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to decode request body: %v", err)
+	}
+	return nil
+}
+
+// writeBody encodes v as the response body. The response is gob
+// encoded if the request accepts gob, otherwise JSON encoded.
+func writeBody(w http.ResponseWriter, r *http.Request, v interface{}) {
+	var b []byte
+	var err error
+	ct := JSONContentType
+	if strings.Contains(r.Header.Get("Accept"), GobContentType) {
+		ct = GobContentType
+		var buf bytes.Buffer
+		err = gob.NewEncoder(&buf).Encode(v)
+		b = buf.Bytes()
+	} else {
+		b, err = json.Marshal(v)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Write(b)
+}
+
+func dbKey(path, prefix string) (storage.Key, error) {
+	result, err := url.QueryUnescape(strings.TrimPrefix(path, prefix))
 	if err == nil {
 		k := storage.Key(result)
 		if len(k) == 0 {
@@ -72,7 +382,7 @@ func dbKey(path string) (storage.Key, error) {
 }
 
 func (s *RESTServer) handlePutAction(w http.ResponseWriter, r *http.Request) {
-	key, err := dbKey(r.URL.Path)
+	key, err := dbKey(r.URL.Path, KVKeyPrefix)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -83,23 +393,32 @@ func (s *RESTServer) handlePutAction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
-	pr := <-s.db.Put(&storage.PutRequest{Key: key, Value: storage.Value{Bytes: b}})
+	pr := <-s.db.Put(&storage.PutRequest{RequestHeader: requestHeader(r), Key: key, Value: storage.Value{Bytes: b}})
 	if pr.Error != nil {
-		http.Error(w, pr.Error.Error(), http.StatusInternalServerError)
+		writeError(w, pr.Error)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
 func (s *RESTServer) handleGetAction(w http.ResponseWriter, r *http.Request) {
-	key, err := dbKey(r.URL.Path)
+	key, err := dbKey(r.URL.Path, KVKeyPrefix)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	gr := <-s.db.Get(&storage.GetRequest{Key: key})
+	args := &storage.GetRequest{RequestHeader: requestHeader(r), Key: key}
+	if asOf := r.URL.Query().Get(AsOfParam); asOf != "" {
+		wallTime, err := strconv.ParseInt(asOf, 10, 64)
+		if err != nil || wallTime <= 0 {
+			http.Error(w, fmt.Sprintf("invalid %s timestamp %q", AsOfParam, asOf), http.StatusBadRequest)
+			return
+		}
+		args.Timestamp = hlc.HLTimestamp{WallTime: wallTime}
+	}
+	gr := <-s.db.Get(args)
 	if gr.Error != nil {
-		http.Error(w, gr.Error.Error(), http.StatusInternalServerError)
+		writeError(w, gr.Error)
 		return
 	}
 	// An empty key will not be nil, but have zero length.
@@ -112,14 +431,14 @@ func (s *RESTServer) handleGetAction(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *RESTServer) handleDeleteAction(w http.ResponseWriter, r *http.Request) {
-	key, err := dbKey(r.URL.Path)
+	key, err := dbKey(r.URL.Path, KVKeyPrefix)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	dr := <-s.db.Delete(&storage.DeleteRequest{Key: key})
+	dr := <-s.db.Delete(&storage.DeleteRequest{RequestHeader: requestHeader(r), Key: key})
 	if dr.Error != nil {
-		http.Error(w, dr.Error.Error(), http.StatusInternalServerError)
+		writeError(w, dr.Error)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
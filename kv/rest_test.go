@@ -18,12 +18,22 @@
 package kv
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 // TestKVRESTEndpoints tests that the REST endpoints for modifying KV
@@ -64,7 +74,7 @@ func TestRESTEndpoints(t *testing.T) {
 		}
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
-			glog.Fatal(err)
+			log.New("kv").Fatalf("%v", err)
 		}
 		defer resp.Body.Close()
 		b, err := ioutil.ReadAll(resp.Body)
@@ -74,6 +84,54 @@ func TestRESTEndpoints(t *testing.T) {
 	}
 }
 
+// TestRESTGetAsOf verifies that GET requests may read keys as of a
+// historical timestamp and that timestamps outside the GC TTL are
+// rejected.
+func TestRESTGetAsOf(t *testing.T) {
+	s := startServer()
+	url := s.httpServer.URL + KVKeyPrefix + string(testKey("as_of_key"))
+	before := time.Now().UnixNano() - 1
+	req, err := http.NewRequest("PUT", url, strings.NewReader("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	after := time.Now().UnixNano()
+
+	testCases := []struct {
+		asOf     string
+		status   int
+		response string
+	}{
+		{fmt.Sprint(before), http.StatusNotFound, "key not found\n"},
+		{fmt.Sprint(after), http.StatusOK, "value"},
+		{"", http.StatusOK, "value"},
+		{"1", http.StatusBadRequest, ""},
+		{"yesterday", http.StatusBadRequest, "invalid as_of timestamp \"yesterday\"\n"},
+	}
+	for i, c := range testCases {
+		resp, err := http.Get(url + "?" + AsOfParam + "=" + c.asOf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != c.status {
+			t.Errorf("%d: expected status %d; got %d (%q)", i, c.status, resp.StatusCode, b)
+		}
+		if c.response != "" && string(b) != c.response {
+			t.Errorf("%d: expected response %q; got %q", i, c.response, b)
+		}
+	}
+}
+
 // TestKeyUnescape ensures that keys specified via URL paths are properly decoded.
 func TestKeyUnescape(t *testing.T) {
 	testCases := map[string]string{
@@ -81,7 +139,7 @@ func TestKeyUnescape(t *testing.T) {
 		"Hello%2C+%E4%B8%96%E7%95%8C": "Hello, 世界",
 	}
 	for escaped, expected := range testCases {
-		key, err := dbKey(KVKeyPrefix + escaped)
+		key, err := dbKey(KVKeyPrefix+escaped, KVKeyPrefix)
 		if err != nil {
 			t.Errorf("error getting db key from path %s: %s", KVKeyPrefix+escaped, err)
 			continue
@@ -91,3 +149,209 @@ func TestKeyUnescape(t *testing.T) {
 		}
 	}
 }
+
+// TestRESTUser verifies the user of a REST request is taken from the
+// user header, defaulting to the anonymous user.
+func TestRESTUser(t *testing.T) {
+	testCases := []struct {
+		header, user string
+	}{
+		{"", AnonymousUser},
+		{"spencer", "spencer"},
+	}
+	for i, test := range testCases {
+		r, err := http.NewRequest("GET", KVKeyPrefix+"a", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.header != "" {
+			r.Header.Set(UserHeader, test.header)
+		}
+		if user := requestHeader(r).User; user != test.user {
+			t.Errorf("%d: expected user %q; got %q", i, test.user, user)
+		}
+	}
+}
+
+// TestRESTErrorStatus verifies KV errors map to HTTP statuses.
+func TestRESTErrorStatus(t *testing.T) {
+	testCases := []struct {
+		err    error
+		status int
+	}{
+		{&storage.PermissionError{User: "foo", Key: storage.Key("a"), Write: true}, http.StatusForbidden},
+		{&storage.ReadTooOldError{}, http.StatusBadRequest},
+		{fmt.Errorf("boom"), http.StatusInternalServerError},
+	}
+	for i, test := range testCases {
+		w := httptest.NewRecorder()
+		writeError(w, test.err)
+		if w.Code != test.status {
+			t.Errorf("%d: expected status %d; got %d", i, test.status, w.Code)
+		}
+	}
+}
+
+// doREST sends a request with the specified body to the test server
+// and returns the response body, failing the test on an unexpected
+// status.
+func doREST(method, path string, body io.Reader, header http.Header, status int, t *testing.T) []byte {
+	s := startServer()
+	req, err := http.NewRequest(method, s.httpServer.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s: expected status %d; got %d (%q)", method, path, status, resp.StatusCode, b)
+	}
+	return b
+}
+
+// TestRESTRange verifies scans and deletions of key ranges.
+func TestRESTRange(t *testing.T) {
+	for _, k := range []string{"range/a", "range/b", "range/c"} {
+		doREST("PUT", KVKeyPrefix+k, strings.NewReader("v-"+k), nil, http.StatusOK, t)
+	}
+	query := func(start, end string, limit int) string {
+		return fmt.Sprintf("%s?%s=%s&%s=%s&%s=%d", KVRangePath, StartParam, url.QueryEscape(start),
+			EndParam, url.QueryEscape(end), LimitParam, limit)
+	}
+	scan := func(start, end string, limit int) []string {
+		var resp RESTRange
+		if err := json.Unmarshal(doREST("GET", query(start, end, limit), nil, nil, http.StatusOK, t), &resp); err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, kv := range resp.Rows {
+			if string(kv.Value) != "v-"+string(kv.Key) {
+				t.Errorf("unexpected value %q for key %q", kv.Value, kv.Key)
+			}
+			keys = append(keys, string(kv.Key))
+		}
+		return keys
+	}
+
+	if keys := scan("range/", "range0", 0); !reflect.DeepEqual(keys, []string{"range/a", "range/b", "range/c"}) {
+		t.Errorf("unexpected scan result %q", keys)
+	}
+	if keys := scan("range/b", "range0", 1); !reflect.DeepEqual(keys, []string{"range/b"}) {
+		t.Errorf("unexpected limited scan result %q", keys)
+	}
+	doREST("GET", KVRangePath+"?"+LimitParam+"=-1", nil, nil, http.StatusBadRequest, t)
+
+	var keysOnly RESTRange
+	if err := json.Unmarshal(doREST("GET", query("range/", "range0", 0)+"&"+KeysOnlyParam+"=true", nil, nil, http.StatusOK, t), &keysOnly); err != nil {
+		t.Fatal(err)
+	}
+	if len(keysOnly.Rows) != 3 || keysOnly.Rows[0].Value != nil {
+		t.Errorf("expected 3 rows without values; got %+v", keysOnly.Rows)
+	}
+
+	var resp RESTRange
+	if err := json.Unmarshal(doREST("DELETE", query("range/a", "range/c", 0), nil, nil, http.StatusOK, t), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.NumDeleted != 2 {
+		t.Errorf("expected 2 keys deleted; got %d", resp.NumDeleted)
+	}
+	if keys := scan("range/", "range0", 0); !reflect.DeepEqual(keys, []string{"range/c"}) {
+		t.Errorf("unexpected scan result after deletion %q", keys)
+	}
+}
+
+// TestRESTCounter verifies counters may be read and incremented.
+func TestRESTCounter(t *testing.T) {
+	testCases := []struct {
+		method, body string
+		status       int
+		expected     int64
+	}{
+		{"GET", "", http.StatusOK, 0},
+		{"POST", "", http.StatusOK, 1},
+		{"PUT", "10", http.StatusOK, 11},
+		{"POST", "-3\n", http.StatusOK, 8},
+		{"POST", "many", http.StatusBadRequest, 0},
+		{"GET", "", http.StatusOK, 8},
+		{"DELETE", "", http.StatusBadRequest, 0},
+	}
+	key := testKey("my_counter")
+	for i, c := range testCases {
+		b := doREST(c.method, KVCounterPrefix+string(key), strings.NewReader(c.body), nil, c.status, t)
+		if c.status != http.StatusOK {
+			continue
+		}
+		var counter RESTCounter
+		if err := json.Unmarshal(b, &counter); err != nil {
+			t.Fatal(err)
+		}
+		if counter.Value != c.expected || string(counter.Key) != string(key) {
+			t.Errorf("%d: expected %s=%d; got %+v", i, key, c.expected, counter)
+		}
+	}
+}
+
+// TestRESTBatch verifies batches of operations with both JSON and
+// gob encoded bodies.
+func TestRESTBatch(t *testing.T) {
+	a, b, c, counter := testKey("batch-a"), testKey("batch-b"), testKey("batch-c"), testKey("batch-counter")
+	doREST("PUT", KVKeyPrefix+string(b), strings.NewReader("2"), nil, http.StatusOK, t)
+	doREST("PUT", KVKeyPrefix+string(c), strings.NewReader("3"), nil, http.StatusOK, t)
+	batch := &RESTBatch{Ops: []RESTOp{
+		{Op: "put", Key: a, Value: []byte("1")},
+		{Op: "get", Key: b},
+		{Op: "increment", Key: counter, Increment: 5},
+		{Op: "delete", Key: c},
+		{Op: "get", Key: testKey("batch-missing")},
+	}}
+	expected := &RESTBatchResponse{Results: []RESTResult{
+		{}, {Value: []byte("2")}, {NewValue: 5}, {}, {},
+	}}
+
+	// JSON.
+	body, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &RESTBatchResponse{}
+	if err := json.Unmarshal(doREST("POST", KVBatchPath, bytes.NewReader(body), nil, http.StatusOK, t), resp); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Errorf("expected %+v; got %+v", expected, resp)
+	}
+	doREST("GET", KVKeyPrefix+string(a), nil, nil, http.StatusOK, t)
+	doREST("GET", KVKeyPrefix+string(c), nil, nil, http.StatusNotFound, t)
+
+	// Gob.
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(batch); err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{"Content-Type": {GobContentType}, "Accept": {GobContentType}}
+	resp = &RESTBatchResponse{}
+	if err := gob.NewDecoder(bytes.NewReader(doREST("POST", KVBatchPath, &buf, header, http.StatusOK, t))).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+	expected.Results[2].NewValue = 10
+	if !reflect.DeepEqual(resp, expected) {
+		t.Errorf("expected %+v; got %+v", expected, resp)
+	}
+
+	// Malformed batches are rejected.
+	for _, bad := range []string{"{", `{"Ops":[{"Op":"frob","Key":"YQ=="}]}`, `{"Ops":[{"Op":"get"}]}`} {
+		doREST("POST", KVBatchPath, strings.NewReader(bad), nil, http.StatusBadRequest, t)
+	}
+	doREST("GET", KVBatchPath, nil, nil, http.StatusBadRequest, t)
+}
@@ -0,0 +1,593 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/hlc"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// Backoff between transaction restarts and the interval between
+// heartbeats of transaction records. Variables so tests may shorten
+// them.
+var (
+	txnRetryBackoff      = 50 * time.Millisecond
+	txnMaxRetryBackoff   = 5 * time.Second
+	txnHeartbeatInterval = storage.TxnHeartbeatInterval
+)
+
+// TransactionOptions specify the parameters of transactions run via
+// RunTransaction.
+type TransactionOptions struct {
+	Isolation storage.IsolationType
+	// Pipeline enables the pipelining of the transaction's puts and
+	// deletes: their replies are returned at once, without waiting for
+	// the writes to complete, so that a transaction writing many keys
+	// doesn't wait for each write in turn. Pipelined writes are
+	// awaited by subsequent requests addressing the same keys, and
+	// all are awaited before the transaction is committed; a failed
+	// pipelined write fails those requests, or the commit, instead.
+	Pipeline bool
+}
+
+// RunTransaction executes retryable in the context of a distributed
+// transaction. All requests sent via the DB supplied to retryable are
+// part of the transaction. If retryable returns nil, the transaction
+// is committed.
+//
+// Transactions which fail with restartable errors are retried with
+// backoff: if the transaction's timestamp was pushed or it
+// encountered a conflicting write intent, it's restarted at an
+// incremented epoch; if it was aborted, it's retried as a new
+// transaction. The transaction's priority is preserved across
+// retries. Intents written by failed attempts are resolved before
+// retrying. retryable must therefore be idempotent.
+//
+// If retryable returns any other error, the transaction is aborted,
+// its intents are resolved and the error is returned. Pipelined
+// writes (see TransactionOptions.Pipeline) are awaited before the
+// transaction is ended either way.
+//
+// Until an attempt ends the transaction, its record is heartbeat so
+// that other transactions don't consider it abandoned.
+func RunTransaction(db DB, clock *hlc.HLClock, opts *TransactionOptions, retryable func(db DB) error) error {
+	txn := storage.NewTransaction(nil, opts.Isolation, clock)
+	retryOpts := util.RetryOptions{
+		Tag:         "transaction",
+		Backoff:     txnRetryBackoff,
+		MaxBackoff:  txnMaxRetryBackoff,
+		Constant:    2,
+		MaxAttempts: 0, // retry indefinitely
+		UseJitter:   true,
+	}
+	var err error
+	util.RetryWithBackoff(retryOpts, func() (bool, error) {
+		tdb := &txnDB{db: db, txn: *txn, pipeline: opts.Pipeline}
+		stopper, done := make(chan struct{}), make(chan struct{})
+		go func() {
+			tdb.heartbeat(clock, stopper)
+			close(done)
+		}()
+		err = retryable(tdb)
+		if flushErr := tdb.flushWrites(); err == nil {
+			err = flushErr
+		}
+		close(stopper)
+		<-done
+		if err == nil {
+			err = tdb.endTransaction(true)
+		}
+		switch t := err.(type) {
+		case nil:
+			tdb.resolveIntents()
+			return true, nil
+		case *storage.TransactionRetryError:
+			// The transaction was pushed; restart at the pushed
+			// timestamp.
+			tdb.abortIntents()
+			txn = restartTransaction(&tdb.txn, &t.Txn, clock)
+		case *storage.WriteIntentError, *storage.TransactionPushError:
+			// Conflict with another transaction; restart.
+			tdb.abortIntents()
+			txn = restartTransaction(&tdb.txn, nil, clock)
+		case *storage.TransactionAbortedError:
+			// The transaction was aborted by a concurrent transaction;
+			// retry as a new transaction with the same priority.
+			tdb.txn.Status = storage.ABORTED
+			tdb.resolveIntents()
+			newTxn := storage.NewTransaction(nil, opts.Isolation, clock)
+			newTxn.Priority = maxPriority(tdb.txn.Priority, t.Txn.Priority)
+			txn = newTxn
+		default:
+			if endErr := tdb.endTransaction(false); endErr != nil {
+				log.New("kv").Warningf("failed to abort %s: %v", &tdb.txn, endErr)
+			}
+			tdb.txn.Status = storage.ABORTED
+			tdb.resolveIntents()
+			return true, nil
+		}
+		log.New("kv").V(1).Infof("restarting %s: %v", txn, err)
+		return false, nil
+	})
+	return err
+}
+
+// restartTransaction returns a copy of txn for the next epoch. Its
+// timestamp is moved forward to the current time or the timestamp of
+// updated, whichever is later, and its priority is preserved.
+func restartTransaction(txn, updated *storage.Transaction, clock *hlc.HLClock) *storage.Transaction {
+	restarted := *txn
+	restarted.Status = storage.PENDING
+	restarted.Epoch++
+	restarted.Timestamp = clock.Now()
+	if updated != nil {
+		if restarted.Timestamp.Less(updated.Timestamp) {
+			restarted.Timestamp = updated.Timestamp
+		}
+		restarted.Priority = maxPriority(restarted.Priority, updated.Priority)
+	}
+	restarted.MaxTimestamp = restarted.Timestamp
+	return &restarted
+}
+
+func maxPriority(a, b int32) int32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// A txnDB is the DB supplied to the function run by
+// RunTransaction. It sets the transaction on all requests, updates it
+// from responses and records the keys of write intents so they can
+// be resolved when the transaction ends. It also tracks the writes
+// which have been pipelined and haven't yet completed.
+type txnDB struct {
+	db       DB
+	pipeline bool       // Pipeline puts and deletes
+	mu       sync.Mutex // Protects txn, keys and writes
+	txn      storage.Transaction
+	keys     []storage.Key     // Keys of write intents
+	writes   []*pipelinedWrite // Incomplete or failed pipelined writes
+}
+
+// A pipelinedWrite is a write whose reply was returned before it
+// completed.
+type pipelinedWrite struct {
+	key  storage.Key
+	done chan struct{} // Closed when the write completes
+	err  error         // Set before done is closed
+}
+
+// prepare sets the transaction in header. The transaction's anchor
+// key is set to key if this is its first request. If write is true,
+// key is recorded as that of a write intent.
+func (tdb *txnDB) prepare(header *storage.RequestHeader, key storage.Key, write bool) {
+	tdb.mu.Lock()
+	defer tdb.mu.Unlock()
+	if tdb.txn.Key == nil {
+		tdb.txn.Key = key
+	}
+	if write {
+		tdb.keys = append(tdb.keys, key)
+	}
+	txn := tdb.txn
+	header.Txn = &txn
+}
+
+// forward returns a channel of the same type as replyChan which
+// receives the reply from replyChan after it's used to update the
+// transaction. If replyChan is nil, so is the returned channel.
+func (tdb *txnDB) forward(replyChan interface{}) interface{} {
+	inVal := reflect.ValueOf(replyChan)
+	chanType := reflect.ChanOf(reflect.BothDir, inVal.Type().Elem())
+	if inVal.IsNil() {
+		return reflect.Zero(chanType).Interface()
+	}
+	chanVal := reflect.MakeChan(chanType, 1)
+	go func() {
+		replyVal, _ := inVal.Recv()
+		if txn := replyVal.Interface().(storage.Response).Header().Txn; txn != nil {
+			tdb.update(txn)
+		}
+		chanVal.Send(replyVal)
+	}()
+	return chanVal.Interface()
+}
+
+// overlapping returns the pipelined writes to keys from key to
+// endKey, or to the end of the key space if endKey is empty.
+func (tdb *txnDB) overlapping(key, endKey storage.Key) []*pipelinedWrite {
+	tdb.mu.Lock()
+	defer tdb.mu.Unlock()
+	var writes []*pipelinedWrite
+	for _, w := range tdb.writes {
+		if bytes.Compare(w.key, key) >= 0 && (len(endKey) == 0 || bytes.Compare(w.key, endKey) < 0) {
+			writes = append(writes, w)
+		}
+	}
+	return writes
+}
+
+// nextKey returns the key immediately following key.
+func nextKey(key storage.Key) storage.Key {
+	return storage.MakeKey(key, storage.Key{0})
+}
+
+// waitWrites waits for writes to complete and returns the error of
+// the first which failed.
+func waitWrites(writes []*pipelinedWrite) error {
+	var err error
+	for _, w := range writes {
+		<-w.done
+		if err == nil {
+			err = w.err
+		}
+	}
+	return err
+}
+
+// flushWrites waits for all pipelined writes to complete, proving
+// that their intents were written, and returns the error of the
+// first which failed.
+func (tdb *txnDB) flushWrites() error {
+	return waitWrites(tdb.overlapping(nil, nil))
+}
+
+// send sends a request addressing the keys from key to endKey via
+// sendFn, which returns the reply channel, and forwards the reply
+// (see forward). If pipelined writes to those keys are incomplete,
+// the request is sent once they complete; if one failed, the request
+// isn't sent and reply, an empty reply, is returned with its error.
+func (tdb *txnDB) send(key, endKey storage.Key, reply storage.Response, sendFn func() interface{}) interface{} {
+	writes := tdb.overlapping(key, endKey)
+	if len(writes) == 0 {
+		return tdb.forward(sendFn())
+	}
+	chanVal := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, reflect.TypeOf(reply)), 1)
+	go func() {
+		if err := waitWrites(writes); err != nil {
+			reply.Header().Error = err
+			chanVal.Send(reflect.ValueOf(reply))
+			return
+		}
+		replyVal, _ := reflect.ValueOf(tdb.forward(sendFn())).Recv()
+		chanVal.Send(replyVal)
+	}()
+	return chanVal.Interface()
+}
+
+// sendWrite sends a put or delete of key via send, unless writes are
+// pipelined. A pipelined write is sent asynchronously, once the
+// pipelined writes to key preceding it complete, and reply, an empty
+// reply, is returned at once. The write is tracked until it
+// completes; if it fails, it's tracked until the transaction ends.
+func (tdb *txnDB) sendWrite(key storage.Key, reply storage.Response, sendFn func() interface{}) interface{} {
+	endKey := nextKey(key)
+	if !tdb.pipeline {
+		return tdb.send(key, endKey, reply, sendFn)
+	}
+	writes := tdb.overlapping(key, endKey)
+	w := &pipelinedWrite{key: key, done: make(chan struct{})}
+	tdb.mu.Lock()
+	tdb.writes = append(tdb.writes, w)
+	tdb.mu.Unlock()
+	go func() {
+		if w.err = waitWrites(writes); w.err == nil {
+			replyVal, _ := reflect.ValueOf(tdb.forward(sendFn())).Recv()
+			w.err = replyVal.Interface().(storage.Response).Header().Error
+		}
+		if w.err == nil {
+			tdb.mu.Lock()
+			for i := range tdb.writes {
+				if tdb.writes[i] == w {
+					tdb.writes = append(tdb.writes[:i], tdb.writes[i+1:]...)
+					break
+				}
+			}
+			tdb.mu.Unlock()
+		}
+		close(w.done)
+	}()
+	chanVal := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, reflect.TypeOf(reply)), 1)
+	chanVal.Send(reflect.ValueOf(reply))
+	return chanVal.Interface()
+}
+
+// update forwards the transaction's priority to that of txn. The
+// timestamp of a snapshot transaction is also forwarded; a
+// serializable transaction keeps its original timestamp so that
+// EndTransaction can detect that it was pushed.
+func (tdb *txnDB) update(txn *storage.Transaction) {
+	tdb.mu.Lock()
+	defer tdb.mu.Unlock()
+	if tdb.txn.ID != txn.ID {
+		return
+	}
+	if tdb.txn.Isolation == storage.SNAPSHOT && tdb.txn.Timestamp.Less(txn.Timestamp) {
+		tdb.txn.Timestamp = txn.Timestamp
+	}
+	tdb.txn.Priority = maxPriority(tdb.txn.Priority, txn.Priority)
+}
+
+// heartbeat periodically heartbeats the transaction's record until
+// stopper is closed or the transaction is found to have been ended.
+// Nothing is sent until the transaction's anchor key is set by its
+// first request.
+func (tdb *txnDB) heartbeat(clock *hlc.HLClock, stopper <-chan struct{}) {
+	ticker := time.NewTicker(txnHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			tdb.mu.Lock()
+			txn := tdb.txn
+			tdb.mu.Unlock()
+			if txn.Key == nil {
+				continue
+			}
+			reply := <-tdb.db.InternalHeartbeatTxn(&storage.InternalHeartbeatTxnRequest{
+				RequestHeader: storage.RequestHeader{Timestamp: clock.Now(), Txn: &txn},
+				Key:           txn.Key,
+			})
+			if reply.Error != nil {
+				log.New("kv").Warningf("failed to heartbeat %s: %v", &txn, reply.Error)
+				continue
+			}
+			if reply.Txn != nil && reply.Txn.Status != storage.PENDING {
+				log.New("kv").V(1).Infof("stopped heartbeating %s: %s", &txn, reply.Txn.Status)
+				return
+			}
+		case <-stopper:
+			return
+		}
+	}
+}
+
+// endTransaction commits or aborts the transaction. It's a no-op if
+// the transaction didn't send any requests.
+func (tdb *txnDB) endTransaction(commit bool) error {
+	if tdb.txn.Key == nil {
+		return nil
+	}
+	txn := tdb.txn
+	reply := <-tdb.db.EndTransaction(&storage.EndTransactionRequest{
+		RequestHeader: storage.RequestHeader{Txn: &txn},
+		Commit:        commit,
+		Keys:          tdb.keys,
+	})
+	if reply.Txn != nil {
+		tdb.txn = *reply.Txn
+	}
+	return reply.Error
+}
+
+// abortIntents removes the write intents written by the transaction
+// prior to a restart.
+func (tdb *txnDB) abortIntents() {
+	status := tdb.txn.Status
+	tdb.txn.Status = storage.ABORTED
+	tdb.resolveIntents()
+	tdb.txn.Status = status
+}
+
+// resolveIntents resolves the write intents written by the
+// transaction according to its status.
+//
+// TODO(spencer): intents written by DeleteRange aren't recorded and
+// are left to be resolved by readers which encounter them.
+func (tdb *txnDB) resolveIntents() {
+	for _, key := range tdb.keys {
+		txn := tdb.txn
+		reply := <-tdb.db.InternalResolveIntent(&storage.InternalResolveIntentRequest{
+			RequestHeader: storage.RequestHeader{Txn: &txn},
+			Key:           key,
+		})
+		if reply.Error != nil {
+			log.New("kv").Warningf("failed to resolve intent at %q for %s: %v", key, &txn, reply.Error)
+		}
+	}
+}
+
+// Contains sends the request as part of the transaction.
+func (tdb *txnDB) Contains(args *storage.ContainsRequest) <-chan *storage.ContainsResponse {
+	tdb.prepare(&args.RequestHeader, args.Key, false)
+	return tdb.send(args.Key, nextKey(args.Key), &storage.ContainsResponse{}, func() interface{} {
+		return tdb.db.Contains(args)
+	}).(chan *storage.ContainsResponse)
+}
+
+// Get sends the request as part of the transaction.
+func (tdb *txnDB) Get(args *storage.GetRequest) <-chan *storage.GetResponse {
+	tdb.prepare(&args.RequestHeader, args.Key, false)
+	return tdb.send(args.Key, nextKey(args.Key), &storage.GetResponse{}, func() interface{} {
+		return tdb.db.Get(args)
+	}).(chan *storage.GetResponse)
+}
+
+// Put sends the request as part of the transaction. The write is
+// pipelined if the transaction pipelines writes.
+func (tdb *txnDB) Put(args *storage.PutRequest) <-chan *storage.PutResponse {
+	tdb.prepare(&args.RequestHeader, args.Key, true)
+	return tdb.sendWrite(args.Key, &storage.PutResponse{}, func() interface{} {
+		return tdb.db.Put(args)
+	}).(chan *storage.PutResponse)
+}
+
+// ConditionalPut sends the request as part of the transaction.
+func (tdb *txnDB) ConditionalPut(args *storage.ConditionalPutRequest) <-chan *storage.ConditionalPutResponse {
+	tdb.prepare(&args.RequestHeader, args.Key, true)
+	return tdb.send(args.Key, nextKey(args.Key), &storage.ConditionalPutResponse{}, func() interface{} {
+		return tdb.db.ConditionalPut(args)
+	}).(chan *storage.ConditionalPutResponse)
+}
+
+// Increment sends the request as part of the transaction.
+func (tdb *txnDB) Increment(args *storage.IncrementRequest) <-chan *storage.IncrementResponse {
+	tdb.prepare(&args.RequestHeader, args.Key, true)
+	return tdb.send(args.Key, nextKey(args.Key), &storage.IncrementResponse{}, func() interface{} {
+		return tdb.db.Increment(args)
+	}).(chan *storage.IncrementResponse)
+}
+
+// Delete sends the request as part of the transaction. The write is
+// pipelined if the transaction pipelines writes.
+func (tdb *txnDB) Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResponse {
+	tdb.prepare(&args.RequestHeader, args.Key, true)
+	return tdb.sendWrite(args.Key, &storage.DeleteResponse{}, func() interface{} {
+		return tdb.db.Delete(args)
+	}).(chan *storage.DeleteResponse)
+}
+
+// DeleteRange sends the request as part of the transaction.
+func (tdb *txnDB) DeleteRange(args *storage.DeleteRangeRequest) <-chan *storage.DeleteRangeResponse {
+	tdb.prepare(&args.RequestHeader, args.StartKey, false)
+	return tdb.send(args.StartKey, args.EndKey, &storage.DeleteRangeResponse{}, func() interface{} {
+		return tdb.db.DeleteRange(args)
+	}).(chan *storage.DeleteRangeResponse)
+}
+
+// Scan sends the request as part of the transaction.
+func (tdb *txnDB) Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse {
+	tdb.prepare(&args.RequestHeader, args.StartKey, false)
+	return tdb.send(args.StartKey, args.EndKey, &storage.ScanResponse{}, func() interface{} {
+		return tdb.db.Scan(args)
+	}).(chan *storage.ScanResponse)
+}
+
+// ReverseScan sends the request as part of the transaction.
+func (tdb *txnDB) ReverseScan(args *storage.ReverseScanRequest) <-chan *storage.ReverseScanResponse {
+	tdb.prepare(&args.RequestHeader, storage.ReverseScanKey(args), false)
+	return tdb.send(args.StartKey, args.EndKey, &storage.ReverseScanResponse{}, func() interface{} {
+		return tdb.db.ReverseScan(args)
+	}).(chan *storage.ReverseScanResponse)
+}
+
+// EndTransaction returns an error; transactions run via
+// RunTransaction are ended by the runner.
+func (tdb *txnDB) EndTransaction(args *storage.EndTransactionRequest) <-chan *storage.EndTransactionResponse {
+	replyChan := make(chan *storage.EndTransactionResponse, 1)
+	replyChan <- &storage.EndTransactionResponse{
+		ResponseHeader: storage.ResponseHeader{
+			Error: util.Error("EndTransaction may not be invoked within RunTransaction"),
+		},
+	}
+	return replyChan
+}
+
+// Batch sends the request as part of the transaction, once all
+// pipelined writes complete. The keys of batched writes are recorded
+// as write intents.
+func (tdb *txnDB) Batch(args *storage.BatchRequest) <-chan *storage.BatchResponse {
+	for _, req := range args.Requests {
+		switch t := req.(type) {
+		case *storage.PutRequest:
+			tdb.prepare(&t.RequestHeader, t.Key, true)
+		case *storage.ConditionalPutRequest:
+			tdb.prepare(&t.RequestHeader, t.Key, true)
+		case *storage.IncrementRequest:
+			tdb.prepare(&t.RequestHeader, t.Key, true)
+		case *storage.DeleteRequest:
+			tdb.prepare(&t.RequestHeader, t.Key, true)
+		}
+	}
+	tdb.prepare(&args.RequestHeader, args.Key(), false)
+	return tdb.send(nil, nil, &storage.BatchResponse{}, func() interface{} {
+		return tdb.db.Batch(args)
+	}).(chan *storage.BatchResponse)
+}
+
+// AdminSplit returns an error; splits execute their own
+// transactions.
+func (tdb *txnDB) AdminSplit(args *storage.AdminSplitRequest) <-chan *storage.AdminSplitResponse {
+	replyChan := make(chan *storage.AdminSplitResponse, 1)
+	replyChan <- &storage.AdminSplitResponse{
+		ResponseHeader: storage.ResponseHeader{
+			Error: util.Error("AdminSplit may not be invoked within RunTransaction"),
+		},
+	}
+	return replyChan
+}
+
+// AdminMerge returns an error; merges execute their own
+// transactions.
+func (tdb *txnDB) AdminMerge(args *storage.AdminMergeRequest) <-chan *storage.AdminMergeResponse {
+	replyChan := make(chan *storage.AdminMergeResponse, 1)
+	replyChan <- &storage.AdminMergeResponse{
+		ResponseHeader: storage.ResponseHeader{
+			Error: util.Error("AdminMerge may not be invoked within RunTransaction"),
+		},
+	}
+	return replyChan
+}
+
+// AccumulateTS sends the request as part of the transaction.
+func (tdb *txnDB) AccumulateTS(args *storage.AccumulateTSRequest) <-chan *storage.AccumulateTSResponse {
+	tdb.prepare(&args.RequestHeader, args.Key, true)
+	return tdb.send(args.Key, nextKey(args.Key), &storage.AccumulateTSResponse{}, func() interface{} {
+		return tdb.db.AccumulateTS(args)
+	}).(chan *storage.AccumulateTSResponse)
+}
+
+// ReapQueue sends the request as part of the transaction.
+func (tdb *txnDB) ReapQueue(args *storage.ReapQueueRequest) <-chan *storage.ReapQueueResponse {
+	tdb.prepare(&args.RequestHeader, args.Inbox, false)
+	return tdb.forward(tdb.db.ReapQueue(args)).(chan *storage.ReapQueueResponse)
+}
+
+// EnqueueUpdate sends the request as part of the transaction.
+func (tdb *txnDB) EnqueueUpdate(args *storage.EnqueueUpdateRequest) <-chan *storage.EnqueueUpdateResponse {
+	tdb.prepare(&args.RequestHeader, nil, false)
+	return tdb.forward(tdb.db.EnqueueUpdate(args)).(chan *storage.EnqueueUpdateResponse)
+}
+
+// EnqueueMessage sends the request as part of the transaction.
+func (tdb *txnDB) EnqueueMessage(args *storage.EnqueueMessageRequest) <-chan *storage.EnqueueMessageResponse {
+	tdb.prepare(&args.RequestHeader, args.Inbox, false)
+	return tdb.forward(tdb.db.EnqueueMessage(args)).(chan *storage.EnqueueMessageResponse)
+}
+
+// InternalPushTxn passes through to the underlying DB.
+func (tdb *txnDB) InternalPushTxn(args *storage.InternalPushTxnRequest) <-chan *storage.InternalPushTxnResponse {
+	return tdb.db.InternalPushTxn(args)
+}
+
+// InternalResolveIntent passes through to the underlying DB.
+func (tdb *txnDB) InternalResolveIntent(args *storage.InternalResolveIntentRequest) <-chan *storage.InternalResolveIntentResponse {
+	return tdb.db.InternalResolveIntent(args)
+}
+
+// InternalHeartbeatTxn passes through to the underlying DB.
+func (tdb *txnDB) InternalHeartbeatTxn(args *storage.InternalHeartbeatTxnRequest) <-chan *storage.InternalHeartbeatTxnResponse {
+	return tdb.db.InternalHeartbeatTxn(args)
+}
+
+// InternalSnapshot passes through to the underlying DB.
+func (tdb *txnDB) InternalSnapshot(args *storage.InternalSnapshotRequest) <-chan *storage.InternalSnapshotResponse {
+	return tdb.db.InternalSnapshot(args)
+}
+
+// InternalChecksum passes through to the underlying DB.
+func (tdb *txnDB) InternalChecksum(args *storage.InternalChecksumRequest) <-chan *storage.InternalChecksumResponse {
+	return tdb.db.InternalChecksum(args)
+}
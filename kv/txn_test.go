@@ -0,0 +1,246 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/hlc"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+func init() {
+	txnRetryBackoff = 1 * time.Millisecond
+}
+
+// expectValue verifies that a non-transactional read of key returns
+// the expected value, or no value if expected is nil.
+func expectValue(db DB, key storage.Key, expected []byte, t *testing.T) {
+	gr := <-db.Get(&storage.GetRequest{Key: key})
+	if gr.Error != nil {
+		t.Fatalf("unexpected error reading %q: %v", key, gr.Error)
+	}
+	if !bytes.Equal(gr.Value.Bytes, expected) {
+		t.Errorf("expected %q at %q; got %q", expected, key, gr.Value.Bytes)
+	}
+}
+
+// TestRunTransactionCommit verifies that writes of a committed
+// transaction are visible to subsequent readers.
+func TestRunTransactionCommit(t *testing.T) {
+	s := startServer()
+	key := storage.Key("txn-commit")
+	err := RunTransaction(s.db, hlc.NewHLClock(hlc.UnixNano), &TransactionOptions{}, func(db DB) error {
+		return (<-db.Put(&storage.PutRequest{Key: key, Value: storage.Value{Bytes: []byte("value")}})).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValue(s.db, key, []byte("value"), t)
+}
+
+// TestRunTransactionRestart verifies that a transaction which fails
+// with a retry error is restarted at the next epoch with the same ID
+// and priority, and one which is aborted is retried as a new
+// transaction with the same priority.
+func TestRunTransactionRestart(t *testing.T) {
+	s := startServer()
+	key := storage.Key("txn-restart")
+	var txns []storage.Transaction
+	err := RunTransaction(s.db, hlc.NewHLClock(hlc.UnixNano), &TransactionOptions{}, func(db DB) error {
+		pr := <-db.Put(&storage.PutRequest{Key: key, Value: storage.Value{Bytes: []byte("value")}})
+		if pr.Error != nil {
+			return pr.Error
+		}
+		txn := db.(*txnDB).txn
+		txns = append(txns, txn)
+		switch len(txns) {
+		case 1:
+			return &storage.TransactionRetryError{Txn: txn}
+		case 2:
+			return &storage.TransactionAbortedError{Txn: txn}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 3 {
+		t.Fatalf("expected 3 attempts; got %d", len(txns))
+	}
+	if txns[1].ID != txns[0].ID || txns[1].Epoch != txns[0].Epoch+1 || txns[1].Priority != txns[0].Priority {
+		t.Errorf("expected restart of %s; got %s", &txns[0], &txns[1])
+	}
+	if txns[2].ID == txns[1].ID || txns[2].Priority != txns[1].Priority {
+		t.Errorf("expected new transaction with priority of %s; got %s", &txns[1], &txns[2])
+	}
+	expectValue(s.db, key, []byte("value"), t)
+}
+
+// TestRunTransactionAbort verifies that a transaction which fails
+// with a non-retryable error is aborted, its intents are resolved and
+// the error is returned.
+func TestRunTransactionAbort(t *testing.T) {
+	s := startServer()
+	key := storage.Key("txn-abort")
+	attempts := 0
+	failure := util.Error("failure")
+	err := RunTransaction(s.db, hlc.NewHLClock(hlc.UnixNano), &TransactionOptions{}, func(db DB) error {
+		attempts++
+		pr := <-db.Put(&storage.PutRequest{Key: key, Value: storage.Value{Bytes: []byte("value")}})
+		if pr.Error != nil {
+			return pr.Error
+		}
+		return failure
+	})
+	if err != failure || attempts != 1 {
+		t.Errorf("expected single attempt failing with error; got %d attempts, %v", attempts, err)
+	}
+	expectValue(s.db, key, nil, t)
+}
+
+// errPutFailed is returned by slowDB for failed puts.
+var errPutFailed = util.Error("put failed")
+
+// slowDB delays puts by delay before sending them to the underlying
+// DB, failing those to fail.
+type slowDB struct {
+	DB
+	delay time.Duration
+	fail  storage.Key
+}
+
+func (db *slowDB) Put(args *storage.PutRequest) <-chan *storage.PutResponse {
+	replyChan := make(chan *storage.PutResponse, 1)
+	go func() {
+		time.Sleep(db.delay)
+		if bytes.Equal(args.Key, db.fail) {
+			replyChan <- &storage.PutResponse{ResponseHeader: storage.ResponseHeader{Error: errPutFailed}}
+			return
+		}
+		replyChan <- <-db.DB.Put(args)
+	}()
+	return replyChan
+}
+
+// TestRunTransactionPipelinedWrites verifies that the replies to
+// pipelined writes are returned before the writes complete, that
+// subsequent reads of the written keys wait for the writes, and that
+// all writes complete before the transaction commits.
+func TestRunTransactionPipelinedWrites(t *testing.T) {
+	s := startServer()
+	db := &slowDB{DB: s.db, delay: 50 * time.Millisecond}
+	keys := []storage.Key{storage.Key("pipeline-a"), storage.Key("pipeline-b"), storage.Key("pipeline-c")}
+	err := RunTransaction(db, hlc.NewHLClock(hlc.UnixNano), &TransactionOptions{Pipeline: true}, func(txnDB DB) error {
+		start := time.Now()
+		for _, key := range keys {
+			if pr := <-txnDB.Put(&storage.PutRequest{Key: key, Value: storage.Value{Bytes: key}}); pr.Error != nil {
+				return pr.Error
+			}
+		}
+		if elapsed := time.Since(start); elapsed >= db.delay {
+			t.Errorf("expected pipelined puts to return at once; took %s", elapsed)
+		}
+		gr := <-txnDB.Get(&storage.GetRequest{Key: keys[0]})
+		if gr.Error != nil {
+			return gr.Error
+		}
+		if !bytes.Equal(gr.Value.Bytes, keys[0]) {
+			t.Errorf("expected to read pipelined write %q; got %q", keys[0], gr.Value.Bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		expectValue(s.db, key, key, t)
+	}
+}
+
+// TestRunTransactionPipelinedWriteFailure verifies that a failed
+// pipelined write fails the transaction at commit.
+func TestRunTransactionPipelinedWriteFailure(t *testing.T) {
+	s := startServer()
+	key := storage.Key("pipeline-fail")
+	db := &slowDB{DB: s.db, delay: 10 * time.Millisecond, fail: key}
+	err := RunTransaction(db, hlc.NewHLClock(hlc.UnixNano), &TransactionOptions{Pipeline: true}, func(txnDB DB) error {
+		return (<-txnDB.Put(&storage.PutRequest{Key: key, Value: storage.Value{Bytes: []byte("value")}})).Error
+	})
+	if err != errPutFailed {
+		t.Errorf("expected pipelined put failure; got %v", err)
+	}
+	expectValue(s.db, key, nil, t)
+}
+
+// heartbeatDB records the replies to heartbeats of transaction
+// records sent to the underlying DB.
+type heartbeatDB struct {
+	DB
+	mu      sync.Mutex
+	replies []*storage.InternalHeartbeatTxnResponse
+}
+
+func (db *heartbeatDB) InternalHeartbeatTxn(args *storage.InternalHeartbeatTxnRequest) <-chan *storage.InternalHeartbeatTxnResponse {
+	reply := <-db.DB.InternalHeartbeatTxn(args)
+	db.mu.Lock()
+	db.replies = append(db.replies, reply)
+	db.mu.Unlock()
+	replyChan := make(chan *storage.InternalHeartbeatTxnResponse, 1)
+	replyChan <- reply
+	return replyChan
+}
+
+// TestRunTransactionHeartbeat verifies that the record of a
+// transaction is heartbeat while it runs and no longer once it ends.
+func TestRunTransactionHeartbeat(t *testing.T) {
+	defer func(interval time.Duration) { txnHeartbeatInterval = interval }(txnHeartbeatInterval)
+	txnHeartbeatInterval = 5 * time.Millisecond
+	s := startServer()
+	db := &heartbeatDB{DB: s.db}
+	key := storage.Key("txn-heartbeat")
+	err := RunTransaction(db, hlc.NewHLClock(hlc.UnixNano), &TransactionOptions{}, func(txnDB DB) error {
+		if pr := <-txnDB.Put(&storage.PutRequest{Key: key, Value: storage.Value{Bytes: []byte("value")}}); pr.Error != nil {
+			return pr.Error
+		}
+		time.Sleep(10 * txnHeartbeatInterval)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.mu.Lock()
+	replies := db.replies
+	db.mu.Unlock()
+	if len(replies) == 0 {
+		t.Fatal("expected transaction record to be heartbeat")
+	}
+	for i, reply := range replies {
+		if reply.Error != nil || reply.Txn == nil || reply.Txn.LastHeartbeat.WallTime == 0 {
+			t.Errorf("%d: expected successful heartbeat; got %+v", i, reply)
+		}
+	}
+	time.Sleep(5 * txnHeartbeatInterval)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(db.replies) != len(replies) {
+		t.Errorf("expected no heartbeats once the transaction ended; got %d more", len(db.replies)-len(replies))
+	}
+}
@@ -54,7 +54,12 @@ func main() {
 		Name: "cockroach",
 		Commands: []*commander.Command{
 			server.CmdInit,
+			server.CmdCreateCACert,
+			server.CmdCreateNodeCert,
+			server.CmdDebug,
+			server.CmdExport,
 			server.CmdGetZone,
+			server.CmdImport,
 			server.CmdLsZones,
 			server.CmdRmZone,
 			server.CmdSetZone,
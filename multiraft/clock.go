@@ -52,43 +52,80 @@ func (realClock) StopElectionTimer(t *time.Timer) {
 	t.Stop()
 }
 
-// manualClock is a fake implementation of the Clock interface.  With this clock
-// time does not flow normally, but time-based events can be triggered manually with
-// methods like triggerElection.
-type manualClock struct {
+// ManualClock is a fake implementation of the Clock interface for use in tests.  With
+// this clock time does not flow normally, but time-based events can be triggered
+// manually with methods like TriggerElection.
+type ManualClock struct {
 	sync.Mutex
-	now             time.Time
-	electionChannel chan time.Time
-	nextElection    time.Time
+	cond   *sync.Cond // Signaled when an election timer is created
+	now    time.Time
+	timers map[*time.Timer]manualTimer // The active election timers
 }
 
-func newManualClock() *manualClock {
-	return &manualClock{
-		now:             time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC),
-		electionChannel: make(chan time.Time),
+// manualTimer is the deadline and channel of an election timer of a ManualClock.
+type manualTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+// NewManualClock creates a ManualClock.
+func NewManualClock() *ManualClock {
+	m := &ManualClock{
+		now:    time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC),
+		timers: make(map[*time.Timer]manualTimer),
 	}
+	m.cond = sync.NewCond(m)
+	return m
 }
 
-func (m *manualClock) Now() time.Time {
+// Now implements Clock.
+func (m *ManualClock) Now() time.Time {
 	m.Lock()
 	defer m.Unlock()
 	return m.now
 }
 
-func (m *manualClock) NewElectionTimer(t time.Duration) *time.Timer {
+// NewElectionTimer implements Clock.  A timer whose deadline has already passed fires
+// immediately, so that an election triggered just as its event loop replaced the
+// timer isn't lost.
+func (m *ManualClock) NewElectionTimer(t time.Duration) *time.Timer {
 	m.Lock()
 	defer m.Unlock()
-	m.nextElection = m.now.Add(t)
-	return &time.Timer{C: m.electionChannel}
+	c := make(chan time.Time, 1)
+	timer := &time.Timer{C: c}
+	if t <= 0 {
+		c <- m.now
+		return timer
+	}
+	m.timers[timer] = manualTimer{m.now.Add(t), c}
+	m.cond.Broadcast()
+	return timer
 }
 
-func (m *manualClock) StopElectionTimer(*time.Timer) {
+// StopElectionTimer implements Clock.
+func (m *ManualClock) StopElectionTimer(t *time.Timer) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.timers, t)
 }
 
-func (m *manualClock) triggerElection() {
+// TriggerElection advances the clock to the earliest deadline of the active election
+// timers (one per event loop shard) and fires that timer.  Blocks until there is an
+// active timer.
+func (m *ManualClock) TriggerElection() {
 	m.Lock()
-	m.now = m.nextElection
-	now := m.now
-	m.Unlock()
-	m.electionChannel <- now
+	defer m.Unlock()
+	for len(m.timers) == 0 {
+		m.cond.Wait()
+	}
+	var next *time.Timer
+	for timer, mt := range m.timers {
+		if next == nil || mt.deadline.Before(m.timers[next].deadline) {
+			next = timer
+		}
+	}
+	mt := m.timers[next]
+	delete(m.timers, next)
+	m.now = mt.deadline
+	mt.c <- m.now
 }
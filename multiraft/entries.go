@@ -0,0 +1,173 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package multiraft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// A LogEntryCodec encodes the values submitted as log entries of a
+// type into entry payloads, and decodes the payloads of the entries
+// as they commit.
+type LogEntryCodec interface {
+	Encode(value interface{}) ([]byte, error)
+	Decode(payload []byte) (interface{}, error)
+}
+
+// BytesCodec is a LogEntryCodec whose values are the payloads
+// themselves, as []byte. A nil value encodes an empty payload.
+type BytesCodec struct{}
+
+// Encode implements LogEntryCodec.
+func (BytesCodec) Encode(value interface{}) ([]byte, error) {
+	if value == nil {
+		return nil, nil
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return nil, util.Errorf("expected []byte entry value; got %T", value)
+	}
+	return b, nil
+}
+
+// Decode implements LogEntryCodec.
+func (BytesCodec) Decode(payload []byte) (interface{}, error) {
+	return payload, nil
+}
+
+// GobCodec is a LogEntryCodec which gob-encodes values. Payloads are
+// decoded into the values returned by New, which should be pointers.
+type GobCodec struct {
+	New func() interface{}
+}
+
+// Encode implements LogEntryCodec.
+func (c GobCodec) Encode(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode implements LogEntryCodec.
+func (c GobCodec) Decode(payload []byte) (interface{}, error) {
+	value := c.New()
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// A Lease is the payload of LogEntryLease entries: it grants a node
+// the lease of a group until its expiration.
+type Lease struct {
+	NodeID     NodeID
+	Expiration time.Time
+}
+
+// logEntryHandler encodes, decodes and applies the log entries of a
+// type.
+type logEntryHandler struct {
+	name  string
+	codec LogEntryCodec
+	// apply is invoked by the group's event loop with the decoded
+	// payload of each committed entry; nil if there's nothing to do.
+	apply func(s *state, g *group, value interface{})
+}
+
+var (
+	logEntryHandlersMu sync.RWMutex
+	logEntryHandlers   = map[LogEntryType]*logEntryHandler{}
+)
+
+// init registers the handlers of the built-in entry types.
+func init() {
+	registerLogEntryHandler(LogEntryCommand, &logEntryHandler{"command", BytesCodec{},
+		func(s *state, g *group, value interface{}) {
+			s.sendEvent(&EventCommandCommitted{value.([]byte)})
+		}})
+	registerLogEntryHandler(LogEntryConfigChange, &logEntryHandler{"config change",
+		GobCodec{func() interface{} { return &GroupMembers{} }},
+		func(s *state, g *group, value interface{}) {
+			s.applyMembershipChange(g, value.(*GroupMembers))
+			s.sendEvent(&EventMembershipChangeCommitted{g.groupID, *value.(*GroupMembers)})
+		}})
+	registerLogEntryHandler(LogEntryLease, &logEntryHandler{"lease",
+		GobCodec{func() interface{} { return &Lease{} }},
+		func(s *state, g *group, value interface{}) {
+			s.sendEvent(&EventLeaseCommitted{g.groupID, *value.(*Lease)})
+		}})
+	registerLogEntryHandler(LogEntryNoop, &logEntryHandler{"no-op", BytesCodec{}, nil})
+}
+
+// RegisterLogEntryType registers an application-defined type of log
+// entry, whose values are encoded and decoded by codec. Entries of
+// the type are submitted via MultiRaft.SubmitEntry, and broadcast as
+// EventEntryCommitted with their decoded values once committed.
+// Returns an error if the type is already registered.
+func RegisterLogEntryType(typ LogEntryType, name string, codec LogEntryCodec) error {
+	return registerLogEntryHandler(typ, &logEntryHandler{name, codec,
+		func(s *state, g *group, value interface{}) {
+			s.sendEvent(&EventEntryCommitted{g.groupID, typ, value})
+		}})
+}
+
+func registerLogEntryHandler(typ LogEntryType, h *logEntryHandler) error {
+	logEntryHandlersMu.Lock()
+	defer logEntryHandlersMu.Unlock()
+	if existing, ok := logEntryHandlers[typ]; ok {
+		return util.Errorf("log entry type %d is already registered as %q", typ, existing.name)
+	}
+	logEntryHandlers[typ] = h
+	return nil
+}
+
+// getLogEntryHandler returns the handler of the entry type, or an
+// error if the type isn't registered.
+func getLogEntryHandler(typ LogEntryType) (*logEntryHandler, error) {
+	logEntryHandlersMu.RLock()
+	defer logEntryHandlersMu.RUnlock()
+	h, ok := logEntryHandlers[typ]
+	if !ok {
+		return nil, util.Errorf("unregistered log entry type %d", typ)
+	}
+	return h, nil
+}
+
+// applyEntry decodes the committed entry's payload and dispatches it
+// to the handler of the entry's type. Entries which can't be decoded
+// are logged and skipped.
+func (s *state) applyEntry(g *group, entry *LogEntry) {
+	h, err := getLogEntryHandler(entry.Type)
+	if err != nil {
+		s.strictErrorLog("group %d: skipping committed entry %d: %s", g.groupID, entry.Index, err)
+		return
+	}
+	value, err := h.codec.Decode(entry.Payload)
+	if err != nil {
+		s.strictErrorLog("group %d: unable to decode %s entry %d: %s", g.groupID, h.name, entry.Index, err)
+		return
+	}
+	if h.apply != nil {
+		h.apply(s, g, value)
+	}
+}
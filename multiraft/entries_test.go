@@ -0,0 +1,103 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package multiraft
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// unregisterLogEntryType removes the registration of an entry type
+// registered by a test, so that the test may be rerun.
+func unregisterLogEntryType(typ LogEntryType) {
+	logEntryHandlersMu.Lock()
+	defer logEntryHandlersMu.Unlock()
+	delete(logEntryHandlers, typ)
+}
+
+// TestApplyEntry verifies that committed entries are decoded by the
+// codecs of their types and broadcast as the types' events.
+func TestApplyEntry(t *testing.T) {
+	const typeTest LogEntryType = 100
+	if err := RegisterLogEntryType(typeTest, "test", GobCodec{func() interface{} { return new(string) }}); err != nil {
+		t.Fatal(err)
+	}
+	defer unregisterLogEntryType(typeTest)
+	if err := RegisterLogEntryType(typeTest, "test", BytesCodec{}); err == nil {
+		t.Error("expected error registering a type twice")
+	}
+	if err := RegisterLogEntryType(LogEntryLease, "lease", BytesCodec{}); err == nil {
+		t.Error("expected error registering a built-in type")
+	}
+
+	mr, err := NewMultiRaft(1, &Config{
+		Transport:          NewLocalRPCTransport(),
+		Storage:            NewMemoryStorage(),
+		ElectionTimeoutMin: 10 * time.Millisecond,
+		ElectionTimeoutMax: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Stop()
+	s := mr.shards[0]
+	g := newGroup(1, []NodeID{1})
+
+	lease := Lease{NodeID: 2, Expiration: time.Unix(100, 0).UTC()}
+	value := "value"
+	for i, test := range []struct {
+		typ      LogEntryType
+		value    interface{}
+		expEvent interface{}
+	}{
+		{LogEntryCommand, []byte("command"), &EventCommandCommitted{[]byte("command")}},
+		{LogEntryConfigChange, GroupMembers{Members: []NodeID{1, 2}},
+			&EventMembershipChangeCommitted{1, GroupMembers{Members: []NodeID{1, 2}}}},
+		{LogEntryLease, lease, &EventLeaseCommitted{1, lease}},
+		{LogEntryNoop, nil, nil},
+		{typeTest, value, &EventEntryCommitted{1, typeTest, &value}},
+	} {
+		h, err := getLogEntryHandler(test.typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := h.codec.Encode(test.value)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		s.applyEntry(g, &LogEntry{Index: i + 1, Type: test.typ, Payload: payload})
+		if test.expEvent == nil {
+			select {
+			case event := <-mr.Events:
+				t.Errorf("%d: unexpected event %+v", i, event)
+			default:
+			}
+			continue
+		}
+		if event := <-mr.Events; !reflect.DeepEqual(event, test.expEvent) {
+			t.Errorf("%d: expected event %+v; got %+v", i, test.expEvent, event)
+		}
+	}
+
+	// Values which the type's codec can't encode are refused.
+	if err := <-mr.SubmitEntry(1, LogEntryCommand, "not bytes"); err == nil {
+		t.Error("expected error submitting an unencodable command")
+	}
+	if err := <-mr.SubmitEntry(1, LogEntryType(101), nil); err == nil {
+		t.Error("expected error submitting an unregistered entry type")
+	}
+}
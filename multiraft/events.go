@@ -28,3 +28,26 @@ type EventLeaderElection struct {
 type EventCommandCommitted struct {
 	Command []byte
 }
+
+// An EventMembershipChangeCommitted is broadcast whenever a
+// LogEntryConfigChange entry has been committed.
+type EventMembershipChangeCommitted struct {
+	GroupID GroupID
+	Members GroupMembers
+}
+
+// An EventLeaseCommitted is broadcast whenever a LogEntryLease entry
+// has been committed.
+type EventLeaseCommitted struct {
+	GroupID GroupID
+	Lease   Lease
+}
+
+// An EventEntryCommitted is broadcast whenever an entry of a type
+// registered via RegisterLogEntryType has been committed. Value is
+// the entry's payload as decoded by the type's codec.
+type EventEntryCommitted struct {
+	GroupID GroupID
+	Type    LogEntryType
+	Value   interface{}
+}
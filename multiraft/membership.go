@@ -0,0 +1,212 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package multiraft
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// A DuplicateMemberError indicates that a membership change lists a
+// node more than once.
+type DuplicateMemberError struct {
+	GroupID GroupID
+	NodeID  NodeID
+}
+
+// Error formats error.
+func (e *DuplicateMemberError) Error() string {
+	return fmt.Sprintf("group %d: node %d is listed more than once", e.GroupID, e.NodeID)
+}
+
+// A NoVotersError indicates that a membership change would remove
+// the last voting member of a group.
+type NoVotersError struct {
+	GroupID GroupID
+}
+
+// Error formats error.
+func (e *NoVotersError) Error() string {
+	return fmt.Sprintf("group %d: membership change would remove the last voter", e.GroupID)
+}
+
+// A QuorumError indicates that a membership change would leave a
+// group without a quorum of live nodes among Members, either the
+// current or the proposed members.
+type QuorumError struct {
+	GroupID GroupID
+	Members []NodeID
+	Live    int // The number of live nodes among Members
+}
+
+// Error formats error.
+func (e *QuorumError) Error() string {
+	return fmt.Sprintf("group %d: only %d of members %v are live; a quorum requires %d",
+		e.GroupID, e.Live, e.Members, len(e.Members)/2+1)
+}
+
+// A MembershipChangeInProgressError indicates that a group's previous
+// membership change hasn't completed.
+type MembershipChangeInProgressError struct {
+	GroupID         GroupID
+	ProposedMembers []NodeID
+}
+
+// Error formats error.
+func (e *MembershipChangeInProgressError) Error() string {
+	return fmt.Sprintf("group %d: change to members %v is still in progress",
+		e.GroupID, e.ProposedMembers)
+}
+
+// changeMembershipOp proposes new members for a group.
+type changeMembershipOp struct {
+	groupID GroupID
+	members []NodeID
+	ch      chan error
+}
+
+// ChangeGroupMembership proposes that the group's members be replaced by members,
+// which must list each node once.  The change is made by joint consensus (section 6
+// of the Raft paper): a LogEntryConfigChange entry holding both the current and the
+// proposed members (see GroupMembers) is committed first, followed by an entry
+// holding only the proposed members.  Each is broadcast as
+// EventMembershipChangeCommitted once committed.  Changes which are unsafe are
+// refused with a DuplicateMemberError, NoVotersError, QuorumError or
+// MembershipChangeInProgressError, rather than committed; the returned channel
+// otherwise receives nil once the change completes.
+func (m *MultiRaft) ChangeGroupMembership(groupID GroupID, members []NodeID) <-chan error {
+	op := &changeMembershipOp{groupID, members, make(chan error, 1)}
+	m.shardFor(groupID).ops <- op
+	return op.ch
+}
+
+// changeMembership validates the proposed change against the group's members,
+// including those of a change still in progress, and proposes the joint
+// configuration.  The leader adopts each configuration as soon as it proposes it.
+func (s *state) changeMembership(op *changeMembershipOp) {
+	g, err := s.getGroup(op.groupID)
+	if err != nil {
+		op.ch <- err
+		return
+	}
+	if g.role != RoleLeader {
+		op.ch <- util.Errorf("node %v is not the leader of group %v", s.nodeID, op.groupID)
+		return
+	}
+	if g.membershipChange != nil {
+		op.ch <- &MembershipChangeInProgressError{g.groupID, g.membershipChange.members}
+		return
+	}
+	if err := validateMembershipChange(g.groupID, g.committedMembers, op.members, s.IsLive); err != nil {
+		op.ch <- err
+		return
+	}
+	for _, id := range op.members {
+		if _, err := s.connect(id); err != nil {
+			op.ch <- err
+			return
+		}
+	}
+	change := &GroupMembers{Members: g.committedMembers.Members, ProposedMembers: op.members}
+	if err := s.proposeMembers(g, change); err != nil {
+		op.ch <- err
+		return
+	}
+	g.membershipChange = op
+}
+
+// proposeMembers appends a LogEntryConfigChange entry holding members to the
+// leader's log, and adopts members as the group's current members.
+func (s *state) proposeMembers(g *group, members *GroupMembers) error {
+	h, err := getLogEntryHandler(LogEntryConfigChange)
+	if err != nil {
+		return err
+	}
+	payload, err := h.codec.Encode(*members)
+	if err != nil {
+		return util.Errorf("unable to encode membership change: %s", err)
+	}
+	s.proposeCommand(g, &submitCommandOp{g.groupID, payload, make(chan error, 1), LogEntryConfigChange})
+	g.currentMembers = members
+	return nil
+}
+
+// applyMembershipChange makes the members of a committed LogEntryConfigChange entry
+// the group's committed members.  Once the joint configuration of a change it
+// proposed commits, the leader proposes the final configuration of only the
+// proposed members; the change completes once that commits.
+func (s *state) applyMembershipChange(g *group, members *GroupMembers) {
+	for _, id := range members.allMembers() {
+		if n, err := s.connect(id); err != nil {
+			s.groupLog(g.groupID).Warningf("unable to connect to member %v: %v", id, err)
+		} else {
+			n.refCount++
+		}
+	}
+	for _, id := range g.committedMembers.allMembers() {
+		if n, ok := s.nodes[id]; ok {
+			n.refCount--
+		}
+	}
+	g.committedMembers = members
+	if g.role != RoleLeader || g.membershipChange == nil {
+		return
+	}
+	if len(members.ProposedMembers) > 0 {
+		if err := s.proposeMembers(g, &GroupMembers{Members: members.ProposedMembers}); err != nil {
+			g.membershipChange.ch <- err
+			g.membershipChange = nil
+		}
+		return
+	}
+	g.membershipChange.ch <- nil
+	g.membershipChange = nil
+}
+
+// validateMembershipChange returns an error if replacing the current members of
+// the group by members would be unsafe: if members is empty or lists a node twice,
+// if a change is already in progress, or if either the current or the proposed
+// members lack a quorum of live nodes, which joint consensus requires of both.
+// A nil isLive considers all nodes live.
+func validateMembershipChange(groupID GroupID, current *GroupMembers, members []NodeID,
+	isLive func(NodeID) bool) error {
+	if len(current.ProposedMembers) > 0 {
+		return &MembershipChangeInProgressError{groupID, current.ProposedMembers}
+	}
+	if len(members) == 0 {
+		return &NoVotersError{groupID}
+	}
+	seen := map[NodeID]bool{}
+	for _, id := range members {
+		if seen[id] {
+			return &DuplicateMemberError{groupID, id}
+		}
+		seen[id] = true
+	}
+	for _, nodes := range [][]NodeID{current.Members, members} {
+		live := 0
+		for _, id := range nodes {
+			if isLive == nil || isLive(id) {
+				live++
+			}
+		}
+		if live*2 <= len(nodes) {
+			return &QuorumError{groupID, nodes, live}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package multiraft
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestValidateMembershipChange verifies that unsafe membership changes
+// are refused with the errors describing them.
+func TestValidateMembershipChange(t *testing.T) {
+	current := &GroupMembers{Members: []NodeID{1, 2, 3}}
+	dead := func(ids ...NodeID) func(NodeID) bool {
+		return func(id NodeID) bool {
+			for _, d := range ids {
+				if id == d {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	for i, test := range []struct {
+		current *GroupMembers
+		members []NodeID
+		isLive  func(NodeID) bool
+		expErr  error
+	}{
+		{current, []NodeID{1, 2, 3, 4}, nil, nil},
+		{current, []NodeID{1, 2}, dead(3), nil},
+		{current, []NodeID{1, 2, 4}, dead(4), nil},
+		{current, nil, nil, &NoVotersError{1}},
+		{current, []NodeID{1, 2, 2}, nil, &DuplicateMemberError{1, 2}},
+		// Node 3's removal leaves a single live node of two.
+		{current, []NodeID{1, 2}, dead(2), &QuorumError{1, []NodeID{1, 2}, 1}},
+		// Adding two dead nodes leaves the new members without a quorum.
+		{current, []NodeID{1, 2, 3, 4, 5}, dead(3, 4, 5), &QuorumError{1, []NodeID{1, 2, 3, 4, 5}, 2}},
+		// The current members have lost their quorum, so no change can commit.
+		{current, []NodeID{1, 4, 5}, dead(2, 3), &QuorumError{1, []NodeID{1, 2, 3}, 1}},
+		{&GroupMembers{Members: []NodeID{1}, ProposedMembers: []NodeID{1, 2}}, []NodeID{1, 3}, nil,
+			&MembershipChangeInProgressError{1, []NodeID{1, 2}}},
+	} {
+		err := validateMembershipChange(1, test.current, test.members, test.isLive)
+		if !reflect.DeepEqual(err, test.expErr) {
+			t.Errorf("%d: expected error %v; got %v", i, test.expErr, err)
+		}
+	}
+}
+
+// TestChangeGroupMembership verifies that the leader of a group commits
+// safe membership changes and refuses unsafe ones.
+func TestChangeGroupMembership(t *testing.T) {
+	cluster := newTestCluster(3, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.clocks[0].TriggerElection()
+	<-cluster.events[0].LeaderElection
+
+	err := <-cluster.nodes[0].ChangeGroupMembership(groupID, []NodeID{1, 1, 2})
+	if _, ok := err.(*DuplicateMemberError); !ok {
+		t.Errorf("expected duplicate member error; got %v", err)
+	}
+	if err := <-cluster.nodes[0].ChangeGroupMembership(groupID, []NodeID{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestConcurrentMembershipChanges verifies that a membership change
+// proposed while another is in progress is refused, and that the next
+// change may be proposed once the first completes.
+func TestConcurrentMembershipChanges(t *testing.T) {
+	cluster := newTestCluster(3, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.clocks[0].TriggerElection()
+	<-cluster.events[0].LeaderElection
+
+	first := cluster.nodes[0].ChangeGroupMembership(groupID, []NodeID{1, 2})
+	second := cluster.nodes[0].ChangeGroupMembership(groupID, []NodeID{1, 2, 3})
+	err := <-second
+	if _, ok := err.(*MembershipChangeInProgressError); !ok {
+		t.Errorf("expected membership change in progress error; got %v", err)
+	}
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	// Node 3 is added back, catching up on the entries it missed.
+	if err := <-cluster.nodes[0].ChangeGroupMembership(groupID, []NodeID{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	committed := cluster.nodes[0].SubmitCommand(groupID, []byte("command"))
+	for _, events := range cluster.events {
+		if commit := <-events.CommandCommitted; string(commit.Command) != "command" {
+			t.Errorf("unexpected value in committed command: %v", commit.Command)
+		}
+	}
+	if err := <-committed; err != nil {
+		t.Fatal(err)
+	}
+}
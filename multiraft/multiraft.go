@@ -26,7 +26,8 @@ import (
 	"time"
 
 	"github.com/cockroachdb/cockroach/util"
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/metrics"
 )
 
 // NodeID is a unique non-zero identifier for the node within the cluster.
@@ -56,6 +57,36 @@ type Config struct {
 	ElectionTimeoutMin time.Duration
 	ElectionTimeoutMax time.Duration
 
+	// When a quorum of a group trails the leader's log by more than
+	// MaxFollowerLagEntries entries or MaxFollowerLagBytes bytes of
+	// command payloads, new commands submitted to the group are
+	// delayed until the quorum catches up, applying backpressure to
+	// clients rather than letting the leader's log grow ever further
+	// ahead of its followers. Followers outside of the quorum, such as
+	// those which have failed, don't delay commands. Zero disables
+	// either limit.
+	MaxFollowerLagEntries int
+	MaxFollowerLagBytes   int
+
+	// EventLoopShards is the number of event loops among which groups are sharded by
+	// GroupID, so that a node with many busy groups isn't limited by a single goroutine.
+	// Each loop has its own storage write task and connections to other nodes; all
+	// events of a group are handled by the same loop, in order.  Storage methods may be
+	// called concurrently for groups of different shards.  Zero means one loop.
+	EventLoopShards int
+
+	// MaxActiveGroups limits the number of groups per event loop shard whose raft state
+	// machines are kept instantiated.  Beyond it, the least recently used idle groups
+	// are reduced to their persistent state and reinstantiated on their next message
+	// or proposal (see state.getGroup), so that a node hosting many idle groups needs
+	// little memory for them.  Zero means no limit.
+	MaxActiveGroups int
+
+	// IsLive reports whether a node is believed to be live.  Membership changes which
+	// would leave a group without a quorum of live nodes are refused (see
+	// ChangeGroupMembership).  Nil considers all nodes live.
+	IsLive func(NodeID) bool
+
 	// If Strict is true, some warnings become fatal panics and additional (possibly expensive)
 	// sanity checks will be done.
 	Strict bool
@@ -67,6 +98,12 @@ func (c *Config) Validate() error {
 	if c.Transport == nil {
 		return util.Error("Transport is required")
 	}
+	if c.MaxFollowerLagEntries < 0 || c.MaxFollowerLagBytes < 0 {
+		return util.Error("MaxFollowerLag{Entries,Bytes} must be non-negative")
+	}
+	if c.EventLoopShards < 0 || c.MaxActiveGroups < 0 {
+		return util.Error("EventLoopShards and MaxActiveGroups must be non-negative")
+	}
 	if c.ElectionTimeoutMin == 0 || c.ElectionTimeoutMax == 0 {
 		return util.Error("ElectionTimeout{Min,Max} must be non-zero")
 	}
@@ -80,11 +117,11 @@ func (c *Config) Validate() error {
 // the Events channel in a timely manner.
 type MultiRaft struct {
 	Config
-	Events   chan interface{}
-	nodeID   NodeID
-	ops      chan interface{}
-	requests chan *rpc.Call
-	stopped  chan struct{}
+	Events  chan interface{}
+	nodeID  NodeID
+	log     log.Logger // Logs with the node ID in context
+	shards  []*state   // Event loops among which groups are sharded; see shardFor
+	stopper *util.Stopper
 }
 
 // NewMultiRaft creates a MultiRaft object.
@@ -102,12 +139,18 @@ func NewMultiRaft(nodeID NodeID, config *Config) (*MultiRaft, error) {
 	}
 
 	m := &MultiRaft{
-		Config:   *config,
-		nodeID:   nodeID,
-		Events:   make(chan interface{}, 1000),
-		ops:      make(chan interface{}, 100),
-		requests: make(chan *rpc.Call, 100),
-		stopped:  make(chan struct{}),
+		Config:  *config,
+		nodeID:  nodeID,
+		log:     log.New("multiraft").With(log.NodeID, nodeID),
+		Events:  make(chan interface{}, 1000),
+		stopper: util.NewStopper(),
+	}
+	numShards := config.EventLoopShards
+	if numShards == 0 {
+		numShards = 1
+	}
+	for i := 0; i < numShards; i++ {
+		m.shards = append(m.shards, newState(m))
 	}
 
 	err = m.Transport.Listen(nodeID, m)
@@ -118,46 +161,88 @@ func NewMultiRaft(nodeID NodeID, config *Config) (*MultiRaft, error) {
 	return m, nil
 }
 
-// Start runs the raft algorithm in a background goroutine.
+// Start runs the raft algorithm in background goroutines, one per event loop shard.
+// Groups previously created are loaded from storage and instantiated once they
+// receive a message or proposal.
 func (m *MultiRaft) Start() {
-	s := newState(m)
-	go s.start()
+	for ps := range m.Storage.LoadGroups() {
+		m.shardFor(ps.GroupID).cold[ps.GroupID] = &coldGroup{GroupPersistentState: *ps}
+	}
+	for _, s := range m.shards {
+		m.stopper.RunWorker(s.start)
+	}
+}
+
+// shardFor returns the event loop which handles the given group.  Groups are assigned
+// to shards by a hash of their ID.
+func (m *MultiRaft) shardFor(groupID GroupID) *state {
+	return m.shards[uint64(groupID)%uint64(len(m.shards))]
 }
 
 // Stop terminates the running raft instance and shuts down all network interfaces.
 func (m *MultiRaft) Stop() {
 	m.Transport.Stop(m.nodeID)
-	m.ops <- &stopOp{}
-	<-m.stopped
+	m.stopper.Stop()
 }
 
-// DoRPC implements ServerInterface
+// DoRPC implements ServerInterface.  The call is handled by the event loop of the
+// group it's addressed to.
 func (m *MultiRaft) DoRPC(name string, req, resp interface{}) error {
+	s := m.shards[0]
+	switch req := req.(type) {
+	case *RequestVoteRequest:
+		s = m.shardFor(req.GroupID)
+	case *AppendEntriesRequest:
+		s = m.shardFor(req.GroupID)
+	}
 	call := &rpc.Call{
 		ServiceMethod: name,
 		Args:          req,
 		Reply:         resp,
 		Done:          make(chan *rpc.Call, 1),
 	}
+	if err := s.dispatch(call); err != nil {
+		return err
+	}
 	select {
-	case m.requests <- call:
-	default:
-		m.strictErrorLog("RPC request channel blocked")
-		// In non-strict mode, try again with blocking.
-		m.requests <- call
+	case <-call.Done:
+		return call.Error
+	case <-m.stopper.ShouldStop():
+		return errStopped
 	}
-	<-call.Done
-	return call.Error
+}
 
+// dispatch queues an incoming RPC on the shard's request channel.  Each shard has its
+// own channel, so requests for different shards never contend with one another.  If
+// the channel is full the overflow is counted and, outside of strict mode, the caller
+// blocks until the shard catches up, applying backpressure to the sending node.
+// Returns an error if the node stops first.
+func (s *state) dispatch(call *rpc.Call) error {
+	dispatchCount.Inc(1)
+	dispatchDepth.Update(int64(len(s.requests)))
+	select {
+	case s.requests <- call:
+		return nil
+	default:
+	}
+	overflowCount.Inc(1)
+	s.strictErrorLog("RPC request channel blocked")
+	// In non-strict mode, try again with blocking.
+	select {
+	case s.requests <- call:
+		return nil
+	case <-s.stopper.ShouldStop():
+		return errStopped
+	}
 }
 
 // strictErrorLog panics in strict mode and logs an error otherwise.  Arguments are printf-style
-// and will be passed directly to either glog.Errorf or glog.Fatalf.
+// and will be passed directly to either Logger.Errorf or Logger.Fatalf.
 func (m *MultiRaft) strictErrorLog(format string, args ...interface{}) {
 	if m.Strict {
-		glog.Fatalf(format, args...)
+		m.log.Fatalf(format, args...)
 	} else {
-		glog.Errorf(format, args...)
+		m.log.Errorf(format, args...)
 	}
 }
 
@@ -181,19 +266,78 @@ func (m *MultiRaft) CreateGroup(groupID GroupID, initialMembers []NodeID) error
 		}
 	}
 	op := &createGroupOp{newGroup(groupID, initialMembers), make(chan error)}
-	m.ops <- op
+	m.shardFor(groupID).ops <- op
 	return <-op.ch
 }
 
-// SubmitCommand sends a command (a binary blob) to the cluster.  This method returns
-// when the command has been successfully sent, not when it has been committed.
-// TODO(bdarnell): should SubmitCommand wait until the commit?
-func (m *MultiRaft) SubmitCommand(groupID GroupID, command []byte) error {
-	op := &submitCommandOp{groupID, command, make(chan error)}
-	m.ops <- op
-	return <-op.ch
+// SubmitCommand sends a command (a binary blob) to the cluster.  The command is
+// buffered and proposed by the group's event loop along with any other commands
+// submitted in the meantime (see proposalBuffer).  The returned channel receives nil
+// once the command has been committed, or an error if it couldn't be proposed.  If the
+// group's quorum lags too far behind (see Config.MaxFollowerLagEntries), the command
+// isn't proposed until the quorum catches up.
+func (m *MultiRaft) SubmitCommand(groupID GroupID, command []byte) <-chan error {
+	op := &submitCommandOp{groupID, command, make(chan error, 1), LogEntryCommand}
+	m.shardFor(groupID).proposals.add(op)
+	return op.ch
+}
+
+// SubmitEntry sends a log entry of the specified type to the cluster.  value is
+// encoded by the codec of the type (see RegisterLogEntryType), and the entry is
+// proposed and acknowledged like the commands of SubmitCommand.  Once committed,
+// the entry is applied according to its type; e.g. LogEntryConfigChange entries
+// broadcast EventMembershipChangeCommitted.
+func (m *MultiRaft) SubmitEntry(groupID GroupID, typ LogEntryType, value interface{}) <-chan error {
+	ch := make(chan error, 1)
+	h, err := getLogEntryHandler(typ)
+	if err != nil {
+		ch <- err
+		return ch
+	}
+	payload, err := h.codec.Encode(value)
+	if err != nil {
+		ch <- util.Errorf("unable to encode %s entry: %s", h.name, err)
+		return ch
+	}
+	op := &submitCommandOp{groupID, payload, ch, typ}
+	m.shardFor(groupID).proposals.add(op)
+	return op.ch
+}
+
+// WaitForLeaderBarrier returns a channel which receives nil once this node, as
+// leader of the group, has committed the no-op barrier entry it proposed on winning
+// the election.  Until then the leader's commit index may trail entries committed in
+// prior terms, so consistent reads shouldn't be served.  The channel receives an
+// error if this node isn't the group's leader.
+func (m *MultiRaft) WaitForLeaderBarrier(groupID GroupID) <-chan error {
+	op := &waitForBarrierOp{groupID, make(chan error, 1)}
+	m.shardFor(groupID).ops <- op
+	return op.ch
 }
 
+// errStopped is returned for operations and requests cut short by Stop.
+var errStopped = util.Error("multiraft stopped")
+
+// Metrics exported by all MultiRaft instances of the process.
+var (
+	proposalCount = metrics.DefaultRegistry.Counter("multiraft_proposals")
+	throttleCount = metrics.DefaultRegistry.Counter("multiraft_throttled_proposals")
+	// Commands submitted per flush of a shard's proposal buffer.
+	proposalBatchSize = metrics.DefaultRegistry.Histogram("multiraft_proposal_batch_size", metrics.SizeBuckets)
+	electionCount     = metrics.DefaultRegistry.Counter("multiraft_elections")
+	leaderCount       = metrics.DefaultRegistry.Counter("multiraft_leader_transitions")
+	commitCount       = metrics.DefaultRegistry.Counter("multiraft_committed_entries")
+	writeLatency      = metrics.DefaultRegistry.Histogram("multiraft_write_latency_ns", metrics.LatencyBuckets)
+	// Groups with instantiated raft state, and instantiations of cold groups.
+	activeGroups     = metrics.DefaultRegistry.Gauge("multiraft_active_groups")
+	instantiateCount = metrics.DefaultRegistry.Counter("multiraft_group_instantiations")
+	// Incoming requests, those which found their shard's request channel full, and the
+	// channel's length as each is dispatched.
+	dispatchCount = metrics.DefaultRegistry.Counter("multiraft_dispatched_requests")
+	overflowCount = metrics.DefaultRegistry.Counter("multiraft_dispatch_overflows")
+	dispatchDepth = metrics.DefaultRegistry.Histogram("multiraft_dispatch_queue_depth", metrics.SizeBuckets)
+)
+
 // Role represents the state of the node in a group.
 type Role int
 
@@ -235,6 +379,7 @@ type group struct {
 	// Volatile state
 	role             Role
 	commitIndex      int
+	leaderCommit     int // The highest commit index received from the leader
 	lastApplied      int
 	electionDeadline time.Time
 	votes            map[NodeID]bool
@@ -246,11 +391,48 @@ type group struct {
 	nextIndex  map[NodeID]int // default: lastLogIndex + 1
 	matchIndex map[NodeID]int // default: 0
 
+	// The index of the no-op entry proposed by this node on winning its last election,
+	// or -1 until the entry is proposed (see maybeProposeBarrier).  Committing it commits
+	// the entries of prior terms and establishes the leader's commit index;
+	// barrierWaiters are notified once it commits.
+	barrierIndex   int
+	barrierWaiters []chan error
+
+	// The membership change proposed by this node as leader which hasn't completed, if
+	// any (see changeMembership).
+	membershipChange *changeMembershipOp
+
 	// a List of *pendingCall
 	pendingCalls list.List
 
 	// LogEntries that have not been persisted.  The group is 'dirty' when this is non-empty.
 	pendingEntries []*LogEntry
+
+	// Leader flow control state (see Config.MaxFollowerLagEntries).  proposals holds the
+	// commands proposed by this node which a quorum hasn't yet acknowledged (tracked
+	// only if MaxFollowerLagBytes is set), and
+	// delayedCommands the commands waiting for a lagging quorum to catch up, in order.
+	proposals       []proposal
+	delayedCommands []*submitCommandOp
+
+	// Commands proposed by this node, in log order, whose submitters are acknowledged
+	// once they commit.
+	uncommitted []*proposedCommand
+
+	// The group's element of its shard's list of active groups.
+	lruElement *list.Element
+}
+
+// proposedCommand is a command appended to the leader's log at index.
+type proposedCommand struct {
+	index int
+	op    *submitCommandOp
+}
+
+// proposal records the log index and payload size of a command proposed by the leader.
+type proposal struct {
+	index int
+	bytes int
 }
 
 func newGroup(groupID GroupID, members []NodeID) *group {
@@ -286,24 +468,35 @@ func (g *group) findQuorumIndexInNodes(nodes []NodeID) int {
 	for _, nodeID := range nodes {
 		indices = append(indices, g.matchIndex[nodeID])
 	}
+	// The indices are sorted in ascending order, so a quorum of nodes has reached the
+	// index at the position which leaves a quorum at or above it.
 	sort.Ints(indices)
-	quorumPos := len(indices)/2 + 1
+	quorumPos := len(indices) - (len(indices)/2 + 1)
 	return indices[quorumPos]
 }
 
-type stopOp struct{}
-
 type createGroupOp struct {
 	group *group
 	ch    chan error
 }
 
-type submitCommandOp struct {
+// waitForBarrierOp waits for this node's leader barrier in a group (see
+// MultiRaft.WaitForLeaderBarrier).
+type waitForBarrierOp struct {
 	groupID GroupID
-	command []byte
 	ch      chan error
 }
 
+// submitCommandOp is a command submitted to a group.  ch is buffered so that the
+// event loop never blocks acknowledging the submitter.  command is the encoded
+// payload of the log entry to propose, of type entryType.
+type submitCommandOp struct {
+	groupID   GroupID
+	command   []byte
+	ch        chan error
+	entryType LogEntryType
+}
+
 // node represents a connection to a remote node.
 type node struct {
 	nodeID   NodeID
@@ -311,32 +504,50 @@ type node struct {
 	client   *asyncClient
 }
 
-// state represents the internal state of a MultiRaft object.  All variables here
-// are accessible only from the state.start goroutine so they can be accessed without
-// synchronization.
+// state represents the internal state of one event loop shard of a MultiRaft object,
+// holding the groups assigned to the shard (see MultiRaft.shardFor).  All variables
+// here are accessible only from the state.start goroutine so they can be accessed
+// without synchronization.
 type state struct {
 	*MultiRaft
+	ops           chan interface{}
+	requests      chan *rpc.Call
+	proposals     *proposalBuffer
 	rand          *rand.Rand
-	groups        map[GroupID]*group
+	groups        map[GroupID]*group     // Instantiated groups
+	cold          map[GroupID]*coldGroup // Groups which aren't instantiated
+	lru           *list.List             // Instantiated groups, most recently used first
 	dirtyGroups   map[GroupID]*group
 	nodes         map[NodeID]*node
 	electionTimer *time.Timer
 	responses     chan *rpc.Call
 	writeTask     *writeTask
+	writeStart    time.Time // Start of the outstanding write request
 }
 
 func newState(m *MultiRaft) *state {
 	return &state{
 		MultiRaft:   m,
+		ops:         make(chan interface{}, 100),
+		requests:    make(chan *rpc.Call, 100),
+		proposals:   newProposalBuffer(),
 		rand:        util.NewPseudoRand(),
 		groups:      make(map[GroupID]*group),
+		cold:        make(map[GroupID]*coldGroup),
+		lru:         list.New(),
 		dirtyGroups: make(map[GroupID]*group),
 		nodes:       make(map[NodeID]*node),
 		responses:   make(chan *rpc.Call, 100),
-		writeTask:   newWriteTask(m.Storage),
+		writeTask:   newWriteTask(m.Storage, m.stopper),
 	}
 }
 
+// groupLog returns the node's logger with groupID added to its
+// context.
+func (s *state) groupLog(groupID GroupID) log.Logger {
+	return s.log.With(log.GroupID, groupID)
+}
+
 func (s *state) updateElectionDeadline(g *group) {
 	timeout := util.RandIntInRange(s.rand, int(s.ElectionTimeoutMin), int(s.ElectionTimeoutMax))
 	g.electionDeadline = s.Clock.Now().Add(time.Duration(timeout))
@@ -355,8 +566,8 @@ func (s *state) nextElectionTimer() *time.Timer {
 }
 
 func (s *state) start() {
-	glog.V(1).Infof("node %v starting", s.nodeID)
-	go s.writeTask.start()
+	s.log.V(1).Infof("starting")
+	s.stopper.RunWorker(s.writeTask.start)
 	for {
 		electionTimer := s.nextElectionTimer()
 		var writeReady chan struct{}
@@ -365,27 +576,29 @@ func (s *state) start() {
 		} else {
 			writeReady = nil
 		}
-		glog.V(6).Infof("node %v: selecting", s.nodeID)
+		s.log.V(6).Infof("selecting")
 		select {
+		case <-s.proposals.ready:
+			s.flushProposals()
+
 		case op := <-s.ops:
-			glog.V(6).Infof("node %v: got op %#v", s.nodeID, op)
+			s.log.V(6).Infof("got op %#v", op)
 			switch op := op.(type) {
-			case *stopOp:
-				s.stop()
-				return
-
 			case *createGroupOp:
 				s.createGroup(op)
 
-			case *submitCommandOp:
-				s.submitCommand(op)
+			case *waitForBarrierOp:
+				s.waitForBarrier(op)
+
+			case *changeMembershipOp:
+				s.changeMembership(op)
 
 			default:
 				s.strictErrorLog("unknown op: %#v", op)
 			}
 
 		case call := <-s.requests:
-			glog.V(6).Infof("node %v: got request %v", s.nodeID, call)
+			s.log.V(6).Infof("got request %v", call)
 			switch call.ServiceMethod {
 			case requestVoteName:
 				s.requestVoteRequest(call.Args.(*RequestVoteRequest),
@@ -400,7 +613,13 @@ func (s *state) start() {
 			}
 
 		case call := <-s.responses:
-			glog.V(6).Infof("node %v: got response %v", s.nodeID, call)
+			s.log.V(6).Infof("got response %v", call)
+			if call.Error != nil {
+				// The request failed (e.g. the remote node was stopping), so the
+				// reply is meaningless; raft will retry.
+				s.log.V(1).Infof("%s failed: %v", call.ServiceMethod, call.Error)
+				break
+			}
 			switch call.ServiceMethod {
 			case requestVoteName:
 				s.requestVoteResponse(call.Args.(*RequestVoteRequest), call.Reply.(*RequestVoteResponse))
@@ -420,73 +639,210 @@ func (s *state) start() {
 			s.handleWriteResponse(resp)
 
 		case now := <-electionTimer.C:
-			glog.V(6).Infof("node %v: got election timer", s.nodeID)
+			s.log.V(6).Infof("got election timer")
 			s.handleElectionTimers(now)
+
+		case <-s.stopper.ShouldStop():
+			s.Clock.StopElectionTimer(electionTimer)
+			s.stop()
+			return
 		}
 		s.Clock.StopElectionTimer(electionTimer)
 	}
 }
 
 func (s *state) stop() {
-	glog.V(6).Infof("node %v stopping", s.nodeID)
+	s.log.V(6).Infof("stopping")
+	for _, g := range s.groups {
+		for _, op := range g.delayedCommands {
+			op.ch <- errStopped
+		}
+		g.delayedCommands = nil
+		for _, c := range g.uncommitted {
+			c.op.ch <- errStopped
+		}
+		g.uncommitted = nil
+		for _, ch := range g.barrierWaiters {
+			ch <- errStopped
+		}
+		g.barrierWaiters = nil
+		if g.membershipChange != nil {
+			g.membershipChange.ch <- errStopped
+			g.membershipChange = nil
+		}
+	}
+	for _, op := range s.proposals.flush() {
+		op.ch <- errStopped
+	}
 	for _, n := range s.nodes {
 		err := n.client.conn.Close()
 		if err != nil {
-			glog.Warning("error stopping client:", err)
+			s.log.Warningf("error stopping client: %v", err)
 		}
 	}
-	s.writeTask.stop()
-	close(s.stopped)
 }
 
 func (s *state) createGroup(op *createGroupOp) {
-	glog.V(6).Infof("node %v creating group %v", s.nodeID, op.group.groupID)
-	if _, ok := s.groups[op.group.groupID]; ok {
+	s.groupLog(op.group.groupID).V(6).Infof("creating group")
+	_, active := s.groups[op.group.groupID]
+	if _, cold := s.cold[op.group.groupID]; active || cold {
 		op.ch <- util.Errorf("group %v already exists", op.group.groupID)
 		return
 	}
-	for _, member := range op.group.committedMembers.Members {
-		if node, ok := s.nodes[member]; ok {
-			node.refCount++
-			continue
-		}
-		conn, err := s.Transport.Connect(member)
-		if err != nil {
-			op.ch <- err
-			return
-		}
-		s.nodes[member] = &node{member, 1, &asyncClient{member, conn, s.responses}}
+	op.ch <- s.addGroup(op.group)
+}
+
+// waitForBarrier acknowledges op once the group's leader barrier commits, or
+// immediately if it already has.
+func (s *state) waitForBarrier(op *waitForBarrierOp) {
+	g, err := s.getGroup(op.groupID)
+	if err != nil {
+		op.ch <- err
+		return
+	}
+	if g.role != RoleLeader {
+		op.ch <- util.Errorf("node %v is not the leader of group %v", s.nodeID, op.groupID)
+		return
+	}
+	if g.barrierIndex != -1 && g.commitIndex >= g.barrierIndex {
+		op.ch <- nil
+		return
+	}
+	g.barrierWaiters = append(g.barrierWaiters, op.ch)
+}
+
+// maybeProposeBarrier proposes the no-op barrier entry of a newly-elected leader once
+// the election state of its term has been persisted, so that the entry is never
+// broadcast on behalf of a term the leader could forget.  The barrier is proposed
+// ahead of any throttled commands, so that the entries of prior terms commit without
+// waiting for new commands.
+func (s *state) maybeProposeBarrier(g *group) {
+	if g.role != RoleLeader || g.barrierIndex != -1 || !g.electionState.Equal(g.persistedElectionState) {
+		return
+	}
+	s.proposeCommand(g, &submitCommandOp{g.groupID, nil, make(chan error, 1), LogEntryNoop})
+	g.barrierIndex = g.lastLogIndex
+}
+
+// flushProposals submits the commands buffered since the last flush, in order.
+func (s *state) flushProposals() {
+	ops := s.proposals.flush()
+	proposalBatchSize.Update(int64(len(ops)))
+	for _, op := range ops {
+		s.submitCommand(op)
 	}
-	s.updateElectionDeadline(op.group)
-	s.groups[op.group.groupID] = op.group
-	op.ch <- nil
 }
 
 func (s *state) submitCommand(op *submitCommandOp) {
-	glog.V(6).Infof("node %v submitting command to group %v", s.nodeID, op.groupID)
-	g := s.groups[op.groupID]
+	s.groupLog(op.groupID).V(6).Infof("submitting command")
+	proposalCount.Inc(1)
+	g, err := s.getGroup(op.groupID)
+	if err != nil {
+		op.ch <- err
+		return
+	}
 	if g.role != RoleLeader {
 		op.ch <- util.Error("TODO(bdarnell): forward commands to leader")
 		return
 	}
+	// Commands queue behind those already delayed so they're proposed in order.
+	if len(g.delayedCommands) > 0 || s.isThrottled(g) {
+		s.groupLog(op.groupID).V(1).Infof("delaying command until a quorum catches up")
+		throttleCount.Inc(1)
+		g.delayedCommands = append(g.delayedCommands, op)
+		return
+	}
+	s.proposeCommand(g, op)
+}
 
+// proposeCommand appends the command to the leader's log.  The submitter is
+// acknowledged once the command commits (see commitEntries).
+func (s *state) proposeCommand(g *group, op *submitCommandOp) {
 	g.lastLogIndex++
 	entry := &LogEntry{
 		Term:    g.electionState.CurrentTerm,
 		Index:   g.lastLogIndex,
-		Type:    LogEntryCommand,
+		Type:    op.entryType,
 		Payload: op.command,
 	}
 	g.pendingEntries = append(g.pendingEntries, entry)
+	if s.MaxFollowerLagBytes > 0 {
+		g.proposals = append(g.proposals, proposal{entry.Index, len(op.command)})
+	}
+	g.uncommitted = append(g.uncommitted, &proposedCommand{entry.Index, op})
 	s.updateDirtyStatus(g)
-	op.ch <- nil
+}
+
+// quorumLag returns the number of entries and of bytes of proposed command payloads
+// by which the group's quorum trails the leader's log: the lag of the log index which a
+// quorum of the current members has acknowledged (see findQuorumIndex).  Followers which
+// fail or fall behind without holding back the quorum don't count, so that a dead
+// follower can't block the group's commands.  Followers which haven't acknowledged any
+// entries since this node's election are taken to be caught up, so that a
+// newly-elected leader isn't throttled before hearing from them.
+func (s *state) quorumLag(g *group) (entries, bytes int) {
+	quorumIndex := -1
+	for _, nodes := range [][]NodeID{g.currentMembers.Members, g.currentMembers.ProposedMembers} {
+		if len(nodes) == 0 {
+			continue
+		}
+		indices := make([]int, len(nodes))
+		for i, id := range nodes {
+			matchIndex, ok := g.matchIndex[id]
+			if id == s.nodeID || !ok {
+				matchIndex = g.lastLogIndex
+			}
+			indices[i] = matchIndex
+		}
+		sort.Ints(indices)
+		if index := indices[len(indices)-(len(indices)/2+1)]; quorumIndex == -1 || index < quorumIndex {
+			quorumIndex = index
+		}
+	}
+	if quorumIndex == -1 {
+		return 0, 0
+	}
+	for _, p := range g.proposals {
+		if p.index > quorumIndex {
+			bytes += p.bytes
+		}
+	}
+	return g.lastLogIndex - quorumIndex, bytes
+}
+
+// isThrottled returns true if commands submitted to the group must be delayed because
+// its quorum lags by more than the configured limits.
+func (s *state) isThrottled(g *group) bool {
+	if s.MaxFollowerLagEntries == 0 && s.MaxFollowerLagBytes == 0 {
+		return false
+	}
+	entries, bytes := s.quorumLag(g)
+	return (s.MaxFollowerLagEntries > 0 && entries > s.MaxFollowerLagEntries) ||
+		(s.MaxFollowerLagBytes > 0 && bytes > s.MaxFollowerLagBytes)
+}
+
+// releaseDelayedCommands forgets the proposals acknowledged by a quorum and proposes
+// delayed commands for as long as the quorum's lag permits.
+func (s *state) releaseDelayedCommands(g *group) {
+	entries, _ := s.quorumLag(g)
+	quorumIndex := g.lastLogIndex - entries
+	i := 0
+	for i < len(g.proposals) && g.proposals[i].index <= quorumIndex {
+		i++
+	}
+	g.proposals = g.proposals[i:]
+	for len(g.delayedCommands) > 0 && !s.isThrottled(g) {
+		op := g.delayedCommands[0]
+		g.delayedCommands = g.delayedCommands[1:]
+		s.proposeCommand(g, op)
+	}
 }
 
 func (s *state) requestVoteRequest(req *RequestVoteRequest, resp *RequestVoteResponse,
 	call *rpc.Call) {
-	g, ok := s.groups[req.GroupID]
-	if !ok {
-		call.Error = util.Errorf("unknown group %v", req.GroupID)
+	g, err := s.getGroup(req.GroupID)
+	if err != nil {
+		call.Error = err
 		call.Done <- call
 		return
 	}
@@ -513,7 +869,11 @@ func hasMajority(votes map[NodeID]bool, members []NodeID) bool {
 }
 
 func (s *state) requestVoteResponse(req *RequestVoteRequest, resp *RequestVoteResponse) {
-	g := s.groups[req.GroupID]
+	g, err := s.getGroup(req.GroupID)
+	if err != nil {
+		s.log.Warningf("vote response: %v", err)
+		return
+	}
 	if resp.Term < g.electionState.CurrentTerm {
 		return
 	}
@@ -528,8 +888,11 @@ func (s *state) requestVoteResponse(req *RequestVoteRequest, resp *RequestVoteRe
 		(len(g.currentMembers.ProposedMembers) == 0 ||
 			hasMajority(g.votes, g.currentMembers.ProposedMembers)) {
 		g.role = RoleLeader
-		glog.V(1).Infof("node %v becoming leader for group %v", s.nodeID, g.groupID)
+		s.groupLog(g.groupID).V(1).Infof("becoming leader")
+		leaderCount.Inc(1)
 		s.sendEvent(&EventLeaderElection{g.groupID, s.nodeID})
+		g.barrierIndex = -1
+		s.maybeProposeBarrier(g)
 	}
 	s.updateDirtyStatus(g)
 }
@@ -546,23 +909,49 @@ func (s *state) requestVoteResponse(req *RequestVoteRequest, resp *RequestVoteRe
 // min(leaderCommit, last log index)
 func (s *state) appendEntriesRequest(req *AppendEntriesRequest, resp *AppendEntriesResponse,
 	call *rpc.Call) {
-	g := s.groups[req.GroupID]
+	g, err := s.getGroup(req.GroupID)
+	if err != nil {
+		call.Error = err
+		call.Done <- call
+		return
+	}
 	resp.Term = g.electionState.CurrentTerm
 	if req.Term < g.electionState.CurrentTerm {
 		resp.Success = false
 		call.Done <- call
 		return
 	}
-	// TODO(bdarnell): check prevLogIndex and terms
-	g.pendingEntries = append(g.pendingEntries, req.Entries...)
-	if len(g.pendingEntries) > 0 {
-		lastEntry := g.pendingEntries[len(g.pendingEntries)-1]
-		g.lastLogIndex = lastEntry.Index
-		g.lastLogTerm = lastEntry.Term
+	// TODO(bdarnell): check terms
+	if req.PrevLogIndex > g.lastLogIndex {
+		// Our log doesn't reach the entries sent (e.g. an earlier request is still in
+		// flight), so appending them would leave a gap.  The leader resends the
+		// entries we may be missing.
+		resp.Success = false
+		call.Done <- call
+		return
+	}
+	if req.LeaderCommit > g.leaderCommit {
+		g.leaderCommit = req.LeaderCommit
+	}
+	// Entries already in the log are skipped; in particular a leader receives its
+	// own entries, and appending them again could move lastLogIndex backwards
+	// past commands proposed in the meantime.
+	for _, entry := range req.Entries {
+		if entry.Index > g.lastLogIndex {
+			g.pendingEntries = append(g.pendingEntries, entry)
+			g.lastLogIndex = entry.Index
+			g.lastLogTerm = entry.Term
+		}
 	}
 	s.updateDirtyStatus(g)
 	resp.Success = true
-	g.pendingCalls.PushBack(&pendingCall{call, -1, g.lastLogIndex})
+	if _, dirty := s.dirtyGroups[g.groupID]; !dirty && g.lastLogIndex <= g.persistedLastIndex {
+		// Nothing new to persist (e.g. a heartbeat), so there is no write
+		// response to wait for.
+		call.Done <- call
+	} else {
+		g.pendingCalls.PushBack(&pendingCall{call, -1, g.lastLogIndex})
+	}
 	s.commitEntries(g, req.LeaderCommit)
 }
 
@@ -572,22 +961,33 @@ func (s *state) appendEntriesRequest(req *AppendEntriesRequest, resp *AppendEntr
 // If there exists an N such that N > commitIndex, a majority of matchIndex[i] ≥ N, and
 // log[N].term == currentTerm: set commitIndex = N (§5.3, §5.4).
 func (s *state) appendEntriesResponse(req *AppendEntriesRequest, resp *AppendEntriesResponse) {
-	g := s.groups[req.GroupID]
+	g, err := s.getGroup(req.GroupID)
+	if err != nil {
+		s.log.Warningf("append entries response: %v", err)
+		return
+	}
 	if resp.Success {
 		if len(req.Entries) > 0 {
-			lastIndex := req.Entries[len(req.Entries)-1].Index
-			g.nextIndex[req.DestNode] = lastIndex + 1
-			g.matchIndex[req.DestNode] = lastIndex
+			// Responses may arrive out of order, so an earlier request's mustn't move
+			// the follower's position backwards.
+			if lastIndex := req.Entries[len(req.Entries)-1].Index; lastIndex > g.matchIndex[req.DestNode] {
+				g.nextIndex[req.DestNode] = lastIndex + 1
+				g.matchIndex[req.DestNode] = lastIndex
+			}
+			s.releaseDelayedCommands(g)
 		}
-	} else {
-		g.nextIndex[req.DestNode]--
+	} else if resp.Term <= g.electionState.CurrentTerm {
+		// The follower's log didn't reach the entries sent, so resend all those it
+		// hasn't acknowledged.
+		g.nextIndex[req.DestNode] = g.matchIndex[req.DestNode] + 1
+		s.sendEntries(g, req.DestNode, g.matchIndex[req.DestNode])
 	}
 
 	s.commitEntries(g, g.findQuorumIndex())
 }
 
 func (s *state) handleWriteReady() {
-	glog.V(6).Infof("node %v write ready, preparing request", s.nodeID)
+	s.log.V(6).Infof("write ready, preparing request")
 	writeRequest := newWriteRequest()
 	for groupID, group := range s.dirtyGroups {
 		req := &groupWriteRequest{}
@@ -601,6 +1001,7 @@ func (s *state) handleWriteReady() {
 			group.pendingEntries = nil
 		}
 	}
+	s.writeStart = time.Now()
 	s.writeTask.in <- writeRequest
 }
 
@@ -608,8 +1009,8 @@ func (s *state) broadcastEntries(g *group, entries []*LogEntry) {
 	if g.role != RoleLeader {
 		return
 	}
-	glog.V(6).Infof("node %v: broadcasting entries to followers", s.nodeID)
-	for _, id := range g.currentMembers.Members {
+	s.groupLog(g.groupID).V(6).Infof("broadcasting entries to followers")
+	for _, id := range g.currentMembers.allMembers() {
 		node := s.nodes[id]
 		node.client.appendEntries(&AppendEntriesRequest{
 			RequestHeader: RequestHeader{s.nodeID, id},
@@ -624,20 +1025,64 @@ func (s *state) broadcastEntries(g *group, entries []*LogEntry) {
 	}
 }
 
+// sendEntries sends the persisted entries following prevIndex to a member of the
+// group.
+func (s *state) sendEntries(g *group, nodeID NodeID, prevIndex int) {
+	if g.role != RoleLeader {
+		return
+	}
+	req := &AppendEntriesRequest{
+		RequestHeader: RequestHeader{s.nodeID, nodeID},
+		GroupID:       g.groupID,
+		Term:          g.electionState.CurrentTerm,
+		LeaderID:      s.nodeID,
+		PrevLogIndex:  prevIndex,
+		LeaderCommit:  g.commitIndex,
+	}
+	if prevIndex < g.persistedLastIndex {
+		firstIndex := prevIndex
+		if firstIndex == 0 {
+			firstIndex = 1
+		}
+		entries := make(chan *LogEntryState, 100)
+		go s.Storage.GetLogEntries(g.groupID, firstIndex, g.persistedLastIndex, entries)
+		for entry := range entries {
+			if entry.Error != nil {
+				s.groupLog(g.groupID).Warningf("failed to read entry %v: %v", entry.Index, entry.Error)
+				return
+			}
+			if entry.Index == prevIndex {
+				req.PrevLogTerm = entry.Entry.Term
+				continue
+			}
+			e := entry.Entry
+			req.Entries = append(req.Entries, &e)
+		}
+	}
+	s.nodes[nodeID].client.appendEntries(req)
+}
+
 func (s *state) handleWriteResponse(response *writeResponse) {
-	glog.V(6).Infof("node %v got write response: %#v", s.nodeID, *response)
+	s.log.V(6).Infof("got write response: %#v", *response)
+	writeLatency.UpdateSince(s.writeStart)
 	for groupID, persistedGroup := range response.groups {
 		g := s.groups[groupID]
 		if persistedGroup.electionState != nil {
 			g.persistedElectionState = persistedGroup.electionState
 		}
 		if persistedGroup.lastIndex != -1 {
-			glog.V(6).Infof("node %v: updating persisted log index to %v", s.nodeID,
+			s.groupLog(groupID).V(6).Infof("updating persisted log index to %v",
 				persistedGroup.lastIndex)
 			s.broadcastEntries(g, persistedGroup.entries)
 			g.persistedLastIndex = persistedGroup.lastIndex
 			g.persistedLastTerm = persistedGroup.lastTerm
+			// Commit the entries the leader had already committed when we received
+			// them, which commitEntries capped at our persisted index.
+			if g.role != RoleLeader {
+				s.commitEntries(g, g.leaderCommit)
+			}
 		}
+		s.maybeProposeBarrier(g)
 
 		// Resolve any pending RPCs that have been waiting for persistence to catch up.
 		var toDelete []*list.Element
@@ -671,7 +1116,8 @@ func (s *state) handleElectionTimers(now time.Time) {
 }
 
 func (s *state) becomeCandidate(g *group) {
-	glog.V(1).Infof("node %v becoming candidate (was %v) for group %s", s.nodeID, g.role, g.groupID)
+	s.groupLog(g.groupID).V(1).Infof("becoming candidate (was %v)", g.role)
+	electionCount.Inc(1)
 	if g.role == RoleLeader {
 		panic("cannot transition from leader to candidate")
 	}
@@ -682,7 +1128,7 @@ func (s *state) becomeCandidate(g *group) {
 	// TODO(bdarnell): scan the uncommitted tail to find currentMembers.
 	g.currentMembers = g.committedMembers
 	s.updateElectionDeadline(g)
-	for _, id := range g.currentMembers.Members {
+	for _, id := range g.currentMembers.allMembers() {
 		node := s.nodes[id]
 		node.client.requestVote(&RequestVoteRequest{
 			RequestHeader: RequestHeader{s.nodeID, id},
@@ -700,29 +1146,40 @@ func (s *state) commitEntries(g *group, index int) {
 	if index <= g.commitIndex {
 		// Commit index cannot actually move backwards, but a newly-elected leader might
 		// report stale positions for a short time so just ignore them.
-		glog.V(6).Infof("node %v: ignoring commit index %v because it is behind existing commit %v",
-			s.nodeID, index, g.commitIndex)
+		s.groupLog(g.groupID).V(6).Infof("ignoring commit index %v because it is behind existing commit %v",
+			index, g.commitIndex)
 		return
 	}
 	if index > g.persistedLastIndex {
 		// If we are not caught up with the leader, just commit as far as we can.
 		// We'll continue to commit new entries as we receive AppendEntriesRequests.
-		glog.V(6).Infof("node %v: leader is commited to %v, but capping to %v",
-			s.nodeID, index, g.persistedLastIndex)
+		s.groupLog(g.groupID).V(6).Infof("leader is commited to %v, but capping to %v",
+			index, g.persistedLastIndex)
 		index = g.persistedLastIndex
 	}
-	glog.V(6).Infof("node %v advancing commit position for group %v from %v to %v",
-		s.nodeID, g.groupID, g.commitIndex, index)
+	s.groupLog(g.groupID).V(6).Infof("advancing commit position from %v to %v",
+		g.commitIndex, index)
 	// TODO(bdarnell): move storage access (incl. the channel iteration) to a goroutine
 	entries := make(chan *LogEntryState, 100)
 	go s.Storage.GetLogEntries(g.groupID, g.commitIndex+1, index, entries)
 	for entry := range entries {
-		glog.V(6).Infof("node %v: committing %+v", s.nodeID, entry)
-		if entry.Entry.Type == LogEntryCommand {
-			s.sendEvent(&EventCommandCommitted{entry.Entry.Payload})
-		}
+		s.groupLog(g.groupID).V(6).Infof("committing %+v", entry)
+		commitCount.Inc(1)
+		s.applyEntry(g, &entry.Entry)
 	}
 	g.commitIndex = index
+	// Acknowledge the submitters of the newly committed commands.
+	i := 0
+	for ; i < len(g.uncommitted) && g.uncommitted[i].index <= index; i++ {
+		g.uncommitted[i].op.ch <- nil
+	}
+	g.uncommitted = g.uncommitted[i:]
+	if g.role == RoleLeader && g.barrierIndex != -1 && index >= g.barrierIndex {
+		for _, ch := range g.barrierWaiters {
+			ch <- nil
+		}
+		g.barrierWaiters = nil
+	}
 	s.broadcastEntries(g, nil)
 }
 
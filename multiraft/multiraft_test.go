@@ -18,6 +18,8 @@
 package multiraft
 
 import (
+	"encoding/binary"
+	"net/rpc"
 	"testing"
 	"time"
 
@@ -25,17 +27,25 @@ import (
 )
 
 type testCluster struct {
-	t      *testing.T
-	nodes  []*state
-	clocks []*manualClock
+	t      testing.TB
+	nodes  []*MultiRaft
+	clocks []*ManualClock
 	events []*eventDemux
 }
 
-func newTestCluster(size int, t *testing.T) *testCluster {
+func newTestCluster(size int, t testing.TB) *testCluster {
+	return newShardedTestCluster(size, 1, t)
+}
+
+// newShardedTestCluster creates a cluster whose nodes each run the given number of
+// event loop shards.
+func newShardedTestCluster(size, shards int, t testing.TB) *testCluster {
 	transport := NewLocalRPCTransport()
 	cluster := &testCluster{t: t}
+	// Benchmarks may back up the request queues, which strict mode treats as fatal.
+	_, strict := t.(*testing.T)
 	for i := 0; i < size; i++ {
-		clock := newManualClock()
+		clock := NewManualClock()
 		storage := NewMemoryStorage()
 		config := &Config{
 			Transport:          transport,
@@ -43,22 +53,22 @@ func newTestCluster(size int, t *testing.T) *testCluster {
 			Clock:              clock,
 			ElectionTimeoutMin: 10 * time.Millisecond,
 			ElectionTimeoutMax: 20 * time.Millisecond,
-			Strict:             true,
+			EventLoopShards:    shards,
+			Strict:             strict,
 		}
 		mr, err := NewMultiRaft(NodeID(i+1), config)
 		if err != nil {
 			t.Fatal(err)
 		}
-		state := newState(mr)
-		demux := newEventDemux(state.Events)
+		demux := newEventDemux(mr.Events)
 		demux.start()
-		cluster.nodes = append(cluster.nodes, state)
+		cluster.nodes = append(cluster.nodes, mr)
 		cluster.clocks = append(cluster.clocks, clock)
 		cluster.events = append(cluster.events, demux)
 	}
-	// Let all the states listen before starting any.
+	// Let all the nodes listen before starting any.
 	for _, node := range cluster.nodes {
-		go node.start()
+		node.Start()
 	}
 	return cluster
 }
@@ -75,7 +85,7 @@ func (c *testCluster) stop() {
 // createGroup replicates a group among the first numReplicas nodes in the cluster
 func (c *testCluster) createGroup(groupID GroupID, numReplicas int) {
 	var replicaIDs []NodeID
-	var replicaNodes []*state
+	var replicaNodes []*MultiRaft
 	for i := 0; i < numReplicas; i++ {
 		replicaNodes = append(replicaNodes, c.nodes[i])
 		replicaIDs = append(replicaIDs, c.nodes[i].nodeID)
@@ -88,6 +98,16 @@ func (c *testCluster) createGroup(groupID GroupID, numReplicas int) {
 	}
 }
 
+// electLeaders makes the given node the leader of groups 1 through numGroups, which
+// must have just been created.  Each election timer only fires for the group with
+// the earliest deadline, so the node's clock is triggered once per group.
+func (c *testCluster) electLeaders(nodeIndex, numGroups int) {
+	for i := 0; i < numGroups; i++ {
+		c.clocks[nodeIndex].TriggerElection()
+		<-c.events[nodeIndex].LeaderElection
+	}
+}
+
 func TestInitialLeaderElection(t *testing.T) {
 	// Run the test three times, each time triggering a different node's election clock.
 	// The node that requests an election first should win.
@@ -96,7 +116,7 @@ func TestInitialLeaderElection(t *testing.T) {
 		groupID := GroupID(1)
 		cluster.createGroup(groupID, 3)
 
-		cluster.clocks[leaderIndex].triggerElection()
+		cluster.clocks[leaderIndex].TriggerElection()
 
 		event := <-cluster.events[leaderIndex].LeaderElection
 		if event.GroupID != groupID {
@@ -115,11 +135,11 @@ func TestCommand(t *testing.T) {
 	groupID := GroupID(1)
 	cluster.createGroup(groupID, 3)
 	// TODO(bdarnell): once followers can forward to leaders, don't wait for the election here.
-	cluster.clocks[0].triggerElection()
+	cluster.clocks[0].TriggerElection()
 	<-cluster.events[0].LeaderElection
 
 	// Submit a command to the leader
-	cluster.nodes[0].SubmitCommand(groupID, []byte("command"))
+	committed := cluster.nodes[0].SubmitCommand(groupID, []byte("command"))
 
 	// The command will be committed on each node.
 	for i, events := range cluster.events {
@@ -129,4 +149,287 @@ func TestCommand(t *testing.T) {
 			t.Errorf("unexpected value in committed command: %v", commit.Command)
 		}
 	}
+	// The submitter is acknowledged once the command commits.
+	if err := <-committed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLeaderBarrier verifies that a new leader commits a no-op barrier without any
+// commands being submitted, and that only the leader may wait for it.
+func TestLeaderBarrier(t *testing.T) {
+	cluster := newTestCluster(3, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.clocks[0].TriggerElection()
+	<-cluster.events[0].LeaderElection
+
+	if err := <-cluster.nodes[0].WaitForLeaderBarrier(groupID); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-cluster.nodes[1].WaitForLeaderBarrier(groupID); err == nil {
+		t.Error("expected error waiting for the barrier of a follower")
+	}
+	// Waiting again once the barrier has committed returns immediately.
+	if err := <-cluster.nodes[0].WaitForLeaderBarrier(groupID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestShardedCommands verifies that groups spread across several event loop shards
+// elect leaders and commit commands on every node.
+func TestShardedCommands(t *testing.T) {
+	const numGroups = 8
+	cluster := newShardedTestCluster(3, 4, t)
+	defer cluster.stop()
+	for i := 1; i <= numGroups; i++ {
+		cluster.createGroup(GroupID(i), 3)
+	}
+	cluster.electLeaders(0, numGroups)
+
+	var acks []<-chan error
+	for i := 1; i <= numGroups; i++ {
+		acks = append(acks, cluster.nodes[0].SubmitCommand(GroupID(i), []byte{byte(i)}))
+	}
+	for i, events := range cluster.events {
+		seen := map[byte]bool{}
+		for j := 0; j < numGroups; j++ {
+			commit := <-events.CommandCommitted
+			seen[commit.Command[0]] = true
+		}
+		if len(seen) != numGroups {
+			t.Errorf("node %d: expected commands of all %d groups to commit; got %v", i, numGroups, seen)
+		}
+	}
+	for i, ack := range acks {
+		if err := <-ack; err != nil {
+			t.Errorf("group %d: %v", i+1, err)
+		}
+	}
+}
+
+// benchmarkCommands submits b.N commands of payloadSize bytes, spread round-robin
+// across numGroups groups which are replicated on all numNodes nodes and led by the
+// first node.  Reports committed commands per second and the mean latency from
+// submission to commit on the leader.
+//
+// TODO(bdarnell): commands are pipelined across groups but not within a group,
+// since AppendEntries requests may be handled out of order and followers don't
+// yet check PrevLogIndex or repair their logs.
+func benchmarkCommands(b *testing.B, numNodes, numGroups, payloadSize int) {
+	cluster := newTestCluster(numNodes, b)
+	defer cluster.stop()
+	for i := 1; i <= numGroups; i++ {
+		cluster.createGroup(GroupID(i), numNodes)
+	}
+	cluster.electLeaders(0, numGroups)
+
+	// Followers' commit events must be consumed to keep the event queues from
+	// filling up.
+	done := make(chan struct{})
+	defer close(done)
+	for _, events := range cluster.events[1:] {
+		go func(events *eventDemux) {
+			for {
+				select {
+				case <-events.CommandCommitted:
+				case <-done:
+					return
+				}
+			}
+		}(events)
+	}
+
+	// Command i is submitted to group i%numGroups+1 once that group's previous
+	// command has committed.
+	starts := make([]time.Time, b.N)
+	inFlight := make([]chan struct{}, numGroups)
+	for i := range inFlight {
+		inFlight[i] = make(chan struct{}, 1)
+	}
+	committed := make(chan time.Duration)
+	go func() {
+		var latency time.Duration
+		for i := 0; i < b.N; i++ {
+			commit := <-cluster.events[0].CommandCommitted
+			seq := binary.BigEndian.Uint64(commit.Command)
+			latency += time.Since(starts[seq])
+			<-inFlight[seq%uint64(numGroups)]
+		}
+		committed <- latency
+	}()
+
+	b.SetBytes(int64(payloadSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		inFlight[i%numGroups] <- struct{}{}
+		command := make([]byte, payloadSize)
+		binary.BigEndian.PutUint64(command, uint64(i))
+		starts[i] = time.Now()
+		go func(ack <-chan error) {
+			if err := <-ack; err != nil {
+				b.Error(err)
+			}
+		}(cluster.nodes[0].SubmitCommand(GroupID(i%numGroups+1), command))
+	}
+	latency := <-committed
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "cmds/s")
+	b.ReportMetric(float64(latency.Nanoseconds())/float64(b.N), "ns/commit")
+}
+
+func BenchmarkCommand3Nodes1Group64B(b *testing.B)   { benchmarkCommands(b, 3, 1, 64) }
+func BenchmarkCommand3Nodes10Groups64B(b *testing.B) { benchmarkCommands(b, 3, 10, 64) }
+func BenchmarkCommand3Nodes100Groups64B(b *testing.B) {
+	benchmarkCommands(b, 3, 100, 64)
+}
+func BenchmarkCommand3Nodes1Group1K(b *testing.B)  { benchmarkCommands(b, 3, 1, 1<<10) }
+func BenchmarkCommand3Nodes1Group64K(b *testing.B) { benchmarkCommands(b, 3, 1, 1<<16) }
+func BenchmarkCommand5Nodes1Group64B(b *testing.B) { benchmarkCommands(b, 5, 1, 64) }
+func BenchmarkCommand5Nodes10Groups64B(b *testing.B) {
+	benchmarkCommands(b, 5, 10, 64)
+}
+
+// newThrottledGroup returns a node whose group 1 of nodes 1, 2 and 3 is led by node 1
+// and throttled beyond 2 entries or 10 bytes of lag.
+func newThrottledGroup(t *testing.T) (*MultiRaft, *state, *group) {
+	mr, err := NewMultiRaft(1, &Config{
+		Transport:             NewLocalRPCTransport(),
+		Storage:               NewMemoryStorage(),
+		ElectionTimeoutMin:    10 * time.Millisecond,
+		ElectionTimeoutMax:    20 * time.Millisecond,
+		MaxFollowerLagEntries: 2,
+		MaxFollowerLagBytes:   10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := mr.shards[0]
+	g := newGroup(1, []NodeID{1, 2, 3})
+	g.role = RoleLeader
+	g.currentMembers = g.committedMembers
+	s.groups[g.groupID] = g
+	g.lruElement = s.lru.PushFront(g)
+	return mr, s, g
+}
+
+// submitThrottled submits command to g and returns true if it was proposed rather than
+// delayed.
+func submitThrottled(s *state, g *group, command string) bool {
+	lastIndex := g.lastLogIndex
+	s.submitCommand(&submitCommandOp{g.groupID, []byte(command), make(chan error, 1), LogEntryCommand})
+	return g.lastLogIndex > lastIndex
+}
+
+// TestFollowerLagThrottling verifies that commands are delayed while a quorum lags by
+// more than the configured number of entries or bytes, and proposed in order once it
+// catches up.
+func TestFollowerLagThrottling(t *testing.T) {
+	mr, s, g := newThrottledGroup(t)
+	defer mr.Stop()
+	// Nodes 2 and 3 have acknowledged nothing, so no quorum has acknowledged anything.
+	g.matchIndex[2] = 0
+	g.matchIndex[3] = 0
+	submit := func(command string) bool { return submitThrottled(s, g, command) }
+	for i := 0; i < 3; i++ {
+		if !submit("a") {
+			t.Fatalf("%d: expected command to be proposed", i)
+		}
+	}
+	for i, command := range []string{"b", "c"} {
+		if submit(command) {
+			t.Errorf("%d: expected command to be delayed by %d entries of lag", i, g.lastLogIndex)
+		}
+	}
+
+	// Once node 2 catches up, a quorum has, and the delayed commands are proposed in
+	// order.
+	g.matchIndex[2] = 3
+	s.releaseDelayedCommands(g)
+	if len(g.delayedCommands) != 0 {
+		t.Errorf("expected delayed commands to be proposed; %d remain", len(g.delayedCommands))
+	}
+	if g.lastLogIndex != 5 || string(g.pendingEntries[4].Payload) != "c" {
+		t.Errorf("expected delayed commands at the end of the log; got %d entries", g.lastLogIndex)
+	}
+
+	// A command exceeding the byte limit delays those which follow it.
+	if !submit("0123456789a") {
+		t.Fatal("expected command to be proposed")
+	}
+	g.matchIndex[2] = 5
+	s.releaseDelayedCommands(g)
+	if submit("d") {
+		t.Error("expected command to be delayed by bytes of lag")
+	}
+}
+
+// TestFollowerLagStoppedFollower verifies that a stopped follower, which never
+// acknowledges entries, doesn't delay commands while a quorum keeps up.
+func TestFollowerLagStoppedFollower(t *testing.T) {
+	mr, s, g := newThrottledGroup(t)
+	defer mr.Stop()
+	// Node 3 has stopped after acknowledging nothing.
+	g.matchIndex[2] = 0
+	g.matchIndex[3] = 0
+	for i := 0; i < 10; i++ {
+		if !submitThrottled(s, g, "a") {
+			t.Fatalf("%d: expected command to be proposed", i)
+		}
+		// Node 2 acknowledges each command.
+		g.matchIndex[2] = g.lastLogIndex
+		s.releaseDelayedCommands(g)
+	}
+	if len(g.proposals) != 0 {
+		t.Errorf("expected proposals acknowledged by a quorum to be forgotten; %d remain", len(g.proposals))
+	}
+}
+
+// TestDispatchOverflow verifies that requests are dispatched to the shard of their
+// group, and that a request finding its shard's channel full is counted and waits for
+// room or for the node to stop.
+func TestDispatchOverflow(t *testing.T) {
+	mr, err := NewMultiRaft(1, &Config{
+		Transport:          NewLocalRPCTransport(),
+		Storage:            NewMemoryStorage(),
+		ElectionTimeoutMin: 10 * time.Millisecond,
+		ElectionTimeoutMax: 20 * time.Millisecond,
+		EventLoopShards:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := mr.shardFor(1)
+	if s == mr.shardFor(2) || s != mr.shardFor(3) {
+		t.Fatal("expected groups to be sharded by group ID")
+	}
+	for len(s.requests) < cap(s.requests) {
+		s.requests <- &rpc.Call{}
+	}
+	overflows := overflowCount.Count()
+	dispatched := make(chan error, 2)
+	go func() { dispatched <- s.dispatch(&rpc.Call{}) }()
+	select {
+	case err := <-dispatched:
+		t.Fatalf("expected dispatch to a full shard to block; got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if overflowCount.Count() != overflows+1 {
+		t.Errorf("expected overflow to be counted")
+	}
+	// The other shard isn't affected.
+	if err := mr.shardFor(2).dispatch(&rpc.Call{}); err != nil {
+		t.Fatal(err)
+	}
+	<-s.requests
+	if err := <-dispatched; err != nil {
+		t.Fatal(err)
+	}
+
+	go func() { dispatched <- s.dispatch(&rpc.Call{}) }()
+	mr.Stop()
+	if err := <-dispatched; err != errStopped {
+		t.Errorf("expected dispatch to fail once stopped; got %v", err)
+	}
 }
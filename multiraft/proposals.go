@@ -0,0 +1,56 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package multiraft
+
+import "sync"
+
+// A proposalBuffer accumulates the commands submitted to a shard's groups between
+// iterations of the shard's event loop.  The loop flushes the whole buffer each time
+// it's woken, so a burst of commands wakes it once rather than once per command.
+type proposalBuffer struct {
+	mu  sync.Mutex // Protects ops
+	ops []*submitCommandOp
+	// ready is signaled, without blocking, when the buffer becomes non-empty.
+	ready chan struct{}
+}
+
+// newProposalBuffer creates a proposalBuffer.
+func newProposalBuffer() *proposalBuffer {
+	return &proposalBuffer{ready: make(chan struct{}, 1)}
+}
+
+// add buffers the command, waking the event loop if the buffer was empty.
+func (pb *proposalBuffer) add(op *submitCommandOp) {
+	pb.mu.Lock()
+	pb.ops = append(pb.ops, op)
+	wake := len(pb.ops) == 1
+	pb.mu.Unlock()
+	if wake {
+		select {
+		case pb.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush empties the buffer, returning the commands in the order they were added.
+func (pb *proposalBuffer) flush() []*submitCommandOp {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	ops := pb.ops
+	pb.ops = nil
+	return ops
+}
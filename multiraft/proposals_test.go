@@ -0,0 +1,54 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package multiraft
+
+import "testing"
+
+func TestProposalBuffer(t *testing.T) {
+	pb := newProposalBuffer()
+	var ops []*submitCommandOp
+	for i := 0; i < 3; i++ {
+		op := &submitCommandOp{GroupID(i), nil, make(chan error, 1), LogEntryCommand}
+		ops = append(ops, op)
+		pb.add(op)
+	}
+	// The loop is woken once for the whole burst.
+	<-pb.ready
+	select {
+	case <-pb.ready:
+		t.Error("expected a single wakeup for buffered commands")
+	default:
+	}
+	flushed := pb.flush()
+	if len(flushed) != len(ops) {
+		t.Fatalf("expected %d commands; got %d", len(ops), len(flushed))
+	}
+	for i, op := range flushed {
+		if op != ops[i] {
+			t.Errorf("%d: expected commands in submission order", i)
+		}
+	}
+	if ops := pb.flush(); len(ops) != 0 {
+		t.Errorf("expected empty buffer after flush; got %d commands", len(ops))
+	}
+	// Adding to the emptied buffer wakes the loop again.
+	pb.add(ops[0])
+	select {
+	case <-pb.ready:
+	default:
+		t.Error("expected wakeup once the buffer is non-empty again")
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package multiraft
+
+import "github.com/cockroachdb/cockroach/util"
+
+// coldGroup is the metadata kept in memory for a group whose raft state machine isn't
+// instantiated: its persistent state and its commit index, so that committed entries
+// aren't committed again when it's reinstantiated.
+type coldGroup struct {
+	GroupPersistentState
+	commitIndex int
+}
+
+// getGroup returns the instantiated group, instantiating it from its metadata if it's
+// cold, and marks it as the shard's most recently used group.
+func (s *state) getGroup(groupID GroupID) (*group, error) {
+	if g, ok := s.groups[groupID]; ok {
+		s.lru.MoveToFront(g.lruElement)
+		return g, nil
+	}
+	cg, ok := s.cold[groupID]
+	if !ok {
+		return nil, util.Errorf("unknown group %v", groupID)
+	}
+	s.groupLog(groupID).V(1).Infof("instantiating group")
+	instantiateCount.Inc(1)
+	g := newGroup(groupID, cg.Members.Members)
+	g.committedMembers = &cg.Members
+	electionState := cg.ElectionState
+	g.electionState = &electionState
+	g.persistedElectionState = &cg.ElectionState
+	g.lastLogIndex, g.persistedLastIndex = cg.LastLogIndex, cg.LastLogIndex
+	g.lastLogTerm, g.persistedLastTerm = cg.LastLogTerm, cg.LastLogTerm
+	g.commitIndex = cg.commitIndex
+	if err := s.addGroup(g); err != nil {
+		return nil, err
+	}
+	delete(s.cold, groupID)
+	return g, nil
+}
+
+// addGroup instantiates the group, connecting to its members, and then reduces the
+// least recently used idle groups to metadata while more than MaxActiveGroups are
+// instantiated.
+func (s *state) addGroup(g *group) error {
+	for _, member := range g.committedMembers.allMembers() {
+		n, err := s.connect(member)
+		if err != nil {
+			return err
+		}
+		n.refCount++
+	}
+	s.updateElectionDeadline(g)
+	s.groups[g.groupID] = g
+	g.lruElement = s.lru.PushFront(g)
+	activeGroups.Inc(1)
+
+	for e := s.lru.Back(); e != nil && s.MaxActiveGroups > 0 && len(s.groups) > s.MaxActiveGroups; {
+		idle := e.Value.(*group)
+		e = e.Prev()
+		if idle != g && s.isIdle(idle) {
+			s.evictGroup(idle)
+		}
+	}
+	return nil
+}
+
+// connect returns the shard's connection to the node, connecting to it if necessary.
+// The caller is responsible for referencing the node.
+func (s *state) connect(nodeID NodeID) (*node, error) {
+	if n, ok := s.nodes[nodeID]; ok {
+		return n, nil
+	}
+	conn, err := s.Transport.Connect(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	n := &node{nodeID, 0, &asyncClient{nodeID, conn, s.responses, s.stopper.ShouldStop()}}
+	s.nodes[nodeID] = n
+	return n, nil
+}
+
+// isIdle returns true if the group holds no state besides its persistent state and
+// commit index, and so may be reduced to a coldGroup.  Candidates and leaders are
+// never idle, as their volatile state drives elections and replication.
+func (s *state) isIdle(g *group) bool {
+	_, dirty := s.dirtyGroups[g.groupID]
+	return (g.role == RoleFollower || g.role == RoleObserver) && !dirty &&
+		g.pendingCalls.Len() == 0 && len(g.delayedCommands) == 0 && len(g.uncommitted) == 0
+}
+
+// evictGroup reduces the idle group to its metadata.
+func (s *state) evictGroup(g *group) {
+	s.groupLog(g.groupID).V(1).Infof("evicting idle group")
+	s.cold[g.groupID] = &coldGroup{
+		GroupPersistentState: GroupPersistentState{
+			GroupID:       g.groupID,
+			ElectionState: *g.electionState,
+			Members:       *g.committedMembers,
+			LastLogIndex:  g.lastLogIndex,
+			LastLogTerm:   g.lastLogTerm,
+		},
+		commitIndex: g.commitIndex,
+	}
+	for _, member := range g.committedMembers.allMembers() {
+		s.nodes[member].refCount--
+	}
+	s.lru.Remove(g.lruElement)
+	delete(s.groups, g.groupID)
+	activeGroups.Inc(-1)
+}
@@ -0,0 +1,77 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package multiraft
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvictIdleGroups(t *testing.T) {
+	mr, err := NewMultiRaft(1, &Config{
+		Transport:          NewLocalRPCTransport(),
+		Storage:            NewMemoryStorage(),
+		ElectionTimeoutMin: 10 * time.Millisecond,
+		ElectionTimeoutMax: 20 * time.Millisecond,
+		MaxActiveGroups:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Stop()
+	s := mr.shards[0]
+	for i := 1; i <= 3; i++ {
+		g := newGroup(GroupID(i), []NodeID{1})
+		g.electionState.CurrentTerm = i
+		op := &createGroupOp{g, make(chan error, 1)}
+		s.createGroup(op)
+		if err := <-op.ch; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The least recently used group was reduced to its metadata.
+	if _, ok := s.cold[1]; !ok || len(s.groups) != 2 {
+		t.Fatalf("expected group 1 to be evicted; %d groups active", len(s.groups))
+	}
+	op := &createGroupOp{newGroup(1, []NodeID{1}), make(chan error, 1)}
+	if s.createGroup(op); <-op.ch == nil {
+		t.Error("expected error creating an existing cold group")
+	}
+
+	// Using group 1 reinstantiates it with its persistent state, evicting group 2.
+	g, err := s.getGroup(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.electionState.CurrentTerm != 1 || g.role != RoleFollower {
+		t.Errorf("unexpected state of reinstantiated group: %+v", g)
+	}
+	if _, ok := s.cold[2]; !ok || len(s.cold) != 1 {
+		t.Errorf("expected group 2 to be evicted; cold groups: %v", s.cold)
+	}
+
+	// Leaders are never evicted.
+	s.groups[3].role = RoleLeader
+	if _, err := s.getGroup(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.groups[3]; !ok {
+		t.Error("expected leader to remain active")
+	}
+	if _, err := s.getGroup(4); err == nil {
+		t.Error("expected error getting unknown group")
+	}
+}
@@ -18,22 +18,28 @@
 package multiraft
 
 import (
+	"sync"
+
 	"github.com/cockroachdb/cockroach/util"
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 // LogEntryType is the type of a LogEntry.
 type LogEntryType int8
 
-// LogEntryCommand is for application-level commands sent via MultiRaft.SendCommand;
-// other LogEntryTypes are for internal use.
+// LogEntryCommand is for application-level commands sent via MultiRaft.SubmitCommand.
+// LogEntryConfigChange, LogEntryLease and LogEntryNoop are built-in types submitted
+// via MultiRaft.SubmitEntry; applications may register further types via
+// RegisterLogEntryType.
 const (
-	LogEntryCommand LogEntryType = iota
+	LogEntryCommand      LogEntryType = iota
+	LogEntryConfigChange              // Payload is an encoded GroupMembers
+	LogEntryLease                     // Payload is an encoded Lease
+	LogEntryNoop                      // Empty payload; a barrier for prior entries
 )
 
-// LogEntry represents a persistent log entry.  Payloads are opaque to the raft system.
-// TODO(bdarnell): we will need both opaque payloads for the application and raft-subsystem
-// payloads for membership changes.
+// LogEntry represents a persistent log entry.  Payloads are opaque to the raft system
+// except as decoded by the handler registered for their Type (see entries.go).
 type LogEntry struct {
 	Term    int
 	Index   int
@@ -75,6 +81,27 @@ type GroupMembers struct {
 	NonVotingMembers []NodeID
 }
 
+// allMembers returns the nodes which are either current or proposed members.
+func (m *GroupMembers) allMembers() []NodeID {
+	nodes := append([]NodeID(nil), m.Members...)
+	for _, id := range m.ProposedMembers {
+		if !containsNode(nodes, id) {
+			nodes = append(nodes, id)
+		}
+	}
+	return nodes
+}
+
+// containsNode returns true if nodes contains id.
+func containsNode(nodes []NodeID, id NodeID) bool {
+	for _, n := range nodes {
+		if n == id {
+			return true
+		}
+	}
+	return false
+}
+
 // GroupPersistentState is a unified view of the readable data (except for log entries)
 // about a group; used by Storage.LoadGroups.
 type GroupPersistentState struct {
@@ -127,6 +154,7 @@ type memoryGroup struct {
 
 // MemoryStorage is an in-memory implementation of Storage for testing.
 type MemoryStorage struct {
+	mu     sync.Mutex // Protects groups
 	groups map[GroupID]*memoryGroup
 }
 
@@ -135,7 +163,7 @@ var _ Storage = (*MemoryStorage)(nil)
 
 // NewMemoryStorage creates a MemoryStorage.
 func NewMemoryStorage() *MemoryStorage {
-	return &MemoryStorage{make(map[GroupID]*memoryGroup)}
+	return &MemoryStorage{groups: make(map[GroupID]*memoryGroup)}
 }
 
 // LoadGroups implements the Storage interface.
@@ -149,12 +177,16 @@ func (m *MemoryStorage) LoadGroups() <-chan *GroupPersistentState {
 // SetGroupElectionState implements the Storage interface.
 func (m *MemoryStorage) SetGroupElectionState(groupID GroupID,
 	electionState *GroupElectionState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.getGroup(groupID).electionState = *electionState
 	return nil
 }
 
 // AppendLogEntries implements the Storage interface.
 func (m *MemoryStorage) AppendLogEntries(groupID GroupID, entries []*LogEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	g := m.getGroup(groupID)
 	for i, entry := range entries {
 		expectedIndex := len(g.entries) + i
@@ -179,14 +211,18 @@ func (m *MemoryStorage) GetLogEntry(groupID GroupID, index int) (*LogEntry, erro
 // GetLogEntries implements the Storage interface.
 func (m *MemoryStorage) GetLogEntries(groupID GroupID, firstIndex, lastIndex int,
 	ch chan<- *LogEntryState) {
-	g := m.getGroup(groupID)
-	for i := firstIndex; i <= lastIndex; i++ {
-		ch <- &LogEntryState{i, *g.entries[i], nil}
+	// Copy the entries so the lock isn't held while the channel is consumed.
+	m.mu.Lock()
+	entries := append([]*LogEntry(nil), m.getGroup(groupID).entries[firstIndex:lastIndex+1]...)
+	m.mu.Unlock()
+	for i, entry := range entries {
+		ch <- &LogEntryState{firstIndex + i, *entry, nil}
 	}
 	close(ch)
 }
 
-// getGroup returns a mutable memoryGroup object, creating if necessary.
+// getGroup returns a mutable memoryGroup object, creating if necessary.  The
+// storage's mutex must be held.
 func (m *MemoryStorage) getGroup(groupID GroupID) *memoryGroup {
 	g, ok := m.groups[groupID]
 	if !ok {
@@ -234,7 +270,7 @@ type writeResponse struct {
 // writeTask manages a goroutine that interacts with the storage system.
 type writeTask struct {
 	storage Storage
-	stopper chan struct{}
+	stopper *util.Stopper
 
 	// ready is an unbuffered channel used for synchronization.  If writes to this channel do not
 	// block, the writeTask is ready to receive a request.
@@ -245,29 +281,31 @@ type writeTask struct {
 	out chan *writeResponse
 }
 
-// newWriteTask creates a writeTask.  The caller should start the task after creating it.
-func newWriteTask(storage Storage) *writeTask {
+// newWriteTask creates a writeTask.  The caller should start the task after creating it,
+// as a worker of the given stopper.
+func newWriteTask(storage Storage, stopper *util.Stopper) *writeTask {
 	return &writeTask{
 		storage: storage,
-		stopper: make(chan struct{}),
+		stopper: stopper,
 		ready:   make(chan struct{}),
 		in:      make(chan *writeRequest, 1),
 		out:     make(chan *writeResponse, 1),
 	}
 }
 
-// start runs the storage loop.  Blocks until stopped, so should be run in a goroutine.
+// start runs the storage loop.  Blocks until the stopper is stopped, so should be run
+// as a worker of the stopper.
 func (w *writeTask) start() {
 	for {
 		var request *writeRequest
 		select {
 		case <-w.ready:
 			continue
-		case <-w.stopper:
+		case <-w.stopper.ShouldStop():
 			return
 		case request = <-w.in:
 		}
-		glog.V(6).Infof("writeTask got request %#v", *request)
+		log.New("multiraft").V(6).Infof("writeTask got request %#v", *request)
 		response := &writeResponse{make(map[GroupID]*groupWriteResponse)}
 
 		for groupID, groupReq := range request.groups {
@@ -289,11 +327,10 @@ func (w *writeTask) start() {
 				groupResp.lastTerm = groupReq.entries[len(groupReq.entries)-1].Term
 			}
 		}
-		w.out <- response
+		select {
+		case w.out <- response:
+		case <-w.stopper.ShouldStop():
+			return
+		}
 	}
 }
-
-// stop the running task.
-func (w *writeTask) stop() {
-	close(w.stopper)
-}
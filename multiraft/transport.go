@@ -21,7 +21,8 @@ import (
 	"net"
 	"net/rpc"
 
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 // The Transport interface is supplied by the application to manage communication with
@@ -80,7 +81,7 @@ func (lt *localRPCTransport) accept(server *rpc.Server, listener net.Listener) {
 					return
 				}
 			}
-			glog.Errorf("rpc.Serve: accept: %s", err.Error())
+			log.New("multiraft").Errorf("rpc.Serve: accept: %s", err.Error())
 		}
 		go server.ServeConn(conn)
 	}
@@ -92,8 +93,11 @@ func (lt *localRPCTransport) Stop(id NodeID) {
 }
 
 func (lt *localRPCTransport) Connect(id NodeID) (ClientInterface, error) {
-	address := lt.listeners[id].Addr().String()
-	client, err := rpc.Dial("tcp", address)
+	listener, ok := lt.listeners[id]
+	if !ok {
+		return nil, util.Errorf("node %v is not listening", id)
+	}
+	client, err := rpc.Dial("tcp", listener.Addr().String())
 	if err != nil {
 		return nil, err
 	}
@@ -173,6 +177,13 @@ type rpcAdapter struct {
 	server ServerInterface
 }
 
+// NewRPCAdapter returns an RPCInterface passing RPCs to server, for
+// Transports which serve raft RPCs via net/rpc. It must be registered
+// under the name "MultiRaft".
+func NewRPCAdapter(server ServerInterface) RPCInterface {
+	return &rpcAdapter{server}
+}
+
 func (r *rpcAdapter) RequestVote(req *RequestVoteRequest, resp *RequestVoteResponse) error {
 	return r.server.DoRPC(requestVoteName, req, resp)
 }
@@ -186,15 +197,29 @@ func (r *rpcAdapter) AppendEntries(req *AppendEntriesRequest,
 // Outgoing requests are run in a goroutine and their response ops are returned on the
 // given channel.
 type asyncClient struct {
-	nodeID NodeID
-	conn   ClientInterface
-	ch     chan *rpc.Call
+	nodeID  NodeID
+	conn    ClientInterface
+	ch      chan *rpc.Call
+	stopped <-chan struct{} // Closed when the local node stops; responses are dropped
 }
 
 func (a *asyncClient) requestVote(req *RequestVoteRequest) {
-	a.conn.Go(requestVoteName, req, &RequestVoteResponse{}, a.ch)
+	a.goRPC(requestVoteName, req, &RequestVoteResponse{})
 }
 
 func (a *asyncClient) appendEntries(req *AppendEntriesRequest) {
-	a.conn.Go(appendEntriesName, req, &AppendEntriesResponse{}, a.ch)
+	a.goRPC(appendEntriesName, req, &AppendEntriesResponse{})
+}
+
+// goRPC starts an RPC and forwards its completed call to the response channel.
+// net/rpc silently discards replies when the done channel is full, so each call
+// gets its own rather than sharing the response channel.
+func (a *asyncClient) goRPC(name string, req, resp interface{}) {
+	call := a.conn.Go(name, req, resp, make(chan *rpc.Call, 1))
+	go func() {
+		select {
+		case a.ch <- <-call.Done:
+		case <-a.stopped:
+		}
+	}()
 }
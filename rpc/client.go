@@ -18,14 +18,16 @@
 package rpc
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/rpc"
 	"sync"
 	"time"
 
+	"github.com/cockroachdb/cockroach/hlc"
 	"github.com/cockroachdb/cockroach/util"
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 const (
@@ -65,6 +67,8 @@ type Client struct {
 	lAddr       net.Addr     // Local address of client
 	healthy     bool
 	closed      bool
+	offset      RemoteOffset // Latest measured offset of remote clock
+	tlsConfig   *tls.Config  // TLS configuration; nil for insecure
 }
 
 // NewClient returns a client RPC stub for the specified address
@@ -75,6 +79,9 @@ type Client struct {
 // nil to use defaults (i.e. indefinite retries with exponential
 // backoff).
 //
+// If a TLS configuration has been set via SetTLSConfig, the client
+// connects using TLS.
+//
 // The Client.Ready channel is closed after the client has connected
 // and completed one successful heartbeat. The Closed channel is
 // closed if the client fails to connect or if the client's Close()
@@ -86,9 +93,10 @@ func NewClient(addr net.Addr, opts *util.RetryOptions) *Client {
 		return c
 	}
 	c := &Client{
-		addr:   addr,
-		Ready:  make(chan struct{}),
-		Closed: make(chan struct{}),
+		addr:      addr,
+		Ready:     make(chan struct{}),
+		Closed:    make(chan struct{}),
+		tlsConfig: getTLSConfig(),
 	}
 	clients[c.Addr().String()] = c
 	clientMu.Unlock()
@@ -102,10 +110,15 @@ func NewClient(addr net.Addr, opts *util.RetryOptions) *Client {
 
 	go func() {
 		err := util.RetryWithBackoff(retryOpts, func() (bool, error) {
-			// TODO(spencer): use crypto.tls.
-			conn, err := net.Dial(addr.Network(), addr.String())
+			var conn net.Conn
+			var err error
+			if c.tlsConfig != nil {
+				conn, err = tls.Dial(addr.Network(), addr.String(), c.tlsConfig)
+			} else {
+				conn, err = net.Dial(addr.Network(), addr.String())
+			}
 			if err != nil {
-				glog.Info(err)
+				log.New("rpc").Infof("%v", err)
 				return false, nil
 			}
 			c.mu.Lock()
@@ -121,7 +134,7 @@ func NewClient(addr net.Addr, opts *util.RetryOptions) *Client {
 			}
 
 			// Signal client is ready by closing Ready channel.
-			glog.Infof("client %s connected", addr)
+			log.New("rpc").Infof("client %s connected", addr)
 			close(c.Ready)
 
 			// Launch periodic heartbeat.
@@ -130,7 +143,7 @@ func NewClient(addr net.Addr, opts *util.RetryOptions) *Client {
 			return true, nil
 		})
 		if err != nil {
-			glog.Errorf("client %s failed to connect", addr)
+			log.New("rpc").Errorf("client %s failed to connect", addr)
 			c.Close()
 		}
 	}()
@@ -166,12 +179,22 @@ func (c *Client) LocalAddr() net.Addr {
 	return c.lAddr
 }
 
+// RemoteOffset returns the most recently measured offset of the
+// remote server's clock. The zero value is returned until the first
+// heartbeat has completed.
+func (c *Client) RemoteOffset() RemoteOffset {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.offset
+}
+
 // Close removes the client from the clients map and closes
 // the Closed channel.
 func (c *Client) Close() {
 	clientMu.Lock()
 	if !c.closed {
 		delete(clients, c.Addr().String())
+		removeRemoteOffset(c.Addr().String())
 		c.healthy = false
 		c.closed = true
 		close(c.Closed)
@@ -184,38 +207,61 @@ func (c *Client) Close() {
 // connection on error. Heartbeats are sent in an infinite loop until
 // an error is encountered.
 func (c *Client) startHeartbeat() {
-	glog.Infof("client %s starting heartbeat", c.Addr())
+	log.New("rpc").Infof("client %s starting heartbeat", c.Addr())
 	// On heartbeat failure, remove this client from cache. A new
 	// client to this address will be created on the next call to
 	// NewClient().
 	for {
 		time.Sleep(heartbeatInterval)
 		if err := c.heartbeat(); err != nil {
-			glog.Infof("client %s heartbeat failed: %v; recycling...", c.Addr(), err)
+			log.New("rpc").Infof("client %s heartbeat failed: %v; recycling...", c.Addr(), err)
 			c.Close()
 			break
 		}
 	}
 }
 
-// heartbeat sends a single heartbeat RPC.
+// heartbeat sends a single heartbeat RPC. On success, the remote
+// clock offset is estimated from the server's reported time,
+// assuming the reply was sent halfway through the round trip.
 func (c *Client) heartbeat() error {
-	call := c.Go("Heartbeat.Ping", &PingRequest{}, &PingResponse{}, nil)
+	reply := &PingResponse{}
+	sendTime := hlc.UnixNano()
+	call := c.Go("Heartbeat.Ping", &PingRequest{}, reply, nil)
 	select {
 	case <-call.Done:
-		glog.V(1).Infof("client %s heartbeat: %v", c.Addr(), call.Error)
+		log.New("rpc").V(1).Infof("client %s heartbeat: %v", c.Addr(), call.Error)
 		c.mu.Lock()
 		c.healthy = true
 		c.mu.Unlock()
-		return call.Error
 	case <-time.After(heartbeatInterval * 2):
 		// Allowed twice gossip interval.
 		c.mu.Lock()
 		c.healthy = false
 		c.mu.Unlock()
-		glog.Warningf("client %s unhealthy after %s", c.Addr(), heartbeatInterval)
+		log.New("rpc").Warningf("client %s unhealthy after %s", c.Addr(), heartbeatInterval)
+		<-call.Done
+	}
+	if call.Error != nil {
+		return call.Error
 	}
 
-	<-call.Done
-	return call.Error
+	receiveTime := hlc.UnixNano()
+	halfRTT := (receiveTime - sendTime) / 2
+	offset := RemoteOffset{
+		Offset:     reply.ServerTime - (sendTime + halfRTT),
+		Error:      halfRTT,
+		MeasuredAt: receiveTime,
+	}
+	log.New("rpc").V(1).Infof("client %s clock offset: %s", c.Addr(), offset)
+	c.mu.Lock()
+	c.offset = offset
+	c.mu.Unlock()
+	// Don't resurrect the offset of a client closed in the meantime.
+	clientMu.Lock()
+	if !c.closed {
+		recordRemoteOffset(c.Addr().String(), offset)
+	}
+	clientMu.Unlock()
+	return nil
 }
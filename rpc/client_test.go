@@ -18,11 +18,15 @@
 package rpc
 
 import (
+	"io/ioutil"
 	"net"
 	"net/rpc"
+	"os"
 	"testing"
 	"time"
 
+	"github.com/cockroachdb/cockroach/hlc"
+	"github.com/cockroachdb/cockroach/security"
 	"github.com/cockroachdb/cockroach/util"
 )
 
@@ -67,3 +71,87 @@ func TestClientHeartbeatBadServer(t *testing.T) {
 	}
 	s.Close()
 }
+
+// TestClientRemoteOffset verifies that heartbeats measure the offset
+// of the server's clock relative to the client's.
+func TestClientRemoteOffset(t *testing.T) {
+	addr := util.CreateTestAddr("tcp")
+	// Create a server whose clock runs an hour ahead.
+	s := &Server{
+		Server:         rpc.NewServer(),
+		addr:           addr,
+		closeCallbacks: make([]func(conn net.Conn), 0, 1),
+	}
+	s.RegisterName("Heartbeat", &HeartbeatService{
+		clock: func() int64 { return hlc.UnixNano() + int64(time.Hour) },
+	})
+	s.Start()
+	defer s.Close()
+
+	c := NewClient(s.Addr(), nil)
+	<-c.Ready
+	offset := c.RemoteOffset()
+	if offset.MeasuredAt == 0 {
+		t.Fatal("expected offset to be measured by initial heartbeat")
+	}
+	if offset.Error < 0 || offset.Error > int64(time.Second) {
+		t.Errorf("unexpected offset error: %s", offset)
+	}
+	if delta := offset.Offset - int64(time.Hour); delta < -offset.Error || delta > offset.Error {
+		t.Errorf("expected offset of 1h within error bounds; got %s", offset)
+	}
+
+	// The offset is available for clock verification until the
+	// client is closed.
+	if _, ok := RemoteOffsets()[s.Addr().String()]; !ok {
+		t.Error("expected offset to be recorded for server")
+	}
+	c.Close()
+	if _, ok := RemoteOffsets()[s.Addr().String()]; ok {
+		t.Error("expected offset to be removed on close")
+	}
+}
+
+// TestClientTLS verifies that a client connects to a TLS server using
+// the node certificate, while an insecure client fails to connect.
+func TestClientTLS(t *testing.T) {
+	certDir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(certDir)
+	if err := security.GenerateCA(certDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := security.GenerateNodeCert(certDir, []string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	config, err := security.LoadTLSConfig(certDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetTLSConfig(config)
+	s := NewServer(util.CreateTestAddr("tcp"))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := NewClient(s.Addr(), nil)
+	SetTLSConfig(nil)
+	select {
+	case <-c.Ready:
+	case <-c.Closed:
+		t.Fatal("expected TLS client to connect")
+	}
+	c.Close()
+
+	// An insecure client fails its heartbeat and gives up.
+	opts := &util.RetryOptions{Backoff: time.Millisecond, MaxBackoff: time.Millisecond, Constant: 1, MaxAttempts: 1}
+	c = NewClient(s.Addr(), opts)
+	select {
+	case <-c.Ready:
+		t.Error("unexpected insecure client connection")
+	case <-c.Closed:
+	}
+}
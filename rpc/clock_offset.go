@@ -0,0 +1,94 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package rpc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+var (
+	remoteClockMu sync.Mutex              // Protects access to remoteClocks
+	remoteClocks  map[string]RemoteOffset // Latest offsets by server address
+)
+
+func init() {
+	remoteClocks = map[string]RemoteOffset{}
+}
+
+// recordRemoteOffset stores the latest offset measured for the
+// server at addr.
+func recordRemoteOffset(addr string, offset RemoteOffset) {
+	remoteClockMu.Lock()
+	defer remoteClockMu.Unlock()
+	remoteClocks[addr] = offset
+}
+
+// removeRemoteOffset forgets the offset of the server at addr, whose
+// client has been closed.
+func removeRemoteOffset(addr string) {
+	remoteClockMu.Lock()
+	defer remoteClockMu.Unlock()
+	delete(remoteClocks, addr)
+}
+
+// RemoteOffsets returns a copy of the latest clock offsets measured
+// by heartbeats of all connected clients, keyed by server address.
+func RemoteOffsets() map[string]RemoteOffset {
+	remoteClockMu.Lock()
+	defer remoteClockMu.Unlock()
+	offsets := make(map[string]RemoteOffset, len(remoteClocks))
+	for addr, offset := range remoteClocks {
+		offsets[addr] = offset
+	}
+	return offsets
+}
+
+// VerifyClockOffset returns an error if the local clock has drifted
+// beyond maxOffset from the clocks of the servers this process is
+// connected to. A remote clock agrees with the local clock if its
+// offset could be within maxOffset, given the measurement's
+// uncertainty. A single remote clock may be wrong, so the local
+// clock is only considered faulty if it disagrees with a majority of
+// the remote clocks. With no measured offsets, there's nothing to
+// verify against and no error is returned.
+func VerifyClockOffset(maxOffset time.Duration) error {
+	return verifyOffsets(RemoteOffsets(), maxOffset)
+}
+
+// verifyOffsets implements VerifyClockOffset for the given offsets.
+func verifyOffsets(offsets map[string]RemoteOffset, maxOffset time.Duration) error {
+	if len(offsets) == 0 {
+		return nil
+	}
+	var agree int
+	for _, offset := range offsets {
+		abs := offset.Offset
+		if abs < 0 {
+			abs = -abs
+		}
+		if abs-offset.Error <= int64(maxOffset) {
+			agree++
+		}
+	}
+	if agree <= len(offsets)/2 {
+		return util.Errorf("local clock disagrees with %d of %d remote clocks by more than max offset %s: %v",
+			len(offsets)-agree, len(offsets), maxOffset, offsets)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package rpc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/hlc"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestVerifyOffsets verifies the local clock is only considered
+// faulty if it disagrees with a majority of remote clocks.
+func TestVerifyOffsets(t *testing.T) {
+	maxOffset := 100 * time.Millisecond
+	ok := RemoteOffset{Offset: int64(50 * time.Millisecond), Error: int64(time.Millisecond)}
+	// Too far ahead, but within max offset given the uncertainty.
+	uncertain := RemoteOffset{Offset: int64(-150 * time.Millisecond), Error: int64(60 * time.Millisecond)}
+	bad := RemoteOffset{Offset: int64(time.Second), Error: int64(time.Millisecond)}
+	badBehind := RemoteOffset{Offset: -int64(time.Second), Error: int64(time.Millisecond)}
+
+	testCases := []struct {
+		offsets   []RemoteOffset
+		expectErr bool
+	}{
+		{nil, false},
+		{[]RemoteOffset{ok}, false},
+		{[]RemoteOffset{uncertain}, false},
+		{[]RemoteOffset{bad}, true},
+		{[]RemoteOffset{badBehind}, true},
+		{[]RemoteOffset{ok, bad}, true},
+		{[]RemoteOffset{ok, uncertain, bad}, false},
+		{[]RemoteOffset{ok, bad, badBehind}, true},
+	}
+	for i, test := range testCases {
+		offsets := map[string]RemoteOffset{}
+		for j, offset := range test.offsets {
+			offsets[string('a'+rune(j))] = offset
+		}
+		if err := verifyOffsets(offsets, maxOffset); (err != nil) != test.expectErr {
+			t.Errorf("%d: expected error %t; got %v", i, test.expectErr, err)
+		}
+	}
+}
+
+// TestVerifyClockOffsetSkew skews the clocks of servers the process
+// is connected to and verifies that heartbeats measure the skew and
+// that the local clock is considered faulty once it disagrees with a
+// majority of the servers, and healthy again once their clocks are
+// back in line.
+func TestVerifyClockOffsetSkew(t *testing.T) {
+	maxOffset := 250 * time.Millisecond
+	var clocks []*hlc.SkewedClock
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		s := NewServer(util.CreateTestAddr("tcp"))
+		clock := hlc.NewSkewedClock(hlc.UnixNano)
+		s.SetClock(clock.UnixNano)
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		c := NewClient(s.Addr(), nil)
+		defer c.Close()
+		<-c.Ready
+		clocks = append(clocks, clock)
+		addrs = append(addrs, s.Addr().String())
+	}
+	// Only the offsets of this test's servers are verified; other
+	// tests' clients may still be connected.
+	offsets := func() map[string]RemoteOffset {
+		all := RemoteOffsets()
+		offsets := map[string]RemoteOffset{}
+		for _, addr := range addrs {
+			offsets[addr] = all[addr]
+		}
+		return offsets
+	}
+	// verifyWithin waits for the next heartbeats to measure the current
+	// skews and then checks the outcome of the verification.
+	verifyWithin := func(expectErr bool) {
+		if err := util.IsTrueWithin(func() bool {
+			measured := offsets()
+			for i, addr := range addrs {
+				offset := measured[addr]
+				delta := offset.Offset - int64(clocks[i].Skew())
+				if slack := offset.Error + int64(maxOffset/10); delta < -slack || delta > slack {
+					return false
+				}
+			}
+			return (verifyOffsets(measured, maxOffset) != nil) == expectErr
+		}, time.Second); err != nil {
+			t.Fatalf("expected verification error %t with skews %s, %s, %s: %v; offsets %v",
+				expectErr, clocks[0].Skew(), clocks[1].Skew(), clocks[2].Skew(), err, offsets())
+		}
+	}
+
+	verifyWithin(false)
+	// A skew within the max offset is tolerated.
+	clocks[0].SetSkew(maxOffset / 2)
+	verifyWithin(false)
+	// A single remote clock beyond the max offset is outvoted.
+	clocks[1].SetSkew(time.Hour)
+	verifyWithin(false)
+	// Once a majority of remote clocks disagrees, the local clock is
+	// considered faulty, whether they run ahead or behind.
+	clocks[2].SetSkew(-time.Hour)
+	verifyWithin(true)
+	clocks[1].SetSkew(0)
+	verifyWithin(false)
+}
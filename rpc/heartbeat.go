@@ -17,21 +17,47 @@
 
 package rpc
 
+import (
+	"fmt"
+	"time"
+)
+
+// A RemoteOffset is an estimate of a remote clock's offset from the
+// local clock, as measured by a heartbeat. The true offset lies
+// within [Offset-Error, Offset+Error].
+type RemoteOffset struct {
+	Offset     int64 // Remote clock minus local clock, in nanoseconds
+	Error      int64 // Uncertainty of Offset; half the round trip time
+	MeasuredAt int64 // Local unix nanosecond time of the measurement
+}
+
+// String formats the offset and its uncertainty as durations.
+func (r RemoteOffset) String() string {
+	return fmt.Sprintf("off=%s, err=%s", time.Duration(r.Offset), time.Duration(r.Error))
+}
+
 // A PingRequest specifies the string to echo in response.
 type PingRequest struct {
 	Ping string // Echo this string with PingResponse.
 }
 
-// A PingResponse contains the echoed ping request string.
+// A PingResponse contains the echoed ping request string and the
+// server's clock reading.
 type PingResponse struct {
-	Pong string // An echo of value sent with PingRequest.
+	Pong       string // An echo of value sent with PingRequest.
+	ServerTime int64  // Server's unix nanosecond time when replying.
 }
 
 // A HeartbeatService exposes a method to echo its request params.
-type HeartbeatService struct{}
+type HeartbeatService struct {
+	clock func() int64 // Physical clock reported to pinging clients
+}
 
-// Ping echos the contents of the request to the response.
+// Ping echos the contents of the request to the response and
+// returns the server's clock reading so the client can estimate
+// the server's clock offset.
 func (hs *HeartbeatService) Ping(args *PingRequest, reply *PingResponse) error {
 	reply.Pong = args.Ping
+	reply.ServerTime = hs.clock()
 	return nil
 }
@@ -18,13 +18,23 @@
 package rpc
 
 import (
+	"io"
 	"math/rand"
 	"net"
+	"net/rpc"
 	"reflect"
 	"time"
 
 	"github.com/cockroachdb/cockroach/util"
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/metrics"
+)
+
+// Metrics of the RPCs sent by the process.
+var (
+	sendCount   = metrics.DefaultRegistry.Counter("rpc_sends")
+	sendErrors  = metrics.DefaultRegistry.Counter("rpc_send_errors")
+	sendLatency = metrics.DefaultRegistry.Histogram("rpc_send_latency_ns", metrics.LatencyBuckets)
 )
 
 // An Options structure describes the algorithm for sending RPCs to
@@ -105,8 +115,8 @@ func Send(argsMap map[net.Addr]interface{}, method string, replyChanI interface{
 				continue
 			}
 			reply := reflect.New(reflect.TypeOf(replyChanI).Elem().Elem()).Interface()
-			if glog.V(1) {
-				glog.Infof("%s: sending request to %s: %+v", method, clients[index].Addr(), args)
+			if log.New("rpc").V(1).Enabled() {
+				log.New("rpc").Infof("%s: sending request to %s: %+v", method, clients[index].Addr(), args)
 			}
 			go sendOne(clients[index], opts.Timeout, method, args, reply, helperChan)
 		}
@@ -116,8 +126,8 @@ func Send(argsMap map[net.Addr]interface{}, method string, replyChanI interface{
 			switch t := r.(type) {
 			case error:
 				errors++
-				if glog.V(1) {
-					glog.Warningf("%s: error reply: %+v", method, t)
+				if log.New("rpc").V(1).Enabled() {
+					log.New("rpc").Warningf("%s: error reply: %+v", method, t)
 				}
 				if len(clients)-errors < opts.N {
 					return SendError{util.Errorf("too many errors encountered (%d of %d total): %v",
@@ -129,8 +139,8 @@ func Send(argsMap map[net.Addr]interface{}, method string, replyChanI interface{
 				}
 			default:
 				successes++
-				if glog.V(1) {
-					glog.Infof("%s: successful reply: %+v", method, t)
+				if log.New("rpc").V(1).Enabled() {
+					log.New("rpc").Infof("%s: successful reply: %+v", method, t)
 				}
 				reflect.ValueOf(replyChanI).Send(reflect.ValueOf(t))
 				if successes == opts.N {
@@ -150,20 +160,38 @@ func Send(argsMap map[net.Addr]interface{}, method string, replyChanI interface{
 
 // sendOne invokes the specified RPC on the supplied client when the
 // client is ready. On success, the reply is sent on the channel;
-// otherwise an error is sent.
+// otherwise an error is sent, including if the client fails to
+// connect. If the connection was shut down, for example because the
+// server was restarted, the client is closed so that the next RPC to
+// its address reconnects instead of waiting for a heartbeat to fail.
 func sendOne(client *Client, timeout time.Duration, method string, args, reply interface{}, c chan interface{}) {
-	<-client.Ready
+	select {
+	case <-client.Ready:
+	case <-client.Closed:
+		sendErrors.Inc(1)
+		c <- util.Errorf("rpc to %s failed as client %s failed to connect", method, client.Addr())
+		return
+	}
+	sendCount.Inc(1)
+	start := time.Now()
 	call := client.Go(method, args, reply, nil)
+	var err error
 	select {
 	case <-call.Done:
-		if call.Error != nil {
-			c <- call.Error
-		} else {
-			c <- reply
+		err = call.Error
+		if err == rpc.ErrShutdown || err == io.ErrUnexpectedEOF {
+			client.Close()
 		}
 	case <-client.Closed:
-		c <- util.Errorf("rpc to %s failed as client connection was closed", method)
+		err = util.Errorf("rpc to %s failed as client connection was closed", method)
 	case <-time.After(timeout):
-		c <- util.Errorf("rpc to %s timed out after %s", method, timeout)
+		err = util.Errorf("rpc to %s timed out after %s", method, timeout)
+	}
+	sendLatency.UpdateSince(start)
+	if err != nil {
+		sendErrors.Inc(1)
+		c <- err
+	} else {
+		c <- reply
 	}
 }
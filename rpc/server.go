@@ -18,40 +18,60 @@
 package rpc
 
 import (
+	"crypto/tls"
 	"net"
 	"net/rpc"
 	"sync"
 
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/hlc"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/metrics"
 )
 
+// openConns is the number of connections being served by the RPC
+// servers of the process.
+var openConns = metrics.DefaultRegistry.Gauge("rpc_server_connections")
+
 // Server is a Cockroach-specific RPC server with an embedded go RPC
 // server struct. By default it handles a simple heartbeat protocol
-// to measure link health. It also supports close callbacks.
-//
-// TODO(spencer): heartbeat protocol should also measure link latency
-// and clock skew.
+// to measure link health, latency and clock offset. It also supports
+// close callbacks.
 type Server struct {
 	*rpc.Server              // Embedded RPC server instance
 	listener    net.Listener // Server listener
+	tlsConfig   *tls.Config  // TLS configuration; nil for insecure
+	heartbeat   *HeartbeatService
 
 	mu             sync.RWMutex          // Mutex protects the fields below
 	addr           net.Addr              // Server address; may change if picking unused port
 	closed         bool                  // Set upon invocation of Close()
+	partitioned    bool                  // Set while partitioned; see Partition()
+	conns          map[net.Conn]struct{} // Connections being served
 	closeCallbacks []func(conn net.Conn) // Slice of callbacks to invoke on conn close
 }
 
-// NewServer creates a new instance of Server.
+// NewServer creates a new instance of Server. If a TLS configuration
+// has been set via SetTLSConfig, the server only accepts TLS
+// connections.
 func NewServer(addr net.Addr) *Server {
 	s := &Server{
-		Server: rpc.NewServer(),
-		addr:   addr,
+		Server:    rpc.NewServer(),
+		addr:      addr,
+		tlsConfig: getTLSConfig(),
 	}
-	heartbeat := &HeartbeatService{}
-	s.RegisterName("Heartbeat", heartbeat)
+	s.heartbeat = &HeartbeatService{clock: hlc.UnixNano}
+	s.RegisterName("Heartbeat", s.heartbeat)
 	return s
 }
 
+// SetClock sets the physical clock whose readings the server reports
+// to heartbeating clients, in unix epoch nanoseconds. Tests use it to
+// skew the server's clock as measured by its clients. It must be
+// called before Start.
+func (s *Server) SetClock(clock func() int64) {
+	s.heartbeat.clock = clock
+}
+
 // AddCloseCallback adds a callback to the closeCallbacks slice to
 // be invoked when a connection is closed.
 func (s *Server) AddCloseCallback(cb func(conn net.Conn)) {
@@ -67,6 +87,9 @@ func (s *Server) Start() error {
 	if err != nil {
 		return err
 	}
+	if s.tlsConfig != nil {
+		ln = tls.NewListener(ln, s.tlsConfig)
+	}
 	s.listener = ln
 
 	s.mu.Lock()
@@ -75,13 +98,13 @@ func (s *Server) Start() error {
 
 	go func() {
 		// Start serving in a loop until listener is closed.
-		glog.Infof("serving on %+v...", s.Addr())
+		log.New("rpc").Infof("serving on %+v...", s.Addr())
 		for {
 			conn, err := ln.Accept()
 			if err != nil {
 				s.mu.Lock()
 				if !s.closed {
-					glog.Fatalf("server terminated: %s", err)
+					log.New("rpc").Fatalf("server terminated: %s", err)
 				}
 				s.mu.Unlock()
 				break
@@ -89,7 +112,7 @@ func (s *Server) Start() error {
 			// Serve connection to completion in a goroutine.
 			go s.serveConn(conn)
 		}
-		glog.Infof("done serving on %+v", s.Addr())
+		log.New("rpc").Infof("done serving on %+v", s.Addr())
 	}()
 	return nil
 }
@@ -101,19 +124,57 @@ func (s *Server) Addr() net.Addr {
 	return s.addr
 }
 
-// Close closes the listener.
+// Close closes the listener and the connections being served.
 func (s *Server) Close() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.closed = true
 	s.listener.Close()
+	s.closeConnsLocked()
+}
+
+// Partition cuts the server off from its clients while partitioned
+// is true: the connections being served are closed, as are new
+// connections as soon as they're accepted, so RPCs sent to the server
+// fail as they would across a network partition. Used by tests to
+// inject partitions.
+func (s *Server) Partition(partitioned bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.partitioned = partitioned
+	if partitioned {
+		s.closeConnsLocked()
+	}
+}
+
+// closeConnsLocked closes the connections being served. Requires
+// that s.mu be held.
+func (s *Server) closeConnsLocked() {
+	for conn := range s.conns {
+		conn.Close()
+	}
 }
 
 // serveConn synchronously serves a single connection. When the
 // connection is closed, close callbacks are invoked.
 func (s *Server) serveConn(conn net.Conn) {
+	s.mu.Lock()
+	if s.closed || s.partitioned {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	if s.conns == nil {
+		s.conns = map[net.Conn]struct{}{}
+	}
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+
+	openConns.Inc(1)
+	defer openConns.Inc(-1)
 	s.ServeConn(conn)
 	s.mu.Lock()
+	delete(s.conns, conn)
 	if s.closeCallbacks != nil {
 		for _, cb := range s.closeCallbacks {
 			cb(conn)
@@ -0,0 +1,83 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package rpc
+
+import (
+	"net/rpc"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// ping sends a heartbeat to the server over a new connection
+// and returns the client and the error, if any.
+func ping(t *testing.T, s *Server) (*rpc.Client, error) {
+	client, err := rpc.Dial(s.Addr().Network(), s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, client.Call("Heartbeat.Ping", &PingRequest{}, &PingResponse{})
+}
+
+// TestServerCloseConns verifies that closing a server closes the
+// connections it's serving.
+func TestServerCloseConns(t *testing.T) {
+	s := NewServer(util.CreateTestAddr("tcp"))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	client, err := ping(t, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	s.Close()
+	if err := client.Call("Heartbeat.Ping", &PingRequest{}, &PingResponse{}); err == nil {
+		t.Error("expected heartbeat on closed server's connection to fail")
+	}
+}
+
+// TestServerPartition verifies that a partitioned server drops its
+// connections and refuses new ones until the partition is healed.
+func TestServerPartition(t *testing.T) {
+	s := NewServer(util.CreateTestAddr("tcp"))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	client, err := ping(t, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	s.Partition(true)
+	if err := client.Call("Heartbeat.Ping", &PingRequest{}, &PingResponse{}); err == nil {
+		t.Error("expected heartbeat on partitioned server's connection to fail")
+	}
+	partitioned, err := ping(t, s)
+	defer partitioned.Close()
+	if err == nil {
+		t.Error("expected heartbeat to partitioned server to fail")
+	}
+
+	s.Partition(false)
+	healed, err := ping(t, s)
+	defer healed.Close()
+	if err != nil {
+		t.Errorf("expected heartbeat to succeed once healed: %v", err)
+	}
+}
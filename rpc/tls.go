@@ -0,0 +1,42 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package rpc
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+var (
+	tlsMu     sync.Mutex  // Protects tlsConfig
+	tlsConfig *tls.Config // TLS configuration for new servers and clients
+)
+
+// SetTLSConfig sets the TLS configuration used by servers and clients
+// created from now on. See security.LoadTLSConfig. A nil config
+// disables TLS, which is the default.
+func SetTLSConfig(config *tls.Config) {
+	tlsMu.Lock()
+	defer tlsMu.Unlock()
+	tlsConfig = config
+}
+
+// getTLSConfig returns the current TLS configuration.
+func getTLSConfig() *tls.Config {
+	tlsMu.Lock()
+	defer tlsMu.Unlock()
+	return tlsConfig
+}
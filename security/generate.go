@@ -0,0 +1,155 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+const (
+	// caValidity is the lifetime of generated CA certificates.
+	caValidity = 5 * 365 * 24 * time.Hour
+	// nodeValidity is the lifetime of generated node certificates.
+	nodeValidity = 365 * 24 * time.Hour
+	// validFrom backdates the start of certificate validity to
+	// tolerate clock offsets between the signer and verifiers.
+	validFrom = -time.Hour
+)
+
+// GenerateCA creates a new self-signed CA certificate and private key
+// and writes them to certDir as CACertFile and CAKeyFile. Existing
+// files are not overwritten.
+func GenerateCA(certDir string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return util.Errorf("unable to generate CA key: %v", err)
+	}
+	template, err := newTemplate("Cockroach CA", caValidity)
+	if err != nil {
+		return err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return util.Errorf("unable to create CA certificate: %v", err)
+	}
+	return writeCertAndKey(certDir, CACertFile, CAKeyFile, der, key)
+}
+
+// GenerateNodeCert creates a node certificate and private key signed
+// by the CA in certDir and writes them to certDir as NodeCertFile and
+// NodeKeyFile. The certificate is valid for the specified hosts,
+// which may be host names or IP addresses, and may be used both to
+// serve and to authenticate as a client. Existing files are not
+// overwritten.
+func GenerateNodeCert(certDir string, hosts []string) error {
+	if len(hosts) == 0 {
+		return util.Error("no hosts specified for node certificate")
+	}
+	ca, err := tls.LoadX509KeyPair(filepath.Join(certDir, CACertFile), filepath.Join(certDir, CAKeyFile))
+	if err != nil {
+		return util.Errorf("unable to load CA certificate and key: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return util.Errorf("unable to parse CA certificate: %v", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return util.Errorf("unable to generate node key: %v", err)
+	}
+	template, err := newTemplate(hosts[0], nodeValidity)
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return util.Errorf("unable to create node certificate: %v", err)
+	}
+	return writeCertAndKey(certDir, NodeCertFile, NodeKeyFile, der, key)
+}
+
+// newTemplate returns a certificate template with a random serial
+// number, valid for the specified duration from now.
+func newTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, util.Errorf("unable to generate serial number: %v", err)
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"Cockroach"},
+			CommonName:   commonName,
+		},
+		NotBefore: now.Add(validFrom),
+		NotAfter:  now.Add(validity),
+	}, nil
+}
+
+// writeCertAndKey PEM-encodes the DER certificate and private key and
+// writes them to the named files in certDir. The key file is only
+// readable by its owner.
+func writeCertAndKey(certDir, certFile, keyFile string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return util.Errorf("unable to marshal private key: %v", err)
+	}
+	certPath, keyPath := filepath.Join(certDir, certFile), filepath.Join(certDir, keyFile)
+	for _, path := range []string{certPath, keyPath} {
+		if _, err := os.Stat(path); err == nil {
+			return util.Errorf("refusing to overwrite existing file %s", path)
+		}
+	}
+	if err := os.MkdirAll(certDir, 0755); err != nil {
+		return util.Errorf("unable to create certs directory: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(certPath, certPEM, 0644); err != nil {
+		return util.Errorf("unable to write certificate: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return util.Errorf("unable to write private key: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package security
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestGenerateCerts verifies generated node certificates are signed
+// by the generated CA and valid for the specified hosts.
+func TestGenerateCerts(t *testing.T) {
+	certDir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(certDir)
+
+	// A node certificate can't be generated without a CA.
+	if err := GenerateNodeCert(certDir, []string{"localhost"}); err == nil {
+		t.Error("expected error generating node certificate without CA")
+	}
+	if err := GenerateCA(certDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateCA(certDir); err == nil {
+		t.Error("expected error overwriting existing CA")
+	}
+	if err := GenerateNodeCert(certDir, nil); err == nil {
+		t.Error("expected error generating node certificate without hosts")
+	}
+	if err := GenerateNodeCert(certDir, []string{"localhost", "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(certDir, NodeKeyFile)); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected node key readable only by owner; got %v, %v", info, err)
+	}
+
+	ca := readCert(filepath.Join(certDir, CACertFile), t)
+	node := readCert(filepath.Join(certDir, NodeCertFile), t)
+	if !ca.IsCA {
+		t.Error("expected CA certificate to be a CA")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for _, host := range []string{"localhost", "127.0.0.1"} {
+		if _, err := node.Verify(x509.VerifyOptions{
+			DNSName:   host,
+			Roots:     roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}); err != nil {
+			t.Errorf("node certificate failed to verify for %s: %v", host, err)
+		}
+	}
+	if !node.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("expected IP address 127.0.0.1; got %v", node.IPAddresses)
+	}
+}
+
+func readCert(path string, t *testing.T) *x509.Certificate {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		t.Fatalf("no PEM data in %s", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
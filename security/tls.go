@@ -0,0 +1,71 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// Package security manages the certificates used to authenticate and
+// encrypt traffic between nodes. Every node holds a certificate
+// signed by the cluster's certificate authority (CA), which it
+// presents both when serving and when connecting to other nodes, so
+// that connections are mutually authenticated.
+package security
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+const (
+	// CACertFile is the name of the CA certificate file in the certs
+	// directory.
+	CACertFile = "ca.crt"
+	// CAKeyFile is the name of the CA private key file. It's needed
+	// only to sign node certificates and needn't be present on nodes.
+	CAKeyFile = "ca.key"
+	// NodeCertFile is the name of the node certificate file.
+	NodeCertFile = "node.crt"
+	// NodeKeyFile is the name of the node private key file.
+	NodeKeyFile = "node.key"
+)
+
+// LoadTLSConfig creates a TLS configuration from the CA and node
+// certificates in certDir. The configuration serves and presents the
+// node certificate, and requires and verifies certificates signed by
+// the CA from peers. It's suitable both for servers and clients.
+func LoadTLSConfig(certDir string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(certDir, NodeCertFile), filepath.Join(certDir, NodeKeyFile))
+	if err != nil {
+		return nil, util.Errorf("unable to load node certificate: %v", err)
+	}
+	caPEM, err := ioutil.ReadFile(filepath.Join(certDir, CACertFile))
+	if err != nil {
+		return nil, util.Errorf("unable to read CA certificate: %v", err)
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caPEM) {
+		return nil, util.Errorf("no valid CA certificate found in %s", filepath.Join(certDir, CACertFile))
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// Verify server certificates presented to clients.
+		RootCAs: caPool,
+		// Require and verify client certificates presented to servers.
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  caPool,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,259 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// chaosInterval is the duration of injected failures.
+const chaosInterval = 100 * time.Millisecond
+
+// TestChaosRestartNodes kills and restarts each node of a cluster in
+// turn under a concurrent write load, waiting for writes to be
+// acknowledged again after each restart, then verifies that no
+// acknowledged writes were lost and that the nodes converged.
+func TestChaosRestartNodes(t *testing.T) {
+	c := newLocalCluster(3, t)
+	defer c.stop()
+	acked := newAckLog()
+	stopper := make(chan struct{})
+	writers := c.startWriters(3, "restart", acked, stopper)
+
+	for i := range c.nodes {
+		acked.waitForProgress(t)
+		c.kill(i)
+		time.Sleep(chaosInterval)
+		c.restart(i)
+	}
+	acked.waitForProgress(t)
+	close(stopper)
+	writers.Wait()
+
+	c.verify("restart", acked)
+}
+
+// TestChaosPartition partitions the node holding the cluster's only
+// range, and then another node, under a concurrent write load. Writes
+// must not be acknowledged while the range is partitioned, and once
+// the partitions heal, no acknowledged writes may have been lost and
+// the nodes must have converged.
+func TestChaosPartition(t *testing.T) {
+	c := newLocalCluster(3, t)
+	defer c.stop()
+	acked := newAckLog()
+	stopper := make(chan struct{})
+	writers := c.startWriters(3, "partition", acked, stopper)
+
+	acked.waitForProgress(t)
+	c.partition(0, true)
+	reply := c.db(1).Put(&storage.PutRequest{Key: storage.Key("partition-probe"), Value: storage.Value{Bytes: []byte("v")}})
+	select {
+	case r := <-reply:
+		t.Fatalf("expected write to be blocked by partition; got %+v", r)
+	case <-time.After(chaosInterval):
+	}
+	c.partition(0, false)
+	select {
+	case r := <-reply:
+		if r.Error != nil {
+			t.Fatalf("expected write to succeed once partition healed: %v", r.Error)
+		}
+	case <-time.After(clusterWaitTimeout):
+		t.Fatal("timed out waiting for write once partition healed")
+	}
+
+	acked.waitForProgress(t)
+	c.partition(2, true)
+	time.Sleep(chaosInterval)
+	c.partition(2, false)
+	acked.waitForProgress(t)
+	close(stopper)
+	writers.Wait()
+
+	acked.add("partition-probe", []byte("v"))
+	c.verify("partition", acked)
+}
+
+// TestChaosClockSkew skews the clocks of individual nodes under a
+// concurrent write load. Writes timestamped by a node whose clock is
+// skewed beyond the max offset must be rejected rather than applied,
+// while writes timestamped within the max offset must be visible to
+// subsequent reads on other nodes, whose clocks compensate for the
+// skew. The cluster must remain available throughout.
+func TestChaosClockSkew(t *testing.T) {
+	c := newLocalCluster(3, t)
+	defer c.stop()
+	acked := newAckLog()
+	stopper := make(chan struct{})
+	writers := c.startWriters(3, "skew", acked, stopper)
+
+	// putAt writes key via node 0, timestamped by the clock of node i.
+	putAt := func(i int, key, value string) error {
+		args := &storage.PutRequest{
+			RequestHeader: storage.RequestHeader{Timestamp: c.nodes[i].node.clock.Now()},
+			Key:           storage.Key(key),
+			Value:         storage.Value{Bytes: []byte(value)},
+		}
+		select {
+		case r := <-c.db(0).Put(args):
+			return r.Error
+		case <-time.After(clusterWaitTimeout):
+			t.Fatalf("timed out writing %q", key)
+		}
+		return nil
+	}
+	// get reads key via node i, timestamped by the range's replica.
+	get := func(i int, key string) []byte {
+		select {
+		case r := <-c.db(i).Get(&storage.GetRequest{Key: storage.Key(key)}):
+			if r.Error != nil {
+				t.Fatalf("node %d: get of %q failed: %v", i, key, r.Error)
+			}
+			return r.Value.Bytes
+		case <-time.After(clusterWaitTimeout):
+			t.Fatalf("node %d: timed out reading %q", i, key)
+		}
+		return nil
+	}
+
+	acked.waitForProgress(t)
+	c.skew(2, time.Hour)
+	if err := putAt(2, "skew-ahead", "v"); err == nil {
+		t.Error("expected write timestamped an hour ahead to be rejected")
+	}
+	if value := get(1, "skew-ahead"); value != nil {
+		t.Errorf("expected rejected write not to be applied; got %q", value)
+	}
+	acked.waitForProgress(t)
+
+	c.skew(1, clusterMaxOffset/2)
+	if err := putAt(1, "skew-within", "v"); err != nil {
+		t.Fatalf("expected write timestamped within max offset to succeed: %v", err)
+	}
+	if value := get(2, "skew-within"); !bytes.Equal(value, []byte("v")) {
+		t.Errorf("expected read to observe write timestamped within max offset; got %q", value)
+	}
+	acked.waitForProgress(t)
+	close(stopper)
+	writers.Wait()
+
+	acked.add("skew-within", []byte("v"))
+	c.verify("skew", acked)
+}
+
+// TestChaosLinearizableRegister performs concurrent reads, writes and
+// CAS operations on a few registers while nodes are partitioned and
+// restarted, and verifies that the observed history is linearizable.
+func TestChaosLinearizableRegister(t *testing.T) {
+	testChaosLinearizable(t, "register", registerOp, registerModel{})
+}
+
+// TestChaosLinearizableCounter performs concurrent increments and
+// reads of a few counters while nodes are partitioned and restarted,
+// and verifies that the observed history is linearizable.
+func TestChaosLinearizableCounter(t *testing.T) {
+	testChaosLinearizable(t, "counter", counterOp, counterModel{})
+}
+
+func testChaosLinearizable(t *testing.T, prefix string,
+	newOp func(r *rand.Rand, prefix string, client, seq int, last map[string]int64) *operation, m model) {
+	c := newLocalCluster(3, t)
+	defer c.stop()
+	h := &history{}
+	stopper := make(chan struct{})
+	clients := c.startClients(5, prefix, h, stopper, newOp)
+
+	time.Sleep(chaosInterval)
+	c.partition(0, true)
+	time.Sleep(chaosInterval)
+	c.partition(0, false)
+	time.Sleep(chaosInterval)
+	c.kill(2)
+	time.Sleep(chaosInterval)
+	c.restart(2)
+	time.Sleep(chaosInterval)
+	close(stopper)
+	clients.Wait()
+
+	ops := h.operations()
+	var known int
+	for _, op := range ops {
+		if op.known {
+			known++
+		}
+	}
+	t.Logf("checking history of %d operations, %d with known results", len(ops), known)
+	if known == 0 {
+		t.Fatal("no operations completed")
+	}
+	if err := checkLinearizable(ops, m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLocalClusterCheckpoint sets up a cluster with a split range as
+// a fixture, checkpoints it and restores it twice. Each restored
+// cluster must hold the fixture's writes and its own, but not the
+// writes made to the other.
+func TestLocalClusterCheckpoint(t *testing.T) {
+	c := newLocalCluster(3, t)
+	acked := newAckLog()
+	for _, key := range []string{"fixture-a", "fixture-c"} {
+		mustPut(c, key, acked, t)
+	}
+	split := <-c.db(0).AdminSplit(&storage.AdminSplitRequest{
+		Key:      storage.Key("fixture-a"),
+		SplitKey: storage.Key("fixture-b"),
+	})
+	if split.Error != nil {
+		t.Fatal(split.Error)
+	}
+	c.stop()
+	cp := c.checkpoint()
+
+	for i := 0; i < 2; i++ {
+		r := restoreLocalCluster(cp, t)
+		restoreAcked := newAckLog()
+		for key, value := range acked.writes {
+			restoreAcked.add(key, value)
+		}
+		mustPut(r, fmt.Sprintf("fixture-restore-%d", i), restoreAcked, t)
+		r.verify("fixture", restoreAcked)
+		prefix := storage.Key("fixture")
+		if sr := r.scan(0, prefix, storage.PrefixEndKey(prefix)); len(sr.Rows) != restoreAcked.len() {
+			t.Errorf("restore %d: expected %d writes; read %d", i, restoreAcked.len(), len(sr.Rows))
+		}
+		r.stop()
+	}
+}
+
+// mustPut writes key through the first node of c, recording the write in
+// acked, and fails the test if the write isn't acknowledged.
+func mustPut(c *localCluster, key string, acked *ackLog, t *testing.T) {
+	value := []byte("value-" + key)
+	reply := <-c.db(0).Put(&storage.PutRequest{Key: storage.Key(key), Value: storage.Value{Bytes: value}})
+	if reply.Error != nil {
+		t.Fatalf("put %q: %v", key, reply.Error)
+	}
+	acked.add(key, value)
+}
@@ -0,0 +1,113 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"unicode/utf8"
+
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+	yaml "gopkg.in/yaml.v1"
+)
+
+// An acctHandler implements the actionHandler interface for
+// accounting configs.
+type acctHandler struct {
+	kvDB kv.DB // Key-value database client
+}
+
+// Put writes an accounting config for the specified key prefix. The
+// config is parsed from the YAML input body and stored gob-encoded.
+func (ah *acctHandler) Put(path string, body []byte, r *http.Request) error {
+	if len(path) == 0 {
+		return util.Errorf("no path specified for accounting Put")
+	}
+	if !utf8.Valid(body) {
+		return util.Errorf("config contents not valid utf8: %q", body)
+	}
+	config, err := storage.ParseAcctConfig(body)
+	if err != nil {
+		return util.Errorf("accounting config has invalid format: %s: %v", body, err)
+	}
+	acctKey := storage.MakeKey(storage.KeyConfigAccountingPrefix, storage.Key(path[1:]))
+	return kv.PutI(ah.kvDB, acctKey, config)
+}
+
+// Get retrieves the accounting config for the specified key prefix,
+// less its leading "/" path delimiter, as YAML. If the path is
+// empty, the escaped prefixes of all accounting configs are listed
+// as JSON.
+func (ah *acctHandler) Get(path string, r *http.Request) (body []byte, contentType string, err error) {
+	if len(path) == 0 {
+		sr := <-ah.kvDB.Scan(&storage.ScanRequest{
+			StartKey:   storage.KeyConfigAccountingPrefix,
+			EndKey:     storage.PrefixEndKey(storage.KeyConfigAccountingPrefix),
+			MaxResults: maxGetResults,
+		})
+		if sr.Error != nil {
+			err = sr.Error
+			return
+		}
+		if len(sr.Rows) == maxGetResults {
+			log.New("server").Warningf("retrieved maximum number of results (%d); some may be missing", maxGetResults)
+		}
+		var prefixes []string
+		for _, kv := range sr.Rows {
+			trimmed := bytes.TrimPrefix(kv.Key, storage.KeyConfigAccountingPrefix)
+			prefixes = append(prefixes, url.QueryEscape(string(trimmed)))
+		}
+		contentType = "application/json"
+		if body, err = json.Marshal(prefixes); err != nil {
+			err = util.Errorf("unable to format accounting configurations: %v", err)
+		}
+		return
+	}
+	acctKey := storage.MakeKey(storage.KeyConfigAccountingPrefix, storage.Key(path[1:]))
+	config := &storage.AcctConfig{}
+	var ok bool
+	if ok, _, err = kv.GetI(ah.kvDB, acctKey, config); err != nil {
+		return
+	}
+	if !ok {
+		err = util.Errorf("no config found for key prefix %q", path)
+		return
+	}
+	if body, err = yaml.Marshal(config); err != nil {
+		err = util.Errorf("unable to marshal accounting config %+v to yaml: %v", config, err)
+		return
+	}
+	contentType = "text/yaml"
+	return
+}
+
+// Delete removes the accounting config for the specified key prefix.
+func (ah *acctHandler) Delete(path string, r *http.Request) error {
+	if len(path) == 0 {
+		return util.Errorf("no path specified for accounting Delete")
+	}
+	if path == "/" {
+		return util.Errorf("the default accounting configuration cannot be deleted")
+	}
+	acctKey := storage.MakeKey(storage.KeyConfigAccountingPrefix, storage.Key(path[1:]))
+	dr := <-ah.kvDB.Delete(&storage.DeleteRequest{Key: acctKey})
+	return dr.Error
+}
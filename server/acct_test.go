@@ -0,0 +1,116 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// doAdmin invokes handler with a request of the specified method,
+// path and body and returns the recorded response, failing the test
+// on an unexpected status.
+func doAdmin(handler http.HandlerFunc, method, path, body string, status int, t *testing.T) *httptest.ResponseRecorder {
+	r, err := http.NewRequest(method, "http://localhost"+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != status {
+		t.Fatalf("%s %s: expected status %d; got %d: %s", method, path, status, w.Code, w.Body)
+	}
+	return w
+}
+
+// TestAcctConfigs verifies accounting configs may be set, listed,
+// fetched and deleted via the admin API.
+func TestAcctConfigs(t *testing.T) {
+	db, err := BootstrapCluster("cluster-1", storage.NewInMem(storage.Attributes{}, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := newAdminServer(db, nil, nil)
+	handler := admin.handleAcctAction
+
+	doAdmin(handler, "PUT", acctKeyPrefix+"/db1", "account: sales\n", http.StatusOK, t)
+	w := doAdmin(handler, "GET", acctKeyPrefix+"/db1", "", http.StatusOK, t)
+	config, err := storage.ParseAcctConfig(w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Account != "sales" {
+		t.Errorf("expected account \"sales\"; got %+v", config)
+	}
+
+	w = doAdmin(handler, "GET", acctKeyPrefix, "", http.StatusOK, t)
+	var prefixes []string
+	if err := json.Unmarshal(w.Body.Bytes(), &prefixes); err != nil {
+		t.Fatal(err)
+	}
+	if len(prefixes) != 2 || prefixes[0] != "" || prefixes[1] != "db1" {
+		t.Errorf("expected default and db1 prefixes; got %q", prefixes)
+	}
+
+	doAdmin(handler, "PUT", acctKeyPrefix+"/db2", "account: [", http.StatusInternalServerError, t)
+	doAdmin(handler, "DELETE", acctKeyPrefix+"/", "", http.StatusInternalServerError, t)
+	doAdmin(handler, "DELETE", acctKeyPrefix+"/db1", "", http.StatusOK, t)
+	doAdmin(handler, "GET", acctKeyPrefix+"/db1", "", http.StatusInternalServerError, t)
+}
+
+// TestAcctUsage verifies the admin API sums the gossiped accounting
+// usage of stores by prefix.
+func TestAcctUsage(t *testing.T) {
+	g := gossip.New()
+	admin := newAdminServer(nil, g, nil)
+	doAdmin(admin.handleAcctUsage, "GET", acctUsagePath, "", http.StatusServiceUnavailable, t)
+
+	if err := g.RegisterGroup(gossip.KeyAcctUsagePrefix, gossipGroupLimit, gossip.MaxGroup); err != nil {
+		t.Fatal(err)
+	}
+	for storeID := int32(1); storeID <= 2; storeID++ {
+		usage := storage.StoreAcctUsage{
+			NodeID:    1,
+			StoreID:   storeID,
+			Timestamp: time.Now(),
+			Usage: map[string]storage.AcctUsage{
+				"":     {Reads: 1},
+				"db 1": {Reads: 2, Writes: 3},
+			},
+		}
+		if err := g.AddInfo(gossip.MakeAcctUsageKey(usage.NodeID, usage.StoreID), usage, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := doAdmin(admin.handleAcctUsage, "GET", acctUsagePath, "", http.StatusOK, t)
+	var usage map[string]storage.AcctUsage
+	if err := json.Unmarshal(w.Body.Bytes(), &usage); err != nil {
+		t.Fatal(err)
+	}
+	if u := usage[""]; u.Reads != 2 || u.Writes != 0 {
+		t.Errorf("expected 2 reads under default prefix; got %+v", u)
+	}
+	if u := usage["db+1"]; u.Reads != 4 || u.Writes != 6 {
+		t.Errorf("expected 4 reads and 6 writes under \"db 1\"; got %+v", u)
+	}
+}
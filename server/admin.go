@@ -18,23 +18,56 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/hlc"
 	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
 )
 
 const (
 	// adminKeyPrefix is the prefix for RESTful endpoints used to
 	// provide an administrative interface to the cockroach cluster.
 	adminKeyPrefix = "/_admin/"
+	// acctKeyPrefix is the prefix for accounting configuration changes.
+	acctKeyPrefix = adminKeyPrefix + "acct"
+	// acctUsagePath is the path for queries of accounting usage.
+	acctUsagePath = adminKeyPrefix + "usage"
 	// zoneKeyPrefix is the prefix for zone configuration changes.
 	zoneKeyPrefix = adminKeyPrefix + "zones"
+	// livenessKeyPrefix is the prefix for node liveness queries.
+	livenessKeyPrefix = adminKeyPrefix + "liveness"
+	// metricsPath is the path for export of the node's metrics.
+	metricsPath = adminKeyPrefix + "metrics"
+	// tracesPath is the path for the traces of recent slow requests.
+	tracesPath = adminKeyPrefix + "traces"
+	// raftLogPrefix is the prefix for queries of the raft logs of the
+	// node's ranges, by range ID.
+	raftLogPrefix = adminKeyPrefix + "raft/"
+	// drainPath is the path for draining the node and querying the
+	// progress of a drain.
+	drainPath = adminKeyPrefix + "drain"
+	// decommissionPath is the path for decommissioning the node and
+	// querying the progress of its decommissioning.
+	decommissionPath = adminKeyPrefix + "decommission"
+	// changesPath is the path for streams of the writes committed by
+	// the node's ranges.
+	changesPath = adminKeyPrefix + "changes"
 )
 
+// changesBufferSize is the number of changes buffered for each store
+// by streams of committed writes.
+const changesBufferSize = 1000
+
 // A actionHandler is an interface which provides Get, Put & Delete
 // to satisfy administrative REST APIs.
 type actionHandler interface {
@@ -46,16 +79,22 @@ type actionHandler interface {
 // A adminServer provides a RESTful HTTP API to administration of
 // the cockroach cluster.
 type adminServer struct {
-	kvDB kv.DB // Key-value database client
-	zone *zoneHandler
+	kvDB   kv.DB          // Key-value database client
+	gossip *gossip.Gossip // Provides node liveness records and accounting usage
+	node   *Node          // Provides the raft logs of the node's ranges
+	acct   *acctHandler
+	zone   *zoneHandler
 }
 
 // newAdminServer allocates and returns a new REST server for
 // administrative APIs.
-func newAdminServer(kvDB kv.DB) *adminServer {
+func newAdminServer(kvDB kv.DB, gossip *gossip.Gossip, node *Node) *adminServer {
 	return &adminServer{
-		kvDB: kvDB,
-		zone: &zoneHandler{kvDB: kvDB},
+		kvDB:   kvDB,
+		gossip: gossip,
+		node:   node,
+		acct:   &acctHandler{kvDB: kvDB},
+		zone:   &zoneHandler{kvDB: kvDB},
 	}
 }
 
@@ -65,15 +104,270 @@ func (s *adminServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "ok")
 }
 
+// handleLiveness responds with the liveness status of each node
+// whose liveness record is gossiped, one node per line in order of
+// node ID.
+func (s *adminServer) handleLiveness(w http.ResponseWriter, r *http.Request) {
+	records, err := storage.GossipedLiveness(s.gossip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	sort.Sort(livenessByNodeID(records))
+	w.Header().Set("Content-Type", "text/plain")
+	now := time.Now()
+	for _, l := range records {
+		var decommissioning string
+		if l.Decommissioning {
+			decommissioning = ", decommissioning"
+		}
+		fmt.Fprintf(w, "node %d: %s (expiration %s%s)\n", l.NodeID, l.Status(now),
+			l.Expiration.Format(time.RFC3339), decommissioning)
+	}
+}
+
+// handleTraces responds with the traces of the most recent requests
+// coordinated by the node which exceeded the slow request threshold,
+// most recent first.
+func (s *adminServer) handleTraces(w http.ResponseWriter, r *http.Request) {
+	requests := storage.SlowRequests.Requests()
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "%d requests slower than %s\n", len(requests), storage.SlowRequests.Threshold())
+	for i := len(requests) - 1; i >= 0; i-- {
+		fmt.Fprintln(w, requests[i])
+	}
+}
+
+// handleRaftLog responds with a JSON-encoded window of the raft log
+// of the range whose ID follows the path prefix, as held by the
+// node's replica; see storage.Store.RaftLog. The window's bounds may
+// be specified by the "first" and "last" query parameters.
+func (s *adminServer) handleRaftLog(w http.ResponseWriter, r *http.Request) {
+	rangeID, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, raftLogPrefix), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid range ID: %v", err), http.StatusBadRequest)
+		return
+	}
+	var bounds [2]int
+	for i, name := range []string{"first", "last"} {
+		if v := r.URL.Query().Get(name); v != "" {
+			if bounds[i], err = strconv.Atoi(v); err != nil || bounds[i] < 0 {
+				http.Error(w, fmt.Sprintf("invalid %s index %q", name, v), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	window, err := s.node.RaftLog(rangeID, bounds[0], bounds[1])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	b, err := json.Marshal(window)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// A drainStatus reports whether the node is draining and the work
+// remaining to drain it.
+type drainStatus struct {
+	Draining bool
+	storage.DrainProgress
+}
+
+// handleDrain responds with the JSON-encoded drain status of the
+// node. A POST first drains the node, moving its replicas to other
+// nodes if the "replicas" query parameter is true; POSTs may be
+// repeated until no work remains. See Node.Drain.
+func (s *adminServer) handleDrain(w http.ResponseWriter, r *http.Request) {
+	var status drainStatus
+	switch r.Method {
+	case "GET":
+		status.DrainProgress = s.node.DrainProgress()
+	case "POST":
+		moveReplicas, err := strconv.ParseBool(r.URL.Query().Get("replicas"))
+		if err != nil && r.URL.Query().Get("replicas") != "" {
+			http.Error(w, fmt.Sprintf("invalid replicas parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+		if status.DrainProgress, err = s.node.Drain(moveReplicas); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	status.Draining = s.node.IsDraining()
+	b, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// A decommissionStatus reports whether the node is decommissioning
+// and the number of replicas which remain on its stores.
+type decommissionStatus struct {
+	Decommissioning bool
+	Replicas        int
+}
+
+// handleDecommission responds with the JSON-encoded decommission
+// status of the node. A POST first marks the node as decommissioning;
+// see Node.Decommission. Decommissioning is complete once no replicas
+// remain.
+func (s *adminServer) handleDecommission(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		s.node.Decommission()
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	status := decommissionStatus{
+		Decommissioning: s.node.IsDecommissioning(),
+		Replicas:        s.node.DrainProgress().Replicas,
+	}
+	b, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// A changeRecord is a committed write as streamed by handleChanges.
+// Deletions have no value.
+type changeRecord struct {
+	Key       []byte
+	Value     []byte `json:",omitempty"`
+	Timestamp hlc.HLTimestamp
+	Deleted   bool `json:",omitempty"`
+}
+
+// handleChanges streams the writes committed by the node's ranges to
+// keys with the prefix specified by the "prefix" query parameter, as
+// newline-delimited JSON change records, until the client
+// disconnects. A client which falls behind is sent a final record
+// holding only an Error; see storage.ErrChangeFeedOverflow.
+func (s *adminServer) handleChanges(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	subs := s.node.SubscribeChanges(storage.Key(r.URL.Query().Get("prefix")), changesBufferSize)
+	defer func() {
+		for _, sub := range subs {
+			sub.Close()
+		}
+	}()
+	// Merge the changes of the node's stores.
+	changes := make(chan storage.KeyValue)
+	errs := make(chan error, len(subs))
+	done := make(chan struct{})
+	defer close(done)
+	for _, sub := range subs {
+		go func(sub *storage.ChangeFeedSubscription) {
+			for change := range sub.Changes() {
+				select {
+				case changes <- change:
+				case <-done:
+					return
+				}
+			}
+			if err := sub.Err(); err != nil {
+				errs <- err
+			}
+		}(sub)
+	}
+
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case change := <-changes:
+			rec := changeRecord{Key: change.Key, Timestamp: change.Value.Timestamp, Deleted: change.Deleted}
+			if !change.Deleted {
+				rec.Value = change.Value.Bytes
+			}
+			if err := enc.Encode(rec); err != nil {
+				return
+			}
+			flusher.Flush()
+		case err := <-errs:
+			enc.Encode(struct{ Error string }{err.Error()})
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+// livenessByNodeID sorts liveness records by node ID.
+type livenessByNodeID []storage.NodeLiveness
+
+func (l livenessByNodeID) Len() int           { return len(l) }
+func (l livenessByNodeID) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l livenessByNodeID) Less(i, j int) bool { return l[i].NodeID < l[j].NodeID }
+
+// handleAcctUsage responds with the cluster's accounting usage, a
+// JSON object mapping each escaped accounting prefix to its usage
+// summed over the records gossiped by all stores.
+func (s *adminServer) handleAcctUsage(w http.ResponseWriter, r *http.Request) {
+	usage, err := storage.GossipedAcctUsage(s.gossip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	escaped := map[string]storage.AcctUsage{}
+	for prefix, u := range usage {
+		escaped[url.QueryEscape(prefix)] = u
+	}
+	b, err := json.Marshal(escaped)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleAcctAction handles actions for accounting configuration by
+// method.
+func (s *adminServer) handleAcctAction(w http.ResponseWriter, r *http.Request) {
+	s.handleAction(s.acct, acctKeyPrefix, w, r)
+}
+
 // handleZoneAction handles actions for zone configuration by method.
 func (s *adminServer) handleZoneAction(w http.ResponseWriter, r *http.Request) {
+	s.handleAction(s.zone, zoneKeyPrefix, w, r)
+}
+
+// handleAction dispatches an action on the configs handled by handler
+// by method. The path of the request, less prefix, specifies the key
+// prefix of the config.
+func (s *adminServer) handleAction(handler actionHandler, prefix string, w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		s.handleGetAction(s.zone, w, r)
+		s.handleGetAction(handler, prefix, w, r)
 	case "PUT", "POST":
-		s.handlePutAction(s.zone, w, r)
+		s.handlePutAction(handler, prefix, w, r)
 	case "DELETE":
-		s.handleDeleteAction(s.zone, w, r)
+		s.handleDeleteAction(handler, prefix, w, r)
 	default:
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 	}
@@ -87,8 +381,8 @@ func unescapePath(path, prefix string) (string, error) {
 	return result, nil
 }
 
-func (s *adminServer) handlePutAction(handler actionHandler, w http.ResponseWriter, r *http.Request) {
-	path, err := unescapePath(r.URL.Path, zoneKeyPrefix)
+func (s *adminServer) handlePutAction(handler actionHandler, prefix string, w http.ResponseWriter, r *http.Request) {
+	path, err := unescapePath(r.URL.Path, prefix)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -106,8 +400,8 @@ func (s *adminServer) handlePutAction(handler actionHandler, w http.ResponseWrit
 	w.WriteHeader(http.StatusOK)
 }
 
-func (s *adminServer) handleGetAction(handler actionHandler, w http.ResponseWriter, r *http.Request) {
-	path, err := unescapePath(r.URL.Path, zoneKeyPrefix)
+func (s *adminServer) handleGetAction(handler actionHandler, prefix string, w http.ResponseWriter, r *http.Request) {
+	path, err := unescapePath(r.URL.Path, prefix)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -121,8 +415,8 @@ func (s *adminServer) handleGetAction(handler actionHandler, w http.ResponseWrit
 	fmt.Fprintf(w, "%s", string(b))
 }
 
-func (s *adminServer) handleDeleteAction(handler actionHandler, w http.ResponseWriter, r *http.Request) {
-	path, err := unescapePath(r.URL.Path, zoneKeyPrefix)
+func (s *adminServer) handleDeleteAction(handler actionHandler, prefix string, w http.ResponseWriter, r *http.Request) {
+	path, err := unescapePath(r.URL.Path, prefix)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
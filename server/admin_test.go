@@ -24,7 +24,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/kv"
 	"github.com/cockroachdb/cockroach/storage"
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 // startAdminServer launches a new admin server using minimal engine
@@ -34,9 +34,9 @@ import (
 func startAdminServer() *httptest.Server {
 	db, err := BootstrapCluster("cluster-1", storage.NewInMem(storage.Attributes{}, 1<<20))
 	if err != nil {
-		glog.Fatal(err)
+		log.New("server").Fatalf("%v", err)
 	}
-	admin := newAdminServer(db)
+	admin := newAdminServer(db, nil, nil)
 	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		admin.handleZoneAction(w, r)
 	}))
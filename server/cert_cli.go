@@ -0,0 +1,82 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	commander "code.google.com/p/go-commander"
+	"github.com/cockroachdb/cockroach/security"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// A CmdCreateCACert command generates a CA certificate and key.
+var CmdCreateCACert = &commander.Command{
+	UsageLine: "create-ca-cert -certs=<cert-dir>",
+	Short:     "create CA certificate and key",
+	Long: `
+Generates a new certificate authority (CA) certificate and private key
+in the directory specified by -certs. The CA signs the certificates of
+all nodes in the cluster. Its key is only required to create node
+certificates and should be kept secret.
+`,
+	Run:  runCreateCACert,
+	Flag: *flag.CommandLine,
+}
+
+// runCreateCACert generates the CA certificate and key.
+func runCreateCACert(cmd *commander.Command, args []string) {
+	if len(args) != 0 || *certDir == "" {
+		cmd.Usage()
+		return
+	}
+	if err := security.GenerateCA(*certDir); err != nil {
+		log.New("server").Errorf("Failed to create CA certificate: %v", err)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "Created CA certificate and key in %s\n", *certDir)
+}
+
+// A CmdCreateNodeCert command generates a node certificate and key.
+var CmdCreateNodeCert = &commander.Command{
+	UsageLine: "create-node-cert -certs=<cert-dir> <host 1> [<host 2> ...]",
+	Short:     "create node certificate and key",
+	Long: `
+Generates a node certificate and private key signed by the CA in the
+directory specified by -certs. The certificate is valid for each of
+the specified host names and IP addresses, which should include every
+address by which other nodes reach this node. Copy the CA certificate
+and the node certificate and key to the node and start it with the
+same -certs directory.
+`,
+	Run:  runCreateNodeCert,
+	Flag: *flag.CommandLine,
+}
+
+// runCreateNodeCert generates a node certificate and key.
+func runCreateNodeCert(cmd *commander.Command, args []string) {
+	if len(args) == 0 || *certDir == "" {
+		cmd.Usage()
+		return
+	}
+	if err := security.GenerateNodeCert(*certDir, args); err != nil {
+		log.New("server").Errorf("Failed to create node certificate: %v", err)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "Created node certificate and key for %v in %s\n", args, *certDir)
+}
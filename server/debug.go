@@ -0,0 +1,160 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/metrics"
+)
+
+const (
+	// debugPrefix is the prefix of the debugging endpoints enabled by
+	// the -debug_endpoints flag.
+	debugPrefix = "/debug/"
+	// debugStatsPath is the path for the node's runtime statistics.
+	debugStatsPath = debugPrefix + "stats"
+	// runtimeStatsInterval is the interval at which runtime statistics
+	// are sampled into the metrics registry.
+	runtimeStatsInterval = 10 * time.Second
+)
+
+// registerDebugHandlers registers the pprof profiling endpoints and
+// the runtime statistics of sampler with mux.
+func registerDebugHandlers(mux *http.ServeMux, sampler *runtimeStatSampler) {
+	mux.HandleFunc(debugPrefix+"pprof/", pprof.Index)
+	mux.HandleFunc(debugPrefix+"pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc(debugPrefix+"pprof/profile", pprof.Profile)
+	mux.HandleFunc(debugPrefix+"pprof/symbol", pprof.Symbol)
+	mux.Handle(debugStatsPath, sampler)
+}
+
+// runtimeStats is a sample of the Go runtime's and the process's
+// resource usage.
+type runtimeStats struct {
+	Goroutines  int
+	HeapAlloc   uint64        // Bytes of allocated heap objects
+	HeapObjects uint64        // Number of allocated heap objects
+	NumGC       uint32        // Number of completed GC cycles
+	PauseTotal  time.Duration // Cumulative GC pause time
+	LastPause   time.Duration // Pause time of the most recent GC
+	OpenFDs     int           // Open file descriptors; -1 if unknown
+}
+
+// A runtimeStatSampler samples runtime statistics into gauges of a
+// metrics registry.
+type runtimeStatSampler struct {
+	goroutines  *metrics.Gauge
+	heapAlloc   *metrics.Gauge
+	heapObjects *metrics.Gauge
+	numGC       *metrics.Gauge
+	pauseTotal  *metrics.Gauge
+	lastPause   *metrics.Gauge
+	openFDs     *metrics.Gauge
+}
+
+// newRuntimeStatSampler returns a sampler which registers its gauges
+// with registry.
+func newRuntimeStatSampler(registry *metrics.Registry) *runtimeStatSampler {
+	return &runtimeStatSampler{
+		goroutines:  registry.Gauge("runtime_goroutines"),
+		heapAlloc:   registry.Gauge("runtime_heap_alloc_bytes"),
+		heapObjects: registry.Gauge("runtime_heap_objects"),
+		numGC:       registry.Gauge("runtime_gc_count"),
+		pauseTotal:  registry.Gauge("runtime_gc_pause_total_ns"),
+		lastPause:   registry.Gauge("runtime_gc_last_pause_ns"),
+		openFDs:     registry.Gauge("runtime_open_fds"),
+	}
+}
+
+// start samples runtime statistics every interval in a worker of the
+// stopper until it's stopped.
+func (rs *runtimeStatSampler) start(interval time.Duration, stopper *util.Stopper) {
+	stopper.RunWorker(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			rs.sample()
+			select {
+			case <-ticker.C:
+			case <-stopper.ShouldStop():
+				return
+			}
+		}
+	})
+}
+
+// sample reads the current runtime statistics, updates the gauges and
+// returns the statistics.
+func (rs *runtimeStatSampler) sample() runtimeStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	stats := runtimeStats{
+		Goroutines:  runtime.NumGoroutine(),
+		HeapAlloc:   ms.HeapAlloc,
+		HeapObjects: ms.HeapObjects,
+		NumGC:       ms.NumGC,
+		PauseTotal:  time.Duration(ms.PauseTotalNs),
+		OpenFDs:     openFDCount(),
+	}
+	if ms.NumGC > 0 {
+		stats.LastPause = time.Duration(ms.PauseNs[(ms.NumGC+255)%256])
+	}
+	rs.goroutines.Update(int64(stats.Goroutines))
+	rs.heapAlloc.Update(int64(stats.HeapAlloc))
+	rs.heapObjects.Update(int64(stats.HeapObjects))
+	rs.numGC.Update(int64(stats.NumGC))
+	rs.pauseTotal.Update(int64(stats.PauseTotal))
+	rs.lastPause.Update(int64(stats.LastPause))
+	rs.openFDs.Update(int64(stats.OpenFDs))
+	return stats
+}
+
+// openFDCount returns the number of file descriptors open by the
+// process, or -1 if it can't be determined. It's only supported on
+// systems with a /proc filesystem.
+func openFDCount() int {
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return -1
+	}
+	// Discount the descriptor used to read the directory.
+	return len(names) - 1
+}
+
+// ServeHTTP responds with a fresh sample of the runtime statistics.
+func (rs *runtimeStatSampler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stats := rs.sample()
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "goroutines:      %d\n", stats.Goroutines)
+	fmt.Fprintf(w, "heap alloc:      %d bytes\n", stats.HeapAlloc)
+	fmt.Fprintf(w, "heap objects:    %d\n", stats.HeapObjects)
+	fmt.Fprintf(w, "gc cycles:       %d\n", stats.NumGC)
+	fmt.Fprintf(w, "gc pause total:  %s\n", stats.PauseTotal)
+	fmt.Fprintf(w, "gc pause last:   %s\n", stats.LastPause)
+	fmt.Fprintf(w, "open fds:        %d\n", stats.OpenFDs)
+}
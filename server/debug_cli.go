@@ -0,0 +1,167 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+
+	commander "code.google.com/p/go-commander"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// raftStore is specified to read the raft state of a store whose raft
+// logs are placed on a separate device.
+var raftStore = flag.String("raft_store", "", "for debug, specify the directory of the store's "+
+	"raft log engine if the store's raft logs are placed on a separate device")
+
+// A CmdDebug command dumps the persisted state of a store.
+var CmdDebug = &commander.Command{
+	UsageLine: "debug <store-dir> ident | ranges | raft-log <range-id> | range-local <range-id> | mvcc <key>",
+	Short:     "dumps the persisted state of a store",
+	Long: `
+Opens the RocksDB store in <store-dir> read-only and prints its
+persisted state, for post-mortem analysis of corrupted or wedged
+nodes. The node serving the store should be stopped first.
+
+  ident                    the store's ident
+  ranges                   the metadata of the store's ranges
+  raft-log <range-id>      the raft state and log entries of a range
+  range-local <range-id>   the range-local keys of a range: MVCC stats,
+                           leader lease, raft state, response cache
+                           and transaction records
+  mvcc <key>               the MVCC metadata and versions of a key
+
+If the store's raft logs are placed on a separate device, its raft
+state is read from the store in the directory specified by -raft_store.
+
+The key should be escaped via URL query escaping if it contains
+non-ascii bytes or spaces.
+`,
+	Run:  runDebug,
+	Flag: *flag.CommandLine,
+}
+
+// runDebug opens the store and dumps the requested state.
+func runDebug(cmd *commander.Command, args []string) {
+	if len(args) < 2 {
+		cmd.Usage()
+		return
+	}
+	engine, err := storage.OpenRocksDBReadOnly(storage.Attributes{}, args[0])
+	if err != nil {
+		log.New("server").Errorf("unable to open store: %v", err)
+		return
+	}
+	raftEngine := engine
+	if *raftStore != "" {
+		if raftEngine, err = storage.OpenRocksDBReadOnly(storage.Attributes{}, *raftStore); err != nil {
+			log.New("server").Errorf("unable to open raft log store: %v", err)
+			return
+		}
+	}
+	if err := debugStore(os.Stdout, engine, raftEngine, args[1:]); err != nil {
+		log.New("server").Errorf("%v", err)
+	}
+}
+
+// debugStore writes the state of the store's engine and raft log
+// engine requested by args to w.
+func debugStore(w io.Writer, engine, raftEngine storage.Engine, args []string) error {
+	switch {
+	case args[0] == "ident" && len(args) == 1:
+		ident, err := storage.DebugStoreIdent(engine)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "cluster %s, node %d, store %d\n", ident.ClusterID, ident.NodeID, ident.StoreID)
+	case args[0] == "ranges" && len(args) == 1:
+		metas, err := storage.DebugRangeMetadata(engine)
+		if err != nil {
+			return err
+		}
+		for _, meta := range metas {
+			fmt.Fprintf(w, "range %d: [%q, %q) replicas %+v\n", meta.RangeID, meta.StartKey, meta.EndKey, meta.Replicas.Replicas)
+		}
+	case args[0] == "raft-log" && len(args) == 2:
+		rangeID, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return util.Errorf("invalid range ID %q: %v", args[1], err)
+		}
+		dump, err := storage.DebugRaftLog(engine, raftEngine, rangeID)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "election state: %+v\n", dump.ElectionState)
+		fmt.Fprintf(w, "last index: %d, applied index: %d\n", dump.LastIndex, dump.AppliedIndex)
+		for _, entry := range dump.Entries {
+			fmt.Fprintf(w, "%d: term %d, type %d, payload %q\n", entry.Index, entry.Term, entry.Type, entry.Payload)
+		}
+	case args[0] == "range-local" && len(args) == 2:
+		rangeID, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return util.Errorf("invalid range ID %q: %v", args[1], err)
+		}
+		metas, err := storage.DebugRangeMetadata(engine)
+		if err != nil {
+			return err
+		}
+		for _, meta := range metas {
+			if meta.RangeID != rangeID {
+				continue
+			}
+			kvs, err := storage.DebugRangeLocal(engine, raftEngine, meta)
+			if err != nil {
+				return err
+			}
+			for _, kv := range kvs {
+				if b, ok := kv.Value.([]byte); ok {
+					fmt.Fprintf(w, "%q: %d bytes\n", kv.Key, len(b))
+				} else {
+					fmt.Fprintf(w, "%q: %+v\n", kv.Key, kv.Value)
+				}
+			}
+			return nil
+		}
+		return util.Errorf("range %d not found", rangeID)
+	case args[0] == "mvcc" && len(args) == 2:
+		key, err := url.QueryUnescape(args[1])
+		if err != nil {
+			return util.Errorf("invalid key %q: %v", args[1], err)
+		}
+		meta, versions, err := storage.DebugMVCCVersions(engine, storage.Key(key))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "metadata: %+v\n", meta)
+		for _, version := range versions {
+			if version.Value == nil {
+				fmt.Fprintf(w, "%d.%d: deleted\n", version.Timestamp.WallTime, version.Timestamp.Logical)
+			} else {
+				fmt.Fprintf(w, "%d.%d: %q\n", version.Timestamp.WallTime, version.Timestamp.Logical, version.Value.Bytes)
+			}
+		}
+	default:
+		return util.Errorf("invalid debug command %q", args)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// TestDebugStore verifies the output of the debug command for a
+// bootstrapped store.
+func TestDebugStore(t *testing.T) {
+	engine := storage.NewInMem(storage.Attributes{}, 1<<20)
+	localDB, err := BootstrapCluster("cluster-1", engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply := <-localDB.Put(&storage.PutRequest{Key: storage.Key("a b"), Value: storage.Value{Bytes: []byte("v")}}); reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	ro := storage.NewReadOnlyEngine(engine)
+
+	testCases := []struct {
+		args     []string
+		expected []string // Substrings of the output
+	}{
+		{[]string{"ident"}, []string{"cluster cluster-1, node 1, store 1\n"}},
+		{[]string{"ranges"}, []string{"range 1: [\"\", \"\\xff\") replicas"}},
+		{[]string{"raft-log", "1"}, []string{"last index: 0, applied index: 0\n"}},
+		{[]string{"range-local", "1"}, []string{"KeyCount:"}},
+		{[]string{"mvcc", "a+b"}, []string{"metadata: &{", ": \"v\"\n"}},
+	}
+	for i, c := range testCases {
+		var buf bytes.Buffer
+		if err := debugStore(&buf, ro, ro, c.args); err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		for _, s := range c.expected {
+			if !strings.Contains(buf.String(), s) {
+				t.Errorf("%d: expected output to contain %q; got %q", i, s, buf.String())
+			}
+		}
+	}
+
+	for i, args := range [][]string{
+		{"ident", "1"},
+		{"raft-log", "x"},
+		{"range-local", "2"},
+		{"mvcc", "%zz"},
+		{"unknown"},
+	} {
+		if err := debugStore(&bytes.Buffer{}, ro, ro, args); err == nil {
+			t.Errorf("%d: expected error for %q", i, args)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/util/metrics"
+)
+
+// TestRuntimeStatSampler verifies that samples of the runtime
+// statistics are recorded in the registry's gauges.
+func TestRuntimeStatSampler(t *testing.T) {
+	registry := metrics.NewRegistry()
+	rs := newRuntimeStatSampler(registry)
+	runtime.GC()
+	stats := rs.sample()
+	if stats.Goroutines <= 0 || stats.HeapAlloc == 0 || stats.NumGC == 0 || stats.OpenFDs == 0 {
+		t.Errorf("unexpected runtime stats %+v", stats)
+	}
+	if g := registry.Gauge("runtime_goroutines").Value(); g != int64(stats.Goroutines) {
+		t.Errorf("expected goroutines gauge %d; got %d", stats.Goroutines, g)
+	}
+	if g := registry.Gauge("runtime_gc_count").Value(); g != int64(stats.NumGC) {
+		t.Errorf("expected gc count gauge %d; got %d", stats.NumGC, g)
+	}
+}
+
+// httpGet fetches url and returns the response's status code and body.
+func httpGet(url string, t *testing.T) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("error requesting %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read response body: %s", err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+// TestDebugEndpoints verifies that the debug endpoints serve profiles
+// and runtime statistics.
+func TestDebugEndpoints(t *testing.T) {
+	mux := http.NewServeMux()
+	registerDebugHandlers(mux, newRuntimeStatSampler(metrics.NewRegistry()))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for path, expected := range map[string]string{
+		debugPrefix + "pprof/":                  "goroutine",
+		debugPrefix + "pprof/goroutine?debug=1": "goroutine profile",
+		debugPrefix + "pprof/cmdline":           os.Args[0],
+		debugStatsPath:                          "goroutines:",
+	} {
+		if code, body := httpGet(ts.URL+path, t); code != http.StatusOK || !strings.Contains(body, expected) {
+			t.Errorf("%s: expected %q in body; got %d: %q", path, expected, code, body)
+		}
+	}
+}
+
+// TestDebugEndpointsDisabled verifies that the debug endpoints aren't
+// exported without the -debug_endpoints flag.
+func TestDebugEndpointsDisabled(t *testing.T) {
+	startServer()
+	if code, _ := httpGet("http://"+*httpAddr+debugStatsPath, t); code != http.StatusNotFound {
+		t.Errorf("expected %s to be disabled; got %d", debugStatsPath, code)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"flag"
+	"net/url"
+	"time"
+
+	commander "code.google.com/p/go-commander"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+var (
+	exportChunkRows = flag.Int64("export_chunk_rows", 10000, "maximum number of exported rows per chunk file")
+	exportSince     = flag.String("export_since", "", "directory of a previous export of the span; if set, only "+
+		"the keys written or deleted since the previous export are exported")
+)
+
+// A CmdExport command exports a key span to a directory.
+var CmdExport = &commander.Command{
+	UsageLine: "export [options] <dir> <start-key> <end-key>",
+	Short:     "exports a key span to chunk files with a manifest",
+	Long: `
+Exports the key-value pairs with keys from <start-key> (inclusive) to
+<end-key> (exclusive), as of the time the export starts, to checksummed
+chunk files in <dir> described by the JSON file MANIFEST. The keys
+should be escaped via URL query escaping if they contain non-ascii
+bytes or spaces.
+
+If <dir> holds the manifest of an interrupted export of the same span,
+the export resumes after its last chunk at its original timestamp,
+which must still be within the GC TTL of the span's zones.
+
+With -export_since, the export is incremental: it holds only the keys
+written or deleted since the previous export of the span in the
+specified directory, which may itself be incremental.
+`,
+	Run:  runExport,
+	Flag: *flag.CommandLine,
+}
+
+// runExport exports the span to the directory from the cluster at
+// kv.Addr.
+func runExport(cmd *commander.Command, args []string) {
+	if len(args) != 3 {
+		cmd.Usage()
+		return
+	}
+	var keys [2]storage.Key
+	for i, arg := range args[1:] {
+		key, err := url.QueryUnescape(arg)
+		if err != nil {
+			log.New("server").Errorf("invalid key %q: %v", arg, err)
+			return
+		}
+		keys[i] = storage.Key(key)
+	}
+
+	opts := client.ExportOptions{ChunkRows: *exportChunkRows}
+	if *exportSince != "" {
+		prev, err := client.ReadExportManifest(*exportSince)
+		if err != nil {
+			log.New("server").Errorf("unable to read previous export: %v", err)
+			return
+		}
+		if !prev.Complete {
+			log.New("server").Errorf("previous export in %s is incomplete", *exportSince)
+			return
+		}
+		if !bytes.Equal(prev.StartKey, keys[0]) || !bytes.Equal(prev.EndKey, keys[1]) {
+			log.New("server").Errorf("previous export in %s is of [%q, %q)", *exportSince, prev.StartKey, prev.EndKey)
+			return
+		}
+		opts.MinTimestamp = prev.Timestamp
+	}
+
+	db := client.NewHTTPDB(kv.HTTPAddr(), nil)
+	defer db.Close()
+	start := time.Now()
+	opts.Progress = func(m *client.ExportManifest) {
+		chunk := m.Chunks[len(m.Chunks)-1]
+		log.New("server").Infof("exported chunk %s of %d rows up to %q in %s", chunk.Name, chunk.Rows, chunk.EndKey, time.Since(start))
+	}
+	manifest, err := client.Export(client.NewKV(db), args[0], keys[0], keys[1], opts)
+	if err != nil {
+		log.New("server").Errorf("export failed: %v", err)
+		return
+	}
+	var rows int64
+	for _, chunk := range manifest.Chunks {
+		rows += chunk.Rows
+	}
+	log.New("server").Infof("exported %d rows in %d chunks as of %+v in %s", rows, len(manifest.Chunks), manifest.Timestamp, time.Since(start))
+}
@@ -0,0 +1,361 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// An opKind is the kind of a client operation recorded in a history.
+type opKind int
+
+const (
+	opRead      opKind = iota // Reads the value of a register or counter
+	opWrite                   // Writes the value of a register
+	opCAS                     // Swaps a register's value if it has an expected value
+	opIncrement               // Increments a counter
+)
+
+var opKindNames = map[opKind]string{
+	opRead:      "read",
+	opWrite:     "write",
+	opCAS:       "cas",
+	opIncrement: "increment",
+}
+
+// An operation is a client operation on a single key, recorded in a
+// history with the logical times at which it was invoked and at which
+// its result was returned to the client. An operation whose result is
+// unknown, because it failed or timed out, may or may not have taken
+// effect; it's recorded as never having completed.
+type operation struct {
+	client   int
+	kind     opKind
+	key      string
+	arg      int64 // Value written or expected by a CAS; counter increment
+	swap     int64 // New value of a CAS
+	result   int64 // Value read or found by a failed CAS; incremented counter value
+	swapped  bool  // Whether a CAS swapped the value
+	known    bool  // Whether the result is known
+	invoke   int64 // Logical time of invocation
+	complete int64 // Logical time of completion; math.MaxInt64 if unknown
+}
+
+func (op *operation) String() string {
+	var s string
+	switch op.kind {
+	case opRead:
+		s = fmt.Sprintf("read()=%d", op.result)
+	case opWrite:
+		s = fmt.Sprintf("write(%d)", op.arg)
+	case opCAS:
+		s = fmt.Sprintf("cas(%d, %d)=%t", op.arg, op.swap, op.swapped)
+		if op.known && !op.swapped {
+			s += fmt.Sprintf(" found %d", op.result)
+		}
+	case opIncrement:
+		s = fmt.Sprintf("increment(%d)=%d", op.arg, op.result)
+	}
+	if !op.known {
+		return fmt.Sprintf("client %d %s [%d, ?]", op.client, s, op.invoke)
+	}
+	return fmt.Sprintf("client %d %s [%d, %d]", op.client, s, op.invoke, op.complete)
+}
+
+// A history records the operations of concurrent clients. Operations
+// are timestamped from a logical clock which ticks on each invocation
+// and completion, so the real-time order of operations as observed by
+// the clients is preserved.
+type history struct {
+	mu  sync.Mutex
+	now int64
+	ops []*operation
+}
+
+// invoke records the invocation of op.
+func (h *history) invoke(op *operation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.now++
+	op.invoke = h.now
+	op.complete = math.MaxInt64
+	h.ops = append(h.ops, op)
+}
+
+// complete records that op's result, which must have been set on op,
+// was returned to the client. Operations which aren't completed are
+// left with unknown results.
+func (h *history) complete(op *operation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.now++
+	op.complete = h.now
+	op.known = true
+}
+
+// operations returns a copy of the operations recorded so far.
+func (h *history) operations() []operation {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ops := make([]operation, len(h.ops))
+	for i, op := range h.ops {
+		ops[i] = *op
+	}
+	return ops
+}
+
+// A model is the sequential specification of an object against which
+// a history of concurrent operations on the object is checked. The
+// state of all the models is a single integer.
+type model interface {
+	// step applies op to the object in state and returns the new
+	// state. If op has a known result which is inconsistent with
+	// state, ok is false. Operations with unknown results may be
+	// applied to any state.
+	step(state int64, op *operation) (next int64, ok bool)
+}
+
+// registerModel specifies a register supporting reads, writes and
+// CAS. A register is initially zero.
+type registerModel struct{}
+
+func (registerModel) step(state int64, op *operation) (int64, bool) {
+	switch op.kind {
+	case opRead:
+		return state, !op.known || op.result == state
+	case opWrite:
+		return op.arg, true
+	case opCAS:
+		if !op.known {
+			if state == op.arg {
+				return op.swap, true
+			}
+			return state, true
+		}
+		if op.swapped {
+			return op.swap, state == op.arg
+		}
+		return state, state != op.arg && op.result == state
+	}
+	return state, false
+}
+
+// counterModel specifies a counter supporting reads and increments,
+// each of which returns the counter's value. A counter is initially
+// zero.
+type counterModel struct{}
+
+func (counterModel) step(state int64, op *operation) (int64, bool) {
+	switch op.kind {
+	case opRead:
+		return state, !op.known || op.result == state
+	case opIncrement:
+		return state + op.arg, !op.known || op.result == state+op.arg
+	}
+	return state, false
+}
+
+// checkLinearizable verifies that a history of operations is
+// linearizable with respect to model: that each operation appears to
+// take effect atomically at some point between its invocation and
+// completion, with the results the clients observed. Operations with
+// unknown results may take effect at any point after their invocation
+// or not at all. Since linearizability is compositional, the
+// operations on each key are checked independently.
+func checkLinearizable(ops []operation, m model) error {
+	byKey := map[string][]*operation{}
+	var keys []string
+	for i := range ops {
+		op := &ops[i]
+		if _, ok := byKey[op.key]; !ok {
+			keys = append(keys, op.key)
+		}
+		byKey[op.key] = append(byKey[op.key], op)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !linearizable(byKey[key], m) {
+			var buf bytes.Buffer
+			for _, op := range byKey[key] {
+				fmt.Fprintf(&buf, "\n  %s", op)
+			}
+			return fmt.Errorf("history of key %q is not linearizable:%s", key, buf.String())
+		}
+	}
+	return nil
+}
+
+// linearizable searches for a linearization of the operations on a
+// single object, using the algorithm of Wing and Gong with the
+// memoization of Lowe ("Testing for Linearizability", 2016). The
+// next operation of a linearization may be any operation which was
+// invoked before every other remaining operation completed. Searched
+// combinations of linearized operations and object state are cached,
+// which bounds the search for histories with limited concurrency.
+func linearizable(ops []*operation, m model) bool {
+	sort.Sort(byInvoke(ops))
+	linearized := make([]bool, len(ops))
+	var required int // Operations with known results must be linearized
+	for _, op := range ops {
+		if op.known {
+			required++
+		}
+	}
+	visited := map[string]struct{}{}
+	var search func(state int64, required int) bool
+	search = func(state int64, required int) bool {
+		if required == 0 {
+			return true
+		}
+		var cache bytes.Buffer
+		for _, l := range linearized {
+			if l {
+				cache.WriteByte(1)
+			} else {
+				cache.WriteByte(0)
+			}
+		}
+		fmt.Fprintf(&cache, "%d", state)
+		if _, ok := visited[cache.String()]; ok {
+			return false
+		}
+		visited[cache.String()] = struct{}{}
+
+		deadline := int64(math.MaxInt64)
+		for i, op := range ops {
+			if !linearized[i] && op.complete < deadline {
+				deadline = op.complete
+			}
+		}
+		for i, op := range ops {
+			if op.invoke > deadline {
+				break
+			}
+			if linearized[i] {
+				continue
+			}
+			next, ok := m.step(state, op)
+			if !ok {
+				continue
+			}
+			linearized[i] = true
+			remaining := required
+			if op.known {
+				remaining--
+			}
+			if search(next, remaining) {
+				return true
+			}
+			linearized[i] = false
+		}
+		return false
+	}
+	return search(0, required)
+}
+
+// byInvoke sorts operations by invocation time.
+type byInvoke []*operation
+
+func (o byInvoke) Len() int           { return len(o) }
+func (o byInvoke) Less(i, j int) bool { return o[i].invoke < o[j].invoke }
+func (o byInvoke) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+
+// TestCheckLinearizable verifies the linearizability checker against
+// hand-constructed histories of register and counter operations.
+func TestCheckLinearizable(t *testing.T) {
+	unknown := int64(math.MaxInt64)
+	read := func(invoke, complete, result int64) operation {
+		return operation{kind: opRead, invoke: invoke, complete: complete, result: result, known: complete != unknown}
+	}
+	write := func(invoke, complete, value int64) operation {
+		return operation{kind: opWrite, invoke: invoke, complete: complete, arg: value, known: complete != unknown}
+	}
+	cas := func(invoke, complete, exp, swap int64, swapped bool, result int64) operation {
+		return operation{kind: opCAS, invoke: invoke, complete: complete, arg: exp, swap: swap,
+			swapped: swapped, result: result, known: complete != unknown}
+	}
+	incr := func(invoke, complete, inc, result int64) operation {
+		return operation{kind: opIncrement, invoke: invoke, complete: complete, arg: inc, result: result,
+			known: complete != unknown}
+	}
+
+	testCases := []struct {
+		ops          []operation
+		m            model
+		linearizable bool
+	}{
+		// Sequential register operations.
+		{[]operation{read(1, 2, 0), write(3, 4, 1), read(5, 6, 1)}, registerModel{}, true},
+		// A read which misses a completed write.
+		{[]operation{write(1, 2, 1), read(3, 4, 0)}, registerModel{}, false},
+		// A read concurrent with a write may observe either value...
+		{[]operation{write(1, 4, 1), read(2, 3, 0)}, registerModel{}, true},
+		{[]operation{write(1, 4, 1), read(2, 3, 1)}, registerModel{}, true},
+		// ...but once a read observes the new value, later reads must too.
+		{[]operation{write(1, 6, 1), read(2, 3, 1), read(4, 5, 0)}, registerModel{}, false},
+		// A read of a value which was never written.
+		{[]operation{write(1, 2, 1), read(3, 4, 2)}, registerModel{}, false},
+		// Writes with unknown results may or may not take effect, but not
+		// before they're invoked.
+		{[]operation{write(1, unknown, 1), read(2, 3, 1), read(4, 5, 1)}, registerModel{}, true},
+		{[]operation{write(1, unknown, 1), read(2, 3, 0), read(4, 5, 0)}, registerModel{}, true},
+		{[]operation{read(1, 2, 1), write(3, unknown, 1)}, registerModel{}, false},
+		// An unknown write can't take effect twice.
+		{[]operation{write(1, unknown, 1), read(2, 3, 1), write(4, 5, 2), read(6, 7, 1)}, registerModel{}, false},
+		// CAS swaps only if the expected value is found.
+		{[]operation{write(1, 2, 1), cas(3, 4, 1, 2, true, 0), read(5, 6, 2)}, registerModel{}, true},
+		{[]operation{write(1, 2, 1), cas(3, 4, 0, 2, true, 0)}, registerModel{}, false},
+		{[]operation{write(1, 2, 1), cas(3, 4, 0, 2, false, 1), read(5, 6, 1)}, registerModel{}, true},
+		{[]operation{write(1, 2, 1), cas(3, 4, 1, 2, false, 1)}, registerModel{}, false},
+		// Two concurrent CAS from the same value can't both succeed.
+		{[]operation{cas(1, 4, 0, 1, true, 0), cas(2, 3, 0, 2, true, 0)}, registerModel{}, false},
+		{[]operation{cas(1, 4, 0, 1, true, 0), cas(2, 3, 0, 2, false, 1)}, registerModel{}, true},
+		// Counter increments return the incremented value.
+		{[]operation{incr(1, 2, 1, 1), incr(3, 4, 2, 3), read(5, 6, 3)}, counterModel{}, true},
+		{[]operation{incr(1, 4, 1, 3), incr(2, 3, 2, 2)}, counterModel{}, true},
+		// A lost increment.
+		{[]operation{incr(1, 2, 1, 1), incr(3, 4, 1, 1)}, counterModel{}, false},
+		// An increment applied twice.
+		{[]operation{incr(1, 2, 1, 1), read(3, 4, 2)}, counterModel{}, false},
+		// Increments with unknown results.
+		{[]operation{incr(1, unknown, 5, 0), read(2, 3, 0), incr(4, 5, 1, 6)}, counterModel{}, true},
+		{[]operation{incr(1, unknown, 5, 0), read(2, 3, 5), incr(4, 5, 1, 1)}, counterModel{}, false},
+	}
+	for i, test := range testCases {
+		for j := range test.ops {
+			test.ops[j].key = "a"
+		}
+		if err := checkLinearizable(test.ops, test.m); (err == nil) != test.linearizable {
+			t.Errorf("%d: expected linearizable %t; got %v", i, test.linearizable, err)
+		}
+	}
+
+	// Histories of different keys are checked independently.
+	ops := []operation{write(1, 2, 1), read(3, 4, 0)}
+	ops[0].key, ops[1].key = "a", "b"
+	if err := checkLinearizable(ops, registerModel{}); err != nil {
+		t.Errorf("expected independent keys to be linearizable: %v", err)
+	}
+	ops[1].key = "a"
+	if err := checkLinearizable(ops, registerModel{}); err == nil {
+		t.Error("expected read missing write to the same key not to be linearizable")
+	}
+}
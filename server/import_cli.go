@@ -0,0 +1,138 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"flag"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	commander "code.google.com/p/go-commander"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+var (
+	importDelimiter   = flag.String("import_delimiter", ",", "field delimiter of imported rows")
+	importLines       = flag.Bool("import_lines", false, "import line-delimited rows, split at every delimiter without CSV quoting")
+	importKeyColumn   = flag.Int("import_key_column", 0, "zero-based index of the field holding the key of imported rows")
+	importValueColumn = flag.Int("import_value_column", 1, "zero-based index of the field holding the value of imported rows")
+	importBatchSize   = flag.Int("import_batch_size", 1000, "number of imported rows written per batch")
+	importConcurrency = flag.Int("import_concurrency", 4, "number of batches of imported rows written in parallel")
+)
+
+// importProgressInterval is the minimum interval between progress
+// reports of an import.
+const importProgressInterval = 5 * time.Second
+
+// A CmdImport command imports delimited rows into the KV store.
+var CmdImport = &commander.Command{
+	UsageLine: "import [options] <key-prefix> [<file>...]",
+	Short:     "imports delimited rows into the key-value store",
+	Long: `
+Imports rows from CSV or line-delimited files, or from standard input
+if no files are specified, writing the value of each row at its key
+prefixed with <key-prefix>. The key prefix should be escaped via URL
+query escaping if it contains non-ascii bytes or spaces. Rows are
+written in batches by parallel workers and aren't transactional; on
+error, rows already written remain.
+
+The delimiter, key and value columns, batch size and concurrency are
+set via the -import_* options.
+`,
+	Run:  runImport,
+	Flag: *flag.CommandLine,
+}
+
+// runImport imports the rows of the specified files into the cluster
+// at kv.Addr.
+func runImport(cmd *commander.Command, args []string) {
+	if len(args) < 1 {
+		cmd.Usage()
+		return
+	}
+	prefix, err := url.QueryUnescape(args[0])
+	if err != nil {
+		log.New("server").Errorf("invalid key prefix %q: %v", args[0], err)
+		return
+	}
+	comma, size := utf8.DecodeRuneInString(*importDelimiter)
+	if size == 0 || size != len(*importDelimiter) {
+		log.New("server").Errorf("delimiter must be a single character; got %q", *importDelimiter)
+		return
+	}
+
+	var readers []io.Reader
+	for _, name := range args[1:] {
+		f, err := os.Open(name)
+		if err != nil {
+			log.New("server").Errorf("unable to open %s: %v", name, err)
+			return
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	if len(readers) == 0 {
+		readers = append(readers, os.Stdin)
+	}
+
+	db := client.NewHTTPDB(kv.HTTPAddr(), nil)
+	defer db.Close()
+	start := time.Now()
+	var mu sync.Mutex
+	lastReport := start
+	opts := client.ImportOptions{
+		Comma:       comma,
+		Lines:       *importLines,
+		Prefix:      storage.Key(prefix),
+		KeyColumn:   *importKeyColumn,
+		ValueColumn: *importValueColumn,
+		BatchSize:   *importBatchSize,
+		Concurrency: *importConcurrency,
+	}
+	// Each file is imported separately, so a file's last row needn't
+	// be terminated by a newline.
+	var total client.ImportStats
+	opts.Progress = func(s client.ImportStats) {
+		mu.Lock()
+		defer mu.Unlock()
+		if now := time.Now(); now.Sub(lastReport) >= importProgressInterval {
+			lastReport = now
+			log.New("server").Infof("imported %d rows (%d bytes) in %s", total.Rows+s.Rows, total.Bytes+s.Bytes, now.Sub(start))
+		}
+	}
+	for _, r := range readers {
+		var stats client.ImportStats
+		stats, err = client.Import(client.NewKV(db), r, opts)
+		total.Rows += stats.Rows
+		total.Bytes += stats.Bytes
+		total.Batches += stats.Batches
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		log.New("server").Errorf("import failed after %d rows: %v", total.Rows, err)
+		return
+	}
+	log.New("server").Infof("imported %d rows (%d bytes) in %d batches in %s", total.Rows, total.Bytes, total.Batches, time.Since(start))
+}
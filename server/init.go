@@ -25,7 +25,7 @@ import (
 	commander "code.google.com/p/go-commander"
 	"code.google.com/p/go-uuid/uuid"
 	"github.com/cockroachdb/cockroach/storage"
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 // A CmdInit command initializes a new Cockroach cluster.
@@ -58,21 +58,22 @@ func runInit(cmd *commander.Command, args []string) {
 		return
 	}
 	// Initialize the engine based on the first argument and
-	// then verify it's not in-memory.
-	engines, err := initEngines(args[0])
+	// then verify it's not in-memory. Bootstrapping writes no raft
+	// state, so any raft log engine specified is ignored.
+	engines, _, err := initEngines(args[0])
 	if err != nil {
-		glog.Errorf("Failed to initialize engine %q: %v", args[0], err)
+		log.New("server").Errorf("Failed to initialize engine %q: %v", args[0], err)
 		return
 	}
 	engine := engines[0]
 	if _, ok := engine.(*storage.InMem); ok {
-		glog.Errorf("Cannot initialize a cluster using an in-memory store")
+		log.New("server").Errorf("Cannot initialize a cluster using an in-memory store")
 		return
 	}
 	// Generate a new UUID for cluster ID and bootstrap the cluster.
 	clusterID := uuid.New()
 	if _, err := BootstrapCluster(clusterID, engine); err != nil {
-		glog.Errorf("Failed to bootstrap cluster: %v", err)
+		log.New("server").Errorf("Failed to bootstrap cluster: %v", err)
 		return
 	}
 	fmt.Fprintf(os.Stdout, "Cockroach cluster %s has been initialized\n", clusterID)
@@ -0,0 +1,623 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/hlc"
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+const (
+	// clusterGossipInterval is an aggressive gossip interval so that
+	// the nodes of a localCluster learn of each other quickly.
+	clusterGossipInterval = 10 * time.Millisecond
+	// clusterWaitTimeout bounds the time the invariant checks of a
+	// localCluster wait for the cluster to recover.
+	clusterWaitTimeout = 10 * time.Second
+	// clusterMaxOffset is the maximum clock offset tolerated by the
+	// nodes of a localCluster.
+	clusterMaxOffset = 250 * time.Millisecond
+	// clusterClientTimeout bounds the time clients of a localCluster
+	// wait for the result of an operation, after which its result is
+	// unknown.
+	clusterClientTimeout = time.Second
+)
+
+// A clusterNode is a member of a localCluster. The node keeps its
+// address, clock and engines across restarts; its server, gossip
+// instance, database and node are nil while it's down.
+type clusterNode struct {
+	addr    net.Addr
+	clock   *hlc.SkewedClock
+	engines []storage.Engine
+	server  *rpc.Server
+	gossip  *gossip.Gossip
+	db      *kv.DistDB
+	node    *Node
+}
+
+// A localCluster is an in-process cluster of nodes for acceptance
+// tests. Each node has its own RPC server, gossip instance, KV
+// database and in-memory engine; the first node's engine is
+// bootstrapped with the cluster's first range. Nodes may be killed
+// and restarted, as though their processes crashed and came back up
+// with their data intact, and may be partitioned from the rest of the
+// cluster. Each node's clock may be skewed. Once the cluster has
+// recovered, verify checks that no acknowledged writes were lost and
+// that the nodes have converged.
+type localCluster struct {
+	t     *testing.T
+	mu    sync.Mutex // Protects the fields of nodes
+	nodes []*clusterNode
+}
+
+// newLocalCluster starts a cluster of size nodes, each with a single
+// store, and waits for all the stores to be bootstrapped.
+func newLocalCluster(size int, t *testing.T) *localCluster {
+	var engines [][]storage.Engine
+	for i := 0; i < size; i++ {
+		engine := storage.NewInMem(storage.Attributes{}, 1<<26)
+		if i == 0 {
+			if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+				t.Fatal(err)
+			}
+		}
+		engines = append(engines, []storage.Engine{engine})
+	}
+	return startLocalCluster(engines, t)
+}
+
+// startLocalCluster starts a cluster with a node per element of
+// engines, on new addresses and with unskewed clocks.
+func startLocalCluster(engines [][]storage.Engine, t *testing.T) *localCluster {
+	c := &localCluster{t: t}
+	for i := range engines {
+		c.nodes = append(c.nodes, &clusterNode{
+			addr:    util.CreateTestAddr("tcp"),
+			clock:   hlc.NewSkewedClock(hlc.UnixNano),
+			engines: engines[i],
+		})
+		c.restart(i)
+	}
+	return c
+}
+
+// A clusterCheckpoint is a copy of the engines of a localCluster's
+// nodes, holding the data of their stores and their ranges' raft
+// state. Any number of clusters may be restored from a checkpoint,
+// so that an expensive fixture, such as a bootstrapped cluster with
+// splits, may be set up once and reused by several tests.
+type clusterCheckpoint struct {
+	engines [][]*storage.InMem // Engines by node
+}
+
+// checkpoint copies the engines of the cluster's nodes, which must
+// all be down (see stop) so that the copies are consistent with each
+// other.
+func (c *localCluster) checkpoint() *clusterCheckpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cp := &clusterCheckpoint{}
+	for i, n := range c.nodes {
+		if n.node != nil {
+			c.t.Fatalf("node %d must be down to checkpoint the cluster", i)
+		}
+		var engines []*storage.InMem
+		for _, e := range n.engines {
+			in, ok := e.(*storage.InMem)
+			if !ok {
+				c.t.Fatalf("node %d: unable to checkpoint engine %s", i, e)
+			}
+			engines = append(engines, in.Clone())
+		}
+		cp.engines = append(cp.engines, engines)
+	}
+	return cp
+}
+
+// restoreLocalCluster starts a cluster on copies of the checkpoint's
+// engines, leaving the checkpoint unchanged for further restores.
+func restoreLocalCluster(cp *clusterCheckpoint, t *testing.T) *localCluster {
+	var engines [][]storage.Engine
+	for _, nodeEngines := range cp.engines {
+		var copies []storage.Engine
+		for _, in := range nodeEngines {
+			copies = append(copies, in.Clone())
+		}
+		engines = append(engines, copies)
+	}
+	return startLocalCluster(engines, t)
+}
+
+// restart starts node i, which must be down, on the address and
+// engines it had before, and waits until its stores are running.
+func (c *localCluster) restart(i int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.nodes[i]
+	n.server = rpc.NewServer(n.addr)
+	n.server.SetClock(n.clock.UnixNano)
+	if err := n.server.Start(); err != nil {
+		c.t.Fatal(err)
+	}
+	// Resolve the port picked on the node's first start.
+	n.addr = n.server.Addr()
+
+	// Bootstrap gossip from the other nodes, so that the node can join
+	// as long as any of them is up. The first node also bootstraps
+	// from itself, as it holds the first range.
+	var bootstrap []net.Addr
+	for j, other := range c.nodes {
+		if j != i || i == 0 {
+			bootstrap = append(bootstrap, other.addr)
+		}
+	}
+	n.gossip = gossip.New()
+	n.gossip.SetInterval(clusterGossipInterval)
+	n.gossip.SetBootstrap(bootstrap)
+	n.gossip.Start(n.server)
+	n.db = kv.NewDB(n.gossip)
+	n.node = NewNode(n.db, n.gossip)
+	n.node.clock = hlc.NewHLClock(n.clock.UnixNano)
+	n.node.clock.SetMaxDrift(uint(clusterMaxOffset))
+	if err := n.node.start(n.server, n.engines, nil); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := util.IsTrueWithin(func() bool {
+		return n.node.getStoreCount() == len(n.engines)
+	}, clusterWaitTimeout); err != nil {
+		c.t.Fatalf("node %d: stores not started: %v", i, err)
+	}
+}
+
+// kill stops node i abruptly, as though its process had crashed: its
+// RPC server and connections are closed, its gossip instance is
+// stopped and its stores are closed without transferring their
+// leader leases. The node's engines are kept for restart.
+func (c *localCluster) kill(i int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.nodes[i]
+	n.server.Close()
+	n.gossip.Stop()
+	n.node.stopper.Stop()
+	n.node.mu.RLock()
+	for _, store := range n.node.storeMap {
+		store.Close()
+	}
+	n.node.mu.RUnlock()
+	n.db.Close()
+	n.server, n.gossip, n.db, n.node = nil, nil, nil, nil
+}
+
+// partition cuts node i off from the RPCs sent to it by the cluster,
+// or heals the partition if partitioned is false. Since RPC clients
+// are shared by all the nodes in the process, the partition only
+// affects the node's inbound traffic.
+func (c *localCluster) partition(i int, partitioned bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nodes[i].server.Partition(partitioned)
+}
+
+// skew sets the offset of node i's clock from the physical clock.
+func (c *localCluster) skew(i int, skew time.Duration) {
+	c.nodes[i].clock.SetSkew(skew)
+}
+
+// stop kills all the nodes which are up.
+func (c *localCluster) stop() {
+	for i := range c.nodes {
+		if c.live(i) {
+			c.kill(i)
+		}
+	}
+}
+
+// live returns whether node i is up.
+func (c *localCluster) live(i int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nodes[i].node != nil
+}
+
+// db returns the KV database of node i, or nil if the node is down.
+func (c *localCluster) db(i int) kv.DB {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nodes[i].db == nil {
+		return nil
+	}
+	return c.nodes[i].db
+}
+
+// randomDB returns the KV database of a randomly chosen node which
+// is up, or nil if all nodes are down.
+func (c *localCluster) randomDB() kv.DB {
+	for _, i := range rand.Perm(len(c.nodes)) {
+		if db := c.db(i); db != nil {
+			return db
+		}
+	}
+	return nil
+}
+
+// An ackLog records the writes acknowledged to clients of a cluster.
+type ackLog struct {
+	sync.Mutex
+	writes map[string][]byte // Acknowledged values by key
+}
+
+func newAckLog() *ackLog {
+	return &ackLog{writes: map[string][]byte{}}
+}
+
+func (l *ackLog) add(key string, value []byte) {
+	l.Lock()
+	defer l.Unlock()
+	l.writes[key] = value
+}
+
+func (l *ackLog) len() int {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.writes)
+}
+
+// waitForProgress waits until more writes are acknowledged than the
+// current count, failing the test if the cluster doesn't recover its
+// availability in time.
+func (l *ackLog) waitForProgress(t *testing.T) {
+	count := l.len()
+	if err := util.IsTrueWithin(func() bool { return l.len() > count }, clusterWaitTimeout); err != nil {
+		t.Fatalf("no writes acknowledged beyond %d: %v", count, err)
+	}
+}
+
+// startWriters starts count writers, each of which puts unique keys
+// under prefix through randomly chosen live nodes, recording the
+// writes which are acknowledged, until stopper is closed. Writes which
+// fail or are still pending when a writer is stopped may or may not
+// have been applied. The returned WaitGroup is done once all writers
+// have returned.
+func (c *localCluster) startWriters(count int, prefix string, acked *ackLog,
+	stopper <-chan struct{}) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for w := 0; w < count; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for seq := 0; ; seq++ {
+				select {
+				case <-stopper:
+					return
+				default:
+				}
+				db := c.randomDB()
+				if db == nil {
+					time.Sleep(10 * time.Millisecond)
+					continue
+				}
+				key := fmt.Sprintf("%s-%d-%05d", prefix, w, seq)
+				value := []byte(fmt.Sprintf("value-%d-%d", w, seq))
+				reply := <-db.Put(&storage.PutRequest{Key: storage.Key(key), Value: storage.Value{Bytes: value}})
+				if reply.Error == nil {
+					acked.add(key, value)
+				}
+			}
+		}(w)
+	}
+	return &wg
+}
+
+// registerOp returns a random register operation by client on one
+// of a few keys under prefix: a read, a write of a value unique to
+// the client, or a CAS from the last value the client observed.
+// Written values are nonzero, so that an absent key reads as zero.
+func registerOp(r *rand.Rand, prefix string, client, seq int, last map[string]int64) *operation {
+	op := &operation{client: client, key: fmt.Sprintf("%s-%d", prefix, r.Intn(3))}
+	value := int64(client)<<32 | int64(seq+1)
+	switch r.Intn(3) {
+	case 0:
+		op.kind = opRead
+	case 1:
+		op.kind, op.arg = opWrite, value
+	case 2:
+		op.kind, op.arg, op.swap = opCAS, last[op.key], value
+	}
+	return op
+}
+
+// counterOp returns a random increment by client of one of a few
+// counter keys under prefix. Increments of zero read the counter.
+func counterOp(r *rand.Rand, prefix string, client, seq int, last map[string]int64) *operation {
+	return &operation{
+		client: client,
+		kind:   opIncrement,
+		key:    fmt.Sprintf("%s-%d", prefix, r.Intn(2)),
+		arg:    int64(r.Intn(4)),
+	}
+}
+
+// startClients starts count clients, each of which performs random
+// operations returned by newOp on keys under prefix through randomly
+// chosen live nodes, recording them in h, until stopper is closed.
+// The returned WaitGroup is done once all clients have returned.
+func (c *localCluster) startClients(count int, prefix string, h *history, stopper <-chan struct{},
+	newOp func(r *rand.Rand, prefix string, client, seq int, last map[string]int64) *operation) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for client := 0; client < count; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(client)))
+			last := map[string]int64{} // Last value observed by key
+			for seq := 0; ; seq++ {
+				select {
+				case <-stopper:
+					return
+				default:
+				}
+				db := c.randomDB()
+				if db == nil {
+					time.Sleep(10 * time.Millisecond)
+					continue
+				}
+				op := newOp(r, prefix, client, seq, last)
+				h.invoke(op)
+				if !perform(db, op) {
+					continue
+				}
+				h.complete(op)
+				switch {
+				case op.kind == opWrite:
+					last[op.key] = op.arg
+				case op.swapped:
+					last[op.key] = op.swap
+				default:
+					last[op.key] = op.result
+				}
+			}
+		}(client)
+	}
+	return &wg
+}
+
+// perform performs op through db, setting its result, and returns
+// whether the result is known. Operations which fail, other than CAS
+// whose condition failed, or which time out have unknown results.
+func perform(db kv.DB, op *operation) bool {
+	key := storage.Key(op.key)
+	var header *storage.ResponseHeader
+	var reply interface{}
+	select {
+	case reply = <-performAsync(db, op, key):
+	case <-time.After(clusterClientTimeout):
+		return false
+	}
+	switch r := reply.(type) {
+	case *storage.GetResponse:
+		header = &r.ResponseHeader
+		op.result = decodeRegister(r.Value.Bytes)
+	case *storage.PutResponse:
+		header = &r.ResponseHeader
+	case *storage.ConditionalPutResponse:
+		header = &r.ResponseHeader
+		if _, ok := r.Error.(*storage.ConditionFailedError); ok {
+			if r.ActualValue != nil {
+				op.result = decodeRegister(r.ActualValue.Bytes)
+			}
+			return true
+		}
+		op.swapped = true
+	case *storage.IncrementResponse:
+		header = &r.ResponseHeader
+		op.result = r.NewValue
+	}
+	return header.Error == nil
+}
+
+// performAsync sends op through db, returning a channel for its reply.
+func performAsync(db kv.DB, op *operation, key storage.Key) <-chan interface{} {
+	ch := make(chan interface{}, 1)
+	go func() {
+		switch op.kind {
+		case opRead:
+			ch <- <-db.Get(&storage.GetRequest{Key: key})
+		case opWrite:
+			ch <- <-db.Put(&storage.PutRequest{Key: key, Value: storage.Value{Bytes: encodeRegister(op.arg)}})
+		case opCAS:
+			args := &storage.ConditionalPutRequest{Key: key, Value: storage.Value{Bytes: encodeRegister(op.swap)}}
+			if op.arg != 0 {
+				args.ExpValue = &storage.Value{Bytes: encodeRegister(op.arg)}
+			}
+			ch <- <-db.ConditionalPut(args)
+		case opIncrement:
+			ch <- <-db.Increment(&storage.IncrementRequest{Key: key, Increment: op.arg})
+		}
+	}()
+	return ch
+}
+
+// encodeRegister encodes the value of a register.
+func encodeRegister(value int64) []byte {
+	return []byte(strconv.FormatInt(value, 10))
+}
+
+// decodeRegister decodes the value of a register; an absent value is
+// zero.
+func decodeRegister(b []byte) int64 {
+	if len(b) == 0 {
+		return 0
+	}
+	value, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		// Corrupt values are never written, so fail the check.
+		return -1
+	}
+	return value
+}
+
+// verify checks the cluster's invariants once it has recovered from
+// failures: every node must see every other node via gossip, every
+// replica listed by a range's addressing record must exist on its
+// store and agree with the record, and every acknowledged write under
+// prefix must be read back with its value through every live node.
+func (c *localCluster) verify(prefix string, acked *ackLog) {
+	c.verifyMembership()
+	c.verifyReplicas()
+	c.verifyWrites(prefix, acked)
+}
+
+// verifyMembership verifies that every live node sees the address of
+// every other live node via gossip.
+func (c *localCluster) verifyMembership() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, n := range c.nodes {
+		if n.node == nil {
+			continue
+		}
+		for _, other := range c.nodes {
+			if other.node == nil {
+				continue
+			}
+			key := gossip.MakeNodeIDGossipKey(other.node.Descriptor.NodeID)
+			if err := util.IsTrueWithin(func() bool {
+				val, err := n.gossip.GetInfo(key)
+				return err == nil && val.(net.Addr).String() == other.addr.String()
+			}, clusterWaitTimeout); err != nil {
+				c.t.Errorf("node %d doesn't see node %d at %s via gossip",
+					n.node.Descriptor.NodeID, other.node.Descriptor.NodeID, other.addr)
+			}
+		}
+	}
+}
+
+// verifyReplicas verifies that every replica listed by the range
+// addressing records exists on its store with the same start key,
+// end key and replicas as the record.
+//
+// TODO(spencer): also compare the replicas' checksums once ranges
+// replicate their commands via raft; until then, writes are only
+// applied by the leader replica.
+func (c *localCluster) verifyReplicas() {
+	sr := c.scan(0, storage.KeyMeta2Prefix, storage.PrefixEndKey(storage.KeyMeta2Prefix))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var startKey storage.Key
+	for _, kv := range sr.Rows {
+		endKey := kv.Key[len(storage.KeyMeta2Prefix):]
+		desc := storage.RangeDescriptor{}
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value.Bytes)).Decode(&desc); err != nil {
+			c.t.Fatalf("unable to decode range descriptor at %q: %v", kv.Key, err)
+		}
+		if !bytes.Equal(desc.StartKey, startKey) {
+			c.t.Errorf("range ending at %q starts at %q; expected %q", endKey, desc.StartKey, startKey)
+		}
+		startKey = endKey
+		for _, replica := range desc.Replicas {
+			rng, err := c.getRange(replica)
+			if err != nil {
+				c.t.Errorf("replica %+v: %v", replica, err)
+				continue
+			}
+			if !bytes.Equal(rng.Meta.StartKey, desc.StartKey) || !bytes.Equal(rng.Meta.EndKey, endKey) ||
+				!reflect.DeepEqual(rng.Meta.Replicas.Replicas, desc.Replicas) {
+				c.t.Errorf("replica %+v has metadata %+v; expected range [%q, %q) with replicas %+v",
+					replica, rng.Meta, desc.StartKey, endKey, desc.Replicas)
+			}
+		}
+	}
+	if !bytes.Equal(startKey, storage.KeyMax) {
+		c.t.Errorf("range addressing records end at %q; expected %q", startKey, storage.KeyMax)
+	}
+}
+
+// getRange returns the replica's range from the store of its node.
+// Requires that c.mu be held.
+func (c *localCluster) getRange(replica storage.Replica) (*storage.Range, error) {
+	for _, n := range c.nodes {
+		if n.node == nil || n.node.Descriptor.NodeID != replica.NodeID {
+			continue
+		}
+		return n.node.getRange(&replica)
+	}
+	return nil, util.Errorf("node %d isn't live", replica.NodeID)
+}
+
+// verifyWrites verifies that every acknowledged write under prefix
+// is read back with its acknowledged value through every live node,
+// and that all the nodes read back the same writes.
+func (c *localCluster) verifyWrites(prefix string, acked *ackLog) {
+	acked.Lock()
+	defer acked.Unlock()
+	var expected map[string][]byte
+	for i := range c.nodes {
+		if !c.live(i) {
+			continue
+		}
+		sr := c.scan(i, storage.Key(prefix), storage.PrefixEndKey(storage.Key(prefix)))
+		found := map[string][]byte{}
+		for _, kv := range sr.Rows {
+			found[string(kv.Key)] = kv.Value.Bytes
+		}
+		for key, value := range acked.writes {
+			if v, ok := found[key]; !ok {
+				c.t.Errorf("node %d: acknowledged write to %q was lost", i, key)
+			} else if !bytes.Equal(v, value) {
+				c.t.Errorf("node %d: acknowledged write to %q was %q; read %q", i, key, value, v)
+			}
+		}
+		if expected == nil {
+			expected = found
+		} else if !reflect.DeepEqual(found, expected) {
+			c.t.Errorf("node %d read %d writes which differ from the %d read through other nodes",
+				i, len(found), len(expected))
+		}
+	}
+}
+
+// scan scans [start, end) through node i, failing the test if the
+// scan returns an error or the cluster doesn't recover in time.
+func (c *localCluster) scan(i int, start, end storage.Key) *storage.ScanResponse {
+	select {
+	case sr := <-c.db(i).Scan(&storage.ScanRequest{StartKey: start, EndKey: end, MaxResults: math.MaxInt64}):
+		if sr.Error != nil {
+			c.t.Fatalf("node %d: scan of [%q, %q) failed: %v", i, start, end, sr.Error)
+		}
+		return sr
+	case <-time.After(clusterWaitTimeout):
+		c.t.Fatalf("node %d: scan of [%q, %q) timed out", i, start, end)
+	}
+	return nil
+}
@@ -20,16 +20,19 @@ package server
 import (
 	"container/list"
 	"net"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/hlc"
 	"github.com/cockroachdb/cockroach/kv"
 	"github.com/cockroachdb/cockroach/rpc"
 	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/util"
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 const (
@@ -40,8 +43,19 @@ const (
 	gossipInterval = 1 * time.Minute
 	// ttlCapacityGossip is time-to-live for capacity-related info.
 	ttlCapacityGossip = 2 * time.Minute
+	// ttlAcctUsageGossip is time-to-live for accounting usage records.
+	ttlAcctUsageGossip = 2 * time.Minute
 	// ttlNodeIDGossip is time-to-live for node ID -> address.
 	ttlNodeIDGossip = 0 * time.Second
+	// livenessInterval is the interval at which the node heartbeats
+	// its liveness record.
+	livenessInterval = storage.NodeLivenessExpiration / 3
+	// ttlLivenessGossip is time-to-live for liveness records. Records
+	// remain gossiped until their nodes are considered dead.
+	ttlLivenessGossip = storage.NodeLivenessExpiration + storage.NodeDeadTimeout
+	// rangeIDAllocBlockSize is the number of range IDs the node
+	// reserves at a time for splits on its stores.
+	rangeIDAllocBlockSize = 10
 )
 
 // Node manages a map of stores (by store ID) for which it serves traffic.
@@ -49,57 +63,65 @@ type Node struct {
 	ClusterID  string                 // UUID for Cockroach cluster
 	Descriptor storage.NodeDescriptor // Node ID, network/physical topology
 	gossip     *gossip.Gossip         // Nodes gossip cluster ID, node ID -> host:port
+	clock      *hlc.HLClock           // Hybrid logical clock for timestamping commands
 	kvDB       kv.DB                  // Used to access global id generators
-	closer     chan struct{}
+	rangeIDs   *kv.IDAllocator        // Allocates range IDs for the node's stores
+	stopper    *util.Stopper          // Stops the node's gossip worker
 
-	mu       sync.RWMutex             // Protects storeMap during bootstrapping
+	mu       sync.RWMutex             // Protects storeMap and node ID during bootstrapping
 	storeMap map[int32]*storage.Store // Map from StoreID to Store
 
 	maxAvailPrefix string // Prefix for max avail capacity gossip topic
+
+	snapshotLimits  storage.SnapshotLimits  // Snapshot limits of the node's stores
+	fullThreshold   float64                 // Full thresholds of the node's stores
+	admissionLimits storage.AdmissionLimits // Admission limits of the node's stores
+	memory          *util.MemoryBudget      // Root memory budget of the node's stores
+	draining        int32                   // Non-zero once the node is draining; atomic
+	decommission    int32                   // Non-zero once the node is decommissioning; atomic
+
+	// Engines holding the raft logs of the node's stores, keyed by the
+	// stores' engines; stores without one keep raft logs in their own.
+	raftEngines map[storage.Engine]storage.Engine
 }
 
 // allocateNodeID increments the node id generator key to allocate
 // a new, unique node id.
 func allocateNodeID(db kv.DB) (int32, error) {
-	ir := <-db.Increment(&storage.IncrementRequest{
-		Key:       storage.KeyNodeIDGenerator,
-		Increment: 1,
-	})
-	if ir.Error != nil {
-		return 0, util.Errorf("unable to allocate node ID: %v", ir.Error)
+	id, err := kv.Increment(db, storage.KeyNodeIDGenerator, 1)
+	if err != nil {
+		return 0, util.Errorf("unable to allocate node ID: %v", err)
 	}
-	return int32(ir.NewValue), nil
+	return int32(id), nil
 }
 
 // allocateStoreIDs increments the store id generator key for the
 // specified node to allocate "inc" new, unique store ids. The
 // first ID in a contiguous range is returned on success.
 func allocateStoreIDs(nodeID int32, inc int64, db kv.DB) (int32, error) {
-	ir := <-db.Increment(&storage.IncrementRequest{
-		// The Key is a concatenation of StoreIDGeneratorPrefix and this node's ID.
-		Key: storage.MakeKey(storage.KeyStoreIDGeneratorPrefix,
-			[]byte(strconv.Itoa(int(nodeID)))),
-		Increment: inc,
-	})
-	if ir.Error != nil {
-		return 0, util.Errorf("unable to allocate %d store IDs for node %d: %v", inc, nodeID, ir.Error)
+	// The Key is a concatenation of StoreIDGeneratorPrefix and this node's ID.
+	key := storage.MakeKey(storage.KeyStoreIDGeneratorPrefix, []byte(strconv.Itoa(int(nodeID))))
+	id, err := kv.Increment(db, key, inc)
+	if err != nil {
+		return 0, util.Errorf("unable to allocate %d store IDs for node %d: %v", inc, nodeID, err)
 	}
-	return int32(ir.NewValue - inc + 1), nil
+	return int32(id - inc + 1), nil
 }
 
 // BootstrapCluster bootstraps a store using the provided engine and
 // cluster ID. The bootstrapped store contains a single range spanning
 // all keys. Initial range lookup metadata is populated for the range.
 //
-// Returns a direct-access kv.LocalDB for unittest purposes only.
+// Returns a direct-access kv.LocalDB for unittest purposes only. The
+// bootstrap store's range is left running so the LocalDB remains
+// usable.
 func BootstrapCluster(clusterID string, engine storage.Engine) (*kv.LocalDB, error) {
 	sIdent := storage.StoreIdent{
 		ClusterID: clusterID,
 		NodeID:    1,
 		StoreID:   1,
 	}
-	s := storage.NewStore(engine, nil)
-	defer s.Close()
+	s := storage.NewStore(hlc.NewHLClock(hlc.UnixNano), engine, nil, nil)
 
 	// Verify the store isn't already part of a cluster.
 	if s.Ident.ClusterID != "" {
@@ -151,6 +173,12 @@ func BootstrapCluster(clusterID string, engine storage.Engine) (*kv.LocalDB, err
 		return nil, util.Errorf("expected to intialize store id allocator to %d, got %d: %v",
 			sIdent.StoreID, storeID, err)
 	}
+	// Likewise for the range ID generator, which hands out IDs to the
+	// ranges created by splits from here on.
+	if rangeID, err := kv.Increment(localDB, storage.KeyRangeIDGenerator, 1); rangeID != rng.Meta.RangeID || err != nil {
+		return nil, util.Errorf("expected to intialize range id allocator to %d, got %d: %v",
+			rng.Meta.RangeID, rangeID, err)
+	}
 
 	return localDB, nil
 }
@@ -159,11 +187,21 @@ func BootstrapCluster(clusterID string, engine storage.Engine) (*kv.LocalDB, err
 // flags to initialize the appropriate Store or set of
 // Stores. Registers the storage instance for the RPC service "Node".
 func NewNode(kvDB kv.DB, gossip *gossip.Gossip) *Node {
+	rangeIDs, err := kv.NewIDAllocator(storage.KeyRangeIDGenerator, kvDB, rangeIDAllocBlockSize)
+	if err != nil {
+		log.New("server").Fatalf("%v", err)
+	}
 	n := &Node{
-		gossip:   gossip,
-		kvDB:     kvDB,
-		storeMap: make(map[int32]*storage.Store),
-		closer:   make(chan struct{}),
+		clock:           hlc.NewHLClock(hlc.UnixNano),
+		gossip:          gossip,
+		kvDB:            kvDB,
+		rangeIDs:        rangeIDs,
+		storeMap:        make(map[int32]*storage.Store),
+		stopper:         util.NewStopper(),
+		snapshotLimits:  storage.DefaultSnapshotLimits,
+		fullThreshold:   storage.DefaultFullThreshold,
+		admissionLimits: storage.DefaultAdmissionLimits,
+		memory:          util.NewMemoryBudget("node", 0),
 	}
 	return n
 }
@@ -191,21 +229,89 @@ func (n *Node) start(rpcServer *rpc.Server, engines []storage.Engine,
 	if err := n.initStoreMap(engines); err != nil {
 		return err
 	}
-	go n.startGossip()
+	n.stopper.RunWorker(n.startGossip)
 
 	return nil
 }
 
-// stop cleanly stops the node.
+// stop cleanly stops the node. Once the node's gossip worker has
+// exited, leader leases held by the node's stores are transferred to
+// other replicas and the stores are closed.
 func (n *Node) stop() {
-	close(n.closer)
+	n.stopper.Stop()
 	n.mu.RLock()
 	defer n.mu.RUnlock()
 	for _, store := range n.storeMap {
+		store.DrainLeaderLeases()
 		store.Close()
 	}
 }
 
+// Drain drains each of the node's stores (see storage.Store.Drain),
+// moving their replicas off the node if moveReplicas is true, and
+// returns the work remaining summed over all stores. The stores'
+// descriptors are gossiped as draining first, so that other nodes
+// stop allocating replicas to them. Once draining, the node's server
+// rejects client requests.
+func (n *Node) Drain(moveReplicas bool) (storage.DrainProgress, error) {
+	atomic.StoreInt32(&n.draining, 1)
+	n.mu.RLock()
+	for _, store := range n.storeMap {
+		store.SetDraining(true)
+	}
+	n.mu.RUnlock()
+	n.gossipCapacities()
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	var progress storage.DrainProgress
+	for _, store := range n.storeMap {
+		p, err := store.Drain(moveReplicas)
+		progress.Leases += p.Leases
+		progress.Replicas += p.Replicas
+		if err != nil {
+			return progress, err
+		}
+	}
+	return progress, nil
+}
+
+// DrainProgress returns the work remaining to drain the node's stores,
+// summed over all stores.
+func (n *Node) DrainProgress() storage.DrainProgress {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	var progress storage.DrainProgress
+	for _, store := range n.storeMap {
+		p := store.DrainProgress()
+		progress.Leases += p.Leases
+		progress.Replicas += p.Replicas
+	}
+	return progress
+}
+
+// IsDraining returns true once the node has begun draining.
+func (n *Node) IsDraining() bool {
+	return atomic.LoadInt32(&n.draining) != 0
+}
+
+// Decommission marks the node as decommissioning in its liveness
+// record, which is gossiped at once. The repairers of other nodes'
+// stores then move the node's replicas to other nodes, and allocators
+// stop choosing the node's stores for new replicas. Decommissioning
+// can't be undone; it completes once DrainProgress reports no
+// remaining replicas, after which the node may be shut down.
+func (n *Node) Decommission() {
+	atomic.StoreInt32(&n.decommission, 1)
+	n.heartbeatLiveness()
+}
+
+// IsDecommissioning returns true once the node has begun
+// decommissioning.
+func (n *Node) IsDecommissioning() bool {
+	return atomic.LoadInt32(&n.decommission) != 0
+}
+
 // initStoreMap initializes the Stores map from id to Store. Stores are
 // added to the storeMap if the Store is already bootstrapped. A
 // bootstrapped Store has a valid ident with cluster, node and Store
@@ -219,7 +325,15 @@ func (n *Node) initStoreMap(engines []storage.Engine) error {
 	defer n.mu.Unlock()
 
 	for _, engine := range engines {
-		s := storage.NewStore(engine, n.gossip)
+		s := storage.NewStore(n.clock, engine, n.kvDB, n.gossip)
+		s.SetSnapshotLimits(n.snapshotLimits)
+		s.SetFullThreshold(n.fullThreshold)
+		if raftEngine, ok := n.raftEngines[engine]; ok {
+			s.SetRaftEngine(raftEngine)
+		}
+		s.SetAdmissionLimits(n.admissionLimits)
+		s.SetMemoryBudget(n.memory)
+		s.SetRangeIDAllocator(n.rangeIDs)
 		// If not bootstrapped, add to list.
 		if !s.IsBootstrapped() {
 			bootstraps.PushBack(s)
@@ -237,7 +351,7 @@ func (n *Node) initStoreMap(engines []storage.Engine) error {
 			if err != nil {
 				return err
 			}
-			glog.Infof("initialized store %s: %+v", s, capacity)
+			log.New("server").Infof("initialized store %s: %+v", s, capacity)
 			n.storeMap[s.Ident.StoreID] = s
 		}
 	}
@@ -284,20 +398,22 @@ func (n *Node) validateStores() error {
 // allocated via a sequence id generator stored at a system key per
 // node.
 func (n *Node) bootstrapStores(bootstraps *list.List) {
-	glog.Infof("bootstrapping %d store(s)", bootstraps.Len())
+	log.New("server").Infof("bootstrapping %d store(s)", bootstraps.Len())
 
 	// Allocate a new node ID if necessary.
 	if n.Descriptor.NodeID == 0 {
-		var err error
-		n.Descriptor.NodeID, err = allocateNodeID(n.kvDB)
-		glog.Infof("new node allocated ID %d", n.Descriptor.NodeID)
+		nodeID, err := allocateNodeID(n.kvDB)
 		if err != nil {
-			glog.Fatal(err)
+			log.New("server").Fatalf("%v", err)
 		}
+		n.mu.Lock()
+		n.Descriptor.NodeID = nodeID
+		n.mu.Unlock()
+		log.New("server").Infof("new node allocated ID %d", nodeID)
 		// Gossip node address keyed by node ID.
 		nodeIDKey := gossip.MakeNodeIDGossipKey(n.Descriptor.NodeID)
 		if err := n.gossip.AddInfo(nodeIDKey, n.Descriptor.Address, ttlNodeIDGossip); err != nil {
-			glog.Errorf("couldn't gossip address for node %d: %v", n.Descriptor.NodeID, err)
+			log.New("server").Errorf("couldn't gossip address for node %d: %v", n.Descriptor.NodeID, err)
 		}
 	}
 
@@ -306,7 +422,7 @@ func (n *Node) bootstrapStores(bootstraps *list.List) {
 	inc := int64(bootstraps.Len())
 	firstID, err := allocateStoreIDs(n.Descriptor.NodeID, inc, n.kvDB)
 	if err != nil {
-		glog.Fatal(err)
+		log.New("server").Fatalf("%v", err)
 	}
 	sIdent := storage.StoreIdent{
 		ClusterID: n.ClusterID,
@@ -315,13 +431,24 @@ func (n *Node) bootstrapStores(bootstraps *list.List) {
 	}
 	for e := bootstraps.Front(); e != nil; e = e.Next() {
 		s := e.Value.(*storage.Store)
-		s.Bootstrap(sIdent)
+		if err := s.Bootstrap(sIdent); err != nil {
+			log.New("server").Fatalf("unable to bootstrap store %d: %v", sIdent.StoreID, err)
+		}
+		// Initialize the store to start its range scanner and rebalancer.
+		if err := s.Init(); err != nil {
+			log.New("server").Fatalf("unable to initialize bootstrapped store %s: %v", s, err)
+		}
 		n.mu.Lock()
 		n.storeMap[s.Ident.StoreID] = s
 		n.mu.Unlock()
 		sIdent.StoreID++
-		glog.Infof("bootstrapped store %s", s)
+		log.New("server").Infof("bootstrapped store %s", s)
 	}
+
+	// Announce the joining node and its stores without waiting for
+	// the next gossip interval.
+	n.heartbeatLiveness()
+	n.gossipCapacities()
 }
 
 // connectGossip connects to gossip network and reads cluster ID. If
@@ -329,50 +456,84 @@ func (n *Node) bootstrapStores(bootstraps *list.List) {
 // for a match. If not part of a cluster, the cluster ID is set. The
 // node's address is gossipped with node ID as the gossip key.
 func (n *Node) connectGossip() {
-	glog.Infof("connecting to gossip network to verify cluster ID...")
+	log.New("server").Infof("connecting to gossip network to verify cluster ID...")
 	<-n.gossip.Connected
 
 	val, err := n.gossip.GetInfo(gossip.KeyClusterID)
 	if err != nil || val == nil {
-		glog.Fatalf("unable to ascertain cluster ID from gossip network: %v", err)
+		log.New("server").Fatalf("unable to ascertain cluster ID from gossip network: %v", err)
 	}
 	gossipClusterID := val.(string)
 
 	if n.ClusterID == "" {
 		n.ClusterID = gossipClusterID
 	} else if n.ClusterID != gossipClusterID {
-		glog.Fatalf("node %d belongs to cluster %q but is attempting to connect to a gossip network for cluster %q",
+		log.New("server").Fatalf("node %d belongs to cluster %q but is attempting to connect to a gossip network for cluster %q",
 			n.Descriptor.NodeID, n.ClusterID, gossipClusterID)
 	}
-	glog.Infof("node connected via gossip and verified as part of cluster %q", gossipClusterID)
+	log.New("server").Infof("node connected via gossip and verified as part of cluster %q", gossipClusterID)
 
 	// Gossip node address keyed by node ID.
 	if n.Descriptor.NodeID != 0 {
 		nodeIDKey := gossip.MakeNodeIDGossipKey(n.Descriptor.NodeID)
 		if err := n.gossip.AddInfo(nodeIDKey, n.Descriptor.Address, ttlNodeIDGossip); err != nil {
-			glog.Errorf("couldn't gossip address for node %d: %v", n.Descriptor.NodeID, err)
+			log.New("server").Errorf("couldn't gossip address for node %d: %v", n.Descriptor.NodeID, err)
 		}
 	}
 }
 
-// startGossip loops on a periodic ticker to gossip node-related
-// information. Loops until the node is closed and should be
-// invoked via goroutine.
+// startGossip gossips node-related information immediately and then
+// on periodic tickers, so that other nodes' allocators have a current
+// view of the node's stores and its liveness. Loops until the node is
+// stopped and should be run as a worker of the node's stopper.
 func (n *Node) startGossip() {
+	n.gossip.RegisterGroup(gossip.KeyNodeLivenessPrefix, gossipGroupLimit, gossip.MaxGroup)
+	n.gossip.RegisterGroup(gossip.KeyAcctUsagePrefix, gossipGroupLimit, gossip.MaxGroup)
+	n.heartbeatLiveness()
+	n.gossipCapacities()
 	ticker := time.NewTicker(gossipInterval)
+	livenessTicker := time.NewTicker(livenessInterval)
 	for {
 		select {
 		case <-ticker.C:
 			n.gossipCapacities()
-		case <-n.closer:
+			n.gossipAcctUsage()
+			n.persistGossipBootstrap()
+		case <-livenessTicker.C:
+			n.heartbeatLiveness()
+		case <-n.stopper.ShouldStop():
 			ticker.Stop()
+			livenessTicker.Stop()
 			return
 		}
 	}
 }
 
-// gossipCapacities calls capacity on each store and adds it to the
-// gossip network.
+// heartbeatLiveness gossips the node's liveness record, extending its
+// expiration by storage.NodeLivenessExpiration and recording whether
+// the node is decommissioning.
+func (n *Node) heartbeatLiveness() {
+	n.mu.RLock()
+	nodeID := n.Descriptor.NodeID
+	n.mu.RUnlock()
+	if nodeID == 0 {
+		return
+	}
+	l := storage.NodeLiveness{
+		NodeID:          nodeID,
+		Expiration:      time.Now().Add(storage.NodeLivenessExpiration),
+		Decommissioning: n.IsDecommissioning(),
+	}
+	if err := n.gossip.AddInfo(gossip.MakeNodeLivenessKey(l.NodeID), l, ttlLivenessGossip); err != nil {
+		log.New("server").Errorf("couldn't gossip liveness for node %d: %v", l.NodeID, err)
+	}
+}
+
+// gossipCapacities adds the descriptor of each store, including its
+// attributes and capacity, to the gossip network. Descriptors are
+// gossiped in groups by the stores' combined attributes (see
+// gossip.MakeMaxAvailCapacityKey); storage.Store.ClusterCapacity
+// summarizes the descriptors gossiped by all nodes.
 func (n *Node) gossipCapacities() {
 	n.mu.RLock()
 	defer n.mu.RUnlock()
@@ -380,12 +541,12 @@ func (n *Node) gossipCapacities() {
 	for _, store := range n.storeMap {
 		storeDesc, err := store.Descriptor(&n.Descriptor)
 		if err != nil {
-			glog.Warningf("problem getting store descriptor for store %+v: %v", store.Ident, err)
+			log.New("server").Warningf("problem getting store descriptor for store %+v: %v", store.Ident, err)
 			continue
 		}
-		gossipPrefix := gossip.KeyMaxAvailCapacityPrefix + storeDesc.CombinedAttrs().SortedString()
-		keyMaxCapacity := gossipPrefix + strconv.FormatInt(int64(storeDesc.Node.NodeID), 10) + "-" +
-			strconv.FormatInt(int64(storeDesc.StoreID), 10)
+		attrs := storeDesc.CombinedAttrs().SortedString()
+		gossipPrefix := gossip.MakeMaxAvailCapacityGroup(attrs)
+		keyMaxCapacity := gossip.MakeMaxAvailCapacityKey(attrs, storeDesc.Node.NodeID, storeDesc.StoreID)
 		// Register gossip group.
 		n.gossip.RegisterGroup(gossipPrefix, gossipGroupLimit, gossip.MaxGroup)
 		// Gossip store descriptor.
@@ -393,6 +554,51 @@ func (n *Node) gossipCapacities() {
 	}
 }
 
+// gossipAcctUsage adds the accounting usage of each store to the
+// gossip network; storage.GossipedAcctUsage sums the usage gossiped
+// by all nodes.
+func (n *Node) gossipAcctUsage() {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for _, store := range n.storeMap {
+		usage, err := store.AcctUsage()
+		if err != nil {
+			log.New("server").Warningf("problem getting accounting usage for store %+v: %v", store.Ident, err)
+			continue
+		}
+		n.gossip.AddInfo(gossip.MakeAcctUsageKey(usage.NodeID, usage.StoreID), usage, ttlAcctUsageGossip)
+	}
+}
+
+// persistGossipBootstrap writes the addresses of the node's gossip
+// peers to each of its stores, to be added to the gossip bootstrap
+// hosts when the node restarts (see server.addGossipBootstrap).
+// Nothing is written while the node has no peers, so the addresses
+// persisted last remain available for reconnecting.
+func (n *Node) persistGossipBootstrap() {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	seen := map[string]bool{n.Descriptor.Address.String(): true}
+	var addrs []string
+	for _, addr := range append(n.gossip.Outgoing(), n.gossip.Incoming()...) {
+		if !seen[addr.String()] {
+			seen[addr.String()] = true
+			addrs = append(addrs, addr.String())
+		}
+	}
+	if len(addrs) == 0 {
+		return
+	}
+	sort.Strings(addrs)
+	for _, store := range n.storeMap {
+		if err := store.WriteGossipBootstrap(addrs); err != nil {
+			log.New("server").Warningf("unable to persist gossip bootstrap addresses to store %s: %v", store, err)
+		}
+	}
+}
+
 // storeCount returns the number of stores this node is exporting.
 func (n *Node) getStoreCount() int {
 	n.mu.RLock()
@@ -416,125 +622,283 @@ func (n *Node) getRange(r *storage.Replica) (*storage.Range, error) {
 	return rng, nil
 }
 
+// RaftLog returns a window of the raft log of the range with ID
+// rangeID from the first of the node's stores which holds a replica
+// of it. See storage.Store.RaftLog.
+func (n *Node) RaftLog(rangeID int64, first, last int) (*storage.RaftLogWindow, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for _, store := range n.storeMap {
+		if _, err := store.GetRange(rangeID); err == nil {
+			return store.RaftLog(rangeID, first, last)
+		}
+	}
+	return nil, util.Errorf("range %d not found on node", rangeID)
+}
+
+// SubscribeChanges returns subscriptions to the writes committed to
+// keys with prefix by the ranges of each of the node's stores, each
+// buffering up to bufferSize changes; see storage.ChangeFeed. Only
+// ranges whose commands the node executes publish their writes, so a
+// cluster-wide feed subscribes at every node.
+func (n *Node) SubscribeChanges(prefix storage.Key, bufferSize int) []*storage.ChangeFeedSubscription {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	var subs []*storage.ChangeFeedSubscription
+	for _, store := range n.storeMap {
+		subs = append(subs, store.ChangeFeed().Subscribe(prefix, bufferSize))
+	}
+	return subs
+}
+
 // All methods to satisfy the Node RPC service fetch the range
 // based on the Replica target provided in the argument header.
 // Commands are broken down into read-only and read-write and
 // sent along to the range via either Range.readOnlyCmd() or
-// Range.readWriteCmd().
+// Range.readWriteCmd(). Errors are returned in the reply header via
+// replyError.
+
+// replyError sets the error of the reply header to err, unless the
+// command already set it, in a form which may be sent over the wire.
+// Returns nil: errors returned from RPC methods reach clients only
+// as strings and without the reply, so clients couldn't act on
+// errors such as storage.NotLeaderError.
+func replyError(reply storage.Response, err error) error {
+	header := reply.Header()
+	if header.Error == nil {
+		header.Error = err
+	}
+	header.Error = storage.WireError(header.Error)
+	if br, ok := reply.(*storage.BatchResponse); ok {
+		for _, r := range br.Responses {
+			r.Header().Error = storage.WireError(r.Header().Error)
+		}
+	}
+	return nil
+}
 
 // Contains .
 func (n *Node) Contains(args *storage.ContainsRequest, reply *storage.ContainsResponse) error {
 	rng, err := n.getRange(&args.Replica)
 	if err != nil {
-		return err
+		return replyError(reply, err)
 	}
-	return rng.ReadOnlyCmd("Contains", args, reply)
+	return replyError(reply, rng.ReadOnlyCmd("Contains", args, reply))
 }
 
 // Get .
 func (n *Node) Get(args *storage.GetRequest, reply *storage.GetResponse) error {
 	rng, err := n.getRange(&args.Replica)
 	if err != nil {
-		return err
+		return replyError(reply, err)
 	}
-	return rng.ReadOnlyCmd("Get", args, reply)
+	return replyError(reply, rng.ReadOnlyCmd("Get", args, reply))
 }
 
 // Put .
 func (n *Node) Put(args *storage.PutRequest, reply *storage.PutResponse) error {
 	rng, err := n.getRange(&args.Replica)
 	if err != nil {
-		return err
+		return replyError(reply, err)
 	}
-	return <-rng.ReadWriteCmd("Put", args, reply)
+	return replyError(reply, <-rng.ReadWriteCmd("Put", args, reply))
+}
+
+// ConditionalPut .
+func (n *Node) ConditionalPut(args *storage.ConditionalPutRequest, reply *storage.ConditionalPutResponse) error {
+	rng, err := n.getRange(&args.Replica)
+	if err != nil {
+		return replyError(reply, err)
+	}
+	return replyError(reply, <-rng.ReadWriteCmd("ConditionalPut", args, reply))
 }
 
 // Increment .
 func (n *Node) Increment(args *storage.IncrementRequest, reply *storage.IncrementResponse) error {
 	rng, err := n.getRange(&args.Replica)
 	if err != nil {
-		return err
+		return replyError(reply, err)
 	}
-	return <-rng.ReadWriteCmd("Increment", args, reply)
+	return replyError(reply, <-rng.ReadWriteCmd("Increment", args, reply))
 }
 
 // Delete .
 func (n *Node) Delete(args *storage.DeleteRequest, reply *storage.DeleteResponse) error {
 	rng, err := n.getRange(&args.Replica)
 	if err != nil {
-		return err
+		return replyError(reply, err)
 	}
-	return <-rng.ReadWriteCmd("Delete", args, reply)
+	return replyError(reply, <-rng.ReadWriteCmd("Delete", args, reply))
 }
 
 // DeleteRange .
 func (n *Node) DeleteRange(args *storage.DeleteRangeRequest, reply *storage.DeleteRangeResponse) error {
 	rng, err := n.getRange(&args.Replica)
 	if err != nil {
-		return err
+		return replyError(reply, err)
 	}
-	return <-rng.ReadWriteCmd("DeleteRange", args, reply)
+	return replyError(reply, <-rng.ReadWriteCmd("DeleteRange", args, reply))
 }
 
 // Scan .
 func (n *Node) Scan(args *storage.ScanRequest, reply *storage.ScanResponse) error {
 	rng, err := n.getRange(&args.Replica)
 	if err != nil {
-		return err
+		return replyError(reply, err)
+	}
+	return replyError(reply, rng.ReadOnlyCmd("Scan", args, reply))
+}
+
+// ReverseScan .
+func (n *Node) ReverseScan(args *storage.ReverseScanRequest, reply *storage.ReverseScanResponse) error {
+	rng, err := n.getRange(&args.Replica)
+	if err != nil {
+		return replyError(reply, err)
 	}
-	return rng.ReadOnlyCmd("Scan", args, reply)
+	return replyError(reply, rng.ReadOnlyCmd("ReverseScan", args, reply))
 }
 
 // EndTransaction .
 func (n *Node) EndTransaction(args *storage.EndTransactionRequest, reply *storage.EndTransactionResponse) error {
 	rng, err := n.getRange(&args.Replica)
 	if err != nil {
-		return err
+		return replyError(reply, err)
 	}
-	return <-rng.ReadWriteCmd("EndTransaction", args, reply)
+	return replyError(reply, <-rng.ReadWriteCmd("EndTransaction", args, reply))
+}
+
+// Batch .
+func (n *Node) Batch(args *storage.BatchRequest, reply *storage.BatchResponse) error {
+	rng, err := n.getRange(&args.Replica)
+	if err != nil {
+		return replyError(reply, err)
+	}
+	return replyError(reply, <-rng.ReadWriteCmd("Batch", args, reply))
+}
+
+// AdminSplit is not a replicated command; it's invoked directly on
+// the range.
+func (n *Node) AdminSplit(args *storage.AdminSplitRequest, reply *storage.AdminSplitResponse) error {
+	rng, err := n.getRange(&args.Replica)
+	if err != nil {
+		return replyError(reply, err)
+	}
+	rng.AdminSplit(args, reply)
+	return replyError(reply, reply.Error)
+}
+
+// AdminMerge is not a replicated command; it's invoked directly on
+// the range.
+func (n *Node) AdminMerge(args *storage.AdminMergeRequest, reply *storage.AdminMergeResponse) error {
+	rng, err := n.getRange(&args.Replica)
+	if err != nil {
+		return replyError(reply, err)
+	}
+	rng.AdminMerge(args, reply)
+	return replyError(reply, reply.Error)
 }
 
 // AccumulateTS .
 func (n *Node) AccumulateTS(args *storage.AccumulateTSRequest, reply *storage.AccumulateTSResponse) error {
 	rng, err := n.getRange(&args.Replica)
 	if err != nil {
-		return err
+		return replyError(reply, err)
 	}
-	return <-rng.ReadWriteCmd("AccumulateTS", args, reply)
+	return replyError(reply, <-rng.ReadWriteCmd("AccumulateTS", args, reply))
 }
 
 // ReapQueue .
 func (n *Node) ReapQueue(args *storage.ReapQueueRequest, reply *storage.ReapQueueResponse) error {
 	rng, err := n.getRange(&args.Replica)
 	if err != nil {
-		return err
+		return replyError(reply, err)
 	}
-	return <-rng.ReadWriteCmd("ReapQueue", args, reply)
+	return replyError(reply, <-rng.ReadWriteCmd("ReapQueue", args, reply))
 }
 
 // EnqueueUpdate .
 func (n *Node) EnqueueUpdate(args *storage.EnqueueUpdateRequest, reply *storage.EnqueueUpdateResponse) error {
 	rng, err := n.getRange(&args.Replica)
 	if err != nil {
-		return err
+		return replyError(reply, err)
 	}
-	return <-rng.ReadWriteCmd("EnqueueUpdate", args, reply)
+	return replyError(reply, <-rng.ReadWriteCmd("EnqueueUpdate", args, reply))
 }
 
 // EnqueueMessage .
 func (n *Node) EnqueueMessage(args *storage.EnqueueMessageRequest, reply *storage.EnqueueMessageResponse) error {
 	rng, err := n.getRange(&args.Replica)
 	if err != nil {
-		return err
+		return replyError(reply, err)
 	}
-	return <-rng.ReadWriteCmd("EnqueueMessage", args, reply)
+	return replyError(reply, <-rng.ReadWriteCmd("EnqueueMessage", args, reply))
 }
 
 // InternalRangeLookup .
 func (n *Node) InternalRangeLookup(args *storage.InternalRangeLookupRequest, reply *storage.InternalRangeLookupResponse) error {
 	rng, err := n.getRange(&args.Replica)
 	if err != nil {
-		return err
+		return replyError(reply, err)
+	}
+	return replyError(reply, rng.ReadOnlyCmd("InternalRangeLookup", args, reply))
+}
+
+// InternalPushTxn .
+func (n *Node) InternalPushTxn(args *storage.InternalPushTxnRequest, reply *storage.InternalPushTxnResponse) error {
+	rng, err := n.getRange(&args.Replica)
+	if err != nil {
+		return replyError(reply, err)
+	}
+	return replyError(reply, <-rng.ReadWriteCmd("InternalPushTxn", args, reply))
+}
+
+// InternalResolveIntent .
+func (n *Node) InternalResolveIntent(args *storage.InternalResolveIntentRequest, reply *storage.InternalResolveIntentResponse) error {
+	rng, err := n.getRange(&args.Replica)
+	if err != nil {
+		return replyError(reply, err)
+	}
+	return replyError(reply, <-rng.ReadWriteCmd("InternalResolveIntent", args, reply))
+}
+
+// InternalHeartbeatTxn .
+func (n *Node) InternalHeartbeatTxn(args *storage.InternalHeartbeatTxnRequest, reply *storage.InternalHeartbeatTxnResponse) error {
+	rng, err := n.getRange(&args.Replica)
+	if err != nil {
+		return replyError(reply, err)
+	}
+	return replyError(reply, <-rng.ReadWriteCmd("InternalHeartbeatTxn", args, reply))
+}
+
+// InternalSnapshot instantiates the replica specified in the header
+// from the snapshot on the replica's store.
+func (n *Node) InternalSnapshot(args *storage.InternalSnapshotRequest, reply *storage.InternalSnapshotResponse) error {
+	n.mu.RLock()
+	store, ok := n.storeMap[args.Replica.StoreID]
+	n.mu.RUnlock()
+	if !ok {
+		reply.Error = util.Errorf("store for replica %+v not found", args.Replica)
+	} else {
+		reply.Error = store.ApplySnapshot(&args.Snapshot)
+	}
+	return replyError(reply, reply.Error)
+}
+
+// InternalChecksum computes the checksum of the range's data on the
+// replica specified in the header.
+func (n *Node) InternalChecksum(args *storage.InternalChecksumRequest, reply *storage.InternalChecksumResponse) error {
+	n.mu.RLock()
+	store, ok := n.storeMap[args.Replica.StoreID]
+	n.mu.RUnlock()
+	if !ok {
+		reply.Error = util.Errorf("store for replica %+v not found", args.Replica)
+		return replyError(reply, reply.Error)
+	}
+	rng, err := store.GetRange(args.Replica.RangeID)
+	if err != nil {
+		reply.Error = err
+		return replyError(reply, err)
 	}
-	return rng.ReadOnlyCmd("InternalRangeLookup", args, reply)
+	rng.InternalChecksum(args, reply)
+	return replyError(reply, reply.Error)
 }
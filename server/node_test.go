@@ -19,10 +19,15 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"math"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -31,6 +36,7 @@ import (
 	"github.com/cockroachdb/cockroach/rpc"
 	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/metrics"
 )
 
 // createTestNode creates an rpc server using the specified address,
@@ -39,11 +45,21 @@ import (
 // nil, the gossip bootstrap address is set to gossipBS.
 func createTestNode(addr net.Addr, engines []storage.Engine, gossipBS net.Addr, t *testing.T) (
 	*rpc.Server, *Node) {
+	return createTestNodeWithGossipInterval(addr, engines, gossipBS, 0, t)
+}
+
+// createTestNodeWithGossipInterval is like createTestNode, but sets
+// the gossip interval of the node to interval if it's non-zero.
+func createTestNodeWithGossipInterval(addr net.Addr, engines []storage.Engine, gossipBS net.Addr,
+	interval time.Duration, t *testing.T) (*rpc.Server, *Node) {
 	rpcServer := rpc.NewServer(addr)
 	if err := rpcServer.Start(); err != nil {
 		t.Fatal(err)
 	}
 	g := gossip.New()
+	if interval != 0 {
+		g.SetInterval(interval)
+	}
 	if gossipBS != nil {
 		// Handle possibility of a :0 port specification.
 		if gossipBS == addr {
@@ -90,14 +106,12 @@ func TestBootstrapCluster(t *testing.T) {
 		keys = append(keys, kv.Key)
 	}
 	var expectedKeys = []storage.Key{
-		storage.Key("\x00\x00\x00range-1"),
-		storage.Key("\x00\x00\x00range-id-generator"),
-		storage.Key("\x00\x00\x00store-ident"),
 		storage.Key("\x00\x00meta1\xff"),
 		storage.Key("\x00\x00meta2\xff"),
 		storage.Key("\x00acct"),
 		storage.Key("\x00node-id-generator"),
 		storage.Key("\x00perm"),
+		storage.Key("\x00range-id-generator"),
 		storage.Key("\x00store-id-generator-1"),
 		storage.Key("\x00zone"),
 	}
@@ -177,4 +191,587 @@ func TestNodeJoin(t *testing.T) {
 	}, 50*time.Millisecond); err != nil {
 		t.Error(err)
 	}
+
+	// Verify node1 sees node2 as live and counts its store towards
+	// the cluster's capacity.
+	node1.mu.RLock()
+	store1 := node1.storeMap[1]
+	node1.mu.RUnlock()
+	if err := util.IsTrueWithin(func() bool {
+		ls, err := storage.GossipedLiveness(node1.gossip)
+		if err != nil {
+			return false
+		}
+		live := false
+		for _, l := range ls {
+			if l.NodeID == node2.Descriptor.NodeID && l.Status(time.Now()) == storage.NodeLive {
+				live = true
+			}
+		}
+		if !live {
+			return false
+		}
+		cc, err := store1.ClusterCapacity()
+		return err == nil && cc.StoreCount == 2
+	}, 50*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestNodePersistGossipBootstrap verifies that a node persists the
+// addresses of its gossip peers to its stores.
+func TestNodePersistGossipBootstrap(t *testing.T) {
+	engine := storage.NewInMem(storage.Attributes{}, 1<<20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	interval := 10 * time.Millisecond
+	addr1 := util.CreateTestAddr("tcp")
+	server1, _ := createTestNodeWithGossipInterval(addr1, []storage.Engine{engine}, addr1, interval, t)
+	defer server1.Close()
+	engine2 := storage.NewInMem(storage.Attributes{}, 1<<20)
+	server2, node2 := createTestNodeWithGossipInterval(util.CreateTestAddr("tcp"), []storage.Engine{engine2},
+		server1.Addr(), interval, t)
+	defer server2.Close()
+	if err := util.IsTrueWithin(func() bool { return node2.getStoreCount() == 1 }, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	node2.persistGossipBootstrap()
+	addrs, err := storage.ReadGossipBootstrap(engine2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != server1.Addr().String() {
+		t.Errorf("expected persisted address %s; got %v", server1.Addr(), addrs)
+	}
+}
+
+// TestNodeGossipsStoreCapacity verifies that a node gossips the
+// capacity of its stores upon starting, so that it's immediately
+// reflected in the cluster capacity seen by the stores' allocators.
+func TestNodeGossipsStoreCapacity(t *testing.T) {
+	engine := storage.NewInMem(storage.Attributes{}, 1<<20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+
+	node.mu.RLock()
+	store := node.storeMap[1]
+	node.mu.RUnlock()
+	if store == nil {
+		t.Fatal("expected store 1 on node")
+	}
+	if err := util.IsTrueWithin(func() bool {
+		cc, err := store.ClusterCapacity()
+		return err == nil && cc.StoreCount == 1 && cc.Capacity == 1<<20
+	}, 50*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestNodeRaftLog verifies that the admin server serves windows of
+// the raft logs of the node's ranges.
+func TestNodeRaftLog(t *testing.T) {
+	engine := storage.NewInMem(storage.Attributes{}, 1<<20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+	if _, err := node.RaftLog(2, 0, 0); err == nil {
+		t.Error("expected error for range not on node")
+	}
+
+	admin := newAdminServer(nil, nil, node)
+	testCases := []struct {
+		path    string
+		expCode int
+	}{
+		{raftLogPrefix + "1", http.StatusOK},
+		{raftLogPrefix + "1?first=1&last=10", http.StatusOK},
+		{raftLogPrefix + "1?last=-1", http.StatusBadRequest},
+		{raftLogPrefix + "x", http.StatusBadRequest},
+		{raftLogPrefix + "2", http.StatusNotFound},
+	}
+	for i, test := range testCases {
+		w := httptest.NewRecorder()
+		admin.handleRaftLog(w, &http.Request{Method: "GET", URL: &url.URL{Path: strings.Split(test.path, "?")[0],
+			RawQuery: strings.TrimPrefix(test.path, strings.Split(test.path, "?")[0]+"?")}})
+		if w.Code != test.expCode {
+			t.Errorf("%d: expected status %d; got %d: %s", i, test.expCode, w.Code, w.Body)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		window := &storage.RaftLogWindow{}
+		if err := json.Unmarshal(w.Body.Bytes(), window); err != nil {
+			t.Errorf("%d: %v", i, err)
+		} else if window.RangeID != 1 || window.FirstIndex != 1 {
+			t.Errorf("%d: unexpected window %+v", i, window)
+		}
+	}
+}
+
+// TestNodeDrain verifies that the admin server drains the node and
+// reports its drain status.
+func TestNodeDrain(t *testing.T) {
+	engine := storage.NewInMem(storage.Attributes{}, 1<<20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+
+	admin := newAdminServer(nil, nil, node)
+	drain := func(method, query string, expCode int) drainStatus {
+		w := httptest.NewRecorder()
+		admin.handleDrain(w, &http.Request{Method: method, URL: &url.URL{Path: drainPath, RawQuery: query}})
+		var status drainStatus
+		if w.Code != expCode {
+			t.Fatalf("%s %s: expected status %d; got %d: %s", method, query, expCode, w.Code, w.Body)
+		} else if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return status
+	}
+	if status := drain("GET", "", http.StatusOK); status.Draining || status.Replicas != 1 {
+		t.Errorf("expected node with one replica not to be draining; got %+v", status)
+	}
+	drain("POST", "replicas=maybe", http.StatusBadRequest)
+	if node.IsDraining() {
+		t.Error("expected invalid drain request not to drain node")
+	}
+	// The only range has no other replicas, so it can't be drained.
+	if status := drain("POST", "replicas=true", http.StatusOK); !status.Draining || status.Replicas != 1 {
+		t.Errorf("expected node to be draining with one replica remaining; got %+v", status)
+	}
+	node.mu.RLock()
+	defer node.mu.RUnlock()
+	for _, store := range node.storeMap {
+		if !store.IsDraining() {
+			t.Errorf("expected store %s to be draining", store)
+		}
+	}
+}
+
+// TestNodeDecommission verifies that the admin server marks the node
+// as decommissioning in its gossiped liveness record and reports the
+// replicas remaining on the node.
+func TestNodeDecommission(t *testing.T) {
+	engine := storage.NewInMem(storage.Attributes{}, 1<<20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+
+	admin := newAdminServer(nil, nil, node)
+	decommission := func(method string) decommissionStatus {
+		w := httptest.NewRecorder()
+		admin.handleDecommission(w, &http.Request{Method: method, URL: &url.URL{Path: decommissionPath}})
+		var status decommissionStatus
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d; got %d: %s", method, http.StatusOK, w.Code, w.Body)
+		} else if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+	if status := decommission("GET"); status.Decommissioning || status.Replicas != 1 {
+		t.Errorf("expected node not to be decommissioning; got %+v", status)
+	}
+	if status := decommission("POST"); !status.Decommissioning || status.Replicas != 1 {
+		t.Errorf("expected node to be decommissioning with one replica remaining; got %+v", status)
+	}
+	if err := util.IsTrueWithin(func() bool {
+		info, err := node.gossip.GetInfo(gossip.MakeNodeLivenessKey(node.Descriptor.NodeID))
+		return err == nil && info.(storage.NodeLiveness).Decommissioning
+	}, 50*time.Millisecond); err != nil {
+		t.Errorf("expected gossiped liveness to be decommissioning: %v", err)
+	}
+}
+
+// TestNodeChanges verifies that the admin server streams the writes
+// committed to keys with the requested prefix by the node's ranges.
+func TestNodeChanges(t *testing.T) {
+	engine := storage.NewInMem(storage.Attributes{}, 1<<20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+
+	admin := newAdminServer(nil, nil, node)
+	httpServer := httptest.NewServer(http.HandlerFunc(admin.handleChanges))
+	defer httpServer.Close()
+	resp, err := http.Get(httpServer.URL + changesPath + "?prefix=feed-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var rng *storage.Range
+	for _, store := range node.storeMap {
+		rng = store.LookupRangeByKey(storage.Key("feed-"))
+	}
+	for _, key := range []string{"feed-a", "other", "feed-b"} {
+		args := &storage.PutRequest{Key: storage.Key(key), Value: storage.Value{Bytes: []byte("v")}}
+		if err := <-rng.ReadWriteCmd("Put", args, &storage.PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-rng.ReadWriteCmd("Delete", &storage.DeleteRequest{Key: storage.Key("feed-a")},
+		&storage.DeleteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for i, exp := range []changeRecord{
+		{Key: []byte("feed-a"), Value: []byte("v")},
+		{Key: []byte("feed-b"), Value: []byte("v")},
+		{Key: []byte("feed-a"), Deleted: true},
+	} {
+		var rec changeRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !bytes.Equal(rec.Key, exp.Key) || !bytes.Equal(rec.Value, exp.Value) || rec.Deleted != exp.Deleted ||
+			rec.Timestamp.WallTime == 0 {
+			t.Errorf("%d: expected %+v; got %+v", i, exp, rec)
+		}
+	}
+}
+
+// TestDistDBBatchAcrossRanges verifies that a batch spanning ranges
+// is split by range and that errors are returned in replies with
+// their types intact.
+func TestDistDBBatchAcrossRanges(t *testing.T) {
+	db := startServer().kvDB
+	if reply := <-db.AdminSplit(&storage.AdminSplitRequest{
+		Key:      storage.Key("m"),
+		SplitKey: storage.Key("m"),
+	}); reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+
+	args := &storage.BatchRequest{}
+	for _, key := range []string{"batch-a", "z-batch", "batch-b"} {
+		args.Requests = append(args.Requests, &storage.PutRequest{Key: storage.Key(key), Value: storage.Value{Bytes: []byte(key)}})
+	}
+	reply := <-db.Batch(args)
+	if reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	if len(reply.Responses) != len(args.Requests) {
+		t.Fatalf("expected %d responses; got %d", len(args.Requests), len(reply.Responses))
+	}
+	for _, key := range []string{"batch-a", "z-batch", "batch-b"} {
+		gr := <-db.Get(&storage.GetRequest{Key: storage.Key(key)})
+		if gr.Error != nil {
+			t.Fatal(gr.Error)
+		}
+		if string(gr.Value.Bytes) != key {
+			t.Errorf("expected value %q at key %q; got %+v", key, key, gr.Value)
+		}
+	}
+
+	cr := <-db.ConditionalPut(&storage.ConditionalPutRequest{
+		Key:      storage.Key("z-batch"),
+		Value:    storage.Value{Bytes: []byte("new")},
+		ExpValue: &storage.Value{Bytes: []byte("other")},
+	})
+	if _, ok := cr.Error.(*storage.ConditionFailedError); !ok {
+		t.Errorf("expected condition failed error; got %T: %v", cr.Error, cr.Error)
+	}
+}
+
+// TestDistDBSpansAcrossRanges verifies that scans and range deletions
+// spanning ranges, alone and within batches, are split at range
+// boundaries and their results merged in key order.
+func TestDistDBSpansAcrossRanges(t *testing.T) {
+	db := startServer().kvDB
+	for _, splitKey := range []string{"span-p", "span-f"} {
+		if reply := <-db.AdminSplit(&storage.AdminSplitRequest{
+			Key:      storage.Key(splitKey),
+			SplitKey: storage.Key(splitKey),
+		}); reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+	keys := []string{"span-a", "span-e", "span-f", "span-k", "span-p", "span-z"}
+	for _, key := range keys {
+		if reply := <-db.Put(&storage.PutRequest{Key: storage.Key(key), Value: storage.Value{Bytes: []byte(key)}}); reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+	scanKeys := func(rows []storage.KeyValue) []string {
+		var result []string
+		for _, row := range rows {
+			result = append(result, string(row.Key))
+		}
+		return result
+	}
+
+	sr := <-db.Scan(&storage.ScanRequest{StartKey: storage.Key("span-"), EndKey: storage.Key("span-~")})
+	if sr.Error != nil {
+		t.Fatal(sr.Error)
+	}
+	if result := scanKeys(sr.Rows); !reflect.DeepEqual(result, keys) || sr.ResumeKey != nil {
+		t.Errorf("expected keys %v; got %v, resume key %q", keys, result, sr.ResumeKey)
+	}
+	sr = <-db.Scan(&storage.ScanRequest{StartKey: storage.Key("span-b"), EndKey: storage.Key("span-~"), MaxResults: 3})
+	if sr.Error != nil {
+		t.Fatal(sr.Error)
+	}
+	if result := scanKeys(sr.Rows); !reflect.DeepEqual(result, keys[1:4]) {
+		t.Errorf("expected keys %v; got %v", keys[1:4], result)
+	}
+
+	br := <-db.Batch(&storage.BatchRequest{Requests: []storage.Request{
+		&storage.ScanRequest{StartKey: storage.Key("span-"), EndKey: storage.Key("span-q")},
+		&storage.DeleteRangeRequest{StartKey: storage.Key("span-b"), EndKey: storage.Key("span-q")},
+		&storage.ScanRequest{StartKey: storage.Key("span-"), EndKey: storage.Key("span-~")},
+	}})
+	if br.Error != nil {
+		t.Fatal(br.Error)
+	}
+	if result := scanKeys(br.Responses[0].(*storage.ScanResponse).Rows); !reflect.DeepEqual(result, keys[:5]) {
+		t.Errorf("expected keys %v; got %v", keys[:5], result)
+	}
+	if n := br.Responses[1].(*storage.DeleteRangeResponse).NumDeleted; n != 4 {
+		t.Errorf("expected 4 keys deleted; got %d", n)
+	}
+	if result, expected := scanKeys(br.Responses[2].(*storage.ScanResponse).Rows), []string{"span-a", "span-z"}; !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected keys %v; got %v", expected, result)
+	}
+
+	dr := <-db.DeleteRange(&storage.DeleteRangeRequest{StartKey: storage.Key("span-"), EndKey: storage.Key("span-~")})
+	if dr.Error != nil {
+		t.Fatal(dr.Error)
+	}
+	if dr.NumDeleted != 2 || dr.ResumeKey != nil {
+		t.Errorf("expected 2 keys deleted; got %d, resume key %q", dr.NumDeleted, dr.ResumeKey)
+	}
+}
+
+// TestDistDBBatchConcurrentRuns verifies that the runs of a batch
+// addressing distinct ranges are sent concurrently, while those of a
+// batch addressing a range more than once are sent in order.
+func TestDistDBBatchConcurrentRuns(t *testing.T) {
+	db := startServer().kvDB
+	if reply := <-db.AdminSplit(&storage.AdminSplitRequest{
+		Key:      storage.Key("par-m"),
+		SplitKey: storage.Key("par-m"),
+	}); reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	parallelRuns := metrics.DefaultRegistry.Counter("kv_batch_parallel_runs")
+	put := func(key, value string) storage.Request {
+		return &storage.PutRequest{Key: storage.Key(key), Value: storage.Value{Bytes: []byte(value)}}
+	}
+
+	// Refresh any range descriptors cached before the split.
+	for _, key := range []string{"par-a", "par-z"} {
+		if reply := <-db.Put(put(key, key).(*storage.PutRequest)); reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+
+	count := parallelRuns.Count()
+	reply := <-db.Batch(&storage.BatchRequest{Requests: []storage.Request{
+		put("par-a", "a"), put("par-b", "b"), put("par-z", "z"),
+	}})
+	if reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	if len(reply.Responses) != 3 {
+		t.Fatalf("expected 3 responses; got %d", len(reply.Responses))
+	}
+	if n := parallelRuns.Count() - count; n != 2 {
+		t.Errorf("expected 2 runs sent concurrently; got %d", n)
+	}
+
+	// The second write to "par-a" must follow the first.
+	count = parallelRuns.Count()
+	reply = <-db.Batch(&storage.BatchRequest{Requests: []storage.Request{
+		put("par-a", "first"), put("par-z", "z"), put("par-a", "second"),
+	}})
+	if reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	if n := parallelRuns.Count() - count; n != 0 {
+		t.Errorf("expected no runs sent concurrently; got %d", n)
+	}
+	gr := <-db.Get(&storage.GetRequest{Key: storage.Key("par-a")})
+	if gr.Error != nil {
+		t.Fatal(gr.Error)
+	}
+	if string(gr.Value.Bytes) != "second" {
+		t.Errorf("expected value \"second\"; got %q", gr.Value.Bytes)
+	}
+}
+
+// TestDistDBScanSplitMidScan verifies that a scan paged with resume
+// keys returns each row once and in key order, and honors its limits
+// across ranges, while the ranges it spans are split between pages.
+// Reverse scans of the split ranges return the rows in reverse.
+func TestDistDBScanSplitMidScan(t *testing.T) {
+	db := startServer().kvDB
+	var keys []string
+	for i := 0; i < 26; i++ {
+		key := fmt.Sprintf("page-%c", 'a'+i)
+		keys = append(keys, key)
+		if reply := <-db.Put(&storage.PutRequest{Key: storage.Key(key), Value: storage.Value{Bytes: []byte("v")}}); reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+
+	splitKeys := []string{"page-x", "page-q", "page-j", "page-d"}
+	var result []string
+	startKey := storage.Key("page-")
+	for page := 0; ; page++ {
+		sr := <-db.Scan(&storage.ScanRequest{StartKey: startKey, EndKey: storage.Key("page-~"), MaxResults: 5})
+		if sr.Error != nil {
+			t.Fatal(sr.Error)
+		}
+		for _, row := range sr.Rows {
+			result = append(result, string(row.Key))
+		}
+		if sr.ResumeKey == nil {
+			break
+		}
+		startKey = sr.ResumeKey
+		// Split the ranges ahead of the scan, invalidating cached
+		// descriptors.
+		if page < len(splitKeys) {
+			if reply := <-db.AdminSplit(&storage.AdminSplitRequest{
+				Key:      storage.Key(splitKeys[page]),
+				SplitKey: storage.Key(splitKeys[page]),
+			}); reply.Error != nil {
+				t.Fatal(reply.Error)
+			}
+		}
+	}
+	if !reflect.DeepEqual(result, keys) {
+		t.Errorf("expected keys %v; got %v", keys, result)
+	}
+
+	// Limits apply to the rows of all ranges scanned: each row's key
+	// and value total 7 bytes.
+	sr := <-db.Scan(&storage.ScanRequest{StartKey: storage.Key("page-b"), EndKey: storage.Key("page-~"), MaxBytes: 7 * 10})
+	if sr.Error != nil {
+		t.Fatal(sr.Error)
+	}
+	if len(sr.Rows) != 10 || string(sr.Rows[9].Key) != "page-k" || !bytes.Equal(sr.ResumeKey, storage.Key("page-k\x00")) {
+		t.Errorf("expected 10 rows through \"page-k\" with resume key \"page-k\\x00\"; got %d rows with resume key %q",
+			len(sr.Rows), sr.ResumeKey)
+	}
+	sr = <-db.Scan(&storage.ScanRequest{StartKey: storage.Key("page-w"), EndKey: storage.Key("page-~"), MaxResults: 4})
+	if sr.Error != nil {
+		t.Fatal(sr.Error)
+	}
+	if len(sr.Rows) != 4 || !bytes.Equal(sr.ResumeKey, storage.Key("page-z\x00")) {
+		t.Errorf("expected 4 rows through \"page-z\" with resume key \"page-z\\x00\"; got %d rows with resume key %q",
+			len(sr.Rows), sr.ResumeKey)
+	}
+
+	// Reverse scans visit the ranges in descending order, starting
+	// with the range ending at the end key if it's a split key.
+	rsr := <-db.ReverseScan(&storage.ReverseScanRequest{StartKey: storage.Key("page-"), EndKey: storage.Key("page-~")})
+	if rsr.Error != nil {
+		t.Fatal(rsr.Error)
+	}
+	result = nil
+	for _, row := range rsr.Rows {
+		result = append([]string{string(row.Key)}, result...)
+	}
+	if !reflect.DeepEqual(result, keys) || rsr.ResumeKey != nil {
+		t.Errorf("expected keys %v in reverse; got %v with resume key %q", keys, result, rsr.ResumeKey)
+	}
+	rsr = <-db.ReverseScan(&storage.ReverseScanRequest{StartKey: storage.Key("page-"), EndKey: storage.Key("page-j"), MaxResults: 3})
+	if rsr.Error != nil {
+		t.Fatal(rsr.Error)
+	}
+	if len(rsr.Rows) != 3 || string(rsr.Rows[0].Key) != "page-i" || !bytes.Equal(rsr.ResumeKey, storage.Key("page-g")) {
+		t.Errorf("expected 3 rows from \"page-i\" with resume key \"page-g\"; got %d rows with resume key %q",
+			len(rsr.Rows), rsr.ResumeKey)
+	}
+}
+
+// TestDistDBTrace verifies that traced requests sent via DistDB
+// return the executing range and replica, the number of attempts and
+// the time spent in each phase.
+func TestDistDBTrace(t *testing.T) {
+	db := startServer().kvDB
+	header := storage.RequestHeader{Trace: true}
+	if reply := <-db.Put(&storage.PutRequest{RequestHeader: header, Key: storage.Key("trace"), Value: storage.Value{Bytes: []byte("v")}}); reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	reply := <-db.Get(&storage.GetRequest{RequestHeader: header, Key: storage.Key("trace")})
+	if reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	trace := reply.Trace
+	if trace == nil {
+		t.Fatal("expected trace")
+	}
+	if trace.RangeID == 0 || trace.Replica.NodeID == 0 || trace.Leader == nil || trace.Attempts != 1 {
+		t.Errorf("unexpected trace: %s", trace)
+	}
+	var phases []string
+	for _, phase := range trace.Phases {
+		phases = append(phases, phase.Name)
+	}
+	if expected := []string{storage.TraceExecute, storage.TraceLookup, storage.TraceRPC}; !reflect.DeepEqual(phases, expected) {
+		t.Errorf("expected phases %v; got %v", expected, phases)
+	}
+}
+
+// TestDistDBSlowRequests verifies that requests over the slow request
+// threshold are collected with traces of the full write path, whether
+// or not they asked for a trace, and are listed by the admin server.
+func TestDistDBSlowRequests(t *testing.T) {
+	db := startServer().kvDB
+	defer storage.SlowRequests.SetThreshold(storage.SlowRequests.Threshold())
+	storage.SlowRequests.SetThreshold(time.Nanosecond)
+
+	key := storage.Key(fmt.Sprintf("slow-%d", time.Now().UnixNano()))
+	reply := <-db.Put(&storage.PutRequest{Key: key, Value: storage.Value{Bytes: []byte("v")}})
+	if reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	if reply.Trace != nil {
+		t.Errorf("expected no trace in reply; got %s", reply.Trace)
+	}
+	requests := storage.SlowRequests.Requests()
+	if len(requests) == 0 {
+		t.Fatal("expected slow request to be collected")
+	}
+	sr := requests[len(requests)-1]
+	var phases []string
+	for _, phase := range sr.Trace.Phases {
+		phases = append(phases, phase.Name)
+	}
+	expected := []string{storage.TraceLease, storage.TracePropose, storage.TraceApply,
+		storage.TraceExecute, storage.TraceLookup, storage.TraceRPC}
+	if sr.Method != "Node.Put" || !reflect.DeepEqual(phases, expected) {
+		t.Errorf("expected Node.Put with phases %v; got %s", expected, sr)
+	}
+
+	w := httptest.NewRecorder()
+	startServer().admin.handleTraces(w, nil)
+	if body := w.Body.String(); !strings.Contains(body, "requests slower than 1ns") || !strings.Contains(body, sr.String()) {
+		t.Errorf("expected slow request in traces; got %q", body)
+	}
 }
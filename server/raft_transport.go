@@ -0,0 +1,200 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"net"
+	netrpc "net/rpc"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/multiraft"
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// raftTransport is a multiraft.Transport which serves raft RPCs via
+// the node's RPC server and sends them to the addresses nodes gossip
+// (see gossip.MakeNodeIDGossipKey), so no static map of node
+// addresses is needed and nodes may restart at new addresses. Stores
+// don't yet replicate their ranges via multiraft, so the transport is
+// only exercised by its tests until a MultiRaft is created per node.
+type raftTransport struct {
+	rpcServer *rpc.Server
+	resolver  *nodeAddrResolver
+
+	mu         sync.Mutex
+	registered bool // True once the RPC service is registered
+	servers    map[multiraft.NodeID]multiraft.ServerInterface
+}
+
+// newRaftTransport returns a raft transport serving RPCs via
+// rpcServer and resolving node addresses via g.
+func newRaftTransport(g *gossip.Gossip, rpcServer *rpc.Server) *raftTransport {
+	return &raftTransport{
+		rpcServer: rpcServer,
+		resolver:  newNodeAddrResolver(g),
+		servers:   map[multiraft.NodeID]multiraft.ServerInterface{},
+	}
+}
+
+// Listen implements multiraft.Transport. RPCs are dispatched to
+// servers by their destination node, so the local stores of a node
+// may all listen via the same RPC server.
+func (t *raftTransport) Listen(id multiraft.NodeID, server multiraft.ServerInterface) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.registered {
+		if err := t.rpcServer.RegisterName("MultiRaft", multiraft.NewRPCAdapter(t)); err != nil {
+			return err
+		}
+		t.registered = true
+	}
+	t.servers[id] = server
+	return nil
+}
+
+// Stop implements multiraft.Transport.
+func (t *raftTransport) Stop(id multiraft.NodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.servers, id)
+}
+
+// Connect implements multiraft.Transport. The node's address is
+// resolved anew for each RPC, so the returned client follows the node
+// to new addresses.
+func (t *raftTransport) Connect(id multiraft.NodeID) (multiraft.ClientInterface, error) {
+	return &raftClient{nodeID: id, resolver: t.resolver}, nil
+}
+
+// DoRPC implements multiraft.ServerInterface, passing RPCs to the
+// server listening as their destination node.
+func (t *raftTransport) DoRPC(name string, req, resp interface{}) error {
+	var dest multiraft.NodeID
+	switch req := req.(type) {
+	case *multiraft.RequestVoteRequest:
+		dest = req.DestNode
+	case *multiraft.AppendEntriesRequest:
+		dest = req.DestNode
+	default:
+		return util.Errorf("unexpected raft request %T", req)
+	}
+	t.mu.Lock()
+	server, ok := t.servers[dest]
+	t.mu.Unlock()
+	if !ok {
+		return util.Errorf("raft node %d is not listening", dest)
+	}
+	return server.DoRPC(name, req, resp)
+}
+
+// raftClient sends raft RPCs to the current address of a node via the
+// process-wide cache of RPC clients.
+type raftClient struct {
+	nodeID   multiraft.NodeID
+	resolver *nodeAddrResolver
+}
+
+// Go implements multiraft.ClientInterface. It never blocks: if the
+// node's address is unknown or its client isn't connected yet, the
+// call completes immediately with an error and raft retries it.
+func (c *raftClient) Go(serviceMethod string, args interface{}, reply interface{}, done chan *netrpc.Call) *netrpc.Call {
+	if done == nil {
+		done = make(chan *netrpc.Call, 1)
+	}
+	call := &netrpc.Call{ServiceMethod: serviceMethod, Args: args, Reply: reply, Done: done}
+	addr, err := c.resolver.resolve(c.nodeID)
+	if err != nil {
+		call.Error = err
+		done <- call
+		return call
+	}
+	client := rpc.NewClient(addr, nil)
+	select {
+	case <-client.Closed:
+		call.Error = util.Errorf("connection to raft node %d at %s closed", c.nodeID, addr)
+	case <-client.Ready:
+		return client.Go(serviceMethod, args, reply, done)
+	default:
+		call.Error = util.Errorf("raft node %d at %s is not connected", c.nodeID, addr)
+	}
+	done <- call
+	return call
+}
+
+// Close implements multiraft.ClientInterface. It's a no-op, as RPC
+// clients are shared via the process-wide cache.
+func (c *raftClient) Close() error {
+	return nil
+}
+
+// nodeAddrResolver resolves node IDs to the addresses the nodes
+// gossip, caching them. A node's cached address is invalidated when
+// the node gossips its address anew, e.g. on restarting at a new
+// address.
+type nodeAddrResolver struct {
+	gossip *gossip.Gossip
+
+	mu      sync.Mutex
+	addrs   map[multiraft.NodeID]net.Addr // Cached addresses
+	watched map[multiraft.NodeID]bool     // Nodes with invalidation callbacks
+}
+
+// newNodeAddrResolver returns a resolver of the node addresses
+// gossiped via g.
+func newNodeAddrResolver(g *gossip.Gossip) *nodeAddrResolver {
+	return &nodeAddrResolver{
+		gossip:  g,
+		addrs:   map[multiraft.NodeID]net.Addr{},
+		watched: map[multiraft.NodeID]bool{},
+	}
+}
+
+// resolve returns the address of the node with the specified ID, or
+// an error if the node's address isn't gossiped.
+func (r *nodeAddrResolver) resolve(nodeID multiraft.NodeID) (net.Addr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if addr, ok := r.addrs[nodeID]; ok {
+		return addr, nil
+	}
+	key := gossip.MakeNodeIDGossipKey(int32(nodeID))
+	if !r.watched[nodeID] {
+		// Callbacks run in their own goroutines, so the cache is only
+		// invalidated after the address read below is cached.
+		r.gossip.RegisterCallback(key, func(_ string, contentsChanged bool) {
+			if contentsChanged {
+				r.invalidate(nodeID)
+			}
+		})
+		r.watched[nodeID] = true
+	}
+	info, err := r.gossip.GetInfo(key)
+	if err != nil {
+		return nil, util.Errorf("unable to resolve address of raft node %d: %v", nodeID, err)
+	}
+	addr := info.(net.Addr)
+	r.addrs[nodeID] = addr
+	return addr, nil
+}
+
+// invalidate removes the node's cached address.
+func (r *nodeAddrResolver) invalidate(nodeID multiraft.NodeID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.addrs, nodeID)
+}
@@ -0,0 +1,136 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	netrpc "net/rpc"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/multiraft"
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// testRaftServer grants the votes requested of it, counting them.
+type testRaftServer struct {
+	mu    sync.Mutex
+	votes int
+}
+
+func (s *testRaftServer) DoRPC(name string, req, resp interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.votes++
+	resp.(*multiraft.RequestVoteResponse).VoteGranted = true
+	return nil
+}
+
+func (s *testRaftServer) numVotes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.votes
+}
+
+// startRaftTransport starts an RPC server with a raft transport on
+// which a test raft server listens as nodeID.
+func startRaftTransport(g *gossip.Gossip, nodeID multiraft.NodeID, t *testing.T) (
+	*rpc.Server, *testRaftServer) {
+	rpcServer := rpc.NewServer(util.CreateTestAddr("tcp"))
+	if err := rpcServer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	raftServer := &testRaftServer{}
+	if err := newRaftTransport(g, rpcServer).Listen(nodeID, raftServer); err != nil {
+		t.Fatal(err)
+	}
+	return rpcServer, raftServer
+}
+
+// requestVote sends a vote request to node 2 via client, returning
+// whether the vote was granted.
+func requestVote(client multiraft.ClientInterface) bool {
+	req := &multiraft.RequestVoteRequest{RequestHeader: multiraft.RequestHeader{SrcNode: 1, DestNode: 2}}
+	resp := &multiraft.RequestVoteResponse{}
+	call := <-client.Go("MultiRaft.RequestVote", req, resp, make(chan *netrpc.Call, 1)).Done
+	return call.Error == nil && resp.VoteGranted
+}
+
+// TestRaftTransportGossipedAddress verifies that raft RPCs are sent to
+// the address a node gossips, and follow the node when it gossips a
+// new address.
+func TestRaftTransportGossipedAddress(t *testing.T) {
+	g := gossip.New()
+	s1, _ := startRaftTransport(g, 1, t)
+	defer s1.Close()
+	s2, server2 := startRaftTransport(g, 2, t)
+	defer s2.Close()
+
+	client, err := newRaftTransport(g, s1).Connect(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Node 2's address isn't gossiped yet.
+	if requestVote(client) {
+		t.Fatal("expected failure to resolve address of node 2")
+	}
+	nodeKey := gossip.MakeNodeIDGossipKey(2)
+	if err := g.AddInfo(nodeKey, s2.Addr(), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.IsTrueWithin(func() bool { return requestVote(client) }, 500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// Node 2 restarts at a new address.
+	s3, server3 := startRaftTransport(g, 2, t)
+	defer s3.Close()
+	if err := g.AddInfo(nodeKey, s3.Addr(), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.IsTrueWithin(func() bool { return requestVote(client) && server3.numVotes() > 0 }, 500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if server2.numVotes() == 0 {
+		t.Error("expected votes requested at node 2's first address")
+	}
+}
+
+// TestRaftTransportDispatch verifies that RPCs are passed to the raft
+// server listening as their destination node.
+func TestRaftTransportDispatch(t *testing.T) {
+	transport := newRaftTransport(gossip.New(), rpc.NewServer(util.CreateTestAddr("tcp")))
+	server := &testRaftServer{}
+	if err := transport.Listen(2, server); err != nil {
+		t.Fatal(err)
+	}
+	if err := transport.Listen(3, &testRaftServer{}); err != nil {
+		t.Fatal(err)
+	}
+	req := &multiraft.RequestVoteRequest{RequestHeader: multiraft.RequestHeader{DestNode: 2}}
+	if err := transport.DoRPC("MultiRaft.RequestVote", req, &multiraft.RequestVoteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if server.numVotes() != 1 {
+		t.Errorf("expected 1 vote at node 2; got %d", server.numVotes())
+	}
+	transport.Stop(2)
+	if err := transport.DoRPC("MultiRaft.RequestVote", req, &multiraft.RequestVoteResponse{}); err == nil {
+		t.Error("expected error sending to stopped node")
+	}
+}
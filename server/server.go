@@ -24,6 +24,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"os"
@@ -32,15 +33,18 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	commander "code.google.com/p/go-commander"
 	"github.com/cockroachdb/cockroach/gossip"
 	"github.com/cockroachdb/cockroach/kv"
 	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/security"
 	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/structured"
 	"github.com/cockroachdb/cockroach/util"
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/metrics"
 )
 
 var (
@@ -52,11 +56,15 @@ var (
 	// optionally specified via mem=<integer byte size>.
 	stores = flag.String("stores", "", "specify a comma-separated list of stores, "+
 		"specified by a colon-separated list of device attributes followed by '=' and "+
-		"either a filepath for a persistent store or an integer size in bytes for an "+
-		"in-memory store. Device attributes typically include whether the store is "+
+		"either a filepath for a persistent store or a size for an in-memory store. "+
+		"Sizes are an integer number of bytes, optionally suffixed by a unit of KB, MB, "+
+		"GB or TB (powers of 1024). Device attributes typically include whether the store is "+
 		"flash (ssd), spinny disk (hdd), fusion-io (fio), in-memory (mem); device "+
 		"attributes might also include speeds and other specs (7200rpm, 200kiops, etc.). "+
-		"For example, -store=hdd:7200rpm=/mnt/hda1,ssd=/mnt/ssd01,ssd=/mnt/ssd02,mem=1073741824")
+		"A store's raft logs may be placed on a separate device by appending '+' and its "+
+		"specification. "+
+		"For example, -stores=hdd:7200rpm=/mnt/hda1,ssd=/mnt/ssd01,ssd=/mnt/ssd02,mem=1GB or "+
+		"-stores=hdd=/mnt/hda1+ssd=/mnt/ssd01")
 
 	// attrs specifies node topography or machine capabilities, used to
 	// match capabilities or location preferences specified in zone configs.
@@ -67,14 +75,88 @@ var (
 		"might include specialized hardware or number of cores (e.g. \"gpu\", "+
 		"\"x16c\"). For example: -attrs=us-west-1b,gpu")
 
+	// maxOffset is the maximum clock offset tolerated between nodes.
+	// The correctness of MVCC reads depends on it; a node whose clock
+	// drifts further from the clocks of a majority of its peers
+	// terminates itself.
+	maxOffset = flag.Duration("max_offset", 250*time.Millisecond, "specify the maximum "+
+		"clock offset between nodes in the cluster. A node whose clock is measured to be "+
+		"offset by more than this from a majority of its peers will terminate itself")
+
+	// slowRequestThreshold is the latency above which requests
+	// coordinated by the node are logged and collected with their
+	// traces.
+	slowRequestThreshold = flag.Duration("slow_request_threshold", storage.DefaultSlowRequestThreshold,
+		"specify the latency above which requests are logged and their traces collected "+
+			"for display at "+tracesPath+"; 0 to disable")
+
+	// snapshotMaxSends, snapshotMaxApplies and snapshotRate bound the
+	// snapshots each store sends and applies to add range replicas.
+	snapshotMaxSends = flag.Int("snapshot_max_sends", storage.DefaultSnapshotLimits.MaxConcurrentSends,
+		"specify the maximum number of snapshots each store sends concurrently; further snapshots "+
+			"are queued. 0 for no limit")
+	snapshotMaxApplies = flag.Int("snapshot_max_applies", storage.DefaultSnapshotLimits.MaxConcurrentApplies,
+		"specify the maximum number of snapshots each store applies concurrently; further snapshots "+
+			"are queued. 0 for no limit")
+	snapshotRate = flag.Float64("snapshot_rate", storage.DefaultSnapshotLimits.BytesPerSec,
+		"specify the maximum rate, in bytes per second, at which each store sends snapshots. 0 for no limit")
+
+	// storeFullThreshold bounds the fraction of each store's capacity
+	// filled by new replicas.
+	storeFullThreshold = flag.Float64("store_full_threshold", storage.DefaultFullThreshold,
+		"specify the fraction of each store's capacity in use beyond which the store refuses new "+
+			"replicas, so that rebalancing doesn't fill it")
+
+	// admissionMaxInFlight, admissionMaxQueued, admissionQueueWait and
+	// admissionMaxHeap bound the client requests each store admits.
+	// Requests which can't be admitted are shed, and retried by
+	// clients with backoff.
+	admissionMaxInFlight = flag.Int("admission_max_in_flight", storage.DefaultAdmissionLimits.MaxInFlight,
+		"specify the maximum number of client requests each store executes concurrently; further "+
+			"requests are queued. 0 for no limit")
+	admissionMaxQueued = flag.Int("admission_max_queued", storage.DefaultAdmissionLimits.MaxQueued,
+		"specify the maximum number of client requests each store queues for admission; further "+
+			"requests are shed. 0 for no limit")
+	admissionQueueWait = flag.Duration("admission_queue_wait", storage.DefaultAdmissionLimits.MaxQueueWait,
+		"specify the maximum time a client request is queued for admission before it's shed. 0 for no limit")
+	admissionMaxHeap = flag.Uint64("admission_max_heap_bytes", storage.DefaultAdmissionLimits.MaxHeapBytes,
+		"specify the heap usage, in bytes, above which stores shed client requests. 0 for no limit")
+
+	// memoryBudget bounds the memory charged for the scans and
+	// snapshots of the node's stores.
+	memoryBudget = flag.Int64("memory_budget", 1<<30,
+		"specify the maximum memory, in bytes, held by the scans and snapshots of the node's stores; "+
+			"work which would exceed it fails. 0 for no limit")
+
+	// debugEndpoints enables the profiling and runtime statistics
+	// endpoints under /debug/.
+	debugEndpoints = flag.Bool("debug_endpoints", false, "expose pprof profiling at "+
+		debugPrefix+"pprof/ and runtime statistics at "+debugStatsPath+" over HTTP. "+
+		"Profiling costs performance while it runs and the endpoints are unauthenticated")
+
+	// certDir is the directory containing the CA and node certificates
+	// used to secure inter-node traffic. If empty, nodes communicate
+	// insecurely.
+	certDir = flag.String("certs", "", "specify the directory containing the CA "+
+		"certificate ("+security.CACertFile+") and the node certificate and key ("+
+		security.NodeCertFile+", "+security.NodeKeyFile+") used to authenticate and "+
+		"encrypt RPC traffic between nodes. Certificates may be created with "+
+		"\"cockroach create-ca-cert\" and \"cockroach create-node-cert\". If not "+
+		"specified, traffic between nodes is insecure")
+
 	// Regular expression for capturing data directory specifications.
 	storesRE = regexp.MustCompile(`([^=]+)=([^,]+)(,|$)`)
+	// raftStoreRE matches the '+' which separates a store's path from
+	// the specification of its raft log engine: the first '+' followed
+	// by a list of attributes and '=', which paths containing '+'
+	// otherwise lack.
+	raftStoreRE = regexp.MustCompile(`\+[^=+/]*=`)
 )
 
 // A CmdStart command starts nodes by joining the gossip network.
 var CmdStart = &commander.Command{
 	UsageLine: "start -gossip=host1:port1[,host2:port2...] " +
-		"-stores=(ssd=<data-dir>|hdd=<data-dir>|mem=<capacity-in-bytes>)[,...]",
+		"-stores=(ssd=<data-dir>|hdd=<data-dir>|mem=<capacity>)[+<raft-log-store>][,...]",
 	Short: "start node by joining the gossip network",
 	Long: fmt.Sprintf(`
 
@@ -84,20 +166,59 @@ contacting one or more well-known hosts specified by the -gossip
 command line flag. Every node should be run with the same list of
 bootstrap hosts to guarantee a connected network. An alternate
 approach is to use a single host for -gossip and round-robin DNS.
+Nodes persist the addresses of their gossip peers to their stores and
+add them to the bootstrap hosts on restart, so a restarted cluster
+reconnects even if the hosts specified via -gossip are gone.
 
 Each node exports data from one or more physical devices. These
 devices are specified via the -stores command line flag. This is a
 comma-separated list of paths to storage directories or for in-memory
 stores, the number of bytes. Although the paths should be specified to
 correspond uniquely to physical devices, this requirement isn't
-strictly enforced.
+strictly enforced. The raft logs of a store, written on every command,
+may be placed on a separate low-latency device by appending '+' and
+its specification to the store's; e.g. -stores=hdd=/mnt/hda1+ssd=/mnt/ssd01
+keeps range data on /mnt/hda1 and raft logs on /mnt/ssd01. A store must
+be restarted with the same raft log device.
 
 A node exports an HTTP API with the following endpoints:
 
   Health check:           /healthz
   Key-value REST:         %s
+  Key range scan REST:    %s
+  Counter REST:           %s
+  Batch REST:             %s
+  Go client (gob):        %s
   Structured Schema REST: %s
-`, kv.KVKeyPrefix, structured.StructuredKeyPrefix),
+  Accounting configs:     %s
+  Accounting usage:       %s
+  Metrics:                %s
+  Slow request traces:    %s
+  Drain:                  %s
+  Decommission:           %s
+
+Metrics are exported in the Prometheus text format, or as JSON with
+the query parameter format=json. Runtime statistics (goroutines, heap,
+GC pauses and open file descriptors) are among the metrics.
+
+A POST to the drain endpoint transfers the node's leader leases to
+other nodes and, with the query parameter replicas=true, moves its
+replicas off the node; a GET reports the leases and replicas which
+remain. Once draining, the node rejects client requests. Drain a node
+before restarting it.
+
+A POST to the decommission endpoint marks the node as decommissioning
+in its liveness record: the cluster moves all of its replicas to other
+nodes and allocates it no new ones. A GET reports the replicas which
+remain; once none do, the node may be shut down for good.
+
+With -debug_endpoints, a node additionally exports:
+
+  pprof profiling:        %spprof/
+  Runtime statistics:     %s
+`, kv.KVKeyPrefix, kv.KVRangePath, kv.KVCounterPrefix, kv.KVBatchPath,
+		kv.DBPrefix, structured.StructuredKeyPrefix, acctKeyPrefix, acctUsagePath,
+		metricsPath, tracesPath, drainPath, decommissionPath, debugPrefix, debugStatsPath),
 	Run:  runStart,
 	Flag: *flag.CommandLine,
 }
@@ -107,41 +228,49 @@ type server struct {
 	mux            *http.ServeMux
 	rpc            *rpc.Server
 	gossip         *gossip.Gossip
-	kvDB           kv.DB
+	kvDB           *kv.DistDB
 	kvREST         *kv.RESTServer
+	kvDBServer     *kv.DBServer
 	node           *Node
 	admin          *adminServer
 	structuredDB   *structured.DB
 	structuredREST *structured.RESTServer
+	runtimeStats   *runtimeStatSampler
 	httpListener   *net.Listener // holds http endpoint information
+	stopper        *util.Stopper
 }
 
+// clockOffsetCheckInterval is the interval at which the local clock
+// is verified against the clock offsets measured by RPC heartbeats.
+const clockOffsetCheckInterval = 10 * time.Second
+
 // runStart starts the cockroach node using -stores as the list of
 // storage devices ("stores") on this machine and -gossip as the list
 // of "well-known" hosts used to join this node to the cockroach
 // cluster via the gossip network.
 func runStart(cmd *commander.Command, args []string) {
-	glog.Info("Starting cockroach cluster")
+	log.New("server").Infof("starting cockroach cluster")
 	s, err := newServer()
 	if err != nil {
-		glog.Errorf("Failed to start Cockroach server: %v", err)
+		log.New("server").Errorf("Failed to start Cockroach server: %v", err)
 		return
 	}
 	// Init engines from -stores.
-	engines, err := initEngines(*stores)
+	engines, raftEngines, err := initEngines(*stores)
 	if err != nil {
-		glog.Errorf("Failed to initialize engines from -stores=%q: %v", *stores, err)
+		log.New("server").Errorf("Failed to initialize engines from -stores=%q: %v", *stores, err)
 		return
 	}
 	if len(engines) == 0 {
-		glog.Errorf("No valid engines specified after initializing from -stores=%q", *stores)
+		log.New("server").Errorf("No valid engines specified after initializing from -stores=%q", *stores)
 		return
 	}
+	s.node.raftEngines = raftEngines
 
 	err = s.start(engines, false)
 	defer s.stop()
 	if err != nil {
-		glog.Errorf("Cockroach server exited with error: %v", err)
+		log.New("server").Errorf("Cockroach server exited with error: %v", err)
 		return
 	}
 
@@ -167,44 +296,97 @@ func parseAttributes(attrsStr string) storage.Attributes {
 }
 
 // initEngines interprets the stores parameter to initialize a slice of
-// storage.Engine objects.
-func initEngines(stores string) ([]storage.Engine, error) {
+// storage.Engine objects. Engines specified for the raft logs of
+// stores (following '+') are returned keyed by their stores' engines.
+func initEngines(stores string) ([]storage.Engine, map[storage.Engine]storage.Engine, error) {
 	// Error if regexp doesn't match.
 	storeSpecs := storesRE.FindAllStringSubmatch(stores, -1)
 	if storeSpecs == nil || len(storeSpecs) == 0 {
-		return nil, util.Errorf("invalid or empty engines specification %q", stores)
+		return nil, nil, util.Errorf("invalid or empty engines specification %q", stores)
 	}
 
 	engines := []storage.Engine{}
+	raftEngines := map[storage.Engine]storage.Engine{}
 	for _, store := range storeSpecs {
 		if len(store) != 4 {
-			return nil, util.Errorf("unable to parse attributes and path from store %q", store[0])
+			return nil, nil, util.Errorf("unable to parse attributes and path from store %q", store[0])
 		}
 		// There are two matches for each store specification: the colon-separated
-		// list of attributes and the path.
-		engine, err := initEngine(store[1], store[2])
+		// list of attributes and the path, which may be followed by '+' and the
+		// specification of the raft log engine.
+		path, raftSpec := store[2], ""
+		sep := -1
+		if loc := raftStoreRE.FindStringIndex(path); loc != nil {
+			sep = loc[0]
+			path, raftSpec = path[:sep], path[sep+1:]
+		}
+		engine, err := initEngine(store[1], path)
 		if err != nil {
-			return nil, util.Errorf("unable to init engine for store %q: %v", store[0], err)
+			return nil, nil, util.Errorf("unable to init engine for store %q: %v", store[0], err)
 		}
 		engines = append(engines, engine)
+		if sep == -1 {
+			continue
+		}
+		i := strings.Index(raftSpec, "=")
+		if i <= 0 {
+			return nil, nil, util.Errorf("unable to parse attributes and path from raft log store %q", raftSpec)
+		}
+		raftEngine, err := initEngine(raftSpec[:i], raftSpec[i+1:])
+		if err != nil {
+			return nil, nil, util.Errorf("unable to init raft log engine for store %q: %v", store[0], err)
+		}
+		raftEngines[engine] = raftEngine
 	}
 
-	return engines, nil
+	return engines, raftEngines, nil
+}
+
+// capacityUnits maps the unit suffixes accepted by parseCapacity to
+// their sizes in bytes.
+var capacityUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"GB", 1 << 30},
+	{"TB", 1 << 40},
+}
+
+// parseCapacity parses an in-memory store capacity: an integer number
+// of bytes, optionally followed by a case-insensitive unit of KB, MB,
+// GB or TB. Returns false if s isn't a capacity.
+func parseCapacity(s string) (int64, bool) {
+	mult := int64(1)
+	for _, u := range capacityUnits {
+		if len(s) > len(u.suffix) && strings.EqualFold(s[len(s)-len(u.suffix):], u.suffix) {
+			s, mult = s[:len(s)-len(u.suffix)], u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/mult {
+		return 0, false
+	}
+	return n * mult, true
 }
 
 // initEngine parses the store attributes as a colon-separated list
 // and instantiates an engine based on the dir parameter. If dir parses
-// to an integer, it's taken to mean an in-memory engine; otherwise,
-// dir is treated as a path and a RocksDB engine is created.
+// as a capacity (see parseCapacity), it's taken to mean an in-memory
+// engine; otherwise, dir is treated as a path and a RocksDB engine is
+// created.
 func initEngine(attrsStr, path string) (storage.Engine, error) {
 	attrs := parseAttributes(attrsStr)
 	var engine storage.Engine
-	if size, err := strconv.ParseUint(path, 10, 64); err == nil {
+	if size, ok := parseCapacity(path); ok {
 		if size == 0 {
 			return nil, util.Errorf("unable to initialize an in-memory store with capacity 0")
 		}
-		engine = storage.NewInMem(attrs, int64(size))
+		engine = storage.NewInMem(attrs, size)
 	} else {
+		var err error
 		engine, err = storage.NewRocksDB(attrs, path)
 		if err != nil {
 			return nil, util.Errorf("unable to init rocksdb with data dir %q: %v", path, err)
@@ -230,19 +412,46 @@ func newServer() (*server, error) {
 		return nil, util.Errorf("unable to resolve RPC address %q: %v", *rpcAddr, err)
 	}
 
+	// Secure RPC traffic, including gossip, if certificates are given.
+	if *certDir != "" {
+		tlsConfig, err := security.LoadTLSConfig(*certDir)
+		if err != nil {
+			return nil, util.Errorf("unable to load certificates from %q: %v", *certDir, err)
+		}
+		rpc.SetTLSConfig(tlsConfig)
+	}
+
 	s := &server{
-		host: host,
-		mux:  http.NewServeMux(),
-		rpc:  rpc.NewServer(addr),
+		host:    host,
+		mux:     http.NewServeMux(),
+		rpc:     rpc.NewServer(addr),
+		stopper: util.NewStopper(),
 	}
 
 	s.gossip = gossip.New()
 	s.kvDB = kv.NewDB(s.gossip)
 	s.kvREST = kv.NewRESTServer(s.kvDB)
+	s.kvDBServer = kv.NewDBServer(s.kvDB)
 	s.node = NewNode(s.kvDB, s.gossip)
-	s.admin = newAdminServer(s.kvDB)
+	// Reject remote timestamps further in the future than the maximum
+	// clock offset allows.
+	s.node.clock.SetMaxDrift(uint(*maxOffset))
+	storage.SlowRequests.SetThreshold(*slowRequestThreshold)
+	s.node.snapshotLimits = storage.SnapshotLimits{
+		MaxConcurrentSends:   *snapshotMaxSends,
+		MaxConcurrentApplies: *snapshotMaxApplies,
+		BytesPerSec:          *snapshotRate,
+	}
+	s.node.fullThreshold = *storeFullThreshold
+	s.node.admissionLimits.MaxInFlight = *admissionMaxInFlight
+	s.node.admissionLimits.MaxQueued = *admissionMaxQueued
+	s.node.admissionLimits.MaxQueueWait = *admissionQueueWait
+	s.node.admissionLimits.MaxHeapBytes = *admissionMaxHeap
+	s.node.memory.SetLimit(*memoryBudget)
+	s.admin = newAdminServer(s.kvDB, s.gossip, s.node)
 	s.structuredDB = structured.NewDB(s.kvDB)
 	s.structuredREST = structured.NewRESTServer(s.structuredDB)
+	s.runtimeStats = newRuntimeStatSampler(metrics.DefaultRegistry)
 
 	return s, nil
 }
@@ -252,31 +461,34 @@ func newServer() (*server, error) {
 // bootstrap), and starts the node using the supplied engines slice.
 func (s *server) start(engines []storage.Engine, selfBootstrap bool) error {
 	s.rpc.Start() // bind RPC socket and launch goroutine.
-	glog.Infof("Started RPC server at %s", s.rpc.Addr())
-
-	// Handle self-bootstrapping case for a single node.
-	if selfBootstrap {
-		s.gossip.SetBootstrap([]net.Addr{s.rpc.Addr()})
-	}
-	s.gossip.Start(s.rpc)
-	glog.Infoln("Started gossip instance")
+	log.New("server").Infof("Started RPC server at %s", s.rpc.Addr())
 
 	// Init the engines specified via command line flags if not supplied.
 	if engines == nil {
 		var err error
-		engines, err = initEngines(*stores)
+		engines, s.node.raftEngines, err = initEngines(*stores)
 		if err != nil {
 			return err
 		}
 	}
 
+	// Handle self-bootstrapping case for a single node.
+	if selfBootstrap {
+		s.gossip.SetBootstrap([]net.Addr{s.rpc.Addr()})
+	}
+	s.addGossipBootstrap(engines)
+	s.gossip.Start(s.rpc)
+	log.New("server").Infof("started gossip instance")
+
 	// Init the node attributes from the -attrs command line flag.
 	nodeAttrs := parseAttributes(*attrs)
 
 	if err := s.node.start(s.rpc, engines, nodeAttrs); err != nil {
 		return err
 	}
-	glog.Infof("Initialized %d storage engine(s)", len(engines))
+	log.New("server").Infof("Initialized %d storage engine(s)", len(engines))
+	s.stopper.RunWorker(s.monitorClockOffset)
+	s.runtimeStats.start(runtimeStatsInterval, s.stopper)
 
 	s.initHTTP()
 	if strings.HasPrefix(*httpAddr, ":") {
@@ -289,22 +501,91 @@ func (s *server) start(engines []storage.Engine, selfBootstrap bool) error {
 	// Obtaining the http end point listener is difficult using
 	// http.ListenAndServe(), so we are storing it with the server
 	s.httpListener = &ln
-	glog.Infof("Starting HTTP server at %s", ln.Addr())
+	log.New("server").Infof("Starting HTTP server at %s", ln.Addr())
 	go http.Serve(ln, s)
 	return nil
 }
 
+// addGossipBootstrap adds the addresses of the gossip peers persisted
+// to engines by the node before it restarted (see
+// Node.persistGossipBootstrap) to the gossip bootstrap hosts, so the
+// node can rejoin the cluster even if the hosts specified via -gossip
+// are gone.
+func (s *server) addGossipBootstrap(engines []storage.Engine) {
+	var bootstraps []net.Addr
+	for _, engine := range engines {
+		addrs, err := storage.ReadGossipBootstrap(engine)
+		if err != nil {
+			log.New("server").Warningf("unable to read gossip bootstrap addresses from %s: %v", engine, err)
+			continue
+		}
+		for _, addr := range addrs {
+			tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+			if err != nil {
+				log.New("server").Warningf("invalid persisted gossip bootstrap address %s: %v", addr, err)
+				continue
+			}
+			bootstraps = append(bootstraps, tcpAddr)
+		}
+	}
+	if len(bootstraps) > 0 {
+		log.New("server").Infof("adding %d persisted gossip bootstrap address(es)", len(bootstraps))
+		s.gossip.SetBootstrap(bootstraps)
+	}
+}
+
 func (s *server) initHTTP() {
 	s.mux.HandleFunc(adminKeyPrefix+"healthz", s.admin.handleHealthz)
+	s.mux.HandleFunc(acctKeyPrefix, s.admin.handleAcctAction)
+	s.mux.HandleFunc(acctUsagePath, s.admin.handleAcctUsage)
 	s.mux.HandleFunc(zoneKeyPrefix, s.admin.handleZoneAction)
+	s.mux.HandleFunc(livenessKeyPrefix, s.admin.handleLiveness)
+	s.mux.Handle(metricsPath, metrics.DefaultRegistry)
+	s.mux.HandleFunc(tracesPath, s.admin.handleTraces)
+	s.mux.HandleFunc(raftLogPrefix, s.admin.handleRaftLog)
+	s.mux.HandleFunc(drainPath, s.admin.handleDrain)
+	s.mux.HandleFunc(decommissionPath, s.admin.handleDecommission)
+	s.mux.HandleFunc(changesPath, s.admin.handleChanges)
 	s.mux.HandleFunc(kv.KVKeyPrefix, s.kvREST.HandleAction)
+	s.mux.HandleFunc(kv.KVRangePath, s.kvREST.HandleRangeAction)
+	s.mux.HandleFunc(kv.KVCounterPrefix, s.kvREST.HandleCounterAction)
+	s.mux.HandleFunc(kv.KVBatchPath, s.kvREST.HandleBatchAction)
+	s.mux.Handle(kv.DBPrefix, s.kvDBServer)
 	s.mux.HandleFunc(structured.StructuredKeyPrefix, s.structuredREST.HandleAction)
+	if *debugEndpoints {
+		registerDebugHandlers(s.mux, s.runtimeStats)
+	}
 }
 
+// monitorClockOffset periodically verifies that the local clock
+// agrees with the clocks of the majority of remote nodes to within
+// the maximum clock offset, terminating the process if it doesn't.
+// Serving reads with a faulty clock could violate MVCC consistency.
+func (s *server) monitorClockOffset() {
+	ticker := time.NewTicker(clockOffsetCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := rpc.VerifyClockOffset(*maxOffset); err != nil {
+				log.New("server").Fatalf("clock offset check failed: %v", err)
+			}
+		case <-s.stopper.ShouldStop():
+			return
+		}
+	}
+}
+
+// stop shuts the server down in order: the server's own workers are
+// stopped first, then the node, which drains its stores, the KV
+// client, whose requests stop retrying, and finally gossip and the
+// RPC server through which the node is reached.
 func (s *server) stop() {
 	// TODO(spencer): the http server should exit; this functionality is
 	// slated for go 1.3.
+	s.stopper.Stop()
 	s.node.stop()
+	s.kvDB.Close()
 	s.gossip.Stop()
 	s.rpc.Close()
 }
@@ -325,7 +606,15 @@ func (w gzipResponseWriter) Write(b []byte) (int, error) {
 
 // ServeHTTP is necessary to implement the http.Handler interface. It
 // will gzip a response if the appropriate request headers are set.
+// Once the node is draining, client requests are rejected so that
+// clients fail over to other nodes; admin and debug endpoints are
+// still served.
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.node.IsDraining() && !strings.HasPrefix(r.URL.Path, adminKeyPrefix) &&
+		!strings.HasPrefix(r.URL.Path, debugPrefix) {
+		http.Error(w, "node is draining", http.StatusServiceUnavailable)
+		return
+	}
 	if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
 		s.mux.ServeHTTP(w, r)
 		return
@@ -19,6 +19,7 @@ package server
 
 import (
 	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -26,9 +27,12 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/cockroachdb/cockroach/hlc"
 	"github.com/cockroachdb/cockroach/storage"
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 var (
@@ -45,24 +49,25 @@ func init() {
 
 func startServer() *server {
 	serverTestOnce.Do(func() {
-		s, err := newServer()
+		var err error
+		s, err = newServer()
 		if err != nil {
-			glog.Fatal(err)
+			log.New("server").Fatalf("%v", err)
 		}
 		engines := []storage.Engine{storage.NewInMem(storage.Attributes{}, 1<<20)}
 		if _, err := BootstrapCluster("cluster-1", engines[0]); err != nil {
-			glog.Fatal(err)
+			log.New("server").Fatalf("%v", err)
 		}
 		err = s.start(engines, true) // TODO(spencer): should shutdown server.
 		if err != nil {
-			glog.Fatalf("Could not start server: %s", err)
+			log.New("server").Fatalf("Could not start server: %s", err)
 		}
 
 		// Update the configuration variables to reflect the actual
 		// sockets bound during this test.
 		*httpAddr = (*s.httpListener).Addr().String()
 		*rpcAddr = s.rpc.Addr().String()
-		glog.Infof("Test server listening on http: %s, rpc: %s", *httpAddr, *rpcAddr)
+		log.New("server").Infof("Test server listening on http: %s, rpc: %s", *httpAddr, *rpcAddr)
 	})
 	return s
 }
@@ -101,6 +106,8 @@ func TestInitEngine(t *testing.T) {
 	}{
 		{"mem=1000", storage.Attributes([]string{"mem"}), false, true},
 		{"ssd=1000", storage.Attributes([]string{"ssd"}), false, true},
+		{"mem=1GB", storage.Attributes([]string{"mem"}), false, true},
+		{"mem=0MB", storage.Attributes{}, true, false},
 		{fmt.Sprintf("ssd=%s", tmp[0]), storage.Attributes([]string{"ssd"}), false, false},
 		{fmt.Sprintf("hdd=%s", tmp[1]), storage.Attributes([]string{"hdd"}), false, false},
 		{fmt.Sprintf("mem=%s", tmp[2]), storage.Attributes([]string{"mem"}), false, false},
@@ -115,7 +122,7 @@ func TestInitEngine(t *testing.T) {
 		{"hdd=", storage.Attributes{}, true, false},
 	}
 	for _, spec := range testCases {
-		engines, err := initEngines(spec.key)
+		engines, _, err := initEngines(spec.key)
 		if err == nil {
 			if spec.wantError {
 				t.Fatalf("invalid engine spec '%v' erroneously accepted: %+v", spec.key, spec)
@@ -137,6 +144,34 @@ func TestInitEngine(t *testing.T) {
 	}
 }
 
+// TestParseCapacity verifies parsing of in-memory store capacities.
+func TestParseCapacity(t *testing.T) {
+	testCases := []struct {
+		s    string
+		size int64
+		ok   bool
+	}{
+		{"1000", 1000, true},
+		{"0", 0, true},
+		{"1KB", 1 << 10, true},
+		{"2mb", 2 << 20, true},
+		{"1GB", 1 << 30, true},
+		{"3Tb", 3 << 40, true},
+		{"GB", 0, false},
+		{"-1", 0, false},
+		{"1.5GB", 0, false},
+		{"1PB", 0, false},
+		{"16777216TB", 0, false},
+		{"/mnt/ssd01", 0, false},
+	}
+	for _, test := range testCases {
+		size, ok := parseCapacity(test.s)
+		if ok != test.ok || size != test.size {
+			t.Errorf("%q: expected %d, %t; got %d, %t", test.s, test.size, test.ok, size, ok)
+		}
+	}
+}
+
 // TestInitEngines tests whether multiple engines specified as a
 // single comma-separated list are parsed correctly.
 func TestInitEngines(t *testing.T) {
@@ -154,7 +189,7 @@ func TestInitEngines(t *testing.T) {
 		{storage.Attributes([]string{"hdd", "7200rpm"}), false},
 	}
 
-	engines, err := initEngines(stores)
+	engines, _, err := initEngines(stores)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -172,6 +207,47 @@ func TestInitEngines(t *testing.T) {
 	}
 }
 
+// TestInitEnginesRaftLog verifies that engines specified for the raft
+// logs of stores are parsed and paired with the stores' engines.
+func TestInitEnginesRaftLog(t *testing.T) {
+	tmp := createTempDirs(2, t)
+	defer resetTestData(tmp)
+
+	stores := fmt.Sprintf("hdd=%s+ssd=%s,mem=1000", tmp[0], tmp[1])
+	engines, raftEngines, err := initEngines(stores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(engines) != 2 || len(raftEngines) != 1 {
+		t.Fatalf("expected 2 engines and 1 raft log engine; got %d, %d", len(engines), len(raftEngines))
+	}
+	raftEngine, ok := raftEngines[engines[0]]
+	if !ok || raftEngine.Attrs().SortedString() != "ssd" {
+		t.Errorf("expected ssd raft log engine for first store; got %v", raftEngine)
+	}
+	if _, ok := raftEngines[engines[1]]; ok {
+		t.Error("expected no raft log engine for in-memory store")
+	}
+
+	// Paths may contain '+' without specifying a raft log engine.
+	stores = fmt.Sprintf("hdd=%s/a+b+ssd=%s/c+d,hdd=%s/e+f", tmp[0], tmp[1], tmp[0])
+	if engines, raftEngines, err = initEngines(stores); err != nil {
+		t.Fatal(err)
+	}
+	if len(engines) != 2 || len(raftEngines) != 1 {
+		t.Fatalf("expected 2 engines and 1 raft log engine; got %d, %d", len(engines), len(raftEngines))
+	}
+	if raftEngine, ok := raftEngines[engines[0]]; !ok || raftEngine.Attrs().SortedString() != "ssd" {
+		t.Errorf("expected ssd raft log engine for first store; got %v", raftEngine)
+	}
+
+	for _, stores := range []string{"mem=1000+=1000", "mem=1000+mem=0"} {
+		if _, _, err := initEngines(stores); err == nil {
+			t.Errorf("%q: expected error for invalid raft log store", stores)
+		}
+	}
+}
+
 // TestHealthz verifies that /_admin/healthz does, in fact, return "ok"
 // as expected.
 func TestHealthz(t *testing.T) {
@@ -192,6 +268,76 @@ func TestHealthz(t *testing.T) {
 	}
 }
 
+// TestLiveness verifies that /_admin/liveness reports the server's
+// node as live once it has heartbeated its liveness record.
+func TestLiveness(t *testing.T) {
+	startServer()
+	url := "http://" + *httpAddr + "/_admin/liveness"
+	var body string
+	if err := util.IsTrueWithin(func() bool {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("error requesting liveness at %s: %s", url, err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("could not read response body: %s", err)
+		}
+		body = string(b)
+		return strings.Contains(body, "node 1: live")
+	}, 500*time.Millisecond); err != nil {
+		t.Errorf("expected node 1 to be live; got %q", body)
+	}
+}
+
+// TestMetrics verifies that /_admin/metrics exports the node's
+// metrics in both the text and JSON formats.
+func TestMetrics(t *testing.T) {
+	startServer()
+	url := "http://" + *httpAddr + "/_admin/metrics"
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("error requesting metrics at %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read response body: %s", err)
+	}
+	for _, expected := range []string{"# TYPE kv_requests counter", "# TYPE rpc_server_connections gauge",
+		"multiraft_write_latency_ns_count"} {
+		if !strings.Contains(string(b), expected) {
+			t.Errorf("expected body to contain %q, got %q", expected, string(b))
+		}
+	}
+
+	resp, err = http.Get(url + "?format=json")
+	if err != nil {
+		t.Fatalf("error requesting metrics at %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+	var values map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&values); err != nil {
+		t.Fatalf("could not decode metrics: %s", err)
+	}
+	if _, ok := values["kv_requests"]; !ok {
+		t.Errorf("expected kv_requests in %v", values)
+	}
+}
+
+// TestMaxClockOffset verifies the node's clock rejects remote
+// timestamps further ahead than the maximum clock offset.
+func TestMaxClockOffset(t *testing.T) {
+	s := startServer()
+	if drift := s.node.clock.MaxDrift(); drift != uint(*maxOffset) {
+		t.Errorf("expected max drift %s; got %s", *maxOffset, time.Duration(drift))
+	}
+	if _, err := s.node.clock.Update(hlc.HLTimestamp{WallTime: hlc.UnixNano() + int64(time.Hour)}); err == nil {
+		t.Error("expected error updating clock with timestamp beyond max offset")
+	}
+}
+
 // TestGzip hits the /_admin/healthz endpoint while explicitly disabling
 // decompression on a custom client's Transport and setting it
 // conditionally via the request's Accept-Encoding headers.
@@ -27,7 +27,7 @@ import (
 	"github.com/cockroachdb/cockroach/kv"
 	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/util"
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/util/log"
 	yaml "gopkg.in/yaml.v1"
 )
 
@@ -84,7 +84,7 @@ func (zh *zoneHandler) Get(path string, r *http.Request) (body []byte, contentTy
 			return
 		}
 		if len(sr.Rows) == maxGetResults {
-			glog.Warningf("retrieved maximum number of results (%d); some may be missing", maxGetResults)
+			log.New("server").Warningf("retrieved maximum number of results (%d); some may be missing", maxGetResults)
 		}
 		var prefixes []string
 		for _, kv := range sr.Rows {
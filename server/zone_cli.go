@@ -31,7 +31,7 @@ import (
 	commander "code.google.com/p/go-commander"
 	"github.com/cockroachdb/cockroach/kv"
 	"github.com/cockroachdb/cockroach/util"
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 // sendAdminRequest send an HTTP request and processes the response for
@@ -74,13 +74,13 @@ func runGetZones(cmd *commander.Command, args []string) {
 	}
 	req, err := http.NewRequest("GET", kv.HTTPAddr()+zoneKeyPrefix+"/"+args[0], nil)
 	if err != nil {
-		glog.Errorf("unable to create request to admin REST endpoint: %v", err)
+		log.New("server").Errorf("unable to create request to admin REST endpoint: %v", err)
 		return
 	}
 	// TODO(spencer): need to move to SSL.
 	b, err := sendAdminRequest(req)
 	if err != nil {
-		glog.Errorf("admin REST request failed: %v", err)
+		log.New("server").Errorf("admin REST request failed: %v", err)
 		return
 	}
 	fmt.Fprintf(os.Stdout, "zone config for key prefix %q:\n%s\n", args[0], string(b))
@@ -111,23 +111,23 @@ func runLsZones(cmd *commander.Command, args []string) {
 	}
 	req, err := http.NewRequest("GET", kv.HTTPAddr()+zoneKeyPrefix, nil)
 	if err != nil {
-		glog.Errorf("unable to create request to admin REST endpoint: %v", err)
+		log.New("server").Errorf("unable to create request to admin REST endpoint: %v", err)
 		return
 	}
 	b, err := sendAdminRequest(req)
 	if err != nil {
-		glog.Errorf("admin REST request failed: %v", err)
+		log.New("server").Errorf("admin REST request failed: %v", err)
 		return
 	}
 	var prefixes []string
 	if err = json.Unmarshal(b, &prefixes); err != nil {
-		glog.Errorf("unable to parse admin REST response: %v", err)
+		log.New("server").Errorf("unable to parse admin REST response: %v", err)
 		return
 	}
 	var re *regexp.Regexp
 	if len(args) == 1 {
 		if re, err = regexp.Compile(args[0]); err != nil {
-			glog.Warningf("invalid regular expression %q; skipping regexp match and listing all zone prefixes", args[0])
+			log.New("server").Warningf("invalid regular expression %q; skipping regexp match and listing all zone prefixes", args[0])
 			re = nil
 		}
 	}
@@ -169,13 +169,13 @@ func runRmZone(cmd *commander.Command, args []string) {
 	}
 	req, err := http.NewRequest("DELETE", kv.HTTPAddr()+zoneKeyPrefix+"/"+args[0], nil)
 	if err != nil {
-		glog.Errorf("unable to create request to admin REST endpoint: %v", err)
+		log.New("server").Errorf("unable to create request to admin REST endpoint: %v", err)
 		return
 	}
 	// TODO(spencer): need to move to SSL.
 	_, err = sendAdminRequest(req)
 	if err != nil {
-		glog.Errorf("admin REST request failed: %v", err)
+		log.New("server").Errorf("admin REST request failed: %v", err)
 		return
 	}
 	fmt.Fprintf(os.Stdout, "removed zone config for key prefix %q\n", args[0])
@@ -229,18 +229,18 @@ func runSetZone(cmd *commander.Command, args []string) {
 	// Read in the config file.
 	body, err := ioutil.ReadFile(args[1])
 	if err != nil {
-		glog.Errorf("unable to read zone config file %q: %v", args[1], err)
+		log.New("server").Errorf("unable to read zone config file %q: %v", args[1], err)
 		return
 	}
 	req, err := http.NewRequest("POST", kv.HTTPAddr()+zoneKeyPrefix+"/"+args[0], bytes.NewReader(body))
 	if err != nil {
-		glog.Errorf("unable to create request to admin REST endpoint: %v", err)
+		log.New("server").Errorf("unable to create request to admin REST endpoint: %v", err)
 		return
 	}
 	// TODO(spencer): need to move to SSL.
 	_, err = sendAdminRequest(req)
 	if err != nil {
-		glog.Errorf("admin REST request failed: %v", err)
+		log.New("server").Errorf("admin REST request failed: %v", err)
 		return
 	}
 	fmt.Fprintf(os.Stdout, "set zone config for key prefix %q\n", args[0])
@@ -0,0 +1,173 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strconv"
+
+	"github.com/cockroachdb/cockroach/hlc"
+)
+
+// An AbortCache records the transactions whose write intents on a
+// range have been resolved as aborted. Requests of such transactions
+// are rejected with a TransactionAbortedError: otherwise, a zombie
+// coordinator unaware that its transaction was aborted could replay
+// writes which leave new intents behind after the transaction's
+// other intents were removed, and reads which no longer observe the
+// transaction's own writes.
+//
+// Coordinators also abort the intents of a transaction's epoch when
+// restarting it, so entries record the aborted epoch and only
+// requests at or below it are rejected.
+//
+// The AbortCache stores entries in the underlying engine, using keys
+// derived from keyLocalAbortCachePrefix, range ID and the transaction
+// ID. Entries are removed once their timestamp falls below the
+// range's GC threshold, at which point replayed writes are too old to
+// be of concern.
+type AbortCache struct {
+	rangeID int64
+	engine  Engine
+}
+
+// An AbortCacheEntry records an aborted transaction.
+type AbortCacheEntry struct {
+	Key       Key             // Anchor key of the transaction
+	Epoch     int32           // Latest epoch of the transaction aborted
+	Timestamp hlc.HLTimestamp // Timestamp of the transaction when aborted
+	Priority  int32           // Priority of the transaction when aborted
+}
+
+// NewAbortCache returns a new abort cache for the range with the
+// specified ID, backed by engine.
+func NewAbortCache(rangeID int64, engine Engine) *AbortCache {
+	return &AbortCache{rangeID: rangeID, engine: engine}
+}
+
+// abortCacheKeyPrefix returns the key prefix of all abort cache
+// entries for the range with the specified ID. The range ID is encoded
+// so that the entries of one range are not a prefix of another's.
+func abortCacheKeyPrefix(rangeID int64) Key {
+	return MakeKey(keyLocalAbortCachePrefix, encodeBytes([]byte(strconv.FormatInt(rangeID, 16))))
+}
+
+// abortCacheKey returns the key of the abort cache entry for the
+// transaction with the specified ID.
+func abortCacheKey(rangeID int64, txnID string) Key {
+	return MakeKey(abortCacheKeyPrefix(rangeID), Key(txnID))
+}
+
+// Get looks up the entry for the transaction with the specified ID.
+// Returns nil if the transaction hasn't been aborted.
+func (ac *AbortCache) Get(txnID string) (*AbortCacheEntry, error) {
+	entry := &AbortCacheEntry{}
+	ok, _, err := getI(ac.engine, abortCacheKey(ac.rangeID, txnID), entry)
+	if !ok || err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Add records txn as aborted at its current epoch. An entry for a
+// later epoch of the transaction is left in place.
+func (ac *AbortCache) Add(txn *Transaction) error {
+	existing, err := ac.Get(txn.ID)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.Epoch > txn.Epoch {
+		return nil
+	}
+	return putI(ac.engine, abortCacheKey(ac.rangeID, txn.ID), &AbortCacheEntry{
+		Key:       txn.Key,
+		Epoch:     txn.Epoch,
+		Timestamp: txn.Timestamp,
+		Priority:  txn.Priority,
+	})
+}
+
+// Check returns a TransactionAbortedError if txn has been aborted at
+// or after its current epoch.
+func (ac *AbortCache) Check(txn *Transaction) error {
+	entry, err := ac.Get(txn.ID)
+	if err != nil || entry == nil || entry.Epoch < txn.Epoch {
+		return err
+	}
+	aborted := *txn
+	aborted.Status = ABORTED
+	if aborted.Priority < entry.Priority {
+		aborted.Priority = entry.Priority
+	}
+	return &TransactionAbortedError{Txn: aborted}
+}
+
+// GC removes the entries of transactions aborted at timestamps below
+// threshold.
+func (ac *AbortCache) GC(threshold hlc.HLTimestamp) error {
+	prefix := abortCacheKeyPrefix(ac.rangeID)
+	kvs, err := ac.engine.scan(prefix, PrefixEndKey(prefix), 0)
+	if err != nil {
+		return err
+	}
+	var dels []Key
+	for _, kv := range kvs {
+		entry := &AbortCacheEntry{}
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value.Bytes)).Decode(entry); err != nil {
+			return err
+		}
+		if entry.Timestamp.Less(threshold) {
+			dels = append(dels, kv.Key)
+		}
+	}
+	if len(dels) == 0 {
+		return nil
+	}
+	return ac.engine.writeBatch(nil, dels)
+}
+
+// CopyInto copies all entries to the abort cache of the range with
+// the specified ID. This is used when a range is split or merged, so
+// that the range which takes over the keys of aborted transactions'
+// intents continues to reject their requests.
+func (ac *AbortCache) CopyInto(destRangeID int64) error {
+	prefix := abortCacheKeyPrefix(ac.rangeID)
+	destPrefix := abortCacheKeyPrefix(destRangeID)
+	kvs, err := ac.engine.scan(prefix, PrefixEndKey(prefix), 0)
+	if err != nil || len(kvs) == 0 {
+		return err
+	}
+	puts := make([]KeyValue, len(kvs))
+	for i, kv := range kvs {
+		puts[i] = KeyValue{Key: MakeKey(destPrefix, kv.Key[len(prefix):]), Value: kv.Value}
+	}
+	return ac.engine.writeBatch(puts, nil)
+}
+
+// ClearData removes all entries.
+func (ac *AbortCache) ClearData() error {
+	prefix := abortCacheKeyPrefix(ac.rangeID)
+	kvs, err := ac.engine.scan(prefix, PrefixEndKey(prefix), 0)
+	if err != nil || len(kvs) == 0 {
+		return err
+	}
+	dels := make([]Key, len(kvs))
+	for i, kv := range kvs {
+		dels[i] = kv.Key
+	}
+	return ac.engine.writeBatch(nil, dels)
+}
@@ -0,0 +1,192 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/hlc"
+)
+
+// TestAbortCache verifies that aborted transactions are rejected at
+// or below their aborted epoch, and that entries are garbage
+// collected, copied and cleared.
+func TestAbortCache(t *testing.T) {
+	engine := NewInMem(Attributes{}, 1<<20)
+	ac := NewAbortCache(1, engine)
+	txn := &Transaction{ID: "txn", Key: Key("a"), Epoch: 1, Priority: 5, Timestamp: hlc.HLTimestamp{WallTime: 10}}
+
+	if err := ac.Check(txn); err != nil {
+		t.Fatalf("expected transaction not yet aborted to pass: %v", err)
+	}
+	if err := ac.Add(txn); err != nil {
+		t.Fatal(err)
+	}
+	for _, epoch := range []int32{0, 1} {
+		zombie := *txn
+		zombie.Epoch = epoch
+		zombie.Priority = 1
+		err, ok := ac.Check(&zombie).(*TransactionAbortedError)
+		if !ok {
+			t.Fatalf("expected epoch %d to be rejected", epoch)
+		}
+		if err.Txn.Status != ABORTED || err.Txn.Priority != txn.Priority {
+			t.Errorf("expected aborted transaction with priority %d; got %s", txn.Priority, &err.Txn)
+		}
+	}
+	restarted := *txn
+	restarted.Epoch++
+	if err := ac.Check(&restarted); err != nil {
+		t.Errorf("expected restarted transaction to pass: %v", err)
+	}
+	// An abort of an earlier epoch doesn't regress the entry.
+	earlier := *txn
+	earlier.Epoch = 0
+	if err := ac.Add(&earlier); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := ac.Get(txn.ID); err != nil || entry == nil || entry.Epoch != 1 {
+		t.Errorf("expected entry at epoch 1; got %+v, %v", entry, err)
+	}
+
+	// Entries are copied into other ranges' caches.
+	if err := ac.CopyInto(2); err != nil {
+		t.Fatal(err)
+	}
+	ac2 := NewAbortCache(2, engine)
+	if err := ac2.Check(txn); err == nil {
+		t.Error("expected copied entry to reject transaction")
+	}
+	if err := ac2.ClearData(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ac2.Check(txn); err != nil {
+		t.Errorf("expected cleared cache to pass transaction: %v", err)
+	}
+
+	// Entries are only garbage collected once older than the threshold.
+	if err := ac.GC(txn.Timestamp); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := ac.Get(txn.ID); entry == nil {
+		t.Error("expected entry at threshold to remain")
+	}
+	if err := ac.GC(txn.Timestamp.Next()); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := ac.Get(txn.ID); entry != nil {
+		t.Errorf("expected entry below threshold to be removed; got %+v", entry)
+	}
+}
+
+// TestRangeAbortCacheRejectsZombie verifies that once a transaction's
+// intents on a range are resolved as aborted, the range rejects
+// further requests of the transaction's epoch, but not of its
+// restarted epochs.
+func TestRangeAbortCacheRejectsZombie(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	txn := NewTransaction(Key("a"), SERIALIZABLE, r.clock)
+	put := func(key string, txn *Transaction) error {
+		args := &PutRequest{
+			RequestHeader: RequestHeader{Timestamp: txn.Timestamp, Txn: txn},
+			Key:           Key(key),
+			Value:         Value{Bytes: []byte("value")},
+		}
+		return <-r.ReadWriteCmd("Put", args, &PutResponse{})
+	}
+	if err := put("a", txn); err != nil {
+		t.Fatal(err)
+	}
+	aborted := *txn
+	aborted.Status = ABORTED
+	resolveArgs := &InternalResolveIntentRequest{RequestHeader: RequestHeader{Txn: &aborted}, Key: Key("a")}
+	if err := <-r.ReadWriteCmd("InternalResolveIntent", resolveArgs, &InternalResolveIntentResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The zombie's replayed write and read are rejected.
+	if _, ok := put("a", txn).(*TransactionAbortedError); !ok {
+		t.Error("expected replayed write of aborted transaction to be rejected")
+	}
+	getArgs := &GetRequest{RequestHeader: RequestHeader{Timestamp: txn.Timestamp, Txn: txn}, Key: Key("a")}
+	if _, ok := r.ReadOnlyCmd("Get", getArgs, &GetResponse{}).(*TransactionAbortedError); !ok {
+		t.Error("expected read of aborted transaction to be rejected")
+	}
+	// A restarted epoch of the transaction proceeds.
+	restarted := *txn
+	restarted.Epoch++
+	if err := put("b", &restarted); err != nil {
+		t.Errorf("expected write of restarted transaction to succeed: %v", err)
+	}
+}
+
+// batchRecordingEngine records the writes applied by each call to
+// writeBatch.
+type batchRecordingEngine struct {
+	Engine
+	batches [][]Key // Keys written or deleted, per batch
+}
+
+func (e *batchRecordingEngine) writeBatch(puts []KeyValue, deletes []Key) error {
+	var keys []Key
+	for _, kv := range puts {
+		keys = append(keys, kv.Key)
+	}
+	e.batches = append(e.batches, append(keys, deletes...))
+	return e.Engine.writeBatch(puts, deletes)
+}
+
+// TestRangeResolveAbortedIntentBatch verifies that resolving the
+// intent of an aborted transaction removes the intent in the same
+// batch as the transaction's abort cache entry is written.
+func TestRangeResolveAbortedIntentBatch(t *testing.T) {
+	engine := &batchRecordingEngine{Engine: createTestEngine(t)}
+	r, _ := createTestRange(engine, t)
+	defer r.Stop()
+	txn := NewTransaction(Key("a"), SERIALIZABLE, r.clock)
+	args := &PutRequest{
+		RequestHeader: RequestHeader{Timestamp: txn.Timestamp, Txn: txn},
+		Key:           Key("a"),
+		Value:         Value{Bytes: []byte("value")},
+	}
+	if err := <-r.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	aborted := *txn
+	aborted.Status = ABORTED
+	engine.batches = nil
+	resolveArgs := &InternalResolveIntentRequest{RequestHeader: RequestHeader{Txn: &aborted}, Key: Key("a")}
+	if err := <-r.ReadWriteCmd("InternalResolveIntent", resolveArgs, &InternalResolveIntentResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, b := range engine.batches {
+		var intent, entry bool
+		for _, key := range b {
+			intent = intent || bytes.Equal(key, mvccEncodeKey(Key("a")))
+			entry = entry || bytes.Equal(key, abortCacheKey(r.Meta.RangeID, txn.ID))
+		}
+		if intent || entry {
+			found = append(found, fmt.Sprintf("intent=%t entry=%t", intent, entry))
+		}
+	}
+	if len(found) != 1 || found[0] != "intent=true entry=true" {
+		t.Errorf("expected intent and abort cache entry written in one batch; got %v", found)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// AcctUsage is the usage of the keys governed by an accounting
+// config: the MVCC stats of their ranges and the number of read and
+// write requests served. Request counts accumulate in memory from
+// the time each range replica is loaded, so restarting a node resets
+// the counts of its ranges.
+type AcctUsage struct {
+	MVCCStats
+	Reads, Writes int64
+}
+
+// Add adds the values from o to u.
+func (u *AcctUsage) Add(o AcctUsage) {
+	u.MVCCStats.Add(o.MVCCStats)
+	u.Reads += o.Reads
+	u.Writes += o.Writes
+}
+
+// A StoreAcctUsage is the usage of a store's ranges, keyed by the
+// prefix of the accounting config governing each range. It's
+// gossiped periodically by the store's node (see
+// gossip.KeyAcctUsagePrefix).
+type StoreAcctUsage struct {
+	NodeID    int32
+	StoreID   int32
+	Timestamp time.Time
+	Usage     map[string]AcctUsage
+}
+
+// Less compares two StoreAcctUsage records by timestamp.
+func (u StoreAcctUsage) Less(b util.Ordered) bool {
+	return u.Timestamp.Before(b.(StoreAcctUsage).Timestamp)
+}
+
+// recordRequest counts a request served by the range for
+// accounting. Internal and admin commands aren't counted.
+func (r *Range) recordRequest(method string) {
+	if strings.HasPrefix(method, "Internal") || strings.HasPrefix(method, "Admin") {
+		return
+	}
+	if IsReadOnly(method) {
+		atomic.AddInt64(&r.reads, 1)
+	} else {
+		atomic.AddInt64(&r.writes, 1)
+	}
+}
+
+// AcctUsage returns the usage of the range's keys.
+func (r *Range) AcctUsage() AcctUsage {
+	return AcctUsage{
+		MVCCStats: r.Stats(),
+		Reads:     atomic.LoadInt64(&r.reads),
+		Writes:    atomic.LoadInt64(&r.writes),
+	}
+}
+
+// AcctUsage returns the usage of the ranges for which this store's
+// replica is leader, keyed by the prefix of the gossiped accounting
+// config governing each range. Ranges are split at accounting
+// prefixes, so each range is attributed in full to the config
+// matching its start key.
+func (s *Store) AcctUsage() (StoreAcctUsage, error) {
+	usage := StoreAcctUsage{
+		NodeID:    s.Ident.NodeID,
+		StoreID:   s.Ident.StoreID,
+		Timestamp: time.Now(),
+		Usage:     map[string]AcctUsage{},
+	}
+	if s.gossip == nil {
+		return usage, util.Errorf("no gossip network to find accounting configs")
+	}
+	info, err := s.gossip.GetInfo(gossip.KeyConfigAccounting)
+	if err != nil {
+		return usage, util.Errorf("accounting configs unavailable: %v", err)
+	}
+	configMap, err := newPrefixConfigMap(info.([]*prefixConfig))
+	if err != nil {
+		return usage, util.Errorf("unable to build accounting config map: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rng := range s.ranges {
+		if !rng.IsLeader() {
+			continue
+		}
+		prefix := string(configMap.matchByPrefix(rng.getMeta().StartKey).Prefix)
+		u := usage.Usage[prefix]
+		u.Add(rng.AcctUsage())
+		usage.Usage[prefix] = u
+	}
+	return usage, nil
+}
+
+// GossipedAcctUsage returns the usage of the cluster, keyed by
+// accounting prefix, summed over the usage records of all stores
+// currently gossiped.
+func GossipedAcctUsage(g *gossip.Gossip) (map[string]AcctUsage, error) {
+	if g == nil {
+		return nil, util.Errorf("no gossip network to find accounting usage")
+	}
+	infos, err := g.GetGroupInfos(gossip.KeyAcctUsagePrefix)
+	if err != nil {
+		return nil, err
+	}
+	usage := map[string]AcctUsage{}
+	for _, info := range infos {
+		su, ok := info.(StoreAcctUsage)
+		if !ok {
+			continue
+		}
+		for prefix, o := range su.Usage {
+			u := usage[prefix]
+			u.Add(o)
+			usage[prefix] = u
+		}
+	}
+	return usage, nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/hlc"
+)
+
+// TestStoreAcctUsage verifies that a store attributes the requests
+// and stats of its ranges to the accounting prefixes governing them,
+// and that gossiped usage is summed across stores.
+func TestStoreAcctUsage(t *testing.T) {
+	g := gossip.New()
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), NewInMem(Attributes{}, 1<<20), nil, g)
+	if err := store.Bootstrap(StoreIdent{ClusterID: testIdent.ClusterID, NodeID: 1, StoreID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	db := &storeDB{store: store}
+	if _, err := store.CreateRange(KeyMin, Key("/db1"), []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateRange(Key("/db1"), KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	// Gossip accounting configs after creating the ranges, which may
+	// gossip the (empty) configs of their engine.
+	configs := []*prefixConfig{
+		{KeyMin, &AcctConfig{}},
+		{Key("/db1"), &AcctConfig{Account: "db1"}},
+	}
+	if err := g.AddInfo(gossip.KeyConfigAccounting, configs, 0*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []Key{Key("/db1/a"), Key("/db1/b")} {
+		if reply := <-db.Put(&PutRequest{Key: key, Value: Value{Bytes: []byte("value")}}); reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+	if reply := <-db.Scan(&ScanRequest{StartKey: Key("/db1"), EndKey: Key("/db2")}); reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+
+	usage, err := store.AcctUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.NodeID != 1 || usage.StoreID != 1 {
+		t.Errorf("expected usage of node 1, store 1; got %+v", usage)
+	}
+	db1 := usage.Usage["/db1"]
+	if db1.Reads != 1 || db1.Writes != 2 {
+		t.Errorf("expected 1 read and 2 writes under /db1; got %+v", db1)
+	}
+	if db1.LiveCount != 2 || db1.LiveBytes == 0 {
+		t.Errorf("expected 2 live keys under /db1; got %+v", db1.MVCCStats)
+	}
+	if def := usage.Usage[""]; def.Reads != 0 || def.Writes != 0 {
+		t.Errorf("expected no requests under default prefix; got %+v", def)
+	}
+
+	// Gossip the store's usage along with that of another store and
+	// verify the usage is summed.
+	if err := g.RegisterGroup(gossip.KeyAcctUsagePrefix, 10, gossip.MaxGroup); err != nil {
+		t.Fatal(err)
+	}
+	other := StoreAcctUsage{
+		NodeID:    2,
+		StoreID:   2,
+		Timestamp: time.Now(),
+		Usage:     map[string]AcctUsage{"/db1": {Reads: 3, Writes: 4}},
+	}
+	for _, u := range []StoreAcctUsage{usage, other} {
+		if err := g.AddInfo(gossip.MakeAcctUsageKey(u.NodeID, u.StoreID), u, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	total, err := GossipedAcctUsage(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db1 := total["/db1"]; db1.Reads != 4 || db1.Writes != 6 {
+		t.Errorf("expected 4 reads and 6 writes under /db1; got %+v", db1)
+	}
+}
+
+// TestAcctUsageNoConfigs verifies that usage is unavailable without
+// gossiped accounting configs.
+func TestAcctUsageNoConfigs(t *testing.T) {
+	store := createTestStore(1, 1, t)
+	defer store.Close()
+	if _, err := store.AcctUsage(); err == nil {
+		t.Error("expected error without gossip")
+	}
+	if _, err := GossipedAcctUsage(nil); err == nil {
+		t.Error("expected error without gossip")
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/metrics"
+)
+
+// AdmissionLimits bound the client requests a store executes at once
+// and the load under which it accepts them. Requests in excess of
+// MaxInFlight are queued in the order received; requests which can't
+// be queued, or which arrive while the store is overloaded, are shed
+// with an OverloadedError. Internal and admin commands, which the
+// cluster relies on to make progress, aren't subject to admission.
+type AdmissionLimits struct {
+	MaxInFlight         int           // Maximum requests executing at once; 0 for no limit
+	MaxQueued           int           // Maximum requests queued for admission; 0 for no limit
+	MaxQueueWait        time.Duration // Maximum time queued for admission; 0 for no limit
+	MaxQueuedWrites     int           // Writes admitted but not yet applied above which writes are shed; 0 for no limit
+	MaxPendingProposals int           // Commands proposed but not yet applied above which writes are shed; 0 for no limit
+	MaxHeapBytes        uint64        // Heap in use above which requests are shed; 0 for no limit
+}
+
+// DefaultAdmissionLimits are the admission limits of new stores.
+var DefaultAdmissionLimits = AdmissionLimits{
+	MaxInFlight:         256,
+	MaxQueued:           1024,
+	MaxQueueWait:        1 * time.Second,
+	MaxQueuedWrites:     4096,
+	MaxPendingProposals: 4096,
+}
+
+// heapSampleInterval is the interval at which admission samples the
+// process's heap usage. Reading memory statistics stops the world, so
+// isn't done for every request.
+const heapSampleInterval = 100 * time.Millisecond
+
+// Metrics of the admission of requests to all stores in the process.
+var (
+	admissionQueue = metrics.DefaultRegistry.Gauge("store_admission_queue_depth")
+	admissionWait  = metrics.DefaultRegistry.Histogram("store_admission_wait_ns", metrics.LatencyBuckets)
+	admissionShed  = metrics.DefaultRegistry.Counter("store_admission_shed")
+)
+
+// admission admits client requests to a store's ranges according to
+// the store's admission limits. A nil admission admits every request,
+// as is the case for ranges which don't belong to a store.
+type admission struct {
+	ident     *StoreIdent // Identifies the store in OverloadedErrors
+	inFlight  *semaphore  // Bounds requests executing at once
+	stopper   *util.Stopper
+	writes    int64 // Writes admitted but not yet applied; atomic
+	proposals int64 // Commands proposed but not yet applied; atomic
+
+	mu          sync.Mutex // Protects the fields below
+	limits      AdmissionLimits
+	heapBytes   uint64        // Heap in use as of heapSampled
+	heapSampled time.Time     // Time of the last heap sample
+	readHeap    func() uint64 // Samples heap usage; replaced by tests
+}
+
+// newAdmission returns an admission with the default limits for the
+// store identified by ident. Queued requests are abandoned when
+// stopper is stopped.
+func newAdmission(ident *StoreIdent, stopper *util.Stopper) *admission {
+	return &admission{
+		ident:    ident,
+		inFlight: newSemaphore(DefaultAdmissionLimits.MaxInFlight, admissionQueue, admissionWait),
+		stopper:  stopper,
+		limits:   DefaultAdmissionLimits,
+		readHeap: readHeapInUse,
+	}
+}
+
+// readHeapInUse returns the bytes of heap allocated by the process.
+func readHeapInUse() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// setLimits changes the admission limits. Queued requests are
+// admitted as soon as the new limits allow.
+func (a *admission) setLimits(limits AdmissionLimits) {
+	a.mu.Lock()
+	a.limits = limits
+	a.mu.Unlock()
+	a.inFlight.setLimit(limits.MaxInFlight)
+}
+
+// isAdmissionExempt returns true if the command bypasses admission.
+func isAdmissionExempt(method string) bool {
+	return strings.HasPrefix(method, "Internal") || strings.HasPrefix(method, "Admin")
+}
+
+// admit blocks until the command may execute and returns a function
+// which the caller must invoke once it has executed, or been applied
+// in the case of writes. Returns an OverloadedError if the command is
+// shed, or an error if the store is stopped while the command is
+// queued.
+func (a *admission) admit(method string, write bool) (func(), error) {
+	if a == nil || isAdmissionExempt(method) {
+		return func() {}, nil
+	}
+	a.mu.Lock()
+	limits := a.limits
+	heap := a.sampleHeapLocked(time.Now())
+	a.mu.Unlock()
+
+	if limits.MaxHeapBytes > 0 && heap > limits.MaxHeapBytes {
+		return nil, a.shed("heap usage %d bytes exceeds %d", heap, limits.MaxHeapBytes)
+	}
+	if write {
+		if n := atomic.LoadInt64(&a.writes); limits.MaxQueuedWrites > 0 && n >= int64(limits.MaxQueuedWrites) {
+			return nil, a.shed("%d writes queued", n)
+		}
+		if n := atomic.LoadInt64(&a.proposals); limits.MaxPendingProposals > 0 && n >= int64(limits.MaxPendingProposals) {
+			return nil, a.shed("%d proposals pending", n)
+		}
+	}
+	ok, err := a.inFlight.tryAcquire(a.stopper.ShouldStop(), limits.MaxQueued, limits.MaxQueueWait)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, a.shed("too many requests in flight")
+	}
+	if !write {
+		return a.inFlight.release, nil
+	}
+	atomic.AddInt64(&a.writes, 1)
+	return func() {
+		atomic.AddInt64(&a.writes, -1)
+		a.inFlight.release()
+	}, nil
+}
+
+// propose records that n commands were proposed, or, for negative n,
+// applied.
+func (a *admission) propose(n int64) {
+	if a != nil {
+		atomic.AddInt64(&a.proposals, n)
+	}
+}
+
+// sampleHeapLocked returns the heap usage of the process, sampling it
+// anew if the last sample is older than heapSampleInterval. Heap usage
+// isn't sampled without a limit on it.
+func (a *admission) sampleHeapLocked(now time.Time) uint64 {
+	if a.limits.MaxHeapBytes > 0 && now.Sub(a.heapSampled) >= heapSampleInterval {
+		a.heapBytes = a.readHeap()
+		a.heapSampled = now
+	}
+	return a.heapBytes
+}
+
+// shed records a shed request and returns an OverloadedError with
+// the reason formatted from format and args.
+func (a *admission) shed(format string, args ...interface{}) error {
+	admissionShed.Inc(1)
+	return &OverloadedError{StoreID: a.ident.StoreID, Reason: fmt.Sprintf(format, args...)}
+}
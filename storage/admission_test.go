@@ -0,0 +1,154 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestAdmissionQueue verifies that requests in excess of the in-flight
+// limit are queued in order, and shed once the queue is full or
+// they've waited too long.
+func TestAdmissionQueue(t *testing.T) {
+	stopper := util.NewStopper()
+	defer stopper.Stop()
+	a := newAdmission(&StoreIdent{StoreID: 1}, stopper)
+	a.setLimits(AdmissionLimits{MaxInFlight: 1, MaxQueued: 1})
+
+	release, err := a.admit("Get", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admitted := make(chan func())
+	go func() {
+		r, err := a.admit("Get", false)
+		if err != nil {
+			t.Error(err)
+		}
+		admitted <- r
+	}()
+	// Wait for the second request to queue; the third is shed.
+	if err := util.IsTrueWithin(func() bool { return admissionQueue.Value() > 0 }, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.admit("Put", true); err == nil {
+		t.Error("expected request to be shed with full queue")
+	} else if _, ok := err.(*OverloadedError); !ok {
+		t.Errorf("expected OverloadedError; got %v", err)
+	}
+	release()
+	release = <-admitted
+
+	// Requests queued longer than the maximum wait are shed.
+	a.setLimits(AdmissionLimits{MaxInFlight: 1, MaxQueueWait: time.Millisecond})
+	if _, err := a.admit("Get", false); err == nil {
+		t.Error("expected request to be shed after waiting")
+	}
+	release()
+	if release, err = a.admit("Get", false); err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+// TestAdmissionOverload verifies that writes are shed while too many
+// writes or proposals are pending, that all requests are shed while
+// heap usage is too high, and that internal commands are exempt.
+func TestAdmissionOverload(t *testing.T) {
+	stopper := util.NewStopper()
+	defer stopper.Stop()
+	a := newAdmission(&StoreIdent{StoreID: 1}, stopper)
+	a.setLimits(AdmissionLimits{MaxQueuedWrites: 1, MaxPendingProposals: 1, MaxHeapBytes: 1 << 20})
+	heap := uint64(0)
+	a.readHeap = func() uint64 { return heap }
+
+	release, err := a.admit("Put", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.admit("Put", true); err == nil {
+		t.Error("expected write to be shed with full write queue")
+	}
+	if r, err := a.admit("Get", false); err != nil {
+		t.Errorf("expected read to be admitted: %v", err)
+	} else {
+		r()
+	}
+	release()
+
+	a.propose(1)
+	if _, err := a.admit("Put", true); err == nil {
+		t.Error("expected write to be shed with pending proposals")
+	}
+	a.propose(-1)
+	if release, err = a.admit("Put", true); err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	heap = 2 << 20
+	a.mu.Lock()
+	a.heapSampled = time.Time{}
+	a.mu.Unlock()
+	if _, err := a.admit("Get", false); err == nil {
+		t.Error("expected read to be shed with heap usage over limit")
+	}
+	if release, err = a.admit("InternalRangeLookup", false); err != nil {
+		t.Errorf("expected internal command to be exempt: %v", err)
+	}
+	release()
+}
+
+// TestRangeAdmission verifies that ranges shed client requests, but
+// not internal commands, when their store is overloaded.
+func TestRangeAdmission(t *testing.T) {
+	store := createTestStore(1, 1, t)
+	defer store.Close()
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.admission.readHeap = func() uint64 { return 2 }
+	store.SetAdmissionLimits(AdmissionLimits{MaxHeapBytes: 1})
+
+	putArgs := &PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}
+	putReply := &PutResponse{}
+	if _, ok := (<-rng.ReadWriteCmd("Put", putArgs, putReply)).(*OverloadedError); !ok {
+		t.Errorf("expected write to be shed; got %v", putReply.Error)
+	}
+	getReply := &GetResponse{}
+	if err := rng.ReadOnlyCmd("Get", &GetRequest{Key: Key("a")}, getReply); err == nil {
+		t.Error("expected read to be shed")
+	} else if oErr, ok := getReply.Error.(*OverloadedError); !ok || oErr.StoreID != 1 {
+		t.Errorf("expected OverloadedError from store 1; got %v", getReply.Error)
+	}
+	lookupArgs := &InternalRangeLookupRequest{Key: RangeMetaKey(Key("a"))}
+	err = rng.ReadOnlyCmd("InternalRangeLookup", lookupArgs, &InternalRangeLookupResponse{})
+	if _, ok := err.(*OverloadedError); ok {
+		t.Errorf("expected internal command to be admitted: %v", err)
+	}
+
+	store.SetAdmissionLimits(DefaultAdmissionLimits)
+	if err := <-rng.ReadWriteCmd("Put", putArgs, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if w := store.admission.writes; w != 0 {
+		t.Errorf("expected no queued writes once applied; got %d", w)
+	}
+}
@@ -20,53 +20,237 @@ package storage
 
 import (
 	"math/rand"
+	"sync"
+	"time"
 
+	"github.com/cockroachdb/cockroach/gossip"
 	"github.com/cockroachdb/cockroach/util"
 )
 
+// maxFractionUsedThreshold is the fraction of a store's capacity
+// beyond which the store is considered nearly full. Nearly full
+// stores are never chosen as allocation targets, nor are stores which
+// advertise themselves as full at a lower threshold.
+const maxFractionUsedThreshold = 0.95
+
+// DefaultFullThreshold is the default fraction of a store's capacity
+// in use beyond which the store refuses new replicas; see
+// Store.SetFullThreshold.
+const DefaultFullThreshold = maxFractionUsedThreshold
+
+// allocatorRetryOptions are the options with which an allocator waits
+// for the first stores to be found, e.g. until the store descriptors
+// gossiped by the cluster reach a node which has just started.
+var allocatorRetryOptions = util.RetryOptions{
+	Tag:         "find stores for allocation",
+	Backoff:     50 * time.Millisecond,
+	MaxBackoff:  1 * time.Second,
+	Constant:    2,
+	MaxDuration: 5 * time.Second,
+	UseJitter:   true,
+}
+
 // StoreFinder finds the disks in a datacenter with the most available capacity.
 type StoreFinder func(Attributes) ([]*StoreDescriptor, error)
 
+// newGossipStoreFinder returns a StoreFinder which finds stores
+// matching the required attributes from the store descriptors
+// gossiped by each node (see KeyMaxAvailCapacityPrefix). Stores are
+// gossiped in groups by their combined node and store attributes;
+// every group is searched for stores whose attributes are a superset
+// of the required attributes.
+func newGossipStoreFinder(g *gossip.Gossip) StoreFinder {
+	return func(required Attributes) ([]*StoreDescriptor, error) {
+		if g == nil {
+			return nil, util.Errorf("no gossip network to find stores")
+		}
+		var stores []*StoreDescriptor
+		for _, prefix := range g.GetGroupPrefixes(gossip.KeyMaxAvailCapacityPrefix) {
+			infos, err := g.GetGroupInfos(prefix)
+			if err != nil {
+				return nil, err
+			}
+			for _, info := range infos {
+				desc, ok := info.(StoreDescriptor)
+				if !ok {
+					continue
+				}
+				if l, ok := gossipedLiveness(g, desc.Node.NodeID); ok && l.Decommissioning {
+					continue
+				}
+				if required.IsSubset(desc.CombinedAttrs()) {
+					stores = append(stores, &desc)
+				}
+			}
+		}
+		return stores, nil
+	}
+}
+
+// A ClusterCapacity summarizes the capacity of the stores gossiped by
+// the cluster's nodes.
+type ClusterCapacity struct {
+	StoreCount int
+	Capacity   int64 // Total capacity of all stores in bytes
+	Available  int64 // Total available bytes of all stores
+	RangeCount int   // Total range replicas on all stores
+	FullCount  int   // Stores too full to be allocation targets
+}
+
+// FractionUsed returns the fraction of the cluster's total capacity
+// which is in use.
+func (cc ClusterCapacity) FractionUsed() float64 {
+	return StoreCapacity{Capacity: cc.Capacity, Available: cc.Available}.FractionUsed()
+}
+
+// clusterCapacity returns the summary of the capacity of the stores
+// found by the allocator's store finder.
+func (a *allocator) clusterCapacity() (ClusterCapacity, error) {
+	stores, err := a.storeFinder(Attributes{})
+	if err != nil {
+		return ClusterCapacity{}, err
+	}
+	var cc ClusterCapacity
+	for _, s := range stores {
+		cc.StoreCount++
+		cc.Capacity += s.Capacity.Capacity
+		cc.Available += s.Capacity.Available
+		cc.RangeCount += s.Capacity.RangeCount
+		if isFull(s) {
+			cc.FullCount++
+		}
+	}
+	return cc, nil
+}
+
 // allocator makes allocation decisions based on a zone configuration,
 // existing range metadata and available stores. Configuration
 // settings and range metadata information is stored directly in the
 // engine-backed range they describe. Information on suitability and
-// availability of servers is gleaned from the gossip network.
+// availability of servers is gleaned from the gossip network, via the
+// store's storePool.
 type allocator struct {
 	storeFinder StoreFinder
+	retryOpts   *util.RetryOptions // Waits for the first stores to be found; nil to fail at once
+	mu          sync.Mutex         // Protects rand
 	rand        rand.Rand
 }
 
+// newAllocator returns an allocator which finds candidate stores
+// via storeFinder. Allocations made before any store has been found
+// wait for stores with backoff until stopper is stopped or
+// allocatorRetryOptions gives up.
+func newAllocator(storeFinder StoreFinder, stopper *util.Stopper) *allocator {
+	retryOpts := allocatorRetryOptions
+	retryOpts.Stopper = stopper
+	return &allocator{
+		storeFinder: storeFinder,
+		retryOpts:   &retryOpts,
+		rand:        *rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// waitForStores returns once the allocator's store finder finds any
+// store, or with an error if the finder fails or the allocator's
+// retry options give up first. It returns at once if the allocator
+// has no retry options.
+func (a *allocator) waitForStores() error {
+	if a.retryOpts == nil {
+		return nil
+	}
+	return util.RetryWithBackoff(*a.retryOpts, func() (bool, error) {
+		stores, err := a.storeFinder(Attributes{})
+		return len(stores) > 0, err
+	})
+}
+
+// allocateMissing returns a suitable store for a replica required by
+// the zone config which is missing from existingReplicas. Each
+// existing replica satisfies at most one of the zone's required
+// attribute sets; the first unsatisfied set is allocated. Returns nil
+// if the range has all replicas required by the zone config.
+func (a *allocator) allocateMissing(zone *ZoneConfig, existingReplicas []Replica) (*StoreDescriptor, error) {
+	used := make([]bool, len(existingReplicas))
+	for _, required := range zone.Replicas {
+		satisfied := false
+		for i, replica := range existingReplicas {
+			if !used[i] && required.IsSubset(replica.Attrs) {
+				used[i], satisfied = true, true
+				break
+			}
+		}
+		if !satisfied {
+			return a.allocate(required, existingReplicas)
+		}
+	}
+	return nil, nil
+}
+
 // allocate returns a suitable store based on the supplied
 // attributes list. If none are available / suitable, returns an
 // error. It uses the allocator's StoreFinder to select the set of
 // available stores matching attributes for missing replicas and picks
 // using randomly weighted selection based on available capacities.
+// Stores on nodes which already hold one of existingReplicas, stores
+// which are nearly full and draining stores are never chosen. If no
+// store has been found yet, allocate waits for stores to be gossiped
+// (see newAllocator). Only
+// the stores whose localities are most diverse from those of the
+// existing replicas are considered (see diversityScore).
 func (a *allocator) allocate(required Attributes, existingReplicas []Replica) (
 	*StoreDescriptor, error) {
+	return a.allocateFiltered(required, existingReplicas, nil)
+}
+
+// allocateFiltered is like allocate, but further restricts the
+// candidate stores to those for which filter, if not nil, returns
+// true.
+func (a *allocator) allocateFiltered(required Attributes, existingReplicas []Replica,
+	filter func(*StoreDescriptor) bool) (*StoreDescriptor, error) {
 	// Get a set of current nodes -- we never want to allocate on an existing node.
 	usedNodes := make(map[int32]struct{})
 	for _, replica := range existingReplicas {
 		usedNodes[replica.NodeID] = struct{}{}
 	}
 
+	if err := a.waitForStores(); err != nil {
+		return nil, err
+	}
 	stores, err := a.storeFinder(required)
 	if err != nil {
 		return nil, err
 	}
 
-	// Randomly pick a node weighted by capacity.
+	// Randomly pick a node weighted by capacity among the candidates
+	// most diverse from the existing replicas.
 	var candidates []*StoreDescriptor
 	var capacityTotal float64
+	maxScore := -1.0
 	for _, s := range stores {
-		if _, ok := usedNodes[s.Node.NodeID]; !ok {
-			candidates = append(candidates, s)
-			capacityTotal += s.Capacity.PercentAvail()
+		if _, ok := usedNodes[s.Node.NodeID]; ok {
+			continue
+		}
+		// Skip stores which are nearly full or being drained.
+		if isFull(s) || s.Draining {
+			continue
+		}
+		if filter != nil && !filter(s) {
+			continue
+		}
+		score := diversityScore(s.CombinedAttrs(), existingReplicas)
+		if score < maxScore {
+			continue
+		} else if score > maxScore {
+			candidates, capacityTotal, maxScore = nil, 0, score
 		}
+		candidates = append(candidates, s)
+		capacityTotal += s.Capacity.PercentAvail()
 	}
 
 	var capacitySeen float64
+	a.mu.Lock()
 	targetCapacity := a.rand.Float64() * capacityTotal
+	a.mu.Unlock()
 
 	// Walk through candidates, stopping when
 	// we've passed the capacity target.
@@ -78,3 +262,52 @@ func (a *allocator) allocate(required Attributes, existingReplicas []Replica) (
 	}
 	return nil, util.Errorf("unable to find an appropriate store for requested replica attributes")
 }
+
+// rebalanceTarget returns a store to which a replica with the
+// required attributes may be moved from an overloaded store, chosen
+// among the stores which are underloaded relative to the mean load
+// of all stores: a store is underloaded if neither its fraction of
+// capacity used nor its range count exceeds the mean, and at least
+// one of them is below the mean. Returns an error if no store is
+// suitable.
+func (a *allocator) rebalanceTarget(required Attributes, existingReplicas []Replica,
+	allStores []*StoreDescriptor) (*StoreDescriptor, error) {
+	meanFractionUsed, meanRangeCount := meanStoreLoad(allStores)
+	return a.allocateFiltered(required, existingReplicas, func(s *StoreDescriptor) bool {
+		fractionUsed, rangeCount := s.Capacity.FractionUsed(), float64(s.Capacity.RangeCount)
+		return fractionUsed <= meanFractionUsed && rangeCount <= meanRangeCount &&
+			(fractionUsed < meanFractionUsed || rangeCount < meanRangeCount)
+	})
+}
+
+// meanStoreLoad returns the mean fraction of capacity used and the
+// mean range count of the supplied stores.
+func meanStoreLoad(stores []*StoreDescriptor) (fractionUsed, rangeCount float64) {
+	if len(stores) == 0 {
+		return 0, 0
+	}
+	for _, s := range stores {
+		fractionUsed += s.Capacity.FractionUsed()
+		rangeCount += float64(s.Capacity.RangeCount)
+	}
+	return fractionUsed / float64(len(stores)), rangeCount / float64(len(stores))
+}
+
+// isFull returns true if the store advertises itself as full, or if
+// it's nearly full regardless.
+func isFull(store *StoreDescriptor) bool {
+	return store.Full || store.Capacity.FractionUsed() >= maxFractionUsedThreshold
+}
+
+// isOverloaded returns true if the store's fraction of capacity used
+// exceeds the mean of all stores by more than rebalanceThreshold, or
+// if its range count exceeds the mean by more than rebalanceThreshold
+// of the mean and by at least one range.
+func isOverloaded(store *StoreDescriptor, allStores []*StoreDescriptor) bool {
+	meanFractionUsed, meanRangeCount := meanStoreLoad(allStores)
+	if store.Capacity.FractionUsed() > meanFractionUsed+rebalanceThreshold {
+		return true
+	}
+	rangeCount := float64(store.Capacity.RangeCount)
+	return rangeCount > meanRangeCount*(1+rebalanceThreshold) && rangeCount >= meanRangeCount+1
+}
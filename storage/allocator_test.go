@@ -18,8 +18,13 @@
 package storage
 
 import (
+	"math"
 	"math/rand"
 	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/util"
 )
 
 var simpleZoneConfig = ZoneConfig{
@@ -200,6 +205,34 @@ func TestNoAvailableDisks(t *testing.T) {
 	}
 }
 
+// TestAllocatorWaitsForStores verifies that an allocation made
+// before any store has been found waits for stores to be found, and
+// that waiting is abandoned once the allocator's stopper is stopped.
+func TestAllocatorWaitsForStores(t *testing.T) {
+	stopper := util.NewStopper()
+	var calls int
+	a := newAllocator(func(required Attributes) ([]*StoreDescriptor, error) {
+		if calls++; calls < 3 {
+			return noStores(required)
+		}
+		return singleStore(required)
+	}, stopper)
+	a.retryOpts.Backoff = time.Millisecond
+	result, err := a.allocate(simpleZoneConfig.Replicas[0], []Replica{})
+	if err != nil {
+		t.Fatalf("Unable to perform allocation: %v", err)
+	}
+	if result.StoreID != 1 || calls != 4 {
+		t.Errorf("expected store 1 after 3 searches for any store; got %+v after %d", result, calls-1)
+	}
+
+	a.storeFinder = noStores
+	stopper.Stop()
+	if _, err := a.allocate(simpleZoneConfig.Replicas[0], []Replica{}); err == nil {
+		t.Error("expected error allocating once stopped without stores")
+	}
+}
+
 func TestThreeDisksSameDC(t *testing.T) {
 	var a = allocator{
 		storeFinder: sameDCStores,
@@ -286,3 +319,264 @@ func TestExistingReplica(t *testing.T) {
 		t.Errorf("expected result to have node 3 and store 4: %+v", result)
 	}
 }
+
+func TestNearlyFullStores(t *testing.T) {
+	var a = allocator{
+		storeFinder: func(attrs Attributes) ([]*StoreDescriptor, error) {
+			return filterStores(attrs, []*StoreDescriptor{
+				&StoreDescriptor{
+					StoreID:  1,
+					Attrs:    Attributes([]string{"ssd"}),
+					Node:     NodeDescriptor{NodeID: 1, Attrs: Attributes([]string{"a"})},
+					Capacity: StoreCapacity{Capacity: 100, Available: 2},
+				},
+				&StoreDescriptor{
+					StoreID:  2,
+					Attrs:    Attributes([]string{"ssd"}),
+					Node:     NodeDescriptor{NodeID: 2, Attrs: Attributes([]string{"a"})},
+					Capacity: StoreCapacity{Capacity: 100, Available: 10},
+				},
+			})
+		},
+		rand: *rand.New(rand.NewSource(0)),
+	}
+	for i := 0; i < 10; i++ {
+		result, err := a.allocate(simpleZoneConfig.Replicas[0], []Replica{})
+		if err != nil {
+			t.Fatalf("Unable to perform allocation: %v", err)
+		}
+		if result.StoreID != 2 {
+			t.Fatalf("expected nearly full store 1 to be skipped; got %+v", result)
+		}
+	}
+	if _, err := a.allocate(simpleZoneConfig.Replicas[0], []Replica{{NodeID: 2, StoreID: 2}}); err == nil {
+		t.Errorf("expected error allocating with only a nearly full store available")
+	}
+}
+
+// TestFullStores verifies that stores advertising themselves as full
+// aren't allocated replicas, regardless of their available capacity.
+func TestFullStores(t *testing.T) {
+	full := loadedStore(1, 50, 10)
+	full.Full = true
+	stores := []*StoreDescriptor{full, loadedStore(2, 50, 10)}
+	a := allocator{
+		storeFinder: func(attrs Attributes) ([]*StoreDescriptor, error) { return filterStores(attrs, stores) },
+		rand:        *rand.New(rand.NewSource(0)),
+	}
+	for i := 0; i < 10; i++ {
+		result, err := a.allocate(simpleZoneConfig.Replicas[0], []Replica{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.StoreID != 2 {
+			t.Fatalf("expected full store 1 to be skipped; got %+v", result)
+		}
+	}
+	if cc, err := a.clusterCapacity(); err != nil || cc.FullCount != 1 {
+		t.Errorf("expected 1 full store; got %+v, %v", cc, err)
+	}
+}
+
+// TestDrainingStores verifies that draining stores aren't allocated
+// replicas.
+func TestDrainingStores(t *testing.T) {
+	draining := loadedStore(1, 0, 0)
+	draining.Draining = true
+	stores := []*StoreDescriptor{draining, loadedStore(2, 50, 10)}
+	var a = allocator{
+		storeFinder: func(attrs Attributes) ([]*StoreDescriptor, error) { return filterStores(attrs, stores) },
+		rand:        *rand.New(rand.NewSource(0)),
+	}
+	for i := 0; i < 10; i++ {
+		result, err := a.allocate(simpleZoneConfig.Replicas[0], []Replica{})
+		if err != nil {
+			t.Fatalf("Unable to perform allocation: %v", err)
+		}
+		if result.StoreID != 2 {
+			t.Fatalf("expected draining store 1 to be skipped; got %+v", result)
+		}
+	}
+}
+
+func TestAllocateMissing(t *testing.T) {
+	var a = allocator{
+		storeFinder: sameDCStores,
+		rand:        *rand.New(rand.NewSource(0)),
+	}
+	existing := []Replica{
+		Replica{NodeID: 1, StoreID: 1, Attrs: Attributes([]string{"a", "ssd"})},
+		Replica{NodeID: 4, StoreID: 5, Attrs: Attributes([]string{"a", "mem"})},
+	}
+	result, err := a.allocateMissing(&multiDisksConfig, existing)
+	if err != nil {
+		t.Fatalf("Unable to perform allocation: %v", err)
+	}
+	if result == nil || result.Node.NodeID == 1 || result.Node.NodeID == 4 ||
+		!multiDisksConfig.Replicas[1].IsSubset(result.CombinedAttrs()) {
+		t.Fatalf("expected an hdd store on a new node; got %+v", result)
+	}
+	existing = append(existing, Replica{NodeID: result.Node.NodeID, StoreID: result.StoreID, Attrs: result.CombinedAttrs()})
+	if result, err = a.allocateMissing(&multiDisksConfig, existing); result != nil || err != nil {
+		t.Errorf("expected no allocation for fully replicated range; got %+v, %v", result, err)
+	}
+}
+
+func TestGossipStoreFinder(t *testing.T) {
+	g := gossip.New()
+	stores, err := sameDCStores(Attributes{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stores {
+		attrs := s.CombinedAttrs().SortedString()
+		g.RegisterGroup(gossip.MakeMaxAvailCapacityGroup(attrs), 10, gossip.MaxGroup)
+		if err := g.AddInfo(gossip.MakeMaxAvailCapacityKey(attrs, s.Node.NodeID, s.StoreID), *s, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	finder := newGossipStoreFinder(g)
+	found, err := finder(Attributes([]string{"hdd"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeIDs := map[int32]struct{}{}
+	for _, s := range found {
+		storeIDs[s.StoreID] = struct{}{}
+	}
+	if _, ok3 := storeIDs[3]; len(found) != 2 || !ok3 {
+		t.Errorf("expected hdd stores 3 and 4; got %+v", found)
+	}
+	if found, err = finder(Attributes([]string{"a"})); err != nil || len(found) != len(stores) {
+		t.Errorf("expected all %d stores; got %d, %v", len(stores), len(found), err)
+	}
+}
+
+// loadedStore returns a store descriptor on its own node with the
+// specified fraction of capacity used and range count.
+func loadedStore(storeID int32, percentUsed int64, rangeCount int) *StoreDescriptor {
+	return &StoreDescriptor{
+		StoreID:  storeID,
+		Attrs:    Attributes([]string{"ssd"}),
+		Node:     NodeDescriptor{NodeID: storeID, Attrs: Attributes([]string{"a"})},
+		Capacity: StoreCapacity{Capacity: 100, Available: 100 - percentUsed, RangeCount: rangeCount},
+	}
+}
+
+func TestClusterCapacity(t *testing.T) {
+	stores := []*StoreDescriptor{
+		loadedStore(1, 20, 5),
+		loadedStore(2, 60, 10),
+		loadedStore(3, 96, 15),
+	}
+	a := allocator{
+		storeFinder: func(attrs Attributes) ([]*StoreDescriptor, error) { return filterStores(attrs, stores) },
+	}
+	cc, err := a.clusterCapacity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expCC := ClusterCapacity{StoreCount: 3, Capacity: 300, Available: 124, RangeCount: 30, FullCount: 1}
+	if cc != expCC {
+		t.Errorf("expected cluster capacity %+v; got %+v", expCC, cc)
+	}
+	if fractionUsed := cc.FractionUsed(); math.Abs(fractionUsed-176.0/300) > 1e-9 {
+		t.Errorf("expected fraction used %f; got %f", 176.0/300, fractionUsed)
+	}
+	a.storeFinder = noStores
+	if cc, err = a.clusterCapacity(); err != nil || cc != (ClusterCapacity{}) {
+		t.Errorf("expected empty cluster capacity; got %+v, %v", cc, err)
+	}
+}
+
+func TestIsOverloaded(t *testing.T) {
+	testCases := []struct {
+		stores     []*StoreDescriptor
+		overloaded bool
+	}{
+		// Balanced stores.
+		{[]*StoreDescriptor{loadedStore(1, 50, 10), loadedStore(2, 50, 10)}, false},
+		// More full than the mean, but within the threshold.
+		{[]*StoreDescriptor{loadedStore(1, 52, 10), loadedStore(2, 50, 10)}, false},
+		// More full than the mean, beyond the threshold.
+		{[]*StoreDescriptor{loadedStore(1, 70, 10), loadedStore(2, 50, 10)}, true},
+		// More ranges than the mean.
+		{[]*StoreDescriptor{loadedStore(1, 50, 20), loadedStore(2, 50, 10)}, true},
+		// One range more than the mean of few ranges is tolerated.
+		{[]*StoreDescriptor{loadedStore(1, 50, 2), loadedStore(2, 50, 1)}, false},
+	}
+	for i, test := range testCases {
+		if o := isOverloaded(test.stores[0], test.stores); o != test.overloaded {
+			t.Errorf("%d: expected overloaded %t; got %t", i, test.overloaded, o)
+		}
+	}
+}
+
+func TestRebalanceTarget(t *testing.T) {
+	stores := []*StoreDescriptor{
+		loadedStore(1, 80, 20),
+		loadedStore(2, 60, 10),
+		loadedStore(3, 20, 5),
+	}
+	var a = allocator{
+		storeFinder: func(attrs Attributes) ([]*StoreDescriptor, error) { return filterStores(attrs, stores) },
+		rand:        *rand.New(rand.NewSource(0)),
+	}
+	existing := []Replica{{NodeID: 1, StoreID: 1, Attrs: stores[0].CombinedAttrs()}}
+	for i := 0; i < 10; i++ {
+		target, err := a.rebalanceTarget(simpleZoneConfig.Replicas[0], existing, stores)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target.StoreID != 3 {
+			t.Fatalf("expected underloaded store 3; got %+v", target)
+		}
+	}
+	existing = append(existing, Replica{NodeID: 3, StoreID: 3, Attrs: stores[2].CombinedAttrs()})
+	if target, err := a.rebalanceTarget(simpleZoneConfig.Replicas[0], existing, stores); err == nil {
+		t.Errorf("expected no rebalance target; got %+v", target)
+	}
+}
+
+// TestAllocateDiverseLocalities verifies that replicas are placed in
+// the localities most diverse from those of the existing replicas.
+func TestAllocateDiverseLocalities(t *testing.T) {
+	localityStore := func(id int32, localityAttrs ...string) *StoreDescriptor {
+		s := loadedStore(id, 50, 1)
+		s.Node.Attrs = append(s.Node.Attrs, localityAttrs...)
+		return s
+	}
+	stores := []*StoreDescriptor{
+		localityStore(1, "region=east", "zone=east-a", "rack=1"),
+		localityStore(2, "region=east", "zone=east-a", "rack=2"),
+		localityStore(3, "region=east", "zone=east-b", "rack=1"),
+		localityStore(4, "region=west", "zone=west-a", "rack=1"),
+	}
+	var a = allocator{
+		storeFinder: func(attrs Attributes) ([]*StoreDescriptor, error) { return filterStores(attrs, stores) },
+		rand:        *rand.New(rand.NewSource(0)),
+	}
+	testCases := []struct {
+		existing []int32 // IDs of stores holding existing replicas
+		expected int32
+	}{
+		{[]int32{1}, 4},       // another region
+		{[]int32{1, 4}, 3},    // another zone
+		{[]int32{1, 3, 4}, 2}, // another rack
+	}
+	for i, c := range testCases {
+		var existing []Replica
+		for _, id := range c.existing {
+			existing = append(existing, Replica{NodeID: id, StoreID: id, Attrs: stores[id-1].CombinedAttrs()})
+		}
+		for j := 0; j < 10; j++ {
+			result, err := a.allocate(simpleZoneConfig.Replicas[0], existing)
+			if err != nil {
+				t.Fatalf("%d: unable to perform allocation: %v", i, err)
+			}
+			if result.StoreID != c.expected {
+				t.Fatalf("%d: expected store %d; got %+v", i, c.expected, result)
+			}
+		}
+	}
+}
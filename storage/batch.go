@@ -0,0 +1,272 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// A batch accumulates the puts and deletes of a write to be applied
+// atomically by an engine's writeBatch. Batches are pooled so that
+// the hot write paths (MVCC writes and raft log appends) don't
+// allocate new slices for every operation: get a batch with newBatch
+// and return it with release once committed. Engines don't retain
+// the batch's slices past writeBatch, though they may retain the keys
+// and values added to it.
+type batch struct {
+	puts []KeyValue
+	dels []Key
+}
+
+var batchPool = sync.Pool{
+	New: func() interface{} { return &batch{} },
+}
+
+// newBatch returns an empty batch from the pool.
+func newBatch() *batch {
+	return batchPool.Get().(*batch)
+}
+
+// put adds a write of value at key to the batch.
+func (b *batch) put(key Key, value Value) {
+	b.puts = append(b.puts, KeyValue{Key: key, Value: value})
+}
+
+// del adds a deletion of key to the batch.
+func (b *batch) del(key Key) {
+	b.dels = append(b.dels, key)
+}
+
+// empty returns true if the batch holds no puts or deletes.
+func (b *batch) empty() bool {
+	return len(b.puts) == 0 && len(b.dels) == 0
+}
+
+// commit atomically applies the batch to the engine.
+func (b *batch) commit(engine Engine) error {
+	return engine.writeBatch(b.puts, b.dels)
+}
+
+// release clears the batch and returns it to the pool. The batch
+// must not be used afterwards.
+func (b *batch) release() {
+	// Drop references to keys and values so the pool doesn't pin them.
+	for i := range b.puts {
+		b.puts[i] = KeyValue{}
+	}
+	for i := range b.dels {
+		b.dels[i] = nil
+	}
+	b.puts, b.dels = b.puts[:0], b.dels[:0]
+	batchPool.Put(b)
+}
+
+// keyBufPool pools buffers for keys encoded only to look up values.
+// Engines don't retain the keys passed to get, so the buffers may be
+// reused once the lookup returns; keys which are written must never
+// use them.
+var keyBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 64)
+		return &b
+	},
+}
+
+// A bufferedEngine wraps an engine so that the writes made between
+// begin and commit are buffered and applied to the engine in a single
+// batch. Reads see the buffered writes. Outside of begin and commit,
+// writes pass through to the engine. A range executes each read-write
+// command between begin and commit, so that the command's writes and
+// the bookkeeping which accompanies them (e.g. the response cache
+// entry) are applied atomically.
+//
+// Only one goroutine may begin and commit batches. Reads and writes
+// may be executed concurrently from other goroutines; those executed
+// while a batch is open see, or are added to, the open batch.
+type bufferedEngine struct {
+	Engine
+	mu        sync.RWMutex
+	buffering bool
+	writes    map[string]*Value // Buffered writes; nil for deletions
+}
+
+// newBufferedEngine returns a bufferedEngine wrapping engine.
+func newBufferedEngine(engine Engine) *bufferedEngine {
+	return &bufferedEngine{Engine: engine}
+}
+
+// begin starts buffering writes.
+func (be *bufferedEngine) begin() {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	be.buffering = true
+	be.writes = map[string]*Value{}
+}
+
+// commit atomically applies the writes buffered since begin to the
+// engine and stops buffering. The buffered writes are dropped even if
+// they fail to apply.
+func (be *bufferedEngine) commit() error {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	wb := newBatch()
+	defer wb.release()
+	for key, value := range be.writes {
+		if value == nil {
+			wb.del(Key(key))
+		} else {
+			wb.put(Key(key), *value)
+		}
+	}
+	be.buffering = false
+	be.writes = nil
+	if wb.empty() {
+		return nil
+	}
+	return wb.commit(be.Engine)
+}
+
+// put sets the given key to the value provided.
+func (be *bufferedEngine) put(key Key, value Value) error {
+	return be.writeBatch([]KeyValue{{Key: key, Value: value}}, nil)
+}
+
+// get returns the value for the given key, nil otherwise.
+func (be *bufferedEngine) get(key Key) (Value, error) {
+	be.mu.RLock()
+	defer be.mu.RUnlock()
+	if value, ok := be.writes[string(key)]; ok {
+		if value == nil {
+			return Value{}, nil
+		}
+		return *value, nil
+	}
+	return be.Engine.get(key)
+}
+
+// scan returns up to max key/value objects starting from
+// start (inclusive) and ending at end (non-inclusive).
+func (be *bufferedEngine) scan(start, end Key, max int64) ([]KeyValue, error) {
+	return be.scanBuffered(start, end, max, false)
+}
+
+// reverseScan is like scan, but returns the key/value objects in
+// descending key order, starting from the last key before end.
+func (be *bufferedEngine) reverseScan(start, end Key, max int64) ([]KeyValue, error) {
+	return be.scanBuffered(start, end, max, true)
+}
+
+// scanBuffered merges the buffered writes in [start, end) into a scan
+// of the engine.
+func (be *bufferedEngine) scanBuffered(start, end Key, max int64, reverse bool) ([]KeyValue, error) {
+	be.mu.RLock()
+	defer be.mu.RUnlock()
+	scan := be.Engine.scan
+	if reverse {
+		scan = be.Engine.reverseScan
+	}
+	var overlay []KeyValue
+	deletes := int64(0)
+	for key, value := range be.writes {
+		if k := Key(key); bytes.Compare(k, start) >= 0 && bytes.Compare(k, end) < 0 {
+			if value == nil {
+				overlay = append(overlay, KeyValue{Key: k, Deleted: true})
+				deletes++
+			} else {
+				overlay = append(overlay, KeyValue{Key: k, Value: *value})
+			}
+		}
+	}
+	if len(overlay) == 0 {
+		return scan(start, end, max)
+	}
+	// Each buffered deletion removes at most one of the engine's
+	// key/value objects from the result.
+	engineMax := max
+	if max > 0 {
+		engineMax += deletes
+	}
+	kvs, err := scan(start, end, engineMax)
+	if err != nil {
+		return nil, err
+	}
+	merged := map[string]KeyValue{}
+	for _, kv := range kvs {
+		merged[string(kv.Key)] = kv
+	}
+	for _, kv := range overlay {
+		if kv.Deleted {
+			delete(merged, string(kv.Key))
+		} else {
+			merged[string(kv.Key)] = kv
+		}
+	}
+	// Buffered puts beyond the last key of a truncated engine scan
+	// may precede engine keys which the scan didn't return.
+	var limit Key
+	if max > 0 && int64(len(kvs)) == engineMax {
+		limit = kvs[len(kvs)-1].Key
+	}
+	result := make([]KeyValue, 0, len(merged))
+	for _, kv := range merged {
+		if c := bytes.Compare(kv.Key, limit); limit != nil && (!reverse && c > 0 || reverse && c < 0) {
+			continue
+		}
+		result = append(result, kv)
+	}
+	sort.Sort(kvSlice(result))
+	if reverse {
+		for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+			result[i], result[j] = result[j], result[i]
+		}
+	}
+	if max > 0 && int64(len(result)) > max {
+		result = result[:max]
+	}
+	return result, nil
+}
+
+// del removes the item from the db with the given key.
+func (be *bufferedEngine) del(key Key) error {
+	return be.writeBatch(nil, []Key{key})
+}
+
+// writeBatch atomically applies the specified writes and deletions,
+// or adds them to the open batch.
+func (be *bufferedEngine) writeBatch(puts []KeyValue, dels []Key) error {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if !be.buffering {
+		return be.Engine.writeBatch(puts, dels)
+	}
+	for _, kv := range puts {
+		value := kv.Value
+		be.writes[string(kv.Key)] = &value
+	}
+	for _, key := range dels {
+		be.writes[string(key)] = nil
+	}
+	return nil
+}
+
+// kvSlice sorts key/value objects in ascending key order.
+type kvSlice []KeyValue
+
+func (s kvSlice) Len() int           { return len(s) }
+func (s kvSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s kvSlice) Less(i, j int) bool { return bytes.Compare(s[i].Key, s[j].Key) < 0 }
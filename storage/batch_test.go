@@ -0,0 +1,150 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/hlc"
+)
+
+// TestBatchReuse verifies that a batch's writes are committed
+// atomically and that a released batch is cleared before reuse.
+func TestBatchReuse(t *testing.T) {
+	engine := NewInMem(Attributes{}, 1<<20)
+	if err := engine.put(Key("c"), Value{Bytes: []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+	wb := newBatch()
+	if !wb.empty() {
+		t.Fatal("expected new batch to be empty")
+	}
+	wb.put(Key("a"), Value{Bytes: []byte("a")})
+	wb.put(Key("b"), Value{Bytes: []byte("b")})
+	wb.del(Key("c"))
+	if err := wb.commit(engine); err != nil {
+		t.Fatal(err)
+	}
+	puts, dels := wb.puts, wb.dels
+	wb.release()
+	for i := range puts {
+		if puts[i].Key != nil || puts[i].Value.Bytes != nil {
+			t.Errorf("expected released batch not to reference put %d", i)
+		}
+	}
+	if dels[0] != nil {
+		t.Error("expected released batch not to reference deletion")
+	}
+	kvs, err := engine.scan(KeyMin, KeyMax, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 || !bytes.Equal(kvs[0].Key, Key("a")) || !bytes.Equal(kvs[1].Key, Key("b")) {
+		t.Errorf("expected keys a and b; got %+v", kvs)
+	}
+
+	wb = newBatch()
+	defer wb.release()
+	if !wb.empty() {
+		t.Errorf("expected reused batch to be empty; got %+v", wb)
+	}
+}
+
+// TestAppendEncodedBytes verifies that appending an encoding to a
+// reused buffer yields the same bytes as encodeBytes.
+func TestAppendEncodedBytes(t *testing.T) {
+	buf := []byte("prefix")
+	for _, b := range [][]byte{{}, []byte("a"), []byte("a\x00b"), []byte("\x00\x00")} {
+		buf = appendEncodedBytes(buf[:0], b)
+		if !bytes.Equal(buf, encodeBytes(b)) {
+			t.Errorf("expected %q; got %q", encodeBytes(b), buf)
+		}
+	}
+}
+
+// TestBufferedEngine verifies that writes to a buffered engine are
+// visible to its reads but not applied to the underlying engine until
+// committed.
+func TestBufferedEngine(t *testing.T) {
+	engine := NewInMem(Attributes{}, 1<<20)
+	for _, key := range []string{"a", "c", "e"} {
+		if err := engine.put(Key(key), Value{Bytes: []byte(key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	be := newBufferedEngine(engine)
+	be.begin()
+	if err := be.put(Key("b"), Value{Bytes: []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.put(Key("c"), Value{Bytes: []byte("c2")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.del(Key("a")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := be.get(Key("a")); err != nil || value.Bytes != nil {
+		t.Errorf("expected deleted value; got %q, %v", value.Bytes, err)
+	}
+	if value, err := engine.get(Key("b")); err != nil || value.Bytes != nil {
+		t.Errorf("expected uncommitted value to be buffered; got %q, %v", value.Bytes, err)
+	}
+	scanValues := func(kvs []KeyValue, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s string
+		for _, kv := range kvs {
+			s += string(kv.Value.Bytes) + " "
+		}
+		return s
+	}
+	if s := scanValues(be.scan(KeyMin, KeyMax, 0)); s != "b c2 e " {
+		t.Errorf("unexpected scan %q", s)
+	}
+	if s := scanValues(be.scan(KeyMin, KeyMax, 2)); s != "b c2 " {
+		t.Errorf("unexpected limited scan %q", s)
+	}
+	if s := scanValues(be.reverseScan(KeyMin, KeyMax, 2)); s != "e c2 " {
+		t.Errorf("unexpected reverse scan %q", s)
+	}
+	if err := be.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if s := scanValues(engine.scan(KeyMin, KeyMax, 0)); s != "b c2 e " {
+		t.Errorf("unexpected scan after commit %q", s)
+	}
+	if err := be.put(Key("f"), Value{Bytes: []byte("f")}); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := engine.get(Key("f")); err != nil || string(value.Bytes) != "f" {
+		t.Errorf("expected write outside of batch to pass through; got %q, %v", value.Bytes, err)
+	}
+}
+
+func BenchmarkMVCCPutSmall(b *testing.B) {
+	mvcc := NewMVCC(NewInMem(Attributes{}, 1<<30))
+	value := []byte("0123456789")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		key := Key(fmt.Sprintf("%08d", i%1000))
+		if err := mvcc.Put(key, hlc.HLTimestamp{WallTime: int64(i + 1)}, Value{Bytes: value}, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
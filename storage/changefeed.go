@@ -0,0 +1,127 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// ErrChangeFeedOverflow ends subscriptions which fall too far behind
+// the writes committed to their prefix. The subscriber may catch up
+// by scanning the prefix for the changes since the timestamp of the
+// last change received (see ScanRequest.MinTimestamp) and
+// subscribing anew.
+var ErrChangeFeedOverflow = util.Error("change feed subscriber fell behind")
+
+// A ChangeFeed distributes the writes committed by the ranges of a
+// store to the subscribers of key prefixes, for cache invalidation
+// and the replication of changes to other systems. Writes are
+// published as ranges apply them, so a subscription receives the
+// writes to its prefix in the order committed, with the value and
+// timestamp of each. Deletions are marked Deleted. Writes of
+// transactions are published as their intents are resolved.
+//
+// Publishing never blocks on subscribers: subscriptions whose buffer
+// of unreceived changes is full are ended with ErrChangeFeedOverflow.
+type ChangeFeed struct {
+	mu   sync.Mutex
+	subs map[*ChangeFeedSubscription]struct{}
+}
+
+// NewChangeFeed returns a change feed without subscribers.
+func NewChangeFeed() *ChangeFeed {
+	return &ChangeFeed{subs: map[*ChangeFeedSubscription]struct{}{}}
+}
+
+// A ChangeFeedSubscription receives the writes committed to the keys
+// with its prefix.
+type ChangeFeedSubscription struct {
+	feed    *ChangeFeed
+	prefix  Key
+	changes chan KeyValue
+	err     error // Set before changes is closed
+}
+
+// Subscribe returns a subscription to the writes committed to keys
+// with prefix, buffering up to bufferSize unreceived changes.
+func (cf *ChangeFeed) Subscribe(prefix Key, bufferSize int) *ChangeFeedSubscription {
+	sub := &ChangeFeedSubscription{
+		feed:    cf,
+		prefix:  prefix,
+		changes: make(chan KeyValue, bufferSize),
+	}
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	cf.subs[sub] = struct{}{}
+	return sub
+}
+
+// publish sends each change to the subscriptions of prefixes of its
+// key, ending those which can't accept it.
+func (cf *ChangeFeed) publish(changes []KeyValue) {
+	if len(changes) == 0 {
+		return
+	}
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	for _, change := range changes {
+		for sub := range cf.subs {
+			if !bytes.HasPrefix(change.Key, sub.prefix) {
+				continue
+			}
+			select {
+			case sub.changes <- change:
+			default:
+				cf.endLocked(sub, ErrChangeFeedOverflow)
+			}
+		}
+	}
+}
+
+// endLocked removes sub from the feed and closes its channel with
+// err. The feed's mutex must be held.
+func (cf *ChangeFeed) endLocked(sub *ChangeFeedSubscription, err error) {
+	if _, ok := cf.subs[sub]; !ok {
+		return
+	}
+	delete(cf.subs, sub)
+	sub.err = err
+	close(sub.changes)
+}
+
+// Changes returns the channel on which the subscription's changes
+// are received. It's closed when the subscription ends, after which
+// Err returns the reason.
+func (sub *ChangeFeedSubscription) Changes() <-chan KeyValue {
+	return sub.changes
+}
+
+// Err returns ErrChangeFeedOverflow if the subscription was ended
+// because it fell behind, or nil if it was closed. It may be called
+// only once the changes channel is closed.
+func (sub *ChangeFeedSubscription) Err() error {
+	return sub.err
+}
+
+// Close ends the subscription.
+func (sub *ChangeFeedSubscription) Close() {
+	sub.feed.mu.Lock()
+	defer sub.feed.mu.Unlock()
+	sub.feed.endLocked(sub, nil)
+}
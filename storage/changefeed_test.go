@@ -0,0 +1,116 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/hlc"
+)
+
+// TestChangeFeed verifies that changes are delivered to the
+// subscribers of prefixes of their keys, that subscribers which fall
+// behind are ended and that closed subscriptions receive no changes.
+func TestChangeFeed(t *testing.T) {
+	cf := NewChangeFeed()
+	subA := cf.Subscribe(Key("a"), 2)
+	subAB := cf.Subscribe(Key("ab"), 10)
+	subB := cf.Subscribe(Key("b"), 10)
+
+	cf.publish([]KeyValue{{Key: Key("aa")}, {Key: Key("ab")}, {Key: Key("ba")}})
+	for i, test := range []struct {
+		sub     *ChangeFeedSubscription
+		expKeys []string
+	}{
+		{subA, []string{"aa", "ab"}},
+		{subAB, []string{"ab"}},
+		{subB, []string{"ba"}},
+	} {
+		for _, key := range test.expKeys {
+			if change := <-test.sub.Changes(); !bytes.Equal(change.Key, Key(key)) {
+				t.Errorf("%d: expected change of %q; got %q", i, key, change.Key)
+			}
+		}
+	}
+
+	// subA's buffer overflows.
+	cf.publish([]KeyValue{{Key: Key("a1")}, {Key: Key("a2")}, {Key: Key("a3")}})
+	var n int
+	for _ = range subA.Changes() {
+		n++
+	}
+	if n != 2 || subA.Err() != ErrChangeFeedOverflow {
+		t.Errorf("expected 2 changes before overflow; got %d, %v", n, subA.Err())
+	}
+
+	subB.Close()
+	cf.publish([]KeyValue{{Key: Key("b1")}})
+	if _, ok := <-subB.Changes(); ok || subB.Err() != nil {
+		t.Errorf("expected closed subscription without error; got %v", subB.Err())
+	}
+	// Closing again, or after an overflow, is a no-op.
+	subB.Close()
+	subA.Close()
+	if subA.Err() != ErrChangeFeedOverflow {
+		t.Errorf("expected overflow error to persist; got %v", subA.Err())
+	}
+}
+
+// TestRangeChangeFeed verifies that ranges publish the writes they
+// commit to their change feed.
+func TestRangeChangeFeed(t *testing.T) {
+	rm := RangeMetadata{
+		RangeID:  0,
+		StartKey: KeyMin,
+		EndKey:   KeyMax,
+		Replicas: testRangeDescriptor,
+	}
+	r := NewRange(rm, hlc.NewHLClock(hlc.UnixNano), createTestEngine(t), nil, gossip.New(), nil)
+	r.db = &rangeDB{rng: r}
+	r.changeFeed = NewChangeFeed()
+	sub := r.changeFeed.Subscribe(Key("feed-"), 10)
+	r.Start()
+	defer r.Stop()
+
+	put := &PutRequest{Key: Key("feed-a"), Value: Value{Bytes: []byte("value")}}
+	if err := <-r.ReadWriteCmd("Put", put, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	other := &PutRequest{Key: Key("other"), Value: Value{Bytes: []byte("value")}}
+	if err := <-r.ReadWriteCmd("Put", other, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-r.ReadWriteCmd("Delete", &DeleteRequest{Key: Key("feed-a")}, &DeleteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	change := <-sub.Changes()
+	if !bytes.Equal(change.Key, Key("feed-a")) || !bytes.Equal(change.Value.Bytes, []byte("value")) ||
+		change.Deleted || change.Value.Timestamp.WallTime == 0 {
+		t.Errorf("expected put of \"feed-a\"; got %+v", change)
+	}
+	change = <-sub.Changes()
+	if !bytes.Equal(change.Key, Key("feed-a")) || !change.Deleted {
+		t.Errorf("expected deletion of \"feed-a\"; got %+v", change)
+	}
+	select {
+	case change := <-sub.Changes():
+		t.Errorf("unexpected change %+v", change)
+	default:
+	}
+}
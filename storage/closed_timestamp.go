@@ -0,0 +1,162 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/cockroach/hlc"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+const (
+	// ClosedTimestampLag is how far the closed timestamp of a range
+	// trails the clock of its leader lease holder. Writes at or below
+	// the closed timestamp are rejected, so replicas which have applied
+	// it may serve consistent reads at or below it without consulting
+	// the lease holder.
+	ClosedTimestampLag = 3 * time.Second
+	// closedTimestampInterval is the interval at which lease holders
+	// publish their ranges' closed timestamps.
+	closedTimestampInterval = 1 * time.Second
+)
+
+// rangeClosedTimestampKey returns the range-local key at which the
+// closed timestamp for the range with the specified ID is stored.
+func rangeClosedTimestampKey(rangeID int64) Key {
+	return MakeKey(keyLocalRangeClosedTimestampPrefix, Key(strconv.FormatInt(rangeID, 16)))
+}
+
+// IsFollowerRead returns true if the command may be served by any
+// replica of its range rather than by the leader lease holder: it's a
+// consistent, non-transactional read at an explicit timestamp old
+// enough, as of now, to have been closed, or a bounded-staleness read
+// whose bound is looser than ClosedTimestampLag. Replicas which
+// haven't yet applied a closed timestamp covering the read redirect
+// it to the lease holder.
+func IsFollowerRead(method string, header *RequestHeader, now time.Time) bool {
+	if !IsReadOnly(method) || header.ReadConsistency != CONSISTENT || header.Txn != nil {
+		return false
+	}
+	if header.MaxStaleness > 0 {
+		// Closed timestamps trail the clock by at least
+		// ClosedTimestampLag, so tighter bounds may only be satisfied
+		// by the lease holder.
+		return header.MaxStaleness > ClosedTimestampLag
+	}
+	return header.Timestamp != (hlc.HLTimestamp{}) &&
+		header.Timestamp.WallTime < now.Add(-ClosedTimestampLag-closedTimestampInterval).UnixNano()
+}
+
+// getClosedTimestamp returns the range's closed timestamp.
+func (r *Range) getClosedTimestamp() hlc.HLTimestamp {
+	r.leaseMu.Lock()
+	defer r.leaseMu.Unlock()
+	return r.closedTS
+}
+
+// canServeFollowerRead returns true if the replica may serve the
+// consistent read described by header without holding the leader
+// lease, because the read's timestamp is at or below the range's
+// closed timestamp. All writes at or below the closed timestamp were
+// applied before it, so the replica's data is complete as of the
+// read's timestamp.
+func (r *Range) canServeFollowerRead(header *RequestHeader) bool {
+	if header.Txn != nil || header.Timestamp == (hlc.HLTimestamp{}) {
+		return false
+	}
+	closed := r.getClosedTimestamp()
+	return closed != (hlc.HLTimestamp{}) && !closed.Less(header.Timestamp)
+}
+
+// resolveBoundedStaleness chooses the timestamp of a bounded-staleness
+// read (see RequestHeader.MaxStaleness). If the range's closed
+// timestamp is within the read's bound, the read is served at the
+// closed timestamp by this replica. Otherwise the timestamp is left
+// unset, so the read requires the leader lease and is served at the
+// current time.
+func (r *Range) resolveBoundedStaleness(header *RequestHeader) error {
+	if header.MaxStaleness == 0 {
+		return nil
+	}
+	if header.MaxStaleness < 0 {
+		return util.Errorf("invalid max staleness %s", header.MaxStaleness)
+	}
+	if header.Timestamp != (hlc.HLTimestamp{}) {
+		return util.Errorf("bounded-staleness reads may not specify a timestamp")
+	}
+	closed := r.getClosedTimestamp()
+	if closed != (hlc.HLTimestamp{}) &&
+		closed.WallTime >= r.clock.Now().WallTime-header.MaxStaleness.Nanoseconds() {
+		header.Timestamp = closed
+	}
+	return nil
+}
+
+// checkClosedTimestamp returns an error if the write described by
+// header is timestamped at or below the range's closed timestamp.
+// Transactional writes get a TransactionRetryError with the
+// transaction pushed past the closed timestamp, so the transaction is
+// restarted above it; other writes get a WriteTooOldError.
+func (r *Range) checkClosedTimestamp(header *RequestHeader) error {
+	closed := r.getClosedTimestamp()
+	if closed.Less(header.Timestamp) {
+		return nil
+	}
+	if header.Txn != nil {
+		txn := *header.Txn
+		txn.Timestamp = closed.Next()
+		return &TransactionRetryError{Txn: txn}
+	}
+	return &WriteTooOldError{Timestamp: header.Timestamp, ExistingTimestamp: closed}
+}
+
+// publishClosedTimestamps periodically closes timestamps trailing the
+// clock by ClosedTimestampLag while the replica holds the leader
+// lease. Closed timestamps are proposed as commands, and so are
+// applied by every replica in order with the range's writes. Loops
+// until the range is stopped and should be run as a worker of the
+// range's stopper.
+func (r *Range) publishClosedTimestamps() {
+	ticker := time.NewTicker(closedTimestampInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.maybeCloseTimestamp(); err != nil {
+				r.logger().Warningf("unable to publish closed timestamp: %v", err)
+			}
+		case <-r.stopper.ShouldStop():
+			return
+		}
+	}
+}
+
+// maybeCloseTimestamp proposes a closed timestamp ClosedTimestampLag
+// behind the clock if the replica holds the leader lease.
+func (r *Range) maybeCloseTimestamp() error {
+	now := r.clock.Now()
+	if !r.HasLeaderLease(now) {
+		return nil
+	}
+	closed := hlc.HLTimestamp{WallTime: now.WallTime - ClosedTimestampLag.Nanoseconds()}
+	if !r.getClosedTimestamp().Less(closed) {
+		return nil
+	}
+	args := &InternalCloseTimestampRequest{Key: r.Meta.StartKey, ClosedTimestamp: closed}
+	return <-r.ReadWriteCmd("InternalCloseTimestamp", args, &InternalCloseTimestampResponse{})
+}
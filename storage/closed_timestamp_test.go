@@ -0,0 +1,234 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/hlc"
+)
+
+// TestClosedTimestamp verifies that the lease holder closes
+// timestamps trailing its clock, that writes at or below the closed
+// timestamp are rejected, and that replicas which don't hold the
+// lease serve reads at or below it.
+func TestClosedTimestamp(t *testing.T) {
+	manual := hlc.ManualClock(1)
+	clock := hlc.NewHLClock(manual.UnixNano)
+	store := NewStore(clock, NewInMem(Attributes{}, 1<<20), nil, nil)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	local := Replica{NodeID: 1, StoreID: 1, RangeID: 1}
+	remote := Replica{NodeID: 2, StoreID: 2, RangeID: 1}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{local, remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := func(d time.Duration) hlc.HLTimestamp { return hlc.HLTimestamp{WallTime: d.Nanoseconds()} }
+	put := func(key string, timestamp hlc.HLTimestamp, txn *Transaction) error {
+		args := &PutRequest{
+			RequestHeader: RequestHeader{Timestamp: timestamp, Txn: txn},
+			Key:           Key(key),
+			Value:         Value{Bytes: []byte("value")},
+		}
+		return <-rng.ReadWriteCmd("Put", args, &PutResponse{})
+	}
+	get := func(timestamp hlc.HLTimestamp) error {
+		args := &GetRequest{RequestHeader: RequestHeader{Timestamp: timestamp}, Key: Key("a")}
+		return rng.ReadOnlyCmd("Get", args, &GetResponse{})
+	}
+
+	manual = hlc.ManualClock(ts(time.Second).WallTime)
+	if err := put("a", ts(time.Second), nil); err != nil {
+		t.Fatal(err)
+	}
+	// Acquire the lease at 10s and close 10s less the lag.
+	manual = hlc.ManualClock(ts(10 * time.Second).WallTime)
+	if err := put("b", hlc.HLTimestamp{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := rng.maybeCloseTimestamp(); err != nil {
+		t.Fatal(err)
+	}
+	closed := ts(10*time.Second - ClosedTimestampLag)
+	if c := rng.getClosedTimestamp(); c != closed {
+		t.Fatalf("expected closed timestamp %+v; got %+v", closed, c)
+	}
+	// Older closed timestamps are ignored.
+	args := &InternalCloseTimestampRequest{Key: KeyMin, ClosedTimestamp: ts(time.Second)}
+	if err := <-rng.ReadWriteCmd("InternalCloseTimestamp", args, &InternalCloseTimestampResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if c := rng.getClosedTimestamp(); c != closed {
+		t.Errorf("expected closed timestamp not to regress from %+v; got %+v", closed, c)
+	}
+
+	// Writes at or below the closed timestamp are rejected.
+	if _, ok := put("a", closed, nil).(*WriteTooOldError); !ok {
+		t.Error("expected write at closed timestamp to be rejected")
+	}
+	txn := NewTransaction(Key("a"), SERIALIZABLE, clock)
+	txn.Timestamp = ts(5 * time.Second)
+	if err, ok := put("a", txn.Timestamp, txn).(*TransactionRetryError); !ok {
+		t.Errorf("expected transactional write below closed timestamp to be retried; got %v", err)
+	} else if !closed.Less(err.Txn.Timestamp) {
+		t.Errorf("expected transaction to be pushed past %+v; got %+v", closed, err.Txn.Timestamp)
+	}
+	if err := put("a", closed.Next(), nil); err != nil {
+		t.Errorf("expected write above closed timestamp to succeed: %v", err)
+	}
+
+	// Once the lease is transferred, reads at or below the closed
+	// timestamp are still served; later reads are redirected.
+	if err := rng.TransferLeaderLease(remote); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(closed); err != nil {
+		t.Errorf("expected follower read at closed timestamp to succeed: %v", err)
+	}
+	if _, ok := get(closed.Next()).(*NotLeaderError); !ok {
+		t.Error("expected read above closed timestamp to be redirected")
+	}
+	// Only the lease holder closes timestamps.
+	manual = hlc.ManualClock(ts(20 * time.Second).WallTime)
+	if err := rng.maybeCloseTimestamp(); err != nil {
+		t.Fatal(err)
+	}
+	if c := rng.getClosedTimestamp(); c != closed {
+		t.Errorf("expected replica without lease not to close timestamps; got %+v", c)
+	}
+}
+
+// TestBoundedStalenessRead verifies that bounded-staleness reads are
+// served at the closed timestamp when it satisfies their bound, by
+// the lease holder at the current time otherwise, and are redirected
+// by replicas which can do neither.
+func TestBoundedStalenessRead(t *testing.T) {
+	manual := hlc.ManualClock(1)
+	clock := hlc.NewHLClock(manual.UnixNano)
+	store := NewStore(clock, NewInMem(Attributes{}, 1<<20), nil, nil)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	local := Replica{NodeID: 1, StoreID: 1, RangeID: 1}
+	remote := Replica{NodeID: 2, StoreID: 2, RangeID: 1}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{local, remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := func(d time.Duration) hlc.HLTimestamp { return hlc.HLTimestamp{WallTime: d.Nanoseconds()} }
+	get := func(header RequestHeader) (*GetResponse, error) {
+		reply := &GetResponse{}
+		err := rng.ReadOnlyCmd("Get", &GetRequest{RequestHeader: header, Key: Key("a")}, reply)
+		return reply, err
+	}
+
+	// Acquire the lease at 10s and close 10s less the lag.
+	manual = hlc.ManualClock(ts(10 * time.Second).WallTime)
+	putArgs := &PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}
+	if err := <-rng.ReadWriteCmd("Put", putArgs, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rng.maybeCloseTimestamp(); err != nil {
+		t.Fatal(err)
+	}
+	closed := rng.getClosedTimestamp()
+
+	// A bound the closed timestamp satisfies is served at it...
+	loose := RequestHeader{MaxStaleness: ClosedTimestampLag + time.Second}
+	if reply, err := get(loose); err != nil {
+		t.Fatal(err)
+	} else if reply.Timestamp != closed {
+		t.Errorf("expected read at closed timestamp %+v; got %+v", closed, reply.Timestamp)
+	}
+	// ...while a tighter bound is served by the lease holder at the
+	// current time, which observes the write.
+	tight := RequestHeader{MaxStaleness: time.Second}
+	if reply, err := get(tight); err != nil {
+		t.Fatal(err)
+	} else if reply.Timestamp.WallTime != ts(10*time.Second).WallTime {
+		t.Errorf("expected read at current time; got %+v", reply.Timestamp)
+	} else if reply.Value.Bytes == nil {
+		t.Error("expected lease holder read to observe write")
+	}
+
+	// Without the lease, only bounds the closed timestamp satisfies
+	// are served.
+	if err := rng.TransferLeaderLease(remote); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := get(loose); err != nil {
+		t.Errorf("expected follower to serve bounded-staleness read: %v", err)
+	} else if reply.Timestamp != closed {
+		t.Errorf("expected read at closed timestamp %+v; got %+v", closed, reply.Timestamp)
+	}
+	if _, err := get(tight); err == nil {
+		t.Error("expected follower to redirect read with tight bound")
+	} else if _, ok := err.(*NotLeaderError); !ok {
+		t.Errorf("expected NotLeaderError; got %v", err)
+	}
+
+	// Bounded staleness is unavailable to reads at explicit
+	// timestamps, inconsistent and transactional reads, and writes.
+	txn := NewTransaction(Key("a"), SERIALIZABLE, clock)
+	for i, header := range []RequestHeader{
+		{MaxStaleness: -time.Second},
+		{MaxStaleness: loose.MaxStaleness, Timestamp: closed},
+		{MaxStaleness: loose.MaxStaleness, ReadConsistency: INCONSISTENT},
+		{MaxStaleness: loose.MaxStaleness, Txn: txn},
+	} {
+		if _, err := get(header); err == nil {
+			t.Errorf("%d: expected error for %+v", i, header)
+		}
+	}
+	putArgs.MaxStaleness = loose.MaxStaleness
+	if err := <-rng.ReadWriteCmd("Put", putArgs, &PutResponse{}); err == nil {
+		t.Error("expected error for write with bounded staleness")
+	}
+}
+
+// TestIsFollowerRead verifies which commands may be sent to any
+// replica of a range.
+func TestIsFollowerRead(t *testing.T) {
+	now := time.Unix(100, 0)
+	old := hlc.HLTimestamp{WallTime: now.Add(-ClosedTimestampLag - closedTimestampInterval - time.Nanosecond).UnixNano()}
+	recent := hlc.HLTimestamp{WallTime: now.UnixNano()}
+	testCases := []struct {
+		method string
+		header RequestHeader
+		expect bool
+	}{
+		{"Get", RequestHeader{Timestamp: old}, true},
+		{"Scan", RequestHeader{Timestamp: old}, true},
+		{"Get", RequestHeader{Timestamp: recent}, false},
+		{"Get", RequestHeader{}, false},
+		{"Get", RequestHeader{Timestamp: old, Txn: &Transaction{}}, false},
+		{"Get", RequestHeader{Timestamp: old, ReadConsistency: INCONSISTENT}, false},
+		{"Put", RequestHeader{Timestamp: old}, false},
+		{"Get", RequestHeader{MaxStaleness: ClosedTimestampLag + time.Second}, true},
+		{"Get", RequestHeader{MaxStaleness: ClosedTimestampLag}, false},
+		{"Get", RequestHeader{MaxStaleness: ClosedTimestampLag + time.Second, Txn: &Transaction{}}, false},
+	}
+	for i, test := range testCases {
+		if is := IsFollowerRead(test.method, &test.header, now); is != test.expect {
+			t.Errorf("%d: expected %t for %s with %+v; got %t", i, test.expect, test.method, test.header, is)
+		}
+	}
+}
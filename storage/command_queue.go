@@ -0,0 +1,109 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"sync"
+
+	"github.com/cockroachdb/cockroach/util/interval"
+)
+
+// A CommandQueue tracks the key spans of in-flight commands so that
+// commands whose spans overlap are executed in the order in which
+// they're added, while commands addressing disjoint spans proceed
+// concurrently. Read-only commands don't wait on one another, only on
+// overlapping read-write commands; read-write commands wait on all
+// overlapping commands.
+//
+// Before executing a command, the caller invokes GetWait to collect
+// the overlapping in-flight commands in a WaitGroup and then Add to
+// add the command itself, before waiting on the WaitGroup. When the
+// command completes, Remove signals any commands waiting on it.
+// Because commands must be added in the order in which they wait,
+// GetWait and Add must be invoked together under a lock by the
+// caller: CommandQueue is not safe for concurrent access.
+type CommandQueue struct {
+	tree   interval.Tree
+	nextID uintptr
+}
+
+// cmd is an in-flight command in the queue. pending lists the
+// WaitGroups of the commands waiting on this one to complete.
+type cmd struct {
+	id       uintptr
+	rng      interval.Range
+	readOnly bool
+	pending  []*sync.WaitGroup
+}
+
+func (c *cmd) Range() interval.Range { return c.rng }
+func (c *cmd) ID() uintptr           { return c.id }
+
+// NewCommandQueue returns a new command queue.
+func NewCommandQueue() *CommandQueue {
+	return &CommandQueue{}
+}
+
+// cmdRange returns the interval for the span [start, end). If end is
+// empty, the span is the single key start.
+func cmdRange(start, end Key) interval.Range {
+	if len(end) == 0 {
+		end = MakeKey(start, Key{0})
+	}
+	return interval.Range{Start: interval.Comparable(start), End: interval.Comparable(end)}
+}
+
+// GetWait adds one to wg for each in-flight command which must
+// complete before a command addressing [start, end) may execute;
+// wg.Done() is called for each as it's removed from the queue. If
+// readOnly is true, only read-write commands are waited upon.
+func (cq *CommandQueue) GetWait(start, end Key, readOnly bool, wg *sync.WaitGroup) {
+	for _, e := range cq.tree.Get(cmdRange(start, end)) {
+		c := e.(*cmd)
+		if readOnly && c.readOnly {
+			continue
+		}
+		wg.Add(1)
+		c.pending = append(c.pending, wg)
+	}
+}
+
+// Add adds a command addressing [start, end) to the queue and returns
+// a key with which it's later removed. Empty spans (end <= start,
+// other than an empty end) aren't added and return nil, as they
+// can't conflict with other commands.
+func (cq *CommandQueue) Add(start, end Key, readOnly bool) interface{} {
+	cq.nextID++
+	c := &cmd{id: cq.nextID, rng: cmdRange(start, end), readOnly: readOnly}
+	if err := cq.tree.Insert(c); err != nil {
+		return nil
+	}
+	return c
+}
+
+// Remove removes the command identified by key, as returned by Add,
+// from the queue and signals the commands waiting on it.
+func (cq *CommandQueue) Remove(key interface{}) {
+	c, ok := key.(*cmd)
+	if !ok {
+		return
+	}
+	cq.tree.Delete(c)
+	for _, wg := range c.pending {
+		wg.Done()
+	}
+	c.pending = nil
+}
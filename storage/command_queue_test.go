@@ -0,0 +1,148 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForCmd launches a goroutine to wait on the given WaitGroup and
+// returns a channel which is closed when the wait completes.
+func waitForCmd(wg *sync.WaitGroup) <-chan struct{} {
+	cmdDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(cmdDone)
+	}()
+	return cmdDone
+}
+
+func testCmdDone(cmdDone <-chan struct{}, wait time.Duration) bool {
+	select {
+	case <-cmdDone:
+		return true
+	case <-time.After(wait):
+		return false
+	}
+}
+
+func TestCommandQueue(t *testing.T) {
+	cq := NewCommandQueue()
+	wg := sync.WaitGroup{}
+
+	// Try a command with no overlapping already-running commands.
+	cq.GetWait(Key("a"), nil, false, &wg)
+	wg.Wait()
+	cq.GetWait(Key("a"), Key("b"), false, &wg)
+	wg.Wait()
+
+	// Add a command and verify wait group is returned.
+	wk := cq.Add(Key("a"), nil, false)
+	cq.GetWait(Key("a"), nil, false, &wg)
+	cmdDone := waitForCmd(&wg)
+	if testCmdDone(cmdDone, 1*time.Millisecond) {
+		t.Fatal("command should not finish with command outstanding")
+	}
+	cq.Remove(wk)
+	if !testCmdDone(cmdDone, 5*time.Millisecond) {
+		t.Fatal("command should finish with no commands outstanding")
+	}
+}
+
+// TestCommandQueueNoWaitOnReadOnly verifies that read-only commands
+// don't wait on each other, but do wait on read-write commands and
+// vice versa.
+func TestCommandQueueNoWaitOnReadOnly(t *testing.T) {
+	cq := NewCommandQueue()
+	wg := sync.WaitGroup{}
+	// Add a read-only command.
+	wk := cq.Add(Key("a"), nil, true)
+	// Verify no wait on another read-only command.
+	cq.GetWait(Key("a"), nil, true, &wg)
+	wg.Wait()
+	// Verify wait with a read-write command.
+	cq.GetWait(Key("a"), nil, false, &wg)
+	cmdDone := waitForCmd(&wg)
+	if testCmdDone(cmdDone, 1*time.Millisecond) {
+		t.Fatal("command should not finish with command outstanding")
+	}
+	cq.Remove(wk)
+	if !testCmdDone(cmdDone, 5*time.Millisecond) {
+		t.Fatal("command should finish with no commands outstanding")
+	}
+
+	// And a read-only command waits on a read-write command.
+	wk = cq.Add(Key("a"), nil, false)
+	cq.GetWait(Key("a"), nil, true, &wg)
+	cmdDone = waitForCmd(&wg)
+	if testCmdDone(cmdDone, 1*time.Millisecond) {
+		t.Fatal("read-only command should wait on read-write command")
+	}
+	cq.Remove(wk)
+	if !testCmdDone(cmdDone, 5*time.Millisecond) {
+		t.Fatal("command should finish with no commands outstanding")
+	}
+}
+
+// TestCommandQueueMultipleExecutingCommands verifies that a command
+// waits on all overlapping commands, and only on those.
+func TestCommandQueueMultipleExecutingCommands(t *testing.T) {
+	cq := NewCommandQueue()
+	wg := sync.WaitGroup{}
+
+	// Add multiple commands and add a command which overlaps them all.
+	wk1 := cq.Add(Key("a"), nil, false)
+	wk2 := cq.Add(Key("b"), Key("c"), false)
+	wk3 := cq.Add(Key("0"), Key("d"), false)
+	wk4 := cq.Add(Key("e"), Key("f"), false)
+	cq.GetWait(Key("a"), Key("cc"), false, &wg)
+	cmdDone := waitForCmd(&wg)
+	cq.Remove(wk1)
+	if testCmdDone(cmdDone, 1*time.Millisecond) {
+		t.Fatal("command should not finish with two commands outstanding")
+	}
+	cq.Remove(wk2)
+	if testCmdDone(cmdDone, 1*time.Millisecond) {
+		t.Fatal("command should not finish with one command outstanding")
+	}
+	cq.Remove(wk3)
+	if !testCmdDone(cmdDone, 5*time.Millisecond) {
+		t.Fatal("command should finish with no overlapping commands outstanding")
+	}
+	cq.Remove(wk4)
+
+	// The span end is exclusive.
+	wk := cq.Add(Key("a"), Key("b"), false)
+	cq.GetWait(Key("b"), nil, false, &wg)
+	wg.Wait()
+	cq.Remove(wk)
+}
+
+// TestCommandQueueEmptySpan verifies that commands with empty spans
+// aren't added to the queue and that removing them is a no-op.
+func TestCommandQueueEmptySpan(t *testing.T) {
+	cq := NewCommandQueue()
+	wg := sync.WaitGroup{}
+	wk := cq.Add(Key("b"), Key("a"), false)
+	if wk != nil {
+		t.Fatalf("expected empty span not to be added; got %v", wk)
+	}
+	cq.GetWait(KeyMin, KeyMax, false, &wg)
+	wg.Wait()
+	cq.Remove(wk)
+}
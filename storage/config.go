@@ -76,13 +76,27 @@ type Replica struct {
 type StoreCapacity struct {
 	Capacity  int64
 	Available int64
+	// LogicalBytes is the total size of the MVCC data in the store's
+	// ranges, including non-live versions not yet garbage collected.
+	LogicalBytes int64
+	// RangeCount is the number of range replicas on the store.
+	RangeCount int
 }
 
 // PercentAvail computes the percentage of disk space that is available.
+// A store with zero capacity has no space available.
 func (sc StoreCapacity) PercentAvail() float64 {
+	if sc.Capacity == 0 {
+		return 0
+	}
 	return float64(sc.Available) / float64(sc.Capacity)
 }
 
+// FractionUsed computes the fraction of disk space that is in use.
+func (sc StoreCapacity) FractionUsed() float64 {
+	return 1 - sc.PercentAvail()
+}
+
 // NodeDescriptor holds details on node physical/network topology.
 type NodeDescriptor struct {
 	NodeID  int32
@@ -97,6 +111,8 @@ type StoreDescriptor struct {
 	Attrs    Attributes // store specific attributes (e.g. ssd, hdd, mem)
 	Node     NodeDescriptor
 	Capacity StoreCapacity
+	Draining bool // True if the store is draining; see Store.Drain
+	Full     bool // True if the store refuses new replicas; see Store.SetFullThreshold
 }
 
 // CombinedAttrs returns the full list of attributes for the store,
@@ -123,9 +139,24 @@ type RangeDescriptor struct {
 	Replicas []Replica
 }
 
-// AcctConfig holds accounting configuration.
+// AcctConfig holds accounting configuration. Usage of the keys
+// governed by an accounting config is tracked by the config's key
+// prefix (see AcctUsage).
 type AcctConfig struct {
-	// Nothing for the moment.
+	// Account names the party to which usage of the keys is charged.
+	Account string `yaml:"account,omitempty"`
+}
+
+// ParseAcctConfig parses a YAML serialized AcctConfig.
+func ParseAcctConfig(in []byte) (*AcctConfig, error) {
+	a := &AcctConfig{}
+	err := yaml.Unmarshal(in, a)
+	return a, err
+}
+
+// ToYAML serializes an AcctConfig as YAML.
+func (a *AcctConfig) ToYAML() ([]byte, error) {
+	return yaml.Marshal(a)
 }
 
 // Permission specifies read/write access and associated priority.
@@ -141,6 +172,43 @@ type PermConfig struct {
 	Perms []Permission `yaml:"permissions,omitempty"`
 }
 
+// appliesTo returns whether the permission applies to user. A
+// permission without users, or whose users include the empty
+// string, applies to all users.
+func (p Permission) appliesTo(user string) bool {
+	if len(p.Users) == 0 {
+		return true
+	}
+	for _, u := range p.Users {
+		if u == "" || u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// CanRead returns whether user is permitted to read keys governed by
+// the config.
+func (pc *PermConfig) CanRead(user string) bool {
+	for _, p := range pc.Perms {
+		if p.Read && p.appliesTo(user) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanWrite returns whether user is permitted to write keys governed
+// by the config.
+func (pc *PermConfig) CanWrite(user string) bool {
+	for _, p := range pc.Perms {
+		if p.Write && p.appliesTo(user) {
+			return true
+		}
+	}
+	return false
+}
+
 // ZoneConfig holds configuration that is needed for a range of KV pairs.
 type ZoneConfig struct {
 	// Replicas is a slice of Attributes, each describing required
@@ -148,6 +216,20 @@ type ZoneConfig struct {
 	Replicas      []Attributes `yaml:"replicas,omitempty,flow"`
 	RangeMinBytes int64        `yaml:"range_min_bytes,omitempty"`
 	RangeMaxBytes int64        `yaml:"range_max_bytes,omitempty"`
+	// GCTTLSeconds is the number of seconds for which historical
+	// versions are retained. Reads at timestamps older than this may
+	// not be served. Zero specifies the default TTL.
+	GCTTLSeconds int32 `yaml:"gc_ttl_seconds,omitempty"`
+	// RangeMaxQPS is the request rate, in requests per second, above
+	// which a range is split to divide its load. Zero disables
+	// load-based splits.
+	RangeMaxQPS float64 `yaml:"range_max_qps,omitempty"`
+	// LeasePreferences lists, in order of preference, the attributes
+	// of the replicas which should hold the leader lease of ranges in
+	// the zone; e.g. [[us-east]] to serve reads from nodes near
+	// clients pinned to that region. The lease is moved to a replica
+	// satisfying the first preference any live replica satisfies.
+	LeasePreferences []Attributes `yaml:"lease_preferences,omitempty,flow"`
 }
 
 // ParseZoneConfig parses a YAML serialized ZoneConfig.
@@ -34,6 +34,10 @@ var testConfig = ZoneConfig{
 	},
 	RangeMinBytes: 1 << 20,
 	RangeMaxBytes: 64 << 20,
+	LeasePreferences: []Attributes{
+		Attributes([]string{"a", "ssd"}),
+		Attributes([]string{"a"}),
+	},
 }
 
 var yamlConfig = `
@@ -44,6 +48,9 @@ replicas:
   - [b, hdd]
 range_min_bytes: 1048576
 range_max_bytes: 67108864
+lease_preferences:
+  - [a, ssd]
+  - [a]
 `
 
 func TestZoneConfigRoundTrip(t *testing.T) {
@@ -109,3 +116,41 @@ func TestSortedString(t *testing.T) {
 		glog.Errorf("sorted string of %+v (%s) != \"a,b,c\"", c, c.SortedString())
 	}
 }
+
+// TestPermConfigAccess verifies read and write access by user.
+func TestPermConfigAccess(t *testing.T) {
+	config := &PermConfig{
+		Perms: []Permission{
+			{Users: []string{"spencer"}, Read: true, Write: true},
+			{Users: []string{"foo", "bar"}, Read: true},
+			{Users: []string{"baz"}, Write: true},
+		},
+	}
+	testCases := []struct {
+		user        string
+		read, write bool
+	}{
+		{"spencer", true, true},
+		{"foo", true, false},
+		{"bar", true, false},
+		{"baz", false, true},
+		{"qux", false, false},
+	}
+	for _, test := range testCases {
+		if read := config.CanRead(test.user); read != test.read {
+			t.Errorf("%s: expected read %t; got %t", test.user, test.read, read)
+		}
+		if write := config.CanWrite(test.user); write != test.write {
+			t.Errorf("%s: expected write %t; got %t", test.user, test.write, write)
+		}
+	}
+
+	// Permissions without users, or including the empty user, apply
+	// to all users.
+	for _, users := range [][]string{nil, {""}} {
+		config := &PermConfig{Perms: []Permission{{Users: users, Read: true}}}
+		if !config.CanRead("qux") || config.CanWrite("qux") {
+			t.Errorf("%q: expected read-only access for all users", users)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// consistencyCheckInterval is the minimum interval between
+// consistency checks of a range's replicas.
+const consistencyCheckInterval = 24 * time.Hour
+
+// CheckConsistency verifies that the range's replicas hold identical
+// versioned data. The leader proposes an InternalChecksum command,
+// which acts as a checkpoint in the range's command sequence, and
+// requests the checksum computed at the same point by each of the
+// other replicas. A divergent replica is logged as an error and
+// returned as such; replicas which can't be reached are logged but
+// not reported as divergent.
+func (r *Range) CheckConsistency() error {
+	meta := r.getMeta()
+	local, ok := r.localReplica()
+	if !ok {
+		return util.Errorf("range %d: no local replica", meta.RangeID)
+	}
+	args := &InternalChecksumRequest{Key: meta.StartKey}
+	reply := &InternalChecksumResponse{}
+	if err := <-r.ReadWriteCmd("InternalChecksum", args, reply); err != nil {
+		return err
+	}
+	var diverged []Replica
+	for _, replica := range meta.Replicas.Replicas {
+		if sameReplica(replica, local) {
+			continue
+		}
+		remoteReply := <-r.db.InternalChecksum(&InternalChecksumRequest{
+			RequestHeader: RequestHeader{Replica: replica},
+			Key:           meta.StartKey,
+		})
+		if remoteReply.Error != nil {
+			r.logger().Warningf("unable to compute checksum on replica %+v: %v", replica, remoteReply.Error)
+			continue
+		}
+		if !bytes.Equal(remoteReply.Checksum, reply.Checksum) {
+			r.logger().Errorf("replica %+v is inconsistent with leader %+v: checksum %x != %x",
+				replica, local, remoteReply.Checksum, reply.Checksum)
+			diverged = append(diverged, replica)
+		}
+	}
+	if len(diverged) > 0 {
+		return util.Errorf("range %d: replicas %+v are inconsistent with leader", meta.RangeID, diverged)
+	}
+	return nil
+}
+
+// A consistencyQueue is a range queue which checks the consistency of
+// the replicas of ranges for which the store holds the leader
+// replica. Each range is checked at most once per interval.
+type consistencyQueue struct {
+	interval  time.Duration
+	now       func() time.Time
+	lastCheck map[int64]time.Time // Last check time by range ID
+}
+
+// newConsistencyQueue returns a consistency queue which checks each
+// range at most once per interval.
+func newConsistencyQueue(interval time.Duration) *consistencyQueue {
+	return &consistencyQueue{
+		interval:  interval,
+		now:       time.Now,
+		lastCheck: map[int64]time.Time{},
+	}
+}
+
+func (cq *consistencyQueue) name() string     { return "consistency" }
+func (cq *consistencyQueue) beginScan() error { return nil }
+
+// process checks the consistency of the range's replicas, at a pace
+// set by the store's throttle.
+func (cq *consistencyQueue) process(rng *Range) error {
+	rangeID := rng.Meta.RangeID
+	now := cq.now()
+	if !rng.IsLeader() || len(rng.getMeta().Replicas.Replicas) < 2 || now.Sub(cq.lastCheck[rangeID]) < cq.interval {
+		return nil
+	}
+	if err := rng.throttle.wait(throttleConsistency, rng.Stats().TotalBytes()); err != nil {
+		return err
+	}
+	cq.lastCheck[rangeID] = now
+	return rng.CheckConsistency()
+}
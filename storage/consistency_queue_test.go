@@ -0,0 +1,67 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// TestConsistencyQueue verifies that replicas holding identical data
+// are found consistent, that a divergent replica is reported and that
+// each range is checked at most once per interval.
+func TestConsistencyQueue(t *testing.T) {
+	store1, store2 := createTestStore(1, 1, t), createTestStore(2, 2, t)
+	defer store1.Close()
+	defer store2.Close()
+	store1.db = &storeDB{store: store1, remotes: map[int32]*Store{2: store2}}
+	// The range's addressing records are stored in a separate range,
+	// which isn't replicated to store 2.
+	if _, err := store1.CreateRange(KeyMin, Key("a"), []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store1.CreateRange(Key("a"), KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply := <-store1.db.Put(&PutRequest{Key: Key("b"), Value: Value{Bytes: []byte("value")}}); reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	if err := rng.ChangeReplicas([]Replica{{NodeID: 1, StoreID: 1, RangeID: 2}, {NodeID: 2, StoreID: 2, RangeID: 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	cq := newConsistencyQueue(consistencyCheckInterval)
+	if err := cq.process(rng); err != nil {
+		t.Fatalf("expected replicas to be consistent: %v", err)
+	}
+
+	// Diverge the replica on store 2.
+	rng2, err := store2.GetRange(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rng2.mvcc.Put(Key("c"), store2.clock.Now(), Value{Bytes: []byte("value")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := cq.process(rng); err != nil {
+		t.Errorf("expected range not to be checked within interval: %v", err)
+	}
+	cq.now = func() time.Time { return time.Now().Add(consistencyCheckInterval) }
+	if err := cq.process(rng); err == nil {
+		t.Error("expected divergent replica to be reported")
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/cockroachdb/cockroach/hlc"
+	"github.com/cockroachdb/cockroach/multiraft"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// This file provides read access to the persisted state of a store
+// for post-mortem analysis of corrupted or wedged nodes; see the
+// "debug" command of the cockroach binary.
+
+// errReadOnly is returned by writes to a read-only engine.
+var errReadOnly = util.Error("engine is read-only")
+
+// readOnlyEngine wraps an engine, failing all writes.
+type readOnlyEngine struct {
+	Engine
+}
+
+// NewReadOnlyEngine returns an engine which reads from engine and
+// fails all writes.
+func NewReadOnlyEngine(engine Engine) Engine {
+	return readOnlyEngine{engine}
+}
+
+func (readOnlyEngine) put(key Key, value Value) error                  { return errReadOnly }
+func (readOnlyEngine) del(key Key) error                               { return errReadOnly }
+func (readOnlyEngine) writeBatch(puts []KeyValue, deletes []Key) error { return errReadOnly }
+
+// DebugStoreIdent returns the ident of the store persisted in engine.
+func DebugStoreIdent(engine Engine) (StoreIdent, error) {
+	var ident StoreIdent
+	ok, _, err := getI(engine, keyStoreIdent, &ident)
+	if err == nil && !ok {
+		err = util.Errorf("store %s is not bootstrapped", engine)
+	}
+	return ident, err
+}
+
+// DebugRangeMetadata returns the metadata of the ranges persisted in
+// engine.
+func DebugRangeMetadata(engine Engine) ([]RangeMetadata, error) {
+	return loadRangeMetadata(engine)
+}
+
+// A RaftLogDump is the persisted raft state of a range.
+type RaftLogDump struct {
+	ElectionState multiraft.GroupElectionState
+	LastIndex     int
+	AppliedIndex  int
+	Entries       []multiraft.LogEntry
+}
+
+// DebugRaftLog returns the persisted raft state and log entries of
+// the range with ID rangeID. raftEngine is the store's raft log
+// engine, which is engine unless the store's raft logs are placed on
+// a separate device.
+func DebugRaftLog(engine, raftEngine Engine, rangeID int64) (*RaftLogDump, error) {
+	rs := newRaftStorage(engine, raftEngine)
+	dump := &RaftLogDump{}
+	var err error
+	if _, _, err = getI(raftEngine, raftHardStateKey(rangeID), &dump.ElectionState); err != nil {
+		return nil, err
+	}
+	if dump.LastIndex, err = rs.lastIndex(rangeID); err != nil {
+		return nil, err
+	}
+	if dump.AppliedIndex, err = rs.appliedIndex(rangeID); err != nil {
+		return nil, err
+	}
+	prefix := raftLogPrefix(rangeID)
+	kvs, err := raftEngine.scan(prefix, PrefixEndKey(prefix), 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range kvs {
+		var entry multiraft.LogEntry
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value.Bytes)).Decode(&entry); err != nil {
+			return nil, util.Errorf("unable to decode raft log entry at %q: %v", kv.Key, err)
+		}
+		dump.Entries = append(dump.Entries, entry)
+	}
+	return dump, nil
+}
+
+// A DebugKeyValue is a key with its decoded value. Values which can't
+// be decoded are the raw bytes.
+type DebugKeyValue struct {
+	Key   Key
+	Value interface{}
+}
+
+// DebugRangeLocal returns the range-local keys of the range described
+// by meta with their decoded values: its MVCC stats, leader lease,
+// raft state other than log entries (see DebugRaftLog), response
+// cache entries, abort cache entries and transaction records. The
+// raft state other than the applied index is read from raftEngine
+// (see DebugRaftLog).
+func DebugRangeLocal(engine, raftEngine Engine, meta RangeMetadata) ([]DebugKeyValue, error) {
+	var kvs []DebugKeyValue
+	// decodeKey appends the value at key in e decoded into value, if
+	// present.
+	decodeKey := func(e Engine, key Key, value interface{}) error {
+		ok, _, err := getI(e, key, value)
+		if ok {
+			kvs = append(kvs, DebugKeyValue{key, value})
+		}
+		return err
+	}
+	var electionState multiraft.GroupElectionState
+	var lastIndex, appliedIndex int
+	for _, kv := range []struct {
+		engine Engine
+		DebugKeyValue
+	}{
+		{engine, DebugKeyValue{rangeStatsKey(meta.RangeID), &MVCCStats{}}},
+		{engine, DebugKeyValue{rangeLeaderLeaseKey(meta.RangeID), &LeaderLease{}}},
+		{engine, DebugKeyValue{rangeClosedTimestampKey(meta.RangeID), &hlc.HLTimestamp{}}},
+		{raftEngine, DebugKeyValue{raftHardStateKey(meta.RangeID), &electionState}},
+		{raftEngine, DebugKeyValue{raftLastIndexKey(meta.RangeID), &lastIndex}},
+		{engine, DebugKeyValue{raftAppliedIndexKey(meta.RangeID), &appliedIndex}},
+	} {
+		if err := decodeKey(kv.engine, kv.Key, kv.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	// The types of cached responses aren't recorded, so they're left
+	// undecoded.
+	respCachePrefix := responseCacheKeyPrefix(meta.RangeID)
+	respKVs, err := engine.scan(respCachePrefix, PrefixEndKey(respCachePrefix), 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range respKVs {
+		kvs = append(kvs, DebugKeyValue{kv.Key, kv.Value.Bytes})
+	}
+
+	abortCachePrefix := abortCacheKeyPrefix(meta.RangeID)
+	abortKVs, err := engine.scan(abortCachePrefix, PrefixEndKey(abortCachePrefix), 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range abortKVs {
+		var entry AbortCacheEntry
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value.Bytes)).Decode(&entry); err != nil {
+			kvs = append(kvs, DebugKeyValue{kv.Key, kv.Value.Bytes})
+			continue
+		}
+		kvs = append(kvs, DebugKeyValue{kv.Key, &entry})
+	}
+
+	txnKVs, err := engine.scan(txnKey(meta.StartKey, ""), txnKey(meta.EndKey, ""), 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range txnKVs {
+		var txn Transaction
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value.Bytes)).Decode(&txn); err != nil {
+			kvs = append(kvs, DebugKeyValue{kv.Key, kv.Value.Bytes})
+			continue
+		}
+		kvs = append(kvs, DebugKeyValue{kv.Key, &txn})
+	}
+	return kvs, nil
+}
+
+// An MVCCVersion is a version of a key. Value is nil for deletions.
+type MVCCVersion struct {
+	Timestamp hlc.HLTimestamp
+	Value     *Value
+}
+
+// DebugMVCCVersions returns the MVCC metadata of key, nil if key has
+// none, and all versions of key, most recent first.
+func DebugMVCCVersions(engine Engine, key Key) (*MVCCMetadata, []MVCCVersion, error) {
+	meta, _, err := NewMVCC(engine).getMetadata(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Version keys are the encoded key followed by the timestamp. The
+	// encoding is terminated, so no other key's encoding has the
+	// encoded key as prefix.
+	encKey := mvccEncodeKey(key)
+	kvs, err := engine.scan(encKey, PrefixEndKey(encKey), 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var versions []MVCCVersion
+	for _, kv := range kvs {
+		_, timestamp, isVersion, err := mvccDecodeKey(kv.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !isVersion {
+			continue
+		}
+		value, err := decodeVersion(kv.Value.Bytes, timestamp)
+		if err != nil {
+			return nil, nil, util.Errorf("unable to decode version %+v of %q: %v", timestamp, key, err)
+		}
+		versions = append(versions, MVCCVersion{Timestamp: timestamp, Value: value})
+	}
+	return meta, versions, nil
+}
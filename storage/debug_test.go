@@ -0,0 +1,134 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/multiraft"
+)
+
+// TestReadOnlyEngine verifies that a read-only engine reads from the
+// wrapped engine and fails writes.
+func TestReadOnlyEngine(t *testing.T) {
+	engine := NewInMem(Attributes{}, 1<<20)
+	if err := engine.put(Key("a"), Value{Bytes: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	ro := NewReadOnlyEngine(engine)
+	if val, err := ro.get(Key("a")); err != nil || !bytes.Equal(val.Bytes, []byte("a")) {
+		t.Errorf("expected to read %q; got %q, %v", "a", val.Bytes, err)
+	}
+	if err := ro.put(Key("b"), Value{Bytes: []byte("b")}); err != errReadOnly {
+		t.Errorf("expected read-only error on put; got %v", err)
+	}
+	if err := ro.del(Key("a")); err != errReadOnly {
+		t.Errorf("expected read-only error on delete; got %v", err)
+	}
+	if err := ro.writeBatch([]KeyValue{{Key: Key("b")}}, nil); err != errReadOnly {
+		t.Errorf("expected read-only error on write batch; got %v", err)
+	}
+}
+
+// TestDebugStore verifies that the debugging accessors decode the
+// persisted state of a store.
+func TestDebugStore(t *testing.T) {
+	store := createTestStore(1, 2, t)
+	defer store.Close()
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 2, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range []string{"v1", "v2"} {
+		header := RequestHeader{CmdID: ClientCmdID{WallTime: int64(i + 1), Random: 1}}
+		args := &PutRequest{RequestHeader: header, Key: Key("a"), Value: Value{Bytes: []byte(v)}}
+		if err := <-rng.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	header := RequestHeader{CmdID: ClientCmdID{WallTime: 3, Random: 1}}
+	if err := <-rng.ReadWriteCmd("Delete", &DeleteRequest{RequestHeader: header, Key: Key("a")}, &DeleteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	rs := newRaftStorage(store.engine, store.engine)
+	if err := rs.AppendLogEntries(multiraft.GroupID(1), []*multiraft.LogEntry{
+		{Term: 1, Index: 1, Payload: []byte("x")},
+		{Term: 2, Index: 2, Payload: []byte("y")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	engine := NewReadOnlyEngine(store.engine)
+
+	ident, err := DebugStoreIdent(engine)
+	if err != nil || ident.NodeID != 1 || ident.StoreID != 2 {
+		t.Errorf("unexpected store ident %+v, %v", ident, err)
+	}
+	if _, err := DebugStoreIdent(NewInMem(Attributes{}, 1<<20)); err == nil {
+		t.Error("expected error reading ident of unbootstrapped store")
+	}
+
+	metas, err := DebugRangeMetadata(engine)
+	if err != nil || len(metas) != 1 || metas[0].RangeID != 1 {
+		t.Fatalf("unexpected range metadata %+v, %v", metas, err)
+	}
+
+	dump, err := DebugRaftLog(engine, engine, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dump.LastIndex != 2 || len(dump.Entries) != 2 || dump.Entries[1].Term != 2 || string(dump.Entries[1].Payload) != "y" {
+		t.Errorf("unexpected raft log dump %+v", dump)
+	}
+
+	kvs, err := DebugRangeLocal(engine, engine, metas[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats *MVCCStats
+	respCacheEntries := 0
+	for _, kv := range kvs {
+		switch v := kv.Value.(type) {
+		case *MVCCStats:
+			stats = v
+		case []byte:
+			if bytes.HasPrefix(kv.Key, keyLocalResponseCachePrefix) {
+				respCacheEntries++
+			}
+		}
+	}
+	if stats == nil || stats.KeyCount != 1 {
+		t.Errorf("expected MVCC stats of one key; got %+v", stats)
+	}
+	if respCacheEntries != 3 {
+		t.Errorf("expected 3 response cache entries; got %d", respCacheEntries)
+	}
+
+	meta, versions, err := DebugMVCCVersions(engine, Key("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta == nil || !meta.Deleted {
+		t.Errorf("expected metadata of deleted key; got %+v", meta)
+	}
+	if len(versions) != 3 || versions[0].Value != nil ||
+		string(versions[1].Value.Bytes) != "v2" || string(versions[2].Value.Bytes) != "v1" {
+		t.Fatalf("unexpected versions %+v", versions)
+	}
+	if !versions[1].Timestamp.Less(versions[0].Timestamp) {
+		t.Errorf("expected versions most recent first; got %+v", versions)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import "sync/atomic"
+
+// DrainProgress reports the work remaining to drain a store.
+type DrainProgress struct {
+	Leases   int // Leader leases still held by the store's replicas
+	Replicas int // Replicas remaining on the store
+}
+
+// SetDraining sets whether the store is draining. A draining store's
+// replicas don't acquire or extend leader leases, and other stores
+// don't allocate replicas to it once its descriptor is gossiped.
+func (s *Store) SetDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&s.draining, v)
+}
+
+// IsDraining returns true if the store is draining.
+func (s *Store) IsDraining() bool {
+	return atomic.LoadInt32(&s.draining) != 0
+}
+
+// Drain drains the store so that its node may be restarted or
+// decommissioned without a loss of availability. The store is marked
+// draining, its replicas are moved to other stores if moveReplicas is
+// true, and the leader leases its replicas hold are transferred to
+// other replicas. Finally, the commands already executing on its
+// ranges are waited for. Drain may be called repeatedly until it
+// reports no remaining work; leases of ranges without other replicas
+// and replicas for which no target store is found remain.
+func (s *Store) Drain(moveReplicas bool) (DrainProgress, error) {
+	s.SetDraining(true)
+	if moveReplicas {
+		for _, rng := range s.sortedRanges() {
+			if _, err := s.moveReplica(rng, s.allocator.allocate); err != nil {
+				return s.DrainProgress(), err
+			}
+		}
+	}
+	s.DrainLeaderLeases()
+	for _, rng := range s.sortedRanges() {
+		rng.flushPending()
+	}
+	return s.DrainProgress(), nil
+}
+
+// DrainProgress returns the work remaining to drain the store.
+func (s *Store) DrainProgress() DrainProgress {
+	now := s.clock.Now()
+	ranges := s.sortedRanges()
+	progress := DrainProgress{Replicas: len(ranges)}
+	for _, rng := range ranges {
+		if rng.HasLeaderLease(now) {
+			progress.Leases++
+		}
+	}
+	return progress
+}
@@ -0,0 +1,83 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/hlc"
+)
+
+// TestStoreDrain verifies that draining a store transfers its leader
+// leases to other replicas and that its replicas don't reacquire
+// leases while it's draining.
+func TestStoreDrain(t *testing.T) {
+	manual := hlc.ManualClock(1)
+	clock := hlc.NewHLClock(manual.UnixNano)
+	store := NewStore(clock, NewInMem(Attributes{}, 1<<20), nil, nil)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	local := Replica{NodeID: 1, StoreID: 1, RangeID: 1}
+	remote := Replica{NodeID: 2, StoreID: 2, RangeID: 1}
+	rng, err := store.CreateRange(KeyMin, Key("m"), []Replica{local, remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second range has no other replica to take its lease.
+	solo, err := store.CreateRange(Key("m"), KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(rng *Range, key string) error {
+		args := &PutRequest{Key: Key(key), Value: Value{Bytes: []byte("value")}}
+		return <-rng.ReadWriteCmd("Put", args, &PutResponse{})
+	}
+	for _, r := range []*Range{rng, solo} {
+		if err := put(r, string(r.Meta.StartKey)+"a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p := store.DrainProgress(); p != (DrainProgress{Leases: 2, Replicas: 2}) {
+		t.Errorf("expected 2 leases and replicas before draining; got %+v", p)
+	}
+
+	progress, err := store.Drain(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress != (DrainProgress{Leases: 1, Replicas: 2}) {
+		t.Errorf("expected the solo range's lease to remain; got %+v", progress)
+	}
+	if !store.IsDraining() {
+		t.Error("expected store to be draining")
+	}
+	if lease := rng.getLease(); !sameReplica(lease.Replica, remote) {
+		t.Errorf("expected lease to be transferred to %+v; got %+v", remote, lease)
+	}
+
+	// Once the transferred lease expires, the draining store doesn't
+	// reacquire it.
+	manual = hlc.ManualClock(int64(manual) + leaderLeaseDuration.Nanoseconds() + 1)
+	if _, ok := put(rng, "a").(*NotLeaderError); !ok {
+		t.Error("expected draining store not to acquire lease")
+	}
+	store.SetDraining(false)
+	if err := put(rng, "a"); err != nil {
+		t.Errorf("expected store to acquire lease once no longer draining: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"encoding/binary"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+const (
+	// encodedEscape is the byte following a null byte in an encoded
+	// byte string which indicates the null byte is part of the
+	// original string.
+	encodedEscape = 0xff
+	// encodedTerm is the byte following a null byte in an encoded
+	// byte string which terminates the encoding.
+	encodedTerm = 0x01
+)
+
+// encodeBytes returns an encoding of b which sorts in the same order
+// as b and which is never a prefix of the encoding of any other byte
+// string. This allows arbitrary suffixes (e.g. timestamps) to be
+// appended to an encoded byte string without disturbing sort order.
+// Null bytes are escaped as \x00\xff and the encoding is terminated
+// with \x00\x01.
+func encodeBytes(b []byte) []byte {
+	return appendEncodedBytes(make([]byte, 0, len(b)+2), b)
+}
+
+// appendEncodedBytes appends the encoding of b (see encodeBytes) to
+// enc and returns the result.
+func appendEncodedBytes(enc, b []byte) []byte {
+	for _, c := range b {
+		enc = append(enc, c)
+		if c == 0 {
+			enc = append(enc, encodedEscape)
+		}
+	}
+	return append(enc, 0, encodedTerm)
+}
+
+// decodeBytes decodes a byte string encoded with encodeBytes from
+// the front of b. Returns the decoded byte string and the remainder
+// of b following the encoding.
+func decodeBytes(b []byte) ([]byte, []byte, error) {
+	dec := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] != 0 {
+			dec = append(dec, b[i])
+			continue
+		}
+		if i+1 >= len(b) {
+			break
+		}
+		switch b[i+1] {
+		case encodedTerm:
+			return dec, b[i+2:], nil
+		case encodedEscape:
+			dec = append(dec, 0)
+			i++
+		default:
+			return nil, nil, util.Errorf("invalid escape byte %q in encoded bytes %q", b[i+1], b)
+		}
+	}
+	return nil, nil, util.Errorf("unterminated encoded bytes %q", b)
+}
+
+// encodeUint64 appends the big-endian encoding of v to b, such that
+// encodings of smaller values sort before encodings of larger ones.
+func encodeUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// decodeUint64 decodes a uint64 encoded with encodeUint64 from the
+// front of b. Returns the value and the remainder of b.
+func decodeUint64(b []byte) (uint64, []byte, error) {
+	if len(b) < 8 {
+		return 0, nil, util.Errorf("insufficient bytes to decode uint64: %q", b)
+	}
+	return binary.BigEndian.Uint64(b), b[8:], nil
+}
+
+// encodeUint64Decreasing appends the encoding of v to b such that
+// encodings of larger values sort before encodings of smaller ones.
+func encodeUint64Decreasing(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], ^v)
+	return append(b, buf[:]...)
+}
+
+// decodeUint64Decreasing decodes a uint64 encoded with
+// encodeUint64Decreasing from the front of b. Returns the value and
+// the remainder of b.
+func decodeUint64Decreasing(b []byte) (uint64, []byte, error) {
+	if len(b) < 8 {
+		return 0, nil, util.Errorf("insufficient bytes to decode uint64: %q", b)
+	}
+	return ^binary.BigEndian.Uint64(b), b[8:], nil
+}
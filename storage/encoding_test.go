@@ -0,0 +1,223 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// fuzzIterations is the number of random inputs tried by each of the
+// randomized encoding tests.
+const fuzzIterations = 1000
+
+// newFuzzRand returns a random source for randomized tests, logging
+// its seed so that failures may be reproduced.
+func newFuzzRand(t *testing.T) *rand.Rand {
+	r, seed := util.NewPseudoRandWithSeed()
+	t.Logf("using random seed %d", seed)
+	return r
+}
+
+// randFuzzBytes returns a random byte string of length [0, maxLen).
+// Bytes are biased towards the values which are significant to the
+// byte string encoding (0x00, 0x01 and 0xff).
+func randFuzzBytes(r *rand.Rand, maxLen int) []byte {
+	b := make([]byte, r.Intn(maxLen))
+	for i := range b {
+		switch r.Intn(4) {
+		case 0:
+			b[i] = []byte{0x00, encodedTerm, encodedEscape}[r.Intn(3)]
+		default:
+			b[i] = byte(r.Intn(256))
+		}
+	}
+	return b
+}
+
+func TestEncodeBytesRoundTrip(t *testing.T) {
+	testCases := [][]byte{
+		{},
+		{0},
+		{0, 0},
+		{0, 1, 0xff},
+		[]byte("a"),
+		[]byte("a\x00b"),
+		[]byte("\xff\xff"),
+	}
+	for i, test := range testCases {
+		enc := encodeBytes(test)
+		enc = append(enc, []byte("suffix")...)
+		dec, rest, err := decodeBytes(enc)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+			continue
+		}
+		if !bytes.Equal(dec, test) {
+			t.Errorf("%d: expected %q; got %q", i, test, dec)
+		}
+		if string(rest) != "suffix" {
+			t.Errorf("%d: expected remainder \"suffix\"; got %q", i, rest)
+		}
+	}
+}
+
+// TestEncodeBytesOrdering verifies that encoded byte strings sort in
+// the same order as the original byte strings, even when suffixes
+// are appended to the encodings.
+func TestEncodeBytesOrdering(t *testing.T) {
+	ordered := [][]byte{
+		{},
+		{0},
+		{0, 0},
+		{0, 1},
+		[]byte("a"),
+		[]byte("a\x00"),
+		[]byte("a\x00\x00"),
+		[]byte("a\x01"),
+		[]byte("aa"),
+		[]byte("b"),
+		[]byte("\xff"),
+	}
+	for i := 1; i < len(ordered); i++ {
+		a := append(encodeBytes(ordered[i-1]), 0xff, 0xff)
+		b := append(encodeBytes(ordered[i]), 0x00)
+		if bytes.Compare(a, b) >= 0 {
+			t.Errorf("expected %q < %q; encodings %q >= %q", ordered[i-1], ordered[i], a, b)
+		}
+	}
+}
+
+func TestDecodeBytesErrors(t *testing.T) {
+	testCases := [][]byte{
+		{},
+		[]byte("a"),
+		{'a', 0},
+		{'a', 0, 2},
+	}
+	for i, test := range testCases {
+		if _, _, err := decodeBytes(test); err == nil {
+			t.Errorf("%d: expected error decoding %q", i, test)
+		}
+	}
+}
+
+func TestEncodeUint64(t *testing.T) {
+	ordered := []uint64{0, 1, 255, 256, 1 << 32, math.MaxUint64}
+	var last []byte
+	for i, v := range ordered {
+		enc := encodeUint64(nil, v)
+		if last != nil && bytes.Compare(last, enc) >= 0 {
+			t.Errorf("%d: expected encoding of %d to sort after its predecessor", i, v)
+		}
+		last = enc
+		dec, rest, err := decodeUint64(enc)
+		if err != nil || dec != v || len(rest) != 0 {
+			t.Errorf("%d: expected %d; got %d, %q, %v", i, v, dec, rest, err)
+		}
+	}
+	if _, _, err := decodeUint64([]byte{1, 2, 3}); err == nil {
+		t.Error("expected error decoding short byte slice")
+	}
+}
+
+func TestEncodeUint64Decreasing(t *testing.T) {
+	ordered := []uint64{math.MaxUint64, 1 << 32, 256, 255, 1, 0}
+	var last []byte
+	for i, v := range ordered {
+		enc := encodeUint64Decreasing(nil, v)
+		if last != nil && bytes.Compare(last, enc) >= 0 {
+			t.Errorf("%d: expected encoding of %d to sort after its predecessor", i, v)
+		}
+		last = enc
+		dec, rest, err := decodeUint64Decreasing(enc)
+		if err != nil || dec != v || len(rest) != 0 {
+			t.Errorf("%d: expected %d; got %d, %q, %v", i, v, dec, rest, err)
+		}
+	}
+	if _, _, err := decodeUint64Decreasing([]byte{1, 2, 3}); err == nil {
+		t.Error("expected error decoding short byte slice")
+	}
+}
+
+// TestEncodeBytesRandom verifies round-trip stability and order
+// preservation of encodeBytes on random byte strings.
+func TestEncodeBytesRandom(t *testing.T) {
+	r := newFuzzRand(t)
+	for i := 0; i < fuzzIterations; i++ {
+		a, b := randFuzzBytes(r, 20), randFuzzBytes(r, 20)
+		encA, encB := encodeBytes(a), encodeBytes(b)
+		suffix := randFuzzBytes(r, 10)
+		dec, rest, err := decodeBytes(append(append([]byte(nil), encA...), suffix...))
+		if err != nil || !bytes.Equal(dec, a) || !bytes.Equal(rest, suffix) {
+			t.Fatalf("%d: expected %q with remainder %q; got %q, %q, %v", i, a, suffix, dec, rest, err)
+		}
+		// Suffixes appended to encodings must not disturb sort order.
+		encA = append(encA, randFuzzBytes(r, 10)...)
+		encB = append(encB, randFuzzBytes(r, 10)...)
+		if cmp := bytes.Compare(a, b); cmp != 0 && cmp != bytes.Compare(encA, encB) {
+			t.Fatalf("%d: ordering of %q and %q not preserved by encodings %q and %q", i, a, b, encA, encB)
+		}
+	}
+}
+
+// TestDecodeArbitraryBytes verifies that the decoding functions don't
+// panic on arbitrary input and that any successful decoding is
+// canonical: re-encoding the result reproduces the consumed input.
+func TestDecodeArbitraryBytes(t *testing.T) {
+	r := newFuzzRand(t)
+	for i := 0; i < fuzzIterations; i++ {
+		b := randFuzzBytes(r, 30)
+		if dec, rest, err := decodeBytes(b); err == nil {
+			if enc := encodeBytes(dec); !bytes.Equal(append(enc, rest...), b) {
+				t.Fatalf("%d: decoding of %q is not canonical: %q + %q", i, b, enc, rest)
+			}
+		}
+		if v, rest, err := decodeUint64(b); err == nil {
+			if enc := encodeUint64(nil, v); !bytes.Equal(append(enc, rest...), b) {
+				t.Fatalf("%d: decoding of %q is not canonical: %q + %q", i, b, enc, rest)
+			}
+		} else if len(b) >= 8 {
+			t.Fatalf("%d: unexpected error decoding %q: %v", i, b, err)
+		}
+		if v, rest, err := decodeUint64Decreasing(b); err == nil {
+			if enc := encodeUint64Decreasing(nil, v); !bytes.Equal(append(enc, rest...), b) {
+				t.Fatalf("%d: decoding of %q is not canonical: %q + %q", i, b, enc, rest)
+			}
+		} else if len(b) >= 8 {
+			t.Fatalf("%d: unexpected error decoding %q: %v", i, b, err)
+		}
+	}
+}
+
+// TestEncodeUint64Random verifies order preservation of the uint64
+// encodings on random values.
+func TestEncodeUint64Random(t *testing.T) {
+	r := newFuzzRand(t)
+	for i := 0; i < fuzzIterations; i++ {
+		a, b := uint64(r.Int63())<<1|uint64(r.Intn(2)), uint64(r.Int63())>>uint(r.Intn(64))
+		if (a < b) != (bytes.Compare(encodeUint64(nil, a), encodeUint64(nil, b)) < 0) {
+			t.Fatalf("%d: ordering of %d and %d not preserved", i, a, b)
+		}
+		if (a > b) != (bytes.Compare(encodeUint64Decreasing(nil, a), encodeUint64Decreasing(nil, b)) < 0) {
+			t.Fatalf("%d: reverse ordering of %d and %d not preserved", i, a, b)
+		}
+	}
+}
@@ -21,9 +21,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
-	"time"
 
+	"github.com/cockroachdb/cockroach/hlc"
 	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/metrics"
 )
 
 // Engine is the interface that wraps the core operations of a
@@ -39,39 +40,91 @@ type Engine interface {
 	// start (inclusive) and ending at end (non-inclusive).
 	// Specify max=0 for unbounded scans.
 	scan(start, end Key, max int64) ([]KeyValue, error)
+	// reverseScan is like scan, but returns the key/value objects in
+	// descending key order, starting from the last key before end.
+	reverseScan(start, end Key, max int64) ([]KeyValue, error)
 	// delete removes the item from the db with the given key.
 	del(key Key) error
 	// writeBatch atomically applies the specified writes and deletions.
 	writeBatch(puts []KeyValue, deletes []Key) error
 	// capacity returns capacity details for the engine's available storage.
 	capacity() (StoreCapacity, error)
+	// snapshot returns a consistent, read-only view of the engine's
+	// data as of the time of the call. The snapshot must be released
+	// when no longer needed.
+	snapshot() (engineSnapshot, error)
 }
 
+// An engineSnapshot is a consistent, read-only view of an engine's
+// data which is unaffected by subsequent writes to the engine.
+type engineSnapshot interface {
+	// scan returns up to max key/value objects starting from
+	// start (inclusive) and ending at end (non-inclusive).
+	// Specify max=0 for unbounded scans.
+	scan(start, end Key, max int64) ([]KeyValue, error)
+	// release frees the resources held by the snapshot.
+	release()
+}
+
+// engineMetrics counts the operations performed by all engines of an
+// implementation, registered as storage_<kind>_<op>.
+type engineMetrics struct {
+	puts, gets, scans, deletes, batches *metrics.Counter
+	scanRows                            *metrics.Histogram // Rows returned per scan
+}
+
+// newEngineMetrics registers the metrics of the engine
+// implementation kind.
+func newEngineMetrics(kind string) engineMetrics {
+	prefix := "storage_" + kind + "_"
+	return engineMetrics{
+		puts:     metrics.DefaultRegistry.Counter(prefix + "puts"),
+		gets:     metrics.DefaultRegistry.Counter(prefix + "gets"),
+		scans:    metrics.DefaultRegistry.Counter(prefix + "scans"),
+		deletes:  metrics.DefaultRegistry.Counter(prefix + "deletes"),
+		batches:  metrics.DefaultRegistry.Counter(prefix + "write_batches"),
+		scanRows: metrics.DefaultRegistry.Histogram(prefix+"scan_rows", metrics.SizeBuckets),
+	}
+}
+
+var (
+	inMemMetrics   = newEngineMetrics("inmem")
+	rocksDBMetrics = newEngineMetrics("rocksdb")
+)
+
 // putI sets the given key to the gob-serialized byte string of the
-// value provided. Used internally. Uses current time and default
-// expiration.
+// value provided. Used internally for unversioned keys, such as
+// store-local and range-local keys.
 func putI(engine Engine, key Key, value interface{}) error {
+	kv, err := encodeI(key, value)
+	if err != nil {
+		return err
+	}
+	return engine.put(kv.Key, kv.Value)
+}
+
+// encodeI returns a KeyValue pairing key with the gob-serialized byte
+// string of the value provided, for inclusion in an engine's
+// writeBatch.
+func encodeI(key Key, value interface{}) (KeyValue, error) {
 	var buf bytes.Buffer
 	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
-		return err
+		return KeyValue{}, err
 	}
-	return engine.put(key, Value{
-		Bytes:     buf.Bytes(),
-		Timestamp: time.Now().UnixNano(),
-	})
+	return KeyValue{Key: key, Value: Value{Bytes: buf.Bytes()}}, nil
 }
 
 // getI fetches the specified key and gob-deserializes it into
 // "value". Returns true on success or false if the key was not
 // found. The timestamp of the write is returned as the second return
 // value.
-func getI(engine Engine, key Key, value interface{}) (bool, int64, error) {
+func getI(engine Engine, key Key, value interface{}) (bool, hlc.HLTimestamp, error) {
 	val, err := engine.get(key)
 	if err != nil {
-		return false, 0, err
+		return false, hlc.HLTimestamp{}, err
 	}
 	if len(val.Bytes) == 0 {
-		return false, 0, nil
+		return false, hlc.HLTimestamp{}, nil
 	}
 	if value != nil {
 		if err = gob.NewDecoder(bytes.NewBuffer(val.Bytes)).Decode(value); err != nil {
@@ -81,37 +134,49 @@ func getI(engine Engine, key Key, value interface{}) (bool, int64, error) {
 	return true, val.Timestamp, nil
 }
 
-// increment fetches the varint encoded int64 value specified by key
-// and adds "inc" to it then re-encodes as varint and puts the new
-// value to key using the timestamp "ts". The newly incremented value
-// is returned.
-func increment(engine Engine, key Key, inc int64, ts int64) (int64, error) {
-	// First retrieve existing value.
-	val, err := engine.get(key)
-	if err != nil {
-		return 0, err
-	}
+// incrementValue interprets b as a varint encoded int64 and adds inc
+// to it. An empty b is treated as zero. The newly incremented value
+// is returned along with its varint encoding. This is the primitive
+// underlying both unversioned and MVCC increments; key is used only
+// for error messages.
+func incrementValue(key Key, b []byte, inc int64) (int64, []byte, error) {
 	var int64Val int64
 	// If the value exists, attempt to decode it as a varint.
-	if len(val.Bytes) != 0 {
+	if len(b) != 0 {
 		var numBytes int
-		int64Val, numBytes = binary.Varint(val.Bytes)
+		int64Val, numBytes = binary.Varint(b)
 		if numBytes == 0 {
-			return 0, util.Errorf("key %q cannot be incremented; not varint-encoded", key)
+			return 0, nil, util.Errorf("key %q cannot be incremented; not varint-encoded", key)
 		} else if numBytes < 0 {
-			return 0, util.Errorf("key %q cannot be incremented; integer overflow", key)
+			return 0, nil, util.Errorf("key %q cannot be incremented; integer overflow", key)
 		}
 	}
 
 	// Check for overflow and underflow.
 	r := int64Val + inc
 	if (r < int64Val) != (inc < 0) {
-		return 0, util.Errorf("key %q with value %d incremented by %d results in overflow", key, int64Val, inc)
+		return 0, nil, util.Errorf("key %q with value %d incremented by %d results in overflow", key, int64Val, inc)
 	}
 
 	encoded := make([]byte, binary.MaxVarintLen64)
 	numBytes := binary.PutVarint(encoded, r)
-	encoded = encoded[:numBytes]
+	return r, encoded[:numBytes], nil
+}
+
+// increment fetches the varint encoded int64 value specified by key
+// and adds "inc" to it then re-encodes as varint and puts the new
+// value to key using the timestamp "ts". The newly incremented value
+// is returned.
+func increment(engine Engine, key Key, inc int64, ts hlc.HLTimestamp) (int64, error) {
+	// First retrieve existing value.
+	val, err := engine.get(key)
+	if err != nil {
+		return 0, err
+	}
+	r, encoded, err := incrementValue(key, val.Bytes, inc)
+	if err != nil {
+		return 0, err
+	}
 	if err = engine.put(key, Value{Bytes: encoded, Timestamp: ts}); err != nil {
 		return 0, err
 	}
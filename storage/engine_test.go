@@ -101,3 +101,96 @@ func TestEngineWriteBatch(t *testing.T) {
 		<-readsDone
 	}, t)
 }
+
+// TestEngineSnapshot verifies that engine snapshots aren't affected
+// by writes to the engine after the snapshot was taken.
+func TestEngineSnapshot(t *testing.T) {
+	runWithAllEngines(func(e Engine, t *testing.T) {
+		if err := e.writeBatch([]KeyValue{
+			{Key: Key("a"), Value: Value{Bytes: []byte("1")}},
+			{Key: Key("b"), Value: Value{Bytes: []byte("2")}},
+		}, nil); err != nil {
+			t.Fatal(err)
+		}
+		snap, err := e.snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snap.release()
+		if err := e.writeBatch([]KeyValue{
+			{Key: Key("a"), Value: Value{Bytes: []byte("3")}},
+			{Key: Key("c"), Value: Value{Bytes: []byte("4")}},
+		}, []Key{Key("b")}); err != nil {
+			t.Fatal(err)
+		}
+		kvs, err := snap.scan(KeyMin, KeyMax, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(kvs) != 2 || !bytes.Equal(kvs[0].Key, Key("a")) || !bytes.Equal(kvs[0].Value.Bytes, []byte("1")) ||
+			!bytes.Equal(kvs[1].Key, Key("b")) {
+			t.Errorf("expected snapshot to contain a=1, b=2; got %+v", kvs)
+		}
+		if kvs, err = snap.scan(Key("b"), KeyMax, 1); err != nil || len(kvs) != 1 || !bytes.Equal(kvs[0].Key, Key("b")) {
+			t.Errorf("expected bounded snapshot scan to return b; got %+v, %v", kvs, err)
+		}
+	}, t)
+}
+
+// TestEngineReverseScan verifies that reverse scans return the keys
+// of their span in descending order, from the last key before the
+// span's end.
+func TestEngineReverseScan(t *testing.T) {
+	runWithAllEngines(func(e Engine, t *testing.T) {
+		var puts []KeyValue
+		for _, key := range []string{"a", "b", "c", "d"} {
+			puts = append(puts, KeyValue{Key: Key(key), Value: Value{Bytes: []byte(key)}})
+		}
+		if err := e.writeBatch(puts, nil); err != nil {
+			t.Fatal(err)
+		}
+		testCases := []struct {
+			start, end Key
+			max        int64
+			expKeys    string
+		}{
+			{KeyMin, KeyMax, 0, "dcba"},
+			{Key("b"), Key("d"), 0, "cb"},
+			{Key("a"), Key("c\x00"), 2, "cb"},
+			{Key("b0"), Key("c"), 0, ""},
+			{Key("c"), Key("c"), 0, ""},
+		}
+		for i, test := range testCases {
+			kvs, err := e.reverseScan(test.start, test.end, test.max)
+			if err != nil {
+				t.Fatalf("%d: %v", i, err)
+			}
+			var keys string
+			for _, kv := range kvs {
+				keys += string(kv.Key)
+			}
+			if keys != test.expKeys {
+				t.Errorf("%d: expected keys %q; got %q", i, test.expKeys, keys)
+			}
+		}
+	}, t)
+}
+
+// TestIncrementValue verifies decoding, overflow detection and
+// encoding of the increment primitive.
+func TestIncrementValue(t *testing.T) {
+	val, encoded, err := incrementValue(Key("a"), nil, 5)
+	if err != nil || val != 5 {
+		t.Fatalf("expected 5; got %d, %v", val, err)
+	}
+	if val, _, err = incrementValue(Key("a"), encoded, -7); err != nil || val != -2 {
+		t.Errorf("expected -2; got %d, %v", val, err)
+	}
+	if _, _, err = incrementValue(Key("a"), []byte{0xff}, 1); err == nil {
+		t.Error("expected error decoding non-varint value")
+	}
+	_, encoded, _ = incrementValue(Key("a"), nil, 1<<62)
+	if _, _, err = incrementValue(Key("a"), encoded, 1<<62); err == nil {
+		t.Error("expected overflow error")
+	}
+}
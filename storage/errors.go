@@ -0,0 +1,248 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"encoding/gob"
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/hlc"
+)
+
+// init registers the error types which may be sent in the Error
+// field of RPC replies (see WireError).
+func init() {
+	gob.Register(&GenericError{})
+	gob.Register(&NotLeaderError{})
+	gob.Register(&RangeKeyMismatchError{})
+	gob.Register(&WriteIntentError{})
+	gob.Register(&WriteTooOldError{})
+	gob.Register(&ConditionFailedError{})
+	gob.Register(&ReadTooOldError{})
+	gob.Register(&PermissionError{})
+	gob.Register(&TransactionPushError{})
+	gob.Register(&TransactionAbortedError{})
+	gob.Register(&TransactionRetryError{})
+	gob.Register(&TransactionStatusError{})
+	gob.Register(&OverloadedError{})
+}
+
+// A GenericError carries the message of an error of a type which
+// can't be sent in RPC replies.
+type GenericError struct {
+	Message string
+}
+
+// Error formats error.
+func (e *GenericError) Error() string {
+	return e.Message
+}
+
+// WireError returns err in a form which may be gob-encoded in the
+// Error field of an RPC reply. Errors of the types defined in this
+// file are returned as is, so that clients may act on them; others
+// are converted to a GenericError with the same message.
+func WireError(err error) error {
+	switch err.(type) {
+	case nil, *GenericError, *NotLeaderError, *RangeKeyMismatchError, *WriteIntentError,
+		*WriteTooOldError, *ConditionFailedError, *ReadTooOldError, *PermissionError,
+		*TransactionPushError, *TransactionAbortedError, *TransactionRetryError,
+		*TransactionStatusError, *OverloadedError:
+		return err
+	}
+	return &GenericError{Message: err.Error()}
+}
+
+// A NotLeaderError indicates that the request was addressed to a
+// range replica which doesn't hold the leader lease and can't serve
+// it. Clients should retry the request, possibly addressed to the
+// leader, which is the holder of the range's leader lease if known.
+type NotLeaderError struct {
+	RangeID int64
+	Leader  *Replica
+}
+
+// Error formats error.
+func (e *NotLeaderError) Error() string {
+	if e.Leader != nil {
+		return fmt.Sprintf("range %d: replica is not the leader; leader is %+v", e.RangeID, *e.Leader)
+	}
+	return fmt.Sprintf("range %d: replica is not the leader", e.RangeID)
+}
+
+// CanRetry implements the util.Retryable interface.
+func (e *NotLeaderError) CanRetry() bool { return true }
+
+// A RangeKeyMismatchError indicates that the key addressed by a
+// request isn't contained in the range to which the request was sent.
+// This happens when a client's cached range metadata is stale, for
+// example after a split. Clients should refresh their range metadata
+// and retry.
+type RangeKeyMismatchError struct {
+	RequestKey Key
+	Range      RangeMetadata
+}
+
+// Error formats error.
+func (e *RangeKeyMismatchError) Error() string {
+	return fmt.Sprintf("key %q outside of bounds of range %d [%q, %q)",
+		e.RequestKey, e.Range.RangeID, e.Range.StartKey, e.Range.EndKey)
+}
+
+// CanRetry implements the util.Retryable interface.
+func (e *RangeKeyMismatchError) CanRetry() bool { return true }
+
+// A WriteIntentError indicates that an operation encountered a
+// write intent belonging to another transaction.
+type WriteIntentError struct {
+	Key Key
+	Txn Transaction
+}
+
+// Error formats error.
+func (e *WriteIntentError) Error() string {
+	return fmt.Sprintf("conflicting write intent at key %q from %s", e.Key, &e.Txn)
+}
+
+// A WriteTooOldError indicates that a write was attempted at a
+// timestamp not later than that of the most recent committed version
+// of the key.
+type WriteTooOldError struct {
+	Timestamp         hlc.HLTimestamp
+	ExistingTimestamp hlc.HLTimestamp
+}
+
+// Error formats error.
+func (e *WriteTooOldError) Error() string {
+	return fmt.Sprintf("write too old: timestamp %+v <= %+v", e.Timestamp, e.ExistingTimestamp)
+}
+
+// A ConditionFailedError indicates that the expected value of a
+// ConditionalPut didn't match the actual value. ActualValue is nil if
+// the key doesn't exist.
+type ConditionFailedError struct {
+	ActualValue *Value
+}
+
+// Error formats error.
+func (e *ConditionFailedError) Error() string {
+	if e.ActualValue == nil {
+		return "unexpected value: <nil>"
+	}
+	return fmt.Sprintf("unexpected value: %q", e.ActualValue.Bytes)
+}
+
+// A ReadTooOldError indicates that a read was attempted at a
+// timestamp older than the range's GC threshold. Historical versions
+// which would have been visible to the read may have been garbage
+// collected.
+type ReadTooOldError struct {
+	Timestamp hlc.HLTimestamp
+	Threshold hlc.HLTimestamp
+}
+
+// Error formats error.
+func (e *ReadTooOldError) Error() string {
+	return fmt.Sprintf("read at timestamp %+v is older than GC threshold %+v; history may have been garbage collected",
+		e.Timestamp, e.Threshold)
+}
+
+// A PermissionError indicates that the user on whose behalf a request
+// was made isn't permitted to read or write the keys it addresses.
+type PermissionError struct {
+	User  string
+	Key   Key  // First key of the span for which access was denied
+	Write bool // True if write access was denied; false for read access
+}
+
+// Error formats error.
+func (e *PermissionError) Error() string {
+	access := "read"
+	if e.Write {
+		access = "write"
+	}
+	return fmt.Sprintf("user %q does not have %s permission for key %q", e.User, access, e.Key)
+}
+
+// A TransactionPushError indicates that the pusher was unable to
+// push the pushee transaction because the pushee has higher
+// priority. The pusher should back off and retry.
+type TransactionPushError struct {
+	PusheeTxn Transaction
+}
+
+// Error formats error.
+func (e *TransactionPushError) Error() string {
+	return fmt.Sprintf("failed to push %s", &e.PusheeTxn)
+}
+
+// CanRetry implements the util.Retryable interface.
+func (e *TransactionPushError) CanRetry() bool { return true }
+
+// A TransactionAbortedError indicates that the transaction was
+// aborted by another concurrent transaction.
+type TransactionAbortedError struct {
+	Txn Transaction
+}
+
+// Error formats error.
+func (e *TransactionAbortedError) Error() string {
+	return fmt.Sprintf("%s aborted", &e.Txn)
+}
+
+// A TransactionRetryError indicates that the transaction's timestamp
+// was pushed and, because of its isolation level, it must be
+// restarted at the new timestamp.
+type TransactionRetryError struct {
+	Txn Transaction
+}
+
+// Error formats error.
+func (e *TransactionRetryError) Error() string {
+	return fmt.Sprintf("retry %s", &e.Txn)
+}
+
+// CanRetry implements the util.Retryable interface.
+func (e *TransactionRetryError) CanRetry() bool { return true }
+
+// A TransactionStatusError indicates that the transaction's status
+// doesn't permit the requested operation (e.g. committing an already
+// committed transaction).
+type TransactionStatusError struct {
+	Txn Transaction
+	Msg string
+}
+
+// Error formats error.
+func (e *TransactionStatusError) Error() string {
+	return fmt.Sprintf("%s: %s", &e.Txn, e.Msg)
+}
+
+// An OverloadedError indicates that the store addressed by the
+// request was overloaded and shed the request without executing it.
+// Clients should back off and retry.
+type OverloadedError struct {
+	StoreID int32
+	Reason  string
+}
+
+// Error formats error.
+func (e *OverloadedError) Error() string {
+	return fmt.Sprintf("store %d is overloaded: %s", e.StoreID, e.Reason)
+}
+
+// CanRetry implements the util.Retryable interface.
+func (e *OverloadedError) CanRetry() bool { return true }
@@ -0,0 +1,53 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// TestWireError verifies that errors prepared by WireError survive
+// gob encoding in replies, keeping their types where defined here.
+func TestWireError(t *testing.T) {
+	testCases := []struct {
+		err error
+		exp error
+	}{
+		{nil, nil},
+		{&NotLeaderError{RangeID: 1, Leader: &Replica{NodeID: 2}}, &NotLeaderError{RangeID: 1, Leader: &Replica{NodeID: 2}}},
+		{&PermissionError{User: "foo", Key: Key("a")}, &PermissionError{User: "foo", Key: Key("a")}},
+		{&OverloadedError{StoreID: 1, Reason: "busy"}, &OverloadedError{StoreID: 1, Reason: "busy"}},
+		{errors.New("boom"), &GenericError{Message: "boom"}},
+	}
+	for i, test := range testCases {
+		reply := &GetResponse{ResponseHeader: ResponseHeader{Error: WireError(test.err)}}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(reply); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		decoded := &GetResponse{}
+		if err := gob.NewDecoder(&buf).Decode(decoded); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(decoded.Error, test.exp) {
+			t.Errorf("%d: expected %#v; got %#v", i, test.exp, decoded.Error)
+		}
+	}
+}
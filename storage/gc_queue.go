@@ -0,0 +1,75 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import "time"
+
+// gcInterval is the minimum interval between garbage collections of
+// a range's historical versions.
+const gcInterval = 1 * time.Hour
+
+// A gcQueue is a range queue which garbage collects historical
+// versions no longer visible to reads within the GC TTL of the zone
+// config covering the range (see Range.gcTTL). Before collecting, it
+// cleans up the range's write intents older than txnExpiration whose
+// transactions have ended or been abandoned (see
+// Range.cleanupIntents). Only ranges for which the store holds the
+// leader replica and which have non-live bytes or intents are
+// collected, each at most once per gcInterval.
+type gcQueue struct {
+	interval time.Duration
+	now      func() time.Time
+	lastGC   map[int64]time.Time // Last GC time by range ID
+}
+
+// newGCQueue returns a GC queue which collects each range at most
+// once per interval.
+func newGCQueue(interval time.Duration) *gcQueue {
+	return &gcQueue{
+		interval: interval,
+		now:      time.Now,
+		lastGC:   map[int64]time.Time{},
+	}
+}
+
+func (gq *gcQueue) name() string     { return "GC" }
+func (gq *gcQueue) beginScan() error { return nil }
+
+// process cleans up the range's old intents and garbage collects its
+// versions older than its GC threshold, at a pace set by the store's
+// throttle.
+func (gq *gcQueue) process(rng *Range) error {
+	rangeID := rng.Meta.RangeID
+	now := gq.now()
+	stats := rng.Stats()
+	gcBytes := stats.GCBytes()
+	if !rng.IsLeader() || (gcBytes == 0 && stats.IntentCount == 0) || now.Sub(gq.lastGC[rangeID]) < gq.interval {
+		return nil
+	}
+	if err := rng.throttle.wait(throttleGC, gcBytes); err != nil {
+		return err
+	}
+	gq.lastGC[rangeID] = now
+	if stats.IntentCount > 0 {
+		intentThreshold := rng.clock.Now()
+		intentThreshold.WallTime -= int64(txnExpiration)
+		if err := rng.cleanupIntents(intentThreshold); err != nil {
+			return err
+		}
+	}
+	args := &InternalGCRequest{Key: rng.getMeta().StartKey, GCThreshold: rng.gcThreshold()}
+	return <-rng.ReadWriteCmd("InternalGC", args, &InternalGCResponse{})
+}
@@ -0,0 +1,89 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/hlc"
+)
+
+// TestGCQueue verifies that the GC queue collects versions older than
+// the GC TTL of the range's zone, and that it collects each range at
+// most once per interval.
+func TestGCQueue(t *testing.T) {
+	engine := NewInMem(Attributes{}, 1<<20)
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), engine, nil, gossip.New())
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	putTestConfig(engine, KeyConfigZonePrefix, ZoneConfig{GCTTLSeconds: 10}, t)
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The range also contains the zone config.
+	baseCount := rng.Stats().ValCount
+	now := store.clock.Now()
+	for _, age := range []time.Duration{30 * time.Second, 20 * time.Second, 0} {
+		ts := now
+		ts.WallTime -= age.Nanoseconds()
+		args := &PutRequest{RequestHeader: RequestHeader{Timestamp: ts}, Key: Key("a"), Value: Value{Bytes: []byte("value")}}
+		if err := <-rng.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if valCount := rng.Stats().ValCount - baseCount; valCount != 3 {
+		t.Fatalf("expected 3 versions; got %d", valCount)
+	}
+
+	gq := newGCQueue(gcInterval)
+	if err := gq.process(rng); err != nil {
+		t.Fatal(err)
+	}
+	// The version written 20s ago is visible at the GC threshold and
+	// must be kept; the oldest version is collected.
+	if valCount := rng.Stats().ValCount - baseCount; valCount != 2 {
+		t.Errorf("expected 2 versions after GC; got %d", valCount)
+	}
+
+	// Within the interval, the range isn't collected again.
+	for _, age := range []time.Duration{30 * time.Second, 25 * time.Second} {
+		ts := now
+		ts.WallTime -= age.Nanoseconds()
+		args := &PutRequest{RequestHeader: RequestHeader{Timestamp: ts}, Key: Key("b"), Value: Value{Bytes: []byte("value")}}
+		if err := <-rng.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gq.now = func() time.Time { return time.Now().Add(gcInterval / 2) }
+	if err := gq.process(rng); err != nil {
+		t.Fatal(err)
+	}
+	if valCount := rng.Stats().ValCount - baseCount; valCount != 4 {
+		t.Errorf("expected range not to be collected within interval; got %d versions", valCount)
+	}
+	gq.now = func() time.Time { return time.Now().Add(gcInterval) }
+	if err := gq.process(rng); err != nil {
+		t.Fatal(err)
+	}
+	if valCount := rng.Stats().ValCount - baseCount; valCount != 3 {
+		t.Errorf("expected 3 versions after second GC; got %d", valCount)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+// WriteGossipBootstrap persists the addresses (host:port) of gossip
+// peers recently known to the store's node, replacing those persisted
+// before. On restart, the node adds them to its gossip bootstrap
+// hosts, so a restarted cluster can reconnect even if the hosts
+// originally specified for joining it are gone.
+func (s *Store) WriteGossipBootstrap(addrs []string) error {
+	return putI(s.engine, keyGossipBootstrap, addrs)
+}
+
+// ReadGossipBootstrap returns the gossip peer addresses last
+// persisted to engine via WriteGossipBootstrap, if any. It may be
+// called before the engine's store is initialized.
+func ReadGossipBootstrap(engine Engine) ([]string, error) {
+	var addrs []string
+	if _, _, err := getI(engine, keyGossipBootstrap, &addrs); err != nil {
+		return nil, err
+	}
+	return addrs, nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestGossipBootstrap verifies that the gossip bootstrap addresses
+// written by a store replace those written before and are read back
+// from its engine.
+func TestGossipBootstrap(t *testing.T) {
+	store := createTestStore(1, 1, t)
+	if addrs, err := ReadGossipBootstrap(store.engine); err != nil || len(addrs) != 0 {
+		t.Fatalf("expected no addresses; got %v, %v", addrs, err)
+	}
+	for _, expAddrs := range [][]string{
+		{"10.0.0.1:8080", "10.0.0.2:8080"},
+		{"10.0.0.3:8080"},
+	} {
+		if err := store.WriteGossipBootstrap(expAddrs); err != nil {
+			t.Fatal(err)
+		}
+		addrs, err := ReadGossipBootstrap(store.engine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(addrs, expAddrs) {
+			t.Errorf("expected addresses %v; got %v", expAddrs, addrs)
+		}
+	}
+}
@@ -75,6 +75,7 @@ func (in *InMem) Attrs() Attributes {
 
 // put sets the given key to the value provided.
 func (in *InMem) put(key Key, value Value) error {
+	inMemMetrics.puts.Inc(1)
 	in.Lock()
 	defer in.Unlock()
 	return in.putLocked(key, value)
@@ -94,6 +95,7 @@ func (in *InMem) putLocked(key Key, value Value) error {
 
 // get returns the value for the given key, nil otherwise.
 func (in *InMem) get(key Key) (Value, error) {
+	inMemMetrics.gets.Inc(1)
 	in.RLock()
 	defer in.RUnlock()
 	val := in.data.Get(KeyValue{Key: key})
@@ -106,11 +108,19 @@ func (in *InMem) get(key Key) (Value, error) {
 // scan returns up to max key/value objects starting from
 // start (inclusive) and ending at end (non-inclusive).
 func (in *InMem) scan(start, end Key, max int64) ([]KeyValue, error) {
+	inMemMetrics.scans.Inc(1)
 	in.RLock()
 	defer in.RUnlock()
+	kvs := scanTree(&in.data, start, end, max)
+	inMemMetrics.scanRows.Update(int64(len(kvs)))
+	return kvs, nil
+}
 
+// scanTree returns up to max key/value objects from the tree starting
+// from start (inclusive) and ending at end (non-inclusive).
+func scanTree(tree *llrb.Tree, start, end Key, max int64) []KeyValue {
 	var scanned []KeyValue
-	in.data.DoRange(func(kv llrb.Comparable) (done bool) {
+	tree.DoRange(func(kv llrb.Comparable) (done bool) {
 		if max != 0 && int64(len(scanned)) >= max {
 			done = true
 			return
@@ -118,12 +128,55 @@ func (in *InMem) scan(start, end Key, max int64) ([]KeyValue, error) {
 		scanned = append(scanned, kv.(KeyValue))
 		return
 	}, KeyValue{Key: start}, KeyValue{Key: end})
+	return scanned
+}
 
-	return scanned, nil
+// reverseScan returns up to max key/value objects starting from the
+// last key before end and ending at start (inclusive), in descending
+// key order.
+func (in *InMem) reverseScan(start, end Key, max int64) ([]KeyValue, error) {
+	inMemMetrics.scans.Inc(1)
+	in.RLock()
+	defer in.RUnlock()
+	kvs := reverseScanTree(&in.data, start, end, max)
+	inMemMetrics.scanRows.Update(int64(len(kvs)))
+	return kvs, nil
+}
+
+// reverseScanTree returns up to max key/value objects from the tree
+// in descending key order, starting from the last key before end and
+// ending at start (inclusive).
+func reverseScanTree(tree *llrb.Tree, start, end Key, max int64) []KeyValue {
+	var scanned []KeyValue
+	if bytes.Compare(start, end) >= 0 {
+		return scanned
+	}
+	// The reverse traversal's interval is open at its lower bound and
+	// closed at its upper bound, the opposite of the scan's; so end is
+	// skipped and start is appended last.
+	tree.DoRangeReverse(func(kv llrb.Comparable) (done bool) {
+		key := kv.(KeyValue).Key
+		if bytes.Equal(key, end) || bytes.Equal(key, start) {
+			return
+		}
+		if max != 0 && int64(len(scanned)) >= max {
+			done = true
+			return
+		}
+		scanned = append(scanned, kv.(KeyValue))
+		return
+	}, KeyValue{Key: end}, KeyValue{Key: start})
+	if max == 0 || int64(len(scanned)) < max {
+		if kv := tree.Get(KeyValue{Key: start}); kv != nil {
+			scanned = append(scanned, kv.(KeyValue))
+		}
+	}
+	return scanned
 }
 
 // del removes the item from the db with the given key.
 func (in *InMem) del(key Key) error {
+	inMemMetrics.deletes.Inc(1)
 	in.Lock()
 	defer in.Unlock()
 	return in.delLocked(key)
@@ -144,6 +197,7 @@ func (in *InMem) delLocked(key Key) error {
 // writeBatch atomically applies the specified writes and deletions
 // by holding the mutex.
 func (in *InMem) writeBatch(puts []KeyValue, dels []Key) error {
+	inMemMetrics.batches.Inc(1)
 	in.Lock()
 	defer in.Unlock()
 	for _, put := range puts {
@@ -164,8 +218,52 @@ func (in *InMem) writeBatch(puts []KeyValue, dels []Key) error {
 // not be entirely accurate due to object storage costs and other
 // internal glue.
 func (in *InMem) capacity() (StoreCapacity, error) {
+	in.RLock()
+	defer in.RUnlock()
 	return StoreCapacity{
 		Capacity:  in.maxBytes,
 		Available: in.maxBytes - in.usedBytes,
 	}, nil
 }
+
+// Clone returns a copy of the engine with the same attributes and
+// capacity. Later writes to either engine aren't visible to the
+// other, so a clone may checkpoint an engine's state for reuse.
+func (in *InMem) Clone() *InMem {
+	in.RLock()
+	defer in.RUnlock()
+	clone := NewInMem(in.attrs, in.maxBytes)
+	clone.usedBytes = in.usedBytes
+	in.data.Do(func(kv llrb.Comparable) (done bool) {
+		clone.data.Insert(kv)
+		return false
+	})
+	return clone
+}
+
+// inMemSnapshot is a snapshot of an InMem engine.
+type inMemSnapshot struct {
+	data llrb.Tree
+}
+
+// snapshot returns a snapshot of the engine. The engine's data is
+// copied, so snapshots of large engines are expensive.
+func (in *InMem) snapshot() (engineSnapshot, error) {
+	in.RLock()
+	defer in.RUnlock()
+	snap := &inMemSnapshot{}
+	in.data.Do(func(kv llrb.Comparable) (done bool) {
+		snap.data.Insert(kv)
+		return false
+	})
+	return snap, nil
+}
+
+// scan returns up to max key/value objects from the snapshot starting
+// from start (inclusive) and ending at end (non-inclusive).
+func (s *inMemSnapshot) scan(start, end Key, max int64) ([]KeyValue, error) {
+	return scanTree(&s.data, start, end, max), nil
+}
+
+// release is a noop for InMem snapshots.
+func (s *inMemSnapshot) release() {}
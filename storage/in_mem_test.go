@@ -23,8 +23,11 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"reflect"
 	"runtime"
 	"testing"
+
+	"github.com/cockroachdb/cockroach/hlc"
 )
 
 func TestInMemEnginePutGetDelete(t *testing.T) {
@@ -71,6 +74,32 @@ func TestInMemEnginePutGetDelete(t *testing.T) {
 	}
 }
 
+// TestInMemClone verifies that a clone has the engine's data and
+// capacity, and that later writes to either aren't seen by the other.
+func TestInMemClone(t *testing.T) {
+	engine := NewInMem(Attributes{"mem"}, 1<<20)
+	if err := engine.put(Key("a"), Value{Bytes: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	clone := engine.Clone()
+	if err := engine.put(Key("b"), Value{Bytes: []byte("2")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := clone.del(Key("a")); err != nil {
+		t.Fatal(err)
+	}
+	verifyScan(KeyMin, KeyMax, 10, []Key{Key("a"), Key("b")}, engine, t)
+	verifyScan(KeyMin, KeyMax, 10, []Key{}, clone, t)
+
+	if err := clone.put(Key("c"), Value{Bytes: []byte("3")}); err != nil {
+		t.Fatal(err)
+	}
+	verifyScan(KeyMin, KeyMax, 10, []Key{Key("c")}, clone, t)
+	if !reflect.DeepEqual(clone.Attrs(), engine.Attrs()) || clone.maxBytes != engine.maxBytes {
+		t.Errorf("expected clone %s to have the attributes and capacity of %s", clone, engine)
+	}
+}
+
 func TestInMemCapacity(t *testing.T) {
 	engine := NewInMem(Attributes{}, 1<<20)
 	c, err := engine.capacity()
@@ -115,7 +144,7 @@ func TestInMemCapacity(t *testing.T) {
 }
 
 func TestInMemOverCapacity(t *testing.T) {
-	engine := NewInMem(Attributes{}, 120 /* 120 bytes only -- enough for one node, not two */)
+	engine := NewInMem(Attributes{}, 140 /* 140 bytes only -- enough for one node, not two */)
 	bytes := []byte("0123456789")
 	var err error
 	if err = engine.put(Key("1"), Value{Bytes: bytes}); err != nil {
@@ -129,7 +158,7 @@ func TestInMemOverCapacity(t *testing.T) {
 func TestInMemIncrement(t *testing.T) {
 	engine := NewInMem(Attributes{}, 1<<20)
 	// Start with increment of an empty key.
-	val, err := increment(engine, Key("a"), 1, 0)
+	val, err := increment(engine, Key("a"), 1, hlc.HLTimestamp{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -137,31 +166,31 @@ func TestInMemIncrement(t *testing.T) {
 		t.Errorf("expected increment to be %d; got %d", 1, val)
 	}
 	// Increment same key by 1.
-	if val, err = increment(engine, Key("a"), 1, 0); err != nil {
+	if val, err = increment(engine, Key("a"), 1, hlc.HLTimestamp{}); err != nil {
 		t.Fatal(err)
 	}
 	if val != 2 {
 		t.Errorf("expected increment to be %d; got %d", 2, val)
 	}
 	// Increment same key by 2.
-	if val, err = increment(engine, Key("a"), 2, 0); err != nil {
+	if val, err = increment(engine, Key("a"), 2, hlc.HLTimestamp{}); err != nil {
 		t.Fatal(err)
 	}
 	if val != 4 {
 		t.Errorf("expected increment to be %d; got %d", 4, val)
 	}
 	// Decrement same key by -1.
-	if val, err = increment(engine, Key("a"), -1, 0); err != nil {
+	if val, err = increment(engine, Key("a"), -1, hlc.HLTimestamp{}); err != nil {
 		t.Fatal(err)
 	}
 	if val != 3 {
 		t.Errorf("expected increment to be %d; got %d", 3, val)
 	}
 	// Increment same key by max int64 value to cause overflow; should return error.
-	if val, err = increment(engine, Key("a"), math.MaxInt64, 0); err == nil {
+	if val, err = increment(engine, Key("a"), math.MaxInt64, hlc.HLTimestamp{}); err == nil {
 		t.Error("expected an overflow error")
 	}
-	if val, err = increment(engine, Key("a"), 0, 0); err != nil {
+	if val, err = increment(engine, Key("a"), 0, hlc.HLTimestamp{}); err != nil {
 		t.Fatal(err)
 	}
 	if val != 3 {
@@ -26,6 +26,23 @@ func MakeKey(prefix, suffix Key) Key {
 	return Key(bytes.Join([][]byte{prefix, suffix}, []byte{}))
 }
 
+// RangeMetaKey returns the range addressing key at which the
+// RangeDescriptor of the range ending at key is stored. Addressing is
+// two-level: the descriptors of ranges containing user keys are stored
+// at meta2 keys, which are in turn addressed by meta1 keys. The
+// descriptors of ranges ending in the meta1 keyspace aren't stored;
+// all meta1 keys reside in the first range, which is located via
+// gossip. For these keys, and for KeyMin, KeyMin is returned.
+func RangeMetaKey(key Key) Key {
+	if len(key) == 0 || bytes.HasPrefix(key, KeyMeta1Prefix) || bytes.Compare(key, KeyMeta1Prefix) < 0 {
+		return KeyMin
+	}
+	if bytes.HasPrefix(key, KeyMeta2Prefix) {
+		return MakeKey(KeyMeta1Prefix, key[len(KeyMeta2Prefix):])
+	}
+	return MakeKey(KeyMeta2Prefix, key)
+}
+
 // Constants for system-reserved keys in the KV map.
 var (
 	// KeyMin is a minimum key value which sorts before all other keys.
@@ -54,7 +71,48 @@ var (
 	KeyMeta2Prefix = MakeKey(KeyMetaPrefix, Key("2"))
 	// KeyNodeIDGenerator contains a sequence generator for node IDs.
 	KeyNodeIDGenerator = Key("\x00node-id-generator")
+	// KeyRangeIDGenerator contains a sequence generator for range IDs.
+	KeyRangeIDGenerator = Key("\x00range-id-generator")
 	// KeyStoreIDGeneratorPrefix specifies key prefixes for sequence
 	// generators, one per node, for store IDs.
 	KeyStoreIDGeneratorPrefix = Key("\x00store-id-generator-")
 )
+
+// Constants for range-local keys. Like store-reserved keys, these are
+// prefixed with three null characters so they precede all global
+// keys and are not addressable via the global key-value store. Unlike
+// store-reserved keys, data at these keys belongs to a range and is
+// replicated along with it.
+var (
+	// keyLocalTransactionPrefix is the prefix for transaction records.
+	// The suffix is the encoded transaction anchor key followed by the
+	// transaction ID. See txnKey().
+	keyLocalTransactionPrefix = Key("\x00\x00\x00txn-")
+	// keyLocalRangeStatsPrefix is the prefix for a range's MVCC
+	// statistics. The suffix is the hexadecimal-formatted range ID.
+	// See rangeStatsKey().
+	keyLocalRangeStatsPrefix = Key("\x00\x00\x00stats-")
+	// keyLocalResponseCachePrefix is the prefix for a range's response
+	// cache entries. The suffix is the hexadecimal-formatted range ID
+	// followed by the encoded client command ID. See
+	// responseCacheKey().
+	keyLocalResponseCachePrefix = Key("\x00\x00\x00respcache-")
+	// keyLocalAbortCachePrefix is the prefix for a range's abort cache
+	// entries. The suffix is the hexadecimal-formatted range ID
+	// followed by the transaction ID. See abortCacheKey().
+	keyLocalAbortCachePrefix = Key("\x00\x00\x00abortcache-")
+	// keyLocalRangeLeaderLeasePrefix is the prefix for a range's
+	// leader lease. The suffix is the hexadecimal-formatted range ID.
+	// See rangeLeaderLeaseKey().
+	keyLocalRangeLeaderLeasePrefix = Key("\x00\x00\x00lease-")
+	// keyLocalRangeClosedTimestampPrefix is the prefix for a range's
+	// closed timestamp. The suffix is the hexadecimal-formatted range
+	// ID. See rangeClosedTimestampKey().
+	keyLocalRangeClosedTimestampPrefix = Key("\x00\x00\x00closedts-")
+	// keyLocalRaftPrefix is the prefix for a range's raft state: its
+	// hard state, log entries, last log index and applied index. The
+	// suffix is the encoded hexadecimal-formatted range ID, so that
+	// all raft state of a range is contiguous, followed by the kind of
+	// state. See raftKeyPrefix().
+	keyLocalRaftPrefix = Key("\x00\x00\x00raft-")
+)
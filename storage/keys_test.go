@@ -0,0 +1,41 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRangeMetaKey(t *testing.T) {
+	testCases := []struct {
+		key, expKey Key
+	}{
+		{KeyMin, KeyMin},
+		{Key("\x00\x00\x00local"), KeyMin},
+		{MakeKey(KeyMeta1Prefix, Key("foo")), KeyMin},
+		{KeyMeta2Prefix, KeyMeta1Prefix},
+		{MakeKey(KeyMeta2Prefix, Key("foo")), MakeKey(KeyMeta1Prefix, Key("foo"))},
+		{MakeKey(KeyMeta2Prefix, KeyMax), MakeKey(KeyMeta1Prefix, KeyMax)},
+		{Key("foo"), MakeKey(KeyMeta2Prefix, Key("foo"))},
+		{KeyMax, MakeKey(KeyMeta2Prefix, KeyMax)},
+	}
+	for i, test := range testCases {
+		if metaKey := RangeMetaKey(test.key); !bytes.Equal(metaKey, test.expKey) {
+			t.Errorf("%d: expected range meta key for %q to be %q; got %q", i, test.key, test.expKey, metaKey)
+		}
+	}
+}
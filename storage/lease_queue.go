@@ -0,0 +1,81 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import "time"
+
+// A leaseQueue is a range queue which moves leader leases to the
+// replicas preferred by the zone config covering the range (see
+// ZoneConfig.LeasePreferences). For each range whose lease is held by
+// the store's replica, if the replica doesn't satisfy the most
+// preferred attributes satisfied by any of the range's live replicas,
+// the lease is transferred to a replica which does.
+type leaseQueue struct{}
+
+func (leaseQueue) name() string     { return "lease" }
+func (leaseQueue) beginScan() error { return nil }
+
+// process transfers the range's lease to its preferred replica if
+// it's held by this store's replica and that isn't preferred.
+func (leaseQueue) process(rng *Range) error {
+	zone := rng.zoneConfig()
+	if zone == nil || len(zone.LeasePreferences) == 0 || !rng.HasLeaderLease(rng.clock.Now()) {
+		return nil
+	}
+	local, ok := rng.localReplica()
+	if !ok {
+		return nil
+	}
+	var live []Replica
+	for _, replica := range rng.getMeta().Replicas.Replicas {
+		if l, ok := gossipedLiveness(rng.gossip, replica.NodeID); ok && l.Status(time.Now()) != NodeLive {
+			continue
+		}
+		live = append(live, replica)
+	}
+	target := preferredLeaseHolder(zone.LeasePreferences, live, local)
+	if target == nil || sameReplica(*target, local) {
+		return nil
+	}
+	rng.logger().Infof("transferring leader lease to preferred replica on store %d:%d", target.NodeID, target.StoreID)
+	return rng.TransferLeaderLease(*target)
+}
+
+// preferredLeaseHolder returns the replica which should hold the
+// leader lease according to preferences: of the replicas satisfying
+// the first preference any replica satisfies, current if it's one of
+// them, or otherwise the first. Returns nil if no replica satisfies
+// any preference.
+func preferredLeaseHolder(preferences []Attributes, replicas []Replica, current Replica) *Replica {
+	for _, preference := range preferences {
+		var preferred *Replica
+		for i := range replicas {
+			if !preference.IsSubset(replicas[i].Attrs) {
+				continue
+			}
+			if sameReplica(replicas[i], current) {
+				return &replicas[i]
+			}
+			if preferred == nil {
+				preferred = &replicas[i]
+			}
+		}
+		if preferred != nil {
+			return preferred
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import "testing"
+
+// TestPreferredLeaseHolder verifies the lease is preferred on replicas
+// satisfying the earliest satisfiable preference, staying put if the
+// current holder already satisfies it.
+func TestPreferredLeaseHolder(t *testing.T) {
+	east := Replica{NodeID: 1, StoreID: 1, Attrs: Attributes([]string{"us-east", "ssd"})}
+	east2 := Replica{NodeID: 2, StoreID: 2, Attrs: Attributes([]string{"us-east", "hdd"})}
+	west := Replica{NodeID: 3, StoreID: 3, Attrs: Attributes([]string{"us-west", "ssd"})}
+	replicas := []Replica{west, east, east2}
+	preferEast := []Attributes{Attributes([]string{"us-east"})}
+
+	testCases := []struct {
+		preferences []Attributes
+		replicas    []Replica
+		current     Replica
+		expected    *Replica
+	}{
+		// Lease held by a non-matching replica moves to the first match.
+		{preferEast, replicas, west, &east},
+		// Lease held by a matching replica stays put.
+		{preferEast, replicas, east2, &east2},
+		// Earlier preferences win over later ones.
+		{[]Attributes{Attributes([]string{"us-east", "hdd"}), Attributes([]string{"ssd"})}, replicas, east, &east2},
+		// Unsatisfiable preferences fall through to later ones.
+		{[]Attributes{Attributes([]string{"eu"}), Attributes([]string{"us-west"})}, replicas, east, &west},
+		// No replica satisfies any preference.
+		{[]Attributes{Attributes([]string{"eu"})}, replicas, east, nil},
+		// Matching replicas which aren't live are excluded by the caller.
+		{preferEast, []Replica{west}, west, nil},
+	}
+	for i, c := range testCases {
+		target := preferredLeaseHolder(c.preferences, c.replicas, c.current)
+		if c.expected == nil {
+			if target != nil {
+				t.Errorf("%d: expected no preferred lease holder; got %+v", i, *target)
+			}
+			continue
+		}
+		if target == nil || !sameReplica(*target, *c.expected) {
+			t.Errorf("%d: expected preferred lease holder %+v; got %+v", i, *c.expected, target)
+		}
+	}
+}
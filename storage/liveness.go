@@ -0,0 +1,173 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+const (
+	// NodeLivenessExpiration is the duration for which a liveness
+	// heartbeat keeps a node live. Nodes heartbeat several times per
+	// expiration.
+	NodeLivenessExpiration = 10 * time.Second
+	// NodeDeadTimeout is the duration after its liveness record
+	// expires that a node is considered dead and its replicas are
+	// replaced.
+	NodeDeadTimeout = 5 * time.Minute
+)
+
+// A NodeLiveness is a node's liveness record, gossiped by the node
+// with each heartbeat (see gossip.KeyNodeLivenessPrefix). The node is
+// live until Expiration. A decommissioning node's replicas are
+// replaced by replicas on other nodes and no new replicas are
+// allocated to its stores.
+type NodeLiveness struct {
+	NodeID          int32
+	Expiration      time.Time
+	Decommissioning bool
+}
+
+// Less compares two NodeLiveness records by expiration.
+func (l NodeLiveness) Less(b util.Ordered) bool {
+	return l.Expiration.Before(b.(NodeLiveness).Expiration)
+}
+
+// Status returns the status at time now of the node whose liveness
+// record this is.
+func (l NodeLiveness) Status(now time.Time) NodeStatus {
+	if now.Before(l.Expiration) {
+		return NodeLive
+	} else if now.Sub(l.Expiration) > NodeDeadTimeout {
+		return NodeDead
+	}
+	return NodeSuspect
+}
+
+// NodeStatus is the liveness status of a node.
+type NodeStatus int
+
+const (
+	// NodeLive nodes have heartbeated within the liveness expiration.
+	NodeLive NodeStatus = iota
+	// NodeSuspect nodes have missed heartbeats but aren't yet dead.
+	NodeSuspect
+	// NodeDead nodes haven't heartbeated for longer than
+	// NodeDeadTimeout.
+	NodeDead
+)
+
+// String implements the fmt.Stringer interface.
+func (s NodeStatus) String() string {
+	switch s {
+	case NodeLive:
+		return "live"
+	case NodeSuspect:
+		return "suspect"
+	case NodeDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// gossipedLiveness returns the liveness record of the node from
+// gossip and true, or false if no record has been gossiped or the
+// gossiped record has expired from the gossip network.
+func gossipedLiveness(g *gossip.Gossip, nodeID int32) (NodeLiveness, bool) {
+	if g == nil {
+		return NodeLiveness{}, false
+	}
+	info, err := g.GetInfo(gossip.MakeNodeLivenessKey(nodeID))
+	if err != nil {
+		return NodeLiveness{}, false
+	}
+	l, ok := info.(NodeLiveness)
+	return l, ok
+}
+
+// GossipedLiveness returns the liveness records of all nodes
+// currently gossiped.
+func GossipedLiveness(g *gossip.Gossip) ([]NodeLiveness, error) {
+	if g == nil {
+		return nil, util.Errorf("no gossip network to find liveness records")
+	}
+	infos, err := g.GetGroupInfos(gossip.KeyNodeLivenessPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var records []NodeLiveness
+	for _, info := range infos {
+		if l, ok := info.(NodeLiveness); ok {
+			records = append(records, l)
+		}
+	}
+	return records, nil
+}
+
+// A livenessMonitor determines the status of nodes from their
+// gossiped liveness records. A node whose record isn't gossiped,
+// because the node hasn't yet been heard from or because its record
+// expired from the gossip network, is suspect until NodeDeadTimeout
+// after the latest expiration seen by the monitor, or after the
+// monitor started if no record was ever seen.
+type livenessMonitor struct {
+	gossip      *gossip.Gossip
+	now         func() time.Time
+	started     time.Time
+	mu          sync.Mutex          // Protects expirations
+	expirations map[int32]time.Time // Latest expiration seen by node ID
+}
+
+// newLivenessMonitor returns a liveness monitor for nodes gossiped on
+// the gossip network.
+func newLivenessMonitor(g *gossip.Gossip) *livenessMonitor {
+	return &livenessMonitor{
+		gossip:      g,
+		now:         time.Now,
+		started:     time.Now(),
+		expirations: map[int32]time.Time{},
+	}
+}
+
+// decommissioning returns true if the node's gossiped liveness record
+// marks it as decommissioning.
+func (lm *livenessMonitor) decommissioning(nodeID int32) bool {
+	l, ok := gossipedLiveness(lm.gossip, nodeID)
+	return ok && l.Decommissioning
+}
+
+// status returns the current status of the node.
+func (lm *livenessMonitor) status(nodeID int32) NodeStatus {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	expiration, ok := lm.expirations[nodeID]
+	if l, gossiped := gossipedLiveness(lm.gossip, nodeID); gossiped && (!ok || expiration.Before(l.Expiration)) {
+		expiration, ok = l.Expiration, true
+		lm.expirations[nodeID] = expiration
+	}
+	now := lm.now()
+	if !ok {
+		if now.Sub(lm.started) > NodeDeadTimeout {
+			return NodeDead
+		}
+		return NodeSuspect
+	}
+	return NodeLiveness{NodeID: nodeID, Expiration: expiration}.Status(now)
+}
@@ -0,0 +1,78 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+)
+
+func TestNodeLivenessStatus(t *testing.T) {
+	now := time.Now()
+	testCases := []struct {
+		expiration time.Time
+		status     NodeStatus
+	}{
+		{now.Add(time.Second), NodeLive},
+		{now, NodeSuspect},
+		{now.Add(-NodeDeadTimeout), NodeSuspect},
+		{now.Add(-NodeDeadTimeout - time.Second), NodeDead},
+	}
+	for i, test := range testCases {
+		if status := (NodeLiveness{NodeID: 1, Expiration: test.expiration}).Status(now); status != test.status {
+			t.Errorf("%d: expected status %s; got %s", i, test.status, status)
+		}
+	}
+}
+
+// TestLivenessMonitor verifies that the monitor tracks nodes through
+// the live, suspect and dead states, remembering the latest
+// expiration of records which are no longer gossiped.
+func TestLivenessMonitor(t *testing.T) {
+	now := time.Now()
+	lm := newLivenessMonitor(gossip.New())
+	lm.started = now
+	lm.now = func() time.Time { return now }
+
+	// A node which hasn't been heard from is suspect until the dead
+	// node timeout after the monitor started.
+	if status := lm.status(1); status != NodeSuspect {
+		t.Errorf("expected unknown node to be suspect; got %s", status)
+	}
+	gossipLiveness(lm.gossip, now.Add(NodeLivenessExpiration), t, 1)
+	if status := lm.status(1); status != NodeLive {
+		t.Errorf("expected heartbeating node to be live; got %s", status)
+	}
+	if records, err := GossipedLiveness(lm.gossip); err != nil || len(records) != 1 || records[0].NodeID != 1 {
+		t.Errorf("expected gossiped record for node 1; got %+v, %v", records, err)
+	}
+
+	// Forget the gossiped record; the monitor remembers its expiration.
+	lm.gossip = gossip.New()
+	now = now.Add(2 * NodeLivenessExpiration)
+	if status := lm.status(1); status != NodeSuspect {
+		t.Errorf("expected node with expired liveness to be suspect; got %s", status)
+	}
+	now = now.Add(NodeDeadTimeout)
+	if status := lm.status(1); status != NodeDead {
+		t.Errorf("expected node to be dead after timeout; got %s", status)
+	}
+	if status := lm.status(2); status != NodeDead {
+		t.Errorf("expected never-seen node to be dead after timeout; got %s", status)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// loadSplitWindow is the interval over which a range's request
+	// load is measured to decide whether and where to split it.
+	loadSplitWindow = 10 * time.Second
+	// loadSplitSamples is the number of request keys sampled in each
+	// window as candidate split keys.
+	loadSplitSamples = 20
+)
+
+// A loadSample is a candidate split key, sampled from the keys of
+// requests to the range. left and right count the requests since the
+// key was sampled which would fall to either side of a split at key.
+type loadSample struct {
+	key         Key
+	left, right int64
+}
+
+// A loadSplitter measures the request load on a range and selects a
+// split key which divides the load evenly between the two sides.
+// Candidate keys are drawn from the requested keys by reservoir
+// sampling, so that each request in a window is equally likely to be
+// sampled. At the end of each window, the candidate with the most
+// even division of the requests counted since it was sampled is
+// chosen. Load on a single key, or on sequentially increasing keys,
+// yields no split key: no split would divide it.
+type loadSplitter struct {
+	sync.Mutex
+	start   time.Time    // Start of the current window
+	count   int64        // Requests in the current window
+	samples []loadSample // Candidate split keys
+	rand    *rand.Rand
+}
+
+// newLoadSplitter returns a load splitter whose first window begins
+// at now.
+func newLoadSplitter(now time.Time) *loadSplitter {
+	return &loadSplitter{
+		start: now,
+		rand:  rand.New(rand.NewSource(now.UnixNano())),
+	}
+}
+
+// record counts a request to key at time now.
+func (ls *loadSplitter) record(key Key, now time.Time) {
+	ls.Lock()
+	defer ls.Unlock()
+	ls.count++
+	if len(ls.samples) < loadSplitSamples {
+		ls.samples = append(ls.samples, loadSample{key: key})
+	} else if i := ls.rand.Int63n(ls.count); i < loadSplitSamples {
+		ls.samples[i] = loadSample{key: key}
+	}
+	for i := range ls.samples {
+		if bytes.Compare(key, ls.samples[i].key) < 0 {
+			ls.samples[i].left++
+		} else {
+			ls.samples[i].right++
+		}
+	}
+}
+
+// splitKey returns the key at which to split the range to divide its
+// load, or nil if the range shouldn't be split. Once the current
+// window has elapsed at time now, a key is returned if the request
+// rate over the window exceeded maxQPS and some candidate divides the
+// requests between both sides; a new window is begun regardless. A
+// maxQPS of zero disables load-based splits.
+func (ls *loadSplitter) splitKey(now time.Time, maxQPS float64) Key {
+	ls.Lock()
+	defer ls.Unlock()
+	elapsed := now.Sub(ls.start)
+	if elapsed < loadSplitWindow {
+		return nil
+	}
+	qps := float64(ls.count) / elapsed.Seconds()
+	var best *loadSample
+	for i := range ls.samples {
+		s := &ls.samples[i]
+		if s.left == 0 || s.right == 0 {
+			continue
+		}
+		if best == nil || imbalance(s) < imbalance(best) {
+			best = s
+		}
+	}
+	var splitKey Key
+	if maxQPS > 0 && qps > maxQPS && best != nil {
+		splitKey = best.key
+	}
+	ls.start, ls.count, ls.samples = now, 0, nil
+	return splitKey
+}
+
+// imbalance returns the fraction of the sample's requests by which
+// the two sides of a split at its key differ.
+func imbalance(s *loadSample) float64 {
+	diff := s.left - s.right
+	if diff < 0 {
+		diff = -diff
+	}
+	return float64(diff) / float64(s.left+s.right)
+}
@@ -0,0 +1,69 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestLoadSplitterSplitKey verifies that the load splitter selects a
+// key which divides the requests of a window evenly, and only if the
+// request rate over the window exceeds the maximum.
+func TestLoadSplitterSplitKey(t *testing.T) {
+	start := time.Unix(0, 0)
+	ls := newLoadSplitter(start)
+	for i := 0; i < 1000; i++ {
+		ls.record(Key(fmt.Sprintf("key%02d", i%100)), start)
+	}
+	if key := ls.splitKey(start.Add(loadSplitWindow/2), 1); key != nil {
+		t.Errorf("expected no split key before the window elapsed; got %q", key)
+	}
+	// 1000 requests over the window is 100 QPS.
+	key := ls.splitKey(start.Add(loadSplitWindow), 50)
+	if bytes.Compare(key, Key("key30")) < 0 || bytes.Compare(key, Key("key70")) > 0 {
+		t.Errorf("expected split key near the middle of the requested keys; got %q", key)
+	}
+
+	// The next window begins empty.
+	for i := 0; i < 1000; i++ {
+		ls.record(Key(fmt.Sprintf("key%02d", i%100)), start)
+	}
+	if key := ls.splitKey(start.Add(2*loadSplitWindow), 200); key != nil {
+		t.Errorf("expected no split key below the maximum QPS; got %q", key)
+	}
+	for i := 0; i < 1000; i++ {
+		ls.record(Key(fmt.Sprintf("key%02d", i%100)), start)
+	}
+	if key := ls.splitKey(start.Add(3*loadSplitWindow), 0); key != nil {
+		t.Errorf("expected no split key with load-based splits disabled; got %q", key)
+	}
+}
+
+// TestLoadSplitterSingleKey verifies that load on a single key, which
+// no split can divide, doesn't produce a split key.
+func TestLoadSplitterSingleKey(t *testing.T) {
+	start := time.Unix(0, 0)
+	ls := newLoadSplitter(start)
+	for i := 0; i < 1000; i++ {
+		ls.record(Key("hot"), start)
+	}
+	if key := ls.splitKey(start.Add(loadSplitWindow), 1); key != nil {
+		t.Errorf("expected no split key for a single hot key; got %q", key)
+	}
+}
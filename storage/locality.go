@@ -0,0 +1,73 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import "strings"
+
+// localityTiers are the tiers of the locality hierarchy, from the
+// broadest to the narrowest. A node's locality is specified by node
+// attributes of the form "<tier>=<value>", e.g. "region=us-east",
+// "zone=us-east-1a" and "rack=12".
+var localityTiers = []string{"region", "zone", "rack"}
+
+// A locality holds the value of each of the localityTiers, in order.
+// The values of tiers which aren't specified are empty.
+type locality []string
+
+// parseLocality returns the locality specified by the attributes.
+func parseLocality(attrs Attributes) locality {
+	l := make(locality, len(localityTiers))
+	for _, attr := range attrs {
+		i := strings.Index(attr, "=")
+		if i < 0 {
+			continue
+		}
+		for j, tier := range localityTiers {
+			if attr[:i] == tier {
+				l[j] = attr[i+1:]
+			}
+		}
+	}
+	return l
+}
+
+// diversity returns a score between 0 and 1 of how far apart the two
+// localities are: 1 if they differ in the broadest tier, decreasing
+// with each narrower tier, and 0 if they don't differ in any tier.
+// Tiers which aren't specified by both localities are assumed equal.
+func (l locality) diversity(o locality) float64 {
+	for i := range localityTiers {
+		if l[i] != "" && o[i] != "" && l[i] != o[i] {
+			return float64(len(localityTiers)-i) / float64(len(localityTiers))
+		}
+	}
+	return 0
+}
+
+// diversityScore returns the diversity of the attributes from the
+// least diverse of the existing replicas, or 1 if there are none.
+// Placing a replica on the store with the highest score minimizes the
+// number of replicas a single rack, zone or region failure takes out.
+func diversityScore(attrs Attributes, existingReplicas []Replica) float64 {
+	l := parseLocality(attrs)
+	score := 1.0
+	for _, replica := range existingReplicas {
+		if d := l.diversity(parseLocality(replica.Attrs)); d < score {
+			score = d
+		}
+	}
+	return score
+}
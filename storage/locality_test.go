@@ -0,0 +1,68 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLocality(t *testing.T) {
+	testCases := []struct {
+		attrs    Attributes
+		expected locality
+	}{
+		{Attributes{}, locality{"", "", ""}},
+		{Attributes{"a", "ssd"}, locality{"", "", ""}},
+		{Attributes{"rack=3", "ssd", "region=us-east"}, locality{"us-east", "", "3"}},
+		{Attributes{"region=eu", "zone=eu-1", "rack=r1", "host=h"}, locality{"eu", "eu-1", "r1"}},
+	}
+	for i, c := range testCases {
+		if l := parseLocality(c.attrs); !reflect.DeepEqual(l, c.expected) {
+			t.Errorf("%d: expected %q; got %q", i, c.expected, l)
+		}
+	}
+}
+
+func TestLocalityDiversity(t *testing.T) {
+	a := locality{"east", "east-a", "1"}
+	testCases := []struct {
+		b        locality
+		expected float64
+	}{
+		{locality{"east", "east-a", "1"}, 0},
+		{locality{"east", "east-a", "2"}, 1.0 / 3},
+		{locality{"east", "east-b", "1"}, 2.0 / 3},
+		{locality{"west", "east-a", "1"}, 1},
+		{locality{"", "", "2"}, 1.0 / 3},
+		{locality{"", "", ""}, 0},
+	}
+	for i, c := range testCases {
+		if d := a.diversity(c.b); d != c.expected {
+			t.Errorf("%d: expected diversity %f; got %f", i, c.expected, d)
+		}
+		if d := c.b.diversity(a); d != c.expected {
+			t.Errorf("%d: expected symmetric diversity %f; got %f", i, c.expected, d)
+		}
+	}
+	existing := []Replica{{Attrs: Attributes{"region=east", "zone=east-a"}}, {Attrs: Attributes{"region=west"}}}
+	if score := diversityScore(Attributes{"region=east", "zone=east-b"}, existing); score != 2.0/3 {
+		t.Errorf("expected diversity score 2/3; got %f", score)
+	}
+	if score := diversityScore(Attributes{"region=east"}, nil); score != 1 {
+		t.Errorf("expected diversity score 1 without existing replicas; got %f", score)
+	}
+}
@@ -17,6 +17,37 @@
 
 package storage
 
+import (
+	"encoding/gob"
+	"time"
+
+	"github.com/cockroachdb/cockroach/hlc"
+)
+
+// init registers the request and response types which may be
+// included in batches, so they may be gob-encoded as interface
+// values.
+func init() {
+	gob.Register(&ContainsRequest{})
+	gob.Register(&ContainsResponse{})
+	gob.Register(&GetRequest{})
+	gob.Register(&GetResponse{})
+	gob.Register(&PutRequest{})
+	gob.Register(&PutResponse{})
+	gob.Register(&ConditionalPutRequest{})
+	gob.Register(&ConditionalPutResponse{})
+	gob.Register(&IncrementRequest{})
+	gob.Register(&IncrementResponse{})
+	gob.Register(&DeleteRequest{})
+	gob.Register(&DeleteResponse{})
+	gob.Register(&DeleteRangeRequest{})
+	gob.Register(&DeleteRangeResponse{})
+	gob.Register(&ScanRequest{})
+	gob.Register(&ScanResponse{})
+	gob.Register(&EndTransactionRequest{})
+	gob.Register(&EndTransactionResponse{})
+}
+
 // Key defines the key in the key-value datastore.
 type Key []byte
 
@@ -27,8 +58,8 @@ type Key []byte
 type Value struct {
 	// Bytes is the byte string value.
 	Bytes []byte
-	// Timestamp of value in nanoseconds since epoch.
-	Timestamp int64
+	// Timestamp of value.
+	Timestamp hlc.HLTimestamp
 	// Expiration in nanoseconds.
 	Expiration int64
 }
@@ -38,14 +69,77 @@ type Value struct {
 type KeyValue struct {
 	Key
 	Value
+	// Deleted is true for the rows of keys deleted since the minimum
+	// timestamp of a scan (see ScanRequest.MinTimestamp). Their values
+	// have no bytes.
+	Deleted bool
+}
+
+// Size returns the number of bytes of the pair's key and value, by
+// which scans are limited (see ScanRequest.MaxBytes).
+func (kv *KeyValue) Size() int64 {
+	return int64(len(kv.Key) + len(kv.Value.Bytes))
+}
+
+// ReadConsistencyType specifies what type of consistency is observed
+// during read operations.
+type ReadConsistencyType int
+
+const (
+	// CONSISTENT reads are served by the range's raft leader and
+	// observe all committed writes. Write intents of other
+	// transactions are resolved before being read.
+	CONSISTENT ReadConsistencyType = iota
+	// INCONSISTENT reads may be served by any replica from its local
+	// state. They don't block on write intents, which are ignored, so
+	// may return stale values. They may not be used within
+	// transactions.
+	INCONSISTENT
+)
+
+// ClientCmdID provides a unique ID for client commands. Clients which
+// provide ClientCmdID gain operation idempotence. In other words,
+// clients can submit the same command multiple times and always
+// receive the same response. This is common on retries over flaky
+// networks. However, the system imposes a limit on how long
+// idempotence is provided. Retries over an hour old are not
+// guaranteed idempotence and may be executed more than once with
+// potentially different results.
+//
+// ClientCmdID contains the client's timestamp and a client-generated
+// random number. The client Timestamp is specified in unix
+// nanoseconds and is used for some uniqueness, but also to provide a
+// rough ordering of requests, useful for data locality on the
+// server. The Random is specified for additional uniqueness.
+type ClientCmdID struct {
+	WallTime int64
+	Random   int64
+}
+
+// IsEmpty returns true if the client command ID has zero values.
+func (ccid ClientCmdID) IsEmpty() bool {
+	return ccid.WallTime == 0 && ccid.Random == 0
 }
 
 // RequestHeader is supplied with every storage node request.
 type RequestHeader struct {
 	// Timestamp specifies time at which read or writes should be
-	// performed. In nanoseconds since the epoch. Defaults to current
-	// wall time.
-	Timestamp int64
+	// performed. Defaults to the transaction timestamp if Txn is set
+	// and otherwise to the current time of the executing node's clock.
+	// Reads may specify a historical timestamp to read the values as
+	// of that time; the timestamp must be within the GC TTL of the
+	// range's zone, or a ReadTooOldError is returned.
+	Timestamp hlc.HLTimestamp
+
+	// CmdID is optionally specified for request idempotence
+	// (i.e. replay protection).
+	CmdID ClientCmdID
+
+	// User is the user on whose behalf the request is made. Access to
+	// keys is subject to the permission configs of the user. Requests
+	// made by the system itself leave User empty and aren't subject
+	// to permissions.
+	User string
 
 	// The following values are set internally and should not be set
 	// manually.
@@ -54,20 +148,64 @@ type RequestHeader struct {
 	Replica Replica
 	// MaxTimestamp is the maximum wall time seen by the client to
 	// date. This should be supplied with successive transactions for
-	// linearalizability for this client. In nanoseconds since the
-	// epoch.
-	MaxTimestamp int64
-	// TxID is set non-empty if a transaction is underway. Empty string
-	// to start a new transaction.
-	TxID string
+	// linearalizability for this client.
+	MaxTimestamp hlc.HLTimestamp
+	// Txn is non-nil if the request is part of a transaction.
+	Txn *Transaction
+	// ReadConsistency specifies the consistency for read operations.
+	// The default is CONSISTENT. This value is ignored for write
+	// operations.
+	ReadConsistency ReadConsistencyType
+	// MaxStaleness, if positive, requests a bounded-staleness read: a
+	// consistent, non-transactional read which may be served by any
+	// replica whose closed timestamp is no more than MaxStaleness
+	// old, as of that timestamp. Failing that, the read is served by
+	// the leader lease holder at the current time. Timestamp must not
+	// be set; the timestamp at which the read was served is returned
+	// in the response header.
+	MaxStaleness time.Duration
+	// Trace requests that the response header include a trace of the
+	// request's routing and execution. See Trace.
+	Trace bool
+}
+
+// Header implements the Request interface.
+func (rh *RequestHeader) Header() *RequestHeader {
+	return rh
 }
 
 // ResponseHeader is returned with every storage node response.
 type ResponseHeader struct {
 	// Error is non-nil if an error occurred.
 	Error error
-	// TxID is non-empty if a transaction is underway.
-	TxID string
+	// Txn is non-nil if the request was part of a transaction. It
+	// reflects any changes to the transaction (e.g. a pushed
+	// timestamp or status) made while executing the request.
+	Txn *Transaction
+	// Timestamp is the timestamp at which the request was executed,
+	// e.g. that chosen by the range for a request which didn't specify
+	// one, or that at which a bounded-staleness read was served (see
+	// RequestHeader.MaxStaleness).
+	Timestamp hlc.HLTimestamp
+	// Trace is set if the request asked for a trace.
+	Trace *Trace
+}
+
+// Header implements the Response interface.
+func (rh *ResponseHeader) Header() *ResponseHeader {
+	return rh
+}
+
+// A Request is implemented by all request structs via the embedded
+// RequestHeader.
+type Request interface {
+	Header() *RequestHeader
+}
+
+// A Response is implemented by all response structs via the embedded
+// ResponseHeader.
+type Response interface {
+	Header() *ResponseHeader
 }
 
 // A ContainsRequest is arguments to the Contains() method.
@@ -96,21 +234,34 @@ type GetResponse struct {
 }
 
 // A PutRequest is arguments to the Put() method.
-// Conditional puts are supported if ExpValue is set.
-// - Returns true and sets value if ExpValue equals existing value.
-// - If key doesn't exist and ExpValue is empty, sets value.
-// - Otherwise, returns error.
 type PutRequest struct {
+	RequestHeader
+	Key   Key   // must be non-empty
+	Value Value // The value to put
+}
+
+// A PutResponse is the return value from the Put() method.
+type PutResponse struct {
+	ResponseHeader
+}
+
+// A ConditionalPutRequest is arguments to the ConditionalPut()
+// method. The value is set if ExpValue equals the existing value or
+// if ExpValue is nil and the key doesn't exist. Otherwise, a
+// ConditionFailedError is returned and the response's ActualValue is
+// set to the existing value.
+type ConditionalPutRequest struct {
 	RequestHeader
 	Key      Key    // must be non-empty
 	Value    Value  // The value to put
-	ExpValue *Value // ExpValue.Bytes empty to test for non-existence
+	ExpValue *Value // ExpValue nil to test for non-existence
 }
 
-// A PutResponse is the return value form the Put() method.
-type PutResponse struct {
+// A ConditionalPutResponse is the return value from the
+// ConditionalPut() method.
+type ConditionalPutResponse struct {
 	ResponseHeader
-	ActualValue *Value // ActualValue.Bytes set if conditional put failed
+	ActualValue *Value // ActualValue set if condition failed; nil if key doesn't exist
 }
 
 // An IncrementRequest is arguments to the Increment() method. It
@@ -147,13 +298,21 @@ type DeleteRangeRequest struct {
 	RequestHeader
 	StartKey Key // Empty to start at first key
 	EndKey   Key // Non-inclusive; if empty, deletes all
+	// If 0, *all* entries between StartKey (inclusive) and EndKey
+	// (exclusive) are deleted. Must be >= 0.
+	MaxEntriesToDelete int64
 }
 
 // A DeleteRangeResponse is the return value from the DeleteRange()
 // method.
 type DeleteRangeResponse struct {
 	ResponseHeader
-	NumDeleted uint64
+	NumDeleted int64
+	// ResumeKey is set if MaxEntriesToDelete or the end of the range
+	// executing the request was reached before all keys in the span
+	// were deleted. The request may be reissued with ResumeKey as
+	// StartKey to continue.
+	ResumeKey Key
 }
 
 // A ScanRequest is arguments to the Scan() method. It specifies the
@@ -163,12 +322,60 @@ type ScanRequest struct {
 	StartKey   Key   // Empty to start at first key
 	EndKey     Key   // Optional max key; empty to ignore
 	MaxResults int64 // Must be > 0
+	// MaxBytes, if > 0, limits the total size of the rows returned
+	// (see KeyValue.Size). The scan stops once the rows returned reach
+	// MaxBytes, so the last row may exceed the limit.
+	MaxBytes int64
+	// KeysOnly, if true, returns the rows without their values' bytes,
+	// for scans which only check the existence of keys, count them or
+	// find those to delete. The rows' sizes, and so MaxBytes, count
+	// their keys alone.
+	KeysOnly bool
+	// MinTimestamp, if not zero, restricts the rows returned to keys
+	// whose most recent version as of Timestamp was written after
+	// MinTimestamp, for incremental reads of the changes to a span.
+	// Keys deleted since MinTimestamp are returned as rows marked
+	// Deleted, with the timestamp of the deletion. Deletions are
+	// garbage collected along with the keys' other versions, so
+	// MinTimestamp should be within the GC TTL of the span's zones.
+	MinTimestamp hlc.HLTimestamp
 }
 
 // A ScanResponse is the return value from the Scan() method.
 type ScanResponse struct {
 	ResponseHeader
 	Rows []KeyValue // Empty if no rows were scanned
+	// ResumeKey is set if MaxResults, MaxBytes or the end of the range
+	// executing the scan was reached before EndKey. The scan may be
+	// reissued with ResumeKey as StartKey to continue.
+	ResumeKey Key
+}
+
+// A ReverseScanRequest is arguments to the ReverseScan() method. It
+// specifies a span to scan in descending key order, for example to
+// read the latest entries before a key, and the limits of the scan
+// as for ScanRequest. Since the scan starts at the last key before
+// EndKey, the request is addressed to the range containing that key:
+// the range whose start key precedes EndKey and whose end key follows
+// or equals it.
+type ReverseScanRequest struct {
+	RequestHeader
+	StartKey   Key   // Empty to scan back to the first key
+	EndKey     Key   // Exclusive; empty to scan from the last key
+	MaxResults int64 // Must be > 0
+	MaxBytes   int64 // See ScanRequest.MaxBytes
+	KeysOnly   bool  // See ScanRequest.KeysOnly
+}
+
+// A ReverseScanResponse is the return value from the ReverseScan()
+// method.
+type ReverseScanResponse struct {
+	ResponseHeader
+	Rows []KeyValue // In descending key order; empty if no rows were scanned
+	// ResumeKey is set if MaxResults, MaxBytes or the start of the
+	// range executing the scan was reached before StartKey. The scan
+	// may be reissued with ResumeKey as EndKey to continue.
+	ResumeKey Key
 }
 
 // An EndTransactionRequest is arguments to the EndTransaction() method.
@@ -179,6 +386,46 @@ type EndTransactionRequest struct {
 	RequestHeader
 	Commit bool  // False to abort and rollback
 	Keys   []Key // Write-intent keys to commit or abort
+	// InternalCommitTrigger is an optional trigger whose side effects
+	// are applied atomically with the commit of the transaction. It's
+	// ignored if the transaction aborts.
+	InternalCommitTrigger *InternalCommitTrigger
+}
+
+// A SplitTrigger is run on commit of a transaction which splits a
+// range in two. UpdatedMeta is the metadata of the original range,
+// whose end key becomes the split key. NewMeta is the metadata of the
+// range created to hold the keys from the split key to the original
+// end key.
+type SplitTrigger struct {
+	UpdatedMeta RangeMetadata
+	NewMeta     RangeMetadata
+}
+
+// A MergeTrigger is run on commit of a transaction which merges two
+// adjacent ranges. UpdatedMeta is the metadata of the subsuming range,
+// whose end key is extended to the end key of the subsumed range.
+type MergeTrigger struct {
+	UpdatedMeta     RangeMetadata
+	SubsumedRangeID int64
+}
+
+// A ChangeReplicasTrigger is run on commit of a transaction which
+// changes the replica membership of a range. UpdatedReplicas is the
+// complete replica set of the range after the change.
+type ChangeReplicasTrigger struct {
+	UpdatedReplicas []Replica
+}
+
+// An InternalCommitTrigger encapsulates the side effects of
+// transactions which modify the range structure of the keyspace or a
+// range's replicas. At most one trigger may be set. The trigger must
+// be carried by the EndTransaction request executed by the range whose
+// structure is modified.
+type InternalCommitTrigger struct {
+	SplitTrigger          *SplitTrigger
+	MergeTrigger          *MergeTrigger
+	ChangeReplicasTrigger *ChangeReplicasTrigger
 }
 
 // An EndTransactionResponse is the return value from the
@@ -189,10 +436,111 @@ type EndTransactionRequest struct {
 // distributed node to maintain consistency.
 type EndTransactionResponse struct {
 	ResponseHeader
-	CommitTimestamp int64 // Unix nanos (us)
+	CommitTimestamp hlc.HLTimestamp
 	CommitWait      int64 // Remaining with (us)
 }
 
+// An AdminSplitRequest is arguments to the AdminSplit() method. The
+// range containing Key is split at SplitKey. If SplitKey is empty, a
+// key near the midpoint of the range's data is chosen.
+type AdminSplitRequest struct {
+	RequestHeader
+	Key      Key
+	SplitKey Key
+}
+
+// An AdminSplitResponse is the return value from the AdminSplit()
+// method. NewRangeID is the ID of the range created by the split,
+// which holds the keys from SplitKey to the original range's end key.
+type AdminSplitResponse struct {
+	ResponseHeader
+	SplitKey   Key
+	NewRangeID int64
+}
+
+// An AdminMergeRequest is arguments to the AdminMerge() method. The
+// range containing Key is merged with the subsequent range.
+type AdminMergeRequest struct {
+	RequestHeader
+	Key Key
+}
+
+// An AdminMergeResponse is the return value from the AdminMerge()
+// method.
+type AdminMergeResponse struct {
+	ResponseHeader
+}
+
+// A BatchRequest is arguments to the Batch() method. It contains an
+// ordered list of requests, which must all address keys within the
+// same range, to be executed together as a single command. Requests
+// which don't specify a timestamp or transaction inherit those of the
+// batch. Only Contains, Get, Put, ConditionalPut, Increment, Delete,
+// DeleteRange, Scan and EndTransaction requests may be batched.
+type BatchRequest struct {
+	RequestHeader
+	Requests []Request
+}
+
+// Key returns the key addressed by the first request in the batch.
+// This key determines the range to which the batch is sent. Returns
+// nil for an empty batch or if the first request may not be batched.
+func (br *BatchRequest) Key() Key {
+	if len(br.Requests) == 0 {
+		return nil
+	}
+	return BatchKey(br.Requests[0])
+}
+
+// BatchKey returns the key addressed by a request which may be
+// batched, which determines the range to which it's sent. Returns nil
+// if the request may not be batched.
+func BatchKey(args Request) Key {
+	_, key, _, _ := batchEntry(args)
+	return key
+}
+
+// A BatchResponse is the return value from the Batch() method. It
+// contains a response for each request executed, in order. If a
+// request fails, execution of the batch stops and the batch error is
+// set to the failed request's error; the failed request's response
+// is the last in Responses.
+type BatchResponse struct {
+	ResponseHeader
+	Responses []Response
+}
+
+// batchEntry returns the method name, addressed key and an empty
+// response for a request which may be included in a batch. ok is
+// false if the request may not be batched.
+func batchEntry(args Request) (method string, key Key, reply Response, ok bool) {
+	switch t := args.(type) {
+	case *ContainsRequest:
+		return "Contains", t.Key, &ContainsResponse{}, true
+	case *GetRequest:
+		return "Get", t.Key, &GetResponse{}, true
+	case *PutRequest:
+		return "Put", t.Key, &PutResponse{}, true
+	case *ConditionalPutRequest:
+		return "ConditionalPut", t.Key, &ConditionalPutResponse{}, true
+	case *IncrementRequest:
+		return "Increment", t.Key, &IncrementResponse{}, true
+	case *DeleteRequest:
+		return "Delete", t.Key, &DeleteResponse{}, true
+	case *DeleteRangeRequest:
+		return "DeleteRange", t.StartKey, &DeleteRangeResponse{}, true
+	case *ScanRequest:
+		return "Scan", t.StartKey, &ScanResponse{}, true
+	case *EndTransactionRequest:
+		var key Key
+		if t.Txn != nil {
+			key = t.Txn.Key
+		}
+		return "EndTransaction", key, &EndTransactionResponse{}, true
+	}
+	return "", nil, nil, false
+}
+
 // An AccumulateTSRequest is arguments to the AccumulateTS() method.
 // It specifies the key at which to accumulate TS values, and the
 // time series counts for this discrete time interval.
@@ -260,6 +608,10 @@ type EnqueueMessageResponse struct {
 type InternalRangeLookupRequest struct {
 	RequestHeader
 	Key Key
+	// Reverse, if true, looks up the range containing the keys just
+	// before the user key, rather than the key itself; that is, the
+	// range the user key ends, as addressed by reverse scans.
+	Reverse bool
 }
 
 // An InternalRangeLookupResponse is the return value from the
@@ -273,3 +625,159 @@ type InternalRangeLookupResponse struct {
 	EndKey Key // The key in datastore whose value is the Range object.
 	Range  RangeDescriptor
 }
+
+// An InternalPushTxnRequest is arguments to the InternalPushTxn()
+// method. It's sent by readers or writers which encounter a write
+// intent belonging to PusheeTxn. The request is addressed to the
+// range holding the pushee's transaction record (Key is the pushee's
+// anchor key). The pusher is the transaction in the header, if any.
+type InternalPushTxnRequest struct {
+	RequestHeader
+	Key       Key
+	PusheeTxn Transaction
+	// Abort is true to abort the pushee; false to push the pushee's
+	// timestamp past the request timestamp.
+	Abort bool
+	// ExpiredOnly is true to push the pushee only if it has been
+	// abandoned by its coordinator, regardless of the pusher's
+	// priority. It's set when cleaning up old intents.
+	ExpiredOnly bool
+}
+
+// An InternalPushTxnResponse is the return value from the
+// InternalPushTxn() method. It returns the pushee's transaction as
+// updated by the push. If the pushee has a higher priority than the
+// pusher, the push fails with a TransactionPushError.
+type InternalPushTxnResponse struct {
+	ResponseHeader
+	PusheeTxn Transaction
+}
+
+// A LeaderLease grants a range replica the exclusive right to serve
+// consistent reads and to propose writes for the range between the
+// Start and Expiration timestamps.
+type LeaderLease struct {
+	Start      hlc.HLTimestamp
+	Expiration hlc.HLTimestamp
+	Replica    Replica
+}
+
+// Covers returns true if the lease is in effect at timestamp.
+func (l *LeaderLease) Covers(timestamp hlc.HLTimestamp) bool {
+	return !timestamp.Less(l.Start) && timestamp.Less(l.Expiration)
+}
+
+// An InternalLeaderLeaseRequest is arguments to the
+// InternalLeaderLease() method. It's proposed by a range replica to
+// acquire, extend, shorten or transfer the range's leader lease. Key
+// is the start key of the range.
+type InternalLeaderLeaseRequest struct {
+	RequestHeader
+	Key   Key
+	Lease LeaderLease
+}
+
+// An InternalLeaderLeaseResponse is the return value from the
+// InternalLeaderLease() method.
+type InternalLeaderLeaseResponse struct {
+	ResponseHeader
+}
+
+// An InternalCloseTimestampRequest is arguments to the
+// InternalCloseTimestamp() method. It's proposed by the holder of the
+// range's leader lease to close ClosedTimestamp: no writes at or below
+// it are accepted thereafter, so replicas which have applied it may
+// serve reads at or below it. Key is the start key of the range.
+type InternalCloseTimestampRequest struct {
+	RequestHeader
+	Key             Key
+	ClosedTimestamp hlc.HLTimestamp
+}
+
+// An InternalCloseTimestampResponse is the return value from the
+// InternalCloseTimestamp() method.
+type InternalCloseTimestampResponse struct {
+	ResponseHeader
+}
+
+// An InternalGCRequest is arguments to the InternalGC() method. It's
+// proposed by the range's leader to garbage collect versions which
+// are no longer visible to reads at or after GCThreshold. Key is the
+// start key of the range.
+type InternalGCRequest struct {
+	RequestHeader
+	Key         Key
+	GCThreshold hlc.HLTimestamp
+}
+
+// An InternalGCResponse is the return value from the InternalGC()
+// method.
+type InternalGCResponse struct {
+	ResponseHeader
+}
+
+// An InternalSnapshotRequest is arguments to the InternalSnapshot()
+// method. It's sent by a range's leader to the store of a replica
+// being added to the range, which verifies the snapshot and
+// instantiates the replica from it. The destination replica is
+// specified in the header.
+type InternalSnapshotRequest struct {
+	RequestHeader
+	Snapshot RangeSnapshot
+}
+
+// An InternalSnapshotResponse is the return value from the
+// InternalSnapshot() method.
+type InternalSnapshotResponse struct {
+	ResponseHeader
+}
+
+// An InternalChecksumRequest is arguments to the InternalChecksum()
+// method. It's proposed by the range's leader as a checkpoint in the
+// range's command sequence and sent to the other replicas, each of
+// which computes a checksum of its copy of the range's versioned
+// data. The replica is specified in the header; Key is the start key
+// of the range.
+type InternalChecksumRequest struct {
+	RequestHeader
+	Key Key
+}
+
+// An InternalChecksumResponse is the return value from the
+// InternalChecksum() method.
+type InternalChecksumResponse struct {
+	ResponseHeader
+	Checksum []byte // SHA-256 checksum of the range's versioned data
+}
+
+// An InternalHeartbeatTxnRequest is arguments to the
+// InternalHeartbeatTxn() method. It's sent periodically by the
+// coordinator of the transaction in the header to the range holding
+// its record, which is anchored at Key, so that other transactions
+// don't consider it abandoned. The request's timestamp is the time of
+// the heartbeat.
+type InternalHeartbeatTxnRequest struct {
+	RequestHeader
+	Key Key
+}
+
+// An InternalHeartbeatTxnResponse is the return value from the
+// InternalHeartbeatTxn() method. The transaction as recorded is
+// returned in the header.
+type InternalHeartbeatTxnResponse struct {
+	ResponseHeader
+}
+
+// An InternalResolveIntentRequest is arguments to the
+// InternalResolveIntent() method. It resolves the write intent at Key
+// according to the status of the transaction in the header.
+type InternalResolveIntentRequest struct {
+	RequestHeader
+	Key Key
+}
+
+// An InternalResolveIntentResponse is the return value from the
+// InternalResolveIntent() method.
+type InternalResolveIntentResponse struct {
+	ResponseHeader
+}
@@ -0,0 +1,122 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/hlc"
+)
+
+// TestBatchRequestGob verifies that batch requests and responses
+// may be gob-encoded for transmission via RPC.
+func TestBatchRequestGob(t *testing.T) {
+	args := &BatchRequest{
+		Requests: []Request{
+			&PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}},
+			&ScanRequest{StartKey: Key("a"), EndKey: Key("b"), MaxResults: 10},
+		},
+	}
+	reply := &BatchResponse{
+		Responses: []Response{&PutResponse{}, &ScanResponse{Rows: []KeyValue{{Key: Key("a")}}}},
+	}
+	for _, v := range []interface{}{args, reply} {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		decoded := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+		if err := gob.NewDecoder(&buf).Decode(decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(v, decoded) {
+			t.Errorf("expected %+v; got %+v", v, decoded)
+		}
+	}
+}
+
+// TestDecodeArbitraryMessages verifies that gob-decoding arbitrary
+// and corrupted input into request and response messages returns
+// errors rather than panicking. Such messages arrive from the network
+// and, in the case of the response cache, are persisted.
+func TestDecodeArbitraryMessages(t *testing.T) {
+	r := newFuzzRand(t)
+	ts := hlc.HLTimestamp{WallTime: r.Int63(), Logical: uint64(r.Int63())}
+	txn := &Transaction{Key: Key("a"), ID: string(randFuzzBytes(r, 20)), Timestamp: ts}
+	valid := []interface{}{
+		&BatchRequest{
+			RequestHeader: RequestHeader{Timestamp: ts, Txn: txn},
+			Requests: []Request{
+				&PutRequest{Key: Key(randFuzzBytes(r, 20)), Value: Value{Bytes: randFuzzBytes(r, 20)}},
+				&ScanRequest{StartKey: Key("a"), EndKey: Key("b"), MaxResults: r.Int63()},
+				&EndTransactionRequest{Commit: true},
+			},
+		},
+		&BatchResponse{
+			ResponseHeader: ResponseHeader{Txn: txn},
+			Responses: []Response{
+				&PutResponse{},
+				&ScanResponse{Rows: []KeyValue{{Key: Key(randFuzzBytes(r, 20))}}},
+			},
+		},
+		&InternalPushTxnResponse{PusheeTxn: *txn},
+	}
+	for i := 0; i < fuzzIterations; i++ {
+		v := valid[r.Intn(len(valid))]
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		b := buf.Bytes()
+		switch r.Intn(3) {
+		case 0:
+			b = b[:r.Intn(len(b))]
+		case 1:
+			for j := 0; j < 1+r.Intn(3); j++ {
+				b[r.Intn(len(b))] = byte(r.Intn(256))
+			}
+		default:
+			b = randFuzzBytes(r, 200)
+		}
+		for _, msg := range valid {
+			decoded := reflect.New(reflect.TypeOf(msg).Elem()).Interface()
+			// The result is unimportant; decoding must simply not panic.
+			gob.NewDecoder(bytes.NewBuffer(b)).Decode(decoded)
+		}
+	}
+}
+
+func TestBatchRequestKey(t *testing.T) {
+	testCases := []struct {
+		requests []Request
+		expKey   Key
+	}{
+		{nil, nil},
+		{[]Request{&GetRequest{Key: Key("a")}, &PutRequest{Key: Key("b")}}, Key("a")},
+		{[]Request{&ScanRequest{StartKey: Key("c")}}, Key("c")},
+		{[]Request{&EndTransactionRequest{RequestHeader: RequestHeader{Txn: &Transaction{Key: Key("d")}}}}, Key("d")},
+		{[]Request{&InternalResolveIntentRequest{Key: Key("e")}}, nil},
+	}
+	for i, test := range testCases {
+		br := &BatchRequest{Requests: test.requests}
+		if key := br.Key(); !bytes.Equal(key, test.expKey) {
+			t.Errorf("%d: expected key %q; got %q", i, test.expKey, key)
+		}
+	}
+}
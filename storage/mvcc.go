@@ -0,0 +1,862 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/cockroachdb/cockroach/hlc"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// MVCCMetadata holds information about the versions of a key. It's
+// stored at the encoded key without a timestamp suffix, which sorts
+// immediately before all of the key's versions. If Txn is non-nil,
+// the most recent version is a write intent belonging to Txn. The
+// sizes of the most recent version are recorded so that statistics
+// can be maintained without reading it.
+type MVCCMetadata struct {
+	Txn       *Transaction
+	Timestamp hlc.HLTimestamp // Timestamp of most recent version
+	Deleted   bool            // Is the most recent version a deletion?
+	KeyBytes  int64           // Bytes in most recent encoded version key
+	ValBytes  int64           // Bytes in most recent version value
+}
+
+// MVCCStats tracks byte and instance counts for the data stored via
+// MVCC. Metadata entries count once per key (KeyCount); versions
+// count once each (ValCount). Live bytes comprise the metadata and
+// most recent version of each key whose most recent version isn't a
+// deletion. Intent bytes comprise the versions written as intents.
+type MVCCStats struct {
+	LiveBytes, KeyBytes, ValBytes, IntentBytes int64
+	LiveCount, KeyCount, ValCount, IntentCount int64
+}
+
+// Add adds the values from o to ms.
+func (ms *MVCCStats) Add(o MVCCStats) {
+	ms.LiveBytes += o.LiveBytes
+	ms.KeyBytes += o.KeyBytes
+	ms.ValBytes += o.ValBytes
+	ms.IntentBytes += o.IntentBytes
+	ms.LiveCount += o.LiveCount
+	ms.KeyCount += o.KeyCount
+	ms.ValCount += o.ValCount
+	ms.IntentCount += o.IntentCount
+}
+
+// TotalBytes returns the total number of key and value bytes.
+func (ms MVCCStats) TotalBytes() int64 {
+	return ms.KeyBytes + ms.ValBytes
+}
+
+// GCBytes returns the number of bytes which aren't live: historical
+// versions, deletion tombstones and the metadata of deleted keys.
+// These may be garbage collected once older than the GC TTL.
+func (ms MVCCStats) GCBytes() int64 {
+	return ms.TotalBytes() - ms.LiveBytes
+}
+
+// updateStatsForKey adds (sign=1) or subtracts (sign=-1) the
+// contributions of a key's metadata, which also determines whether
+// the key's most recent version is live or an intent.
+func (ms *MVCCStats) updateStatsForKey(metaKeySize, metaValSize int64, meta *MVCCMetadata, sign int64) {
+	ms.KeyCount += sign
+	ms.KeyBytes += sign * metaKeySize
+	ms.ValBytes += sign * metaValSize
+	if !meta.Deleted {
+		ms.LiveCount += sign
+		ms.LiveBytes += sign * (metaKeySize + metaValSize + meta.KeyBytes + meta.ValBytes)
+	}
+	if meta.Txn != nil {
+		ms.IntentCount += sign
+		ms.IntentBytes += sign * (meta.KeyBytes + meta.ValBytes)
+	}
+}
+
+// updateStatsForVersion adds (sign=1) or subtracts (sign=-1) the
+// contributions of a single version.
+func (ms *MVCCStats) updateStatsForVersion(keySize, valSize int64, sign int64) {
+	ms.ValCount += sign
+	ms.KeyBytes += sign * keySize
+	ms.ValBytes += sign * valSize
+}
+
+// MVCC wraps an engine to provide multi-version concurrency control.
+// Each key may have many versions, each stored at the encoded key
+// suffixed by the version's timestamp. Timestamps are encoded so
+// that newer versions sort first. Deletions are recorded as
+// versions with empty values.
+//
+// Changes to MVCCStats resulting from writes are accumulated and may
+// be retrieved via FlushStats. Likewise, if enabled via
+// RecordCommits, committed writes are accumulated and may be
+// retrieved via FlushCommits. Writes must not be executed
+// concurrently with one another or with either flush.
+type MVCC struct {
+	engine        Engine
+	stats         MVCCStats  // Accumulated since last FlushStats
+	recordCommits bool       // True to accumulate committed writes
+	commits       []KeyValue // Accumulated since last FlushCommits
+	statsKey      Key        // If set, key at which writes persist total stats
+	statsTotal    MVCCStats  // Total stats persisted at statsKey
+}
+
+// NewMVCC returns a new instance of MVCC wrapping engine.
+func NewMVCC(engine Engine) *MVCC {
+	return &MVCC{engine: engine}
+}
+
+// mvccEncodeKey returns the encoded key at which the metadata for
+// key is stored.
+func mvccEncodeKey(key Key) Key {
+	return Key(encodeBytes(key))
+}
+
+// mvccEncodeVersionKey returns the encoded key at which the version
+// of key written at timestamp is stored.
+func mvccEncodeVersionKey(key Key, timestamp hlc.HLTimestamp) Key {
+	k := encodeBytes(key)
+	k = encodeUint64Decreasing(k, uint64(timestamp.WallTime))
+	k = encodeUint64Decreasing(k, timestamp.Logical)
+	return Key(k)
+}
+
+// mvccDecodeKey decodes an encoded key, returning the original key,
+// and, if the encoded key is a version key, the version timestamp.
+// isVersion is false for metadata keys.
+func mvccDecodeKey(encKey Key) (key Key, timestamp hlc.HLTimestamp, isVersion bool, err error) {
+	var rest []byte
+	if key, rest, err = decodeBytes(encKey); err != nil || len(rest) == 0 {
+		return
+	}
+	var wallTime uint64
+	if wallTime, rest, err = decodeUint64Decreasing(rest); err != nil {
+		return
+	}
+	if timestamp.Logical, rest, err = decodeUint64Decreasing(rest); err != nil {
+		return
+	}
+	if len(rest) != 0 {
+		err = util.Errorf("invalid encoded MVCC key %q", encKey)
+		return
+	}
+	timestamp.WallTime = int64(wallTime)
+	isVersion = true
+	return
+}
+
+// FlushStats returns the changes to MVCCStats accumulated by writes
+// since the last call and resets the accumulated changes.
+func (mvcc *MVCC) FlushStats() MVCCStats {
+	ms := mvcc.stats
+	mvcc.stats = MVCCStats{}
+	return ms
+}
+
+// PersistStats makes subsequent writes persist the total MVCC stats,
+// starting from total, at key in the same batches as the writes
+// themselves, so that the persisted stats never diverge from the data
+// they describe.
+func (mvcc *MVCC) PersistStats(key Key, total MVCCStats) {
+	mvcc.statsKey = key
+	mvcc.statsTotal = total
+}
+
+// commitBatch atomically applies wb, whose writes change the MVCC
+// stats by ms, along with the updated total stats if persisted (see
+// PersistStats).
+func (mvcc *MVCC) commitBatch(wb *batch, ms MVCCStats) error {
+	total := mvcc.statsTotal
+	if mvcc.statsKey != nil && ms != (MVCCStats{}) {
+		total.Add(ms)
+		kv, err := encodeI(mvcc.statsKey, total)
+		if err != nil {
+			return err
+		}
+		wb.put(kv.Key, kv.Value)
+	}
+	if err := wb.commit(mvcc.engine); err != nil {
+		return err
+	}
+	mvcc.statsTotal = total
+	mvcc.stats.Add(ms)
+	return nil
+}
+
+// RecordCommits enables the accumulation of committed writes: those
+// written without a transaction and intents of committed transactions
+// when resolved.
+func (mvcc *MVCC) RecordCommits() {
+	mvcc.recordCommits = true
+}
+
+// FlushCommits returns the writes committed since the last call, in
+// the order committed, and resets the accumulated writes. Deletions
+// are marked Deleted.
+func (mvcc *MVCC) FlushCommits() []KeyValue {
+	commits := mvcc.commits
+	mvcc.commits = nil
+	return commits
+}
+
+// recordCommit accumulates the write of the encoded version b of key
+// at timestamp, if enabled.
+func (mvcc *MVCC) recordCommit(key Key, timestamp hlc.HLTimestamp, b []byte) error {
+	if !mvcc.recordCommits {
+		return nil
+	}
+	value, err := decodeVersion(b, timestamp)
+	if err != nil {
+		return err
+	}
+	commit := KeyValue{Key: key, Value: Value{Timestamp: timestamp}, Deleted: value == nil}
+	if value != nil {
+		commit.Value = *value
+	}
+	mvcc.commits = append(mvcc.commits, commit)
+	return nil
+}
+
+// ComputeStats scans the versioned data for keys in the range
+// [key, endKey) and computes MVCCStats from scratch.
+func (mvcc *MVCC) ComputeStats(key, endKey Key) (MVCCStats, error) {
+	ms := MVCCStats{}
+	kvs, err := mvcc.engine.scan(mvccEncodeKey(key), mvccEncodeKey(endKey), 0)
+	if err != nil {
+		return ms, err
+	}
+	for _, kv := range kvs {
+		_, _, isVersion, err := mvccDecodeKey(kv.Key)
+		if err != nil {
+			return ms, err
+		}
+		if isVersion {
+			ms.updateStatsForVersion(int64(len(kv.Key)), int64(len(kv.Value.Bytes)), 1)
+			continue
+		}
+		meta := &MVCCMetadata{}
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value.Bytes)).Decode(meta); err != nil {
+			return ms, err
+		}
+		ms.updateStatsForKey(int64(len(kv.Key)), int64(len(kv.Value.Bytes)), meta, 1)
+	}
+	return ms, nil
+}
+
+// FindSplitKey returns a key which divides the MVCC data in the range
+// [key, endKey) into two parts of approximately equal size. Sizes
+// include all versions of each key. The split key is never the first
+// key in the range, so each side of a split contains at least one key.
+// Returns an error if the range contains fewer than two keys.
+func (mvcc *MVCC) FindSplitKey(key, endKey Key) (Key, error) {
+	kvs, err := mvcc.engine.scan(mvccEncodeKey(key), mvccEncodeKey(endKey), 0)
+	if err != nil {
+		return nil, err
+	}
+	var keys []Key
+	var sizes []int64
+	var total int64
+	for _, kv := range kvs {
+		k, _, isVersion, err := mvccDecodeKey(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		if !isVersion {
+			keys = append(keys, k)
+			sizes = append(sizes, 0)
+		} else if len(keys) == 0 {
+			return nil, util.Errorf("expected MVCC metadata key; got version key %q", kv.Key)
+		}
+		size := int64(len(kv.Key) + len(kv.Value.Bytes))
+		sizes[len(sizes)-1] += size
+		total += size
+	}
+	if len(keys) < 2 {
+		return nil, util.Errorf("unable to find split key in range [%q, %q): fewer than two keys", key, endKey)
+	}
+	var cumulative int64
+	for i := 0; i < len(keys)-1; i++ {
+		cumulative += sizes[i]
+		if cumulative >= total/2 {
+			return keys[i+1], nil
+		}
+	}
+	return keys[len(keys)-1], nil
+}
+
+// getMetadata fetches and decodes the metadata for key, returning it
+// along with the size of its encoding. Returns nil if the key has no
+// versions.
+func (mvcc *MVCC) getMetadata(key Key) (*MVCCMetadata, int64, error) {
+	buf := keyBufPool.Get().(*[]byte)
+	*buf = appendEncodedBytes((*buf)[:0], key)
+	val, err := mvcc.engine.get(Key(*buf))
+	keyBufPool.Put(buf)
+	if err != nil || len(val.Bytes) == 0 {
+		return nil, 0, err
+	}
+	meta := &MVCCMetadata{}
+	if err := gob.NewDecoder(bytes.NewBuffer(val.Bytes)).Decode(meta); err != nil {
+		return nil, 0, err
+	}
+	return meta, int64(len(val.Bytes)), nil
+}
+
+// isForeignIntent returns true if the metadata indicates a write
+// intent belonging to a transaction other than txn.
+func isForeignIntent(meta *MVCCMetadata, txn *Transaction) bool {
+	return meta.Txn != nil && (txn == nil || meta.Txn.ID != txn.ID)
+}
+
+// Get returns the most recent value for key at or before timestamp.
+// Returns nil if there is no such value or if the most recent
+// version is a deletion. If the most recent version at or before
+// timestamp is a write intent of a transaction other than txn, a
+// WriteIntentError is returned. A transaction always reads its own
+// intents.
+func (mvcc *MVCC) Get(key Key, timestamp hlc.HLTimestamp, txn *Transaction) (*Value, error) {
+	return mvcc.get(key, timestamp, txn, true)
+}
+
+// GetInconsistent is like Get, but write intents of other
+// transactions are ignored instead of returning a WriteIntentError.
+// The most recent version preceding such an intent is returned. The
+// result may not reflect writes which have committed.
+func (mvcc *MVCC) GetInconsistent(key Key, timestamp hlc.HLTimestamp) (*Value, error) {
+	return mvcc.get(key, timestamp, nil, false)
+}
+
+// get implements Get and GetInconsistent.
+func (mvcc *MVCC) get(key Key, timestamp hlc.HLTimestamp, txn *Transaction, consistent bool) (*Value, error) {
+	value, _, _, err := mvcc.getVersion(key, timestamp, txn, consistent)
+	return value, err
+}
+
+// getVersion implements get, additionally returning the timestamp of
+// the version read and whether one was found. The value is nil if the
+// version is a deletion.
+func (mvcc *MVCC) getVersion(key Key, timestamp hlc.HLTimestamp, txn *Transaction, consistent bool) (
+	*Value, hlc.HLTimestamp, bool, error) {
+	meta, _, err := mvcc.getMetadata(key)
+	if err != nil || meta == nil {
+		return nil, hlc.HLTimestamp{}, false, err
+	}
+	seekKey := mvccEncodeVersionKey(key, timestamp)
+	if isForeignIntent(meta, txn) && !timestamp.Less(meta.Timestamp) {
+		if consistent {
+			return nil, hlc.HLTimestamp{}, false, &WriteIntentError{Key: key, Txn: *meta.Txn}
+		}
+		// Skip the intent and read the preceding version.
+		seekKey = MakeKey(mvccEncodeVersionKey(key, meta.Timestamp), Key{0})
+	} else if meta.Txn != nil && !isForeignIntent(meta, txn) {
+		// Read our own intent, whatever its timestamp.
+		seekKey = mvccEncodeVersionKey(key, meta.Timestamp)
+	}
+	kvs, err := mvcc.engine.scan(seekKey, PrefixEndKey(mvccEncodeKey(key)), 1)
+	if err != nil || len(kvs) == 0 {
+		return nil, hlc.HLTimestamp{}, false, err
+	}
+	_, ts, _, err := mvccDecodeKey(kvs[0].Key)
+	if err != nil {
+		return nil, hlc.HLTimestamp{}, false, err
+	}
+	value, err := decodeVersion(kvs[0].Value.Bytes, ts)
+	return value, ts, true, err
+}
+
+// decodeVersion decodes a version's value. Returns nil for
+// deletions.
+func decodeVersion(b []byte, timestamp hlc.HLTimestamp) (*Value, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	value := &Value{}
+	if err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(value); err != nil {
+		return nil, err
+	}
+	// Gob doesn't distinguish empty from nil slices. Live versions
+	// always have non-nil bytes; nil is reserved for missing keys.
+	if value.Bytes == nil {
+		value.Bytes = []byte{}
+	}
+	value.Timestamp = timestamp
+	return value, nil
+}
+
+// Put sets the value for key at timestamp. If txn is non-nil, the
+// value is written as a write intent. Returns a WriteIntentError if
+// the key has a write intent belonging to another transaction and a
+// WriteTooOldError if a more recent version of the key exists.
+func (mvcc *MVCC) Put(key Key, timestamp hlc.HLTimestamp, value Value, txn *Transaction) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return err
+	}
+	return mvcc.putVersion(key, timestamp, buf.Bytes(), txn)
+}
+
+// ConditionalPut sets the value for key at timestamp only if the
+// existing value, as read at timestamp, matches expValue. A nil
+// expValue requires that the key not exist. If the condition fails, a
+// ConditionFailedError is returned with the actual value. The same
+// conditions otherwise apply as for Put.
+func (mvcc *MVCC) ConditionalPut(key Key, timestamp hlc.HLTimestamp, value Value, expValue *Value, txn *Transaction) error {
+	existVal, err := mvcc.Get(key, timestamp, txn)
+	if err != nil {
+		return err
+	}
+	if expValue == nil && existVal != nil {
+		return &ConditionFailedError{ActualValue: existVal}
+	} else if expValue != nil && (existVal == nil || !bytes.Equal(expValue.Bytes, existVal.Bytes)) {
+		return &ConditionFailedError{ActualValue: existVal}
+	}
+	return mvcc.Put(key, timestamp, value, txn)
+}
+
+// Delete marks key as deleted at timestamp by writing a deletion
+// version. The same conditions apply as for Put.
+func (mvcc *MVCC) Delete(key Key, timestamp hlc.HLTimestamp, txn *Transaction) error {
+	return mvcc.putVersion(key, timestamp, nil, txn)
+}
+
+// putVersion writes an encoded version for key along with updated
+// metadata in a single batch. An existing intent belonging to txn is
+// replaced.
+func (mvcc *MVCC) putVersion(key Key, timestamp hlc.HLTimestamp, b []byte, txn *Transaction) error {
+	wb := newBatch()
+	defer wb.release()
+	ms, err := mvcc.addVersion(wb, key, timestamp, b, txn)
+	if err != nil {
+		return err
+	}
+	if err := mvcc.commitBatch(wb, ms); err != nil {
+		return err
+	}
+	if txn == nil {
+		return mvcc.recordCommit(key, timestamp, b)
+	}
+	return nil
+}
+
+// addVersion adds the writes of an encoded version for key and its
+// updated metadata to wb, returning the resulting change to the MVCC
+// stats. wb must not hold other writes to key.
+func (mvcc *MVCC) addVersion(wb *batch, key Key, timestamp hlc.HLTimestamp, b []byte, txn *Transaction) (MVCCStats, error) {
+	ms := MVCCStats{}
+	if len(key) == 0 {
+		return ms, emptyKeyError()
+	}
+	meta, metaSize, err := mvcc.getMetadata(key)
+	if err != nil {
+		return ms, err
+	}
+	metaKey := mvccEncodeKey(key)
+	if meta != nil {
+		if err := checkWriteConflict(key, meta, timestamp, txn); err != nil {
+			return ms, err
+		}
+		if meta.Txn != nil {
+			// Replace our own intent. If the timestamp is unchanged, the
+			// version is overwritten in place.
+			if meta.Timestamp != timestamp {
+				wb.del(mvccEncodeVersionKey(key, meta.Timestamp))
+			}
+			ms.updateStatsForVersion(meta.KeyBytes, meta.ValBytes, -1)
+		}
+		ms.updateStatsForKey(int64(len(metaKey)), metaSize, meta, -1)
+	}
+	versionKey := mvccEncodeVersionKey(key, timestamp)
+	newMeta := &MVCCMetadata{
+		Txn:       txn,
+		Timestamp: timestamp,
+		Deleted:   len(b) == 0,
+		KeyBytes:  int64(len(versionKey)),
+		ValBytes:  int64(len(b)),
+	}
+	metaBytes, err := encodeMetadata(newMeta)
+	if err != nil {
+		return ms, err
+	}
+	ms.updateStatsForKey(int64(len(metaKey)), int64(len(metaBytes)), newMeta, 1)
+	ms.updateStatsForVersion(newMeta.KeyBytes, newMeta.ValBytes, 1)
+	wb.put(metaKey, Value{Bytes: metaBytes})
+	wb.put(versionKey, Value{Bytes: b})
+	return ms, nil
+}
+
+// checkWriteConflict returns an error if a write to key at timestamp
+// by txn would conflict with the existing metadata: a
+// WriteIntentError for an intent of another transaction or a
+// WriteTooOldError if a committed version exists at or after
+// timestamp.
+func checkWriteConflict(key Key, meta *MVCCMetadata, timestamp hlc.HLTimestamp, txn *Transaction) error {
+	if isForeignIntent(meta, txn) {
+		return &WriteIntentError{Key: key, Txn: *meta.Txn}
+	} else if meta.Txn == nil && !meta.Timestamp.Less(timestamp) {
+		return &WriteTooOldError{Timestamp: timestamp, ExistingTimestamp: meta.Timestamp}
+	}
+	return nil
+}
+
+// DeleteRange deletes up to max keys with values in the range
+// [key, endKey) at timestamp; max=0 deletes all. Deletion
+// tombstones are written as intents if txn is non-nil. The tombstones
+// of all keys are written in a single batch, so either every key is
+// deleted or none are. Returns the number of keys deleted and, if
+// max was reached with keys remaining, the key at which to resume.
+func (mvcc *MVCC) DeleteRange(key, endKey Key, max int64, timestamp hlc.HLTimestamp, txn *Transaction) (int64, Key, error) {
+	scanMax := max
+	if max > 0 {
+		scanMax = max + 1
+	}
+	kvs, err := mvcc.Scan(key, endKey, scanMax, timestamp, txn)
+	if err != nil {
+		return 0, nil, err
+	}
+	var resumeKey Key
+	if max > 0 && int64(len(kvs)) > max {
+		resumeKey = kvs[max].Key
+		kvs = kvs[:max]
+	}
+	wb := newBatch()
+	defer wb.release()
+	ms := MVCCStats{}
+	for _, kv := range kvs {
+		keyMS, err := mvcc.addVersion(wb, kv.Key, timestamp, nil, txn)
+		if err != nil {
+			return 0, nil, err
+		}
+		ms.Add(keyMS)
+	}
+	if wb.empty() {
+		return 0, resumeKey, nil
+	}
+	if err := mvcc.commitBatch(wb, ms); err != nil {
+		return 0, nil, err
+	}
+	if txn == nil {
+		for _, kv := range kvs {
+			if err := mvcc.recordCommit(kv.Key, timestamp, nil); err != nil {
+				return 0, nil, err
+			}
+		}
+	}
+	return int64(len(kvs)), resumeKey, nil
+}
+
+// encodeMetadata gob-encodes MVCC metadata.
+func encodeMetadata(meta *MVCCMetadata) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(meta); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Increment fetches the varint encoded int64 value specified by key
+// and adds inc to it, then writes the new value at timestamp. The
+// newly incremented value is returned. The read and write are
+// executed atomically with respect to other commands on the range.
+// An increment of zero returns the current value without writing.
+func (mvcc *MVCC) Increment(key Key, timestamp hlc.HLTimestamp, txn *Transaction, inc int64) (int64, error) {
+	value, err := mvcc.Get(key, timestamp, txn)
+	if err != nil {
+		return 0, err
+	}
+	var b []byte
+	if value != nil {
+		b = value.Bytes
+	}
+	r, encoded, err := incrementValue(key, b, inc)
+	if err != nil || inc == 0 {
+		return r, err
+	}
+	if err = mvcc.Put(key, timestamp, Value{Bytes: encoded}, txn); err != nil {
+		return 0, err
+	}
+	return r, nil
+}
+
+// Scan returns up to max key/value pairs with keys in the range
+// [key, endKey), as read at timestamp. Keys whose most recent version
+// is a deletion are skipped. An empty endKey scans to KeyMax; max=0
+// returns all results. Returns a WriteIntentError on encountering a
+// conflicting write intent.
+func (mvcc *MVCC) Scan(key, endKey Key, max int64, timestamp hlc.HLTimestamp, txn *Transaction) ([]KeyValue, error) {
+	return mvcc.scan(key, endKey, max, 0, false, false, hlc.HLTimestamp{}, timestamp, txn, true, nil)
+}
+
+// ReverseScan is like Scan, but returns the key/value pairs in
+// descending key order, starting from the last key before endKey.
+func (mvcc *MVCC) ReverseScan(key, endKey Key, max int64, timestamp hlc.HLTimestamp, txn *Transaction) ([]KeyValue, error) {
+	return mvcc.scan(key, endKey, max, 0, false, true, hlc.HLTimestamp{}, timestamp, txn, true, nil)
+}
+
+// ScanInconsistent is like Scan, but ignores write intents in the
+// manner of GetInconsistent.
+func (mvcc *MVCC) ScanInconsistent(key, endKey Key, max int64, timestamp hlc.HLTimestamp) ([]KeyValue, error) {
+	return mvcc.scan(key, endKey, max, 0, false, false, hlc.HLTimestamp{}, timestamp, nil, false, nil)
+}
+
+// scan implements Scan, ReverseScan and ScanInconsistent. If
+// maxBytes > 0, the scan stops once the size of the rows returned
+// reaches it. If keysOnly is true, the rows' values are returned
+// without their bytes. If reverse is true, the rows are returned in
+// descending key order. If minTimestamp is not zero, only keys whose
+// version read was written after minTimestamp are returned, including
+// those whose version read is a deletion, as rows marked Deleted. The
+// size of each row returned is reserved from budget, if not nil, as
+// the row is read; the scan fails if the budget is exceeded.
+func (mvcc *MVCC) scan(key, endKey Key, max, maxBytes int64, keysOnly, reverse bool,
+	minTimestamp, timestamp hlc.HLTimestamp, txn *Transaction, consistent bool, budget *util.MemoryBudget) ([]KeyValue, error) {
+	if len(endKey) == 0 {
+		endKey = KeyMax
+	}
+	encKey, encEndKey := mvccEncodeKey(key), mvccEncodeKey(endKey)
+	res := []KeyValue{}
+	var size int64
+	for (max == 0 || int64(len(res)) < max) && (maxBytes == 0 || size < maxBytes) {
+		// Each key's metadata sorts before its versions, so the next
+		// entry is always a metadata key. The previous entry is the
+		// oldest version of the previous key, or its metadata.
+		var kvs []KeyValue
+		var err error
+		if reverse {
+			kvs, err = mvcc.engine.reverseScan(encKey, encEndKey, 1)
+		} else {
+			kvs, err = mvcc.engine.scan(encKey, encEndKey, 1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(kvs) == 0 {
+			break
+		}
+		k, _, isVersion, err := mvccDecodeKey(kvs[0].Key)
+		if err != nil {
+			return nil, err
+		} else if isVersion && !reverse {
+			return nil, util.Errorf("expected MVCC metadata key; got version key %q", kvs[0].Key)
+		}
+		value, versionTS, ok, err := mvcc.getVersion(k, timestamp, txn, consistent)
+		if err != nil {
+			return nil, err
+		}
+		var deleted bool
+		if minTimestamp != (hlc.HLTimestamp{}) {
+			if !ok || !minTimestamp.Less(versionTS) {
+				value = nil
+			} else if value == nil {
+				value, deleted = &Value{Timestamp: versionTS}, true
+			}
+		}
+		if value != nil {
+			row := KeyValue{Key: k, Value: *value, Deleted: deleted}
+			if keysOnly {
+				row.Value.Bytes = nil
+			}
+			if err := budget.Reserve(row.Size()); err != nil {
+				return nil, err
+			}
+			res = append(res, row)
+			size += row.Size()
+		}
+		if reverse {
+			encEndKey = mvccEncodeKey(k)
+		} else {
+			encKey = PrefixEndKey(kvs[0].Key)
+		}
+	}
+	return res, nil
+}
+
+// GarbageCollect deletes the versions of keys in the range [key,
+// endKey) which aren't visible to reads at or after threshold: for
+// each key, all versions older than the most recent version at or
+// before threshold are deleted. If that version is the key's most
+// recent version and is a deletion, the key is removed entirely.
+// Write intents are never garbage collected, nor are the versions
+// they would expose if aborted.
+func (mvcc *MVCC) GarbageCollect(key, endKey Key, threshold hlc.HLTimestamp) error {
+	kvs, err := mvcc.engine.scan(mvccEncodeKey(key), mvccEncodeKey(endKey), 0)
+	if err != nil {
+		return err
+	}
+	ms := MVCCStats{}
+	wb := newBatch()
+	defer wb.release()
+	var meta *MVCCMetadata
+	var metaKV KeyValue
+	var newest bool  // True if the next version is the key's most recent
+	var visible bool // True once the version visible at threshold has been seen
+	for _, kv := range kvs {
+		_, timestamp, isVersion, err := mvccDecodeKey(kv.Key)
+		if err != nil {
+			return err
+		}
+		if !isVersion {
+			meta = &MVCCMetadata{}
+			if err := gob.NewDecoder(bytes.NewBuffer(kv.Value.Bytes)).Decode(meta); err != nil {
+				return err
+			}
+			metaKV, newest, visible = kv, true, false
+			continue
+		}
+		wasNewest := newest
+		newest = false
+		if visible {
+			wb.del(kv.Key)
+			ms.updateStatsForVersion(int64(len(kv.Key)), int64(len(kv.Value.Bytes)), -1)
+			continue
+		}
+		if (wasNewest && meta.Txn != nil) || threshold.Less(timestamp) {
+			continue
+		}
+		visible = true
+		if wasNewest && meta.Deleted {
+			wb.del(metaKV.Key)
+			wb.del(kv.Key)
+			ms.updateStatsForKey(int64(len(metaKV.Key)), int64(len(metaKV.Value.Bytes)), meta, -1)
+			ms.updateStatsForVersion(int64(len(kv.Key)), int64(len(kv.Value.Bytes)), -1)
+		}
+	}
+	if wb.empty() {
+		return nil
+	}
+	if err := mvcc.commitBatch(wb, ms); err != nil {
+		return err
+	}
+	return nil
+}
+
+// FindIntents returns the write intents on keys in [key, endKey)
+// written at timestamps before threshold, each as the error which a
+// reader encountering it would return.
+func (mvcc *MVCC) FindIntents(key, endKey Key, threshold hlc.HLTimestamp) ([]*WriteIntentError, error) {
+	kvs, err := mvcc.engine.scan(mvccEncodeKey(key), mvccEncodeKey(endKey), 0)
+	if err != nil {
+		return nil, err
+	}
+	var intents []*WriteIntentError
+	for _, kv := range kvs {
+		decKey, _, isVersion, err := mvccDecodeKey(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		if isVersion {
+			continue
+		}
+		meta := &MVCCMetadata{}
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value.Bytes)).Decode(meta); err != nil {
+			return nil, err
+		}
+		if meta.Txn != nil && meta.Timestamp.Less(threshold) {
+			intents = append(intents, &WriteIntentError{Key: decKey, Txn: *meta.Txn})
+		}
+	}
+	return intents, nil
+}
+
+// ResolveWriteIntent resolves the write intent for key according to
+// the status of txn. Intents of committed transactions become
+// permanent at the transaction's commit timestamp; intents of aborted
+// transactions are removed. Intents of pending transactions are moved
+// to the transaction's current (possibly pushed) timestamp. It is not
+// an error if key has no intent belonging to txn.
+func (mvcc *MVCC) ResolveWriteIntent(key Key, txn *Transaction) error {
+	if txn == nil {
+		return util.Error("no transaction specified to ResolveWriteIntent")
+	}
+	meta, metaSize, err := mvcc.getMetadata(key)
+	if err != nil || meta == nil || meta.Txn == nil || meta.Txn.ID != txn.ID {
+		return err
+	}
+	metaKey := mvccEncodeKey(key)
+	origKey := mvccEncodeVersionKey(key, meta.Timestamp)
+	ms := MVCCStats{}
+	ms.updateStatsForKey(int64(len(metaKey)), metaSize, meta, -1)
+
+	wb := newBatch()
+	defer wb.release()
+	var newMeta *MVCCMetadata
+	var val Value // The version's encoded value, if read
+	if txn.Status == ABORTED {
+		// Remove the intent and restore metadata for the previous
+		// version, if there is one.
+		wb.del(origKey)
+		ms.updateStatsForVersion(meta.KeyBytes, meta.ValBytes, -1)
+		kvs, err := mvcc.engine.scan(MakeKey(origKey, Key{0}), PrefixEndKey(metaKey), 1)
+		if err != nil {
+			return err
+		}
+		if len(kvs) == 0 {
+			wb.del(metaKey)
+		} else {
+			_, ts, _, err := mvccDecodeKey(kvs[0].Key)
+			if err != nil {
+				return err
+			}
+			newMeta = &MVCCMetadata{
+				Timestamp: ts,
+				Deleted:   len(kvs[0].Value.Bytes) == 0,
+				KeyBytes:  int64(len(kvs[0].Key)),
+				ValBytes:  int64(len(kvs[0].Value.Bytes)),
+			}
+		}
+	} else {
+		// Committed or pending: move the version to the transaction's
+		// timestamp if it has changed.
+		newMeta = &MVCCMetadata{
+			Timestamp: txn.Timestamp,
+			Deleted:   meta.Deleted,
+			KeyBytes:  meta.KeyBytes,
+			ValBytes:  meta.ValBytes,
+		}
+		if txn.Status == PENDING {
+			newMeta.Txn = txn
+		}
+		if txn.Timestamp != meta.Timestamp || (txn.Status == COMMITTED && mvcc.recordCommits) {
+			if val, err = mvcc.engine.get(origKey); err != nil {
+				return err
+			}
+		}
+		if txn.Timestamp != meta.Timestamp {
+			newKey := mvccEncodeVersionKey(key, txn.Timestamp)
+			wb.put(newKey, val)
+			wb.del(origKey)
+			newMeta.KeyBytes = int64(len(newKey))
+			ms.updateStatsForVersion(meta.KeyBytes, meta.ValBytes, -1)
+			ms.updateStatsForVersion(newMeta.KeyBytes, newMeta.ValBytes, 1)
+		}
+	}
+	if newMeta != nil {
+		metaBytes, err := encodeMetadata(newMeta)
+		if err != nil {
+			return err
+		}
+		wb.put(metaKey, Value{Bytes: metaBytes})
+		ms.updateStatsForKey(int64(len(metaKey)), int64(len(metaBytes)), newMeta, 1)
+	}
+	if err := mvcc.commitBatch(wb, ms); err != nil {
+		return err
+	}
+	if txn.Status == COMMITTED {
+		return mvcc.recordCommit(key, txn.Timestamp, val.Bytes)
+	}
+	return nil
+}
@@ -0,0 +1,855 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/hlc"
+)
+
+var (
+	testKey1   = Key("/db1")
+	testKey2   = Key("/db2")
+	testKey3   = Key("/db3")
+	testValue1 = Value{Bytes: []byte("testValue1")}
+	testValue2 = Value{Bytes: []byte("testValue2")}
+	testValue3 = Value{Bytes: []byte("testValue3")}
+	testTxn1   = &Transaction{ID: "txn1", Key: testKey1, Priority: 1}
+	testTxn2   = &Transaction{ID: "txn2", Key: testKey2, Priority: 2}
+)
+
+func makeTS(wallTime int64, logical uint64) hlc.HLTimestamp {
+	return hlc.HLTimestamp{WallTime: wallTime, Logical: logical}
+}
+
+func createTestMVCC() *MVCC {
+	return NewMVCC(NewInMem(Attributes{}, 1<<20))
+}
+
+// expectValue fetches key at timestamp and verifies the result
+// matches expected (nil for no value).
+func expectValue(mvcc *MVCC, key Key, ts hlc.HLTimestamp, txn *Transaction, expected *Value, t *testing.T) {
+	value, err := mvcc.Get(key, ts, txn)
+	if err != nil {
+		t.Fatalf("unexpected error reading %q at %+v: %v", key, ts, err)
+	}
+	if expected == nil {
+		if value != nil {
+			t.Fatalf("expected no value for %q at %+v; got %q", key, ts, value.Bytes)
+		}
+		return
+	}
+	if value == nil || !bytes.Equal(value.Bytes, expected.Bytes) {
+		t.Fatalf("expected %q for %q at %+v; got %+v", expected.Bytes, key, ts, value)
+	}
+}
+
+func TestMVCCEncodeDecodeKey(t *testing.T) {
+	key := Key("a\x00b")
+	k, _, isVersion, err := mvccDecodeKey(mvccEncodeKey(key))
+	if err != nil || isVersion || !bytes.Equal(k, key) {
+		t.Errorf("expected metadata key %q; got %q, %t, %v", key, k, isVersion, err)
+	}
+	ts := makeTS(1<<40, 3)
+	k, decTS, isVersion, err := mvccDecodeKey(mvccEncodeVersionKey(key, ts))
+	if err != nil || !isVersion || !bytes.Equal(k, key) || decTS != ts {
+		t.Errorf("expected version key %q@%+v; got %q@%+v, %t, %v", key, ts, k, decTS, isVersion, err)
+	}
+	// Versions sort newest first, immediately after the metadata key.
+	if bytes.Compare(mvccEncodeKey(key), mvccEncodeVersionKey(key, ts)) >= 0 {
+		t.Error("expected metadata key to sort before version keys")
+	}
+	if bytes.Compare(mvccEncodeVersionKey(key, ts), mvccEncodeVersionKey(key, makeTS(1<<40, 2))) >= 0 {
+		t.Error("expected newer versions to sort first")
+	}
+}
+
+// TestMVCCEncodeDecodeKeyRandom verifies round-trip stability of
+// MVCC key encodings and that versions of a key sort newest first,
+// between the key's metadata key and the next key's metadata key.
+func TestMVCCEncodeDecodeKeyRandom(t *testing.T) {
+	r := newFuzzRand(t)
+	for i := 0; i < fuzzIterations; i++ {
+		key := Key(randFuzzBytes(r, 20))
+		ts1 := makeTS(r.Int63(), uint64(r.Int63()))
+		ts2 := makeTS(r.Int63n(2)+ts1.WallTime, uint64(r.Int63()))
+		metaKey, encKey1, encKey2 := mvccEncodeKey(key), mvccEncodeVersionKey(key, ts1), mvccEncodeVersionKey(key, ts2)
+		k, decTS, isVersion, err := mvccDecodeKey(encKey1)
+		if err != nil || !isVersion || !bytes.Equal(k, key) || decTS != ts1 {
+			t.Fatalf("%d: expected %q@%+v; got %q@%+v, %t, %v", i, key, ts1, k, decTS, isVersion, err)
+		}
+		if k, _, isVersion, err = mvccDecodeKey(metaKey); err != nil || isVersion || !bytes.Equal(k, key) {
+			t.Fatalf("%d: expected metadata key %q; got %q, %t, %v", i, key, k, isVersion, err)
+		}
+		if bytes.Compare(metaKey, encKey1) >= 0 {
+			t.Fatalf("%d: expected metadata key %q to sort before version %q", i, metaKey, encKey1)
+		}
+		if ts1.Less(ts2) != (bytes.Compare(encKey2, encKey1) < 0) {
+			t.Fatalf("%d: expected versions %+v and %+v to sort newest first", i, ts1, ts2)
+		}
+		next := mvccEncodeKey(append(append(Key(nil), key...), 0))
+		if bytes.Compare(encKey1, next) >= 0 {
+			t.Fatalf("%d: expected version %q to sort before next key %q", i, encKey1, next)
+		}
+	}
+}
+
+// TestMVCCDecodeArbitraryKey verifies that mvccDecodeKey doesn't
+// panic on arbitrary input and that any successful decoding
+// re-encodes to the input.
+func TestMVCCDecodeArbitraryKey(t *testing.T) {
+	r := newFuzzRand(t)
+	for i := 0; i < fuzzIterations; i++ {
+		encKey := Key(randFuzzBytes(r, 40))
+		if r.Intn(2) == 0 {
+			// Half the time, start from a valid version key and corrupt it.
+			encKey = mvccEncodeVersionKey(Key(randFuzzBytes(r, 10)), makeTS(r.Int63(), uint64(r.Int63())))
+			encKey = encKey[:r.Intn(len(encKey)+1)]
+			if len(encKey) > 0 && r.Intn(2) == 0 {
+				encKey[r.Intn(len(encKey))] = byte(r.Intn(256))
+			}
+		}
+		key, ts, isVersion, err := mvccDecodeKey(encKey)
+		if err != nil {
+			continue
+		}
+		reenc := mvccEncodeKey(key)
+		if isVersion {
+			reenc = mvccEncodeVersionKey(key, ts)
+		}
+		if !bytes.Equal(reenc, encKey) {
+			t.Fatalf("%d: decoding of %q is not canonical; re-encoded as %q", i, encKey, reenc)
+		}
+	}
+}
+
+func TestMVCCGetAndPut(t *testing.T) {
+	mvcc := createTestMVCC()
+	expectValue(mvcc, testKey1, makeTS(1, 0), nil, nil, t)
+
+	if err := mvcc.Put(testKey1, makeTS(1, 0), testValue1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := mvcc.Put(testKey1, makeTS(3, 0), testValue2, nil); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(mvcc, testKey1, makeTS(0, 1), nil, nil, t)
+	expectValue(mvcc, testKey1, makeTS(1, 0), nil, &testValue1, t)
+	expectValue(mvcc, testKey1, makeTS(2, 0), nil, &testValue1, t)
+	expectValue(mvcc, testKey1, makeTS(3, 0), nil, &testValue2, t)
+	expectValue(mvcc, testKey1, makeTS(4, 0), nil, &testValue2, t)
+
+	value, err := mvcc.Get(testKey1, makeTS(2, 0), nil)
+	if err != nil || value.Timestamp != makeTS(1, 0) {
+		t.Errorf("expected version timestamp %+v; got %+v, %v", makeTS(1, 0), value, err)
+	}
+
+	// Writing at or before the most recent version fails.
+	if err := mvcc.Put(testKey1, makeTS(3, 0), testValue3, nil); err == nil {
+		t.Error("expected write too old error")
+	} else if _, ok := err.(*WriteTooOldError); !ok {
+		t.Errorf("expected write too old error; got %v", err)
+	}
+}
+
+func TestMVCCEmptyValue(t *testing.T) {
+	mvcc := createTestMVCC()
+	if err := mvcc.Put(testKey1, makeTS(1, 0), Value{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	value, err := mvcc.Get(testKey1, makeTS(1, 0), nil)
+	if err != nil || value == nil || value.Bytes == nil || len(value.Bytes) != 0 {
+		t.Errorf("expected empty, non-nil value; got %+v, %v", value, err)
+	}
+}
+
+func TestMVCCDelete(t *testing.T) {
+	mvcc := createTestMVCC()
+	if err := mvcc.Put(testKey1, makeTS(1, 0), testValue1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := mvcc.Delete(testKey1, makeTS(2, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(mvcc, testKey1, makeTS(1, 0), nil, &testValue1, t)
+	expectValue(mvcc, testKey1, makeTS(2, 0), nil, nil, t)
+	if err := mvcc.Put(testKey1, makeTS(3, 0), testValue2, nil); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(mvcc, testKey1, makeTS(3, 0), nil, &testValue2, t)
+}
+
+func TestMVCCIncrement(t *testing.T) {
+	mvcc := createTestMVCC()
+	for i, inc := range []int64{1, 2, -4} {
+		if _, err := mvcc.Increment(testKey1, makeTS(int64(i+1), 0), nil, inc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if val, err := mvcc.Increment(testKey1, makeTS(10, 0), nil, 0); err != nil || val != -1 {
+		t.Errorf("expected -1; got %d, %v", val, err)
+	}
+	// A zero increment doesn't write a new version.
+	if meta, _, err := mvcc.getMetadata(testKey1); err != nil || meta.Timestamp != makeTS(3, 0) {
+		t.Errorf("expected most recent version at %+v; got %+v, %v", makeTS(3, 0), meta, err)
+	}
+	if err := mvcc.Put(testKey2, makeTS(1, 0), Value{Bytes: []byte{0xff}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Increment(testKey2, makeTS(2, 0), nil, 1); err == nil {
+		t.Error("expected error incrementing non-varint value")
+	}
+}
+
+func TestMVCCWriteIntents(t *testing.T) {
+	mvcc := createTestMVCC()
+	if err := mvcc.Put(testKey1, makeTS(1, 0), testValue1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := mvcc.Put(testKey1, makeTS(3, 0), testValue2, testTxn1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads older than the intent ignore it.
+	expectValue(mvcc, testKey1, makeTS(2, 0), nil, &testValue1, t)
+	// Reads at or after the intent conflict, unless they belong to the
+	// intent's transaction.
+	for _, txn := range []*Transaction{nil, testTxn2} {
+		_, err := mvcc.Get(testKey1, makeTS(3, 0), txn)
+		if wiErr, ok := err.(*WriteIntentError); !ok || wiErr.Txn.ID != testTxn1.ID || !bytes.Equal(wiErr.Key, testKey1) {
+			t.Errorf("expected write intent error; got %v", err)
+		}
+	}
+	expectValue(mvcc, testKey1, makeTS(2, 0), testTxn1, &testValue2, t)
+
+	// Writes by other transactions conflict.
+	if err := mvcc.Put(testKey1, makeTS(4, 0), testValue3, testTxn2); err == nil {
+		t.Error("expected write intent error")
+	} else if _, ok := err.(*WriteIntentError); !ok {
+		t.Errorf("expected write intent error; got %v", err)
+	}
+	// The intent's transaction may overwrite its own intent, even at a
+	// new timestamp.
+	if err := mvcc.Put(testKey1, makeTS(4, 0), testValue3, testTxn1); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(mvcc, testKey1, makeTS(3, 0), testTxn1, &testValue3, t)
+	expectValue(mvcc, testKey1, makeTS(3, 5), nil, &testValue1, t)
+}
+
+func TestMVCCResolveWriteIntent(t *testing.T) {
+	mvcc := createTestMVCC()
+	if err := mvcc.Put(testKey1, makeTS(1, 0), testValue1, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []Key{testKey1, testKey2} {
+		if err := mvcc.Put(key, makeTS(2, 0), testValue2, testTxn1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Pending with pushed timestamp: the intent moves.
+	pushed := *testTxn1
+	pushed.Timestamp = makeTS(5, 0)
+	if err := mvcc.ResolveWriteIntent(testKey1, &pushed); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(mvcc, testKey1, makeTS(4, 0), nil, &testValue1, t)
+	if _, err := mvcc.Get(testKey1, makeTS(5, 0), nil); err == nil {
+		t.Error("expected write intent error at pushed timestamp")
+	}
+
+	// Committed: the intent becomes a regular version.
+	committed := pushed
+	committed.Status = COMMITTED
+	if err := mvcc.ResolveWriteIntent(testKey1, &committed); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(mvcc, testKey1, makeTS(4, 0), nil, &testValue1, t)
+	expectValue(mvcc, testKey1, makeTS(5, 0), nil, &testValue2, t)
+	// Resolving again is a no-op.
+	if err := mvcc.ResolveWriteIntent(testKey1, &committed); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(mvcc, testKey1, makeTS(5, 0), nil, &testValue2, t)
+
+	// Aborted: the intent is removed. testKey2 has no prior version.
+	aborted := *testTxn1
+	aborted.Status = ABORTED
+	if err := mvcc.ResolveWriteIntent(testKey2, &aborted); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(mvcc, testKey2, makeTS(10, 0), nil, nil, t)
+	if meta, _, err := mvcc.getMetadata(testKey2); err != nil || meta != nil {
+		t.Errorf("expected metadata to be removed; got %+v, %v", meta, err)
+	}
+}
+
+func TestMVCCResolveAbortedIntentRestoresPrevious(t *testing.T) {
+	mvcc := createTestMVCC()
+	if err := mvcc.Put(testKey1, makeTS(1, 0), testValue1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := mvcc.Put(testKey1, makeTS(2, 0), testValue2, testTxn1); err != nil {
+		t.Fatal(err)
+	}
+	aborted := *testTxn1
+	aborted.Status = ABORTED
+	if err := mvcc.ResolveWriteIntent(testKey1, &aborted); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(mvcc, testKey1, makeTS(3, 0), nil, &testValue1, t)
+	// A subsequent write must be newer than the restored version only.
+	if err := mvcc.Put(testKey1, makeTS(2, 0), testValue3, nil); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(mvcc, testKey1, makeTS(2, 0), nil, &testValue3, t)
+}
+
+func TestMVCCScan(t *testing.T) {
+	mvcc := createTestMVCC()
+	for i, key := range []Key{testKey1, testKey2, testKey3} {
+		if err := mvcc.Put(key, makeTS(int64(i+1), 0), testValue1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mvcc.Delete(testKey2, makeTS(5, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		start, end Key
+		max        int64
+		ts         hlc.HLTimestamp
+		expKeys    []Key
+	}{
+		{KeyMin, KeyMax, 0, makeTS(10, 0), []Key{testKey1, testKey3}},
+		{KeyMin, KeyMax, 0, makeTS(4, 0), []Key{testKey1, testKey2, testKey3}},
+		{KeyMin, KeyMax, 1, makeTS(4, 0), []Key{testKey1}},
+		{KeyMin, KeyMax, 0, makeTS(2, 0), []Key{testKey1, testKey2}},
+		{testKey2, testKey3, 0, makeTS(4, 0), []Key{testKey2}},
+		{testKey2, nil, 0, makeTS(4, 0), []Key{testKey2, testKey3}},
+	}
+	for i, test := range testCases {
+		kvs, err := mvcc.Scan(test.start, test.end, test.max, test.ts, nil)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		var keys []Key
+		for _, kv := range kvs {
+			keys = append(keys, kv.Key)
+		}
+		if len(keys) != len(test.expKeys) {
+			t.Errorf("%d: expected keys %q; got %q", i, test.expKeys, keys)
+			continue
+		}
+		for j := range keys {
+			if !bytes.Equal(keys[j], test.expKeys[j]) {
+				t.Errorf("%d: expected keys %q; got %q", i, test.expKeys, keys)
+				break
+			}
+		}
+	}
+
+	// Scans encountering a conflicting intent fail.
+	if err := mvcc.Put(testKey2, makeTS(6, 0), testValue2, testTxn1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Scan(KeyMin, KeyMax, 0, makeTS(10, 0), nil); err == nil {
+		t.Error("expected write intent error")
+	}
+	if kvs, err := mvcc.Scan(KeyMin, KeyMax, 0, makeTS(10, 0), testTxn1); err != nil || len(kvs) != 3 {
+		t.Errorf("expected three results; got %+v, %v", kvs, err)
+	}
+}
+
+// TestMVCCReverseScan verifies that reverse scans return the values
+// visible at their timestamp in descending key order, skipping the
+// older versions of each key.
+func TestMVCCReverseScan(t *testing.T) {
+	mvcc := createTestMVCC()
+	for i, key := range []Key{testKey1, testKey2, testKey3} {
+		if err := mvcc.Put(key, makeTS(int64(i+1), 0), testValue1, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := mvcc.Put(key, makeTS(int64(i+4), 0), testValue2, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mvcc.Delete(testKey2, makeTS(10, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		start, end Key
+		max        int64
+		ts         hlc.HLTimestamp
+		expKeys    []Key
+	}{
+		{KeyMin, KeyMax, 0, makeTS(20, 0), []Key{testKey3, testKey1}},
+		{KeyMin, KeyMax, 0, makeTS(9, 0), []Key{testKey3, testKey2, testKey1}},
+		{KeyMin, KeyMax, 2, makeTS(9, 0), []Key{testKey3, testKey2}},
+		{KeyMin, testKey3, 1, makeTS(9, 0), []Key{testKey2}},
+		{testKey2, nil, 0, makeTS(2, 0), []Key{testKey2}},
+		{testKey2, testKey2, 0, makeTS(9, 0), nil},
+	}
+	for i, test := range testCases {
+		kvs, err := mvcc.ReverseScan(test.start, test.end, test.max, test.ts, nil)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		var keys []Key
+		for _, kv := range kvs {
+			keys = append(keys, kv.Key)
+		}
+		if !reflect.DeepEqual(keys, test.expKeys) {
+			t.Errorf("%d: expected keys %q; got %q", i, test.expKeys, keys)
+		}
+	}
+	if kvs, err := mvcc.ReverseScan(KeyMin, KeyMax, 1, makeTS(5, 0), nil); err != nil ||
+		!bytes.Equal(kvs[0].Value.Bytes, testValue1.Bytes) {
+		t.Errorf("expected the value of %q visible at 5; got %+v, %v", testKey3, kvs, err)
+	}
+}
+
+// TestMVCCInconsistentReads verifies that inconsistent gets and scans
+// ignore write intents and return the preceding versions.
+func TestMVCCInconsistentReads(t *testing.T) {
+	mvcc := createTestMVCC()
+	if err := mvcc.Put(testKey1, makeTS(1, 0), testValue1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := mvcc.Put(testKey1, makeTS(3, 0), testValue2, testTxn1); err != nil {
+		t.Fatal(err)
+	}
+	if err := mvcc.Put(testKey2, makeTS(3, 0), testValue3, testTxn1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ts := range []hlc.HLTimestamp{makeTS(2, 0), makeTS(3, 0), makeTS(4, 0)} {
+		val, err := mvcc.GetInconsistent(testKey1, ts)
+		if err != nil || val == nil || !bytes.Equal(val.Bytes, testValue1.Bytes) {
+			t.Errorf("%+v: expected %q; got %+v, %v", ts, testValue1.Bytes, val, err)
+		}
+	}
+	// A key with only an intent has no visible value.
+	if val, err := mvcc.GetInconsistent(testKey2, makeTS(4, 0)); err != nil || val != nil {
+		t.Errorf("expected nil value; got %+v, %v", val, err)
+	}
+
+	kvs, err := mvcc.ScanInconsistent(KeyMin, KeyMax, 0, makeTS(4, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 1 || !bytes.Equal(kvs[0].Key, testKey1) || !bytes.Equal(kvs[0].Value.Bytes, testValue1.Bytes) {
+		t.Errorf("expected only %q; got %+v", testKey1, kvs)
+	}
+}
+
+// TestMVCCFindSplitKey verifies that the split key divides the
+// range's data in half.
+func TestMVCCFindSplitKey(t *testing.T) {
+	mvcc := createTestMVCC()
+	if _, err := mvcc.FindSplitKey(KeyMin, KeyMax); err == nil {
+		t.Error("expected error finding split key in empty range")
+	}
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+		if err := mvcc.Put(Key(key), makeTS(1, 0), testValue1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	splitKey, err := mvcc.FindSplitKey(KeyMin, KeyMax)
+	if err != nil || !bytes.Equal(splitKey, Key("f")) {
+		t.Errorf("expected split key %q; got %q, %v", "f", splitKey, err)
+	}
+	// Additional versions of a key count towards its size.
+	for i := int64(2); i < 100; i++ {
+		if err := mvcc.Put(Key("a"), makeTS(i, 0), testValue1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	splitKey, err = mvcc.FindSplitKey(KeyMin, KeyMax)
+	if err != nil || !bytes.Equal(splitKey, Key("b")) {
+		t.Errorf("expected split key %q; got %q, %v", "b", splitKey, err)
+	}
+	if splitKey, err = mvcc.FindSplitKey(Key("i"), KeyMax); err != nil || !bytes.Equal(splitKey, Key("j")) {
+		t.Errorf("expected split key %q; got %q, %v", "j", splitKey, err)
+	}
+}
+
+// verifyStats checks that the stats accumulated by mvcc since the
+// last flush, added to ms, match stats computed from scratch. The
+// updated stats are returned.
+func verifyStats(mvcc *MVCC, ms MVCCStats, t *testing.T) MVCCStats {
+	ms.Add(mvcc.FlushStats())
+	computed, err := mvcc.ComputeStats(KeyMin, KeyMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ms != computed {
+		t.Fatalf("expected incremental stats %+v to equal computed stats %+v", ms, computed)
+	}
+	return ms
+}
+
+func TestMVCCStatsBasics(t *testing.T) {
+	mvcc := createTestMVCC()
+	if err := mvcc.Put(testKey1, makeTS(1, 0), testValue1, nil); err != nil {
+		t.Fatal(err)
+	}
+	ms := verifyStats(mvcc, MVCCStats{}, t)
+	if ms.KeyCount != 1 || ms.ValCount != 1 || ms.LiveCount != 1 || ms.IntentCount != 0 {
+		t.Errorf("unexpected counts after put: %+v", ms)
+	}
+	if ms.LiveBytes != ms.TotalBytes() || ms.GCBytes() != 0 {
+		t.Errorf("expected all bytes live: %+v", ms)
+	}
+
+	// Overwriting leaves the previous version as non-live data.
+	if err := mvcc.Put(testKey1, makeTS(2, 0), testValue2, nil); err != nil {
+		t.Fatal(err)
+	}
+	ms = verifyStats(mvcc, ms, t)
+	if ms.KeyCount != 1 || ms.ValCount != 2 || ms.LiveCount != 1 || ms.GCBytes() == 0 {
+		t.Errorf("unexpected stats after overwrite: %+v", ms)
+	}
+
+	// Deleting leaves no live data.
+	if err := mvcc.Delete(testKey1, makeTS(3, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+	ms = verifyStats(mvcc, ms, t)
+	if ms.KeyCount != 1 || ms.ValCount != 3 || ms.LiveCount != 0 || ms.LiveBytes != 0 {
+		t.Errorf("unexpected stats after delete: %+v", ms)
+	}
+}
+
+func TestMVCCStatsWithIntents(t *testing.T) {
+	mvcc := createTestMVCC()
+	ms := MVCCStats{}
+	if err := mvcc.Put(testKey1, makeTS(1, 0), testValue1, nil); err != nil {
+		t.Fatal(err)
+	}
+	ms = verifyStats(mvcc, ms, t)
+
+	for _, key := range []Key{testKey1, testKey2} {
+		if err := mvcc.Put(key, makeTS(2, 0), testValue2, testTxn1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ms = verifyStats(mvcc, ms, t)
+	if ms.IntentCount != 2 || ms.IntentBytes == 0 {
+		t.Errorf("expected two intents: %+v", ms)
+	}
+
+	// Rewrite an intent in place and at a new timestamp.
+	if err := mvcc.Put(testKey1, makeTS(2, 0), testValue3, testTxn1); err != nil {
+		t.Fatal(err)
+	}
+	ms = verifyStats(mvcc, ms, t)
+	if err := mvcc.Delete(testKey2, makeTS(3, 0), testTxn1); err != nil {
+		t.Fatal(err)
+	}
+	ms = verifyStats(mvcc, ms, t)
+
+	// Push, then commit testKey1 and abort testKey2.
+	pushed := *testTxn1
+	pushed.Timestamp = makeTS(4, 0)
+	if err := mvcc.ResolveWriteIntent(testKey1, &pushed); err != nil {
+		t.Fatal(err)
+	}
+	ms = verifyStats(mvcc, ms, t)
+	committed := pushed
+	committed.Status = COMMITTED
+	if err := mvcc.ResolveWriteIntent(testKey1, &committed); err != nil {
+		t.Fatal(err)
+	}
+	ms = verifyStats(mvcc, ms, t)
+	aborted := pushed
+	aborted.Status = ABORTED
+	if err := mvcc.ResolveWriteIntent(testKey2, &aborted); err != nil {
+		t.Fatal(err)
+	}
+	ms = verifyStats(mvcc, ms, t)
+	if ms.IntentCount != 0 || ms.IntentBytes != 0 || ms.KeyCount != 1 || ms.ValCount != 2 || ms.LiveCount != 1 {
+		t.Errorf("unexpected stats after resolution: %+v", ms)
+	}
+
+	// A failed write leaves the stats unchanged.
+	if err := mvcc.Put(testKey1, makeTS(1, 0), testValue1, nil); err == nil {
+		t.Fatal("expected write too old error")
+	}
+	if delta := mvcc.FlushStats(); delta != (MVCCStats{}) {
+		t.Errorf("expected no change in stats; got %+v", delta)
+	}
+}
+
+func TestMVCCConditionalPut(t *testing.T) {
+	mvcc := createTestMVCC()
+	// Expecting a value for a missing key fails.
+	err := mvcc.ConditionalPut(testKey1, makeTS(1, 0), testValue1, &testValue2, nil)
+	if cfErr, ok := err.(*ConditionFailedError); !ok || cfErr.ActualValue != nil {
+		t.Fatalf("expected condition failed error with nil value; got %v", err)
+	}
+	// Expecting non-existence succeeds.
+	if err := mvcc.ConditionalPut(testKey1, makeTS(1, 0), testValue1, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Expecting non-existence now fails.
+	err = mvcc.ConditionalPut(testKey1, makeTS(2, 0), testValue2, nil, nil)
+	if cfErr, ok := err.(*ConditionFailedError); !ok || !bytes.Equal(cfErr.ActualValue.Bytes, testValue1.Bytes) {
+		t.Fatalf("expected condition failed error with actual value; got %v", err)
+	}
+	// Mismatched expected value fails; matching succeeds.
+	if err := mvcc.ConditionalPut(testKey1, makeTS(2, 0), testValue3, &testValue2, nil); err == nil {
+		t.Fatal("expected condition failed error")
+	}
+	if err := mvcc.ConditionalPut(testKey1, makeTS(2, 0), testValue2, &testValue1, nil); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(mvcc, testKey1, makeTS(2, 0), nil, &testValue2, t)
+	// The condition is evaluated at the put's timestamp.
+	if err := mvcc.Delete(testKey1, makeTS(3, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := mvcc.ConditionalPut(testKey1, makeTS(4, 0), testValue3, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(mvcc, testKey1, makeTS(4, 0), nil, &testValue3, t)
+}
+
+func TestMVCCDeleteRange(t *testing.T) {
+	mvcc := createTestMVCC()
+	keys := []Key{Key("a"), Key("b"), Key("c"), Key("d")}
+	for _, key := range keys {
+		if err := mvcc.Put(key, makeTS(1, 0), testValue1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	num, resumeKey, err := mvcc.DeleteRange(Key("a"), Key("d"), 2, makeTS(2, 0), nil)
+	if err != nil || num != 2 || !bytes.Equal(resumeKey, Key("c")) {
+		t.Fatalf("expected 2 deleted with resume key \"c\"; got %d, %q, %v", num, resumeKey, err)
+	}
+	num, resumeKey, err = mvcc.DeleteRange(resumeKey, Key("d"), 2, makeTS(2, 0), nil)
+	if err != nil || num != 1 || resumeKey != nil {
+		t.Fatalf("expected 1 deleted with no resume key; got %d, %q, %v", num, resumeKey, err)
+	}
+	kvs, err := mvcc.Scan(KeyMin, KeyMax, 0, makeTS(2, 0), nil)
+	if err != nil || len(kvs) != 1 || !bytes.Equal(kvs[0].Key, Key("d")) {
+		t.Errorf("expected only \"d\" to remain; got %+v, %v", kvs, err)
+	}
+	// Deleted values remain visible at earlier timestamps.
+	expectValue(mvcc, Key("b"), makeTS(1, 0), nil, &testValue1, t)
+}
+
+// TestMVCCDeleteRangeConflict verifies that no keys are deleted if
+// any key in the range conflicts.
+func TestMVCCDeleteRangeConflict(t *testing.T) {
+	mvcc := createTestMVCC()
+	if err := mvcc.Put(Key("a"), makeTS(1, 0), testValue1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := mvcc.Put(Key("b"), makeTS(1, 0), testValue1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := mvcc.Put(Key("b"), makeTS(3, 0), testValue2, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := mvcc.DeleteRange(KeyMin, KeyMax, 0, makeTS(2, 0), nil)
+	if _, ok := err.(*WriteTooOldError); !ok {
+		t.Fatalf("expected write too old error; got %v", err)
+	}
+	expectValue(mvcc, Key("a"), makeTS(2, 0), nil, &testValue1, t)
+
+	// Transactional deletes write intents.
+	num, _, err := mvcc.DeleteRange(KeyMin, KeyMax, 0, makeTS(4, 0), testTxn1)
+	if err != nil || num != 2 {
+		t.Fatalf("expected 2 deleted; got %d, %v", num, err)
+	}
+	if _, err := mvcc.Get(Key("a"), makeTS(4, 0), nil); err == nil {
+		t.Error("expected write intent error")
+	}
+	expectValue(mvcc, Key("a"), makeTS(4, 0), testTxn1, nil, t)
+}
+
+// TestMVCCGarbageCollect verifies that versions which aren't visible
+// at or after the GC threshold are deleted, that keys deleted before
+// the threshold are removed entirely, that write intents and the
+// versions they would expose are kept, and that stats are updated.
+func TestMVCCGarbageCollect(t *testing.T) {
+	mvcc := createTestMVCC()
+	for _, ts := range []int64{1, 2, 4} {
+		if err := mvcc.Put(testKey1, makeTS(ts, 0), testValue1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mvcc.Put(testKey2, makeTS(1, 0), testValue1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := mvcc.Delete(testKey2, makeTS(2, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+	for i, ts := range []int64{1, 2, 4} {
+		var txn *Transaction
+		if i == 2 {
+			txn = testTxn1
+		}
+		if err := mvcc.Put(testKey3, makeTS(ts, 0), testValue1, txn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ms := verifyStats(mvcc, MVCCStats{}, t)
+
+	if err := mvcc.GarbageCollect(KeyMin, KeyMax, makeTS(3, 0)); err != nil {
+		t.Fatal(err)
+	}
+	ms = verifyStats(mvcc, ms, t)
+	if ms.KeyCount != 2 || ms.ValCount != 4 {
+		t.Errorf("expected 2 keys with 4 versions after GC; got %+v", ms)
+	}
+	testCases := []struct {
+		key   Key
+		expTS []int64
+	}{
+		{testKey1, []int64{4, 2}},
+		{testKey2, nil},
+		{testKey3, []int64{4, 2}},
+	}
+	for i, test := range testCases {
+		kvs, err := mvcc.engine.scan(mvccEncodeKey(test.key), PrefixEndKey(mvccEncodeKey(test.key)), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var versions []int64
+		for _, kv := range kvs {
+			if _, ts, isVersion, _ := mvccDecodeKey(kv.Key); isVersion {
+				versions = append(versions, ts.WallTime)
+			}
+		}
+		if !reflect.DeepEqual(versions, test.expTS) {
+			t.Errorf("%d: expected versions %v of %q; got %v", i, test.expTS, test.key, versions)
+		}
+	}
+	expectValue(mvcc, testKey1, makeTS(3, 0), nil, &testValue1, t)
+	expectValue(mvcc, testKey2, makeTS(3, 0), nil, nil, t)
+}
+
+// TestMVCCFindIntents verifies that only intents written before the
+// threshold are found.
+func TestMVCCFindIntents(t *testing.T) {
+	mvcc := createTestMVCC()
+	if err := mvcc.Put(testKey1, makeTS(1, 0), testValue1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := mvcc.Put(testKey2, makeTS(1, 0), testValue1, testTxn1); err != nil {
+		t.Fatal(err)
+	}
+	if err := mvcc.Put(testKey3, makeTS(3, 0), testValue1, testTxn2); err != nil {
+		t.Fatal(err)
+	}
+	intents, err := mvcc.FindIntents(KeyMin, KeyMax, makeTS(2, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(intents) != 1 || !bytes.Equal(intents[0].Key, testKey2) || intents[0].Txn.ID != testTxn1.ID {
+		t.Errorf("expected intent at %q of %s; got %+v", testKey2, testTxn1, intents)
+	}
+	if intents, err = mvcc.FindIntents(KeyMin, KeyMax, makeTS(4, 0)); err != nil || len(intents) != 2 {
+		t.Errorf("expected 2 intents; got %+v, %v", intents, err)
+	}
+}
+
+// TestMVCCFlushCommits verifies that writes without transactions and
+// intents of committed transactions are recorded as committed, in
+// order, while pending and aborted intents aren't.
+func TestMVCCFlushCommits(t *testing.T) {
+	mvcc := createTestMVCC()
+	if err := mvcc.Put(testKey1, makeTS(1, 0), testValue1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if commits := mvcc.FlushCommits(); len(commits) != 0 {
+		t.Errorf("expected no commits recorded before enabled; got %+v", commits)
+	}
+
+	mvcc.RecordCommits()
+	if err := mvcc.Delete(testKey1, makeTS(2, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []Key{testKey2, testKey3} {
+		if err := mvcc.Put(key, makeTS(3, 0), testValue2, testTxn1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	committed := *testTxn1
+	committed.Status = COMMITTED
+	committed.Timestamp = makeTS(4, 0)
+	if err := mvcc.ResolveWriteIntent(testKey2, &committed); err != nil {
+		t.Fatal(err)
+	}
+	aborted := *testTxn1
+	aborted.Status = ABORTED
+	if err := mvcc.ResolveWriteIntent(testKey3, &aborted); err != nil {
+		t.Fatal(err)
+	}
+
+	expCommits := []KeyValue{
+		{Key: testKey1, Value: Value{Timestamp: makeTS(2, 0)}, Deleted: true},
+		{Key: testKey2, Value: Value{Bytes: testValue2.Bytes, Timestamp: makeTS(4, 0)}},
+	}
+	if commits := mvcc.FlushCommits(); !reflect.DeepEqual(commits, expCommits) {
+		t.Errorf("expected commits %+v; got %+v", expCommits, commits)
+	}
+	if commits := mvcc.FlushCommits(); len(commits) != 0 {
+		t.Errorf("expected no commits after flush; got %+v", commits)
+	}
+}
+
+// TestMVCCPersistStats verifies that once enabled, writes persist the
+// updated total stats along with their data.
+func TestMVCCPersistStats(t *testing.T) {
+	mvcc := createTestMVCC()
+	if err := mvcc.Put(testKey1, makeTS(1, 0), testValue1, nil); err != nil {
+		t.Fatal(err)
+	}
+	statsKey := rangeStatsKey(1)
+	if ok, _, err := getI(mvcc.engine, statsKey, nil); ok || err != nil {
+		t.Fatalf("expected no stats persisted before enabled; got %v", err)
+	}
+	total := mvcc.FlushStats()
+	mvcc.PersistStats(statsKey, total)
+	if err := mvcc.Put(testKey2, makeTS(2, 0), testValue2, testTxn1); err != nil {
+		t.Fatal(err)
+	}
+	committed := *testTxn1
+	committed.Status = COMMITTED
+	if err := mvcc.ResolveWriteIntent(testKey2, &committed); err != nil {
+		t.Fatal(err)
+	}
+	if err := mvcc.GarbageCollect(KeyMin, KeyMax, makeTS(3, 0)); err != nil {
+		t.Fatal(err)
+	}
+	total.Add(mvcc.FlushStats())
+	var persisted MVCCStats
+	if ok, _, err := getI(mvcc.engine, statsKey, &persisted); !ok || err != nil || persisted != total {
+		t.Errorf("expected persisted stats %+v; got %+v, %v", total, persisted, err)
+	}
+	if computed, err := mvcc.ComputeStats(KeyMin, KeyMax); err != nil || computed != total {
+		t.Errorf("expected computed stats %+v; got %+v, %v", total, computed, err)
+	}
+}
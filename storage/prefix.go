@@ -218,7 +218,7 @@ func (p *prefixConfigMap) splitRangeByPrefixes(start, end Key) ([]*rangeResult,
 		return bytes.Compare(end, p.configs[i].Prefix) < 0
 	})
 
-	if startIdx >= len(p.configs) || endIdx > len(p.configs) {
+	if startIdx == 0 || endIdx > len(p.configs) {
 		return nil, util.Errorf("start and/or end keys (%q, %q) fall outside prefix range; "+
 			"was default prefix not added?", start, end)
 	}
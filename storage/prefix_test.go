@@ -259,6 +259,10 @@ func TestSplitRangeByPrefixes(t *testing.T) {
 		{Key("/db1/table3"), Key("/db1/table4"), []*rangeResult{
 			{Key("/db1/table3"), Key("/db1/table4"), config3},
 		}},
+		// A subrange following the last prefix.
+		{Key("/db5"), Key("/db6"), []*rangeResult{
+			{Key("/db5"), Key("/db6"), config1},
+		}},
 	}
 	for i, test := range testData {
 		results, err := pcc.splitRangeByPrefixes(test.start, test.end)
@@ -18,6 +18,8 @@
 
 package storage
 
+import "time"
+
 // A LogEntry provides serialization of a read/write command. Once
 // committed to the log, the command is executed and the result
 // returned via the done channel.
@@ -26,5 +28,9 @@ type LogEntry struct {
 	Args   interface{}
 	Reply  interface{}
 
-	done chan error // Used to signal waiting RPC handler
+	start    time.Time   // Time at which the command was submitted
+	proposed time.Time   // Time at which the command was proposed
+	done     chan error  // Used to signal waiting RPC handler
+	cmdKey   interface{} // Key of the command in the range's command queue
+	release  func()      // Releases the command's admission once applied
 }
@@ -0,0 +1,473 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strconv"
+	"sync"
+
+	"code.google.com/p/biogo.store/llrb"
+	"github.com/cockroachdb/cockroach/multiraft"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// Suffixes of the range-local raft keys of a range, following the
+// range's raft key prefix (see raftKeyPrefix()).
+var (
+	raftAppliedIndexSuffix = Key("applied-index")
+	raftHardStateSuffix    = Key("hard-state")
+	raftLastIndexSuffix    = Key("last-index")
+	raftLogSuffix          = Key("log-")
+)
+
+// raftKeyPrefix returns the prefix of all range-local raft keys of
+// the range with the specified ID. The range ID is encoded so that
+// the prefix of one range is never a prefix of another's.
+func raftKeyPrefix(rangeID int64) Key {
+	return MakeKey(keyLocalRaftPrefix, encodeBytes([]byte(strconv.FormatInt(rangeID, 16))))
+}
+
+// raftHardStateKey returns the key at which the election state of
+// the range's raft group is stored.
+func raftHardStateKey(rangeID int64) Key {
+	return MakeKey(raftKeyPrefix(rangeID), raftHardStateSuffix)
+}
+
+// raftAppliedIndexKey returns the key at which the index of the last
+// raft log entry applied to the range is stored.
+func raftAppliedIndexKey(rangeID int64) Key {
+	return MakeKey(raftKeyPrefix(rangeID), raftAppliedIndexSuffix)
+}
+
+// raftLastIndexKey returns the key at which the index of the last
+// entry in the range's raft log is stored.
+func raftLastIndexKey(rangeID int64) Key {
+	return MakeKey(raftKeyPrefix(rangeID), raftLastIndexSuffix)
+}
+
+// raftLogPrefix returns the prefix of the range's raft log entries.
+func raftLogPrefix(rangeID int64) Key {
+	return MakeKey(raftKeyPrefix(rangeID), raftLogSuffix)
+}
+
+// raftLogKey returns the key of the range's raft log entry at index.
+// Entries sort by index.
+func raftLogKey(rangeID int64, index int) Key {
+	return encodeUint64(raftLogPrefix(rangeID), uint64(index))
+}
+
+// raftKeys returns all raft keys of the range with the specified ID.
+func raftKeys(engine Engine, rangeID int64) ([]Key, error) {
+	prefix := raftKeyPrefix(rangeID)
+	kvs, err := engine.scan(prefix, PrefixEndKey(prefix), 0)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]Key, len(kvs))
+	for i, kv := range kvs {
+		keys[i] = kv.Key
+	}
+	return keys, nil
+}
+
+// A raftStorage implements multiraft.Storage using the store's
+// engines. Raft groups are identified by range ID, and each group's
+// state is stored at the range-local raft keys of its range, so that
+// it's removed along with the range's data. Range metadata and
+// applied indexes are stored in engine, so that the applied index
+// stays consistent with the range's data, and the remaining raft
+// state is stored in logEngine, which is the same engine unless the
+// store's raft logs are placed on a separate device (see
+// Store.SetRaftEngine). Log indexes are 1-based; an empty log has a
+// last index of zero. Recently appended and read log entries are
+// cached, so that entries are usually applied and sent to followers
+// without being read back from the log engine.
+type raftStorage struct {
+	engine    Engine
+	logEngine Engine
+	mu        sync.Mutex         // Protects entries
+	entries   *util.OrderedCache // Log entries by raftEntryCacheKey
+}
+
+// Verifying implementation of multiraft.Storage interface.
+var _ multiraft.Storage = (*raftStorage)(nil)
+
+// raftEntryCacheSize is the maximum total size in bytes of the
+// payloads of the log entries cached by a raft storage.
+const raftEntryCacheSize = 4 << 20
+
+// raftEntryCacheMetrics counts the hits and misses of the log entry
+// caches of all raft storages.
+var raftEntryCacheMetrics = util.NewCacheMetrics("raft_entry_cache")
+
+// A raftEntryCacheKey is the key of a cached raft log entry. Keys
+// sort by group, then by index.
+type raftEntryCacheKey struct {
+	groupID multiraft.GroupID
+	index   int
+}
+
+// Compare implements the llrb.Comparable interface.
+func (k raftEntryCacheKey) Compare(b llrb.Comparable) int {
+	o := b.(raftEntryCacheKey)
+	switch {
+	case k.groupID != o.groupID:
+		if k.groupID < o.groupID {
+			return -1
+		}
+		return 1
+	case k.index != o.index:
+		if k.index < o.index {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// newRaftStorage returns a raft storage loading groups from the range
+// metadata in engine and storing their raft state in logEngine.
+func newRaftStorage(engine, logEngine Engine) *raftStorage {
+	return &raftStorage{
+		engine:    engine,
+		logEngine: logEngine,
+		entries: util.NewOrderedCache(util.CacheConfig{
+			MaxBytes: raftEntryCacheSize,
+			Size: func(key, value interface{}) int64 {
+				return int64(len(value.(multiraft.LogEntry).Payload))
+			},
+			Metrics: raftEntryCacheMetrics,
+		}),
+	}
+}
+
+// cacheEntries adds the log entries of the group to the entry cache.
+func (rs *raftStorage) cacheEntries(groupID multiraft.GroupID, entries []*multiraft.LogEntry) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, entry := range entries {
+		rs.entries.Add(raftEntryCacheKey{groupID, entry.Index}, *entry)
+	}
+}
+
+// cachedEntry returns the cached log entry of the group at index.
+func (rs *raftStorage) cachedEntry(groupID multiraft.GroupID, index int) (multiraft.LogEntry, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if value, ok := rs.entries.Get(raftEntryCacheKey{groupID, index}); ok {
+		return value.(multiraft.LogEntry), true
+	}
+	return multiraft.LogEntry{}, false
+}
+
+// uncacheEntries removes the cached log entries of the group after
+// lastIndex.
+func (rs *raftStorage) uncacheEntries(groupID multiraft.GroupID, lastIndex int) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	var keys []interface{}
+	rs.entries.DoRange(func(e *util.CacheEntry) bool {
+		keys = append(keys, e.Key)
+		return false
+	}, raftEntryCacheKey{groupID, lastIndex + 1}, raftEntryCacheKey{groupID + 1, 0})
+	for _, key := range keys {
+		rs.entries.Del(key)
+	}
+}
+
+// LoadGroups implements the multiraft.Storage interface. A group is
+// loaded for each range with metadata stored in the engine.
+func (rs *raftStorage) LoadGroups() <-chan *multiraft.GroupPersistentState {
+	ch := make(chan *multiraft.GroupPersistentState)
+	go func() {
+		defer close(ch)
+		metas, err := loadRangeMetadata(rs.engine)
+		if err != nil {
+			log.New("storage").Errorf("unable to load range metadata: %v", err)
+			return
+		}
+		for _, meta := range metas {
+			state, err := rs.loadGroup(meta)
+			if err != nil {
+				log.New("storage").With(log.RangeID, meta.RangeID).Errorf("unable to load raft state: %v", err)
+				continue
+			}
+			ch <- state
+		}
+	}()
+	return ch
+}
+
+// loadGroup returns the persistent state of the range's raft group.
+func (rs *raftStorage) loadGroup(meta RangeMetadata) (*multiraft.GroupPersistentState, error) {
+	state := &multiraft.GroupPersistentState{GroupID: multiraft.GroupID(meta.RangeID)}
+	if _, _, err := getI(rs.logEngine, raftHardStateKey(meta.RangeID), &state.ElectionState); err != nil {
+		return nil, err
+	}
+	for _, replica := range meta.Replicas.Replicas {
+		state.Members.Members = append(state.Members.Members, multiraft.NodeID(replica.NodeID))
+	}
+	lastIndex, err := rs.lastIndex(meta.RangeID)
+	if err != nil {
+		return nil, err
+	}
+	if lastIndex > 0 {
+		entry, err := rs.GetLogEntry(state.GroupID, lastIndex)
+		if err != nil {
+			return nil, err
+		}
+		state.LastLogIndex, state.LastLogTerm = lastIndex, entry.Term
+	}
+	return state, nil
+}
+
+// lastIndex returns the index of the last entry in the range's raft
+// log, or zero if the log is empty.
+func (rs *raftStorage) lastIndex(rangeID int64) (int, error) {
+	var lastIndex int
+	if _, _, err := getI(rs.logEngine, raftLastIndexKey(rangeID), &lastIndex); err != nil {
+		return 0, err
+	}
+	return lastIndex, nil
+}
+
+// SetGroupElectionState implements the multiraft.Storage interface.
+func (rs *raftStorage) SetGroupElectionState(groupID multiraft.GroupID, electionState *multiraft.GroupElectionState) error {
+	return putI(rs.logEngine, raftHardStateKey(int64(groupID)), electionState)
+}
+
+// AppendLogEntries implements the multiraft.Storage interface. The
+// entries and the updated last index are written atomically.
+func (rs *raftStorage) AppendLogEntries(groupID multiraft.GroupID, entries []*multiraft.LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	rangeID := int64(groupID)
+	lastIndex, err := rs.lastIndex(rangeID)
+	if err != nil {
+		return err
+	}
+	wb := newBatch()
+	defer wb.release()
+	for i, entry := range entries {
+		if expectedIndex := lastIndex + 1 + i; expectedIndex != entry.Index {
+			return util.Errorf("log index mismatch: expected %d but was %d", expectedIndex, entry.Index)
+		}
+		kv, err := encodeI(raftLogKey(rangeID, entry.Index), entry)
+		if err != nil {
+			return err
+		}
+		wb.put(kv.Key, kv.Value)
+	}
+	kv, err := encodeI(raftLastIndexKey(rangeID), entries[len(entries)-1].Index)
+	if err != nil {
+		return err
+	}
+	wb.put(kv.Key, kv.Value)
+	if err := wb.commit(rs.logEngine); err != nil {
+		return err
+	}
+	// Cached entries beyond the persisted last index are stale, e.g.
+	// those of a log removed along with its range's replica.
+	rs.uncacheEntries(groupID, lastIndex)
+	rs.cacheEntries(groupID, entries)
+	return nil
+}
+
+// TruncateLog implements the multiraft.Storage interface. The entries
+// are deleted and the last index updated atomically.
+func (rs *raftStorage) TruncateLog(groupID multiraft.GroupID, lastIndex int) error {
+	rangeID := int64(groupID)
+	kvs, err := rs.logEngine.scan(raftLogKey(rangeID, lastIndex+1), PrefixEndKey(raftLogPrefix(rangeID)), 0)
+	if err != nil {
+		return err
+	}
+	wb := newBatch()
+	defer wb.release()
+	for _, kv := range kvs {
+		wb.del(kv.Key)
+	}
+	lastKV, err := encodeI(raftLastIndexKey(rangeID), lastIndex)
+	if err != nil {
+		return err
+	}
+	wb.put(lastKV.Key, lastKV.Value)
+	if err := wb.commit(rs.logEngine); err != nil {
+		return err
+	}
+	rs.uncacheEntries(groupID, lastIndex)
+	return nil
+}
+
+// GetLogEntry implements the multiraft.Storage interface.
+func (rs *raftStorage) GetLogEntry(groupID multiraft.GroupID, index int) (*multiraft.LogEntry, error) {
+	if entry, ok := rs.cachedEntry(groupID, index); ok {
+		return &entry, nil
+	}
+	entry := &multiraft.LogEntry{}
+	ok, _, err := getI(rs.logEngine, raftLogKey(int64(groupID), index), entry)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, util.Errorf("raft log entry %d of group %d not found", index, groupID)
+	}
+	rs.cacheEntries(groupID, []*multiraft.LogEntry{entry})
+	return entry, nil
+}
+
+// GetLogEntries implements the multiraft.Storage interface. The
+// entries are read from the log engine unless all are cached.
+func (rs *raftStorage) GetLogEntries(groupID multiraft.GroupID, firstIndex, lastIndex int,
+	ch chan<- *multiraft.LogEntryState) {
+	defer close(ch)
+	var cached []multiraft.LogEntry
+	for index := firstIndex; index <= lastIndex; index++ {
+		entry, ok := rs.cachedEntry(groupID, index)
+		if !ok {
+			break
+		}
+		cached = append(cached, entry)
+	}
+	if len(cached) == lastIndex-firstIndex+1 {
+		for i, entry := range cached {
+			ch <- &multiraft.LogEntryState{Index: firstIndex + i, Entry: entry}
+		}
+		return
+	}
+	rangeID := int64(groupID)
+	kvs, err := rs.logEngine.scan(raftLogKey(rangeID, firstIndex), raftLogKey(rangeID, lastIndex+1), 0)
+	if err == nil && len(kvs) != lastIndex-firstIndex+1 {
+		err = util.Errorf("raft log entries [%d, %d] of group %d not found", firstIndex, lastIndex, groupID)
+	}
+	if err != nil {
+		ch <- &multiraft.LogEntryState{Error: err}
+		return
+	}
+	for i, kv := range kvs {
+		state := &multiraft.LogEntryState{Index: firstIndex + i}
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value.Bytes)).Decode(&state.Entry); err != nil {
+			ch <- &multiraft.LogEntryState{Error: err}
+			return
+		}
+		entry := state.Entry
+		rs.cacheEntries(groupID, []*multiraft.LogEntry{&entry})
+		ch <- state
+	}
+}
+
+// appliedIndex returns the index of the last raft log entry applied
+// to the range, or zero if none has been applied.
+func (rs *raftStorage) appliedIndex(rangeID int64) (int, error) {
+	var appliedIndex int
+	if _, _, err := getI(rs.engine, raftAppliedIndexKey(rangeID), &appliedIndex); err != nil {
+		return 0, err
+	}
+	return appliedIndex, nil
+}
+
+// setAppliedIndex records index as the last raft log entry applied to
+// the range.
+func (rs *raftStorage) setAppliedIndex(rangeID int64, index int) error {
+	return putI(rs.engine, raftAppliedIndexKey(rangeID), index)
+}
+
+// MaxRaftLogWindow is the maximum number of entries in a window of a
+// range's raft log returned by Store.RaftLog.
+const MaxRaftLogWindow = 1000
+
+// A RaftLogEntryInfo describes an entry of a range's raft log without
+// its payload.
+type RaftLogEntryInfo struct {
+	Index       int
+	Term        int
+	Type        multiraft.LogEntryType
+	PayloadSize int
+}
+
+// A RaftLogWindow describes the entries of a range's raft log within
+// an index range, and the range's persisted raft state, as seen by one
+// replica. Comparing the windows of a range's replicas shows where
+// their logs diverge.
+type RaftLogWindow struct {
+	RangeID       int64
+	ElectionState multiraft.GroupElectionState
+	FirstIndex    int // First index of the window
+	LastIndex     int // Index of the last entry in the log
+	AppliedIndex  int // Index of the last entry applied to the range
+	Entries       []RaftLogEntryInfo
+}
+
+// RaftLog returns the window [first, last] of the raft log of the
+// range with ID rangeID, which must be on the store. A last of zero
+// selects the log's last index and a first of zero the window of
+// MaxRaftLogWindow entries ending at last. Entries which have been
+// truncated from the log are omitted. Returns an error if the window
+// is larger than MaxRaftLogWindow.
+func (s *Store) RaftLog(rangeID int64, first, last int) (*RaftLogWindow, error) {
+	if _, err := s.GetRange(rangeID); err != nil {
+		return nil, err
+	}
+	rs := newRaftStorage(s.engine, s.raftEngine)
+	window := &RaftLogWindow{RangeID: rangeID}
+	var err error
+	if _, _, err = getI(s.raftEngine, raftHardStateKey(rangeID), &window.ElectionState); err != nil {
+		return nil, err
+	}
+	if window.LastIndex, err = rs.lastIndex(rangeID); err != nil {
+		return nil, err
+	}
+	if window.AppliedIndex, err = rs.appliedIndex(rangeID); err != nil {
+		return nil, err
+	}
+	if last == 0 {
+		last = window.LastIndex
+	}
+	if first == 0 {
+		if first = last - MaxRaftLogWindow + 1; first < 1 {
+			first = 1
+		}
+	}
+	if last-first+1 > MaxRaftLogWindow {
+		return nil, util.Errorf("raft log window [%d, %d] exceeds %d entries", first, last, MaxRaftLogWindow)
+	}
+	if last > window.LastIndex {
+		last = window.LastIndex
+	}
+	window.FirstIndex = first
+	if first > last {
+		return window, nil
+	}
+	kvs, err := s.raftEngine.scan(raftLogKey(rangeID, first), raftLogKey(rangeID, last+1), 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range kvs {
+		var entry multiraft.LogEntry
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value.Bytes)).Decode(&entry); err != nil {
+			return nil, util.Errorf("unable to decode raft log entry at %q: %v", kv.Key, err)
+		}
+		window.Entries = append(window.Entries, RaftLogEntryInfo{
+			Index:       entry.Index,
+			Term:        entry.Term,
+			Type:        entry.Type,
+			PayloadSize: len(entry.Payload),
+		})
+	}
+	return window, nil
+}
@@ -0,0 +1,519 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/multiraft"
+)
+
+// TestRaftKeyPrefixes verifies that the raft keys of a range are
+// contiguous and don't interleave with those of other ranges.
+func TestRaftKeyPrefixes(t *testing.T) {
+	prefix := raftKeyPrefix(1)
+	end := PrefixEndKey(prefix)
+	for _, key := range []Key{raftHardStateKey(1), raftAppliedIndexKey(1), raftLastIndexKey(1), raftLogKey(1, 0), raftLogKey(1, 1<<40)} {
+		if bytes.Compare(key, prefix) < 0 || bytes.Compare(key, end) >= 0 {
+			t.Errorf("expected key %q to have prefix %q", key, prefix)
+		}
+	}
+	if bytes.HasPrefix(raftKeyPrefix(16), prefix) {
+		t.Errorf("expected raft key prefixes of ranges 1 and 16 to be distinct")
+	}
+	if bytes.Compare(raftLogKey(1, 255), raftLogKey(1, 256)) >= 0 {
+		t.Errorf("expected raft log keys to sort by index")
+	}
+}
+
+// TestRaftStorageLog verifies appending, reading and truncating a
+// group's log.
+func TestRaftStorageLog(t *testing.T) {
+	engine := NewInMem(Attributes{}, 1<<20)
+	rs := newRaftStorage(engine, engine)
+	groupID := multiraft.GroupID(1)
+	var entries []*multiraft.LogEntry
+	for i := 1; i <= 5; i++ {
+		entries = append(entries, &multiraft.LogEntry{Term: 1 + i/3, Index: i, Payload: []byte{byte(i)}})
+	}
+	if err := rs.AppendLogEntries(groupID, entries[1:2]); err == nil {
+		t.Error("expected error appending entry at non-contiguous index")
+	}
+	if err := rs.AppendLogEntries(groupID, entries[:3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.AppendLogEntries(groupID, entries[3:]); err != nil {
+		t.Fatal(err)
+	}
+	// Entries of another group are kept separate.
+	if err := rs.AppendLogEntries(multiraft.GroupID(16), entries[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := rs.GetLogEntry(groupID, 4)
+	if err != nil || !reflect.DeepEqual(entry, entries[3]) {
+		t.Errorf("expected entry %+v; got %+v, %v", entries[3], entry, err)
+	}
+	ch := make(chan *multiraft.LogEntryState, 10)
+	rs.GetLogEntries(groupID, 2, 4, ch)
+	index := 2
+	for state := range ch {
+		if state.Error != nil || state.Index != index || !reflect.DeepEqual(&state.Entry, entries[index-1]) {
+			t.Errorf("expected entry %+v at index %d; got %+v", entries[index-1], index, state)
+		}
+		index++
+	}
+	if index != 5 {
+		t.Errorf("expected entries 2 through 4; got through %d", index-1)
+	}
+
+	if err := rs.TruncateLog(groupID, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.GetLogEntry(groupID, 3); err == nil {
+		t.Error("expected truncated entry to be removed")
+	}
+	ch = make(chan *multiraft.LogEntryState, 10)
+	rs.GetLogEntries(groupID, 2, 3, ch)
+	if state := <-ch; state.Error == nil {
+		t.Error("expected error reading truncated entries")
+	}
+	if err := rs.AppendLogEntries(groupID, entries[2:3]); err != nil {
+		t.Errorf("expected append after truncated index to succeed: %v", err)
+	}
+	if lastIndex, err := rs.lastIndex(16); err != nil || lastIndex != 1 {
+		t.Errorf("expected other group's last index to be 1; got %d, %v", lastIndex, err)
+	}
+}
+
+// TestRaftStorageLogRandom verifies that randomly generated log
+// entries survive a round trip through the persisted log, and that
+// reading entries whose persisted encoding has been corrupted returns
+// errors rather than panicking.
+func TestRaftStorageLogRandom(t *testing.T) {
+	r := newFuzzRand(t)
+	engine := NewInMem(Attributes{}, 1<<24)
+	rs := newRaftStorage(engine, engine)
+	groupID := multiraft.GroupID(1)
+	var entries []*multiraft.LogEntry
+	for i := 1; i <= 100; i++ {
+		entries = append(entries, &multiraft.LogEntry{
+			Term:    r.Int(),
+			Index:   i,
+			Type:    multiraft.LogEntryType(r.Intn(256) - 128),
+			Payload: append([]byte{byte(i)}, randFuzzBytes(r, 100)...),
+		})
+	}
+	if err := rs.AppendLogEntries(groupID, entries); err != nil {
+		t.Fatal(err)
+	}
+	for _, expEntry := range entries {
+		entry, err := rs.GetLogEntry(groupID, expEntry.Index)
+		if err != nil || !reflect.DeepEqual(entry, expEntry) {
+			t.Fatalf("expected entry %+v; got %+v, %v", expEntry, entry, err)
+		}
+	}
+
+	// A new raft storage, whose entry cache is empty, decodes the
+	// corrupted entries.
+	rs = newRaftStorage(engine, engine)
+	for _, entry := range entries {
+		key := raftLogKey(int64(groupID), entry.Index)
+		val, err := engine.get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		corrupt := append([]byte(nil), val.Bytes...)
+		switch r.Intn(3) {
+		case 0:
+			corrupt = corrupt[:r.Intn(len(corrupt))]
+		case 1:
+			corrupt[r.Intn(len(corrupt))] = byte(r.Intn(256))
+		default:
+			corrupt = randFuzzBytes(r, 100)
+		}
+		if len(corrupt) == 0 {
+			corrupt = []byte{0}
+		}
+		if err := engine.put(key, Value{Bytes: corrupt}); err != nil {
+			t.Fatal(err)
+		}
+		// The result is unimportant; decoding must simply not panic.
+		rs.GetLogEntry(groupID, entry.Index)
+	}
+	ch := make(chan *multiraft.LogEntryState, len(entries))
+	rs.GetLogEntries(groupID, 1, len(entries), ch)
+	for _ = range ch {
+	}
+}
+
+// TestRaftStorageEntryCache verifies that appended log entries are
+// read from the entry cache and that truncated entries are removed
+// from it.
+func TestRaftStorageEntryCache(t *testing.T) {
+	engine := NewInMem(Attributes{}, 1<<20)
+	rs := newRaftStorage(engine, engine)
+	groupID := multiraft.GroupID(1)
+	var entries []*multiraft.LogEntry
+	for i := 1; i <= 3; i++ {
+		entries = append(entries, &multiraft.LogEntry{Term: 1, Index: i, Payload: []byte{byte(i)}})
+	}
+	if err := rs.AppendLogEntries(groupID, entries); err != nil {
+		t.Fatal(err)
+	}
+	// Remove the persisted entries; they're still served from the cache.
+	for _, entry := range entries {
+		if err := engine.del(raftLogKey(int64(groupID), entry.Index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hits := raftEntryCacheMetrics.Hits.Count()
+	ch := make(chan *multiraft.LogEntryState, 10)
+	rs.GetLogEntries(groupID, 1, 3, ch)
+	for state := range ch {
+		if state.Error != nil || !reflect.DeepEqual(&state.Entry, entries[state.Index-1]) {
+			t.Errorf("expected cached entry %+v; got %+v", entries[state.Index-1], state)
+		}
+	}
+	if n := raftEntryCacheMetrics.Hits.Count() - hits; n != 3 {
+		t.Errorf("expected 3 cache hits; got %d", n)
+	}
+	if _, err := newRaftStorage(engine, engine).GetLogEntry(groupID, 1); err == nil {
+		t.Error("expected error reading removed entry without cache")
+	}
+
+	if err := rs.TruncateLog(groupID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.GetLogEntry(groupID, 1); err != nil {
+		t.Errorf("expected entry 1 to remain cached: %v", err)
+	}
+	if _, err := rs.GetLogEntry(groupID, 2); err == nil {
+		t.Error("expected truncated entry to be removed from cache")
+	}
+}
+
+// TestRaftStorageLoadGroups verifies that a group is loaded for each
+// range in the engine with its persisted raft state.
+func TestRaftStorageLoadGroups(t *testing.T) {
+	engine := NewInMem(Attributes{}, 1<<20)
+	meta := RangeMetadata{
+		RangeID:  1,
+		StartKey: KeyMin,
+		EndKey:   KeyMax,
+		Replicas: RangeDescriptor{Replicas: []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}, {NodeID: 2, StoreID: 2, RangeID: 1}}},
+	}
+	if err := putI(engine, rangeKey(meta.RangeID), meta); err != nil {
+		t.Fatal(err)
+	}
+	rs := newRaftStorage(engine, engine)
+	electionState := &multiraft.GroupElectionState{CurrentTerm: 3, VotedFor: 2}
+	if err := rs.SetGroupElectionState(1, electionState); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.AppendLogEntries(1, []*multiraft.LogEntry{{Term: 2, Index: 1}, {Term: 3, Index: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.setAppliedIndex(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if appliedIndex, err := rs.appliedIndex(1); err != nil || appliedIndex != 1 {
+		t.Errorf("expected applied index 1; got %d, %v", appliedIndex, err)
+	}
+
+	var states []*multiraft.GroupPersistentState
+	for state := range rs.LoadGroups() {
+		states = append(states, state)
+	}
+	expState := &multiraft.GroupPersistentState{
+		GroupID:       1,
+		ElectionState: *electionState,
+		Members:       multiraft.GroupMembers{Members: []multiraft.NodeID{1, 2}},
+		LastLogIndex:  2,
+		LastLogTerm:   3,
+	}
+	if len(states) != 1 || !reflect.DeepEqual(states[0], expState) {
+		t.Errorf("expected group state %+v; got %+v", expState, states)
+	}
+}
+
+// TestDestroyRangeRemovesRaftState verifies that destroying a range
+// removes its raft state along with its data.
+func TestDestroyRangeRemovesRaftState(t *testing.T) {
+	store := createTestStore(1, 1, t)
+	defer store.Close()
+	if _, err := store.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	rs := newRaftStorage(store.engine, store.engine)
+	if err := rs.AppendLogEntries(1, []*multiraft.LogEntry{{Term: 1, Index: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.setAppliedIndex(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DestroyRange(1); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := raftKeys(store.engine, 1); err != nil || len(keys) != 0 {
+		t.Errorf("expected raft state to be removed; got %q, %v", keys, err)
+	}
+}
+
+// TestStoreRaftEngine verifies that a store with a separate raft
+// engine keeps the raft state of its ranges other than their applied
+// indexes there, loads their groups from it and removes the state
+// from both engines when destroying a range.
+func TestStoreRaftEngine(t *testing.T) {
+	store := createTestStore(1, 1, t)
+	defer store.Close()
+	raftEngine := NewInMem(Attributes{}, 1<<20)
+	store.SetRaftEngine(raftEngine)
+	if _, err := store.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	rs := store.RaftStorage()
+	if err := rs.AppendLogEntries(1, []*multiraft.LogEntry{{Term: 1, Index: 1}, {Term: 2, Index: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := raftKeys(store.engine, 1); err != nil || len(keys) != 0 {
+		t.Errorf("expected no raft state in the store's engine; got %q, %v", keys, err)
+	}
+	if keys, err := raftKeys(raftEngine, 1); err != nil || len(keys) != 3 {
+		t.Errorf("expected 2 log entries and last index in the raft engine; got %q, %v", keys, err)
+	}
+	if err := newRaftStorage(store.engine, raftEngine).setAppliedIndex(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := raftKeys(store.engine, 1); err != nil || len(keys) != 1 {
+		t.Errorf("expected applied index in the store's engine; got %q, %v", keys, err)
+	}
+	var states []*multiraft.GroupPersistentState
+	for state := range rs.LoadGroups() {
+		states = append(states, state)
+	}
+	if len(states) != 1 || states[0].LastLogIndex != 2 || states[0].LastLogTerm != 2 {
+		t.Errorf("expected group 1 with last index 2 at term 2; got %+v", states)
+	}
+	if window, err := store.RaftLog(1, 0, 0); err != nil || len(window.Entries) != 2 || window.AppliedIndex != 2 {
+		t.Errorf("expected 2 entries applied in raft log window; got %+v, %v", window, err)
+	}
+
+	if err := store.DestroyRange(1); err != nil {
+		t.Fatal(err)
+	}
+	for _, engine := range []Engine{store.engine, raftEngine} {
+		if keys, err := raftKeys(engine, 1); err != nil || len(keys) != 0 {
+			t.Errorf("expected raft state to be removed; got %q, %v", keys, err)
+		}
+	}
+}
+
+// TestStoreRaftLog verifies the windows of a range's raft log
+// returned by Store.RaftLog.
+func TestStoreRaftLog(t *testing.T) {
+	store := createTestStore(1, 1, t)
+	defer store.Close()
+	if _, err := store.RaftLog(1, 0, 0); err == nil {
+		t.Error("expected error for range not on store")
+	}
+	if _, err := store.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	rs := newRaftStorage(store.engine, store.engine)
+	var entries []*multiraft.LogEntry
+	for i := 1; i <= 5; i++ {
+		entries = append(entries, &multiraft.LogEntry{Term: (i + 1) / 2, Index: i, Payload: make([]byte, i)})
+	}
+	if err := rs.AppendLogEntries(1, entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.setAppliedIndex(1, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.SetGroupElectionState(1, &multiraft.GroupElectionState{CurrentTerm: 3, VotedFor: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		first, last int
+		expFirst    int
+		expIndexes  []int
+		expectErr   bool
+	}{
+		{0, 0, 1, []int{1, 2, 3, 4, 5}, false},
+		{2, 4, 2, []int{2, 3, 4}, false},
+		{0, 2, 1, []int{1, 2}, false},
+		{4, 10, 4, []int{4, 5}, false},
+		{6, 0, 6, nil, false},
+		{1, MaxRaftLogWindow + 1, 0, nil, true},
+	}
+	for i, test := range testCases {
+		window, err := store.RaftLog(1, test.first, test.last)
+		if err != nil {
+			if !test.expectErr {
+				t.Errorf("%d: unexpected error: %v", i, err)
+			}
+			continue
+		} else if test.expectErr {
+			t.Errorf("%d: expected error", i)
+			continue
+		}
+		if window.FirstIndex != test.expFirst || window.LastIndex != 5 || window.AppliedIndex != 3 ||
+			window.ElectionState.CurrentTerm != 3 {
+			t.Errorf("%d: unexpected window %+v", i, window)
+		}
+		var indexes []int
+		for _, e := range window.Entries {
+			if e.Term != (e.Index+1)/2 || e.PayloadSize != e.Index || e.Type != multiraft.LogEntryCommand {
+				t.Errorf("%d: unexpected entry %+v", i, e)
+			}
+			indexes = append(indexes, e.Index)
+		}
+		if !reflect.DeepEqual(indexes, test.expIndexes) {
+			t.Errorf("%d: expected indexes %v; got %v", i, test.expIndexes, indexes)
+		}
+	}
+}
+
+// benchmarkRaftStorageCommands submits b.N commands of payloadSize bytes,
+// spread round-robin across numGroups groups replicated on numNodes
+// MultiRaft nodes, each of which persists its raft state with a
+// raftStorage over an in-memory engine. Commands are pipelined across
+// groups but not within a group, as in the multiraft benchmarks.
+// Reports committed commands per second and the mean latency from
+// submission to commit on the leader.
+func benchmarkRaftStorageCommands(b *testing.B, numNodes, numGroups, payloadSize int) {
+	transport := multiraft.NewLocalRPCTransport()
+	var nodes []*multiraft.MultiRaft
+	var memberIDs []multiraft.NodeID
+	leaderClock := multiraft.NewManualClock()
+	for i := 0; i < numNodes; i++ {
+		clock := leaderClock
+		if i > 0 {
+			clock = multiraft.NewManualClock()
+		}
+		engine := NewInMem(Attributes{}, 1<<30)
+		mr, err := multiraft.NewMultiRaft(multiraft.NodeID(i+1), &multiraft.Config{
+			Transport:          transport,
+			Storage:            newRaftStorage(engine, engine),
+			Clock:              clock,
+			ElectionTimeoutMin: 10 * time.Millisecond,
+			ElectionTimeoutMax: 20 * time.Millisecond,
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		nodes = append(nodes, mr)
+		memberIDs = append(memberIDs, multiraft.NodeID(i+1))
+	}
+	for _, mr := range nodes {
+		mr.Start()
+		defer mr.Stop()
+	}
+	for i := 1; i <= numGroups; i++ {
+		for _, mr := range nodes {
+			if err := mr.CreateGroup(multiraft.GroupID(i), memberIDs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	// Each trigger of the leader's election timer starts an election in
+	// the group with the earliest deadline.
+	for i := 0; i < numGroups; i++ {
+		leaderClock.TriggerElection()
+		for {
+			if _, ok := (<-nodes[0].Events).(*multiraft.EventLeaderElection); ok {
+				break
+			}
+		}
+	}
+
+	// Followers' events must be consumed to keep their queues from
+	// filling up.
+	done := make(chan struct{})
+	defer close(done)
+	for _, mr := range nodes[1:] {
+		go func(mr *multiraft.MultiRaft) {
+			for {
+				select {
+				case <-mr.Events:
+				case <-done:
+					return
+				}
+			}
+		}(mr)
+	}
+
+	starts := make([]time.Time, b.N)
+	inFlight := make([]chan struct{}, numGroups)
+	for i := range inFlight {
+		inFlight[i] = make(chan struct{}, 1)
+	}
+	committed := make(chan time.Duration)
+	go func() {
+		var latency time.Duration
+		for i := 0; i < b.N; {
+			commit, ok := (<-nodes[0].Events).(*multiraft.EventCommandCommitted)
+			if !ok {
+				continue
+			}
+			seq := binary.BigEndian.Uint64(commit.Command)
+			latency += time.Since(starts[seq])
+			<-inFlight[seq%uint64(numGroups)]
+			i++
+		}
+		committed <- latency
+	}()
+
+	b.SetBytes(int64(payloadSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		inFlight[i%numGroups] <- struct{}{}
+		command := make([]byte, payloadSize)
+		binary.BigEndian.PutUint64(command, uint64(i))
+		starts[i] = time.Now()
+		go func(ack <-chan error) {
+			if err := <-ack; err != nil {
+				b.Error(err)
+			}
+		}(nodes[0].SubmitCommand(multiraft.GroupID(i%numGroups+1), command))
+	}
+	latency := <-committed
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "cmds/s")
+	b.ReportMetric(float64(latency.Nanoseconds())/float64(b.N), "ns/commit")
+}
+
+func BenchmarkRaftStorageCommand3Nodes1Group64B(b *testing.B) {
+	benchmarkRaftStorageCommands(b, 3, 1, 64)
+}
+
+func BenchmarkRaftStorageCommand3Nodes10Groups64B(b *testing.B) {
+	benchmarkRaftStorageCommands(b, 3, 10, 64)
+}
+
+func BenchmarkRaftStorageCommand3Nodes1Group1K(b *testing.B) {
+	benchmarkRaftStorageCommands(b, 3, 1, 1<<10)
+}
+
+func BenchmarkRaftStorageCommand5Nodes10Groups64B(b *testing.B) {
+	benchmarkRaftStorageCommands(b, 5, 10, 64)
+}
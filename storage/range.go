@@ -20,22 +20,33 @@ package storage
 import (
 	"bytes"
 	"encoding/gob"
+	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/hlc"
 	"github.com/cockroachdb/cockroach/util"
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
-// init pre-registers RangeDescriptor and PrefixConfigMap types.
+// init pre-registers RangeDescriptor and PrefixConfigMap types. The
+// configs of a prefix config map are pointers, so their pointer types
+// are registered in order for gossiped maps to decode as pointers on
+// other nodes.
 func init() {
 	gob.Register(RangeDescriptor{})
 	gob.Register(StoreDescriptor{})
+	gob.Register(NodeLiveness{})
 	gob.Register([]*prefixConfig{})
-	gob.Register(AcctConfig{})
-	gob.Register(PermConfig{})
-	gob.Register(ZoneConfig{})
+	gob.Register(&AcctConfig{})
+	gob.Register(&PermConfig{})
+	gob.Register(StoreAcctUsage{})
+	gob.Register(&ZoneConfig{})
 }
 
 // ttlClusterIDGossip is time-to-live for cluster ID. The cluster ID
@@ -46,6 +57,33 @@ func init() {
 // the first range gossips it.
 const ttlClusterIDGossip = 30 * time.Second
 
+// ttlFirstRangeGossip is the time-to-live for the gossiped descriptor
+// of the first range. Nodes locate the first range, which holds the
+// "meta1" range addressing records, via gossip; the descriptor is
+// re-gossipped continually so that nodes with cold range caches can
+// always bootstrap range addressing, and expires so that a stale
+// descriptor isn't gossipped indefinitely once its replicas are gone.
+const ttlFirstRangeGossip = 2 * ttlClusterIDGossip
+
+// defaultGCTTL is the time for which historical versions are retained
+// if the zone config doesn't specify a GC TTL.
+const defaultGCTTL = 24 * time.Hour
+
+// Constants controlling the resolution of write intents encountered
+// by read-only commands. If the transaction owning an intent can't be
+// pushed, the read backs off and retries, up to a maximum number of
+// attempts, after which the conflict is returned to the client.
+const (
+	intentResolutionBackoff     = 10 * time.Millisecond
+	intentResolutionMaxBackoff  = 500 * time.Millisecond
+	intentResolutionMaxAttempts = 8
+)
+
+// leaderLeaseDuration is the duration of leader leases acquired by
+// the raft leader of a range. Leases are extended as needed by
+// subsequent commands.
+var leaderLeaseDuration = 1 * time.Second
+
 // configPrefixes describes administrative configuration maps
 // affecting ranges of the key-value map by key prefix.
 var configPrefixes = []struct {
@@ -59,6 +97,50 @@ var configPrefixes = []struct {
 	{KeyConfigZonePrefix, gossip.KeyConfigZone, ZoneConfig{}, true},
 }
 
+// readOnlyCmds lists the methods which don't modify the key-value
+// store and may be executed via Range.ReadOnlyCmd().
+var readOnlyCmds = map[string]struct{}{
+	"Contains":            struct{}{},
+	"Get":                 struct{}{},
+	"Scan":                struct{}{},
+	"ReverseScan":         struct{}{},
+	"InternalRangeLookup": struct{}{},
+}
+
+// IsReadOnly returns true if the method is read-only.
+func IsReadOnly(method string) bool {
+	_, ok := readOnlyCmds[method]
+	return ok
+}
+
+// A DB is the subset of the distributed key-value store client used
+// by ranges to interact with other ranges; for example, to push a
+// transaction whose record lives elsewhere. It's implemented by
+// kv.DB and defined here to avoid a circular dependency.
+type DB interface {
+	Put(args *PutRequest) <-chan *PutResponse
+	Scan(args *ScanRequest) <-chan *ScanResponse
+	Delete(args *DeleteRequest) <-chan *DeleteResponse
+	EndTransaction(args *EndTransactionRequest) <-chan *EndTransactionResponse
+	InternalPushTxn(args *InternalPushTxnRequest) <-chan *InternalPushTxnResponse
+	InternalResolveIntent(args *InternalResolveIntentRequest) <-chan *InternalResolveIntentResponse
+	InternalSnapshot(args *InternalSnapshotRequest) <-chan *InternalSnapshotResponse
+	InternalChecksum(args *InternalChecksumRequest) <-chan *InternalChecksumResponse
+}
+
+// A RangeManager is the subset of the store used by ranges to apply
+// the side effects of commit triggers which create or remove other
+// ranges. It's implemented by Store.
+type RangeManager interface {
+	NewRangeID() (int64, error)
+	GetRange(rangeID int64) (*Range, error)
+	LookupRange(startKey Key) *Range
+	AddRange(meta RangeMetadata) error
+	RemoveRange(rangeID int64) error
+	StoreIdent() StoreIdent
+	IsDraining() bool
+}
+
 // A RangeMetadata holds information about the range, including
 // range ID and start and end keys, and replicas slice.
 type RangeMetadata struct {
@@ -76,41 +158,175 @@ type RangeMetadata struct {
 // integrity by replacing failed replicas, splitting and merging
 // as appropriate.
 type Range struct {
-	Meta      RangeMetadata
-	engine    Engine         // The underlying key-value store
-	allocator *allocator     // Makes allocation decisions
-	gossip    *gossip.Gossip // Range may gossip based on contents
-	pending   chan *LogEntry // Not-yet-proposed log entries
-	closer    chan struct{}  // Channel for closing the range
+	Meta           RangeMetadata      // Modified only by commit triggers, under metaMu
+	metaMu         sync.RWMutex       // Protects Meta from concurrent commit triggers
+	clock          *hlc.HLClock       // Clock used to timestamp commands
+	engine         Engine             // The underlying key-value store
+	batch          *bufferedEngine    // Buffers each read-write command's writes to engine
+	mvcc           *MVCC              // Versioned access to the engine
+	db             DB                 // Used to push txns; may be nil
+	rm             RangeManager       // Applies split and merge triggers; may be nil
+	respCache      *ResponseCache     // Provides idempotence for retries
+	abortCache     *AbortCache        // Rejects requests of aborted transactions
+	allocator      *allocator         // Makes allocation decisions
+	gossip         *gossip.Gossip     // Range may gossip based on contents
+	pending        chan *LogEntry     // Not-yet-proposed log entries
+	cmdQ           *CommandQueue      // Enforces ordering of overlapping commands
+	cmdQMu         sync.Mutex         // Protects cmdQ
+	stopper        *util.Stopper      // Drains commands and stops the range's workers
+	throttle       *throttle          // Paces background work; nil if not on a store
+	admission      *admission         // Admits client requests; nil if not on a store
+	requestMemory  *util.MemoryBudget // Charged for rows read by scans; nil if not on a store
+	snapshotMemory *util.MemoryBudget // Charged for snapshots taken; nil if not on a store
+	changeFeed     *ChangeFeed        // Receives committed writes; nil if not on a store
+	statsMu        sync.Mutex         // Protects stats
+	stats          MVCCStats          // MVCC stats for the range's keys
+	splitting      int32              // Non-zero while a split is in progress; atomic
+	load           *loadSplitter      // Measures request load to select split keys
+	reads          int64              // Read requests served, for accounting; atomic
+	writes         int64              // Write requests served, for accounting; atomic
+	leaseMu        sync.Mutex         // Protects lease, closedTS and raftLeader
+	lease          LeaderLease        // The range's current leader lease
+	closedTS       hlc.HLTimestamp    // No writes are accepted at or below this timestamp
+	raftLeader     *Replica           // Last known raft leader; nil if unknown
 	// TODO(andybons): raft instance goes here.
 }
 
-// NewRange initializes the range starting at key.
-func NewRange(meta RangeMetadata, engine Engine, allocator *allocator, gossip *gossip.Gossip) *Range {
+// NewRange initializes the range starting at key. If db is nil,
+// write intents encountered by reads are returned as errors instead
+// of being resolved.
+func NewRange(meta RangeMetadata, clock *hlc.HLClock, engine Engine,
+	allocator *allocator, gossip *gossip.Gossip, db DB) *Range {
+	batch := newBufferedEngine(engine)
 	r := &Range{
-		Meta:      meta,
-		engine:    engine,
-		allocator: allocator,
-		gossip:    gossip,
-		pending:   make(chan *LogEntry, 100 /* TODO(spencer): what's correct value? */),
-		closer:    make(chan struct{}),
+		Meta:       meta,
+		clock:      clock,
+		engine:     batch,
+		batch:      batch,
+		mvcc:       NewMVCC(batch),
+		respCache:  NewResponseCache(meta.RangeID, batch),
+		abortCache: NewAbortCache(meta.RangeID, batch),
+		load:       newLoadSplitter(time.Now()),
+		db:         db,
+		allocator:  allocator,
+		gossip:     gossip,
+		pending:    make(chan *LogEntry, 100 /* TODO(spencer): what's correct value? */),
+		cmdQ:       NewCommandQueue(),
+		stopper:    util.NewStopper(),
 	}
 	return r
 }
 
-// Start begins gossiping and starts the pending log entry processing
-// loop in a goroutine.
+// rangeStatsKey returns the range-local key at which the MVCC stats
+// for the range with the specified ID are stored.
+func rangeStatsKey(rangeID int64) Key {
+	return MakeKey(keyLocalRangeStatsPrefix, Key(strconv.FormatInt(rangeID, 16)))
+}
+
+// rangeLeaderLeaseKey returns the range-local key at which the
+// leader lease for the range with the specified ID is stored.
+func rangeLeaderLeaseKey(rangeID int64) Key {
+	return MakeKey(keyLocalRangeLeaderLeasePrefix, Key(strconv.FormatInt(rangeID, 16)))
+}
+
+// Start loads the range's MVCC stats, leader lease and closed
+// timestamp, begins gossiping and publishing closed timestamps, and
+// starts the pending log entry processing loop in a worker of the
+// range's stopper.
 func (r *Range) Start() {
+	if err := r.loadStats(); err != nil {
+		r.logger().Errorf("unable to load stats: %v", err)
+	}
+	if _, _, err := getI(r.engine, rangeLeaderLeaseKey(r.Meta.RangeID), &r.lease); err != nil {
+		r.logger().Errorf("unable to load leader lease: %v", err)
+	}
+	if _, _, err := getI(r.engine, rangeClosedTimestampKey(r.Meta.RangeID), &r.closedTS); err != nil {
+		r.logger().Errorf("unable to load closed timestamp: %v", err)
+	}
+	if r.changeFeed != nil {
+		r.mvcc.RecordCommits()
+	}
 	r.maybeGossipClusterID()
 	r.maybeGossipFirstRange()
 	r.maybeGossipConfigs()
-	go r.processPending()
-	go r.startGossip()
+	r.stopper.RunWorker(r.processPending)
+	r.stopper.RunWorker(r.startGossip)
+	r.stopper.RunWorker(r.publishClosedTimestamps)
 }
 
-// Stop ends the log processing loop.
+// Stop rejects new read-write commands, waits for pending commands to
+// be executed and then ends the log processing loop.
 func (r *Range) Stop() {
-	close(r.closer)
+	r.stopper.Stop()
+}
+
+// loadStats reads the persisted MVCC stats for the range. If none
+// have been persisted, they're computed by scanning the range's data
+// and then persisted.
+func (r *Range) loadStats() error {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	ok, _, err := getI(r.engine, rangeStatsKey(r.Meta.RangeID), &r.stats)
+	if err != nil {
+		return err
+	} else if !ok {
+		return r.computeStatsLocked()
+	}
+	r.mvcc.PersistStats(rangeStatsKey(r.Meta.RangeID), r.stats)
+	return nil
+}
+
+// recomputeStats recomputes the range's MVCC stats by scanning its
+// data and persists them. This is necessary when the range's bounds
+// change.
+func (r *Range) recomputeStats() error {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	return r.computeStatsLocked()
+}
+
+// computeStatsLocked implements recomputeStats; r.statsMu must be
+// held.
+func (r *Range) computeStatsLocked() error {
+	ms, err := r.mvcc.ComputeStats(r.Meta.StartKey, r.Meta.EndKey)
+	if err != nil {
+		return err
+	}
+	// The recomputed stats include changes not yet flushed.
+	r.mvcc.FlushStats()
+	r.stats = ms
+	if err := putI(r.engine, rangeStatsKey(r.Meta.RangeID), r.stats); err != nil {
+		return err
+	}
+	r.mvcc.PersistStats(rangeStatsKey(r.Meta.RangeID), r.stats)
+	return nil
+}
+
+// updateStats applies changes to the MVCC stats accumulated by the
+// most recently executed command to the range's in-memory stats. The
+// stats were persisted along with the command's writes (see
+// MVCC.PersistStats).
+func (r *Range) updateStats() {
+	delta := r.mvcc.FlushStats()
+	if delta == (MVCCStats{}) {
+		return
+	}
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	r.stats.Add(delta)
+}
+
+// Stats returns the range's current MVCC stats.
+func (r *Range) Stats() MVCCStats {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	return r.stats
+}
+
+// ShouldSplit returns true if the total size of the range's data
+// exceeds maxBytes. A maxBytes of zero disables splitting.
+func (r *Range) ShouldSplit(maxBytes int64) bool {
+	return maxBytes > 0 && r.Stats().TotalBytes() > maxBytes
 }
 
 // IsFirstRange returns true if this is the first range.
@@ -119,9 +335,191 @@ func (r *Range) IsFirstRange() bool {
 }
 
 // IsLeader returns true if this range replica is the raft leader.
-// TODO(spencer): this is always true for now.
+// TODO(spencer): raft doesn't report the leader yet, so until
+// LeadershipChanged is called this is always true.
 func (r *Range) IsLeader() bool {
-	return true
+	r.leaseMu.Lock()
+	leader := r.raftLeader
+	r.leaseMu.Unlock()
+	if leader == nil || r.rm == nil {
+		return true
+	}
+	replica, ok := r.localReplica()
+	return ok && sameReplica(*leader, replica)
+}
+
+// LeadershipChanged records leader as the range's raft leader. If
+// this replica holds the leader lease and leader is another replica,
+// the lease is transferred to it, so that the new leader needn't wait
+// for the lease to expire before serving commands.
+func (r *Range) LeadershipChanged(leader Replica) error {
+	r.leaseMu.Lock()
+	r.raftLeader = &leader
+	r.leaseMu.Unlock()
+	if r.rm == nil {
+		return nil
+	}
+	if replica, ok := r.localReplica(); !ok || sameReplica(leader, replica) {
+		return nil
+	}
+	if !r.HasLeaderLease(r.clock.Now()) {
+		return nil
+	}
+	return r.TransferLeaderLease(leader)
+}
+
+// getMeta returns the range's metadata. It must be used to read the
+// metadata from outside the range's command processing loop, which
+// applies commit triggers.
+func (r *Range) getMeta() RangeMetadata {
+	r.metaMu.RLock()
+	defer r.metaMu.RUnlock()
+	return r.Meta
+}
+
+// setMeta sets the range's metadata.
+func (r *Range) setMeta(meta RangeMetadata) {
+	r.metaMu.Lock()
+	defer r.metaMu.Unlock()
+	r.Meta = meta
+}
+
+// getLease returns the range's current leader lease.
+func (r *Range) getLease() LeaderLease {
+	r.leaseMu.Lock()
+	defer r.leaseMu.Unlock()
+	return r.lease
+}
+
+// logger returns a logger with the range ID in context. If the range
+// belongs to a store, the node and store IDs are added as well.
+func (r *Range) logger() log.Logger {
+	l := log.New("storage")
+	if r.rm != nil {
+		ident := r.rm.StoreIdent()
+		l = l.With(log.NodeID, ident.NodeID).With(log.StoreID, ident.StoreID)
+	}
+	return l.With(log.RangeID, r.Meta.RangeID)
+}
+
+// localReplica returns the replica of the range which is located on
+// the range's store. Returns false if the store holds no replica of
+// the range, as is the case once the replica has been removed.
+func (r *Range) localReplica() (Replica, bool) {
+	ident := r.rm.StoreIdent()
+	for _, replica := range r.getMeta().Replicas.Replicas {
+		if replica.NodeID == ident.NodeID && replica.StoreID == ident.StoreID {
+			return replica, true
+		}
+	}
+	return Replica{}, false
+}
+
+// sameReplica returns true if the replicas are located on the same
+// store.
+func sameReplica(a, b Replica) bool {
+	return a.NodeID == b.NodeID && a.StoreID == b.StoreID
+}
+
+// HasLeaderLease returns true if this range replica holds the leader
+// lease and the lease is in effect at timestamp.
+func (r *Range) HasLeaderLease(timestamp hlc.HLTimestamp) bool {
+	if r.rm == nil {
+		return false
+	}
+	replica, ok := r.localReplica()
+	lease := r.getLease()
+	return ok && sameReplica(lease.Replica, replica) && lease.Covers(timestamp)
+}
+
+// redirectOnOrAcquireLeaderLease verifies that this range replica
+// holds the leader lease and may serve a command at timestamp. If
+// another replica holds an unexpired lease, a NotLeaderError
+// identifying the lease holder is returned. If no replica holds an
+// unexpired lease, or this replica's lease must be extended to cover
+// timestamp, the raft leader proposes a new lease for itself; other
+// replicas return a NotLeaderError. Lease expirations are based on
+// the local clock, and timestamps further ahead of it than its max
+// drift are refused. A replica whose node's gossiped liveness record
+// has expired doesn't acquire or extend the lease: other nodes may
+// consider it dead and replace its replicas. Nor does a replica on a
+// draining store, whose leases are being transferred.
+//
+// Ranges which aren't managed by a store (and so can't identify their
+// own replica) don't use leader leases.
+func (r *Range) redirectOnOrAcquireLeaderLease(timestamp hlc.HLTimestamp) error {
+	if r.rm == nil {
+		return nil
+	}
+	replica, ok := r.localReplica()
+	if !ok {
+		return &NotLeaderError{RangeID: r.Meta.RangeID}
+	}
+	now := r.clock.Now()
+	lease := r.getLease()
+	held := sameReplica(lease.Replica, replica)
+	if now.Less(lease.Expiration) {
+		if !held {
+			return &NotLeaderError{RangeID: r.Meta.RangeID, Leader: &lease.Replica}
+		}
+		if timestamp.Less(lease.Expiration) {
+			return nil
+		}
+	}
+	// The clock rejects timestamps too far ahead of it, and so must the
+	// lease: otherwise a client with a skewed clock could extend the
+	// lease far into the future.
+	if maxDrift := r.clock.MaxDrift(); maxDrift > 0 && timestamp.WallTime-now.WallTime > int64(maxDrift) {
+		return util.Errorf("range %d: timestamp %+v is more than max drift %s ahead of local clock %+v",
+			r.Meta.RangeID, timestamp, time.Duration(maxDrift), now)
+	}
+	if !r.IsLeader() || r.rm.IsDraining() {
+		return &NotLeaderError{RangeID: r.Meta.RangeID}
+	}
+	if l, ok := gossipedLiveness(r.gossip, replica.NodeID); ok && l.Status(time.Now()) != NodeLive {
+		return &NotLeaderError{RangeID: r.Meta.RangeID}
+	}
+	newLease := LeaderLease{Start: now, Replica: replica}
+	if held && now.Less(lease.Expiration) {
+		newLease.Start = lease.Start
+	}
+	// The lease's expiration is based on the local clock only; a
+	// timestamp it can't cover is refused rather than allowed to push
+	// the lease into the future.
+	newLease.Expiration = now
+	newLease.Expiration.WallTime += leaderLeaseDuration.Nanoseconds()
+	if !timestamp.Less(newLease.Expiration) {
+		return util.Errorf("range %d: timestamp %+v is beyond the leader lease expiration %+v",
+			r.Meta.RangeID, timestamp, newLease.Expiration)
+	}
+	args := &InternalLeaderLeaseRequest{Key: r.Meta.StartKey, Lease: newLease}
+	return <-r.ReadWriteCmd("InternalLeaderLease", args, &InternalLeaderLeaseResponse{})
+}
+
+// TransferLeaderLease transfers the leader lease held by this range
+// replica to the target replica. The current lease is first shortened
+// to expire now, after which a lease starting now is proposed for the
+// target, so the two leases never overlap. Leases are transferred
+// when the replica's node is drained and when raft leadership moves
+// to another replica (see LeadershipChanged).
+func (r *Range) TransferLeaderLease(target Replica) error {
+	now := r.clock.Now()
+	if !r.HasLeaderLease(now) {
+		return util.Errorf("range %d: cannot transfer a leader lease which isn't held", r.Meta.RangeID)
+	}
+	lease := r.getLease()
+	lease.Expiration = now
+	args := &InternalLeaderLeaseRequest{Key: r.Meta.StartKey, Lease: lease}
+	if err := <-r.ReadWriteCmd("InternalLeaderLease", args, &InternalLeaderLeaseResponse{}); err != nil {
+		return err
+	}
+	expiration := now
+	expiration.WallTime += leaderLeaseDuration.Nanoseconds()
+	args = &InternalLeaderLeaseRequest{
+		Key:   r.Meta.StartKey,
+		Lease: LeaderLease{Start: now, Expiration: expiration, Replica: target},
+	}
+	return <-r.ReadWriteCmd("InternalLeaderLease", args, &InternalLeaderLeaseResponse{})
 }
 
 // ReadOnlyCmd executes a read-only command against the store. If this
@@ -131,11 +529,171 @@ func (r *Range) IsLeader() bool {
 // also satisfy the read locally. Otherwise, we must ping the leader
 // to determine with certainty whether our local data is up to
 // date.
+//
+// Reads with INCONSISTENT read consistency ignore write intents and
+// may be satisfied by any replica without consulting the leader.
+// Consistent reads at timestamps at or below the range's closed
+// timestamp may also be satisfied by any replica (see
+// IsFollowerRead), as may bounded-staleness reads whose bound the
+// closed timestamp satisfies (see RequestHeader.MaxStaleness).
+//
+// If the read encounters a write intent belonging to another
+// transaction, the intent's transaction is pushed and the intent
+// resolved before the read is retried. If the transaction can't be
+// pushed, the read backs off and retries; the WriteIntentError is
+// returned if the maximum number of attempts is exceeded.
 func (r *Range) ReadOnlyCmd(method string, args, reply interface{}) error {
 	if r == nil {
 		return util.Errorf("invalid node specification")
 	}
-	return r.executeCmd(method, args, reply)
+	defer r.traceCmd(args, reply, time.Now())
+	retryOpts := util.RetryOptions{
+		Tag:         fmt.Sprintf("resolving write intent for %s", method),
+		Backoff:     intentResolutionBackoff,
+		MaxBackoff:  intentResolutionMaxBackoff,
+		Constant:    2,
+		MaxAttempts: intentResolutionMaxAttempts,
+		Stopper:     r.stopper,
+	}
+	if err := r.checkPermissions(method, args.(Request)); err != nil {
+		reply.(Response).Header().Error = err
+		return err
+	}
+	header := args.(Request).Header()
+	if err := r.resolveBoundedStaleness(header); err != nil {
+		reply.(Response).Header().Error = err
+		return err
+	}
+	if header.ReadConsistency == CONSISTENT && !r.canServeFollowerRead(header) {
+		timestamp := header.Timestamp
+		if timestamp == (hlc.HLTimestamp{}) {
+			timestamp = r.clock.Now()
+		}
+		if err := r.redirectOnOrAcquireLeaderLease(timestamp); err != nil {
+			reply.(Response).Header().Error = err
+			return err
+		}
+	}
+	release, err := r.admission.admit(method, false)
+	if err != nil {
+		reply.(Response).Header().Error = err
+		return err
+	}
+	defer release()
+	if key := requestKey(args); key != nil {
+		r.load.record(key, time.Now())
+	}
+	r.recordRequest(method)
+	replyVal := reflect.ValueOf(reply).Elem()
+	util.RetryWithBackoff(retryOpts, func() (bool, error) {
+		// Clear any results from a previous attempt.
+		replyVal.Set(reflect.Zero(replyVal.Type()))
+		// Inconsistent reads don't wait on overlapping writes. The
+		// command is removed from the queue before any conflicting
+		// intent is resolved, which would otherwise wait on it.
+		var cmdKey interface{}
+		if header.ReadConsistency == CONSISTENT {
+			cmdKey = r.beginCmd(args, true)
+		}
+		err = r.executeCmd(method, args, reply)
+		r.endCmd(cmdKey)
+		wiErr, ok := err.(*WriteIntentError)
+		if !ok || r.db == nil {
+			return true, nil
+		}
+		if resErr := r.resolveWriteIntentError(args.(Request).Header(), wiErr); resErr != nil {
+			r.logger().V(1).Infof("failed to resolve %s: %v", wiErr, resErr)
+		}
+		return false, nil
+	})
+	return err
+}
+
+// traceCmd records the range and replica which executed the command
+// and the time spent executing it since start in the reply's trace,
+// if the command requested one.
+func (r *Range) traceCmd(args, reply interface{}, start time.Time) {
+	trace := ReplyTrace(args.(Request), reply.(Response))
+	if trace == nil {
+		return
+	}
+	trace.RangeID = r.getMeta().RangeID
+	if r.rm != nil {
+		if replica, ok := r.localReplica(); ok {
+			trace.Replica = replica
+		}
+		if lease := r.getLease(); lease.Covers(r.clock.Now()) {
+			trace.Leader = &lease.Replica
+		}
+	}
+	trace.AddPhase(TraceExecute, start)
+}
+
+// resolveWriteIntentError pushes the transaction which owns the
+// conflicting write intent past the timestamp of the read described
+// by header and resolves the intent according to the pushed
+// transaction's updated status. The intent may then be ignored by
+// the read (if its transaction was pushed or committed at a later
+// timestamp) or will have been removed (if its transaction aborted)
+// or made permanent (if its transaction committed earlier).
+func (r *Range) resolveWriteIntentError(header *RequestHeader, wiErr *WriteIntentError) error {
+	pushArgs := &InternalPushTxnRequest{
+		RequestHeader: RequestHeader{
+			Timestamp: header.Timestamp,
+			Txn:       header.Txn,
+		},
+		Key:       wiErr.Txn.Key,
+		PusheeTxn: wiErr.Txn,
+	}
+	pushReply := <-r.db.InternalPushTxn(pushArgs)
+	if pushReply.Error != nil {
+		return pushReply.Error
+	}
+	resolveArgs := &InternalResolveIntentRequest{
+		RequestHeader: RequestHeader{
+			Timestamp: header.Timestamp,
+			Txn:       &pushReply.PusheeTxn,
+		},
+		Key: wiErr.Key,
+	}
+	return <-r.ReadWriteCmd("InternalResolveIntent", resolveArgs, &InternalResolveIntentResponse{})
+}
+
+// cleanupIntents resolves the write intents in the range written
+// before threshold whose transactions have ended or been abandoned by
+// their coordinators, so that intents left behind by failed
+// coordinators don't block readers and writers indefinitely. Each
+// intent's transaction is pushed, aborting it only if abandoned; the
+// intents of live transactions are left in place.
+func (r *Range) cleanupIntents(threshold hlc.HLTimestamp) error {
+	meta := r.getMeta()
+	intents, err := r.mvcc.FindIntents(meta.StartKey, meta.EndKey, threshold)
+	if err != nil {
+		return err
+	}
+	for _, intent := range intents {
+		now := r.clock.Now()
+		pushReply := <-r.db.InternalPushTxn(&InternalPushTxnRequest{
+			RequestHeader: RequestHeader{Timestamp: now},
+			Key:           intent.Txn.Key,
+			PusheeTxn:     intent.Txn,
+			Abort:         true,
+			ExpiredOnly:   true,
+		})
+		if _, ok := pushReply.Error.(*TransactionPushError); ok {
+			continue
+		} else if pushReply.Error != nil {
+			return pushReply.Error
+		}
+		resolveArgs := &InternalResolveIntentRequest{
+			RequestHeader: RequestHeader{Timestamp: now, Txn: &pushReply.PusheeTxn},
+			Key:           intent.Key,
+		}
+		if err := <-r.ReadWriteCmd("InternalResolveIntent", resolveArgs, &InternalResolveIntentResponse{}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // ReadWriteCmd executes a read-write command against the store. If
@@ -149,28 +707,145 @@ func (r *Range) ReadOnlyCmd(method string, args, reply interface{}) error {
 // raft consensus write protocol. Only after committed can the command
 // be executed. To facilitate this, ReadWriteCmd returns a channel
 // which is signaled upon completion.
+//
+// Only the holder of the leader lease may propose commands, with the
+// exception of the InternalLeaderLease command itself.
 func (r *Range) ReadWriteCmd(method string, args, reply interface{}) <-chan error {
 	if r == nil {
 		c := make(chan error, 1)
 		c <- util.Errorf("invalid node specification")
 		return c
 	}
+	start := time.Now()
+	if err := r.checkPermissions(method, args.(Request)); err != nil {
+		reply.(Response).Header().Error = err
+		r.traceCmd(args, reply, start)
+		c := make(chan error, 1)
+		c <- err
+		return c
+	}
+	if method != "InternalLeaderLease" {
+		timestamp := args.(Request).Header().Timestamp
+		if timestamp == (hlc.HLTimestamp{}) {
+			timestamp = r.clock.Now()
+		}
+		if err := r.redirectOnOrAcquireLeaderLease(timestamp); err != nil {
+			reply.(Response).Header().Error = err
+			r.traceCmd(args, reply, start)
+			c := make(chan error, 1)
+			c <- err
+			return c
+		}
+	}
+	release, err := r.admission.admit(method, true)
+	if err != nil {
+		reply.(Response).Header().Error = err
+		r.traceCmd(args, reply, start)
+		c := make(chan error, 1)
+		c <- err
+		return c
+	}
+	if key := requestKey(args); key != nil {
+		r.load.record(key, time.Now())
+	}
+	r.recordRequest(method)
+	if trace := ReplyTrace(args.(Request), reply.(Response)); trace != nil {
+		trace.AddPhase(TraceLease, start)
+	}
 
 	logEntry := &LogEntry{
-		Method: method,
-		Args:   args,
-		Reply:  reply,
-		done:   make(chan error, 1),
+		Method:   method,
+		Args:     args,
+		Reply:    reply,
+		start:    start,
+		proposed: time.Now(),
+		done:     make(chan error, 1),
+		release:  release,
+	}
+	if !r.stopper.StartTask() {
+		release()
+		err := util.Errorf("range %d is stopping", r.Meta.RangeID)
+		reply.(Response).Header().Error = err
+		logEntry.done <- err
+		return logEntry.done
 	}
+	logEntry.cmdKey = r.beginCmd(args, false)
+	r.admission.propose(1)
 	r.pending <- logEntry
 
 	return logEntry.done
 }
 
+// beginCmd adds the command described by args to the range's
+// command queue and waits for the overlapping commands ahead of it to
+// complete. Returns the key with which the command is removed from
+// the queue via endCmd once it has executed.
+func (r *Range) beginCmd(args interface{}, readOnly bool) interface{} {
+	start, end := r.cmdSpan(args)
+	var wg sync.WaitGroup
+	r.cmdQMu.Lock()
+	r.cmdQ.GetWait(start, end, readOnly, &wg)
+	cmdKey := r.cmdQ.Add(start, end, readOnly)
+	r.cmdQMu.Unlock()
+	wg.Wait()
+	return cmdKey
+}
+
+// flushPending waits for the commands which have entered the range's
+// command queue to complete.
+func (r *Range) flushPending() {
+	var wg sync.WaitGroup
+	r.cmdQMu.Lock()
+	r.cmdQ.GetWait(KeyMin, KeyMax, false, &wg)
+	r.cmdQMu.Unlock()
+	wg.Wait()
+}
+
+// endCmd removes the command identified by cmdKey from the range's
+// command queue, allowing commands waiting on it to proceed.
+func (r *Range) endCmd(cmdKey interface{}) {
+	if cmdKey == nil {
+		return
+	}
+	r.cmdQMu.Lock()
+	r.cmdQ.Remove(cmdKey)
+	r.cmdQMu.Unlock()
+}
+
+// cmdSpan returns the span of keys [start, end) which the command
+// described by args may read or write. Batches span all of their
+// requests. Commands which don't address keys directly, such as
+// EndTransaction, and those which operate on the range's data as a
+// whole span all keys, so they're ordered with respect to every
+// other command.
+func (r *Range) cmdSpan(args interface{}) (start, end Key) {
+	switch t := args.(type) {
+	case *InternalGCRequest, *InternalChecksumRequest:
+		return KeyMin, KeyMax
+	case *BatchRequest:
+		for i, req := range t.Requests {
+			reqStart, reqEnd := r.cmdSpan(req)
+			if i == 0 || bytes.Compare(reqStart, start) < 0 {
+				start = reqStart
+			}
+			if i == 0 || bytes.Compare(reqEnd, end) > 0 {
+				end = reqEnd
+			}
+		}
+		if len(t.Requests) > 0 {
+			return start, end
+		}
+	}
+	if start, end, ok := requestSpan(args); ok {
+		return start, end
+	}
+	return KeyMin, KeyMax
+}
+
 // processPending processes pending read/write commands, sending them
 // to other replicas in the set as necessary to achieve consensus.
 // This method processes indefinitely or until the Range.Stop() is
-// invoked.
+// invoked and all pending commands have been processed.
 //
 // TODO(spencer): this is pretty temporary. Just executing commands
 // immediately until raft is in place.
@@ -178,22 +853,77 @@ func (r *Range) processPending() {
 	for {
 		select {
 		case logEntry := <-r.pending:
-			logEntry.done <- r.executeCmd(logEntry.Method, logEntry.Args, logEntry.Reply)
-		case <-r.closer:
+			trace := ReplyTrace(logEntry.Args.(Request), logEntry.Reply.(Response))
+			if trace != nil {
+				trace.AddPhase(TracePropose, logEntry.proposed)
+			}
+			applyStart := time.Now()
+			err := r.executeCachedCmd(logEntry.Method, logEntry.Args, logEntry.Reply)
+			if trace != nil {
+				trace.AddPhase(TraceApply, applyStart)
+			}
+			r.traceCmd(logEntry.Args, logEntry.Reply, logEntry.start)
+			r.updateStats()
+			if r.changeFeed != nil {
+				r.changeFeed.publish(r.mvcc.FlushCommits())
+			}
+			r.maybeSplit()
+			r.endCmd(logEntry.cmdKey)
+			r.admission.propose(-1)
+			logEntry.release()
+			logEntry.done <- err
+			r.stopper.FinishTask()
+		case <-r.stopper.ShouldStop():
 			return
 		}
 	}
 }
 
-// startGossip periodically gossips the cluster ID if it's the
-// first range and the raft leader.
+// executeCachedCmd executes a read-write command unless a response to
+// a previous execution of the command is found in the response cache,
+// in which case the cached response is returned instead. Responses of
+// successfully executed commands are added to the response cache in
+// the same batch as the command's writes, so that a retry of a command
+// whose writes were applied always finds its response. Traces are
+// particular to each execution and aren't cached.
+func (r *Range) executeCachedCmd(method string, args, reply interface{}) error {
+	cmdID := args.(Request).Header().CmdID
+	header := reply.(Response).Header()
+	trace := header.Trace
+	defer func() { header.Trace = trace }()
+	header.Trace = nil
+	ok, err := r.respCache.GetResponse(cmdID, reply)
+	if err != nil {
+		r.logger().Errorf("unable to read cached response for %s: %v", method, err)
+	} else if ok {
+		return nil
+	}
+	// The writes of failed commands are committed as well; the MVCC
+	// stats already account for them.
+	r.batch.begin()
+	if err = r.executeCmd(method, args, reply); err == nil {
+		if putErr := r.respCache.PutResponse(cmdID, reply); putErr != nil {
+			r.logger().Errorf("unable to cache response for %s: %v", method, putErr)
+		}
+	}
+	if commitErr := r.batch.commit(); commitErr != nil && err == nil {
+		header.Error = commitErr
+		err = commitErr
+	}
+	return err
+}
+
+// startGossip periodically gossips the cluster ID and the range's
+// descriptor if it's the first range and the raft leader.
 func (r *Range) startGossip() {
 	ticker := time.NewTicker(ttlClusterIDGossip / 2)
 	for {
 		select {
 		case <-ticker.C:
 			r.maybeGossipClusterID()
-		case <-r.closer:
+			r.maybeGossipFirstRange()
+		case <-r.stopper.ShouldStop():
+			ticker.Stop()
 			return
 		}
 	}
@@ -204,17 +934,17 @@ func (r *Range) startGossip() {
 func (r *Range) maybeGossipClusterID() {
 	if r.gossip != nil && r.IsFirstRange() && r.IsLeader() {
 		if err := r.gossip.AddInfo(gossip.KeyClusterID, r.Meta.ClusterID, ttlClusterIDGossip); err != nil {
-			glog.Errorf("failed to gossip cluster ID %s: %v", r.Meta.ClusterID, err)
+			r.logger().Errorf("failed to gossip cluster ID %s: %v", r.Meta.ClusterID, err)
 		}
 	}
 }
 
-// maybeGossipFirstRange gossips the range locations if this range is
-// the start of the key space and the raft leader.
+// maybeGossipFirstRange gossips the range's descriptor if this range
+// is the start of the key space and the raft leader.
 func (r *Range) maybeGossipFirstRange() {
 	if r.gossip != nil && r.IsFirstRange() && r.IsLeader() {
-		if err := r.gossip.AddInfo(gossip.KeyFirstRangeMetadata, r.Meta.Replicas, 0*time.Second); err != nil {
-			glog.Errorf("failed to gossip first range metadata: %v", err)
+		if err := r.gossip.AddInfo(gossip.KeyFirstRangeMetadata, r.getMeta().Replicas, ttlFirstRangeGossip); err != nil {
+			r.logger().Errorf("failed to gossip first range metadata: %v", err)
 		}
 	}
 }
@@ -229,11 +959,11 @@ func (r *Range) maybeGossipConfigs() {
 			if cp.dirty && r.containsKey(cp.keyPrefix) {
 				configs, err := r.loadConfigs(cp.keyPrefix, cp.configI)
 				if err != nil {
-					glog.Errorf("failed loading %s configs: %v", cp.gossipKey, err)
+					r.logger().Errorf("failed loading %s configs: %v", cp.gossipKey, err)
 					continue
 				} else {
 					if err := r.gossip.AddInfo(cp.gossipKey, configs, 0*time.Second); err != nil {
-						glog.Errorf("failed to gossip %s configs: %v", cp.gossipKey, err)
+						r.logger().Errorf("failed to gossip %s configs: %v", cp.gossipKey, err)
 						continue
 					}
 				}
@@ -249,7 +979,7 @@ func (r *Range) maybeGossipConfigs() {
 func (r *Range) loadConfigs(keyPrefix Key, configI interface{}) ([]*prefixConfig, error) {
 	// TODO(spencer): need to make sure range splitting never
 	// crosses a configuration map's key prefix.
-	kvs, err := r.engine.scan(keyPrefix, PrefixEndKey(keyPrefix), 0)
+	kvs, err := r.mvcc.Scan(keyPrefix, PrefixEndKey(keyPrefix), 0, r.clock.Now(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -268,13 +998,123 @@ func (r *Range) loadConfigs(keyPrefix Key, configI interface{}) ([]*prefixConfig
 
 // containsKey returns whether this range contains the specified key.
 func (r *Range) containsKey(key Key) bool {
-	return bytes.Compare(r.Meta.StartKey, key) <= 0 &&
-		bytes.Compare(r.Meta.EndKey, key) > 0
+	meta := r.getMeta()
+	return bytes.Compare(meta.StartKey, key) <= 0 &&
+		bytes.Compare(meta.EndKey, key) > 0
+}
+
+// containsRequestKey returns whether this range contains the key
+// addressed by the request args (see requestKey). Reverse scans
+// address the exclusive end of their span, which the range contains
+// if it holds the keys just before it.
+func (r *Range) containsRequestKey(args interface{}, key Key) bool {
+	if _, ok := args.(*ReverseScanRequest); ok {
+		meta := r.getMeta()
+		return bytes.Compare(meta.StartKey, key) < 0 &&
+			bytes.Compare(meta.EndKey, key) >= 0
+	}
+	return r.containsKey(key)
+}
+
+// gcTTL returns the GC TTL from the zone config for the range's
+// start key, or the default TTL if none is specified or the zone
+// configs aren't available.
+func (r *Range) gcTTL() time.Duration {
+	zone := r.zoneConfig()
+	if zone == nil || zone.GCTTLSeconds <= 0 {
+		return defaultGCTTL
+	}
+	return time.Duration(zone.GCTTLSeconds) * time.Second
+}
+
+// zoneConfig returns the gossiped zone config which applies to the
+// range, or nil if zone configs haven't been gossiped.
+func (r *Range) zoneConfig() *ZoneConfig {
+	if r.gossip == nil {
+		return nil
+	}
+	info, err := r.gossip.GetInfo(gossip.KeyConfigZone)
+	if err != nil {
+		return nil
+	}
+	configMap, err := newPrefixConfigMap(info.([]*prefixConfig))
+	if err != nil {
+		r.logger().Errorf("unable to build zone config map: %v", err)
+		return nil
+	}
+	return configMap.matchByPrefix(r.Meta.StartKey).Config.(*ZoneConfig)
+}
+
+// gcThreshold returns the timestamp which precedes the current time
+// by the GC TTL. Versions which aren't visible to reads at or after
+// the threshold may be garbage collected.
+func (r *Range) gcThreshold() hlc.HLTimestamp {
+	threshold := r.clock.Now()
+	threshold.WallTime -= r.gcTTL().Nanoseconds()
+	threshold.Logical = 0
+	return threshold
+}
+
+// checkGCThreshold returns a ReadTooOldError if timestamp precedes
+// the current time by more than the GC TTL.
+func (r *Range) checkGCThreshold(timestamp hlc.HLTimestamp) error {
+	if threshold := r.gcThreshold(); timestamp.Less(threshold) {
+		return &ReadTooOldError{Timestamp: timestamp, Threshold: threshold}
+	}
+	return nil
 }
 
 // executeCmd switches over the method and multiplexes to execute the
-// appropriate storage API command.
+// appropriate storage API command. If not specified, the command
+// timestamp is set to the transaction timestamp or, failing that,
+// the current time; otherwise, the range's clock is updated with the
+// command timestamp. The timestamp is returned in the reply.
+// Read-only commands may specify historical timestamps to read a
+// snapshot of the data as of that time, as long as the timestamp is
+// within the GC TTL.
 func (r *Range) executeCmd(method string, args, reply interface{}) error {
+	header := args.(Request).Header()
+	if key := requestKey(args); key != nil && !r.containsRequestKey(args, key) {
+		err := &RangeKeyMismatchError{RequestKey: key, Range: r.Meta}
+		reply.(Response).Header().Error = err
+		return err
+	}
+	if err := r.checkReadConsistency(method, header); err != nil {
+		reply.(Response).Header().Error = err
+		return err
+	}
+	if header.Txn != nil && !strings.HasPrefix(method, "Internal") {
+		if err := r.abortCache.Check(header.Txn); err != nil {
+			reply.(Response).Header().Error = err
+			return err
+		}
+	}
+	if header.Timestamp == (hlc.HLTimestamp{}) {
+		if header.Txn != nil {
+			header.Timestamp = header.Txn.Timestamp
+		} else {
+			header.Timestamp = r.clock.Now()
+		}
+	} else {
+		if _, err := r.clock.Update(header.Timestamp); err != nil {
+			reply.(Response).Header().Error = err
+			return err
+		}
+		if IsReadOnly(method) {
+			if err := r.checkGCThreshold(header.Timestamp); err != nil {
+				reply.(Response).Header().Error = err
+				return err
+			}
+		}
+	}
+	reply.(Response).Header().Timestamp = header.Timestamp
+	if !IsReadOnly(method) && !strings.HasPrefix(method, "Internal") {
+		if err := r.checkClosedTimestamp(header); err != nil {
+			reply.(Response).Header().Error = err
+			return err
+		}
+	}
+
 	switch method {
 	case "Contains":
 		r.Contains(args.(*ContainsRequest), reply.(*ContainsResponse))
@@ -282,6 +1122,8 @@ func (r *Range) executeCmd(method string, args, reply interface{}) error {
 		r.Get(args.(*GetRequest), reply.(*GetResponse))
 	case "Put":
 		r.Put(args.(*PutRequest), reply.(*PutResponse))
+	case "ConditionalPut":
+		r.ConditionalPut(args.(*ConditionalPutRequest), reply.(*ConditionalPutResponse))
 	case "Increment":
 		r.Increment(args.(*IncrementRequest), reply.(*IncrementResponse))
 	case "Delete":
@@ -290,8 +1132,12 @@ func (r *Range) executeCmd(method string, args, reply interface{}) error {
 		r.DeleteRange(args.(*DeleteRangeRequest), reply.(*DeleteRangeResponse))
 	case "Scan":
 		r.Scan(args.(*ScanRequest), reply.(*ScanResponse))
+	case "ReverseScan":
+		r.ReverseScan(args.(*ReverseScanRequest), reply.(*ReverseScanResponse))
 	case "EndTransaction":
 		r.EndTransaction(args.(*EndTransactionRequest), reply.(*EndTransactionResponse))
+	case "Batch":
+		r.Batch(args.(*BatchRequest), reply.(*BatchResponse))
 	case "AccumulateTS":
 		r.AccumulateTS(args.(*AccumulateTSRequest), reply.(*AccumulateTSResponse))
 	case "ReapQueue":
@@ -302,6 +1148,20 @@ func (r *Range) executeCmd(method string, args, reply interface{}) error {
 		r.EnqueueMessage(args.(*EnqueueMessageRequest), reply.(*EnqueueMessageResponse))
 	case "InternalRangeLookup":
 		r.InternalRangeLookup(args.(*InternalRangeLookupRequest), reply.(*InternalRangeLookupResponse))
+	case "InternalPushTxn":
+		r.InternalPushTxn(args.(*InternalPushTxnRequest), reply.(*InternalPushTxnResponse))
+	case "InternalResolveIntent":
+		r.InternalResolveIntent(args.(*InternalResolveIntentRequest), reply.(*InternalResolveIntentResponse))
+	case "InternalHeartbeatTxn":
+		r.InternalHeartbeatTxn(args.(*InternalHeartbeatTxnRequest), reply.(*InternalHeartbeatTxnResponse))
+	case "InternalLeaderLease":
+		r.InternalLeaderLease(args.(*InternalLeaderLeaseRequest), reply.(*InternalLeaderLeaseResponse))
+	case "InternalCloseTimestamp":
+		r.InternalCloseTimestamp(args.(*InternalCloseTimestampRequest), reply.(*InternalCloseTimestampResponse))
+	case "InternalGC":
+		r.InternalGC(args.(*InternalGCRequest), reply.(*InternalGCResponse))
+	case "InternalChecksum":
+		r.InternalChecksum(args.(*InternalChecksumRequest), reply.(*InternalChecksumResponse))
 	default:
 		return util.Errorf("unrecognized command type: %s", method)
 	}
@@ -313,93 +1173,937 @@ func (r *Range) executeCmd(method string, args, reply interface{}) error {
 	return nil
 }
 
-// Contains verifies the existence of a key in the key value store.
-func (r *Range) Contains(args *ContainsRequest, reply *ContainsResponse) {
-	val, err := r.engine.get(args.Key)
-	if err != nil {
-		reply.Error = err
-		return
+// requestKey returns the key, or start key, addressed by the request
+// args; reverse scans address the end key of their span. Returns nil
+// if the request doesn't address a key directly; for example,
+// EndTransaction addresses its transaction's anchor key and batched
+// requests are checked individually.
+func requestKey(args interface{}) Key {
+	if rs, ok := args.(*ReverseScanRequest); ok {
+		return ReverseScanKey(rs)
 	}
-	if val.Bytes != nil {
-		reply.Exists = true
+	argsVal := reflect.ValueOf(args).Elem()
+	for _, name := range []string{"Key", "StartKey"} {
+		if f := argsVal.FieldByName(name); f.IsValid() {
+			return f.Interface().(Key)
+		}
 	}
+	return nil
 }
 
-// Get returns the value for a specified key.
-func (r *Range) Get(args *GetRequest, reply *GetResponse) {
-	reply.Value, reply.Error = r.engine.get(args.Key)
+// txnCoordinationMethods are the internal methods which clients may
+// invoke on behalf of a user to coordinate transactions; see
+// kv.allowedDBMethods.
+var txnCoordinationMethods = map[string]struct{}{
+	"InternalHeartbeatTxn":  struct{}{},
+	"InternalResolveIntent": struct{}{},
 }
 
-// Put sets the value for a specified key. Conditional puts are supported.
-func (r *Range) Put(args *PutRequest, reply *PutResponse) {
-	// Handle conditional put.
-	if args.ExpValue != nil {
-		// Handle check for non-existence of key.
-		val, err := r.engine.get(args.Key)
-		if err != nil {
-			reply.Error = err
-			return
-		}
-		if args.ExpValue.Bytes == nil && val.Bytes != nil {
-			reply.Error = util.Errorf("key %q already exists", args.Key)
-			return
-		} else if args.ExpValue != nil {
-			// Handle check for existence when there is no key.
-			if val.Bytes == nil {
-				reply.Error = util.Errorf("key %q does not exist", args.Key)
-				return
-			} else if !bytes.Equal(args.ExpValue.Bytes, val.Bytes) {
-				reply.ActualValue.Bytes = val.Bytes
-				reply.Error = util.Errorf("key %q does not match existing", args.Key)
-				return
+// checkPermissions verifies that the user on whose behalf the request
+// is made may read or, for writes, write all keys addressed by the
+// request, according to the gossiped permission configs. Requests
+// made by the system, internal and admin commands and transaction
+// resolution aren't subject to permissions, except for the internal
+// commands clients invoke to coordinate transactions, which require
+// write permission on their key. Neither are requests to ranges
+// without gossip, which have no source of configs.
+func (r *Range) checkPermissions(method string, args Request) error {
+	user := args.Header().User
+	if user == "" || r.gossip == nil || method == "EndTransaction" || strings.HasPrefix(method, "Admin") {
+		return nil
+	}
+	_, txnMethod := txnCoordinationMethods[method]
+	if strings.HasPrefix(method, "Internal") && !txnMethod {
+		return nil
+	}
+	info, err := r.gossip.GetInfo(gossip.KeyConfigPermission)
+	if err != nil {
+		return util.Errorf("permission configs unavailable: %v", err)
+	}
+	configMap, err := newPrefixConfigMap(info.([]*prefixConfig))
+	if err != nil {
+		return util.Errorf("unable to build permission config map: %v", err)
+	}
+	if br, ok := args.(*BatchRequest); ok {
+		for _, req := range br.Requests {
+			batchMethod, _, _, ok := batchEntry(req)
+			if !ok || batchMethod == "EndTransaction" {
+				continue
+			}
+			if err := checkSpanPermissions(configMap, user, !IsReadOnly(batchMethod), req); err != nil {
+				return err
 			}
 		}
+		return nil
 	}
-	if err := r.engine.put(args.Key, args.Value); err != nil {
-		reply.Error = err
-		return
+	return checkSpanPermissions(configMap, user, !IsReadOnly(method), args)
+}
+
+// checkSpanPermissions verifies that user may access the span of keys
+// addressed by args according to each permission config affecting it.
+func checkSpanPermissions(configMap *prefixConfigMap, user string, write bool, args Request) error {
+	start, end, ok := requestSpan(args)
+	if !ok {
+		return nil
 	}
-	// Check whether this put has modified a configuration map.
-	for _, cp := range configPrefixes {
-		if bytes.HasPrefix(args.Key, cp.keyPrefix) {
-			cp.dirty = true
-			r.maybeGossipConfigs()
-			break
+	// Empty spans are checked as the start key alone; the command
+	// itself reports whether the span is invalid.
+	if bytes.Compare(start, end) >= 0 {
+		end = MakeKey(start, Key{0})
+	}
+	results, err := configMap.splitRangeByPrefixes(start, end)
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		config := res.config.(*PermConfig)
+		if (write && !config.CanWrite(user)) || (!write && !config.CanRead(user)) {
+			return &PermissionError{User: user, Key: res.start, Write: write}
 		}
 	}
+	return nil
 }
 
-// Increment increments the value (interpreted as varint64 encoded) and
-// returns the newly incremented value (encoded as varint64). If no
-// value exists for the key, zero is incremented.
-func (r *Range) Increment(args *IncrementRequest, reply *IncrementResponse) {
-	reply.NewValue, reply.Error = increment(r.engine, args.Key, args.Increment, args.Timestamp)
+// requestSpan returns the span of keys [start, end) addressed by the
+// request, which is either a single key or a key range. ok is false
+// for requests which don't address keys.
+func requestSpan(args interface{}) (start, end Key, ok bool) {
+	argsVal := reflect.ValueOf(args).Elem()
+	if f := argsVal.FieldByName("Key"); f.IsValid() {
+		key := f.Interface().(Key)
+		return key, MakeKey(key, Key{0}), true
+	}
+	if f := argsVal.FieldByName("StartKey"); f.IsValid() {
+		start = f.Interface().(Key)
+		if f := argsVal.FieldByName("EndKey"); f.IsValid() {
+			end = f.Interface().(Key)
+		}
+		if len(end) == 0 {
+			end = KeyMax
+		}
+		return start, end, true
+	}
+	return nil, nil, false
 }
 
-// Delete deletes the key and value specified by key.
-func (r *Range) Delete(args *DeleteRequest, reply *DeleteResponse) {
-	if err := r.engine.del(args.Key); err != nil {
+// checkReadConsistency verifies that the read consistency specified
+// in header is permitted for method. Inconsistent reads may be served
+// by any replica, but are only available to read-only commands outside
+// of transactions. Consistent reads must be served by the leader,
+// unless they're at or below the range's closed timestamp. So must
+// bounded-staleness reads, which are also unavailable to writes and
+// transactions.
+func (r *Range) checkReadConsistency(method string, header *RequestHeader) error {
+	switch header.ReadConsistency {
+	case CONSISTENT:
+		if header.MaxStaleness != 0 {
+			if !IsReadOnly(method) {
+				return util.Errorf("bounded staleness is only available to reads; %s is not a read", method)
+			}
+			if header.Txn != nil {
+				return util.Errorf("cannot allow bounded-staleness reads within a transaction")
+			}
+		}
+		if IsReadOnly(method) && !r.IsLeader() && !r.canServeFollowerRead(header) {
+			return &NotLeaderError{RangeID: r.Meta.RangeID}
+		}
+	case INCONSISTENT:
+		if header.MaxStaleness != 0 {
+			return util.Errorf("bounded staleness is only available to consistent reads")
+		}
+		if !IsReadOnly(method) {
+			return util.Errorf("inconsistent mode is only available to reads; %s is not a read", method)
+		}
+		if header.Txn != nil {
+			return util.Errorf("cannot allow inconsistent reads within a transaction")
+		}
+	default:
+		return util.Errorf("unknown read consistency type: %d", header.ReadConsistency)
+	}
+	return nil
+}
+
+// Contains verifies the existence of a key in the key value store.
+func (r *Range) Contains(args *ContainsRequest, reply *ContainsResponse) {
+	val, err := r.get(&args.RequestHeader, args.Key)
+	if err != nil {
 		reply.Error = err
+		return
+	}
+	if val != nil && val.Bytes != nil {
+		reply.Exists = true
 	}
 }
 
-// DeleteRange deletes the range of key/value pairs specified by
-// start and end keys.
+// Get returns the value for a specified key.
+func (r *Range) Get(args *GetRequest, reply *GetResponse) {
+	val, err := r.get(&args.RequestHeader, args.Key)
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	if val != nil {
+		reply.Value = *val
+	}
+}
+
+// get reads the value for key with the consistency specified in the
+// request header.
+func (r *Range) get(header *RequestHeader, key Key) (*Value, error) {
+	if header.ReadConsistency == INCONSISTENT {
+		return r.mvcc.GetInconsistent(key, header.Timestamp)
+	}
+	return r.mvcc.Get(key, header.Timestamp, header.Txn)
+}
+
+// Put sets the value for a specified key.
+func (r *Range) Put(args *PutRequest, reply *PutResponse) {
+	if err := r.mvcc.Put(args.Key, args.Timestamp, args.Value, args.Txn); err != nil {
+		reply.Error = err
+		return
+	}
+	r.maybeUpdateGossipConfigs(args.Key)
+}
+
+// ConditionalPut sets the value for a specified key only if the
+// expected value matches. If not, the actual value is returned in
+// the response along with a ConditionFailedError.
+func (r *Range) ConditionalPut(args *ConditionalPutRequest, reply *ConditionalPutResponse) {
+	err := r.mvcc.ConditionalPut(args.Key, args.Timestamp, args.Value, args.ExpValue, args.Txn)
+	if cfErr, ok := err.(*ConditionFailedError); ok {
+		reply.ActualValue = cfErr.ActualValue
+	}
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	r.maybeUpdateGossipConfigs(args.Key)
+}
+
+// maybeUpdateGossipConfigsInRange re-gossips any configuration maps
+// whose key prefixes overlap the range [key, endKey). An empty endKey
+// extends to KeyMax.
+func (r *Range) maybeUpdateGossipConfigsInRange(key, endKey Key) {
+	if len(endKey) == 0 {
+		endKey = KeyMax
+	}
+	dirty := false
+	for _, cp := range configPrefixes {
+		if bytes.Compare(key, PrefixEndKey(cp.keyPrefix)) < 0 && bytes.Compare(cp.keyPrefix, endKey) < 0 {
+			cp.dirty = true
+			dirty = true
+		}
+	}
+	if dirty {
+		r.maybeGossipConfigs()
+	}
+}
+
+// maybeUpdateGossipConfigs checks whether a write to key has
+// modified a configuration map and, if so, re-gossips it.
+func (r *Range) maybeUpdateGossipConfigs(key Key) {
+	for _, cp := range configPrefixes {
+		if bytes.HasPrefix(key, cp.keyPrefix) {
+			cp.dirty = true
+			r.maybeGossipConfigs()
+			break
+		}
+	}
+}
+
+// Increment increments the value (interpreted as varint64 encoded) and
+// returns the newly incremented value (encoded as varint64). If no
+// value exists for the key, zero is incremented.
+func (r *Range) Increment(args *IncrementRequest, reply *IncrementResponse) {
+	reply.NewValue, reply.Error = r.mvcc.Increment(args.Key, args.Timestamp, args.Txn, args.Increment)
+}
+
+// Delete deletes the key and value specified by key.
+func (r *Range) Delete(args *DeleteRequest, reply *DeleteResponse) {
+	if err := r.mvcc.Delete(args.Key, args.Timestamp, args.Txn); err != nil {
+		reply.Error = err
+	}
+}
+
+// DeleteRange deletes the range of key/value pairs specified by
+// start and end keys, up to args.MaxEntriesToDelete. The span is
+// truncated to the range's bounds. If the maximum or the end of the
+// range is reached, the response's ResumeKey is set to the next key
+// to delete.
 func (r *Range) DeleteRange(args *DeleteRangeRequest, reply *DeleteRangeResponse) {
-	reply.Error = util.Error("unimplemented")
+	if args.MaxEntriesToDelete < 0 {
+		reply.Error = util.Errorf("invalid max entries to delete: %d", args.MaxEntriesToDelete)
+		return
+	}
+	endKey, truncated := r.truncateSpan(args.EndKey)
+	reply.NumDeleted, reply.ResumeKey, reply.Error = r.mvcc.DeleteRange(args.StartKey, endKey,
+		args.MaxEntriesToDelete, args.Timestamp, args.Txn)
+	if reply.Error == nil && reply.ResumeKey == nil && truncated {
+		reply.ResumeKey = endKey
+	}
+	if reply.NumDeleted > 0 {
+		r.maybeUpdateGossipConfigsInRange(args.StartKey, endKey)
+	}
 }
 
 // Scan scans the key range specified by start key through end key up
-// to some maximum number of results. The last key of the iteration is
-// returned with the reply.
+// to some maximum number of results or bytes. The span is truncated
+// to the range's bounds. If a limit is reached, the response's
+// ResumeKey is set to the key following the last row returned;
+// otherwise, if the span extends beyond the range, it's set to the
+// range's end key. The rows read are charged
+// to a budget of the scan, a child of the store's request budget,
+// until the command completes; scans which would exceed the budget
+// fail.
 func (r *Range) Scan(args *ScanRequest, reply *ScanResponse) {
-	reply.Rows, reply.Error = r.engine.scan(args.StartKey, args.EndKey, args.MaxResults)
+	budget := r.requestMemory.NewChild("scan", 0)
+	defer budget.Close()
+	consistent := args.ReadConsistency != INCONSISTENT
+	var txn *Transaction
+	if consistent {
+		txn = args.Txn
+	}
+	endKey, truncated := r.truncateSpan(args.EndKey)
+	reply.Rows, reply.Error = r.mvcc.scan(args.StartKey, endKey, args.MaxResults, args.MaxBytes,
+		args.KeysOnly, false, args.MinTimestamp, args.Timestamp, txn, consistent, budget)
+	if reply.Error != nil {
+		return
+	}
+	if n := len(reply.Rows); n > 0 && ScanLimitReached(args, reply.Rows) {
+		if resumeKey := MakeKey(reply.Rows[n-1].Key, Key{0}); bytes.Compare(resumeKey, endKey) < 0 {
+			reply.ResumeKey = resumeKey
+			return
+		}
+	}
+	if truncated {
+		reply.ResumeKey = endKey
+	}
+}
+
+// ReverseScan scans the key range specified by start key through end
+// key in descending key order, up to some maximum number of results
+// or bytes. The span is truncated to the range's bounds. If a limit
+// is reached, the response's ResumeKey is set to the key of the last
+// row returned; otherwise, if the span extends before the range, it's
+// set to the range's start key. As for Scan, the rows read are
+// charged to a budget of the scan.
+func (r *Range) ReverseScan(args *ReverseScanRequest, reply *ReverseScanResponse) {
+	budget := r.requestMemory.NewChild("reverse scan", 0)
+	defer budget.Close()
+	consistent := args.ReadConsistency != INCONSISTENT
+	var txn *Transaction
+	if consistent {
+		txn = args.Txn
+	}
+	startKey, truncated := r.truncateSpanStart(args.StartKey)
+	reply.Rows, reply.Error = r.mvcc.scan(startKey, args.EndKey, args.MaxResults, args.MaxBytes,
+		args.KeysOnly, true, hlc.HLTimestamp{}, args.Timestamp, txn, consistent, budget)
+	if reply.Error != nil {
+		return
+	}
+	if n := len(reply.Rows); n > 0 && scanLimitReached(args.MaxResults, args.MaxBytes, reply.Rows) {
+		if lastKey := reply.Rows[n-1].Key; truncated || bytes.Compare(lastKey, startKey) > 0 {
+			reply.ResumeKey = lastKey
+			return
+		}
+	}
+	if truncated {
+		reply.ResumeKey = startKey
+	}
+}
+
+// ReverseScanKey returns the key addressed by the reverse scan args:
+// the exclusive end of its span, or KeyMax if it's unbounded.
+func ReverseScanKey(args *ReverseScanRequest) Key {
+	if len(args.EndKey) == 0 {
+		return KeyMax
+	}
+	return args.EndKey
+}
+
+// ScanLimitReached returns whether rows, returned by the scan args,
+// reach its MaxResults or MaxBytes. For a scan spanning ranges, rows
+// are those returned by all ranges scanned.
+func ScanLimitReached(args *ScanRequest, rows []KeyValue) bool {
+	return scanLimitReached(args.MaxResults, args.MaxBytes, rows)
+}
+
+// ReverseScanLimitReached is the ScanLimitReached of reverse scans.
+func ReverseScanLimitReached(args *ReverseScanRequest, rows []KeyValue) bool {
+	return scanLimitReached(args.MaxResults, args.MaxBytes, rows)
+}
+
+func scanLimitReached(maxResults, maxBytes int64, rows []KeyValue) bool {
+	if maxResults > 0 && int64(len(rows)) >= maxResults {
+		return true
+	}
+	if maxBytes > 0 {
+		var size int64
+		for i := range rows {
+			size += rows[i].Size()
+		}
+		return size >= maxBytes
+	}
+	return false
+}
+
+// truncateSpan returns the end key of a span starting within the
+// range and ending at endKey, truncated to the range's end key. An
+// empty endKey denotes the end of the key space. truncated is true if
+// the span extends beyond the range.
+func (r *Range) truncateSpan(endKey Key) (Key, bool) {
+	rangeEnd := r.getMeta().EndKey
+	if len(endKey) != 0 && bytes.Compare(endKey, rangeEnd) <= 0 {
+		return endKey, false
+	}
+	return rangeEnd, !bytes.Equal(rangeEnd, KeyMax)
+}
+
+// truncateSpanStart returns the start key of a span ending within the
+// range and starting at startKey, truncated to the range's start key.
+// truncated is true if the span extends before the range.
+func (r *Range) truncateSpanStart(startKey Key) (Key, bool) {
+	rangeStart := r.getMeta().StartKey
+	if bytes.Compare(startKey, rangeStart) >= 0 {
+		return startKey, false
+	}
+	return rangeStart, true
 }
 
 // EndTransaction either commits or aborts (rolls back) an extant
-// transaction according to the args.Commit parameter.
+// transaction according to the args.Commit parameter. The
+// transaction record, stored in this range, is updated with the final
+// status. Write intents are resolved lazily by readers which
+// encounter them, or explicitly via InternalResolveIntent.
 func (r *Range) EndTransaction(args *EndTransactionRequest, reply *EndTransactionResponse) {
-	reply.Error = util.Error("unimplemented")
+	if args.Txn == nil {
+		reply.Error = util.Error("no transaction specified to EndTransaction")
+		return
+	}
+	key := txnKey(args.Txn.Key, args.Txn.ID)
+
+	// Start with the supplied transaction and update it with any
+	// changes recorded by concurrent pushers.
+	txn := *args.Txn
+	reply.Txn = &txn
+	var existTxn Transaction
+	ok, _, err := getI(r.engine, key, &existTxn)
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	if ok {
+		switch existTxn.Status {
+		case COMMITTED:
+			reply.Error = &TransactionStatusError{Txn: existTxn, Msg: "already committed"}
+			return
+		case ABORTED:
+			reply.Error = &TransactionAbortedError{Txn: existTxn}
+			return
+		}
+		if txn.Timestamp.Less(existTxn.Timestamp) {
+			txn.Timestamp = existTxn.Timestamp
+		}
+		if txn.Priority < existTxn.Priority {
+			txn.Priority = existTxn.Priority
+		}
+	}
+
+	if args.Commit {
+		// A serializable transaction which was pushed must restart,
+		// as its reads are no longer valid at the pushed timestamp.
+		if txn.Isolation == SERIALIZABLE && txn.Timestamp != args.Txn.Timestamp {
+			reply.Error = &TransactionRetryError{Txn: txn}
+			return
+		}
+		txn.Status = COMMITTED
+	} else {
+		txn.Status = ABORTED
+	}
+
+	// The transaction record and any metadata modified by a commit
+	// trigger are written in a single batch.
+	txnKV, err := encodeI(key, txn)
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	puts := []KeyValue{txnKV}
+	var dels []Key
+	trigger := args.InternalCommitTrigger
+	if !args.Commit {
+		trigger = nil
+	}
+	if trigger != nil {
+		if puts, dels, err = r.prepareCommitTrigger(trigger, puts); err != nil {
+			reply.Error = err
+			return
+		}
+	}
+	if err := r.engine.writeBatch(puts, dels); err != nil {
+		reply.Error = err
+		return
+	}
+	if trigger != nil {
+		if err := r.applyCommitTrigger(trigger); err != nil {
+			// The trigger's metadata is already durable; the in-memory
+			// state will be corrected when the store restarts.
+			r.logger().Errorf("failed to apply commit trigger: %v", err)
+		}
+	}
+	reply.CommitTimestamp = txn.Timestamp
+}
+
+// prepareCommitTrigger validates the commit trigger against the
+// range's current metadata and appends the resulting metadata writes
+// and deletions to puts. The returned puts and deletions must be
+// written atomically with the committed transaction record.
+func (r *Range) prepareCommitTrigger(trigger *InternalCommitTrigger, puts []KeyValue) ([]KeyValue, []Key, error) {
+	var dels []Key
+	var metas []RangeMetadata
+	switch {
+	case trigger.SplitTrigger != nil:
+		if trigger.MergeTrigger != nil || trigger.ChangeReplicasTrigger != nil {
+			return nil, nil, util.Error("at most one commit trigger may be specified")
+		}
+		st := trigger.SplitTrigger
+		if r.rm == nil {
+			return nil, nil, util.Errorf("range %d: cannot split without a range manager", r.Meta.RangeID)
+		}
+		if st.UpdatedMeta.RangeID != r.Meta.RangeID || !bytes.Equal(st.UpdatedMeta.StartKey, r.Meta.StartKey) ||
+			!bytes.Equal(st.UpdatedMeta.EndKey, st.NewMeta.StartKey) || !bytes.Equal(st.NewMeta.EndKey, r.Meta.EndKey) {
+			return nil, nil, util.Errorf("range %d: invalid split trigger %+v for range %+v", r.Meta.RangeID, st, r.Meta)
+		}
+		if bytes.Compare(st.NewMeta.StartKey, r.Meta.StartKey) <= 0 || bytes.Compare(st.NewMeta.StartKey, r.Meta.EndKey) >= 0 {
+			return nil, nil, util.Errorf("range %d: split key %q is outside the range", r.Meta.RangeID, st.NewMeta.StartKey)
+		}
+		if _, err := r.rm.GetRange(st.NewMeta.RangeID); err == nil {
+			return nil, nil, util.Errorf("range %d: split range ID %d already in use", r.Meta.RangeID, st.NewMeta.RangeID)
+		}
+		metas = append(metas, st.UpdatedMeta, st.NewMeta)
+	case trigger.MergeTrigger != nil:
+		if trigger.ChangeReplicasTrigger != nil {
+			return nil, nil, util.Error("at most one commit trigger may be specified")
+		}
+		mt := trigger.MergeTrigger
+		if r.rm == nil {
+			return nil, nil, util.Errorf("range %d: cannot merge without a range manager", r.Meta.RangeID)
+		}
+		subsumed, err := r.rm.GetRange(mt.SubsumedRangeID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if mt.UpdatedMeta.RangeID != r.Meta.RangeID || !bytes.Equal(mt.UpdatedMeta.StartKey, r.Meta.StartKey) ||
+			!bytes.Equal(r.Meta.EndKey, subsumed.Meta.StartKey) || !bytes.Equal(mt.UpdatedMeta.EndKey, subsumed.Meta.EndKey) {
+			return nil, nil, util.Errorf("range %d: invalid merge trigger %+v for ranges %+v and %+v",
+				r.Meta.RangeID, mt, r.Meta, subsumed.Meta)
+		}
+		metas = append(metas, mt.UpdatedMeta)
+		dels = append(dels, rangeKey(mt.SubsumedRangeID), rangeStatsKey(mt.SubsumedRangeID),
+			rangeLeaderLeaseKey(mt.SubsumedRangeID), rangeClosedTimestampKey(mt.SubsumedRangeID))
+	case trigger.ChangeReplicasTrigger != nil:
+		meta := r.Meta
+		meta.Replicas.Replicas = trigger.ChangeReplicasTrigger.UpdatedReplicas
+		metas = append(metas, meta)
+	}
+	for _, meta := range metas {
+		kv, err := encodeI(rangeKey(meta.RangeID), meta)
+		if err != nil {
+			return nil, nil, err
+		}
+		puts = append(puts, kv)
+	}
+	return puts, dels, nil
+}
+
+// maybeSplit splits the range in a separate goroutine if no split is
+// already in progress and either its size exceeds the maximum range
+// size of its zone or its request rate exceeds the zone's maximum
+// QPS. Ranges which are too large are split near the midpoint of
+// their data; ranges which are too busy are split at a key which
+// divides their load evenly (see loadSplitter).
+func (r *Range) maybeSplit() {
+	if r.db == nil || r.rm == nil || !r.IsLeader() {
+		return
+	}
+	zone := r.zoneConfig()
+	if zone == nil {
+		return
+	}
+	var splitKey Key
+	if !r.ShouldSplit(zone.RangeMaxBytes) {
+		if splitKey = r.load.splitKey(time.Now(), zone.RangeMaxQPS); splitKey == nil {
+			return
+		}
+	}
+	if !atomic.CompareAndSwapInt32(&r.splitting, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&r.splitting, 0)
+		args := &AdminSplitRequest{Key: r.Meta.StartKey, SplitKey: splitKey}
+		reply := &AdminSplitResponse{}
+		if r.AdminSplit(args, reply); reply.Error != nil {
+			r.logger().Errorf("failed to split: %v", reply.Error)
+		}
+	}()
+}
+
+// AdminSplit divides the range into two ranges at args.SplitKey, or
+// at a key near the midpoint of the range's data if no split key is
+// specified. The split is executed as a distributed transaction which
+// updates the range addressing records of both ranges and commits
+// with a split trigger, which creates the new range.
+//
+// AdminSplit is not a replicated command: it must be invoked directly
+// on the range's leader and not via ReadWriteCmd, as the transaction
+// it executes is itself addressed to the range.
+func (r *Range) AdminSplit(args *AdminSplitRequest, reply *AdminSplitResponse) {
+	if r.db == nil || r.rm == nil {
+		reply.Error = util.Errorf("range %d: cannot split without a db and range manager", r.Meta.RangeID)
+		return
+	}
+	splitKey := args.SplitKey
+	if len(splitKey) == 0 {
+		var err error
+		if splitKey, err = r.mvcc.FindSplitKey(r.Meta.StartKey, r.Meta.EndKey); err != nil {
+			reply.Error = err
+			return
+		}
+	}
+	if bytes.Compare(splitKey, r.Meta.StartKey) <= 0 || bytes.Compare(splitKey, r.Meta.EndKey) >= 0 {
+		reply.Error = util.Errorf("range %d: split key %q is outside the range", r.Meta.RangeID, splitKey)
+		return
+	}
+	if len(RangeMetaKey(splitKey)) == 0 {
+		reply.Error = util.Errorf("range %d: cannot split at %q; meta1 keys must remain in the first range", r.Meta.RangeID, splitKey)
+		return
+	}
+	newRangeID, err := r.rm.NewRangeID()
+	if err != nil {
+		reply.Error = err
+		return
+	}
+
+	updatedMeta := r.Meta
+	updatedMeta.EndKey = splitKey
+	newMeta := RangeMetadata{
+		ClusterID: r.Meta.ClusterID,
+		RangeID:   newRangeID,
+		StartKey:  splitKey,
+		EndKey:    r.Meta.EndKey,
+		Replicas:  RangeDescriptor{StartKey: splitKey},
+	}
+	for _, replica := range r.Meta.Replicas.Replicas {
+		replica.RangeID = newRangeID
+		newMeta.Replicas.Replicas = append(newMeta.Replicas.Replicas, replica)
+	}
+
+	// Range addressing records are keyed by each range's end key.
+	txn := NewTransaction(r.Meta.StartKey, SERIALIZABLE, r.clock)
+	addrKeys := []Key{RangeMetaKey(updatedMeta.EndKey), RangeMetaKey(newMeta.EndKey)}
+	descs := []RangeDescriptor{updatedMeta.Replicas, newMeta.Replicas}
+	for i, key := range addrKeys {
+		if reply.Error = r.putTxnI(txn, key, descs[i]); reply.Error != nil {
+			r.endAdminTxn(txn, addrKeys[:i], nil)
+			return
+		}
+	}
+	trigger := &InternalCommitTrigger{
+		SplitTrigger: &SplitTrigger{UpdatedMeta: updatedMeta, NewMeta: newMeta},
+	}
+	if reply.Error = r.endAdminTxn(txn, addrKeys, trigger); reply.Error != nil {
+		return
+	}
+	reply.SplitKey = splitKey
+	reply.NewRangeID = newRangeID
+}
+
+// putTxnI writes the gob-serialized value to key as part of txn.
+func (r *Range) putTxnI(txn *Transaction, key Key, value interface{}) error {
+	kv, err := encodeI(key, value)
+	if err != nil {
+		return err
+	}
+	pr := <-r.db.Put(&PutRequest{
+		RequestHeader: RequestHeader{Txn: txn},
+		Key:           key,
+		Value:         kv.Value,
+	})
+	return pr.Error
+}
+
+// AdminMerge merges the range with the subsequent range, which must
+// reside on the same store and have the same replicas. The merge is
+// executed as a distributed transaction which removes the range
+// addressing record of this range, updates the record of the
+// subsequent range to describe the merged range and commits with a
+// merge trigger, which removes the subsumed range.
+//
+// Like AdminSplit, AdminMerge is not a replicated command and must be
+// invoked directly on the range's leader.
+func (r *Range) AdminMerge(args *AdminMergeRequest, reply *AdminMergeResponse) {
+	if r.db == nil || r.rm == nil {
+		reply.Error = util.Errorf("range %d: cannot merge without a db and range manager", r.Meta.RangeID)
+		return
+	}
+	if bytes.Equal(r.Meta.EndKey, KeyMax) {
+		reply.Error = util.Errorf("range %d: cannot merge final range", r.Meta.RangeID)
+		return
+	}
+	subsumed := r.rm.LookupRange(r.Meta.EndKey)
+	if subsumed == nil {
+		reply.Error = util.Errorf("range %d: subsequent range starting at %q not found on store", r.Meta.RangeID, r.Meta.EndKey)
+		return
+	}
+	if !sameReplicaStores(r.Meta.Replicas.Replicas, subsumed.Meta.Replicas.Replicas) {
+		reply.Error = util.Errorf("range %d: cannot merge with range %d; replicas differ", r.Meta.RangeID, subsumed.Meta.RangeID)
+		return
+	}
+
+	updatedMeta := r.Meta
+	updatedMeta.EndKey = subsumed.Meta.EndKey
+	txn := NewTransaction(r.Meta.StartKey, SERIALIZABLE, r.clock)
+	addrKeys := []Key{RangeMetaKey(r.Meta.EndKey), RangeMetaKey(updatedMeta.EndKey)}
+	dr := <-r.db.Delete(&DeleteRequest{RequestHeader: RequestHeader{Txn: txn}, Key: addrKeys[0]})
+	if reply.Error = dr.Error; reply.Error != nil {
+		r.endAdminTxn(txn, nil, nil)
+		return
+	}
+	if reply.Error = r.putTxnI(txn, addrKeys[1], updatedMeta.Replicas); reply.Error != nil {
+		r.endAdminTxn(txn, addrKeys[:1], nil)
+		return
+	}
+	trigger := &InternalCommitTrigger{
+		MergeTrigger: &MergeTrigger{UpdatedMeta: updatedMeta, SubsumedRangeID: subsumed.Meta.RangeID},
+	}
+	reply.Error = r.endAdminTxn(txn, addrKeys, trigger)
+}
+
+// sameReplicaStores returns true if the two replica sets are located
+// on the same stores.
+func sameReplicaStores(a, b []Replica) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, ra := range a {
+		found := false
+		for _, rb := range b {
+			if ra.NodeID == rb.NodeID && ra.StoreID == rb.StoreID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ChangeReplicas replaces the range's replica set with
+// updatedReplicas. Replicas being added are first instantiated on
+// their stores from a snapshot of the range (see Range.Snapshot). The
+// change is then executed as a distributed transaction which updates
+// the range's addressing record and commits with a change replicas
+// trigger, which updates the range metadata. Removed replicas are
+// destroyed by the replica GC of their stores.
+//
+// TODO(spencer): added replicas must be kept up to date via raft once
+// replication is in place.
+//
+// Like AdminSplit, ChangeReplicas is not a replicated command and
+// must be invoked directly on the range's leader.
+func (r *Range) ChangeReplicas(updatedReplicas []Replica) error {
+	if r.db == nil {
+		return util.Errorf("range %d: cannot change replicas without a db", r.Meta.RangeID)
+	}
+	if len(updatedReplicas) == 0 {
+		return util.Errorf("range %d: cannot remove all replicas", r.Meta.RangeID)
+	}
+	if err := r.sendSnapshots(updatedReplicas); err != nil {
+		return err
+	}
+	desc := r.Meta.Replicas
+	desc.Replicas = updatedReplicas
+	txn := NewTransaction(r.Meta.StartKey, SERIALIZABLE, r.clock)
+	addrKeys := []Key{RangeMetaKey(r.Meta.EndKey)}
+	if err := r.putTxnI(txn, addrKeys[0], desc); err != nil {
+		r.endAdminTxn(txn, nil, nil)
+		return err
+	}
+	trigger := &InternalCommitTrigger{
+		ChangeReplicasTrigger: &ChangeReplicasTrigger{UpdatedReplicas: updatedReplicas},
+	}
+	return r.endAdminTxn(txn, addrKeys, trigger)
+}
+
+// sendSnapshots sends a snapshot of the range to each replica in
+// updatedReplicas which isn't among the range's current replicas. The
+// snapshot is taken once and shared by all added replicas.
+func (r *Range) sendSnapshots(updatedReplicas []Replica) error {
+	var snap *RangeSnapshot
+	defer func() {
+		if snap != nil {
+			snap.release()
+		}
+	}()
+	for _, replica := range updatedReplicas {
+		existing := false
+		for _, cur := range r.Meta.Replicas.Replicas {
+			if sameReplica(cur, replica) {
+				existing = true
+				break
+			}
+		}
+		if existing {
+			continue
+		}
+		if snap == nil {
+			var err error
+			if snap, err = r.Snapshot(updatedReplicas); err != nil {
+				return err
+			}
+		}
+		if err := r.sendSnapshot(snap, replica); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendSnapshot sends the snapshot to the replica once the store's
+// limits on concurrent snapshot sends and snapshot bytes permit.
+func (r *Range) sendSnapshot(snap *RangeSnapshot, replica Replica) error {
+	if err := r.throttle.acquireSnapshotSend(); err != nil {
+		return err
+	}
+	defer r.throttle.releaseSnapshotSend()
+	if err := r.throttle.wait(throttleSnapshot, snap.size()); err != nil {
+		return err
+	}
+	reply := <-r.db.InternalSnapshot(&InternalSnapshotRequest{
+		RequestHeader: RequestHeader{Replica: replica},
+		Snapshot:      *snap,
+	})
+	if reply.Error != nil {
+		return util.Errorf("range %d: unable to send snapshot to replica %+v: %v", r.Meta.RangeID, replica, reply.Error)
+	}
+	return nil
+}
+
+// endAdminTxn commits txn with the commit trigger, or aborts it if
+// trigger is nil or the commit fails, and then resolves the intents
+// written at keys.
+func (r *Range) endAdminTxn(txn *Transaction, keys []Key, trigger *InternalCommitTrigger) error {
+	etReply := <-r.db.EndTransaction(&EndTransactionRequest{
+		RequestHeader:         RequestHeader{Txn: txn},
+		Commit:                trigger != nil,
+		Keys:                  keys,
+		InternalCommitTrigger: trigger,
+	})
+	err := etReply.Error
+	resolveTxn := *txn
+	if etReply.Txn != nil {
+		resolveTxn = *etReply.Txn
+	}
+	if err != nil || trigger == nil {
+		resolveTxn.Status = ABORTED
+		if trigger != nil {
+			// Abort the transaction record so the intents can't be
+			// committed by a pusher.
+			<-r.db.EndTransaction(&EndTransactionRequest{RequestHeader: RequestHeader{Txn: txn}})
+		}
+	}
+	for _, key := range keys {
+		rReply := <-r.db.InternalResolveIntent(&InternalResolveIntentRequest{
+			RequestHeader: RequestHeader{Txn: &resolveTxn},
+			Key:           key,
+		})
+		if rReply.Error != nil {
+			r.logger().Warningf("failed to resolve intent at %q: %v", key, rReply.Error)
+		}
+	}
+	return err
+}
+
+// applyCommitTrigger applies the in-memory side effects of a commit
+// trigger whose metadata writes have been committed by
+// prepareCommitTrigger.
+func (r *Range) applyCommitTrigger(trigger *InternalCommitTrigger) error {
+	switch {
+	case trigger.SplitTrigger != nil:
+		r.setMeta(trigger.SplitTrigger.UpdatedMeta)
+		if err := r.recomputeStats(); err != nil {
+			return err
+		}
+		if err := r.respCache.CopyInto(trigger.SplitTrigger.NewMeta.RangeID); err != nil {
+			return err
+		}
+		if err := r.abortCache.CopyInto(trigger.SplitTrigger.NewMeta.RangeID); err != nil {
+			return err
+		}
+		return r.rm.AddRange(trigger.SplitTrigger.NewMeta)
+	case trigger.MergeTrigger != nil:
+		subsumed, err := r.rm.GetRange(trigger.MergeTrigger.SubsumedRangeID)
+		if err != nil {
+			return err
+		}
+		if err := r.rm.RemoveRange(subsumed.Meta.RangeID); err != nil {
+			return err
+		}
+		if err := subsumed.respCache.CopyInto(r.Meta.RangeID); err != nil {
+			return err
+		}
+		if err := subsumed.respCache.ClearData(); err != nil {
+			return err
+		}
+		if err := subsumed.abortCache.CopyInto(r.Meta.RangeID); err != nil {
+			return err
+		}
+		if err := subsumed.abortCache.ClearData(); err != nil {
+			return err
+		}
+		r.setMeta(trigger.MergeTrigger.UpdatedMeta)
+		return r.recomputeStats()
+	case trigger.ChangeReplicasTrigger != nil:
+		meta := r.getMeta()
+		meta.Replicas.Replicas = trigger.ChangeReplicasTrigger.UpdatedReplicas
+		r.setMeta(meta)
+		r.maybeGossipFirstRange()
+	}
+	return nil
+}
+
+// Batch executes the requests contained in args in order, as a
+// single command. Requests inherit the batch's timestamp and
+// transaction unless they specify their own. Execution stops at the
+// first error, which is returned as the batch's error; the effects
+// of previously executed requests are not undone, so batches which
+// require atomicity should be executed within a transaction.
+func (r *Range) Batch(args *BatchRequest, reply *BatchResponse) {
+	for i, subArgs := range args.Requests {
+		method, _, subReply, ok := batchEntry(subArgs)
+		if !ok {
+			reply.Error = util.Errorf("request %d of type %T may not be batched", i, subArgs)
+			return
+		}
+		header := subArgs.Header()
+		if header.Timestamp == (hlc.HLTimestamp{}) {
+			header.Timestamp = args.Timestamp
+		}
+		if header.Txn == nil {
+			header.Txn = args.Txn
+		}
+		reply.Responses = append(reply.Responses, subReply)
+		if err := r.executeCmd(method, subArgs, subReply); err != nil {
+			reply.Error = err
+			return
+		}
+		if txn := subReply.Header().Txn; txn != nil {
+			reply.Txn = txn
+		}
+	}
 }
 
 // AccumulateTS is used internally to aggregate statistics over key
@@ -446,8 +2150,16 @@ func (r *Range) InternalRangeLookup(args *InternalRangeLookupRequest, reply *Int
 	}
 
 	// We want to search for the metadata key just greater than args.Key.
+	// The exception is meta1 KeyMax, the key at which the addressing
+	// record of meta2 KeyMax is looked up: that's the record of the last
+	// meta2 range, meta1 KeyMax itself. Reverse lookups search for the
+	// metadata key equal to or greater than args.Key, that of the range
+	// ending at or after the user key.
 	nextKey := MakeKey(args.Key, Key{0})
-	kvs, err := r.engine.scan(nextKey, KeyMax, 1)
+	if args.Reverse || bytes.Equal(args.Key, MakeKey(KeyMeta1Prefix, KeyMax)) {
+		nextKey = args.Key
+	}
+	kvs, err := r.mvcc.Scan(nextKey, KeyMax, 1, args.Timestamp, args.Txn)
 	if err != nil {
 		reply.Error = err
 		return
@@ -463,10 +2175,239 @@ func (r *Range) InternalRangeLookup(args *InternalRangeLookupRequest, reply *Int
 		reply.Error = err
 		return
 	}
-	if bytes.Compare(args.Key, reply.Range.StartKey) < 0 {
+	// args.Key is the addressing record key of some key (see
+	// RangeMetaKey), which the range found must contain.
+	addrKey := args.Key[len(KeyMeta2Prefix):]
+	if bytes.HasPrefix(args.Key, KeyMeta1Prefix) {
+		addrKey = MakeKey(KeyMeta2Prefix, args.Key[len(KeyMeta1Prefix):])
+	}
+	if c := bytes.Compare(addrKey, reply.Range.StartKey); c < 0 || (args.Reverse && c == 0) {
 		// args.Key doesn't belong to this range. We are perhaps searching the wrong node?
 		reply.Error = util.Errorf("no range found for key %q in range: %+v", args.Key, r.Meta)
 		return
 	}
 	reply.EndKey = kvs[0].Key
 }
+
+// InternalPushTxn attempts to resolve a conflict between the pusher
+// (the transaction in the header, if any) and the pushee, whose
+// record is stored in this range. If the pushee has already committed
+// or aborted, its record is returned unchanged. Otherwise, the
+// transaction with the higher priority wins. Non-transactional
+// pushers are assigned a random priority. Pushees abandoned by their
+// coordinators lose regardless of priority; if args.ExpiredOnly is
+// set, only they lose. If the pusher wins, the pushee is either
+// aborted or has its timestamp pushed past the request timestamp,
+// according to args.Abort, and the updated record is persisted. If
+// the pushee wins, a TransactionPushError is returned and the pusher
+// should back off and retry.
+func (r *Range) InternalPushTxn(args *InternalPushTxnRequest, reply *InternalPushTxnResponse) {
+	if args.Txn != nil && args.Txn.ID == args.PusheeTxn.ID {
+		reply.Error = util.Errorf("cannot push self: %s", args.Txn)
+		return
+	}
+	key := txnKey(args.PusheeTxn.Key, args.PusheeTxn.ID)
+
+	// Fetch the existing record, if any; otherwise, use the pushee
+	// transaction as supplied with the request.
+	ok, _, err := getI(r.engine, key, &reply.PusheeTxn)
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	if !ok {
+		reply.PusheeTxn = args.PusheeTxn
+	}
+	if reply.PusheeTxn.Status != PENDING {
+		return
+	}
+	// Already pushed far enough?
+	if !args.Abort && args.Timestamp.Less(reply.PusheeTxn.Timestamp) {
+		return
+	}
+
+	// A pushee abandoned by its coordinator is pushed regardless of
+	// priority.
+	pusherPriority := util.CachedRand.Int31()
+	if args.Txn != nil {
+		pusherPriority = args.Txn.Priority
+	}
+	if (args.ExpiredOnly || pusherPriority <= reply.PusheeTxn.Priority) && !reply.PusheeTxn.isExpired(r.clock.Now()) {
+		reply.Error = &TransactionPushError{PusheeTxn: reply.PusheeTxn}
+		return
+	}
+
+	if args.Abort {
+		reply.PusheeTxn.Status = ABORTED
+	} else {
+		reply.PusheeTxn.Timestamp = args.Timestamp.Next()
+	}
+	reply.Error = putI(r.engine, key, reply.PusheeTxn)
+}
+
+// InternalHeartbeatTxn records the heartbeat of the transaction in
+// the header at the request's timestamp, creating its record if
+// necessary, and returns the transaction as recorded. The records of
+// transactions which have committed or aborted aren't updated; the
+// coordinator learns of their status from the reply.
+func (r *Range) InternalHeartbeatTxn(args *InternalHeartbeatTxnRequest, reply *InternalHeartbeatTxnResponse) {
+	if args.Txn == nil {
+		reply.Error = util.Error("no transaction specified to InternalHeartbeatTxn")
+		return
+	}
+	key := txnKey(args.Txn.Key, args.Txn.ID)
+	var txn Transaction
+	ok, _, err := getI(r.engine, key, &txn)
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	if !ok {
+		txn = *args.Txn
+	}
+	reply.Txn = &txn
+	if txn.Status != PENDING {
+		return
+	}
+	if txn.LastHeartbeat.Less(args.Timestamp) {
+		txn.LastHeartbeat = args.Timestamp
+	}
+	reply.Error = putI(r.engine, key, txn)
+}
+
+// InternalResolveIntent resolves the write intent at args.Key
+// according to the status of the transaction in the header. The
+// intent of an aborted transaction is removed in the same batch as
+// the transaction's abort cache entry is written (see
+// executeCachedCmd). Since the writes of failed commands are
+// committed as well, the abort cache entry is written first: an
+// intent is never removed without it, lest the transaction's
+// coordinator write the key again unawares.
+func (r *Range) InternalResolveIntent(args *InternalResolveIntentRequest, reply *InternalResolveIntentResponse) {
+	if args.Txn.Status == ABORTED {
+		if reply.Error = r.abortCache.Add(args.Txn); reply.Error != nil {
+			return
+		}
+	}
+	reply.Error = r.mvcc.ResolveWriteIntent(args.Key, args.Txn)
+}
+
+// InternalGC garbage collects the versions of keys in the range
+// which aren't visible to reads at or after args.GCThreshold, along
+// with stale transaction records (see gcTxnRecords) and the response
+// and abort cache entries of commands and transactions older than
+// args.GCThreshold.
+func (r *Range) InternalGC(args *InternalGCRequest, reply *InternalGCResponse) {
+	meta := r.getMeta()
+	if reply.Error = r.mvcc.GarbageCollect(meta.StartKey, meta.EndKey, args.GCThreshold); reply.Error != nil {
+		return
+	}
+	if reply.Error = r.gcTxnRecords(args.GCThreshold); reply.Error != nil {
+		return
+	}
+	if reply.Error = r.respCache.GC(args.GCThreshold); reply.Error != nil {
+		return
+	}
+	reply.Error = r.abortCache.GC(args.GCThreshold)
+}
+
+// gcTxnRecords cleans up the stale records of transactions anchored
+// in the range. Pending transactions whose coordinators have stopped
+// heartbeating them are aborted, so that their intents are removed by
+// the readers and writers which encounter them. The records of
+// aborted transactions older than threshold are removed; the abort
+// cache prevents their coordinators from writing further intents.
+// The records of committed transactions are retained, since any of
+// their intents which remain unresolved would otherwise be aborted.
+func (r *Range) gcTxnRecords(threshold hlc.HLTimestamp) error {
+	meta := r.getMeta()
+	kvs, err := r.engine.scan(txnKey(meta.StartKey, ""), txnKey(meta.EndKey, ""), 0)
+	if err != nil {
+		return err
+	}
+	now := r.clock.Now()
+	var puts []KeyValue
+	var dels []Key
+	for _, kv := range kvs {
+		var txn Transaction
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value.Bytes)).Decode(&txn); err != nil {
+			return err
+		}
+		switch {
+		case txn.isExpired(now):
+			r.logger().Infof("aborting abandoned %s", &txn)
+			txn.Status = ABORTED
+			txnKV, err := encodeI(kv.Key, txn)
+			if err != nil {
+				return err
+			}
+			puts = append(puts, txnKV)
+		case txn.Status == ABORTED && txn.Timestamp.Less(threshold):
+			dels = append(dels, kv.Key)
+		}
+	}
+	if len(puts) == 0 && len(dels) == 0 {
+		return nil
+	}
+	return r.engine.writeBatch(puts, dels)
+}
+
+// InternalChecksum computes the SHA-256 checksum of the range's
+// versioned data, read from an engine snapshot.
+//
+// TODO(spencer): when the command is proposed via raft, each replica
+// will compute its checksum upon applying the command, and so at the
+// same index in the range's log. Until then, replicas other than the
+// leader receive the command directly and compute the checksum of
+// their data at the time it arrives.
+func (r *Range) InternalChecksum(args *InternalChecksumRequest, reply *InternalChecksumResponse) {
+	meta := r.getMeta()
+	engSnap, err := r.engine.snapshot()
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	defer engSnap.release()
+	kvs, err := engSnap.scan(mvccEncodeKey(meta.StartKey), mvccEncodeKey(meta.EndKey), 0)
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	reply.Checksum = snapshotChecksum(kvs)
+}
+
+// InternalCloseTimestamp advances the range's closed timestamp to
+// args.ClosedTimestamp. Closed timestamps never regress; an older
+// timestamp is ignored.
+func (r *Range) InternalCloseTimestamp(args *InternalCloseTimestampRequest, reply *InternalCloseTimestampResponse) {
+	r.leaseMu.Lock()
+	defer r.leaseMu.Unlock()
+	if !r.closedTS.Less(args.ClosedTimestamp) {
+		return
+	}
+	if reply.Error = putI(r.engine, rangeClosedTimestampKey(r.Meta.RangeID), args.ClosedTimestamp); reply.Error != nil {
+		return
+	}
+	r.closedTS = args.ClosedTimestamp
+}
+
+// InternalLeaderLease sets the range's leader lease to args.Lease.
+// The lease is rejected if it overlaps an unexpired lease held by a
+// different replica; the holder of a lease may extend or shorten it.
+func (r *Range) InternalLeaderLease(args *InternalLeaderLeaseRequest, reply *InternalLeaderLeaseResponse) {
+	lease := args.Lease
+	if lease.Expiration.Less(lease.Start) {
+		reply.Error = util.Errorf("range %d: lease %+v expires before it starts", r.Meta.RangeID, lease)
+		return
+	}
+	r.leaseMu.Lock()
+	defer r.leaseMu.Unlock()
+	if !sameReplica(r.lease.Replica, lease.Replica) && lease.Start.Less(r.lease.Expiration) {
+		reply.Error = util.Errorf("range %d: lease %+v overlaps lease %+v", r.Meta.RangeID, lease, r.lease)
+		return
+	}
+	if reply.Error = putI(r.engine, rangeLeaderLeaseKey(r.Meta.RangeID), lease); reply.Error != nil {
+		return
+	}
+	r.lease = lease
+}
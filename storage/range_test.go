@@ -20,10 +20,15 @@ package storage
 import (
 	"bytes"
 	"encoding/gob"
+	"fmt"
+	"math"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/hlc"
+	"github.com/cockroachdb/cockroach/util"
 )
 
 var (
@@ -58,24 +63,96 @@ var (
 	}
 )
 
-// createTestEngine creates an in-memory engine and initializes some
-// default configuration settings.
-func createTestEngine(t *testing.T) Engine {
-	engine := NewInMem(Attributes([]string{"dc1", "mem"}), 1<<20)
-	if err := putI(engine, KeyConfigAccountingPrefix, testDefaultAcctConfig); err != nil {
-		t.Fatal(err)
-	}
-	if err := putI(engine, KeyConfigPermissionPrefix, testDefaultPermConfig); err != nil {
+// putTestConfig gob-encodes value and writes it to key via MVCC.
+func putTestConfig(engine Engine, key Key, value interface{}, t *testing.T) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
 		t.Fatal(err)
 	}
-	if err := putI(engine, KeyConfigZonePrefix, testDefaultZoneConfig); err != nil {
+	if err := NewMVCC(engine).Put(key, hlc.HLTimestamp{WallTime: 1}, Value{Bytes: buf.Bytes()}, nil); err != nil {
 		t.Fatal(err)
 	}
+}
+
+// createTestEngine creates an in-memory engine and initializes some
+// default configuration settings.
+func createTestEngine(t *testing.T) Engine {
+	engine := NewInMem(Attributes([]string{"dc1", "mem"}), 1<<20)
+	putTestConfig(engine, KeyConfigAccountingPrefix, testDefaultAcctConfig, t)
+	putTestConfig(engine, KeyConfigPermissionPrefix, testDefaultPermConfig, t)
+	putTestConfig(engine, KeyConfigZonePrefix, testDefaultZoneConfig, t)
 	return engine
 }
 
+// rangeDB implements the DB interface by executing requests
+// directly against a single range.
+type rangeDB struct {
+	rng *Range
+}
+
+func (db *rangeDB) Put(args *PutRequest) <-chan *PutResponse {
+	replyChan := make(chan *PutResponse, 1)
+	reply := &PutResponse{}
+	<-db.rng.ReadWriteCmd("Put", args, reply)
+	replyChan <- reply
+	return replyChan
+}
+
+func (db *rangeDB) Scan(args *ScanRequest) <-chan *ScanResponse {
+	replyChan := make(chan *ScanResponse, 1)
+	reply := &ScanResponse{}
+	db.rng.ReadOnlyCmd("Scan", args, reply)
+	replyChan <- reply
+	return replyChan
+}
+
+func (db *rangeDB) Delete(args *DeleteRequest) <-chan *DeleteResponse {
+	replyChan := make(chan *DeleteResponse, 1)
+	reply := &DeleteResponse{}
+	<-db.rng.ReadWriteCmd("Delete", args, reply)
+	replyChan <- reply
+	return replyChan
+}
+
+func (db *rangeDB) EndTransaction(args *EndTransactionRequest) <-chan *EndTransactionResponse {
+	replyChan := make(chan *EndTransactionResponse, 1)
+	reply := &EndTransactionResponse{}
+	<-db.rng.ReadWriteCmd("EndTransaction", args, reply)
+	replyChan <- reply
+	return replyChan
+}
+
+func (db *rangeDB) InternalPushTxn(args *InternalPushTxnRequest) <-chan *InternalPushTxnResponse {
+	replyChan := make(chan *InternalPushTxnResponse, 1)
+	reply := &InternalPushTxnResponse{}
+	<-db.rng.ReadWriteCmd("InternalPushTxn", args, reply)
+	replyChan <- reply
+	return replyChan
+}
+
+func (db *rangeDB) InternalResolveIntent(args *InternalResolveIntentRequest) <-chan *InternalResolveIntentResponse {
+	replyChan := make(chan *InternalResolveIntentResponse, 1)
+	reply := &InternalResolveIntentResponse{}
+	<-db.rng.ReadWriteCmd("InternalResolveIntent", args, reply)
+	replyChan <- reply
+	return replyChan
+}
+
+func (db *rangeDB) InternalSnapshot(args *InternalSnapshotRequest) <-chan *InternalSnapshotResponse {
+	replyChan := make(chan *InternalSnapshotResponse, 1)
+	replyChan <- &InternalSnapshotResponse{ResponseHeader: ResponseHeader{Error: util.Error("rangeDB cannot send snapshots")}}
+	return replyChan
+}
+
+func (db *rangeDB) InternalChecksum(args *InternalChecksumRequest) <-chan *InternalChecksumResponse {
+	replyChan := make(chan *InternalChecksumResponse, 1)
+	replyChan <- &InternalChecksumResponse{ResponseHeader: ResponseHeader{Error: util.Error("rangeDB cannot request checksums")}}
+	return replyChan
+}
+
 // createTestRange creates a new range initialized to the full extent
 // of the keyspace. The gossip instance is also returned for testing.
+// The range pushes transactions and resolves intents via itself.
 func createTestRange(engine Engine, t *testing.T) (*Range, *gossip.Gossip) {
 	rm := RangeMetadata{
 		RangeID:  0,
@@ -84,11 +161,87 @@ func createTestRange(engine Engine, t *testing.T) (*Range, *gossip.Gossip) {
 		Replicas: testRangeDescriptor,
 	}
 	g := gossip.New()
-	r := NewRange(rm, engine, nil, g)
+	r := NewRange(rm, hlc.NewHLClock(hlc.UnixNano), engine, nil, g, nil)
+	r.db = &rangeDB{rng: r}
 	r.Start()
 	return r, g
 }
 
+// TestRangeStopDrainsCommands verifies that stopping a range waits
+// for pending read-write commands to be executed and that commands
+// issued once the range is stopping are rejected.
+func TestRangeStopDrainsCommands(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	var pending []<-chan error
+	for i := 0; i < 10; i++ {
+		args := &PutRequest{Key: Key(fmt.Sprintf("a%d", i)), Value: Value{Bytes: []byte("value")}}
+		pending = append(pending, r.ReadWriteCmd("Put", args, &PutResponse{}))
+	}
+	r.Stop()
+	for i, done := range pending {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("%d: expected pending command to succeed: %v", i, err)
+			}
+		default:
+			t.Errorf("%d: expected pending command to be executed before range stopped", i)
+		}
+	}
+	reply := &PutResponse{}
+	if err := <-r.ReadWriteCmd("Put", &PutRequest{Key: Key("b"), Value: Value{Bytes: []byte("value")}}, reply); err == nil || reply.Error == nil {
+		t.Fatal("expected command on stopped range to be rejected")
+	}
+	if value, err := r.mvcc.Get(Key("b"), r.clock.Now(), nil); err != nil || value != nil {
+		t.Errorf("expected rejected command not to be applied; got %+v, %v", value, err)
+	}
+}
+
+// TestRangeCommandQueue verifies that reads and writes wait for
+// overlapping in-flight writes to complete, while commands addressing
+// other keys proceed.
+func TestRangeCommandQueue(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+
+	// Simulate an in-flight write to key "a".
+	r.cmdQMu.Lock()
+	cmdKey := r.cmdQ.Add(Key("a"), nil, false)
+	r.cmdQMu.Unlock()
+
+	getDone := make(chan error, 1)
+	go func() {
+		getDone <- r.ReadOnlyCmd("Get", &GetRequest{Key: Key("a")}, &GetResponse{})
+	}()
+	putDone := make(chan error, 1)
+	go func() {
+		args := &PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}
+		putDone <- <-r.ReadWriteCmd("Put", args, &PutResponse{})
+	}()
+
+	// Commands addressing other keys aren't blocked.
+	if err := r.ReadOnlyCmd("Get", &GetRequest{Key: Key("b")}, &GetResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-r.ReadWriteCmd("Put", &PutRequest{Key: Key("b"), Value: Value{Bytes: []byte("value")}}, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-getDone:
+		t.Fatalf("expected read to wait on overlapping write; got %v", err)
+	case err := <-putDone:
+		t.Fatalf("expected write to wait on overlapping write; got %v", err)
+	case <-time.After(5 * time.Millisecond):
+	}
+
+	r.endCmd(cmdKey)
+	for _, done := range []chan error{getDone, putDone} {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
 // TestRangeGossipFirstRange verifies that the first range gossips its location.
 func TestRangeGossipFirstRange(t *testing.T) {
 	r, g := createTestRange(createTestEngine(t), t)
@@ -102,6 +255,28 @@ func TestRangeGossipFirstRange(t *testing.T) {
 	}
 }
 
+// TestRangeGossipFirstRangeUpdate verifies that the first range
+// re-gossips its current descriptor, replacing a stale one.
+func TestRangeGossipFirstRangeUpdate(t *testing.T) {
+	r, g := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	// Overwrite the gossipped descriptor, as a stale replica might.
+	if err := g.AddInfo(gossip.KeyFirstRangeMetadata, RangeDescriptor{StartKey: KeyMin}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	meta := r.getMeta()
+	meta.Replicas.Replicas = append(append([]Replica(nil), meta.Replicas.Replicas...), Replica{NodeID: 2, StoreID: 2})
+	r.setMeta(meta)
+	r.maybeGossipFirstRange()
+	info, err := g.GetInfo(gossip.KeyFirstRangeMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info.(RangeDescriptor), meta.Replicas) {
+		t.Errorf("expected gossipped descriptor %+v; got %+v", meta.Replicas, info)
+	}
+}
+
 // TestRangeGossipAllConfigs verifies that all config types are
 // gossipped.
 func TestRangeGossipAllConfigs(t *testing.T) {
@@ -127,6 +302,38 @@ func TestRangeGossipAllConfigs(t *testing.T) {
 	}
 }
 
+// TestRangeGossipConfigsEncoding verifies that gossiped configs
+// decode as the pointers they're gossiped as when they're received by
+// other nodes.
+func TestRangeGossipConfigsEncoding(t *testing.T) {
+	configs := []*prefixConfig{
+		&prefixConfig{KeyMin, &testDefaultAcctConfig},
+		&prefixConfig{KeyMin, &testDefaultPermConfig},
+		&prefixConfig{KeyMin, &testDefaultZoneConfig},
+	}
+	// Infos are gob-encoded as interface values by gossip.
+	type info struct {
+		Val interface{}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&info{configs}); err != nil {
+		t.Fatal(err)
+	}
+	decoded := &info{}
+	if err := gob.NewDecoder(&buf).Decode(decoded); err != nil {
+		t.Fatal(err)
+	}
+	decodedConfigs, ok := decoded.Val.([]*prefixConfig)
+	if !ok || len(decodedConfigs) != len(configs) {
+		t.Fatalf("expected %d prefix configs; got %#v", len(configs), decoded.Val)
+	}
+	for i, pc := range decodedConfigs {
+		if !reflect.DeepEqual(pc.Config, configs[i].Config) {
+			t.Errorf("%d: expected config %#v; got %#v", i, configs[i].Config, pc.Config)
+		}
+	}
+}
+
 // TestRangeGossipConfigWithMultipleKeyPrefixes verifies that multiple
 // key prefixes for a config are gossipped.
 func TestRangeGossipConfigWithMultipleKeyPrefixes(t *testing.T) {
@@ -139,9 +346,7 @@ func TestRangeGossipConfigWithMultipleKeyPrefixes(t *testing.T) {
 		},
 	}
 	key := MakeKey(KeyConfigPermissionPrefix, Key("/db1"))
-	if err := putI(engine, key, db1Perm); err != nil {
-		t.Fatal(err)
-	}
+	putTestConfig(engine, key, db1Perm, t)
 	r, g := createTestRange(engine, t)
 	defer r.Stop()
 
@@ -195,3 +400,1081 @@ func TestRangeGossipConfigUpdates(t *testing.T) {
 		t.Errorf("expected gossiped configs to be equal %s vs %s", configs, expConfigs)
 	}
 }
+
+// TestRangePermissions verifies that reads and writes are subject to
+// the gossiped permission configs of the requesting user, except for
+// requests made by the system, and that clients may only resolve
+// intents on keys they may write.
+func TestRangePermissions(t *testing.T) {
+	engine := createTestEngine(t)
+	db1Perm := PermConfig{
+		Perms: []Permission{
+			{Users: []string{"spencer"}, Read: true, Write: true},
+			{Users: []string{"foo"}, Read: true},
+		},
+	}
+	putTestConfig(engine, MakeKey(KeyConfigPermissionPrefix, Key("/db1")), db1Perm, t)
+	r, _ := createTestRange(engine, t)
+	defer r.Stop()
+
+	put := func(user string, key Key) error {
+		return <-r.ReadWriteCmd("Put", &PutRequest{
+			RequestHeader: RequestHeader{User: user},
+			Key:           key,
+			Value:         Value{Bytes: []byte("value")},
+		}, &PutResponse{})
+	}
+	get := func(user string, key Key) error {
+		return r.ReadOnlyCmd("Get", &GetRequest{RequestHeader: RequestHeader{User: user}, Key: key}, &GetResponse{})
+	}
+	scan := func(user string, start, end Key) error {
+		return r.ReadOnlyCmd("Scan", &ScanRequest{
+			RequestHeader: RequestHeader{User: user},
+			StartKey:      start,
+			EndKey:        end,
+		}, &ScanResponse{})
+	}
+	resolve := func(user string, key Key) error {
+		txn := NewTransaction(key, SERIALIZABLE, r.clock)
+		txn.Status = ABORTED
+		return <-r.ReadWriteCmd("InternalResolveIntent", &InternalResolveIntentRequest{
+			RequestHeader: RequestHeader{User: user, Txn: txn},
+			Key:           key,
+		}, &InternalResolveIntentResponse{})
+	}
+	batch := func(user string, keys ...Key) error {
+		args := &BatchRequest{RequestHeader: RequestHeader{User: user}}
+		for _, key := range keys {
+			args.Requests = append(args.Requests, &PutRequest{Key: key, Value: Value{Bytes: []byte("value")}})
+		}
+		return <-r.ReadWriteCmd("Batch", args, &BatchResponse{})
+	}
+
+	testCases := []struct {
+		err      error
+		denied   bool
+		denyKey  Key
+		denyRead bool
+	}{
+		{put("spencer", Key("/db1/a")), false, nil, false},
+		{put("foo", Key("/db1/a")), true, Key("/db1/a"), false},
+		{get("foo", Key("/db1/a")), false, nil, false},
+		{get("bob", Key("/db1/a")), true, Key("/db1/a"), true},
+		{put("bob", Key("/db2/a")), false, nil, false},
+		{scan("bob", Key("/db2"), Key("/db3")), false, nil, false},
+		{scan("bob", Key("/a"), KeyMax), true, Key("/db1"), true},
+		{scan("foo", Key("/a"), KeyMax), false, nil, false},
+		{batch("bob", Key("/db2/b"), Key("/db1/b")), true, Key("/db1/b"), false},
+		{batch("spencer", Key("/db2/b"), Key("/db1/b")), false, nil, false},
+		// Clients may only resolve intents on keys they may write.
+		{resolve("foo", Key("/db1/a")), true, Key("/db1/a"), false},
+		{resolve("spencer", Key("/db1/a")), false, nil, false},
+		// The system isn't subject to permissions.
+		{put("", Key("/db1/c")), false, nil, false},
+	}
+	for i, test := range testCases {
+		pErr, ok := test.err.(*PermissionError)
+		if !test.denied {
+			if test.err != nil {
+				t.Errorf("%d: unexpected error: %v", i, test.err)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%d: expected permission error; got %v", i, test.err)
+		} else if !bytes.Equal(pErr.Key, test.denyKey) || pErr.Write == test.denyRead {
+			t.Errorf("%d: unexpected permission error: %v", i, pErr)
+		}
+	}
+}
+
+// writeTestIntent writes an intent for txn at key via a Put command
+// and verifies that a non-transactional read at a later timestamp
+// would conflict with it.
+func writeTestIntent(r *Range, key Key, txn *Transaction, t *testing.T) {
+	args := &PutRequest{
+		RequestHeader: RequestHeader{Timestamp: txn.Timestamp, Txn: txn},
+		Key:           key,
+		Value:         Value{Bytes: []byte("intent")},
+	}
+	if err := <-r.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.mvcc.Get(key, txn.Timestamp, nil); err == nil {
+		t.Fatal("expected write intent error")
+	}
+}
+
+// TestRangeReadResolvesCommittedIntent verifies that a read which
+// encounters an intent of a committed transaction resolves the intent
+// and returns the committed value.
+func TestRangeReadResolvesCommittedIntent(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	key := Key("a")
+	txn := NewTransaction(key, SERIALIZABLE, r.clock)
+	writeTestIntent(r, key, txn, t)
+
+	etArgs := &EndTransactionRequest{RequestHeader: RequestHeader{Txn: txn}, Commit: true}
+	etReply := &EndTransactionResponse{}
+	if err := <-r.ReadWriteCmd("EndTransaction", etArgs, etReply); err != nil {
+		t.Fatal(err)
+	}
+	if etReply.Txn.Status != COMMITTED || etReply.CommitTimestamp != txn.Timestamp {
+		t.Fatalf("expected commit at %+v; got %+v", txn.Timestamp, etReply)
+	}
+
+	reply := &GetResponse{}
+	if err := r.ReadOnlyCmd("Get", &GetRequest{Key: key}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Value.Bytes) != "intent" {
+		t.Errorf("expected committed value; got %+v", reply.Value)
+	}
+	if meta, _, err := r.mvcc.getMetadata(key); err != nil || meta == nil || meta.Txn != nil {
+		t.Errorf("expected intent to be resolved; got %+v, %v", meta, err)
+	}
+}
+
+// TestRangeReadResolvesAbortedIntent verifies that a read which
+// encounters an intent of an aborted transaction removes the intent.
+func TestRangeReadResolvesAbortedIntent(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	key := Key("a")
+	txn := NewTransaction(key, SERIALIZABLE, r.clock)
+	writeTestIntent(r, key, txn, t)
+
+	etArgs := &EndTransactionRequest{RequestHeader: RequestHeader{Txn: txn}, Commit: false}
+	if err := <-r.ReadWriteCmd("EndTransaction", etArgs, &EndTransactionResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := &GetResponse{}
+	if err := r.ReadOnlyCmd("Get", &GetRequest{Key: key}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Value.Bytes != nil {
+		t.Errorf("expected no value; got %+v", reply.Value)
+	}
+	if meta, _, err := r.mvcc.getMetadata(key); err != nil || meta != nil {
+		t.Errorf("expected intent to be removed; got %+v, %v", meta, err)
+	}
+}
+
+// TestRangeReadPushesPendingIntent verifies that a read which
+// encounters the intent of a pending, lower-priority transaction
+// pushes the transaction's timestamp past the read and succeeds. The
+// pushed transaction is then unable to commit at its original
+// timestamp.
+func TestRangeReadPushesPendingIntent(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	key := Key("a")
+	txn := NewTransaction(key, SERIALIZABLE, r.clock)
+	txn.Priority = 0
+	writeTestIntent(r, key, txn, t)
+
+	reader := NewTransaction(Key("b"), SERIALIZABLE, r.clock)
+	reader.Priority = 1
+	readTS := r.clock.Now()
+	reply := &GetResponse{}
+	args := &GetRequest{RequestHeader: RequestHeader{Timestamp: readTS, Txn: reader}, Key: key}
+	if err := r.ReadOnlyCmd("Get", args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Value.Bytes != nil {
+		t.Errorf("expected no value; got %+v", reply.Value)
+	}
+	meta, _, err := r.mvcc.getMetadata(key)
+	if err != nil || meta == nil || meta.Txn == nil || !readTS.Less(meta.Timestamp) {
+		t.Fatalf("expected intent pushed past %+v; got %+v, %v", readTS, meta, err)
+	}
+
+	etArgs := &EndTransactionRequest{RequestHeader: RequestHeader{Txn: txn}, Commit: true}
+	if err := <-r.ReadWriteCmd("EndTransaction", etArgs, &EndTransactionResponse{}); err == nil {
+		t.Error("expected pushed serializable transaction to fail commit")
+	} else if _, ok := err.(*TransactionRetryError); !ok {
+		t.Errorf("expected transaction retry error; got %v", err)
+	}
+}
+
+// TestRangeReadFailsToPushIntent verifies that a read which can't
+// push a higher-priority transaction eventually returns the
+// WriteIntentError.
+func TestRangeReadFailsToPushIntent(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	key := Key("a")
+	txn := NewTransaction(key, SERIALIZABLE, r.clock)
+	txn.Priority = math.MaxInt32
+	writeTestIntent(r, key, txn, t)
+
+	err := r.ReadOnlyCmd("Get", &GetRequest{Key: key}, &GetResponse{})
+	if wiErr, ok := err.(*WriteIntentError); !ok || wiErr.Txn.ID != txn.ID {
+		t.Errorf("expected write intent error; got %v", err)
+	}
+}
+
+// TestRangeInconsistentReads verifies that inconsistent reads ignore
+// write intents without pushing their transactions, and that the
+// inconsistent mode is rejected for writes and transactional reads.
+func TestRangeInconsistentReads(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	key := Key("a")
+	putArgs := &PutRequest{Key: key, Value: Value{Bytes: []byte("value")}}
+	if err := <-r.ReadWriteCmd("Put", putArgs, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	txn := NewTransaction(key, SERIALIZABLE, r.clock)
+	txn.Priority = math.MaxInt32
+	writeTestIntent(r, key, txn, t)
+
+	getArgs := &GetRequest{RequestHeader: RequestHeader{ReadConsistency: INCONSISTENT}, Key: key}
+	getReply := &GetResponse{}
+	if err := r.ReadOnlyCmd("Get", getArgs, getReply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(getReply.Value.Bytes, []byte("value")) {
+		t.Errorf("expected %q; got %q", "value", getReply.Value.Bytes)
+	}
+	scanArgs := &ScanRequest{RequestHeader: RequestHeader{ReadConsistency: INCONSISTENT}, StartKey: key, EndKey: Key("b")}
+	scanReply := &ScanResponse{}
+	if err := r.ReadOnlyCmd("Scan", scanArgs, scanReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(scanReply.Rows) != 1 || !bytes.Equal(scanReply.Rows[0].Value.Bytes, []byte("value")) {
+		t.Errorf("expected one row with %q; got %+v", "value", scanReply.Rows)
+	}
+
+	putArgs.ReadConsistency = INCONSISTENT
+	if err := <-r.ReadWriteCmd("Put", putArgs, &PutResponse{}); err == nil {
+		t.Error("expected error on inconsistent put")
+	}
+	getArgs.Txn = NewTransaction(key, SERIALIZABLE, r.clock)
+	if err := r.ReadOnlyCmd("Get", getArgs, &GetResponse{}); err == nil {
+		t.Error("expected error on inconsistent read within a transaction")
+	}
+}
+
+// TestRangeReplyTimestamp verifies that the reply to a command holds
+// the timestamp at which it was executed, whether specified by the
+// request or chosen by the range.
+func TestRangeReplyTimestamp(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	putReply := &PutResponse{}
+	if err := <-r.ReadWriteCmd("Put", &PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}, putReply); err != nil {
+		t.Fatal(err)
+	}
+	if putReply.Timestamp == (hlc.HLTimestamp{}) {
+		t.Error("expected timestamp chosen by range in put reply")
+	}
+	scanArgs := &ScanRequest{RequestHeader: RequestHeader{Timestamp: r.clock.Now()}, StartKey: Key("a"), EndKey: Key("b")}
+	scanReply := &ScanResponse{}
+	if err := r.ReadOnlyCmd("Scan", scanArgs, scanReply); err != nil {
+		t.Fatal(err)
+	}
+	if scanReply.Timestamp != scanArgs.Timestamp {
+		t.Errorf("expected scan timestamp %+v; got %+v", scanArgs.Timestamp, scanReply.Timestamp)
+	}
+}
+
+// TestRangeKeyMismatch verifies that requests addressing keys outside
+// of the range's bounds fail with a RangeKeyMismatchError.
+func TestRangeKeyMismatch(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	r.Meta.EndKey = Key("b")
+
+	putArgs := &PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}
+	if err := <-r.ReadWriteCmd("Put", putArgs, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	putArgs = &PutRequest{Key: Key("b"), Value: Value{Bytes: []byte("value")}}
+	err := <-r.ReadWriteCmd("Put", putArgs, &PutResponse{})
+	if _, ok := err.(*RangeKeyMismatchError); !ok {
+		t.Errorf("expected range key mismatch error on put; got %v", err)
+	}
+	scanReply := &ScanResponse{}
+	err = r.ReadOnlyCmd("Scan", &ScanRequest{StartKey: Key("c"), EndKey: Key("d")}, scanReply)
+	if _, ok := err.(*RangeKeyMismatchError); !ok {
+		t.Errorf("expected range key mismatch error on scan; got %v", err)
+	}
+	if _, ok := scanReply.Error.(*RangeKeyMismatchError); !ok {
+		t.Errorf("expected range key mismatch error in scan reply; got %v", scanReply.Error)
+	}
+}
+
+// TestRangeChangeReplicasTrigger verifies that a committed
+// transaction carrying a change replicas trigger updates the range's
+// replicas, and that the trigger is ignored on abort.
+func TestRangeChangeReplicasTrigger(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	replicas := []Replica{{NodeID: 2, StoreID: 3, RangeID: r.Meta.RangeID}}
+	trigger := &InternalCommitTrigger{ChangeReplicasTrigger: &ChangeReplicasTrigger{UpdatedReplicas: replicas}}
+
+	txn := NewTransaction(Key("a"), SERIALIZABLE, r.clock)
+	etArgs := &EndTransactionRequest{RequestHeader: RequestHeader{Txn: txn}, InternalCommitTrigger: trigger}
+	if err := <-r.ReadWriteCmd("EndTransaction", etArgs, &EndTransactionResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(r.Meta.Replicas.Replicas, replicas) {
+		t.Error("expected trigger to be ignored on abort")
+	}
+
+	etArgs.Txn = NewTransaction(Key("a"), SERIALIZABLE, r.clock)
+	etArgs.Commit = true
+	if err := <-r.ReadWriteCmd("EndTransaction", etArgs, &EndTransactionResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.Meta.Replicas.Replicas, replicas) {
+		t.Errorf("expected replicas %+v; got %+v", replicas, r.Meta.Replicas.Replicas)
+	}
+	var meta RangeMetadata
+	if ok, _, err := getI(r.engine, rangeKey(r.Meta.RangeID), &meta); !ok || err != nil {
+		t.Fatalf("expected persisted range metadata: %v", err)
+	}
+	if !reflect.DeepEqual(meta.Replicas.Replicas, replicas) {
+		t.Errorf("expected persisted replicas %+v; got %+v", replicas, meta.Replicas.Replicas)
+	}
+}
+
+// TestRangeIdempotence verifies that a replayed increment with the
+// same client command ID returns the cached response without
+// incrementing again, while a new command ID increments.
+func TestRangeIdempotence(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	args := &IncrementRequest{
+		RequestHeader: RequestHeader{CmdID: ClientCmdID{WallTime: 1, Random: 1}},
+		Key:           Key("a"),
+		Increment:     1,
+	}
+	for i := 0; i < 3; i++ {
+		reply := &IncrementResponse{}
+		if err := <-r.ReadWriteCmd("Increment", args, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.NewValue != 1 {
+			t.Errorf("%d: expected cached value 1; got %d", i, reply.NewValue)
+		}
+	}
+	args.CmdID.Random = 2
+	args.Timestamp = hlc.HLTimestamp{}
+	reply := &IncrementResponse{}
+	if err := <-r.ReadWriteCmd("Increment", args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.NewValue != 2 {
+		t.Errorf("expected incremented value 2; got %d", reply.NewValue)
+	}
+}
+
+// TestRangeEndTransaction verifies that a transaction can't be ended
+// more than once and that aborted transactions can't commit.
+func TestRangeEndTransaction(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	txn := NewTransaction(Key("a"), SERIALIZABLE, r.clock)
+
+	if err := <-r.ReadWriteCmd("EndTransaction", &EndTransactionRequest{}, &EndTransactionResponse{}); err == nil {
+		t.Error("expected error ending transaction without txn")
+	}
+	etArgs := &EndTransactionRequest{RequestHeader: RequestHeader{Txn: txn}, Commit: true}
+	if err := <-r.ReadWriteCmd("EndTransaction", etArgs, &EndTransactionResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	err := <-r.ReadWriteCmd("EndTransaction", etArgs, &EndTransactionResponse{})
+	if _, ok := err.(*TransactionStatusError); !ok {
+		t.Errorf("expected transaction status error; got %v", err)
+	}
+
+	txn = NewTransaction(Key("b"), SERIALIZABLE, r.clock)
+	etArgs = &EndTransactionRequest{RequestHeader: RequestHeader{Txn: txn}, Commit: false}
+	if err := <-r.ReadWriteCmd("EndTransaction", etArgs, &EndTransactionResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	etArgs.Commit = true
+	err = <-r.ReadWriteCmd("EndTransaction", etArgs, &EndTransactionResponse{})
+	if _, ok := err.(*TransactionAbortedError); !ok {
+		t.Errorf("expected transaction aborted error; got %v", err)
+	}
+}
+
+// TestRangeInternalPushTxn verifies push outcomes according to
+// relative priorities and the Abort flag.
+func TestRangeInternalPushTxn(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	pushee := NewTransaction(Key("a"), SERIALIZABLE, r.clock)
+	pushee.Priority = 2
+
+	pushArgs := func(pusher *Transaction, abort bool) *InternalPushTxnRequest {
+		return &InternalPushTxnRequest{
+			RequestHeader: RequestHeader{Timestamp: r.clock.Now(), Txn: pusher},
+			Key:           pushee.Key,
+			PusheeTxn:     *pushee,
+			Abort:         abort,
+		}
+	}
+
+	// Self push.
+	if err := <-r.ReadWriteCmd("InternalPushTxn", pushArgs(pushee, false), &InternalPushTxnResponse{}); err == nil {
+		t.Error("expected error pushing self")
+	}
+	// Lower priority pusher fails.
+	low := NewTransaction(Key("b"), SERIALIZABLE, r.clock)
+	low.Priority = 1
+	err := <-r.ReadWriteCmd("InternalPushTxn", pushArgs(low, false), &InternalPushTxnResponse{})
+	if _, ok := err.(*TransactionPushError); !ok {
+		t.Errorf("expected transaction push error; got %v", err)
+	}
+	// Higher priority pusher pushes the timestamp.
+	high := NewTransaction(Key("c"), SERIALIZABLE, r.clock)
+	high.Priority = 3
+	args := pushArgs(high, false)
+	reply := &InternalPushTxnResponse{}
+	if err := <-r.ReadWriteCmd("InternalPushTxn", args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.PusheeTxn.Status != PENDING || reply.PusheeTxn.Timestamp != args.Timestamp.Next() {
+		t.Errorf("expected pushee timestamp %+v; got %s", args.Timestamp.Next(), &reply.PusheeTxn)
+	}
+	// Higher priority pusher aborts.
+	if err := <-r.ReadWriteCmd("InternalPushTxn", pushArgs(high, true), reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.PusheeTxn.Status != ABORTED {
+		t.Errorf("expected aborted pushee; got %s", &reply.PusheeTxn)
+	}
+	// Once aborted, even a lower priority pusher succeeds.
+	if err := <-r.ReadWriteCmd("InternalPushTxn", pushArgs(low, false), reply); err != nil || reply.PusheeTxn.Status != ABORTED {
+		t.Errorf("expected aborted pushee; got %s, %v", &reply.PusheeTxn, err)
+	}
+	// A lower priority pusher pushes an abandoned pushee.
+	pushee = NewTransaction(Key("d"), SERIALIZABLE, r.clock)
+	pushee.Priority = 2
+	pushee.Timestamp.WallTime -= 2 * int64(txnExpiration)
+	if err := <-r.ReadWriteCmd("InternalPushTxn", pushArgs(low, true), reply); err != nil || reply.PusheeTxn.Status != ABORTED {
+		t.Errorf("expected aborted pushee; got %s, %v", &reply.PusheeTxn, err)
+	}
+}
+
+// TestRangeInternalHeartbeatTxn verifies that heartbeats create and
+// update the records of pending transactions, keeping them from
+// expiring, and leave those of ended transactions unchanged.
+func TestRangeInternalHeartbeatTxn(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	txn := NewTransaction(Key("a"), SERIALIZABLE, r.clock)
+	txn.Timestamp.WallTime -= 2 * int64(txnExpiration)
+
+	hbArgs := &InternalHeartbeatTxnRequest{
+		RequestHeader: RequestHeader{Timestamp: r.clock.Now(), Txn: txn},
+		Key:           txn.Key,
+	}
+	reply := &InternalHeartbeatTxnResponse{}
+	if err := <-r.ReadWriteCmd("InternalHeartbeatTxn", hbArgs, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Txn.LastHeartbeat != hbArgs.Timestamp || reply.Txn.isExpired(r.clock.Now()) {
+		t.Errorf("expected heartbeat at %+v; got %+v", hbArgs.Timestamp, reply.Txn.LastHeartbeat)
+	}
+
+	etArgs := &EndTransactionRequest{RequestHeader: RequestHeader{Txn: txn}, Commit: true}
+	if err := <-r.ReadWriteCmd("EndTransaction", etArgs, &EndTransactionResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	hbArgs.Timestamp = r.clock.Now()
+	if err := <-r.ReadWriteCmd("InternalHeartbeatTxn", hbArgs, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Txn.Status != COMMITTED || reply.Txn.LastHeartbeat == hbArgs.Timestamp {
+		t.Errorf("expected committed transaction without heartbeat; got %s", reply.Txn)
+	}
+}
+
+// TestRangeGCTxnRecords verifies that InternalGC aborts abandoned
+// transactions and removes the records of old aborted transactions.
+func TestRangeGCTxnRecords(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	abandoned := NewTransaction(Key("a"), SERIALIZABLE, r.clock)
+	abandoned.Timestamp.WallTime -= 2 * int64(txnExpiration)
+	live := NewTransaction(Key("b"), SERIALIZABLE, r.clock)
+	aborted := NewTransaction(Key("c"), SERIALIZABLE, r.clock)
+	aborted.Status = ABORTED
+	for _, txn := range []*Transaction{abandoned, live, aborted} {
+		if err := putI(r.engine, txnKey(txn.Key, txn.ID), txn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gcArgs := &InternalGCRequest{Key: KeyMin, GCThreshold: r.clock.Now()}
+	if err := <-r.ReadWriteCmd("InternalGC", gcArgs, &InternalGCResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	expStatuses := []TransactionStatus{ABORTED, PENDING}
+	for i, txn := range []*Transaction{abandoned, live} {
+		var gcTxn Transaction
+		if ok, _, err := getI(r.engine, txnKey(txn.Key, txn.ID), &gcTxn); !ok || err != nil {
+			t.Fatalf("%d: expected record of %s; got %v", i, txn, err)
+		}
+		if gcTxn.Status != expStatuses[i] {
+			t.Errorf("%d: expected status %s; got %s", i, expStatuses[i], gcTxn.Status)
+		}
+	}
+	if ok, _, err := getI(r.engine, txnKey(aborted.Key, aborted.ID), &Transaction{}); ok || err != nil {
+		t.Errorf("expected record of aborted transaction to be removed: %v", err)
+	}
+}
+
+// TestRangeCleanupIntents verifies that old intents of committed and
+// abandoned transactions are resolved, while those of live
+// transactions and recent intents are left in place.
+func TestRangeCleanupIntents(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	keys := []Key{Key("a"), Key("b"), Key("c"), Key("d")}
+	var txns []*Transaction
+	for i, key := range keys {
+		txn := NewTransaction(key, SERIALIZABLE, r.clock)
+		if i < 3 {
+			txn.Timestamp.WallTime -= 2 * int64(txnExpiration)
+		}
+		writeTestIntent(r, key, txn, t)
+		txns = append(txns, txn)
+	}
+	// keys[0]'s transaction is abandoned; keys[1]'s is committed and
+	// keys[2]'s is live.
+	etArgs := &EndTransactionRequest{RequestHeader: RequestHeader{Txn: txns[1]}, Commit: true}
+	if err := <-r.ReadWriteCmd("EndTransaction", etArgs, &EndTransactionResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	hbArgs := &InternalHeartbeatTxnRequest{
+		RequestHeader: RequestHeader{Timestamp: r.clock.Now(), Txn: txns[2]},
+		Key:           txns[2].Key,
+	}
+	if err := <-r.ReadWriteCmd("InternalHeartbeatTxn", hbArgs, &InternalHeartbeatTxnResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	threshold := r.clock.Now()
+	threshold.WallTime -= int64(txnExpiration)
+	if err := r.cleanupIntents(threshold); err != nil {
+		t.Fatal(err)
+	}
+	expIntents := []bool{false, false, true, true}
+	for i, key := range keys {
+		meta, _, err := r.mvcc.getMetadata(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hasIntent := meta != nil && meta.Txn != nil; hasIntent != expIntents[i] {
+			t.Errorf("%d: expected intent %t; got %+v", i, expIntents[i], meta)
+		}
+	}
+	if meta, _, _ := r.mvcc.getMetadata(keys[0]); meta != nil {
+		t.Errorf("expected abandoned intent to be removed; got %+v", meta)
+	}
+	if meta, _, _ := r.mvcc.getMetadata(keys[1]); meta == nil {
+		t.Error("expected committed intent to be made permanent")
+	}
+}
+
+// TestRangeStats verifies that the range's MVCC stats are computed
+// on start, updated by writes, persisted and reloaded.
+func TestRangeStats(t *testing.T) {
+	engine := createTestEngine(t)
+	r, _ := createTestRange(engine, t)
+	initial := r.Stats()
+	if initial.KeyCount != 3 || initial.LiveCount != 3 {
+		t.Fatalf("expected stats for three config keys; got %+v", initial)
+	}
+
+	args := &PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}
+	if err := <-r.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	ms := r.Stats()
+	if ms.KeyCount != 4 || ms.LiveBytes <= initial.LiveBytes {
+		t.Errorf("expected stats to reflect put; got %+v", ms)
+	}
+	if computed, err := r.mvcc.ComputeStats(KeyMin, KeyMax); err != nil || computed != ms {
+		t.Errorf("expected stats %+v to match computed %+v (%v)", ms, computed, err)
+	}
+	if !r.ShouldSplit(ms.TotalBytes()-1) || r.ShouldSplit(ms.TotalBytes()) || r.ShouldSplit(0) {
+		t.Errorf("unexpected split decision for stats %+v", ms)
+	}
+	r.Stop()
+
+	// A new range instance loads the persisted stats.
+	var persisted MVCCStats
+	if ok, _, err := getI(engine, rangeStatsKey(r.Meta.RangeID), &persisted); err != nil || !ok || persisted != ms {
+		t.Errorf("expected persisted stats %+v; got %+v, %v", ms, persisted, err)
+	}
+	r, _ = createTestRange(engine, t)
+	defer r.Stop()
+	if loaded := r.Stats(); loaded != ms {
+		t.Errorf("expected loaded stats %+v; got %+v", ms, loaded)
+	}
+}
+
+// TestRangeHistoricalReads verifies that reads may specify historical
+// timestamps within the zone's GC TTL and fail with ReadTooOldError
+// otherwise.
+func TestRangeHistoricalReads(t *testing.T) {
+	engine := createTestEngine(t)
+	zoneConfig := testDefaultZoneConfig
+	zoneConfig.GCTTLSeconds = 60
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(zoneConfig); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewMVCC(engine).Put(KeyConfigZonePrefix, hlc.HLTimestamp{WallTime: 2}, Value{Bytes: buf.Bytes()}, nil); err != nil {
+		t.Fatal(err)
+	}
+	r, _ := createTestRange(engine, t)
+	defer r.Stop()
+	if ttl := r.gcTTL(); ttl != 60*time.Second {
+		t.Fatalf("expected GC TTL of 60s; got %s", ttl)
+	}
+
+	key := Key("a")
+	start := r.clock.Now()
+	start.WallTime -= (30 * time.Second).Nanoseconds()
+	for i, val := range []string{"v1", "v2"} {
+		ts := start
+		ts.WallTime += int64(i) * (10 * time.Second).Nanoseconds()
+		args := &PutRequest{RequestHeader: RequestHeader{Timestamp: ts}, Key: key, Value: Value{Bytes: []byte(val)}}
+		if err := <-r.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		offset   time.Duration
+		expValue string
+	}{
+		{-time.Second, ""},
+		{0, "v1"},
+		{5 * time.Second, "v1"},
+		{10 * time.Second, "v2"},
+		{20 * time.Second, "v2"},
+	}
+	for i, test := range testCases {
+		ts := start
+		ts.WallTime += test.offset.Nanoseconds()
+		reply := &GetResponse{}
+		if err := r.ReadOnlyCmd("Get", &GetRequest{RequestHeader: RequestHeader{Timestamp: ts}, Key: key}, reply); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if string(reply.Value.Bytes) != test.expValue {
+			t.Errorf("%d: expected %q; got %q", i, test.expValue, reply.Value.Bytes)
+		}
+	}
+
+	ts := r.clock.Now()
+	ts.WallTime -= (2 * time.Minute).Nanoseconds()
+	err := r.ReadOnlyCmd("Get", &GetRequest{RequestHeader: RequestHeader{Timestamp: ts}, Key: key}, &GetResponse{})
+	if _, ok := err.(*ReadTooOldError); !ok {
+		t.Errorf("expected read too old error; got %v", err)
+	}
+}
+
+// TestRangeConditionalPut verifies that a failed conditional put
+// returns the actual value in the response.
+func TestRangeConditionalPut(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	args := &ConditionalPutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}
+	if err := <-r.ReadWriteCmd("ConditionalPut", args, &ConditionalPutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	args = &ConditionalPutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value2")}}
+	reply := &ConditionalPutResponse{}
+	err := <-r.ReadWriteCmd("ConditionalPut", args, reply)
+	if _, ok := err.(*ConditionFailedError); !ok {
+		t.Fatalf("expected condition failed error; got %v", err)
+	}
+	if reply.ActualValue == nil || string(reply.ActualValue.Bytes) != "value" {
+		t.Errorf("expected actual value \"value\"; got %+v", reply.ActualValue)
+	}
+
+	args.ExpValue = reply.ActualValue
+	if err := <-r.ReadWriteCmd("ConditionalPut", args, &ConditionalPutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	getReply := &GetResponse{}
+	if err := r.ReadOnlyCmd("Get", &GetRequest{Key: Key("a")}, getReply); err != nil {
+		t.Fatal(err)
+	}
+	if string(getReply.Value.Bytes) != "value2" {
+		t.Errorf("expected \"value2\"; got %q", getReply.Value.Bytes)
+	}
+}
+
+// TestRangeDeleteRange verifies deletion of a span of keys with a
+// maximum count and resume key.
+func TestRangeDeleteRange(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	for _, key := range []string{"a", "b", "c"} {
+		args := &PutRequest{Key: Key(key), Value: Value{Bytes: []byte(key)}}
+		if err := <-r.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := &DeleteRangeRequest{StartKey: Key("a"), EndKey: Key("z"), MaxEntriesToDelete: 2}
+	reply := &DeleteRangeResponse{}
+	if err := <-r.ReadWriteCmd("DeleteRange", args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.NumDeleted != 2 || !bytes.Equal(reply.ResumeKey, Key("c")) {
+		t.Errorf("expected 2 deleted with resume key \"c\"; got %+v", reply)
+	}
+	args = &DeleteRangeRequest{StartKey: reply.ResumeKey, EndKey: Key("z")}
+	reply = &DeleteRangeResponse{}
+	if err := <-r.ReadWriteCmd("DeleteRange", args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.NumDeleted != 1 || reply.ResumeKey != nil {
+		t.Errorf("expected 1 deleted with no resume key; got %+v", reply)
+	}
+	args = &DeleteRangeRequest{StartKey: Key("a"), MaxEntriesToDelete: -1}
+	if err := <-r.ReadWriteCmd("DeleteRange", args, &DeleteRangeResponse{}); err == nil {
+		t.Error("expected error on negative max entries")
+	}
+}
+
+// TestRangeSpanTruncation verifies that scans and range deletions
+// are truncated to the bounds of the range executing them, which
+// returns the key at which to continue in the following range, and
+// that scans reaching their limits resume after the last row.
+func TestRangeSpanTruncation(t *testing.T) {
+	store := createTestStore(1, 1, t)
+	defer store.Close()
+	left, err := store.CreateRange(KeyMin, Key("m"), []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	right, err := store.CreateRange(Key("m"), KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "n"} {
+		rng := left
+		if key >= "m" {
+			rng = right
+		}
+		args := &PutRequest{Key: Key(key), Value: Value{Bytes: []byte(key)}}
+		if err := <-rng.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		rng       *Range
+		endKey    Key
+		max       int64
+		maxBytes  int64
+		rows      int
+		resumeKey Key
+	}{
+		{left, Key("z"), 0, 0, 2, Key("m")},
+		{left, nil, 0, 0, 2, Key("m")},
+		{left, Key("c"), 0, 0, 2, nil},
+		// On reaching a limit, the scan resumes after the last row.
+		{left, Key("z"), 2, 0, 2, Key("b\x00")},
+		{left, Key("z"), 1, 0, 1, Key("a\x00")},
+		{left, Key("z"), 0, 1, 1, Key("a\x00")},
+		{left, Key("z"), 0, 3, 2, Key("b\x00")},
+		{left, Key("b\x00"), 2, 0, 2, nil},
+		{right, nil, 0, 0, 1, nil},
+	}
+	for i, test := range testCases {
+		reply := &ScanResponse{}
+		args := &ScanRequest{StartKey: test.rng.Meta.StartKey, EndKey: test.endKey, MaxResults: test.max, MaxBytes: test.maxBytes}
+		test.rng.ReadOnlyCmd("Scan", args, reply)
+		if reply.Error != nil {
+			t.Fatalf("%d: %v", i, reply.Error)
+		}
+		if len(reply.Rows) != test.rows || !bytes.Equal(reply.ResumeKey, test.resumeKey) {
+			t.Errorf("%d: expected %d rows with resume key %q; got %d rows with resume key %q",
+				i, test.rows, test.resumeKey, len(reply.Rows), reply.ResumeKey)
+		}
+	}
+
+	reply := &DeleteRangeResponse{}
+	if err := <-left.ReadWriteCmd("DeleteRange", &DeleteRangeRequest{StartKey: Key("a"), EndKey: Key("z")}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.NumDeleted != 2 || !bytes.Equal(reply.ResumeKey, Key("m")) {
+		t.Errorf("expected 2 deleted with resume key \"m\"; got %+v", reply)
+	}
+	gr := &GetResponse{}
+	right.ReadOnlyCmd("Get", &GetRequest{Key: Key("n")}, gr)
+	if gr.Error != nil || string(gr.Value.Bytes) != "n" {
+		t.Errorf("expected key \"n\" in the following range to remain; got %+v", gr)
+	}
+}
+
+// TestRangeReverseScan verifies that reverse scans are addressed to
+// the range containing the keys before their end key, are truncated
+// to the range's start key, which is returned as the key at which to
+// continue, and resume before the last row on reaching their limits.
+func TestRangeReverseScan(t *testing.T) {
+	store := createTestStore(1, 1, t)
+	defer store.Close()
+	left, err := store.CreateRange(KeyMin, Key("m"), []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	right, err := store.CreateRange(Key("m"), KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "n"} {
+		rng := left
+		if key >= "m" {
+			rng = right
+		}
+		args := &PutRequest{Key: Key(key), Value: Value{Bytes: []byte(key)}}
+		if err := <-rng.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		rng              *Range
+		startKey, endKey Key
+		max              int64
+		rows             string
+		resumeKey        Key
+	}{
+		{right, nil, nil, 0, "n", Key("m")},
+		{left, nil, Key("m"), 0, "ba", nil},
+		{left, Key("a"), Key("b"), 0, "a", nil},
+		// On reaching a limit, the scan resumes before the last row.
+		{left, nil, Key("m"), 1, "b", Key("b")},
+		{left, Key("b"), Key("m"), 1, "b", nil},
+	}
+	for i, test := range testCases {
+		reply := &ReverseScanResponse{}
+		args := &ReverseScanRequest{StartKey: test.startKey, EndKey: test.endKey, MaxResults: test.max}
+		if err := test.rng.ReadOnlyCmd("ReverseScan", args, reply); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		var rows string
+		for _, kv := range reply.Rows {
+			rows += string(kv.Key)
+		}
+		if rows != test.rows || !bytes.Equal(reply.ResumeKey, test.resumeKey) {
+			t.Errorf("%d: expected rows %q with resume key %q; got %q with resume key %q",
+				i, test.rows, test.resumeKey, rows, reply.ResumeKey)
+		}
+	}
+
+	// The range starting at the scan's end key doesn't contain the
+	// keys before it.
+	reply := &ReverseScanResponse{}
+	err = right.ReadOnlyCmd("ReverseScan", &ReverseScanRequest{EndKey: Key("m")}, reply)
+	if _, ok := err.(*RangeKeyMismatchError); !ok {
+		t.Errorf("expected RangeKeyMismatchError; got %v", err)
+	}
+}
+
+// TestRangeScanKeysOnly verifies that key-only scans return rows
+// without their values' bytes, and that their size limits and
+// memory budget charges count keys alone.
+func TestRangeScanKeysOnly(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	for _, key := range []string{"a", "b", "c"} {
+		args := &PutRequest{Key: Key(key), Value: Value{Bytes: []byte("0123456789")}}
+		if err := <-r.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The budget fits the keys, but not the values.
+	r.requestMemory = util.NewMemoryBudget("requests", 10)
+	reply := &ScanResponse{}
+	args := &ScanRequest{StartKey: Key("a"), EndKey: Key("z"), MaxBytes: 2, KeysOnly: true}
+	if err := r.ReadOnlyCmd("Scan", args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Rows) != 2 || !bytes.Equal(reply.ResumeKey, Key("b\x00")) {
+		t.Fatalf("expected 2 rows with resume key \"b\\x00\"; got %+v", reply)
+	}
+	for i, row := range reply.Rows {
+		if row.Value.Bytes != nil || row.Value.Timestamp.WallTime == 0 {
+			t.Errorf("%d: expected row %q with a timestamp but no value; got %+v", i, row.Key, row.Value)
+		}
+	}
+}
+
+// TestRangeScanMinTimestamp verifies that scans with a minimum
+// timestamp return only the keys written or deleted since, with
+// deletions as rows marked deleted.
+func TestRangeScanMinTimestamp(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	for _, key := range []string{"a", "b", "c"} {
+		args := &PutRequest{Key: Key(key), Value: Value{Bytes: []byte("old")}}
+		if err := <-r.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	minTimestamp := hlc.NewHLClock(hlc.UnixNano).Now()
+	for _, key := range []string{"b", "d"} {
+		args := &PutRequest{Key: Key(key), Value: Value{Bytes: []byte("new")}}
+		if err := <-r.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-r.ReadWriteCmd("Delete", &DeleteRequest{Key: Key("c")}, &DeleteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := &ScanResponse{}
+	args := &ScanRequest{StartKey: Key("a"), EndKey: Key("z"), MinTimestamp: minTimestamp}
+	if err := r.ReadOnlyCmd("Scan", args, reply); err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		key   string
+		value []byte
+	}{
+		{"b", []byte("new")},
+		{"c", nil},
+		{"d", []byte("new")},
+	}
+	if len(reply.Rows) != len(expected) {
+		t.Fatalf("expected %d rows; got %+v", len(expected), reply.Rows)
+	}
+	for i, exp := range expected {
+		row := reply.Rows[i]
+		if !bytes.Equal(row.Key, Key(exp.key)) || !bytes.Equal(row.Value.Bytes, exp.value) ||
+			row.Deleted != (exp.value == nil) {
+			t.Errorf("%d: expected %q=%q; got %+v", i, exp.key, exp.value, row)
+		}
+		if !minTimestamp.Less(row.Value.Timestamp) {
+			t.Errorf("%d: expected timestamp after %+v; got %+v", i, minTimestamp, row.Value.Timestamp)
+		}
+	}
+
+	// As of the minimum timestamp, no key has changed since.
+	args.Timestamp = minTimestamp
+	if err := r.ReadOnlyCmd("Scan", args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Rows) != 0 {
+		t.Errorf("expected no rows; got %+v", reply.Rows)
+	}
+}
+
+// TestRangeScanMemoryBudget verifies that the rows read by scans are
+// charged to the request budget while the scan executes, and that
+// scans which would exceed it fail.
+func TestRangeScanMemoryBudget(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	for _, key := range []string{"a", "b", "c"} {
+		args := &PutRequest{Key: Key(key), Value: Value{Bytes: []byte("0123456789")}}
+		if err := <-r.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each row is charged 11 bytes, so two fit within the budget.
+	budget := util.NewMemoryBudget("requests", 25)
+	r.requestMemory = budget
+	reply := &ScanResponse{}
+	if err := r.ReadOnlyCmd("Scan", &ScanRequest{StartKey: Key("a"), EndKey: Key("z")}, reply); err == nil {
+		t.Error("expected scan to exceed memory budget")
+	} else if _, ok := err.(*util.MemoryBudgetExceededError); !ok {
+		t.Errorf("expected MemoryBudgetExceededError; got %v", err)
+	}
+	reply = &ScanResponse{}
+	if err := r.ReadOnlyCmd("Scan", &ScanRequest{StartKey: Key("a"), EndKey: Key("z"), MaxResults: 2}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Rows) != 2 {
+		t.Errorf("expected 2 rows; got %d", len(reply.Rows))
+	}
+	if used := budget.Used(); used != 0 {
+		t.Errorf("expected scans to release their memory; got %d bytes in use", used)
+	}
+}
+
+// TestRangeBatch verifies that batched requests are executed in
+// order and that execution stops at the first error.
+func TestRangeBatch(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	args := &BatchRequest{
+		Requests: []Request{
+			&PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}},
+			&IncrementRequest{Key: Key("b"), Increment: 5},
+			&GetRequest{Key: Key("a")},
+			&ConditionalPutRequest{Key: Key("a"), Value: Value{Bytes: []byte("other")}},
+			&DeleteRequest{Key: Key("a")},
+		},
+	}
+	reply := &BatchResponse{}
+	err := <-r.ReadWriteCmd("Batch", args, reply)
+	if _, ok := err.(*ConditionFailedError); !ok {
+		t.Fatalf("expected condition failed error; got %v", err)
+	}
+	if len(reply.Responses) != 4 {
+		t.Fatalf("expected 4 responses; got %d", len(reply.Responses))
+	}
+	if ir := reply.Responses[1].(*IncrementResponse); ir.NewValue != 5 {
+		t.Errorf("expected increment to 5; got %d", ir.NewValue)
+	}
+	if gr := reply.Responses[2].(*GetResponse); string(gr.Value.Bytes) != "value" {
+		t.Errorf("expected get of \"value\"; got %q", gr.Value.Bytes)
+	}
+	if cr := reply.Responses[3].(*ConditionalPutResponse); cr.ActualValue == nil {
+		t.Error("expected actual value in conditional put response")
+	}
+	// Requests following the failure aren't executed.
+	getReply := &GetResponse{}
+	if err := r.ReadOnlyCmd("Get", &GetRequest{Key: Key("a")}, getReply); err != nil || string(getReply.Value.Bytes) != "value" {
+		t.Errorf("expected \"value\" to remain; got %q, %v", getReply.Value.Bytes, err)
+	}
+
+	// Requests which may not be batched are rejected.
+	args = &BatchRequest{Requests: []Request{&InternalResolveIntentRequest{Key: Key("a")}}}
+	if err := <-r.ReadWriteCmd("Batch", args, &BatchResponse{}); err == nil {
+		t.Error("expected error batching internal request")
+	}
+}
+
+// TestRangeBatchTransaction verifies that batched requests inherit
+// the batch's transaction.
+func TestRangeBatchTransaction(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	txn := NewTransaction(Key("a"), SERIALIZABLE, r.clock)
+	args := &BatchRequest{
+		RequestHeader: RequestHeader{Txn: txn},
+		Requests: []Request{
+			&PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}},
+			&EndTransactionRequest{Commit: true},
+		},
+	}
+	reply := &BatchResponse{}
+	if err := <-r.ReadWriteCmd("Batch", args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Txn == nil || reply.Txn.Status != COMMITTED {
+		t.Errorf("expected committed transaction; got %+v", reply.Txn)
+	}
+	if meta, _, err := r.mvcc.getMetadata(Key("a")); err != nil || meta == nil || meta.Txn == nil || meta.Txn.ID != txn.ID {
+		t.Errorf("expected intent for %s; got %+v, %v", txn, meta, err)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+const (
+	// rebalanceInterval is the mean interval between rebalancing
+	// passes. At most one replica is moved off a store per pass, which
+	// paces rebalancing to avoid replication storms.
+	rebalanceInterval = 1 * time.Minute
+	// rebalanceThreshold is the fraction by which a store's load must
+	// exceed the mean load of all stores for it to be considered
+	// overloaded.
+	rebalanceThreshold = 0.05
+)
+
+// A rebalancer periodically compares the load of its store with the
+// load of all live stores, as tracked by the store's storePool. If
+// the store is overloaded, in either fraction of capacity used or
+// number of ranges, one of the ranges for which the store holds the
+// leader replica is moved to an underloaded store: a replica is added
+// on the target store and the store's own replica is removed via
+// Range.ChangeReplicas. Replicas are moved at a pace set by the
+// store's throttle.
+type rebalancer struct {
+	store    *Store
+	interval time.Duration
+}
+
+// newRebalancer returns a rebalancer for the store which runs a
+// rebalancing pass every interval on average.
+func newRebalancer(store *Store, interval time.Duration) *rebalancer {
+	return &rebalancer{
+		store:    store,
+		interval: interval,
+	}
+}
+
+// start runs rebalancing passes in a worker of the stopper until it's
+// stopped. Intervals between passes are jittered so that the stores
+// of a cluster don't rebalance in lockstep.
+func (rb *rebalancer) start(stopper *util.Stopper) {
+	stopper.RunWorker(func() {
+		for {
+			jitter := time.Duration(rand.Int63n(int64(rb.interval)))
+			select {
+			case <-time.After(rb.interval/2 + jitter):
+				if err := rb.maybeRebalance(); err != nil {
+					rb.store.logger().Warningf("failed to rebalance: %v", err)
+				}
+			case <-stopper.ShouldStop():
+				return
+			}
+		}
+	})
+}
+
+// maybeRebalance moves a single range replica off the store if the
+// store is overloaded and an underloaded target store is available.
+// Only ranges for which the store's replica is the leader are
+// considered.
+func (rb *rebalancer) maybeRebalance() error {
+	s := rb.store
+	allStores, err := s.allocator.storeFinder(Attributes{})
+	if err != nil {
+		return err
+	}
+	var source *StoreDescriptor
+	for _, sd := range allStores {
+		if sd.Node.NodeID == s.Ident.NodeID && sd.StoreID == s.Ident.StoreID {
+			source = sd
+			break
+		}
+	}
+	// The store's own capacity may not have been gossiped yet.
+	if source == nil || !isOverloaded(source, allStores) {
+		return nil
+	}
+
+	for _, rng := range s.sortedRanges() {
+		if !rng.IsLeader() {
+			continue
+		}
+		moved, err := s.moveReplica(rng, func(required Attributes, replicas []Replica) (*StoreDescriptor, error) {
+			return s.allocator.rebalanceTarget(required, replicas, allStores)
+		})
+		if err != nil || moved {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveReplica moves the store's replica of the range to the store
+// returned by target, which is passed the attributes the replica
+// satisfies and the range's current replicas. Returns false if the
+// store holds no replica of the range or target finds no store.
+func (s *Store) moveReplica(rng *Range, target func(required Attributes, replicas []Replica) (*StoreDescriptor, error)) (bool, error) {
+	replicas := rng.getMeta().Replicas.Replicas
+	var updated []Replica
+	var required Attributes
+	found := false
+	for _, replica := range replicas {
+		if replica.NodeID == s.Ident.NodeID && replica.StoreID == s.Ident.StoreID {
+			required = replicaZoneAttrs(rng.zoneConfig(), replica)
+			found = true
+			continue
+		}
+		updated = append(updated, replica)
+	}
+	if !found {
+		return false, nil
+	}
+	dest, err := target(required, replicas)
+	if err != nil {
+		rng.logger().V(1).Infof("no target store for replica: %v", err)
+		return false, nil
+	}
+	newReplica := Replica{
+		NodeID:  dest.Node.NodeID,
+		StoreID: dest.StoreID,
+		RangeID: rng.Meta.RangeID,
+		Attrs:   dest.CombinedAttrs(),
+	}
+	if err := s.throttle.wait(throttleRebalance, 1); err != nil {
+		return false, err
+	}
+	rng.logger().Infof("moving replica to store %d:%d", dest.Node.NodeID, dest.StoreID)
+	// Add the new replica before removing the store's own, so the
+	// range never has fewer replicas than before.
+	if err := rng.ChangeReplicas(append(append([]Replica(nil), replicas...), newReplica)); err != nil {
+		return false, err
+	}
+	return true, rng.ChangeReplicas(append(updated, newReplica))
+}
+
+// replicaZoneAttrs returns the attributes required by the zone config
+// which the replica satisfies, so that a replacement replica may be
+// allocated with the same attributes. Returns empty attributes if the
+// zone is nil or the replica satisfies none of its requirements.
+func replicaZoneAttrs(zone *ZoneConfig, replica Replica) Attributes {
+	if zone != nil {
+		for _, required := range zone.Replicas {
+			if required.IsSubset(replica.Attrs) {
+				return required
+			}
+		}
+	}
+	return Attributes{}
+}
@@ -0,0 +1,92 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/hlc"
+)
+
+// gossipStores adds the store descriptors to the gossip network as
+// nodes do when gossiping store capacities.
+func gossipStores(g *gossip.Gossip, stores []*StoreDescriptor, t *testing.T) {
+	for _, s := range stores {
+		attrs := s.CombinedAttrs().SortedString()
+		g.RegisterGroup(gossip.MakeMaxAvailCapacityGroup(attrs), 10, gossip.MaxGroup)
+		if err := g.AddInfo(gossip.MakeMaxAvailCapacityKey(attrs, s.Node.NodeID, s.StoreID), *s, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestRebalancerMovesReplica verifies that an overloaded store moves
+// a replica to an underloaded store and updates the range's
+// addressing record, and that a balanced store doesn't.
+func TestRebalancerMovesReplica(t *testing.T) {
+	g := gossip.New()
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), NewInMem(Attributes{}, 1<<20), nil, g)
+	store.db = &storeDB{store: store}
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb := newRebalancer(store, rebalanceInterval)
+
+	// Balanced stores don't rebalance.
+	gossipStores(g, []*StoreDescriptor{loadedStore(1, 50, 10), loadedStore(2, 50, 10)}, t)
+	if err := rb.maybeRebalance(); err != nil {
+		t.Fatal(err)
+	}
+	if r := rng.Meta.Replicas.Replicas; len(r) != 1 || r[0].StoreID != 1 {
+		t.Fatalf("expected replica to remain on store 1; got %+v", r)
+	}
+
+	// Overload store 1.
+	gossipStores(g, []*StoreDescriptor{loadedStore(1, 80, 20)}, t)
+	if err := rb.maybeRebalance(); err != nil {
+		t.Fatal(err)
+	}
+	if r := rng.Meta.Replicas.Replicas; len(r) != 1 || r[0].NodeID != 2 || r[0].StoreID != 2 || r[0].RangeID != 1 {
+		t.Fatalf("expected replica to move to store 2; got %+v", r)
+	}
+	// Having removed its own replica, the store no longer holds the
+	// leader lease and can't resolve the intent on the addressing
+	// record; read it as its (committed) transaction.
+	metaKey := MakeKey(KeyMeta2Prefix, KeyMax)
+	val, err := NewMVCC(store.engine).Get(metaKey, store.clock.Now(), nil)
+	if wiErr, ok := err.(*WriteIntentError); ok {
+		val, err = NewMVCC(store.engine).Get(metaKey, store.clock.Now(), &wiErr.Txn)
+	}
+	if err != nil || val == nil {
+		t.Fatalf("expected addressing record: %v", err)
+	}
+	var desc RangeDescriptor
+	if err := gob.NewDecoder(bytes.NewBuffer(val.Bytes)).Decode(&desc); err != nil {
+		t.Fatal(err)
+	}
+	if len(desc.Replicas) != 1 || desc.Replicas[0].StoreID != 2 {
+		t.Errorf("expected addressing record with replica on store 2; got %+v", desc)
+	}
+}
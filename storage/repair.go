@@ -0,0 +1,88 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+// A repairer is a range queue which restores the replication factor
+// of ranges which have replicas on dead nodes, and moves replicas off
+// decommissioning nodes. Nodes heartbeat liveness records via gossip
+// (see server.Node); a node whose record expired more than
+// NodeDeadTimeout ago is considered dead (see livenessMonitor), and a
+// node whose record is marked decommissioning is being removed from
+// the cluster. For each range for which the store holds the leader
+// replica, replicas on such nodes are replaced: a replacement replica
+// satisfying the same zone attributes is first added on a healthy
+// store and the replaced replica is then removed, both via
+// Range.ChangeReplicas. At most one replica is repaired per scanner
+// pass.
+type repairer struct {
+	store    *Store
+	repaired bool // True if a replica was repaired this pass
+}
+
+// newRepairer returns a repairer for the store.
+func newRepairer(store *Store) *repairer {
+	return &repairer{store: store}
+}
+
+func (rp *repairer) name() string { return "repair" }
+
+// beginScan resets the repairer for a new pass.
+func (rp *repairer) beginScan() error {
+	rp.repaired = false
+	return nil
+}
+
+// process replaces a single replica of the range located on a dead or
+// decommissioning node, if any, unless a replica was already repaired
+// this pass.
+func (rp *repairer) process(rng *Range) error {
+	if rp.repaired || !rng.IsLeader() {
+		return nil
+	}
+	s := rp.store
+	replicas := rng.Meta.Replicas.Replicas
+	for i, replica := range replicas {
+		var reason string
+		if s.liveness.status(replica.NodeID) == NodeDead {
+			reason = "dead"
+		} else if s.liveness.decommissioning(replica.NodeID) {
+			reason = "decommissioning"
+		} else {
+			continue
+		}
+		required := replicaZoneAttrs(rng.zoneConfig(), replica)
+		target, err := s.allocator.allocate(required, replicas)
+		if err != nil {
+			rng.logger().Warningf("no replacement for %s replica %+v: %v", reason, replica, err)
+			continue
+		}
+		rng.logger().Infof("replacing replica on %s node %d with store %d:%d",
+			reason, replica.NodeID, target.Node.NodeID, target.StoreID)
+		rp.repaired = true
+		added := append(append([]Replica(nil), replicas...), Replica{
+			NodeID:  target.Node.NodeID,
+			StoreID: target.StoreID,
+			RangeID: rng.Meta.RangeID,
+			Attrs:   target.CombinedAttrs(),
+		})
+		if err := rng.ChangeReplicas(added); err != nil {
+			return err
+		}
+		removed := append(append([]Replica(nil), added[:i]...), added[i+1:]...)
+		return rng.ChangeReplicas(removed)
+	}
+	return nil
+}
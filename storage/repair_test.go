@@ -0,0 +1,127 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/hlc"
+)
+
+// gossipLiveness gossips liveness records for the nodes, expiring at
+// expiration.
+func gossipLiveness(g *gossip.Gossip, expiration time.Time, t *testing.T, nodeIDs ...int32) {
+	g.RegisterGroup(gossip.KeyNodeLivenessPrefix, 10, gossip.MaxGroup)
+	for _, nodeID := range nodeIDs {
+		l := NodeLiveness{NodeID: nodeID, Expiration: expiration}
+		if err := g.AddInfo(gossip.MakeNodeLivenessKey(nodeID), l, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestRepairerReplacesDeadReplica verifies that a replica on a node
+// which hasn't heartbeated its liveness for longer than the dead node
+// timeout is replaced by a replica on a healthy store.
+func TestRepairerReplacesDeadReplica(t *testing.T) {
+	g := gossip.New()
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), NewInMem(Attributes{}, 1<<20), nil, g)
+	store.db = &storeDB{store: store}
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{
+		{NodeID: 1, StoreID: 1, RangeID: 1},
+		{NodeID: 2, StoreID: 2, RangeID: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Node 2 never heartbeats; nodes 1 and 3 are healthy.
+	gossipStores(g, []*StoreDescriptor{loadedStore(1, 50, 1), loadedStore(3, 50, 1)}, t)
+	now := time.Now()
+	gossipLiveness(g, now.Add(time.Hour), t, 1, 3)
+
+	rp := newRepairer(store)
+	sc := newRangeScanner(store, scanInterval, rp)
+	store.liveness.started = now
+	store.liveness.now = func() time.Time { return now }
+
+	// Within the timeout, node 2 isn't yet considered dead.
+	now = now.Add(NodeDeadTimeout - time.Second)
+	sc.scan()
+	if r := rng.Meta.Replicas.Replicas; len(r) != 2 || r[1].NodeID != 2 {
+		t.Fatalf("expected replicas to be unchanged; got %+v", r)
+	}
+
+	now = now.Add(2 * time.Second)
+	sc.scan()
+	r := rng.Meta.Replicas.Replicas
+	if len(r) != 2 || r[0].NodeID != 1 || r[1].NodeID != 3 || r[1].StoreID != 3 || r[1].RangeID != 1 {
+		t.Errorf("expected replica on node 2 to be replaced by store 3; got %+v", r)
+	}
+}
+
+// TestRepairerReplacesDecommissioningReplica verifies that a replica
+// on a live node which is decommissioning is replaced by a replica on
+// another store, and that no stores of decommissioning nodes are
+// chosen as replacements.
+func TestRepairerReplacesDecommissioningReplica(t *testing.T) {
+	g := gossip.New()
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), NewInMem(Attributes{}, 1<<20), nil, g)
+	store.db = &storeDB{store: store}
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{
+		{NodeID: 1, StoreID: 1, RangeID: 1},
+		{NodeID: 2, StoreID: 2, RangeID: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// All nodes are live; nodes 2 and 4 are decommissioning. Store 4
+	// is the emptiest but mustn't be chosen.
+	gossipStores(g, []*StoreDescriptor{loadedStore(1, 50, 1), loadedStore(2, 50, 1),
+		loadedStore(3, 50, 1), loadedStore(4, 0, 0)}, t)
+	gossipLiveness(g, time.Now().Add(time.Hour), t, 1, 3)
+	for _, nodeID := range []int32{2, 4} {
+		l := NodeLiveness{NodeID: nodeID, Expiration: time.Now().Add(time.Hour), Decommissioning: true}
+		if err := g.AddInfo(gossip.MakeNodeLivenessKey(nodeID), l, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stores, err := store.allocator.storeFinder(Attributes{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stores {
+		if s.Node.NodeID == 2 || s.Node.NodeID == 4 {
+			t.Errorf("expected stores of decommissioning nodes to be excluded; got %+v", s)
+		}
+	}
+
+	sc := newRangeScanner(store, scanInterval, newRepairer(store))
+	sc.scan()
+	r := rng.Meta.Replicas.Replicas
+	if len(r) != 2 || r[0].NodeID != 1 || r[1].NodeID != 3 || r[1].StoreID != 3 {
+		t.Errorf("expected replica on node 2 to be replaced by store 3; got %+v", r)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// A replicaGC is a range queue which destroys replicas which no
+// longer belong to their range. A replica is orphaned on its store
+// when it's removed from the range via Range.ChangeReplicas or when
+// its range is subsumed by a merge executed on another store. Neither
+// event reaches the orphaned replica, so the replica GC reads the
+// current range descriptor for the start key of each of the store's
+// replicas from the range addressing records. Replicas which aren't
+// listed in the descriptor under their own range ID are destroyed via
+// Store.DestroyRange.
+//
+// The first range is located via gossip instead of addressing
+// records and is never collected.
+type replicaGC struct {
+	store *Store
+}
+
+// newReplicaGC returns a replica GC for the store.
+func newReplicaGC(store *Store) *replicaGC {
+	return &replicaGC{store: store}
+}
+
+func (gc *replicaGC) name() string     { return "replica GC" }
+func (gc *replicaGC) beginScan() error { return nil }
+
+// process destroys the range's replica on the store if it's orphaned.
+func (gc *replicaGC) process(rng *Range) error {
+	s := gc.store
+	if s.db == nil {
+		return nil
+	}
+	meta := rng.getMeta()
+	orphaned, err := gc.isOrphaned(meta)
+	if err != nil || !orphaned {
+		return err
+	}
+	rng.logger().Infof("destroying orphaned replica")
+	return s.DestroyRange(meta.RangeID)
+}
+
+// isOrphaned reads the addressing record for the range containing
+// meta.StartKey and returns true if it doesn't list the store's
+// replica of the range described by meta.
+func (gc *replicaGC) isOrphaned(meta RangeMetadata) (bool, error) {
+	metaKey := RangeMetaKey(meta.StartKey)
+	if len(metaKey) == 0 {
+		return false, nil
+	}
+	// The addressing record for the range containing the start key is
+	// the first record at the same level with a key greater than
+	// metaKey.
+	reply := <-gc.store.db.Scan(&ScanRequest{
+		StartKey:   MakeKey(metaKey, Key{0}),
+		EndKey:     PrefixEndKey(metaKey[:len(KeyMeta1Prefix)]),
+		MaxResults: 1,
+	})
+	if reply.Error != nil {
+		return false, reply.Error
+	}
+	if len(reply.Rows) == 0 {
+		return false, nil
+	}
+	var desc RangeDescriptor
+	if err := gob.NewDecoder(bytes.NewBuffer(reply.Rows[0].Value.Bytes)).Decode(&desc); err != nil {
+		return false, err
+	}
+	ident := gc.store.Ident
+	for _, replica := range desc.Replicas {
+		if replica.NodeID == ident.NodeID && replica.StoreID == ident.StoreID && replica.RangeID == meta.RangeID {
+			return false, nil
+		}
+	}
+	return true, nil
+}
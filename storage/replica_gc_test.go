@@ -0,0 +1,94 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/hlc"
+)
+
+// TestReplicaGCDestroysOrphanedReplica verifies that a replica which
+// is listed in its range's addressing record is kept, and that once
+// it's removed from the record, the replica and its data are
+// destroyed while the data of other ranges is left in place.
+func TestReplicaGCDestroysOrphanedReplica(t *testing.T) {
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), NewInMem(Attributes{}, 1<<20), nil, nil)
+	store.db = &storeDB{store: store}
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateRange(KeyMin, Key("m"), []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store.CreateRange(Key("m"), KeyMax, []Replica{
+		{NodeID: 1, StoreID: 1, RangeID: 2},
+		{NodeID: 2, StoreID: 2, RangeID: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putDesc := func(desc RangeDescriptor) {
+		kv, err := encodeI(RangeMetaKey(KeyMax), desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply := <-store.db.Put(&PutRequest{Key: kv.Key, Value: kv.Value}); reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+	putDesc(rng.Meta.Replicas)
+	for _, key := range []Key{Key("a"), Key("n")} {
+		if reply := <-store.db.Put(&PutRequest{Key: key, Value: Value{Bytes: []byte("value")}}); reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+
+	sc := newRangeScanner(store, scanInterval, newReplicaGC(store))
+	sc.scan()
+	if _, err := store.GetRange(2); err != nil {
+		t.Fatalf("expected replica listed in addressing record to be kept: %v", err)
+	}
+
+	// Remove the store's replica from the addressing record.
+	putDesc(RangeDescriptor{StartKey: Key("m"), Replicas: []Replica{{NodeID: 2, StoreID: 2, RangeID: 2}}})
+	sc.scan()
+	if _, err := store.GetRange(2); err == nil {
+		t.Fatal("expected orphaned replica to be removed from store")
+	}
+	if _, err := store.GetRange(1); err != nil {
+		t.Fatalf("expected first range to be kept: %v", err)
+	}
+	if ok, _, err := getI(store.engine, rangeKey(2), nil); ok || err != nil {
+		t.Errorf("expected range metadata to be deleted; got %t, %v", ok, err)
+	}
+	for _, test := range []struct {
+		key       Key
+		expExists bool
+	}{
+		{Key("a"), true},
+		{Key("n"), false},
+	} {
+		kvs, err := store.engine.scan(mvccEncodeKey(test.key), mvccEncodeKey(MakeKey(test.key, Key{0})), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists := len(kvs) > 0; exists != test.expExists {
+			t.Errorf("key %q: expected data to exist %t; got %t", test.key, test.expExists, exists)
+		}
+	}
+}
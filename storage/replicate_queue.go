@@ -0,0 +1,56 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+// A replicateQueue is a range queue which up-replicates ranges that
+// have fewer replicas than required by the zone config covering the
+// range. For each range for which the store holds the leader
+// replica, a replica satisfying the first unsatisfied attribute set
+// of the zone config is allocated and added via
+// Range.ChangeReplicas. At most one replica is added per range per
+// scanner pass.
+type replicateQueue struct {
+	store *Store
+}
+
+// newReplicateQueue returns a replicate queue for the store.
+func newReplicateQueue(store *Store) *replicateQueue {
+	return &replicateQueue{store: store}
+}
+
+func (rq *replicateQueue) name() string     { return "replicate" }
+func (rq *replicateQueue) beginScan() error { return nil }
+
+// process adds a replica to the range if it's missing one required
+// by its zone config.
+func (rq *replicateQueue) process(rng *Range) error {
+	zone := rng.zoneConfig()
+	if zone == nil || !rng.IsLeader() {
+		return nil
+	}
+	replicas := rng.Meta.Replicas.Replicas
+	target, err := rq.store.allocator.allocateMissing(zone, replicas)
+	if err != nil || target == nil {
+		return err
+	}
+	rng.logger().Infof("adding replica on store %d:%d", target.Node.NodeID, target.StoreID)
+	return rng.ChangeReplicas(append(append([]Replica(nil), replicas...), Replica{
+		NodeID:  target.Node.NodeID,
+		StoreID: target.StoreID,
+		RangeID: rng.Meta.RangeID,
+		Attrs:   target.CombinedAttrs(),
+	}))
+}
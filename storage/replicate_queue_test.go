@@ -0,0 +1,59 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/hlc"
+)
+
+// TestReplicateQueueUpReplicates verifies that a range with fewer
+// replicas than required by its zone config is up-replicated to an
+// available store, and that a fully replicated range isn't changed.
+func TestReplicateQueueUpReplicates(t *testing.T) {
+	g := gossip.New()
+	engine := NewInMem(Attributes{}, 1<<20)
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), engine, nil, g)
+	store.db = &storeDB{store: store}
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	putTestConfig(engine, KeyConfigZonePrefix, ZoneConfig{Replicas: []Attributes{{}, {"ssd"}}}, t)
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gossipStores(g, []*StoreDescriptor{loadedStore(1, 50, 1), loadedStore(2, 50, 1)}, t)
+
+	rq := newReplicateQueue(store)
+	if err := rq.process(rng); err != nil {
+		t.Fatal(err)
+	}
+	r := rng.Meta.Replicas.Replicas
+	if len(r) != 2 || r[1].NodeID != 2 || r[1].StoreID != 2 || r[1].RangeID != 1 {
+		t.Fatalf("expected replica to be added on store 2; got %+v", r)
+	}
+
+	if err := rq.process(rng); err != nil {
+		t.Fatal(err)
+	}
+	if r := rng.Meta.Replicas.Replicas; len(r) != 2 {
+		t.Errorf("expected fully replicated range to be unchanged; got %+v", r)
+	}
+}
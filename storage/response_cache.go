@@ -0,0 +1,131 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"strconv"
+
+	"github.com/cockroachdb/cockroach/hlc"
+)
+
+// A ResponseCache provides idempotence for request retries. Each
+// request to a range specifies a ClientCmdID in the request header
+// which uniquely identifies a client command. After commands have
+// been replicated via raft, they are executed against the state
+// machine and the results are stored in the ResponseCache.
+//
+// The ResponseCache stores responses in the underlying engine, using
+// keys derived from keyLocalResponseCachePrefix, range ID and the
+// ClientCmdID. Only responses of commands which executed successfully
+// are cached; failed commands have no effect and may be safely
+// re-executed.
+//
+// A ResponseCache is not safe for concurrent use; it's only accessed
+// by the range's command processing loop. Entries are garbage
+// collected along with the range's versioned data (see GC).
+type ResponseCache struct {
+	rangeID int64
+	engine  Engine
+}
+
+// NewResponseCache returns a new response cache for the range with
+// the specified ID, backed by engine.
+func NewResponseCache(rangeID int64, engine Engine) *ResponseCache {
+	return &ResponseCache{rangeID: rangeID, engine: engine}
+}
+
+// responseCacheKeyPrefix returns the key prefix of all response cache
+// entries for the range with the specified ID. The range ID is encoded
+// so that the entries of one range are not a prefix of another's.
+func responseCacheKeyPrefix(rangeID int64) Key {
+	return MakeKey(keyLocalResponseCachePrefix, encodeBytes([]byte(strconv.FormatInt(rangeID, 16))))
+}
+
+// responseCacheKey returns the key of the response cache entry for
+// the command with the specified ID.
+func responseCacheKey(rangeID int64, cmdID ClientCmdID) Key {
+	b := encodeUint64Decreasing(responseCacheKeyPrefix(rangeID), uint64(cmdID.WallTime))
+	return encodeUint64Decreasing(b, uint64(cmdID.Random))
+}
+
+// GetResponse looks up a response matching the specified cmdID and
+// decodes it into reply. Returns true if a response was found. Empty
+// command IDs are never found.
+func (rc *ResponseCache) GetResponse(cmdID ClientCmdID, reply interface{}) (bool, error) {
+	if cmdID.IsEmpty() {
+		return false, nil
+	}
+	ok, _, err := getI(rc.engine, responseCacheKey(rc.rangeID, cmdID), reply)
+	return ok, err
+}
+
+// PutResponse writes reply to the cache for the specified cmdID. It's
+// a no-op for an empty command ID.
+func (rc *ResponseCache) PutResponse(cmdID ClientCmdID, reply interface{}) error {
+	if cmdID.IsEmpty() {
+		return nil
+	}
+	return putI(rc.engine, responseCacheKey(rc.rangeID, cmdID), reply)
+}
+
+// GC removes the cached responses of commands whose IDs were issued
+// at wall times below threshold's. Entries are ordered by decreasing
+// wall time, so they're the entries following threshold's.
+func (rc *ResponseCache) GC(threshold hlc.HLTimestamp) error {
+	prefix := responseCacheKeyPrefix(rc.rangeID)
+	start := encodeUint64Decreasing(prefix, uint64(threshold.WallTime))
+	kvs, err := rc.engine.scan(PrefixEndKey(start), PrefixEndKey(prefix), 0)
+	if err != nil || len(kvs) == 0 {
+		return err
+	}
+	dels := make([]Key, len(kvs))
+	for i, kv := range kvs {
+		dels[i] = kv.Key
+	}
+	return rc.engine.writeBatch(nil, dels)
+}
+
+// CopyInto copies all cached responses to the response cache of the
+// range with the specified ID. This is used when a range is split, so
+// that retries of commands executed prior to the split aren't
+// re-executed by the new range.
+func (rc *ResponseCache) CopyInto(destRangeID int64) error {
+	prefix := responseCacheKeyPrefix(rc.rangeID)
+	destPrefix := responseCacheKeyPrefix(destRangeID)
+	kvs, err := rc.engine.scan(prefix, PrefixEndKey(prefix), 0)
+	if err != nil || len(kvs) == 0 {
+		return err
+	}
+	puts := make([]KeyValue, len(kvs))
+	for i, kv := range kvs {
+		puts[i] = KeyValue{Key: MakeKey(destPrefix, kv.Key[len(prefix):]), Value: kv.Value}
+	}
+	return rc.engine.writeBatch(puts, nil)
+}
+
+// ClearData removes all cached responses.
+func (rc *ResponseCache) ClearData() error {
+	prefix := responseCacheKeyPrefix(rc.rangeID)
+	kvs, err := rc.engine.scan(prefix, PrefixEndKey(prefix), 0)
+	if err != nil || len(kvs) == 0 {
+		return err
+	}
+	dels := make([]Key, len(kvs))
+	for i, kv := range kvs {
+		dels[i] = kv.Key
+	}
+	return rc.engine.writeBatch(nil, dels)
+}
@@ -0,0 +1,108 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/hlc"
+)
+
+var testCmdID = ClientCmdID{WallTime: 1, Random: 1}
+
+// TestResponseCachePutGetClearData verifies basic operation of the
+// response cache.
+func TestResponseCachePutGetClearData(t *testing.T) {
+	rc := NewResponseCache(1, NewInMem(Attributes{}, 1<<20))
+	reply := &IncrementResponse{NewValue: 1}
+	if ok, err := rc.GetResponse(testCmdID, &IncrementResponse{}); ok || err != nil {
+		t.Errorf("expected no response; got %t, %v", ok, err)
+	}
+	if err := rc.PutResponse(testCmdID, reply); err != nil {
+		t.Fatal(err)
+	}
+	cached := &IncrementResponse{}
+	if ok, err := rc.GetResponse(testCmdID, cached); !ok || err != nil || cached.NewValue != 1 {
+		t.Errorf("expected cached response %+v; got %+v, %t, %v", reply, cached, ok, err)
+	}
+	if err := rc.ClearData(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := rc.GetResponse(testCmdID, &IncrementResponse{}); ok || err != nil {
+		t.Errorf("expected no response after clear; got %t, %v", ok, err)
+	}
+}
+
+// TestResponseCacheEmptyCmdID verifies that responses of commands
+// without a command ID aren't cached.
+func TestResponseCacheEmptyCmdID(t *testing.T) {
+	rc := NewResponseCache(1, NewInMem(Attributes{}, 1<<20))
+	if err := rc.PutResponse(ClientCmdID{}, &IncrementResponse{NewValue: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := rc.GetResponse(ClientCmdID{}, &IncrementResponse{}); ok || err != nil {
+		t.Errorf("expected no response; got %t, %v", ok, err)
+	}
+}
+
+// TestResponseCacheCopyInto verifies that responses are copied to
+// another range's cache without affecting ranges whose IDs share a
+// prefix.
+func TestResponseCacheCopyInto(t *testing.T) {
+	engine := NewInMem(Attributes{}, 1<<20)
+	rc1 := NewResponseCache(1, engine)
+	rc16 := NewResponseCache(16, engine)
+	if err := rc16.PutResponse(testCmdID, &IncrementResponse{NewValue: 16}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc1.PutResponse(testCmdID, &IncrementResponse{NewValue: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc1.CopyInto(2); err != nil {
+		t.Fatal(err)
+	}
+	cached := &IncrementResponse{}
+	if ok, err := NewResponseCache(2, engine).GetResponse(testCmdID, cached); !ok || err != nil || cached.NewValue != 1 {
+		t.Errorf("expected copied response; got %+v, %t, %v", cached, ok, err)
+	}
+	if err := rc1.ClearData(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := rc16.GetResponse(testCmdID, cached); !ok || err != nil || cached.NewValue != 16 {
+		t.Errorf("expected response of range 16 to be unaffected; got %+v, %t, %v", cached, ok, err)
+	}
+}
+
+// TestResponseCacheGC verifies that responses of commands issued
+// before the GC threshold are removed and later ones are kept.
+func TestResponseCacheGC(t *testing.T) {
+	rc := NewResponseCache(1, NewInMem(Attributes{}, 1<<20))
+	cmdIDs := []ClientCmdID{{WallTime: 1, Random: 1}, {WallTime: 2, Random: 1}, {WallTime: 3, Random: 1}}
+	for _, cmdID := range cmdIDs {
+		if err := rc.PutResponse(cmdID, &IncrementResponse{NewValue: cmdID.WallTime}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rc.GC(hlc.HLTimestamp{WallTime: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for i, cmdID := range cmdIDs {
+		expOK := cmdID.WallTime >= 2
+		if ok, err := rc.GetResponse(cmdID, &IncrementResponse{}); ok != expOK || err != nil {
+			t.Errorf("%d: expected cached response %t; got %t, %v", i, expOK, ok, err)
+		}
+	}
+}
@@ -29,11 +29,12 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
+	"os"
 	"syscall"
 	"unsafe"
 
 	"github.com/cockroachdb/cockroach/util"
-	"github.com/golang/glog"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 // defaultCacheSize is the default value for the cacheSize command line flag.
@@ -71,13 +72,37 @@ func NewRocksDB(attrs Attributes, dir string) (*RocksDB, error) {
 	}
 	if _, err := r.capacity(); err != nil {
 		if err := r.destroy(); err != nil {
-			glog.Warningf("could not destroy db at %s", dir)
+			log.New("storage").Warningf("could not destroy db at %s", dir)
 		}
 		return nil, err
 	}
 	return r, nil
 }
 
+// OpenRocksDBReadOnly opens the existing RocksDB database in dir and
+// returns a read-only engine for it (see NewReadOnlyEngine). Unlike
+// NewRocksDB, it neither creates a missing database nor destroys one
+// it fails to open, so it's safe for inspecting a damaged store.
+func OpenRocksDBReadOnly(attrs Attributes, dir string) (Engine, error) {
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return nil, util.Errorf("no RocksDB database at %s", dir)
+	}
+	r := &RocksDB{attrs: attrs, dir: dir}
+	r.createOptions()
+	C.rocksdb_options_set_create_if_missing(r.opts, 0)
+
+	cDir := C.CString(dir)
+	defer C.free(unsafe.Pointer(cDir))
+
+	var cErr *C.char
+	if r.rdb = C.rocksdb_open(r.opts, cDir, &cErr); cErr != nil {
+		r.rdb = nil
+		r.destroyOptions()
+		return nil, charToErr(cErr)
+	}
+	return NewReadOnlyEngine(r), nil
+}
+
 // destroy destroys the underlying filesystem data associated with the database.
 func (r *RocksDB) destroy() error {
 	cDir := C.CString(r.dir)
@@ -146,6 +171,7 @@ func emptyKeyError() error {
 // The key and value byte slices may be reused safely. put takes a copy of
 // them before returning.
 func (r *RocksDB) put(key Key, value Value) error {
+	rocksDBMetrics.puts.Inc(1)
 	if len(key) == 0 {
 		return emptyKeyError()
 	}
@@ -177,6 +203,7 @@ func (r *RocksDB) put(key Key, value Value) error {
 
 // get returns the value for the given key.
 func (r *RocksDB) get(key Key) (Value, error) {
+	rocksDBMetrics.gets.Inc(1)
 	if len(key) == 0 {
 		return Value{}, emptyKeyError()
 	}
@@ -205,6 +232,7 @@ func (r *RocksDB) get(key Key) (Value, error) {
 
 // del removes the item from the db with the given key.
 func (r *RocksDB) del(key Key) error {
+	rocksDBMetrics.deletes.Inc(1)
 	if len(key) == 0 {
 		return emptyKeyError()
 	}
@@ -226,12 +254,26 @@ func (r *RocksDB) del(key Key) error {
 // start (inclusive) and ending at end (non-inclusive).
 // If max is zero then the number of key/values returned is unbounded.
 func (r *RocksDB) scan(start, end Key, max int64) ([]KeyValue, error) {
+	rocksDBMetrics.scans.Inc(1)
+	kvs, err := r.scanSnapshot(start, end, max, nil)
+	if err == nil {
+		rocksDBMetrics.scanRows.Update(int64(len(kvs)))
+	}
+	return kvs, err
+}
+
+// scanSnapshot implements scan, reading from the specified snapshot
+// or, if snap is nil, from the current state of the database.
+func (r *RocksDB) scanSnapshot(start, end Key, max int64, snap *C.rocksdb_snapshot_t) ([]KeyValue, error) {
 	// In order to prevent content displacement, caching is disabled
 	// when performing scans. Any options set within the shared read
 	// options field that should be carried over needs to be set here
 	// as well.
 	opts := C.rocksdb_readoptions_create()
 	C.rocksdb_readoptions_set_fill_cache(opts, 0)
+	if snap != nil {
+		C.rocksdb_readoptions_set_snapshot(opts, snap)
+	}
 	defer C.rocksdb_readoptions_destroy(opts)
 	it := C.rocksdb_create_iterator(r.rdb, opts)
 	defer C.rocksdb_iter_destroy(it)
@@ -275,9 +317,85 @@ func (r *RocksDB) scan(start, end Key, max int64) ([]KeyValue, error) {
 	return keyVals, nil
 }
 
+// reverseScan returns up to max key/value objects starting from the
+// last key before end and ending at start (inclusive), in descending
+// key order.
+func (r *RocksDB) reverseScan(start, end Key, max int64) ([]KeyValue, error) {
+	rocksDBMetrics.scans.Inc(1)
+	// As for scans, caching is disabled to prevent content
+	// displacement.
+	opts := C.rocksdb_readoptions_create()
+	C.rocksdb_readoptions_set_fill_cache(opts, 0)
+	defer C.rocksdb_readoptions_destroy(opts)
+	it := C.rocksdb_create_iterator(r.rdb, opts)
+	defer C.rocksdb_iter_destroy(it)
+
+	// Position the iterator at the last key before end: the key
+	// preceding the first at or after end, or the last key if there
+	// is none.
+	if len(end) == 0 {
+		C.rocksdb_iter_seek_to_last(it)
+	} else {
+		C.rocksdb_iter_seek(it, (*C.char)(unsafe.Pointer(&end[0])), C.size_t(len(end)))
+		if C.rocksdb_iter_valid(it) == 1 {
+			C.rocksdb_iter_prev(it)
+		} else {
+			C.rocksdb_iter_seek_to_last(it)
+		}
+	}
+	keyVals := []KeyValue{}
+	for ; C.rocksdb_iter_valid(it) == 1; C.rocksdb_iter_prev(it) {
+		if max > 0 && int64(len(keyVals)) >= max {
+			break
+		}
+		var l C.size_t
+		data := C.rocksdb_iter_key(it, &l)
+		k := C.GoBytes(unsafe.Pointer(data), C.int(l))
+		if bytes.Compare(k, start) < 0 {
+			break
+		}
+		data = C.rocksdb_iter_value(it, &l)
+		v := C.GoBytes(unsafe.Pointer(data), C.int(l))
+		keyVals = append(keyVals, KeyValue{
+			Key:   k,
+			Value: Value{Bytes: v},
+		})
+	}
+	var cErr *C.char
+	C.rocksdb_iter_get_error(it, &cErr)
+	if cErr != nil {
+		return nil, charToErr(cErr)
+	}
+	rocksDBMetrics.scanRows.Update(int64(len(keyVals)))
+	return keyVals, nil
+}
+
+// rocksDBSnapshot is a snapshot of a RocksDB database.
+type rocksDBSnapshot struct {
+	r    *RocksDB
+	snap *C.rocksdb_snapshot_t
+}
+
+// snapshot returns a RocksDB snapshot of the database.
+func (r *RocksDB) snapshot() (engineSnapshot, error) {
+	return &rocksDBSnapshot{r: r, snap: C.rocksdb_create_snapshot(r.rdb)}, nil
+}
+
+// scan returns up to max key/value objects from the snapshot starting
+// from start (inclusive) and ending at end (non-inclusive).
+func (s *rocksDBSnapshot) scan(start, end Key, max int64) ([]KeyValue, error) {
+	return s.r.scanSnapshot(start, end, max, s.snap)
+}
+
+// release releases the RocksDB snapshot.
+func (s *rocksDBSnapshot) release() {
+	C.rocksdb_release_snapshot(s.r.rdb, s.snap)
+}
+
 // writeBatch applies all puts and deletes atomically via RocksDB write
 // batch facility.
 func (r *RocksDB) writeBatch(puts []KeyValue, dels []Key) error {
+	rocksDBMetrics.batches.Inc(1)
 	batch := C.rocksdb_writebatch_create()
 	defer C.rocksdb_writebatch_destroy(batch)
 
@@ -184,3 +184,35 @@ func ensureRangeEqual(t *testing.T, sortedKeys []string, keyMap map[string][]byt
 		}
 	}
 }
+
+func TestOpenRocksDBReadOnly(t *testing.T) {
+	loc := fmt.Sprintf("%s/data_%d", os.TempDir(), time.Now().UnixNano())
+	if _, err := OpenRocksDBReadOnly(Attributes{}, loc); err == nil {
+		t.Errorf("expected error opening missing rocksdb db at %s", loc)
+	}
+	engine, err := NewRocksDB(Attributes([]string{"ssd"}), loc)
+	if err != nil {
+		t.Fatalf("could not create new rocksdb db instance at %s: %v", loc, err)
+	}
+	defer func(t *testing.T) {
+		if err := engine.destroy(); err != nil {
+			t.Errorf("could not delete rocksdb db at %s: %v", loc, err)
+		}
+	}(t)
+	if err := engine.put(Key("a"), Value{Bytes: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	engine.close()
+
+	ro, err := OpenRocksDBReadOnly(Attributes{}, loc)
+	if err != nil {
+		t.Fatalf("could not open rocksdb db at %s: %v", loc, err)
+	}
+	defer ro.(readOnlyEngine).Engine.(*RocksDB).close()
+	if val, err := ro.get(Key("a")); err != nil || !bytes.Equal(val.Bytes, []byte("a")) {
+		t.Errorf("expected to read %q; got %q, %v", "a", val.Bytes, err)
+	}
+	if err := ro.put(Key("b"), Value{Bytes: []byte("b")}); err != errReadOnly {
+		t.Errorf("expected read-only error on put; got %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// scanInterval is the interval between passes of the range scanner.
+const scanInterval = 10 * time.Second
+
+// A rangeQueue is a maintenance task which the range scanner runs
+// over each of the store's ranges on every pass.
+type rangeQueue interface {
+	// name returns the name of the queue for logging.
+	name() string
+	// beginScan is invoked at the start of each pass, before any
+	// range is processed.
+	beginScan() error
+	// process performs the queue's maintenance on the range.
+	process(rng *Range) error
+}
+
+// A rangeScanner periodically iterates over the store's ranges in key
+// order and passes each range to every queue. Queues are independent:
+// an error returned by one queue is logged and doesn't prevent other
+// queues or ranges from being processed. A pass may also be triggered
+// ahead of the interval; see trigger.
+type rangeScanner struct {
+	store     *Store
+	interval  time.Duration
+	queues    []rangeQueue
+	triggered chan struct{} // Signals a pending triggered pass
+}
+
+// newRangeScanner returns a scanner for the store which runs a pass
+// over its ranges every interval.
+func newRangeScanner(store *Store, interval time.Duration, queues ...rangeQueue) *rangeScanner {
+	return &rangeScanner{
+		store:     store,
+		interval:  interval,
+		queues:    queues,
+		triggered: make(chan struct{}, 1),
+	}
+}
+
+// trigger requests a scanner pass without waiting for the interval to
+// elapse. Triggers received while a pass is pending are coalesced.
+func (rs *rangeScanner) trigger() {
+	select {
+	case rs.triggered <- struct{}{}:
+	default:
+	}
+}
+
+// start runs scanner passes in a worker of the stopper until it's
+// stopped.
+func (rs *rangeScanner) start(stopper *util.Stopper) {
+	stopper.RunWorker(func() {
+		ticker := time.NewTicker(rs.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rs.scan()
+			case <-rs.triggered:
+				rs.scan()
+			case <-stopper.ShouldStop():
+				return
+			}
+		}
+	})
+}
+
+// scan runs a single pass of all queues over the store's ranges and
+// then records the rollup of the stats of the ranges which remain.
+func (rs *rangeScanner) scan() {
+	var queues []rangeQueue
+	for _, q := range rs.queues {
+		if err := q.beginScan(); err != nil {
+			rs.store.logger().Warningf("%s queue failed to begin scan: %v", q.name(), err)
+			continue
+		}
+		queues = append(queues, q)
+	}
+	stats := StoreStats{Timestamp: time.Now().UnixNano()}
+	for _, rng := range rs.store.sortedRanges() {
+		for _, q := range queues {
+			// A previous queue may have removed the range from the store.
+			if _, err := rs.store.GetRange(rng.Meta.RangeID); err != nil {
+				break
+			}
+			if err := q.process(rng); err != nil {
+				rng.logger().Warningf("%s queue failed: %v", q.name(), err)
+			}
+		}
+		if _, err := rs.store.GetRange(rng.Meta.RangeID); err == nil {
+			stats.Add(rng.Stats())
+			stats.RangeCount++
+		}
+	}
+	if err := rs.store.setStats(stats); err != nil {
+		rs.store.logger().Warningf("failed to persist stats rollup: %v", err)
+	}
+}
+
+// splitQueue splits ranges whose size exceeds the maximum range size
+// of their zone. Ranges also check whether to split after each write;
+// the queue catches ranges whose zone's maximum size was lowered.
+type splitQueue struct{}
+
+func (splitQueue) name() string     { return "split" }
+func (splitQueue) beginScan() error { return nil }
+
+func (splitQueue) process(rng *Range) error {
+	rng.maybeSplit()
+	return nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// A RangeSnapshot is a consistent copy of a range's data, read from
+// an engine snapshot. It's used to instantiate a replica being added
+// to the range on another store (see Range.ChangeReplicas). The data
+// comprises the engine key/value pairs of the range's versioned data,
+// transaction records, response cache, abort cache, leader lease and
+// closed timestamp. The range's MVCC stats aren't included; they're
+// computed by the receiver.
+type RangeSnapshot struct {
+	Meta     RangeMetadata // Metadata of the range, including the new replica
+	Data     []KeyValue    // Engine key/value pairs, ordered by span
+	Checksum []byte        // SHA-256 checksum of Data
+
+	memory *util.MemoryBudget // Charged for Data while the snapshot is held
+}
+
+// snapshotSpans returns the engine key spans, each [start, end),
+// which hold the data of the range described by meta.
+func snapshotSpans(meta RangeMetadata) [][2]Key {
+	leaseKey := rangeLeaderLeaseKey(meta.RangeID)
+	closedTSKey := rangeClosedTimestampKey(meta.RangeID)
+	respCachePrefix := responseCacheKeyPrefix(meta.RangeID)
+	abortCachePrefix := abortCacheKeyPrefix(meta.RangeID)
+	return [][2]Key{
+		{closedTSKey, MakeKey(closedTSKey, Key{0})},
+		{leaseKey, MakeKey(leaseKey, Key{0})},
+		{respCachePrefix, PrefixEndKey(respCachePrefix)},
+		{abortCachePrefix, PrefixEndKey(abortCachePrefix)},
+		{txnKey(meta.StartKey, ""), txnKey(meta.EndKey, "")},
+		{mvccEncodeKey(meta.StartKey), mvccEncodeKey(meta.EndKey)},
+	}
+}
+
+// snapshotChecksum returns the SHA-256 checksum of the key/value
+// pairs. Keys and values are prefixed with their lengths so that
+// different sequences of pairs can't have the same encoding.
+func snapshotChecksum(kvs []KeyValue) []byte {
+	h := sha256.New()
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	for _, kv := range kvs {
+		for _, b := range [][]byte{kv.Key, kv.Value.Bytes} {
+			h.Write(lenBuf[:binary.PutUvarint(lenBuf, uint64(len(b)))])
+			h.Write(b)
+		}
+	}
+	return h.Sum(nil)
+}
+
+// Snapshot returns a snapshot of the range's data, read from a
+// consistent engine snapshot. The snapshot's metadata specifies
+// replicas as the range's replicas.
+func (r *Range) Snapshot(replicas []Replica) (*RangeSnapshot, error) {
+	meta := r.getMeta()
+	meta.Replicas.Replicas = replicas
+	engSnap, err := r.engine.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer engSnap.release()
+	snap := &RangeSnapshot{Meta: meta, memory: r.snapshotMemory.NewChild("snapshot", 0)}
+	for _, span := range snapshotSpans(meta) {
+		kvs, err := engSnap.scan(span[0], span[1], 0)
+		if err == nil {
+			err = snap.memory.Reserve(kvsSize(kvs))
+		}
+		if err != nil {
+			snap.release()
+			return nil, err
+		}
+		snap.Data = append(snap.Data, kvs...)
+	}
+	snap.Checksum = snapshotChecksum(snap.Data)
+	return snap, nil
+}
+
+// size returns the number of bytes of data in the snapshot.
+func (snap *RangeSnapshot) size() int64 {
+	return kvsSize(snap.Data)
+}
+
+// kvsSize returns the number of bytes of the keys and values.
+func kvsSize(kvs []KeyValue) int64 {
+	var size int64
+	for _, kv := range kvs {
+		size += int64(len(kv.Key) + len(kv.Value.Bytes))
+	}
+	return size
+}
+
+// release releases the memory charged for the snapshot's data. The
+// snapshot must not be used afterwards.
+func (snap *RangeSnapshot) release() {
+	snap.memory.Close()
+}
+
+// verify returns an error if the snapshot's checksum doesn't match
+// its data or if any of its data lies outside the range's spans.
+func (snap *RangeSnapshot) verify() error {
+	if !bytes.Equal(snapshotChecksum(snap.Data), snap.Checksum) {
+		return util.Errorf("range %d: snapshot checksum mismatch", snap.Meta.RangeID)
+	}
+	spans := snapshotSpans(snap.Meta)
+	for _, kv := range snap.Data {
+		contained := false
+		for _, span := range spans {
+			if bytes.Compare(kv.Key, span[0]) >= 0 && bytes.Compare(kv.Key, span[1]) < 0 {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			return util.Errorf("range %d: snapshot key %q is outside the range", snap.Meta.RangeID, kv.Key)
+		}
+	}
+	return nil
+}
+
+// ApplySnapshot instantiates a replica on the store from the
+// snapshot. The snapshot is verified before any data is written, and
+// must list a replica of the range on this store. The replica is only
+// added to the store, and so becomes visible to requests, once all of
+// its data has been written. Snapshots in excess of the store's limit
+// on concurrent snapshot applications wait their turn. Returns an
+// error if the store is full (see SetFullThreshold), or if the range
+// already exists on the store or overlaps another of the store's
+// ranges.
+func (s *Store) ApplySnapshot(snap *RangeSnapshot) error {
+	meta := snap.Meta
+	if err := snap.verify(); err != nil {
+		return err
+	}
+	if full, err := s.IsFull(); err != nil {
+		return err
+	} else if full {
+		return util.Errorf("range %d: %s is full; refusing new replica", meta.RangeID, s)
+	}
+	if err := s.throttle.acquireSnapshotApply(); err != nil {
+		return err
+	}
+	defer s.throttle.releaseSnapshotApply()
+	// The snapshot is charged to the store's snapshot budget while
+	// it's applied, so that concurrent applications don't exhaust
+	// memory.
+	budget := s.snapshotMemory.NewChild("snapshot", 0)
+	defer budget.Close()
+	if err := budget.Reserve(snap.size()); err != nil {
+		return err
+	}
+	found := false
+	for _, replica := range meta.Replicas.Replicas {
+		if replica.NodeID == s.Ident.NodeID && replica.StoreID == s.Ident.StoreID && replica.RangeID == meta.RangeID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return util.Errorf("range %d: snapshot has no replica on %s", meta.RangeID, s)
+	}
+	s.mu.Lock()
+	_, exists := s.ranges[meta.RangeID]
+	overlapping := s.overlappingRangeLocked(meta)
+	s.mu.Unlock()
+	if exists {
+		return util.Errorf("range %d already exists on store", meta.RangeID)
+	} else if overlapping != nil {
+		return util.Errorf("range %d overlaps range %d on store", meta.RangeID, overlapping.Meta.RangeID)
+	}
+
+	metaKV, err := encodeI(rangeKey(meta.RangeID), meta)
+	if err != nil {
+		return err
+	}
+	// Remove stale stats so that they're computed from the snapshot's
+	// data when the range is started.
+	if err := s.engine.writeBatch(append(snap.Data, metaKV), []Key{rangeStatsKey(meta.RangeID)}); err != nil {
+		return err
+	}
+	return s.AddRange(meta)
+}
@@ -0,0 +1,208 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/hlc"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// createTestStore returns a bootstrapped store with the specified
+// node and store IDs.
+func createTestStore(nodeID, storeID int32, t *testing.T) *Store {
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), NewInMem(Attributes{}, 1<<20), nil, nil)
+	if err := store.Bootstrap(StoreIdent{ClusterID: testIdent.ClusterID, NodeID: nodeID, StoreID: storeID}); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// TestChangeReplicasSendsSnapshot verifies that a replica added via
+// ChangeReplicas is instantiated on its store from a snapshot of the
+// range's data.
+func TestChangeReplicasSendsSnapshot(t *testing.T) {
+	store1, store2 := createTestStore(1, 1, t), createTestStore(2, 2, t)
+	defer store1.Close()
+	defer store2.Close()
+	store1.db = &storeDB{store: store1, remotes: map[int32]*Store{2: store2}}
+	rng, err := store1.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []Key{Key("a"), Key("b")} {
+		if reply := <-store1.db.Put(&PutRequest{Key: key, Value: Value{Bytes: key}}); reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+
+	replicas := []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}, {NodeID: 2, StoreID: 2, RangeID: 1}}
+	if err := rng.ChangeReplicas(replicas); err != nil {
+		t.Fatal(err)
+	}
+	newRng, err := store2.GetRange(1)
+	if err != nil {
+		t.Fatalf("expected range on store 2: %v", err)
+	}
+	if !sameReplicaStores(newRng.Meta.Replicas.Replicas, replicas) {
+		t.Errorf("expected replicas %+v; got %+v", replicas, newRng.Meta.Replicas.Replicas)
+	}
+	for _, key := range []Key{Key("a"), Key("b")} {
+		val, err := newRng.mvcc.Get(key, store2.clock.Now(), nil)
+		if err != nil || val == nil || !bytes.Equal(val.Bytes, key) {
+			t.Errorf("expected %q on new replica; got %+v, %v", key, val, err)
+		}
+	}
+	if newRng.Stats().LiveCount != 2 {
+		t.Errorf("expected stats to be computed for 2 live keys; got %+v", newRng.Stats())
+	}
+}
+
+// TestApplySnapshotVerifies verifies that snapshots which are corrupt,
+// don't list a replica on the store or conflict with the store's
+// ranges are rejected.
+func TestApplySnapshotVerifies(t *testing.T) {
+	store1, store2 := createTestStore(1, 1, t), createTestStore(2, 2, t)
+	defer store1.Close()
+	defer store2.Close()
+	rng, err := store1.CreateRange(KeyMin, Key("m"), []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := &PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}
+	if err := <-rng.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	replicas := []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}, {NodeID: 2, StoreID: 2, RangeID: 1}}
+	newSnap := func() *RangeSnapshot {
+		snap, err := rng.Snapshot(replicas)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return snap
+	}
+
+	corrupt := newSnap()
+	corrupt.Data[len(corrupt.Data)-1].Value.Bytes = []byte("corrupt")
+	outside := newSnap()
+	outside.Data = append(outside.Data, KeyValue{Key: mvccEncodeKey(Key("z"))})
+	outside.Checksum = snapshotChecksum(outside.Data)
+	noReplica := newSnap()
+	noReplica.Meta.Replicas.Replicas = replicas[:1]
+	for i, snap := range []*RangeSnapshot{corrupt, outside, noReplica} {
+		if err := store2.ApplySnapshot(snap); err == nil {
+			t.Errorf("%d: expected snapshot to be rejected", i)
+		}
+		if _, err := store2.GetRange(1); err == nil {
+			t.Fatalf("%d: expected no range to be added", i)
+		}
+	}
+
+	if _, err := store2.CreateRange(Key("l"), KeyMax, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := store2.ApplySnapshot(newSnap()); err == nil {
+		t.Error("expected overlapping snapshot to be rejected")
+	}
+}
+
+// TestApplySnapshotFullStore verifies that full stores refuse
+// snapshots for new replicas and advertise themselves as full.
+func TestApplySnapshotFullStore(t *testing.T) {
+	store1, store2 := createTestStore(1, 1, t), createTestStore(2, 2, t)
+	defer store1.Close()
+	defer store2.Close()
+	rng, err := store1.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := rng.Snapshot([]Replica{{NodeID: 1, StoreID: 1, RangeID: 1}, {NodeID: 2, StoreID: 2, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store2.SetFullThreshold(0)
+	if desc, err := store2.Descriptor(&NodeDescriptor{NodeID: 2}); err != nil || !desc.Full {
+		t.Errorf("expected full store descriptor; got %+v, %v", desc, err)
+	}
+	if err := store2.ApplySnapshot(snap); err == nil {
+		t.Error("expected full store to refuse snapshot")
+	}
+	if _, err := store2.GetRange(1); err == nil {
+		t.Fatal("expected no range to be added")
+	}
+
+	store2.SetFullThreshold(1)
+	if desc, err := store2.Descriptor(&NodeDescriptor{NodeID: 2}); err != nil || desc.Full {
+		t.Errorf("expected store descriptor not to be full; got %+v, %v", desc, err)
+	}
+	if err := store2.ApplySnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSnapshotMemoryBudget verifies that snapshots are charged to the
+// store's budgets while held and applied, and fail if they'd exceed
+// the budget of the store's node.
+func TestSnapshotMemoryBudget(t *testing.T) {
+	store1, store2 := createTestStore(1, 1, t), createTestStore(2, 2, t)
+	defer store1.Close()
+	defer store2.Close()
+	node1, node2 := util.NewMemoryBudget("node1", 1<<20), util.NewMemoryBudget("node2", 1)
+	store1.SetMemoryBudget(node1)
+	store2.SetMemoryBudget(node2)
+	rng, err := store1.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := &PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}
+	if err := <-rng.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	replicas := []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}, {NodeID: 2, StoreID: 2, RangeID: 1}}
+	snap, err := rng.Snapshot(replicas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := node1.Used(); used != snap.size() {
+		t.Errorf("expected snapshot's %d bytes to be charged; got %d", snap.size(), used)
+	}
+	if err := store2.ApplySnapshot(snap); err == nil {
+		t.Error("expected snapshot application to exceed memory budget")
+	}
+	node2.SetLimit(0)
+	if err := store2.ApplySnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+	if used := node2.Used(); used != 0 {
+		t.Errorf("expected applied snapshot to free its memory; got %d bytes in use", used)
+	}
+	snap.release()
+	if used := node1.Used(); used != 0 {
+		t.Errorf("expected released snapshot to free its memory; got %d bytes in use", used)
+	}
+
+	node1.SetLimit(1)
+	if _, err := rng.Snapshot(replicas); err == nil {
+		t.Error("expected snapshot to exceed memory budget")
+	}
+	if used := node1.Used(); used != 0 {
+		t.Errorf("expected failed snapshot to release its memory; got %d bytes in use", used)
+	}
+}
@@ -18,13 +18,18 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"strconv"
 	"sync"
-	"time"
 
+	"code.google.com/p/biogo.store/llrb"
 	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/hlc"
+	"github.com/cockroachdb/cockroach/multiraft"
 	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 // Constants for store-reserved keys. These keys are prefixed with
@@ -36,12 +41,19 @@ var (
 	// keyStoreIdent store immutable identifier for this store, created
 	// when store is first bootstrapped.
 	keyStoreIdent = Key("\x00\x00\x00store-ident")
-	// keyRangeIDGenerator is a range ID generator sequence. Range IDs
-	// must be unique per node ID.
+	// keyRangeIDGenerator is a range ID generator sequence, used to
+	// allocate range IDs by stores without a range ID allocator (see
+	// Store.SetRangeIDAllocator).
 	keyRangeIDGenerator = Key("\x00\x00\x00range-id-generator")
 	// keyRangeMetadataPrefix is the prefix for keys storing range metadata.
 	// The value is a struct of type RangeMetadata.
 	keyRangeMetadataPrefix = Key("\x00\x00\x00range-")
+	// keyGossipBootstrap holds the addresses of the gossip peers most
+	// recently known to the store's node. See WriteGossipBootstrap.
+	keyGossipBootstrap = Key("\x00\x00\x00gossip-bootstrap")
+	// keyStoreStats holds the latest rollup of the stats of the
+	// store's ranges. The value is a struct of type StoreStats.
+	keyStoreStats = Key("\x00\x00\x00store-stats")
 )
 
 // rangeKey creates a range key as the concatenation of the
@@ -50,6 +62,35 @@ func rangeKey(rangeID int64) Key {
 	return MakeKey(keyRangeMetadataPrefix, Key(strconv.FormatInt(rangeID, 16)))
 }
 
+// loadRangeMetadata returns the metadata of all ranges stored in the
+// engine, in order of range key.
+func loadRangeMetadata(engine Engine) ([]RangeMetadata, error) {
+	kvs, err := engine.scan(keyRangeMetadataPrefix, PrefixEndKey(keyRangeMetadataPrefix), 0)
+	if err != nil {
+		return nil, err
+	}
+	var metas []RangeMetadata
+	for _, kv := range kvs {
+		// The range ID generator shares the range metadata prefix.
+		if bytes.Equal(kv.Key, keyRangeIDGenerator) {
+			continue
+		}
+		var meta RangeMetadata
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value.Bytes)).Decode(&meta); err != nil {
+			return nil, util.Errorf("unable to decode range metadata at %q: %v", kv.Key, err)
+		}
+		metas = append(metas, meta)
+	}
+	return metas, nil
+}
+
+// An IDAllocator allocates unique IDs from a cluster-wide sequence.
+// It's implemented by kv.IDAllocator and defined here to avoid a
+// circular dependency.
+type IDAllocator interface {
+	Allocate() (int64, error)
+}
+
 // A StoreIdent uniquely identifies a store in the cluster. The
 // StoreIdent is written to the underlying storage engine at a
 // store-reserved system key (keyStoreIdent).
@@ -59,31 +100,115 @@ type StoreIdent struct {
 	StoreID   int32
 }
 
-// A Store maintains a map of ranges by start key. A Store corresponds
-// to one physical device.
+// A rangeKeyItem indexes a range by its start key in the store's
+// ordered range index. A range's start key never changes: splits and
+// merges modify only the end key of the range which remains.
+type rangeKeyItem struct {
+	startKey Key
+	rng      *Range
+}
+
+// Compare implements the llrb.Comparable interface for tree nodes.
+func (ri *rangeKeyItem) Compare(b llrb.Comparable) int {
+	return bytes.Compare(ri.startKey, b.(*rangeKeyItem).startKey)
+}
+
+// StoreStats is a rollup of the MVCC stats of a store's ranges,
+// computed on each pass of the store's range scanner and persisted to
+// the store. Ranges split or added during a pass are rolled up on the
+// next pass.
+type StoreStats struct {
+	MVCCStats
+	RangeCount int   // Number of ranges rolled up
+	Timestamp  int64 // Wall time of the rollup (Unix-nanos); zero if none
+}
+
+// A Store maintains the ranges it hosts, indexed both by range ID
+// and by key span. A Store corresponds to one physical device, though
+// its raft logs may be placed on another (see SetRaftEngine). Each
+// store runs a range scanner which periodically passes its ranges to
+// maintenance queues (see rangeScanner).
 type Store struct {
-	Ident     StoreIdent
-	engine    Engine           // The underlying key-value store
-	allocator *allocator       // Makes allocation decisions
-	gossip    *gossip.Gossip   // Passed to new ranges
-	mu        sync.Mutex       // Protects the ranges map
-	ranges    map[int64]*Range // Map of ranges by range ID
+	Ident          StoreIdent
+	clock          *hlc.HLClock       // Clock used to timestamp commands
+	engine         Engine             // The underlying key-value store
+	raftEngine     Engine             // Stores the raft state of ranges; engine by default
+	db             DB                 // Client to the distributed KV store
+	rangeIDs       IDAllocator        // Allocates cluster-wide range IDs; nil for store-local ones
+	storePool      *storePool         // Tracks gossiped stores and their health
+	allocator      *allocator         // Makes allocation decisions
+	liveness       *livenessMonitor   // Determines node liveness from gossip
+	rebalancer     *rebalancer        // Moves replicas off overloaded store; started by Init
+	scanner        *rangeScanner      // Runs maintenance queues over ranges; started by Init
+	stopper        *util.Stopper      // Stops the rebalancer and range scanner
+	throttle       *throttle          // Paces background work of the store's ranges
+	admission      *admission         // Admits client requests to the store's ranges
+	memory         *util.MemoryBudget // Parent of the store's memory budgets
+	requestMemory  *util.MemoryBudget // Charged for rows read by scans
+	snapshotMemory *util.MemoryBudget // Charged for snapshots taken and applied
+	changeFeed     *ChangeFeed        // Receives the writes committed by the store's ranges
+	gossip         *gossip.Gossip     // Passed to new ranges
+	mu             sync.Mutex         // Protects ranges, rangesByKey, fullThreshold and stats
+	ranges         map[int64]*Range   // Map of ranges by range ID
+	rangesByKey    llrb.Tree          // Ranges ordered by start key (*rangeKeyItem)
+	fullThreshold  float64            // Fraction of capacity used beyond which replicas are refused
+	stats          StoreStats         // Latest rollup of the stats of the store's ranges
+	draining       int32              // Non-zero while the store is draining; atomic
 }
 
-// NewStore returns a new instance of a store.
-func NewStore(engine Engine, gossip *gossip.Gossip) *Store {
-	return &Store{
+// NewStore returns a new instance of a store. The db is passed to
+// the store's ranges so they may push transactions and resolve
+// write intents; it may be nil, in which case conflicting intents
+// are returned to clients as errors.
+func NewStore(clock *hlc.HLClock, engine Engine, db DB, gossip *gossip.Gossip) *Store {
+	stopper := util.NewStopper()
+	storePool := newStorePool(gossip)
+	s := &Store{
+		clock:     clock,
 		engine:    engine,
-		allocator: &allocator{},
+		db:        db,
+		storePool: storePool,
+		allocator: newAllocator(storePool.findStores, stopper),
+		liveness:  newLivenessMonitor(gossip),
 		gossip:    gossip,
 		ranges:    make(map[int64]*Range),
+		stopper:   stopper,
+		throttle:  newThrottle(stopper),
 	}
+	s.admission = newAdmission(&s.Ident, stopper)
+	s.memory = util.NewMemoryBudget("store", 0)
+	s.requestMemory = s.memory.NewChild("requests", 0)
+	s.snapshotMemory = s.memory.NewChild("snapshots", 0)
+	s.changeFeed = NewChangeFeed()
+	s.fullThreshold = DefaultFullThreshold
+	s.raftEngine = engine
+	return s
 }
 
-// Close calls Range.Stop() on all active ranges.
+// Close stops the rebalancer and range scanner, waiting for any pass
+// in progress to finish, and then calls Range.Stop() on all active
+// ranges. Ranges drain their pending commands as they stop, which may
+// add ranges through splits, so ranges are stopped without holding
+// the store's lock until none remain.
 func (s *Store) Close() {
-	for _, rng := range s.ranges {
-		rng.Stop()
+	s.stopper.Stop()
+	stopped := map[int64]struct{}{}
+	for {
+		var ranges []*Range
+		s.mu.Lock()
+		for rangeID, rng := range s.ranges {
+			if _, ok := stopped[rangeID]; !ok {
+				stopped[rangeID] = struct{}{}
+				ranges = append(ranges, rng)
+			}
+		}
+		s.mu.Unlock()
+		if len(ranges) == 0 {
+			return
+		}
+		for _, rng := range ranges {
+			rng.Stop()
+		}
 	}
 }
 
@@ -92,6 +217,12 @@ func (s *Store) String() string {
 	return fmt.Sprintf("store=%d:%d (%s)", s.Ident.NodeID, s.Ident.StoreID, s.engine)
 }
 
+// logger returns a logger with the store's node and store IDs in
+// context.
+func (s *Store) logger() log.Logger {
+	return log.New("storage").With(log.NodeID, s.Ident.NodeID).With(log.StoreID, s.Ident.StoreID)
+}
+
 // IsBootstrapped returns true if the store has already been
 // bootstrapped. If the store ident is corrupt, IsBootstrapped will
 // return true; the exact error can be retrieved via a call to Init().
@@ -103,7 +234,11 @@ func (s *Store) IsBootstrapped() bool {
 	return false
 }
 
-// Init reads the StoreIdent from the underlying engine.
+// Init reads the StoreIdent from the underlying engine, instantiates
+// each range whose metadata is stored in the engine and starts the
+// store's rebalancer and range scanner. The store subscribes to
+// gossiped zone configs so that changes to them take effect on its
+// ranges without waiting for the next scanner pass.
 func (s *Store) Init() error {
 	ok, _, err := getI(s.engine, keyStoreIdent, &s.Ident)
 	if err != nil {
@@ -111,22 +246,42 @@ func (s *Store) Init() error {
 	} else if !ok {
 		return util.Error("store has not been bootstrapped")
 	}
-
-	// TODO(spencer): scan through all range metadata and instantiate
-	//   ranges. Right now we just get range id hardcoded as 1.
-	var meta RangeMetadata
-	ok, _, err = getI(s.engine, rangeKey(1), &meta)
-	if err != nil || !ok {
+	if _, _, err := getI(s.engine, keyStoreStats, &s.stats); err != nil {
 		return err
 	}
 
-	rng := NewRange(meta, s.engine, s.allocator, s.gossip)
-	rng.Start()
-	s.ranges[meta.RangeID] = rng
-
+	metas, err := loadRangeMetadata(s.engine)
+	if err != nil {
+		return err
+	}
+	for _, meta := range metas {
+		if err := s.AddRange(meta); err != nil {
+			return err
+		}
+	}
+	s.rebalancer = newRebalancer(s, rebalanceInterval)
+	s.rebalancer.start(s.stopper)
+	s.scanner = newRangeScanner(s, scanInterval,
+		newGCQueue(gcInterval), splitQueue{}, newReplicateQueue(s), leaseQueue{},
+		newRepairer(s), newReplicaGC(s),
+		newConsistencyQueue(consistencyCheckInterval))
+	s.scanner.start(s.stopper)
+	if s.gossip != nil {
+		s.gossip.RegisterCallback(gossip.KeyConfigZone, s.zoneConfigChanged)
+	}
 	return nil
 }
 
+// zoneConfigChanged is the gossip callback for zone configs. When
+// their contents change, it triggers a scanner pass so that the
+// store's ranges are replicated and split according to the new
+// configs.
+func (s *Store) zoneConfigChanged(key string, contentsChanged bool) {
+	if contentsChanged {
+		s.scanner.trigger()
+	}
+}
+
 // Bootstrap writes a new store ident to the underlying engine. To
 // ensure that no crufty data already exists in the engine, it scans
 // the engine contents before writing the new store ident. The engine
@@ -143,8 +298,74 @@ func (s *Store) Bootstrap(ident StoreIdent) error {
 	return putI(s.engine, keyStoreIdent, s.Ident)
 }
 
+// SetSnapshotLimits changes the limits on the snapshots the store
+// sends and applies. The limits take effect immediately, including
+// for snapshots already queued.
+func (s *Store) SetSnapshotLimits(limits SnapshotLimits) {
+	s.throttle.setSnapshotLimits(limits)
+}
+
+// SetFullThreshold sets the fraction of the store's capacity in use
+// beyond which the store is full. A full store refuses snapshots for
+// new replicas and is marked Full in its descriptor, so that other
+// stores stop allocating replicas to it once the descriptor is
+// gossiped. The threshold takes effect immediately.
+func (s *Store) SetFullThreshold(fraction float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fullThreshold = fraction
+}
+
+// SetRaftEngine places the raft logs and other raft state of the
+// store's ranges in engine instead of the store's own engine, e.g. so
+// that logs written on every command live on a low-latency device
+// while range data lives on a capacity device. It must be called
+// before the store is bootstrapped or initialized, and with the same
+// engine each time the store is opened.
+func (s *Store) SetRaftEngine(engine Engine) {
+	s.raftEngine = engine
+}
+
+// RaftEngine returns the engine storing the raft state of the store's
+// ranges (see SetRaftEngine).
+func (s *Store) RaftEngine() Engine {
+	return s.raftEngine
+}
+
+// RaftStorage returns a multiraft.Storage persisting the raft groups
+// of the store's ranges to the store's raft engine.
+func (s *Store) RaftStorage() multiraft.Storage {
+	return newRaftStorage(s.engine, s.raftEngine)
+}
+
+// SetAdmissionLimits changes the limits under which the store admits
+// client requests. The limits take effect immediately, including for
+// requests already queued.
+func (s *Store) SetAdmissionLimits(limits AdmissionLimits) {
+	s.admission.setLimits(limits)
+}
+
+// SetMemoryBudget makes the store's memory budgets children of
+// parent, typically the root budget of the store's node, so that the
+// memory charged for the store's scans and snapshots counts against
+// the parent's limit. It must be called before the store is started.
+func (s *Store) SetMemoryBudget(parent *util.MemoryBudget) {
+	s.memory.SetParent(parent)
+}
+
+// SetRangeIDAllocator makes the store allocate the IDs of new ranges
+// from ids, typically an allocator shared by the stores of a node and
+// backed by the cluster-wide range ID generator, instead of from a
+// generator local to the store. It must be called before the store is
+// started.
+func (s *Store) SetRangeIDAllocator(ids IDAllocator) {
+	s.rangeIDs = ids
+}
+
 // GetRange fetches a range by ID. Returns an error if no range is found.
 func (s *Store) GetRange(rangeID int64) (*Range, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if rng, ok := s.ranges[rangeID]; ok {
 		return rng, nil
 	}
@@ -154,13 +375,10 @@ func (s *Store) GetRange(rangeID int64) (*Range, error) {
 // CreateRange allocates a new range ID and stores range metadata.
 // On success, returns the new range.
 func (s *Store) CreateRange(startKey, endKey Key, replicas []Replica) (*Range, error) {
-	rangeID, err := increment(s.engine, keyRangeIDGenerator, 1, time.Now().UnixNano())
+	rangeID, err := s.NewRangeID()
 	if err != nil {
 		return nil, err
 	}
-	if ok, _, _ := getI(s.engine, rangeKey(rangeID), nil); ok {
-		return nil, util.Error("newly allocated range id already in use")
-	}
 	// RangeMetadata is stored local to this store only. It is neither
 	// replicated via raft nor available via the global kv store.
 	meta := RangeMetadata{
@@ -177,10 +395,250 @@ func (s *Store) CreateRange(startKey, endKey Key, replicas []Replica) (*Range, e
 	if err != nil {
 		return nil, err
 	}
-	rng := NewRange(meta, s.engine, s.allocator, s.gossip)
-	rng.Start()
-	s.ranges[rangeID] = rng
-	return rng, nil
+	if err := s.AddRange(meta); err != nil {
+		return nil, err
+	}
+	return s.GetRange(rangeID)
+}
+
+// LookupRange returns the range which starts at startKey, or nil if
+// no such range exists on the store.
+func (s *Store) LookupRange(startKey Key) *Range {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if item := s.rangesByKey.Get(&rangeKeyItem{startKey: startKey}); item != nil {
+		return item.(*rangeKeyItem).rng
+	}
+	return nil
+}
+
+// LookupRangeByKey returns the range whose key span contains key, or
+// nil if no such range exists on the store.
+func (s *Store) LookupRangeByKey(key Key) *Range {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if item := s.rangesByKey.Floor(&rangeKeyItem{startKey: key}); item != nil {
+		if rng := item.(*rangeKeyItem).rng; rng.containsKey(key) {
+			return rng
+		}
+	}
+	return nil
+}
+
+// NewRangeID allocates a new range ID which is unused on this store.
+// IDs come from the store's range ID allocator if it has one and from
+// the store-local generator otherwise.
+func (s *Store) NewRangeID() (int64, error) {
+	var rangeID int64
+	var err error
+	if s.rangeIDs != nil {
+		rangeID, err = s.rangeIDs.Allocate()
+	} else {
+		rangeID, err = increment(s.engine, keyRangeIDGenerator, 1, s.clock.Now())
+	}
+	if err != nil {
+		return 0, err
+	}
+	if ok, _, _ := getI(s.engine, rangeKey(rangeID), nil); ok {
+		return 0, util.Error("newly allocated range id already in use")
+	}
+	return rangeID, nil
+}
+
+// AddRange instantiates and starts the range described by meta,
+// whose metadata has already been persisted, and adds it to the
+// store. Returns an error if a range with the same ID exists or if
+// the range's key span overlaps that of another range on the store.
+func (s *Store) AddRange(meta RangeMetadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.ranges[meta.RangeID]; ok {
+		return util.Errorf("range %d already exists on store", meta.RangeID)
+	}
+	if rng := s.overlappingRangeLocked(meta); rng != nil {
+		return util.Errorf("range %d overlaps range %d on store", meta.RangeID, rng.Meta.RangeID)
+	}
+	item := &rangeKeyItem{startKey: meta.StartKey}
+	item.rng = NewRange(meta, s.clock, s.engine, s.allocator, s.gossip, s.db)
+	item.rng.rm = s
+	item.rng.throttle = s.throttle
+	item.rng.admission = s.admission
+	item.rng.requestMemory = s.requestMemory
+	item.rng.snapshotMemory = s.snapshotMemory
+	item.rng.changeFeed = s.changeFeed
+	item.rng.Start()
+	s.ranges[meta.RangeID] = item.rng
+	s.rangesByKey.Insert(item)
+	return nil
+}
+
+// overlappingRangeLocked returns a range on the store whose key span
+// overlaps that of the range described by meta, or nil if there is
+// none. The store's mutex must be held.
+func (s *Store) overlappingRangeLocked(meta RangeMetadata) *Range {
+	item := &rangeKeyItem{startKey: meta.StartKey}
+	if prev := s.rangesByKey.Floor(item); prev != nil {
+		if rng := prev.(*rangeKeyItem).rng; bytes.Compare(rng.getMeta().EndKey, meta.StartKey) > 0 {
+			return rng
+		}
+	}
+	if next := s.rangesByKey.Ceil(item); next != nil {
+		if rng := next.(*rangeKeyItem).rng; bytes.Compare(rng.getMeta().StartKey, meta.EndKey) < 0 {
+			return rng
+		}
+	}
+	return nil
+}
+
+// ChangeFeed returns the feed of the writes committed by the store's
+// ranges.
+func (s *Store) ChangeFeed() *ChangeFeed {
+	return s.changeFeed
+}
+
+// StoreIdent returns the store's ident.
+func (s *Store) StoreIdent() StoreIdent {
+	return s.Ident
+}
+
+// DrainLeaderLeases transfers the leader leases held by the store's
+// replicas to other replicas of their ranges, so that the store's
+// node can be shut down without waiting for its leases to expire.
+func (s *Store) DrainLeaderLeases() {
+	now := s.clock.Now()
+	for _, rng := range s.sortedRanges() {
+		if !rng.HasLeaderLease(now) {
+			continue
+		}
+		local, _ := rng.localReplica()
+		for _, replica := range rng.getMeta().Replicas.Replicas {
+			if sameReplica(replica, local) {
+				continue
+			}
+			if err := rng.TransferLeaderLease(replica); err != nil {
+				rng.logger().Warningf("failed to transfer leader lease to %+v: %v", replica, err)
+			}
+			break
+		}
+	}
+}
+
+// sortedRanges returns the store's ranges sorted by start key.
+func (s *Store) sortedRanges() []*Range {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ranges := make([]*Range, 0, s.rangesByKey.Len())
+	s.rangesByKey.Do(func(c llrb.Comparable) (done bool) {
+		ranges = append(ranges, c.(*rangeKeyItem).rng)
+		return false
+	})
+	return ranges
+}
+
+// RemoveRange removes the range with the specified ID from the store
+// and stops it. The range's data is left in place. The range is
+// stopped without holding the store's lock, as draining its pending
+// commands may require it.
+func (s *Store) RemoveRange(rangeID int64) error {
+	s.mu.Lock()
+	rng, ok := s.ranges[rangeID]
+	if !ok {
+		s.mu.Unlock()
+		return util.Errorf("range %d not found on store", rangeID)
+	}
+	delete(s.ranges, rangeID)
+	s.rangesByKey.Delete(&rangeKeyItem{startKey: rng.getMeta().StartKey})
+	s.mu.Unlock()
+	rng.Stop()
+	return nil
+}
+
+// DestroyRange removes the range with the specified ID from the
+// store and deletes its data: the range metadata, MVCC statistics,
+// leader lease, raft state, response cache and abort cache, as well
+// as the versioned data and transaction records in the range's key
+// span.
+// Data which is contained in another range on the store (e.g. a
+// range which subsumed this one in a merge) is left in place.
+func (s *Store) DestroyRange(rangeID int64) error {
+	rng, err := s.GetRange(rangeID)
+	if err != nil {
+		return err
+	}
+	if err := s.RemoveRange(rangeID); err != nil {
+		return err
+	}
+	meta := rng.getMeta()
+	dels := []Key{rangeKey(rangeID), rangeStatsKey(rangeID), rangeLeaderLeaseKey(rangeID),
+		rangeClosedTimestampKey(rangeID)}
+	dataDels, err := s.orphanedKeys(mvccEncodeKey(meta.StartKey), mvccEncodeKey(meta.EndKey),
+		func(encKey Key) (Key, error) {
+			key, _, _, err := mvccDecodeKey(encKey)
+			return key, err
+		})
+	if err != nil {
+		return err
+	}
+	txnDels, err := s.orphanedKeys(txnKey(meta.StartKey, ""), txnKey(meta.EndKey, ""),
+		func(encKey Key) (Key, error) {
+			key, _, err := decodeBytes(encKey[len(keyLocalTransactionPrefix):])
+			return key, err
+		})
+	if err != nil {
+		return err
+	}
+	// The applied index is kept with the range's data. The raft state
+	// in a separate raft engine is deleted only once the data is, so
+	// that a failure in between doesn't leave data without raft state.
+	appliedDels, err := raftKeys(s.engine, rangeID)
+	if err != nil {
+		return err
+	}
+	dels = append(append(append(dels, dataDels...), txnDels...), appliedDels...)
+	if err := s.engine.writeBatch(nil, dels); err != nil {
+		return err
+	}
+	if s.raftEngine != s.engine {
+		raftDels, err := raftKeys(s.raftEngine, rangeID)
+		if err != nil {
+			return err
+		}
+		if err := s.raftEngine.writeBatch(nil, raftDels); err != nil {
+			return err
+		}
+	}
+	if err := rng.respCache.ClearData(); err != nil {
+		return err
+	}
+	return rng.abortCache.ClearData()
+}
+
+// orphanedKeys returns the engine keys in [start, end) whose decoded
+// keys aren't contained in any range on the store.
+func (s *Store) orphanedKeys(start, end Key, decode func(Key) (Key, error)) ([]Key, error) {
+	kvs, err := s.engine.scan(start, end, 0)
+	if err != nil {
+		return nil, err
+	}
+	ranges := s.sortedRanges()
+	var keys []Key
+	for _, kv := range kvs {
+		key, err := decode(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		contained := false
+		for _, rng := range ranges {
+			if rng.containsKey(key) {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			keys = append(keys, kv.Key)
+		}
+	}
+	return keys, nil
 }
 
 // Attrs returns the attributes of the underlying store.
@@ -188,9 +646,63 @@ func (s *Store) Attrs() Attributes {
 	return s.engine.Attrs()
 }
 
-// Capacity returns the capacity of the underlying storage engine.
+// Capacity returns the capacity of the underlying storage engine
+// along with the logical size of the store's ranges, taken from the
+// latest stats rollup if there is one. The capacity reported
+// available is at most the capacity not taken by the logical data,
+// so stores whose engines count fewer bytes than they hold, as when
+// data is compressed, aren't reported emptier than they are.
 func (s *Store) Capacity() (StoreCapacity, error) {
-	return s.engine.capacity()
+	capacity, err := s.engine.capacity()
+	if err != nil {
+		return capacity, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stats.Timestamp != 0 {
+		capacity.LogicalBytes = s.stats.TotalBytes()
+	} else {
+		for _, rng := range s.ranges {
+			capacity.LogicalBytes += rng.Stats().TotalBytes()
+		}
+	}
+	if avail := capacity.Capacity - capacity.LogicalBytes; avail < capacity.Available {
+		capacity.Available = avail
+		if avail < 0 {
+			capacity.Available = 0
+		}
+	}
+	capacity.RangeCount = len(s.ranges)
+	return capacity, nil
+}
+
+// Stats returns the latest rollup of the stats of the store's
+// ranges, which is zero until the store's first scanner pass.
+func (s *Store) Stats() StoreStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// setStats records and persists the rollup of the stats of the
+// store's ranges.
+func (s *Store) setStats(stats StoreStats) error {
+	s.mu.Lock()
+	s.stats = stats
+	s.mu.Unlock()
+	return putI(s.engine, keyStoreStats, stats)
+}
+
+// IsFull returns true if the fraction of the store's capacity in use
+// is at or beyond its threshold (see SetFullThreshold).
+func (s *Store) IsFull() (bool, error) {
+	capacity, err := s.engine.capacity()
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return capacity.FractionUsed() >= s.fullThreshold, nil
 }
 
 // Descriptor returns a StoreDescriptor including current store
@@ -200,11 +712,25 @@ func (s *Store) Descriptor(nodeDesc *NodeDescriptor) (*StoreDescriptor, error) {
 	if err != nil {
 		return nil, err
 	}
+	s.mu.Lock()
+	full := capacity.FractionUsed() >= s.fullThreshold
+	s.mu.Unlock()
 	// Initialize the store descriptor.
 	return &StoreDescriptor{
 		StoreID:  s.Ident.StoreID,
 		Attrs:    s.Attrs(),
 		Node:     *nodeDesc,
 		Capacity: capacity,
+		Draining: s.IsDraining(),
+		Full:     full,
 	}, nil
 }
+
+// ClusterCapacity returns a summary of the capacity of the stores
+// currently gossiped by the cluster's nodes, including this store's
+// own node. Gossip groups retain only the stores with the most
+// available capacity, so very large clusters may be summarized in
+// part.
+func (s *Store) ClusterCapacity() (ClusterCapacity, error) {
+	return s.allocator.clusterCapacity()
+}
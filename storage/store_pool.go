@@ -0,0 +1,131 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+)
+
+// storeSuspectDuration is the duration for which a store remains
+// suspect after its node was last seen not to be live. Suspect stores
+// aren't allocation targets, so that replicas aren't placed on the
+// stores of flapping nodes.
+const storeSuspectDuration = 30 * time.Second
+
+// storeKey identifies a store in the pool. Store IDs are only unique
+// within a node.
+type storeKey struct {
+	nodeID  int32
+	storeID int32
+}
+
+// storeDetail is the pool's record of a store.
+type storeDetail struct {
+	desc         StoreDescriptor
+	gossiped     bool      // True if the descriptor was in gossip at the last update
+	lastSeen     time.Time // When the descriptor was last seen in gossip
+	suspectUntil time.Time // The store is suspect until then
+}
+
+// A storePool tracks the descriptors of the stores gossiped by each
+// node and their health. A store is dead once its descriptor hasn't
+// been gossiped for NodeDeadTimeout, and suspect while its descriptor
+// is missing from gossip or for storeSuspectDuration after its node's
+// gossiped liveness record was last seen expired. Only live stores
+// are found by the pool's findStores, which is the StoreFinder of
+// the store's allocator and so is consulted both when allocating
+// replicas and when rebalancing.
+type storePool struct {
+	gossipStores StoreFinder // Finds the stores currently gossiped
+	gossip       *gossip.Gossip
+	now          func() time.Time
+	mu           sync.Mutex                // Protects stores
+	stores       map[storeKey]*storeDetail // Store details by node and store ID
+}
+
+// newStorePool returns a store pool for the stores gossiped on the
+// gossip network.
+func newStorePool(g *gossip.Gossip) *storePool {
+	return &storePool{
+		gossipStores: newGossipStoreFinder(g),
+		gossip:       g,
+		now:          time.Now,
+		stores:       map[storeKey]*storeDetail{},
+	}
+}
+
+// updateLocked refreshes the pool's store details from gossip. The
+// pool's mutex must be held.
+func (sp *storePool) updateLocked() error {
+	stores, err := sp.gossipStores(Attributes{})
+	if err != nil {
+		return err
+	}
+	now := sp.now()
+	for _, d := range sp.stores {
+		d.gossiped = false
+	}
+	for _, desc := range stores {
+		key := storeKey{desc.Node.NodeID, desc.StoreID}
+		d, ok := sp.stores[key]
+		if !ok {
+			d = &storeDetail{}
+			sp.stores[key] = d
+		}
+		d.desc, d.gossiped, d.lastSeen = *desc, true, now
+	}
+	for _, d := range sp.stores {
+		if l, ok := gossipedLiveness(sp.gossip, d.desc.Node.NodeID); ok && l.Status(now) != NodeLive {
+			d.suspectUntil = now.Add(storeSuspectDuration)
+		}
+	}
+	return nil
+}
+
+// statusLocked returns the status of the store at time now. The
+// pool's mutex must be held.
+func (sp *storePool) statusLocked(d *storeDetail, now time.Time) NodeStatus {
+	if now.Sub(d.lastSeen) > NodeDeadTimeout {
+		return NodeDead
+	}
+	if !d.gossiped || now.Before(d.suspectUntil) {
+		return NodeSuspect
+	}
+	return NodeLive
+}
+
+// findStores implements StoreFinder, returning the live stores
+// matching the required attributes.
+func (sp *storePool) findStores(required Attributes) ([]*StoreDescriptor, error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if err := sp.updateLocked(); err != nil {
+		return nil, err
+	}
+	now := sp.now()
+	var stores []*StoreDescriptor
+	for _, d := range sp.stores {
+		if sp.statusLocked(d, now) != NodeLive || !required.IsSubset(d.desc.CombinedAttrs()) {
+			continue
+		}
+		desc := d.desc
+		stores = append(stores, &desc)
+	}
+	return stores, nil
+}
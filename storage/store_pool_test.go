@@ -0,0 +1,117 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+)
+
+// findStoreIDs returns the IDs of the stores the pool finds.
+func findStoreIDs(sp *storePool, t *testing.T) map[int32]struct{} {
+	stores, err := sp.findStores(Attributes{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := map[int32]struct{}{}
+	for _, s := range stores {
+		ids[s.StoreID] = struct{}{}
+	}
+	return ids
+}
+
+// storeStatus returns the pool's current status for the store with
+// the given node and store IDs. Stores the pool hasn't seen are
+// suspect.
+func storeStatus(sp *storePool, nodeID, storeID int32, t *testing.T) NodeStatus {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if err := sp.updateLocked(); err != nil {
+		t.Fatal(err)
+	}
+	d, ok := sp.stores[storeKey{nodeID, storeID}]
+	if !ok {
+		return NodeSuspect
+	}
+	return sp.statusLocked(d, sp.now())
+}
+
+// TestStorePoolStatus verifies that stores of nodes which were seen
+// not to be live remain suspect for storeSuspectDuration, that stores
+// missing from gossip are suspect and then dead, and that only live
+// stores are found.
+func TestStorePoolStatus(t *testing.T) {
+	g := gossip.New()
+	stores := []*StoreDescriptor{loadedStore(1, 50, 1), loadedStore(2, 50, 1), loadedStore(3, 50, 1)}
+	gossipStores(g, stores, t)
+	gossipLiveness(g, time.Now().Add(time.Hour), t, 1, 3)
+	gossipLiveness(g, time.Now().Add(-time.Minute), t, 2)
+
+	now := time.Now()
+	sp := newStorePool(g)
+	sp.now = func() time.Time { return now }
+	if ids := findStoreIDs(sp, t); len(ids) != 2 {
+		t.Errorf("expected stores 1 and 3; got %v", ids)
+	} else if _, ok := ids[2]; ok {
+		t.Errorf("expected store of suspect node 2 to be excluded; got %v", ids)
+	}
+
+	// Node 2 heartbeats again but remains suspect for a while.
+	gossipLiveness(g, time.Now().Add(time.Hour), t, 2)
+	if status := storeStatus(sp, 2, 2, t); status != NodeSuspect {
+		t.Errorf("expected store 2 to remain suspect; got %s", status)
+	}
+	now = now.Add(storeSuspectDuration + time.Second)
+	if ids := findStoreIDs(sp, t); len(ids) != 3 {
+		t.Errorf("expected all stores; got %v", ids)
+	}
+
+	// Store 3's descriptor is no longer gossiped.
+	sp.gossipStores = func(Attributes) ([]*StoreDescriptor, error) { return stores[:2], nil }
+	if status := storeStatus(sp, 3, 3, t); status != NodeSuspect {
+		t.Errorf("expected store 3 to be suspect; got %s", status)
+	}
+	now = now.Add(NodeDeadTimeout + time.Second)
+	if status := storeStatus(sp, 3, 3, t); status != NodeDead {
+		t.Errorf("expected store 3 to be dead; got %s", status)
+	}
+	if status := storeStatus(sp, 1, 1, t); status != NodeLive {
+		t.Errorf("expected store 1 to be live; got %s", status)
+	}
+	if ids := findStoreIDs(sp, t); len(ids) != 2 {
+		t.Errorf("expected stores 1 and 2; got %v", ids)
+	}
+}
+
+// TestStorePoolSameStoreIDs verifies that stores on different nodes
+// which share a store ID are tracked separately.
+func TestStorePoolSameStoreIDs(t *testing.T) {
+	g := gossip.New()
+	stores := []*StoreDescriptor{loadedStore(1, 50, 1), loadedStore(1, 50, 1)}
+	stores[1].Node.NodeID = 2
+	gossipStores(g, stores, t)
+	gossipLiveness(g, time.Now().Add(time.Hour), t, 1, 2)
+
+	found, err := newStorePool(g).findStores(Attributes{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Errorf("expected store 1 of both nodes; got %+v", found)
+	}
+}
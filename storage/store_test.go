@@ -17,7 +17,18 @@
 
 package storage
 
-import "testing"
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/hlc"
+	"github.com/cockroachdb/cockroach/util"
+)
 
 var testIdent = StoreIdent{
 	ClusterID: "cluster",
@@ -29,7 +40,7 @@ var testIdent = StoreIdent{
 // bootstrap.
 func TestStoreInitAndBootstrap(t *testing.T) {
 	engine := NewInMem(Attributes{}, 1<<20)
-	store := NewStore(engine, nil)
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), engine, nil, nil)
 	defer store.Close()
 
 	// Can't init as haven't bootstrapped.
@@ -47,22 +58,31 @@ func TestStoreInitAndBootstrap(t *testing.T) {
 		t.Error("expected error fetching non-existent range")
 	}
 
-	// Create range and fetch.
-	if _, err := store.CreateRange(KeyMin, KeyMax, []Replica{}); err != nil {
+	// Create two ranges and fetch.
+	if _, err := store.CreateRange(KeyMin, Key("a"), []Replica{}); err != nil {
 		t.Errorf("failure to create first range: %v", err)
 	}
+	if _, err := store.CreateRange(Key("a"), KeyMax, []Replica{}); err != nil {
+		t.Errorf("failure to create second range: %v", err)
+	}
 	if _, err := store.GetRange(1); err != nil {
 		t.Errorf("failure fetching 1st range: %v", err)
 	}
 
 	// Now, attempt to initialize a store with a now-bootstrapped engine.
-	store = NewStore(engine, nil)
+	store = NewStore(hlc.NewHLClock(hlc.UnixNano), engine, nil, nil)
+	defer store.Close()
 	if err := store.Init(); err != nil {
 		t.Errorf("failure initializing bootstrapped store: %v", err)
 	}
-	// 1st range should be available.
-	if _, err := store.GetRange(1); err != nil {
-		t.Errorf("failure fetching 1st range: %v", err)
+	// Both ranges should be available.
+	for _, rangeID := range []int64{1, 2} {
+		if _, err := store.GetRange(rangeID); err != nil {
+			t.Errorf("failure fetching range %d: %v", rangeID, err)
+		}
+	}
+	if rng := store.LookupRangeByKey(Key("b")); rng == nil || rng.Meta.RangeID != 2 {
+		t.Errorf("expected key \"b\" to be addressed to range 2; got %+v", rng)
 	}
 }
 
@@ -75,7 +95,7 @@ func TestBootstrapOfNonEmptyStore(t *testing.T) {
 	if err := engine.put(Key("foo"), Value{Bytes: []byte("bar")}); err != nil {
 		t.Errorf("failure putting key foo into engine: %v", err)
 	}
-	store := NewStore(engine, nil)
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), engine, nil, nil)
 	defer store.Close()
 
 	// Can't init as haven't bootstrapped.
@@ -88,3 +108,711 @@ func TestBootstrapOfNonEmptyStore(t *testing.T) {
 		t.Error("expected bootstrap error on non-empty store")
 	}
 }
+
+// TestStoreCapacityLogicalBytes verifies that store capacity reports
+// the logical size of the store's ranges.
+func TestStoreCapacityLogicalBytes(t *testing.T) {
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), NewInMem(Attributes{}, 1<<20), nil, nil)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := &PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}
+	if err := <-rng.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	capacity, err := store.Capacity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capacity.LogicalBytes == 0 || capacity.LogicalBytes != rng.Stats().TotalBytes() {
+		t.Errorf("expected logical bytes %d; got %d", rng.Stats().TotalBytes(), capacity.LogicalBytes)
+	}
+}
+
+// TestStoreRangesByKey verifies that ranges are indexed by key span,
+// that ranges with overlapping key spans are rejected and that
+// removed ranges are removed from the index.
+func TestStoreRangesByKey(t *testing.T) {
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), NewInMem(Attributes{}, 1<<20), nil, nil)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	for _, span := range [][2]Key{{Key("c"), Key("e")}, {KeyMin, Key("c")}, {Key("e"), KeyMax}} {
+		if _, err := store.CreateRange(span[0], span[1], nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.CreateRange(Key("d"), Key("f"), nil); err == nil {
+		t.Error("expected error creating overlapping range")
+	}
+
+	testCases := []struct {
+		key      Key
+		expStart Key
+	}{
+		{KeyMin, KeyMin},
+		{Key("b"), KeyMin},
+		{Key("c"), Key("c")},
+		{Key("d"), Key("c")},
+		{Key("e"), Key("e")},
+		{Key("z"), Key("e")},
+	}
+	for i, test := range testCases {
+		rng := store.LookupRangeByKey(test.key)
+		if rng == nil {
+			t.Errorf("%d: expected range for key %q", i, test.key)
+		} else if !bytes.Equal(rng.Meta.StartKey, test.expStart) {
+			t.Errorf("%d: expected range starting at %q for key %q; got %q", i, test.expStart, test.key, rng.Meta.StartKey)
+		}
+	}
+	var starts []Key
+	for _, rng := range store.sortedRanges() {
+		starts = append(starts, rng.Meta.StartKey)
+	}
+	if !reflect.DeepEqual(starts, []Key{KeyMin, Key("c"), Key("e")}) {
+		t.Errorf("expected ranges sorted by start key; got %q", starts)
+	}
+
+	if err := store.RemoveRange(store.LookupRange(Key("c")).Meta.RangeID); err != nil {
+		t.Fatal(err)
+	}
+	if rng := store.LookupRangeByKey(Key("d")); rng != nil {
+		t.Errorf("expected no range for removed key span; got %+v", rng.Meta)
+	}
+}
+
+// endTxnWithTrigger commits a new transaction on rng carrying the
+// specified commit trigger.
+func endTxnWithTrigger(rng *Range, trigger *InternalCommitTrigger) error {
+	txn := NewTransaction(rng.Meta.StartKey, SERIALIZABLE, rng.clock)
+	args := &EndTransactionRequest{
+		RequestHeader:         RequestHeader{Txn: txn},
+		Commit:                true,
+		InternalCommitTrigger: trigger,
+	}
+	return <-rng.ReadWriteCmd("EndTransaction", args, &EndTransactionResponse{})
+}
+
+// TestStoreSplitAndMergeTriggers verifies that split and merge commit
+// triggers update the store's ranges and their persisted metadata.
+func TestStoreSplitAndMergeTriggers(t *testing.T) {
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), NewInMem(Attributes{}, 1<<20), nil, nil)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []Key{Key("a"), Key("c")} {
+		args := &PutRequest{Key: key, Value: Value{Bytes: []byte("value")}}
+		if err := <-rng.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	splitKey := Key("b")
+	updatedMeta := rng.Meta
+	updatedMeta.EndKey = splitKey
+	newMeta := RangeMetadata{
+		ClusterID: rng.Meta.ClusterID,
+		RangeID:   2,
+		StartKey:  splitKey,
+		EndKey:    KeyMax,
+		Replicas:  RangeDescriptor{StartKey: splitKey},
+	}
+
+	// A split key outside the range is rejected.
+	badMeta := newMeta
+	badMeta.StartKey = KeyMax
+	badUpdatedMeta := updatedMeta
+	badUpdatedMeta.EndKey = KeyMax
+	if err := endTxnWithTrigger(rng, &InternalCommitTrigger{
+		SplitTrigger: &SplitTrigger{UpdatedMeta: badUpdatedMeta, NewMeta: badMeta},
+	}); err == nil {
+		t.Error("expected error splitting at end key")
+	}
+
+	if err := endTxnWithTrigger(rng, &InternalCommitTrigger{
+		SplitTrigger: &SplitTrigger{UpdatedMeta: updatedMeta, NewMeta: newMeta},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	newRng, err := store.GetRange(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rng.Meta.EndKey, splitKey) || !bytes.Equal(newRng.Meta.StartKey, splitKey) {
+		t.Errorf("expected ranges to split at %q; got %+v and %+v", splitKey, rng.Meta, newRng.Meta)
+	}
+	if ok, _, err := getI(store.engine, rangeKey(2), nil); !ok || err != nil {
+		t.Errorf("expected metadata of new range to be persisted: %v", err)
+	}
+	if newRng.Stats().LiveCount != 1 {
+		t.Errorf("expected new range to have one live key; got %+v", newRng.Stats())
+	}
+
+	mergedMeta := rng.Meta
+	mergedMeta.EndKey = KeyMax
+	if err := endTxnWithTrigger(rng, &InternalCommitTrigger{
+		MergeTrigger: &MergeTrigger{UpdatedMeta: mergedMeta, SubsumedRangeID: 2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetRange(2); err == nil {
+		t.Error("expected subsumed range to be removed")
+	}
+	if !bytes.Equal(rng.Meta.EndKey, KeyMax) {
+		t.Errorf("expected range to end at %q; got %q", KeyMax, rng.Meta.EndKey)
+	}
+	if ok, _, err := getI(store.engine, rangeKey(2), nil); ok || err != nil {
+		t.Errorf("expected metadata of subsumed range to be deleted: %v", err)
+	}
+}
+
+// storeDB implements the DB interface by executing requests against
+// the store's range which contains the key addressed by each request.
+// Snapshots are applied to the addressed store in remotes; snapshots
+// addressed to other stores are discarded.
+type storeDB struct {
+	store   *Store
+	remotes map[int32]*Store // Remote stores by store ID
+}
+
+func (db *storeDB) rangeForKey(key Key) *Range {
+	return db.store.LookupRangeByKey(key)
+}
+
+func (db *storeDB) Put(args *PutRequest) <-chan *PutResponse {
+	replyChan := make(chan *PutResponse, 1)
+	reply := &PutResponse{}
+	<-db.rangeForKey(args.Key).ReadWriteCmd("Put", args, reply)
+	replyChan <- reply
+	return replyChan
+}
+
+func (db *storeDB) Scan(args *ScanRequest) <-chan *ScanResponse {
+	replyChan := make(chan *ScanResponse, 1)
+	reply := &ScanResponse{}
+	db.rangeForKey(args.StartKey).ReadOnlyCmd("Scan", args, reply)
+	replyChan <- reply
+	return replyChan
+}
+
+func (db *storeDB) Delete(args *DeleteRequest) <-chan *DeleteResponse {
+	replyChan := make(chan *DeleteResponse, 1)
+	reply := &DeleteResponse{}
+	<-db.rangeForKey(args.Key).ReadWriteCmd("Delete", args, reply)
+	replyChan <- reply
+	return replyChan
+}
+
+func (db *storeDB) EndTransaction(args *EndTransactionRequest) <-chan *EndTransactionResponse {
+	replyChan := make(chan *EndTransactionResponse, 1)
+	reply := &EndTransactionResponse{}
+	<-db.rangeForKey(args.Txn.Key).ReadWriteCmd("EndTransaction", args, reply)
+	replyChan <- reply
+	return replyChan
+}
+
+func (db *storeDB) InternalPushTxn(args *InternalPushTxnRequest) <-chan *InternalPushTxnResponse {
+	replyChan := make(chan *InternalPushTxnResponse, 1)
+	reply := &InternalPushTxnResponse{}
+	<-db.rangeForKey(args.Key).ReadWriteCmd("InternalPushTxn", args, reply)
+	replyChan <- reply
+	return replyChan
+}
+
+func (db *storeDB) InternalResolveIntent(args *InternalResolveIntentRequest) <-chan *InternalResolveIntentResponse {
+	replyChan := make(chan *InternalResolveIntentResponse, 1)
+	reply := &InternalResolveIntentResponse{}
+	<-db.rangeForKey(args.Key).ReadWriteCmd("InternalResolveIntent", args, reply)
+	replyChan <- reply
+	return replyChan
+}
+
+func (db *storeDB) InternalSnapshot(args *InternalSnapshotRequest) <-chan *InternalSnapshotResponse {
+	replyChan := make(chan *InternalSnapshotResponse, 1)
+	reply := &InternalSnapshotResponse{}
+	if remote, ok := db.remotes[args.Replica.StoreID]; ok {
+		reply.Error = remote.ApplySnapshot(&args.Snapshot)
+	}
+	replyChan <- reply
+	return replyChan
+}
+
+// InternalChecksum computes the checksum on the replica's store, if
+// it's one of the remote stores, and returns an error otherwise.
+func (db *storeDB) InternalChecksum(args *InternalChecksumRequest) <-chan *InternalChecksumResponse {
+	replyChan := make(chan *InternalChecksumResponse, 1)
+	reply := &InternalChecksumResponse{}
+	if remote, ok := db.remotes[args.Replica.StoreID]; !ok {
+		reply.Error = util.Errorf("store %d not found", args.Replica.StoreID)
+	} else if rng, err := remote.GetRange(args.Replica.RangeID); err != nil {
+		reply.Error = err
+	} else {
+		rng.InternalChecksum(args, reply)
+	}
+	replyChan <- reply
+	return replyChan
+}
+
+// expectRangeDescriptor verifies that the addressing record at the
+// meta2 key for endKey specifies the range starting at startKey.
+func expectRangeDescriptor(store *Store, endKey, startKey Key, t *testing.T) {
+	val, err := NewMVCC(store.engine).Get(MakeKey(KeyMeta2Prefix, endKey), store.clock.Now(), nil)
+	if err != nil || val == nil {
+		t.Fatalf("expected addressing record for %q: %v", endKey, err)
+	}
+	var desc RangeDescriptor
+	if err := gob.NewDecoder(bytes.NewBuffer(val.Bytes)).Decode(&desc); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(desc.StartKey, startKey) {
+		t.Errorf("expected range ending at %q to start at %q; got %q", endKey, startKey, desc.StartKey)
+	}
+}
+
+// seqIDAllocator is an IDAllocator handing out consecutive IDs.
+type seqIDAllocator struct {
+	lastID int64
+}
+
+func (ia *seqIDAllocator) Allocate() (int64, error) {
+	ia.lastID++
+	return ia.lastID, nil
+}
+
+// TestStoreNewRangeIDAllocator verifies that range IDs are allocated
+// from the store's range ID allocator if it has one and that IDs in
+// use on the store are refused.
+func TestStoreNewRangeIDAllocator(t *testing.T) {
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), NewInMem(Attributes{}, 1<<20), nil, nil)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	ids := &seqIDAllocator{lastID: 100}
+	store.SetRangeIDAllocator(ids)
+	if rangeID, err := store.NewRangeID(); err != nil || rangeID != 101 {
+		t.Errorf("expected range ID 101 from allocator; got %d: %v", rangeID, err)
+	}
+	ids.lastID = 0
+	if _, err := store.NewRangeID(); err == nil {
+		t.Error("expected error allocating range ID 1, which is in use")
+	}
+}
+
+// TestStoreAdminSplit verifies that AdminSplit splits a range at the
+// specified or computed split key and updates range addressing
+// records.
+func TestStoreAdminSplit(t *testing.T) {
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), NewInMem(Attributes{}, 1<<20), nil, nil)
+	store.db = &storeDB{store: store}
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		args := &PutRequest{Key: Key(key), Value: Value{Bytes: []byte("value")}}
+		if err := <-rng.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reply := &AdminSplitResponse{}
+	if rng.AdminSplit(&AdminSplitRequest{Key: KeyMin, SplitKey: KeyMax}, reply); reply.Error == nil {
+		t.Error("expected error splitting at range end key")
+	}
+	reply = &AdminSplitResponse{}
+	if rng.AdminSplit(&AdminSplitRequest{Key: KeyMin, SplitKey: MakeKey(KeyMeta1Prefix, Key("a"))}, reply); reply.Error == nil {
+		t.Error("expected error splitting within meta1 keys")
+	}
+
+	reply = &AdminSplitResponse{}
+	if rng.AdminSplit(&AdminSplitRequest{Key: KeyMin, SplitKey: Key("c")}, reply); reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	newRng, err := store.GetRange(reply.NewRangeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rng.Meta.EndKey, Key("c")) || !bytes.Equal(newRng.Meta.StartKey, Key("c")) {
+		t.Errorf("expected split at %q; got %+v and %+v", "c", rng.Meta, newRng.Meta)
+	}
+	if r := newRng.Meta.Replicas.Replicas; len(r) != 1 || r[0].RangeID != reply.NewRangeID {
+		t.Errorf("expected replicas of new range to have range ID %d; got %+v", reply.NewRangeID, r)
+	}
+	expectRangeDescriptor(store, Key("c"), KeyMin, t)
+	expectRangeDescriptor(store, KeyMax, Key("c"), t)
+
+	// Split the new range at a computed split key.
+	reply = &AdminSplitResponse{}
+	if newRng.AdminSplit(&AdminSplitRequest{Key: Key("c")}, reply); reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	if bytes.Compare(reply.SplitKey, Key("c")) <= 0 || !bytes.Equal(newRng.Meta.EndKey, reply.SplitKey) {
+		t.Errorf("expected split key after %q; got %q with range %+v", "c", reply.SplitKey, newRng.Meta)
+	}
+	expectRangeDescriptor(store, reply.SplitKey, Key("c"), t)
+	expectRangeDescriptor(store, KeyMax, reply.SplitKey, t)
+}
+
+// TestStoreAutomaticSplit verifies that a range is split once its
+// size exceeds the maximum range size of its zone.
+func TestStoreAutomaticSplit(t *testing.T) {
+	engine := NewInMem(Attributes{}, 1<<20)
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), engine, nil, gossip.New())
+	store.db = &storeDB{store: store}
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	putTestConfig(engine, KeyConfigZonePrefix, ZoneConfig{RangeMaxBytes: 1 << 12}, t)
+	if _, err := store.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	value := Value{Bytes: bytes.Repeat([]byte("v"), 100)}
+	for i := 0; i < 50; i++ {
+		// The range may split concurrently; route each put to the range
+		// containing its key and retry if it was split away.
+		args := &PutRequest{Key: Key(fmt.Sprintf("key%02d", i)), Value: value}
+		for {
+			err := (<-store.db.Put(args)).Error
+			if _, ok := err.(*RangeKeyMismatchError); ok {
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if err := util.IsTrueWithin(func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return len(store.ranges) > 1
+	}, 1*time.Second); err != nil {
+		t.Errorf("expected range to split: %v", err)
+	}
+}
+
+// TestStoreLoadBasedSplit verifies that a range whose request rate
+// exceeds the maximum QPS of its zone is split at a key dividing its
+// load.
+func TestStoreLoadBasedSplit(t *testing.T) {
+	engine := NewInMem(Attributes{}, 1<<20)
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), engine, nil, gossip.New())
+	store.db = &storeDB{store: store}
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	putTestConfig(engine, KeyConfigZonePrefix, ZoneConfig{RangeMaxQPS: 1}, t)
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Acquire the leader lease.
+	if reply := <-store.db.Put(&PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}); reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	// Record a window's worth of requests at 10 QPS, to keys in a
+	// scrambled order.
+	rng.load = newLoadSplitter(time.Now().Add(-loadSplitWindow))
+	for i := 0; i < 100; i++ {
+		rng.load.record(Key(fmt.Sprintf("key%02d", i*37%100)), time.Now())
+	}
+	rng.maybeSplit()
+	if err := util.IsTrueWithin(func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return len(store.ranges) > 1
+	}, 1*time.Second); err != nil {
+		t.Fatalf("expected range to split: %v", err)
+	}
+	if meta := rng.getMeta(); bytes.Compare(meta.EndKey, Key("key10")) < 0 || bytes.Compare(meta.EndKey, Key("key90")) > 0 {
+		t.Errorf("expected split key among the requested keys; got %q", meta.EndKey)
+	}
+}
+
+// TestStoreAdminMerge verifies that AdminMerge merges a range with the
+// subsequent range and updates range addressing records.
+func TestStoreAdminMerge(t *testing.T) {
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), NewInMem(Attributes{}, 1<<20), nil, nil)
+	store.db = &storeDB{store: store}
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mergeReply := &AdminMergeResponse{}
+	if rng.AdminMerge(&AdminMergeRequest{Key: KeyMin}, mergeReply); mergeReply.Error == nil {
+		t.Error("expected error merging final range")
+	}
+
+	splitReply := &AdminSplitResponse{}
+	if rng.AdminSplit(&AdminSplitRequest{Key: KeyMin, SplitKey: Key("c")}, splitReply); splitReply.Error != nil {
+		t.Fatal(splitReply.Error)
+	}
+	mergeReply = &AdminMergeResponse{}
+	if rng.AdminMerge(&AdminMergeRequest{Key: KeyMin}, mergeReply); mergeReply.Error != nil {
+		t.Fatal(mergeReply.Error)
+	}
+	if _, err := store.GetRange(splitReply.NewRangeID); err == nil {
+		t.Error("expected subsumed range to be removed")
+	}
+	if !bytes.Equal(rng.Meta.EndKey, KeyMax) {
+		t.Errorf("expected merged range to end at %q; got %q", KeyMax, rng.Meta.EndKey)
+	}
+	if val, err := NewMVCC(store.engine).Get(MakeKey(KeyMeta2Prefix, Key("c")), store.clock.Now(), nil); val != nil || err != nil {
+		t.Errorf("expected addressing record of subsumed range to be deleted; got %+v, %v", val, err)
+	}
+	expectRangeDescriptor(store, KeyMax, KeyMin, t)
+}
+
+// TestStoreLeaderLease verifies that the first command on a range
+// acquires the leader lease for the store's replica, that leases held
+// by other replicas are honored until they expire, and that leases
+// may be transferred.
+func TestStoreLeaderLease(t *testing.T) {
+	manual := hlc.ManualClock(1)
+	clock := hlc.NewHLClock(manual.UnixNano)
+	store := NewStore(clock, NewInMem(Attributes{}, 1<<20), nil, nil)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	local := Replica{NodeID: 1, StoreID: 1, RangeID: 1}
+	remote := Replica{NodeID: 2, StoreID: 2, RangeID: 1}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{local, remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func() error {
+		args := &PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}
+		return <-rng.ReadWriteCmd("Put", args, &PutResponse{})
+	}
+	if err := put(); err != nil {
+		t.Fatal(err)
+	}
+	if !rng.HasLeaderLease(clock.Now()) {
+		t.Fatalf("expected store to acquire leader lease; got %+v", rng.getLease())
+	}
+
+	// A command timestamped beyond the lease duration from now is
+	// refused rather than extending the lease to cover it.
+	lease := rng.getLease()
+	future := &PutRequest{
+		RequestHeader: RequestHeader{Timestamp: hlc.HLTimestamp{WallTime: int64(manual) + 2*leaderLeaseDuration.Nanoseconds()}},
+		Key:           Key("a"),
+		Value:         Value{Bytes: []byte("future")},
+	}
+	if err := <-rng.ReadWriteCmd("Put", future, &PutResponse{}); err == nil {
+		t.Error("expected command beyond the lease duration to be refused")
+	}
+	if newLease := rng.getLease(); newLease.Expiration != lease.Expiration {
+		t.Errorf("expected lease not to be extended; got %+v", newLease)
+	}
+
+	// A lease for another replica overlapping the current lease is
+	// rejected.
+	args := &InternalLeaderLeaseRequest{
+		Key:   KeyMin,
+		Lease: LeaderLease{Start: clock.Now(), Expiration: clock.Now().Next(), Replica: remote},
+	}
+	if err := <-rng.ReadWriteCmd("InternalLeaderLease", args, &InternalLeaderLeaseResponse{}); err == nil {
+		t.Error("expected overlapping lease to be rejected")
+	}
+
+	// Transfer the lease; the store must then redirect to the holder.
+	if err := rng.TransferLeaderLease(remote); err != nil {
+		t.Fatal(err)
+	}
+	err = put()
+	if nlErr, ok := err.(*NotLeaderError); !ok || nlErr.Leader == nil || !sameReplica(*nlErr.Leader, remote) {
+		t.Fatalf("expected not leader error naming %+v; got %v", remote, err)
+	}
+	reply := &GetResponse{}
+	if err := rng.ReadOnlyCmd("Get", &GetRequest{Key: Key("a")}, reply); err == nil {
+		t.Error("expected consistent read to be redirected")
+	}
+	if err := rng.ReadOnlyCmd("Get", &GetRequest{RequestHeader: RequestHeader{ReadConsistency: INCONSISTENT}, Key: Key("a")}, reply); err != nil {
+		t.Errorf("expected inconsistent read to succeed: %v", err)
+	}
+
+	// Once the remote lease expires, the store reacquires the lease.
+	manual = hlc.ManualClock(int64(manual) + leaderLeaseDuration.Nanoseconds() + 1)
+	if err := put(); err != nil {
+		t.Fatal(err)
+	}
+	if !rng.HasLeaderLease(clock.Now()) {
+		t.Errorf("expected store to reacquire leader lease; got %+v", rng.getLease())
+	}
+}
+
+// TestStoreLeadershipChangeTransfersLease verifies that a replica
+// holding the leader lease transfers it to the new raft leader, and
+// stops acquiring leases once it isn't the leader.
+func TestStoreLeadershipChangeTransfersLease(t *testing.T) {
+	manual := hlc.ManualClock(1)
+	clock := hlc.NewHLClock(manual.UnixNano)
+	store := NewStore(clock, NewInMem(Attributes{}, 1<<20), nil, nil)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	local := Replica{NodeID: 1, StoreID: 1, RangeID: 1}
+	remote := Replica{NodeID: 2, StoreID: 2, RangeID: 1}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{local, remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func() error {
+		args := &PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}
+		return <-rng.ReadWriteCmd("Put", args, &PutResponse{})
+	}
+	if err := put(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leadership staying local leaves the lease alone.
+	if err := rng.LeadershipChanged(local); err != nil {
+		t.Fatal(err)
+	}
+	if !rng.IsLeader() || !rng.HasLeaderLease(clock.Now()) {
+		t.Fatalf("expected replica to remain leader and lease holder; got %+v", rng.getLease())
+	}
+
+	if err := rng.LeadershipChanged(remote); err != nil {
+		t.Fatal(err)
+	}
+	if rng.IsLeader() {
+		t.Error("expected replica not to be leader")
+	}
+	if lease := rng.getLease(); !sameReplica(lease.Replica, remote) {
+		t.Fatalf("expected lease to be transferred to %+v; got %+v", remote, lease)
+	}
+
+	// Once the transferred lease expires, a replica which isn't the
+	// leader doesn't reacquire it.
+	manual = hlc.ManualClock(int64(manual) + leaderLeaseDuration.Nanoseconds() + 1)
+	if err := put(); err == nil {
+		t.Error("expected command to be refused")
+	} else if _, ok := err.(*NotLeaderError); !ok {
+		t.Errorf("expected not leader error; got %v", err)
+	}
+}
+
+// TestStoreLeaderLeaseClockSkew verifies that commands timestamped
+// by a clock skewed beyond the store clock's max drift are rejected
+// without extending the leader lease, while commands from a clock
+// skewed within the max drift are served and the store's clock
+// compensates for the skew.
+func TestStoreLeaderLeaseClockSkew(t *testing.T) {
+	manual := hlc.ManualClock(1)
+	clock := hlc.NewHLClock(manual.UnixNano)
+	maxDrift := 250 * time.Millisecond
+	clock.SetMaxDrift(uint(maxDrift))
+	store := NewStore(clock, NewInMem(Attributes{}, 1<<20), nil, nil)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	skewed := hlc.NewSkewedClock(manual.UnixNano)
+	put := func(value string) error {
+		args := &PutRequest{
+			RequestHeader: RequestHeader{Timestamp: hlc.HLTimestamp{WallTime: skewed.UnixNano()}},
+			Key:           Key("a"),
+			Value:         Value{Bytes: []byte(value)},
+		}
+		return <-rng.ReadWriteCmd("Put", args, &PutResponse{})
+	}
+	get := func() []byte {
+		reply := &GetResponse{}
+		if err := rng.ReadOnlyCmd("Get", &GetRequest{Key: Key("a")}, reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply.Value.Bytes
+	}
+
+	// A write from a clock an hour ahead is rejected, and neither the
+	// lease nor the store's clock is pushed into the future.
+	skewed.SetSkew(time.Hour)
+	if err := put("skewed"); err == nil {
+		t.Fatal("expected write from skewed clock to be rejected")
+	}
+	if lease := rng.getLease(); lease.Expiration.WallTime > int64(manual)+leaderLeaseDuration.Nanoseconds() {
+		t.Errorf("expected lease not to be extended by skewed clock; got %+v", lease)
+	}
+	if now := clock.Now(); now.WallTime != int64(manual) {
+		t.Errorf("expected clock not to be pushed by skewed clock; got %+v", now)
+	}
+	if value := get(); value != nil {
+		t.Errorf("expected rejected write not to be applied; got %q", value)
+	}
+
+	// A write from a clock ahead within the max drift is served, and
+	// the store's clock compensates, so a read timestamped by the store
+	// observes it.
+	skewed.SetSkew(maxDrift / 2)
+	if err := put("ok"); err != nil {
+		t.Fatal(err)
+	}
+	if value := get(); !bytes.Equal(value, []byte("ok")) {
+		t.Errorf("expected read to observe write from clock within max drift; got %q", value)
+	}
+	if lease := rng.getLease(); !lease.Covers(hlc.HLTimestamp{WallTime: skewed.UnixNano()}) {
+		t.Errorf("expected lease to cover timestamps within max drift; got %+v", lease)
+	}
+}
+
+// TestStoreLeaderLeaseRequiresLiveness verifies that a replica whose
+// node's liveness record has expired doesn't acquire the leader lease.
+func TestStoreLeaderLeaseRequiresLiveness(t *testing.T) {
+	g := gossip.New()
+	store := NewStore(hlc.NewHLClock(hlc.UnixNano), NewInMem(Attributes{}, 1<<20), nil, g)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func() error {
+		args := &PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}
+		return <-rng.ReadWriteCmd("Put", args, &PutResponse{})
+	}
+	gossipLiveness(g, time.Now().Add(-time.Second), t, 1)
+	if err := put(); err == nil {
+		t.Fatal("expected replica of node with expired liveness not to acquire lease")
+	} else if _, ok := err.(*NotLeaderError); !ok {
+		t.Fatalf("expected not leader error; got %v", err)
+	}
+	gossipLiveness(g, time.Now().Add(NodeLivenessExpiration), t, 1)
+	if err := put(); err != nil {
+		t.Fatal(err)
+	}
+}
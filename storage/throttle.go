@@ -0,0 +1,280 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/metrics"
+)
+
+// A throttleKind identifies a kind of background work paced by a
+// store's throttle.
+type throttleKind int
+
+const (
+	// throttleSnapshot paces the bytes of range snapshots sent to
+	// replicas being added.
+	throttleSnapshot throttleKind = iota
+	// throttleGC paces the bytes of historical versions garbage
+	// collected.
+	throttleGC
+	// throttleConsistency paces the bytes of range data checksummed
+	// by consistency checks.
+	throttleConsistency
+	// throttleRebalance paces the replicas moved off the store by the
+	// rebalancer.
+	throttleRebalance
+	numThrottleKinds
+)
+
+// Default rates of background work, per second. Byte rates permit
+// bursts of one second's worth of work; rebalancing, one replica.
+const (
+	snapshotBytesPerSec    = 16 << 20
+	gcBytesPerSec          = 64 << 20
+	consistencyBytesPerSec = 16 << 20
+	rebalancesPerSec       = 0.1
+)
+
+// SnapshotLimits bounds the snapshots a store sends to replicas being
+// added and applies to instantiate its own new replicas. Snapshots in
+// excess of a concurrency limit are queued in the order requested.
+type SnapshotLimits struct {
+	MaxConcurrentSends   int     // Maximum snapshots sent at once; 0 for no limit
+	MaxConcurrentApplies int     // Maximum snapshots applied at once; 0 for no limit
+	BytesPerSec          float64 // Rate of snapshot bytes sent; 0 for no limit
+}
+
+// DefaultSnapshotLimits are the snapshot limits of new stores.
+var DefaultSnapshotLimits = SnapshotLimits{
+	MaxConcurrentSends:   2,
+	MaxConcurrentApplies: 2,
+	BytesPerSec:          snapshotBytesPerSec,
+}
+
+// Metrics of the snapshot queues of all stores in the process.
+var (
+	snapshotSendQueue  = metrics.DefaultRegistry.Gauge("store_snapshot_send_queue_depth")
+	snapshotSendWait   = metrics.DefaultRegistry.Histogram("store_snapshot_send_wait_ns", metrics.LatencyBuckets)
+	snapshotApplyQueue = metrics.DefaultRegistry.Gauge("store_snapshot_apply_queue_depth")
+	snapshotApplyWait  = metrics.DefaultRegistry.Histogram("store_snapshot_apply_wait_ns", metrics.LatencyBuckets)
+)
+
+// A throttle holds the rate limiters which pace a store's background
+// work, so that snapshots, GC, consistency checks and rebalancing
+// can't starve foreground traffic, and the semaphores which bound its
+// concurrent snapshots. Waits are abandoned when the store's stopper
+// is stopped. A nil throttle doesn't pace work, as is the case for
+// ranges which don't belong to a store.
+type throttle struct {
+	limiters        [numThrottleKinds]*util.RateLimiter
+	snapshotSends   *semaphore
+	snapshotApplies *semaphore
+	stopper         *util.Stopper
+}
+
+// newThrottle returns a throttle with the default rates and snapshot
+// limits whose waits are abandoned when stopper is stopped.
+func newThrottle(stopper *util.Stopper) *throttle {
+	t := &throttle{
+		snapshotSends:   newSemaphore(DefaultSnapshotLimits.MaxConcurrentSends, snapshotSendQueue, snapshotSendWait),
+		snapshotApplies: newSemaphore(DefaultSnapshotLimits.MaxConcurrentApplies, snapshotApplyQueue, snapshotApplyWait),
+		stopper:         stopper,
+	}
+	t.limiters[throttleSnapshot] = util.NewRateLimiter(DefaultSnapshotLimits.BytesPerSec, snapshotBytesPerSec)
+	t.limiters[throttleGC] = util.NewRateLimiter(gcBytesPerSec, gcBytesPerSec)
+	t.limiters[throttleConsistency] = util.NewRateLimiter(consistencyBytesPerSec, consistencyBytesPerSec)
+	t.limiters[throttleRebalance] = util.NewRateLimiter(rebalancesPerSec, 1)
+	return t
+}
+
+// setRate changes the rate of the kind of work, per second. A rate of
+// zero doesn't pace the work at all.
+func (t *throttle) setRate(kind throttleKind, rate float64) {
+	t.limiters[kind].SetRate(rate)
+}
+
+// wait blocks until n units of the kind of work may proceed. Returns
+// an error if the store is stopped first.
+func (t *throttle) wait(kind throttleKind, n int64) error {
+	if t == nil {
+		return nil
+	}
+	if !t.limiters[kind].Wait(n, t.stopper.ShouldStop()) {
+		return util.Errorf("store is stopping")
+	}
+	return nil
+}
+
+// setSnapshotLimits changes the throttle's snapshot limits. Queued
+// snapshots proceed as soon as the new limits allow.
+func (t *throttle) setSnapshotLimits(limits SnapshotLimits) {
+	t.snapshotSends.setLimit(limits.MaxConcurrentSends)
+	t.snapshotApplies.setLimit(limits.MaxConcurrentApplies)
+	t.setRate(throttleSnapshot, limits.BytesPerSec)
+}
+
+// acquireSnapshotSend blocks until a snapshot may be sent. Returns an
+// error if the store is stopped first. On success, the caller must
+// call releaseSnapshotSend once the snapshot has been sent.
+func (t *throttle) acquireSnapshotSend() error {
+	if t == nil {
+		return nil
+	}
+	return t.snapshotSends.acquire(t.stopper.ShouldStop())
+}
+
+// releaseSnapshotSend releases a slot acquired by acquireSnapshotSend.
+func (t *throttle) releaseSnapshotSend() {
+	if t != nil {
+		t.snapshotSends.release()
+	}
+}
+
+// acquireSnapshotApply blocks until a snapshot may be applied.
+// Returns an error if the store is stopped first. On success, the
+// caller must call releaseSnapshotApply once the snapshot has been
+// applied.
+func (t *throttle) acquireSnapshotApply() error {
+	if t == nil {
+		return nil
+	}
+	return t.snapshotApplies.acquire(t.stopper.ShouldStop())
+}
+
+// releaseSnapshotApply releases a slot acquired by
+// acquireSnapshotApply.
+func (t *throttle) releaseSnapshotApply() {
+	if t != nil {
+		t.snapshotApplies.release()
+	}
+}
+
+// A semaphore bounds the number of concurrent holders. Waiters are
+// granted the semaphore in the order they arrived. The number of
+// waiters and the time each spent waiting are recorded in metrics.
+type semaphore struct {
+	mu      sync.Mutex
+	limit   int             // Maximum holders; 0 for no limit
+	holders int             // Current holders
+	waiters []chan struct{} // Closed in order to grant waiters
+	depth   *metrics.Gauge
+	wait    *metrics.Histogram
+}
+
+// newSemaphore returns a semaphore with the given limit, recording
+// its queue depth and wait times in the given metrics.
+func newSemaphore(limit int, depth *metrics.Gauge, wait *metrics.Histogram) *semaphore {
+	return &semaphore{limit: limit, depth: depth, wait: wait}
+}
+
+// acquire blocks until the semaphore is granted or stop is closed, in
+// which case an error is returned.
+func (s *semaphore) acquire(stop <-chan struct{}) error {
+	_, err := s.tryAcquire(stop, 0, 0)
+	return err
+}
+
+// tryAcquire blocks until the semaphore is granted, returning true,
+// or until stop is closed, in which case an error is returned. If
+// maxWaiters are already waiting, or the semaphore isn't granted
+// within timeout, tryAcquire gives up and returns false. Zero values
+// of maxWaiters and timeout impose no limit.
+func (s *semaphore) tryAcquire(stop <-chan struct{}, maxWaiters int, timeout time.Duration) (bool, error) {
+	s.mu.Lock()
+	if len(s.waiters) == 0 && (s.limit == 0 || s.holders < s.limit) {
+		s.holders++
+		s.mu.Unlock()
+		return true, nil
+	}
+	if maxWaiters > 0 && len(s.waiters) >= maxWaiters {
+		s.mu.Unlock()
+		return false, nil
+	}
+	start := time.Now()
+	ch := make(chan struct{})
+	s.waiters = append(s.waiters, ch)
+	s.depth.Inc(1)
+	s.mu.Unlock()
+
+	defer s.wait.UpdateSince(start)
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	stopped := false
+	select {
+	case <-ch:
+		return true, nil
+	case <-stop:
+		stopped = true
+	case <-expired:
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, w := range s.waiters {
+		if w == ch {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			s.depth.Inc(-1)
+			if stopped {
+				return false, util.Errorf("store is stopping")
+			}
+			return false, nil
+		}
+	}
+	// The semaphore was granted concurrently with stop or the
+	// timeout. Keep it, unless stopping, in which case pass it on.
+	if !stopped {
+		return true, nil
+	}
+	s.holders--
+	s.grantLocked()
+	return false, util.Errorf("store is stopping")
+}
+
+// release releases the semaphore, granting it to the first waiter if
+// the limit permits.
+func (s *semaphore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.holders--
+	s.grantLocked()
+}
+
+// setLimit changes the semaphore's limit, granting it to as many
+// waiters as the new limit permits.
+func (s *semaphore) setLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	s.grantLocked()
+}
+
+// grantLocked grants the semaphore to waiters, in order, while the
+// limit permits.
+func (s *semaphore) grantLocked() {
+	for len(s.waiters) > 0 && (s.limit == 0 || s.holders < s.limit) {
+		close(s.waiters[0])
+		s.waiters = s.waiters[1:]
+		s.holders++
+		s.depth.Inc(-1)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/metrics"
+)
+
+// TestThrottle verifies that a nil throttle doesn't pace work and
+// that waits are abandoned once the throttle's stopper is stopped.
+func TestThrottle(t *testing.T) {
+	var nilThrottle *throttle
+	if err := nilThrottle.wait(throttleSnapshot, 1<<40); err != nil {
+		t.Fatal(err)
+	}
+
+	stopper := util.NewStopper()
+	th := newThrottle(stopper)
+	th.setRate(throttleRebalance, 1e-6)
+	// The first rebalance proceeds; the next waits for the first's
+	// token to be replaced, until the stopper is stopped.
+	if err := th.wait(throttleRebalance, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := th.wait(throttleRebalance, 1); err != nil {
+		t.Fatal(err)
+	}
+	errC := make(chan error)
+	go func() { errC <- th.wait(throttleRebalance, 1) }()
+	stopper.Stop()
+	if err := <-errC; err == nil {
+		t.Error("expected wait to fail once stopped")
+	}
+}
+
+// TestSemaphore verifies that a semaphore bounds its holders, grants
+// itself to waiters in order, tracks its queue depth, and honors
+// changes to its limit.
+func TestSemaphore(t *testing.T) {
+	depth := &metrics.Gauge{}
+	wait := metrics.NewHistogram(metrics.LatencyBuckets)
+	sem := newSemaphore(1, depth, wait)
+	stop := make(chan struct{})
+	if err := sem.acquire(stop); err != nil {
+		t.Fatal(err)
+	}
+	// Queue three waiters, in order.
+	acquired := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			if err := sem.acquire(stop); err != nil {
+				t.Error(err)
+			}
+			acquired <- i
+		}(i)
+		if err := util.IsTrueWithin(func() bool { return depth.Value() == int64(i+1) }, 50*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each release admits the next waiter.
+	sem.release()
+	if i := <-acquired; i != 0 {
+		t.Errorf("expected waiter 0 to acquire; got %d", i)
+	}
+	// Raising the limit admits the remaining waiters at once.
+	sem.setLimit(3)
+	if i, j := <-acquired, <-acquired; i+j != 3 {
+		t.Errorf("expected waiters 1 and 2 to acquire; got %d and %d", i, j)
+	}
+	if depth.Value() != 0 {
+		t.Errorf("expected empty queue; got depth %d", depth.Value())
+	}
+	if snap := wait.Snapshot(); snap.Count != 3 {
+		t.Errorf("expected 3 recorded waits; got %d", snap.Count)
+	}
+	// The semaphore is full; a waiter gives up once stopped.
+	errC := make(chan error)
+	go func() { errC <- sem.acquire(stop) }()
+	close(stop)
+	if err := <-errC; err == nil {
+		t.Error("expected acquire to fail once stopped")
+	}
+	if depth.Value() != 0 {
+		t.Errorf("expected empty queue; got depth %d", depth.Value())
+	}
+}
+
+// TestThrottleSnapshotLimits verifies that snapshot sends and
+// applications are bounded separately, and that a nil throttle
+// doesn't bound them.
+func TestThrottleSnapshotLimits(t *testing.T) {
+	var nilThrottle *throttle
+	if err := nilThrottle.acquireSnapshotSend(); err != nil {
+		t.Fatal(err)
+	}
+	nilThrottle.releaseSnapshotSend()
+
+	stopper := util.NewStopper()
+	th := newThrottle(stopper)
+	th.setSnapshotLimits(SnapshotLimits{MaxConcurrentSends: 1, MaxConcurrentApplies: 1})
+	if err := th.acquireSnapshotSend(); err != nil {
+		t.Fatal(err)
+	}
+	// Applies aren't bounded by sends.
+	if err := th.acquireSnapshotApply(); err != nil {
+		t.Fatal(err)
+	}
+	errC := make(chan error)
+	go func() { errC <- th.acquireSnapshotSend() }()
+	select {
+	case err := <-errC:
+		t.Fatalf("expected second send to wait; got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	th.releaseSnapshotSend()
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+	go func() { errC <- th.acquireSnapshotApply() }()
+	stopper.Stop()
+	if err := <-errC; err == nil {
+		t.Error("expected apply to fail once stopped")
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Names of the phases recorded in traces.
+const (
+	// TraceLookup is the time spent looking up the descriptors of the
+	// ranges addressed by a request.
+	TraceLookup = "lookup"
+	// TraceRPC is the time spent sending a request to the replicas of
+	// its range and awaiting the reply, across all attempts.
+	TraceRPC = "rpc"
+	// TraceExecute is the time spent by the range executing a request,
+	// including waiting for the leader lease and for consensus.
+	TraceExecute = "execute"
+	// TraceLease is the time a read/write command spent verifying
+	// permissions and acquiring or verifying the leader lease.
+	TraceLease = "lease"
+	// TracePropose is the time a read/write command waited from
+	// proposal until it was committed and ready to apply. Until ranges
+	// replicate commands via multiraft, this is the time the command
+	// spent queued for the range's pending command processor.
+	TracePropose = "propose"
+	// TraceApply is the time spent applying a committed read/write
+	// command to the engine, including the response cache.
+	TraceApply = "apply"
+	// TraceClient is the total time spent by a client on a request,
+	// including retries.
+	TraceClient = "client"
+)
+
+// A Trace describes how a request was routed and executed. It's
+// returned in the response header of requests which set Trace in
+// their request header, to help debug slow requests without access
+// to server logs. Each component handling the request records what it
+// observed.
+type Trace struct {
+	RangeID int64    // ID of the range which executed the request
+	Replica Replica  // Replica which executed the request
+	Leader  *Replica // Holder of the range's leader lease, if known
+	// Attempts is the number of times the request was sent to a range
+	// before it succeeded or failed permanently.
+	Attempts int
+	// Phases lists the time spent in each phase of the request, in the
+	// order recorded. Phases observed by different components nest:
+	// the rpc phase includes the execute phase, for example.
+	Phases []TracePhase
+}
+
+// A TracePhase is the time spent in one phase of a request.
+type TracePhase struct {
+	Name     string
+	Duration time.Duration
+}
+
+// ReplyTrace returns the trace of reply if tracing was requested by
+// args, allocating it if necessary. Returns nil otherwise.
+func ReplyTrace(args Request, reply Response) *Trace {
+	if !args.Header().Trace {
+		return nil
+	}
+	header := reply.Header()
+	if header.Trace == nil {
+		header.Trace = &Trace{}
+	}
+	return header.Trace
+}
+
+// AddPhase records a phase which started at start and ends now.
+func (t *Trace) AddPhase(name string, start time.Time) {
+	t.Phases = append(t.Phases, TracePhase{Name: name, Duration: time.Since(start)})
+}
+
+// Merge adds the attempts and phases of o to the trace, and replaces
+// its range and replicas with those of o. It's used to combine the
+// traces of requests sent to several ranges on behalf of one request.
+func (t *Trace) Merge(o *Trace) {
+	if o == nil {
+		return
+	}
+	t.RangeID, t.Replica, t.Leader = o.RangeID, o.Replica, o.Leader
+	t.Attempts += o.Attempts
+	t.Phases = append(t.Phases, o.Phases...)
+}
+
+// String formats the trace for logging.
+func (t *Trace) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "range %d at node %d/store %d", t.RangeID, t.Replica.NodeID, t.Replica.StoreID)
+	if t.Leader != nil {
+		fmt.Fprintf(&buf, " (leader node %d/store %d)", t.Leader.NodeID, t.Leader.StoreID)
+	}
+	fmt.Fprintf(&buf, ", %d attempts", t.Attempts)
+	for i, phase := range t.Phases {
+		sep := ", "
+		if i == 0 {
+			sep = ": "
+		}
+		fmt.Fprintf(&buf, "%s%s %s", sep, phase.Name, phase.Duration)
+	}
+	return buf.String()
+}
+
+// DefaultSlowRequestThreshold is the default latency above which
+// requests are collected by SlowRequests.
+const DefaultSlowRequestThreshold = 500 * time.Millisecond
+
+// defaultSlowRequestCapacity is the number of slow requests retained
+// by SlowRequests.
+const defaultSlowRequestCapacity = 100
+
+// SlowRequests collects the traces of the requests coordinated by
+// this process which took longer than its threshold.
+var SlowRequests = NewTraceCollector(DefaultSlowRequestThreshold, defaultSlowRequestCapacity)
+
+// A SlowRequest is the trace of a request whose latency exceeded the
+// threshold of a TraceCollector.
+type SlowRequest struct {
+	Time     time.Time     // Time at which the request started
+	Method   string        // Method of the request
+	Duration time.Duration // Total latency of the request
+	Trace    Trace
+}
+
+// String formats the slow request for logging.
+func (sr SlowRequest) String() string {
+	return fmt.Sprintf("%s %s took %s: %s", sr.Time.Format(time.RFC3339Nano), sr.Method, sr.Duration, &sr.Trace)
+}
+
+// A TraceCollector retains the traces of the most recent requests
+// which exceeded a latency threshold, for diagnosis of tail latency.
+// It's safe for concurrent use.
+type TraceCollector struct {
+	mu        sync.Mutex
+	threshold time.Duration // Zero disables collection
+	capacity  int
+	requests  []SlowRequest // Ring buffer of at most capacity requests
+	next      int           // Index in requests of the next to replace
+}
+
+// NewTraceCollector returns a collector which retains up to capacity
+// requests slower than threshold. A zero threshold disables
+// collection.
+func NewTraceCollector(threshold time.Duration, capacity int) *TraceCollector {
+	return &TraceCollector{threshold: threshold, capacity: capacity}
+}
+
+// Threshold returns the collector's latency threshold.
+func (tc *TraceCollector) Threshold() time.Duration {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.threshold
+}
+
+// SetThreshold sets the collector's latency threshold. Zero disables
+// collection.
+func (tc *TraceCollector) SetThreshold(threshold time.Duration) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.threshold = threshold
+}
+
+// Record collects a copy of the trace of a request which started at
+// start and completes now, if its latency exceeds the threshold.
+// Returns whether the request was collected.
+func (tc *TraceCollector) Record(method string, start time.Time, trace *Trace) bool {
+	duration := time.Since(start)
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.threshold == 0 || duration < tc.threshold || tc.capacity == 0 {
+		return false
+	}
+	sr := SlowRequest{Time: start, Method: method, Duration: duration}
+	if trace != nil {
+		sr.Trace = *trace
+		sr.Trace.Phases = append([]TracePhase(nil), trace.Phases...)
+	}
+	if len(tc.requests) < tc.capacity {
+		tc.requests = append(tc.requests, sr)
+	} else {
+		tc.requests[tc.next] = sr
+	}
+	tc.next = (tc.next + 1) % tc.capacity
+	return true
+}
+
+// Requests returns the collected requests, oldest first.
+func (tc *TraceCollector) Requests() []SlowRequest {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	var requests []SlowRequest
+	if len(tc.requests) == tc.capacity {
+		requests = append(requests, tc.requests[tc.next:]...)
+		requests = append(requests, tc.requests[:tc.next]...)
+	} else {
+		requests = append(requests, tc.requests...)
+	}
+	return requests
+}
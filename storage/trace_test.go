@@ -0,0 +1,167 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReplyTrace verifies that a trace is allocated only for
+// requests which ask for one.
+func TestReplyTrace(t *testing.T) {
+	reply := &GetResponse{}
+	if trace := ReplyTrace(&GetRequest{}, reply); trace != nil || reply.Trace != nil {
+		t.Errorf("expected no trace; got %+v", trace)
+	}
+	args := &GetRequest{RequestHeader: RequestHeader{Trace: true}}
+	trace := ReplyTrace(args, reply)
+	if trace == nil || reply.Trace != trace {
+		t.Fatalf("expected trace to be allocated in reply; got %+v", reply.Trace)
+	}
+	if ReplyTrace(args, reply) != trace {
+		t.Error("expected existing trace to be returned")
+	}
+}
+
+// TestTraceMerge verifies that merged traces accumulate attempts and
+// phases and take the range of the merged trace.
+func TestTraceMerge(t *testing.T) {
+	trace := &Trace{RangeID: 1, Attempts: 1, Phases: []TracePhase{{TraceRPC, time.Millisecond}}}
+	trace.Merge(nil)
+	leader := Replica{NodeID: 2, StoreID: 2, RangeID: 2}
+	trace.Merge(&Trace{
+		RangeID:  2,
+		Replica:  leader,
+		Leader:   &leader,
+		Attempts: 2,
+		Phases:   []TracePhase{{TraceExecute, time.Millisecond}},
+	})
+	if trace.RangeID != 2 || trace.Leader == nil || trace.Attempts != 3 || len(trace.Phases) != 2 {
+		t.Errorf("unexpected merged trace: %+v", trace)
+	}
+	expected := "range 2 at node 2/store 2 (leader node 2/store 2), 3 attempts: rpc 1ms, execute 1ms"
+	if s := trace.String(); s != expected {
+		t.Errorf("expected %q; got %q", expected, s)
+	}
+}
+
+// TestTraceCollector verifies that only requests over the threshold
+// are collected and that the most recent are retained.
+func TestTraceCollector(t *testing.T) {
+	tc := NewTraceCollector(time.Hour, 2)
+	if tc.Record("Get", time.Now(), &Trace{}) || len(tc.Requests()) != 0 {
+		t.Error("expected fast request not to be collected")
+	}
+	tc.SetThreshold(time.Nanosecond)
+	trace := &Trace{Phases: []TracePhase{{TraceRPC, time.Millisecond}}}
+	for _, method := range []string{"Get", "Put", "Scan"} {
+		if !tc.Record(method, time.Now().Add(-time.Second), trace) {
+			t.Errorf("expected %s to be collected", method)
+		}
+	}
+	// Later changes to the trace aren't reflected in the collector.
+	trace.Phases[0].Name = TraceExecute
+	var methods []string
+	for _, sr := range tc.Requests() {
+		methods = append(methods, sr.Method)
+		if sr.Duration < time.Second || sr.Trace.Phases[0].Name != TraceRPC {
+			t.Errorf("unexpected slow request %s", sr)
+		}
+	}
+	if expected := []string{"Put", "Scan"}; !reflect.DeepEqual(methods, expected) {
+		t.Errorf("expected requests %v; got %v", expected, methods)
+	}
+
+	tc.SetThreshold(0)
+	if tc.Record("Get", time.Now().Add(-time.Second), nil) {
+		t.Error("expected collection to be disabled")
+	}
+}
+
+// tracePhaseNames returns the names of the trace's phases.
+func tracePhaseNames(trace *Trace) []string {
+	var names []string
+	for _, phase := range trace.Phases {
+		names = append(names, phase.Name)
+	}
+	return names
+}
+
+// TestRangeTrace verifies that ranges record the executing replica,
+// the lease holder and the execution time in traces of commands, and
+// the phases of the write path in traces of read/write commands.
+func TestRangeTrace(t *testing.T) {
+	store := createTestStore(1, 1, t)
+	defer store.Close()
+	local := Replica{NodeID: 1, StoreID: 1, RangeID: 1}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{local})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putReply := &PutResponse{}
+	putArgs := &PutRequest{RequestHeader: RequestHeader{Trace: true}, Key: Key("a"), Value: Value{Bytes: []byte("a")}}
+	if err := <-rng.ReadWriteCmd("Put", putArgs, putReply); err != nil {
+		t.Fatal(err)
+	}
+	getReply := &GetResponse{}
+	if err := rng.ReadOnlyCmd("Get", &GetRequest{RequestHeader: RequestHeader{Trace: true}, Key: Key("a")}, getReply); err != nil {
+		t.Fatal(err)
+	}
+	for i, trace := range []*Trace{putReply.Trace, getReply.Trace} {
+		if trace == nil {
+			t.Fatalf("%d: expected trace", i)
+		}
+		if trace.RangeID != 1 || !sameReplica(trace.Replica, local) || trace.Leader == nil || !sameReplica(*trace.Leader, local) {
+			t.Errorf("%d: unexpected trace: %s", i, trace)
+		}
+		if !strings.HasPrefix(trace.String(), "range 1 at node 1/store 1") {
+			t.Errorf("%d: unexpected trace string %q", i, trace)
+		}
+	}
+	writePhases := []string{TraceLease, TracePropose, TraceApply, TraceExecute}
+	if names := tracePhaseNames(putReply.Trace); !reflect.DeepEqual(names, writePhases) {
+		t.Errorf("expected put phases %v; got %v", writePhases, names)
+	}
+	if names := tracePhaseNames(getReply.Trace); !reflect.DeepEqual(names, []string{TraceExecute}) {
+		t.Errorf("expected get phases [execute]; got %v", names)
+	}
+
+	// A retried command is answered from the response cache, but its
+	// trace describes the retry rather than the cached execution.
+	putArgs = &PutRequest{
+		RequestHeader: RequestHeader{Trace: true, CmdID: ClientCmdID{WallTime: 1, Random: 1}},
+		Key:           Key("b"),
+		Value:         Value{Bytes: []byte("b")},
+	}
+	for i := 0; i < 2; i++ {
+		putReply = &PutResponse{}
+		if err := <-rng.ReadWriteCmd("Put", putArgs, putReply); err != nil {
+			t.Fatal(err)
+		}
+		if names := tracePhaseNames(putReply.Trace); !reflect.DeepEqual(names, writePhases) {
+			t.Errorf("%d: expected put phases %v; got %v", i, writePhases, names)
+		}
+	}
+
+	// Untraced commands have no trace.
+	getReply = &GetResponse{}
+	if err := rng.ReadOnlyCmd("Get", &GetRequest{Key: Key("a")}, getReply); err != nil || getReply.Trace != nil {
+		t.Errorf("expected no trace; got %v, %v", getReply.Trace, err)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/cockroachdb/cockroach/hlc"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TxnHeartbeatInterval is the interval at which the coordinators of
+// pending transactions heartbeat their transactions' records.
+const TxnHeartbeatInterval = 5 * time.Second
+
+// txnExpiration is the time after its last heartbeat, or its
+// timestamp if it was never heartbeat, after which a pending
+// transaction is considered abandoned by its coordinator. Abandoned
+// transactions may be pushed or aborted regardless of priority.
+const txnExpiration = 2 * TxnHeartbeatInterval
+
+// IsolationType specifies the isolation level of a transaction.
+type IsolationType int
+
+const (
+	// SERIALIZABLE transactions may not commit at a timestamp later
+	// than the one at which they started reading; if pushed, they
+	// must restart.
+	SERIALIZABLE IsolationType = iota
+	// SNAPSHOT transactions read from a consistent snapshot and may
+	// commit at a pushed timestamp.
+	SNAPSHOT
+)
+
+// TransactionStatus specifies the status of a transaction.
+type TransactionStatus int
+
+const (
+	// PENDING is the status of a transaction which has neither
+	// committed nor aborted.
+	PENDING TransactionStatus = iota
+	// COMMITTED is the status of a committed transaction. Write
+	// intents of committed transactions are made permanent.
+	COMMITTED
+	// ABORTED is the status of an aborted transaction. Write intents
+	// of aborted transactions are removed.
+	ABORTED
+)
+
+// String implements the fmt.Stringer interface.
+func (s TransactionStatus) String() string {
+	switch s {
+	case PENDING:
+		return "PENDING"
+	case COMMITTED:
+		return "COMMITTED"
+	case ABORTED:
+		return "ABORTED"
+	}
+	return fmt.Sprintf("TransactionStatus(%d)", s)
+}
+
+// A Transaction is a unit of work performed on the database.
+// Transactions write intents which are only made visible to other
+// readers once the transaction commits. The transaction record is
+// stored in the range containing the transaction's Key and is
+// consulted (and possibly modified) by readers or writers which
+// encounter the transaction's intents.
+type Transaction struct {
+	// ID is a unique identifier for the transaction.
+	ID string
+	// Key is the key which anchors the transaction. This is typically
+	// the first key read or written during the transaction and
+	// determines which range holds the transaction record.
+	Key Key
+	// Priority is used to decide which of two conflicting
+	// transactions is pushed.
+	Priority int32
+	// Isolation is the isolation level of the transaction.
+	Isolation IsolationType
+	// Status is the current status of the transaction.
+	Status TransactionStatus
+	// Epoch is incremented on transaction restarts.
+	Epoch int32
+	// Timestamp is the candidate commit timestamp. Intents are
+	// written at this timestamp. It may be pushed forward by
+	// conflicting readers.
+	Timestamp hlc.HLTimestamp
+	// MaxTimestamp is the maximum timestamp seen by the transaction's
+	// coordinator, used to bound clock uncertainty on reads.
+	MaxTimestamp hlc.HLTimestamp
+	// LastHeartbeat is the time of the last heartbeat of the
+	// transaction's record by its coordinator; zero if none. See
+	// InternalHeartbeatTxn.
+	LastHeartbeat hlc.HLTimestamp
+}
+
+// NewTransaction creates a new transaction anchored at key with a
+// random priority and a timestamp taken from the supplied clock.
+func NewTransaction(key Key, isolation IsolationType, clock *hlc.HLClock) *Transaction {
+	now := clock.Now()
+	return &Transaction{
+		ID:           uuid.New(),
+		Key:          key,
+		Priority:     util.CachedRand.Int31(),
+		Isolation:    isolation,
+		Timestamp:    now,
+		MaxTimestamp: now,
+	}
+}
+
+// String formats a transaction for debug output.
+func (t *Transaction) String() string {
+	return fmt.Sprintf("txn %s (key=%q pri=%d status=%s epoch=%d ts=%+v)",
+		t.ID, t.Key, t.Priority, t.Status, t.Epoch, t.Timestamp)
+}
+
+// isExpired returns whether the transaction is pending and hasn't
+// been heartbeat by its coordinator within txnExpiration of now.
+func (t *Transaction) isExpired(now hlc.HLTimestamp) bool {
+	if t.Status != PENDING {
+		return false
+	}
+	last := t.LastHeartbeat
+	if last.Less(t.Timestamp) {
+		last = t.Timestamp
+	}
+	return last.WallTime+int64(txnExpiration) < now.WallTime
+}
+
+// txnKey returns the range-local key at which the record of the
+// transaction anchored at key with the specified ID is stored. The
+// anchor key is encoded so transaction records sort by anchor key.
+func txnKey(key Key, id string) Key {
+	return MakeKey(keyLocalTransactionPrefix, MakeKey(encodeBytes(key), Key(id)))
+}
@@ -0,0 +1,148 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import (
+	"fmt"
+	"sync"
+)
+
+// A MemoryBudgetExceededError indicates that a reservation of memory
+// would have exceeded the limit of a budget.
+type MemoryBudgetExceededError struct {
+	Budget    string // Name of the budget whose limit would be exceeded
+	Requested int64  // Bytes requested
+	Used      int64  // Bytes already reserved from the budget
+	Limit     int64  // Limit of the budget
+}
+
+// Error formats error.
+func (e *MemoryBudgetExceededError) Error() string {
+	return fmt.Sprintf("memory budget %q exceeded: %d bytes requested with %d of %d bytes in use",
+		e.Budget, e.Requested, e.Used, e.Limit)
+}
+
+// A MemoryBudget accounts for the memory held by a subsystem, cache
+// or request against a limit. Budgets form a hierarchy: memory
+// reserved from a budget is also reserved from its parent, so that a
+// root budget bounds the memory of all of its descendants. Work which
+// can't reserve memory should fail rather than allocate it. A nil
+// budget admits any reservation. MemoryBudgets are safe for
+// concurrent use.
+type MemoryBudget struct {
+	name   string
+	mu     sync.Mutex
+	parent *MemoryBudget
+	limit  int64 // Maximum bytes reserved; zero for no limit
+	used   int64 // Bytes reserved, including by descendants
+}
+
+// NewMemoryBudget returns a root budget of limit bytes. A limit of
+// zero imposes no limit of its own.
+func NewMemoryBudget(name string, limit int64) *MemoryBudget {
+	return &MemoryBudget{name: name, limit: limit}
+}
+
+// NewChild returns a budget of limit bytes whose reservations are
+// also reserved from b. Returns nil if b is nil.
+func (b *MemoryBudget) NewChild(name string, limit int64) *MemoryBudget {
+	if b == nil {
+		return nil
+	}
+	return &MemoryBudget{name: name, parent: b, limit: limit}
+}
+
+// SetParent makes b a child of parent, so that b's reservations are
+// also reserved from parent. It must be called before any memory is
+// reserved from b.
+func (b *MemoryBudget) SetParent(parent *MemoryBudget) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.parent = parent
+}
+
+// SetLimit changes the limit of the budget. Memory already reserved
+// in excess of a lower limit isn't reclaimed, but further
+// reservations fail until enough is released.
+func (b *MemoryBudget) SetLimit(limit int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limit = limit
+}
+
+// Limit returns the limit of the budget.
+func (b *MemoryBudget) Limit() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limit
+}
+
+// Used returns the bytes reserved from the budget.
+func (b *MemoryBudget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// Reserve reserves n bytes from the budget and its ancestors. Returns
+// a MemoryBudgetExceededError, reserving nothing, if the limit of any
+// of them would be exceeded.
+func (b *MemoryBudget) Reserve(n int64) error {
+	if b == nil || n == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 && b.used+n > b.limit {
+		return &MemoryBudgetExceededError{Budget: b.name, Requested: n, Used: b.used, Limit: b.limit}
+	}
+	if err := b.parent.Reserve(n); err != nil {
+		return err
+	}
+	b.used += n
+	return nil
+}
+
+// Release returns n bytes reserved via Reserve to the budget and its
+// ancestors.
+func (b *MemoryBudget) Release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	b.parent.Release(n)
+}
+
+// Close releases all memory reserved from the budget. It's intended
+// for budgets of individual requests, which release their memory all
+// at once when complete.
+func (b *MemoryBudget) Close() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.parent.Release(b.used)
+	b.used = 0
+}
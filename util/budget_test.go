@@ -0,0 +1,61 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import "testing"
+
+// TestMemoryBudget verifies that reservations from a budget are also
+// reserved from its ancestors and fail if any limit would be exceeded.
+func TestMemoryBudget(t *testing.T) {
+	root := NewMemoryBudget("root", 100)
+	sub := root.NewChild("sub", 60)
+	req1, req2 := sub.NewChild("req1", 0), sub.NewChild("req2", 0)
+
+	if err := req1.Reserve(50); err != nil {
+		t.Fatal(err)
+	}
+	if root.Used() != 50 || sub.Used() != 50 || req1.Used() != 50 {
+		t.Errorf("expected 50 bytes reserved throughout; got %d, %d, %d", root.Used(), sub.Used(), req1.Used())
+	}
+	// The subsystem's limit is exceeded before the root's.
+	err := req2.Reserve(20)
+	if e, ok := err.(*MemoryBudgetExceededError); !ok || e.Budget != "sub" {
+		t.Errorf("expected sub's budget to be exceeded; got %v", err)
+	}
+	if req2.Used() != 0 || root.Used() != 50 {
+		t.Errorf("expected failed reservation to reserve nothing; got %d, %d", req2.Used(), root.Used())
+	}
+	// Memory reserved directly from the root counts against its limit.
+	if err := root.Reserve(45); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := req2.Reserve(10).(*MemoryBudgetExceededError); !ok || e.Budget != "root" {
+		t.Errorf("expected root's budget to be exceeded; got %v", e)
+	}
+	root.Release(45)
+
+	req1.Release(10)
+	req1.Close()
+	if root.Used() != 0 || sub.Used() != 0 || req1.Used() != 0 {
+		t.Errorf("expected all memory released; got %d, %d, %d", root.Used(), sub.Used(), req1.Used())
+	}
+
+	// Nil budgets admit any reservation.
+	var none *MemoryBudget
+	if err := none.NewChild("child", 1).Reserve(1 << 40); err != nil {
+		t.Errorf("expected nil budget to admit reservation: %v", err)
+	}
+}
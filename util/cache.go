@@ -0,0 +1,349 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import (
+	"container/list"
+	"fmt"
+
+	"code.google.com/p/biogo.store/llrb"
+	"github.com/cockroachdb/cockroach/util/interval"
+	"github.com/cockroachdb/cockroach/util/metrics"
+)
+
+// CacheConfig specifies the bounds of a cache, beyond which entries
+// are evicted in least recently used order, and how evictions and
+// lookups are reported.
+type CacheConfig struct {
+	// MaxEntries is the maximum number of entries. Zero means no
+	// limit.
+	MaxEntries int
+	// MaxBytes is the maximum total size of the entries, as measured
+	// by Size. Zero means no limit. An entry larger than MaxBytes is
+	// evicted as soon as it's added.
+	MaxBytes int64
+	// Size returns the size in bytes of an entry. It must be set if
+	// MaxBytes is non-zero.
+	Size func(key, value interface{}) int64
+	// OnEvicted optionally specifies a callback invoked when an entry
+	// is evicted or removed from the cache.
+	OnEvicted func(key, value interface{})
+	// Metrics optionally counts the cache's hits and misses.
+	Metrics *CacheMetrics
+	// Budget optionally accounts for the size of the entries. If the
+	// budget can't accommodate an entry being added, entries are
+	// evicted until it can; an entry the budget can't accommodate even
+	// then isn't cached. Size must be set if Budget is non-nil.
+	Budget *MemoryBudget
+}
+
+// CacheMetrics counts cache hits and misses. Metrics may be shared by
+// the caches of a component.
+type CacheMetrics struct {
+	Hits, Misses *metrics.Counter
+}
+
+// NewCacheMetrics returns metrics registered in the default registry
+// as name_hits and name_misses.
+func NewCacheMetrics(name string) *CacheMetrics {
+	return &CacheMetrics{
+		Hits:   metrics.DefaultRegistry.Counter(name + "_hits"),
+		Misses: metrics.DefaultRegistry.Counter(name + "_misses"),
+	}
+}
+
+// A CacheEntry is a key and value held in a cache.
+type CacheEntry struct {
+	Key, Value interface{}
+	size       int64
+	le         *list.Element
+}
+
+// Compare implements llrb.Comparable for entries of an OrderedCache.
+func (e *CacheEntry) Compare(b llrb.Comparable) int {
+	return e.Key.(llrb.Comparable).Compare(b.(*CacheEntry).Key.(llrb.Comparable))
+}
+
+// Range implements interval.Interface for entries of an IntervalCache.
+func (e *CacheEntry) Range() interval.Range {
+	return e.Key.(*IntervalKey).Range
+}
+
+// ID implements interval.Interface for entries of an IntervalCache.
+func (e *CacheEntry) ID() uintptr {
+	return e.Key.(*IntervalKey).id
+}
+
+// cacheStore indexes the entries of a cache by key.
+type cacheStore interface {
+	get(key interface{}) *CacheEntry
+	add(e *CacheEntry)
+	del(e *CacheEntry)
+}
+
+// baseCache implements the eviction policy and accounting common to
+// all caches; the entries are indexed by its store. Caches aren't
+// safe for concurrent use.
+type baseCache struct {
+	CacheConfig
+	store cacheStore
+	ll    list.List // Entries, from most to least recently used
+	bytes int64
+}
+
+func newBaseCache(config CacheConfig, store cacheStore) baseCache {
+	if config.MaxBytes != 0 && config.Size == nil {
+		panic("cache with MaxBytes requires Size")
+	}
+	if config.Budget != nil && config.Size == nil {
+		panic("cache with Budget requires Size")
+	}
+	return baseCache{CacheConfig: config, store: store}
+}
+
+// Add adds a value to the cache, replacing any value with the same
+// key, and marks it as most recently used. Entries are then evicted
+// until the cache is within its bounds and budget.
+func (bc *baseCache) Add(key, value interface{}) {
+	e := bc.store.get(key)
+	if e != nil {
+		bc.bytes -= e.size
+		bc.Budget.Release(e.size)
+		e.size = 0
+		e.Value = value
+		bc.ll.MoveToFront(e.le)
+	} else {
+		e = &CacheEntry{Key: key, Value: value}
+		bc.store.add(e)
+		e.le = bc.ll.PushFront(e)
+	}
+	if bc.Size != nil {
+		size := bc.Size(key, value)
+		for bc.Budget.Reserve(size) != nil {
+			lru := bc.ll.Back().Value.(*CacheEntry)
+			bc.removeEntry(lru)
+			if lru == e {
+				return
+			}
+		}
+		e.size = size
+		bc.bytes += e.size
+	}
+	for bc.ll.Len() > 0 && ((bc.MaxEntries != 0 && bc.ll.Len() > bc.MaxEntries) ||
+		(bc.MaxBytes != 0 && bc.bytes > bc.MaxBytes)) {
+		bc.removeEntry(bc.ll.Back().Value.(*CacheEntry))
+	}
+}
+
+// Get looks up a key's value from the cache, marking it as most
+// recently used.
+func (bc *baseCache) Get(key interface{}) (value interface{}, ok bool) {
+	e := bc.store.get(key)
+	if bc.Metrics != nil {
+		if e != nil {
+			bc.Metrics.Hits.Inc(1)
+		} else {
+			bc.Metrics.Misses.Inc(1)
+		}
+	}
+	if e == nil {
+		return nil, false
+	}
+	bc.ll.MoveToFront(e.le)
+	return e.Value, true
+}
+
+// Del removes the provided key from the cache.
+func (bc *baseCache) Del(key interface{}) {
+	if e := bc.store.get(key); e != nil {
+		bc.removeEntry(e)
+	}
+}
+
+// Clear removes all entries from the cache.
+func (bc *baseCache) Clear() {
+	for bc.ll.Len() > 0 {
+		bc.removeEntry(bc.ll.Back().Value.(*CacheEntry))
+	}
+}
+
+// Len returns the number of entries in the cache.
+func (bc *baseCache) Len() int {
+	return bc.ll.Len()
+}
+
+// Bytes returns the total size of the entries in the cache. It's
+// always zero if the cache's config doesn't specify Size.
+func (bc *baseCache) Bytes() int64 {
+	return bc.bytes
+}
+
+func (bc *baseCache) removeEntry(e *CacheEntry) {
+	bc.ll.Remove(e.le)
+	bc.store.del(e)
+	bc.bytes -= e.size
+	bc.Budget.Release(e.size)
+	if bc.OnEvicted != nil {
+		bc.OnEvicted(e.Key, e.Value)
+	}
+}
+
+// UnorderedCache is a cache whose keys may be any comparable values.
+// See http://golang.org/ref/spec#Comparison_operators
+type UnorderedCache struct {
+	baseCache
+	entries map[interface{}]*CacheEntry
+}
+
+// NewUnorderedCache creates a new UnorderedCache.
+func NewUnorderedCache(config CacheConfig) *UnorderedCache {
+	uc := &UnorderedCache{entries: map[interface{}]*CacheEntry{}}
+	uc.baseCache = newBaseCache(config, uc)
+	return uc
+}
+
+func (uc *UnorderedCache) get(key interface{}) *CacheEntry { return uc.entries[key] }
+func (uc *UnorderedCache) add(e *CacheEntry)               { uc.entries[e.Key] = e }
+func (uc *UnorderedCache) del(e *CacheEntry)               { delete(uc.entries, e.Key) }
+
+// OrderedCache is a cache whose keys implement llrb.Comparable and
+// which supports ordered lookups and iteration.
+type OrderedCache struct {
+	baseCache
+	entries llrb.Tree
+}
+
+// NewOrderedCache creates a new OrderedCache.
+func NewOrderedCache(config CacheConfig) *OrderedCache {
+	oc := &OrderedCache{}
+	oc.baseCache = newBaseCache(config, oc)
+	return oc
+}
+
+func (oc *OrderedCache) get(key interface{}) *CacheEntry {
+	if e := oc.entries.Get(&CacheEntry{Key: key}); e != nil {
+		return e.(*CacheEntry)
+	}
+	return nil
+}
+func (oc *OrderedCache) add(e *CacheEntry) { oc.entries.Insert(e) }
+func (oc *OrderedCache) del(e *CacheEntry) { oc.entries.Delete(e) }
+
+// Ceil returns the entry with the smallest key at or after key.
+// Returns nil if there is none. The entry isn't marked as recently
+// used.
+func (oc *OrderedCache) Ceil(key llrb.Comparable) *CacheEntry {
+	if e := oc.entries.Ceil(&CacheEntry{Key: key}); e != nil {
+		return e.(*CacheEntry)
+	}
+	return nil
+}
+
+// Floor returns the entry with the greatest key at or before key.
+// Returns nil if there is none. The entry isn't marked as recently
+// used.
+func (oc *OrderedCache) Floor(key llrb.Comparable) *CacheEntry {
+	if e := oc.entries.Floor(&CacheEntry{Key: key}); e != nil {
+		return e.(*CacheEntry)
+	}
+	return nil
+}
+
+// Do invokes f on each entry in key order until f returns true.
+func (oc *OrderedCache) Do(f func(e *CacheEntry) bool) {
+	oc.entries.Do(func(c llrb.Comparable) bool {
+		return f(c.(*CacheEntry))
+	})
+}
+
+// DoRange invokes f on each entry with a key in [from, to), in key
+// order, until f returns true.
+func (oc *OrderedCache) DoRange(f func(e *CacheEntry) bool, from, to llrb.Comparable) {
+	oc.entries.DoRange(func(c llrb.Comparable) bool {
+		return f(c.(*CacheEntry))
+	}, &CacheEntry{Key: from}, &CacheEntry{Key: to})
+}
+
+// An IntervalKey is the key of an IntervalCache entry, a span of
+// keys. Entries with identical spans are distinguished by their
+// IntervalKeys' unique IDs.
+type IntervalKey struct {
+	interval.Range
+	id uintptr
+}
+
+func (ik *IntervalKey) String() string {
+	return fmt.Sprintf("%d:[%q,%q)", ik.id, ik.Start, ik.End)
+}
+
+// IntervalCache is a cache whose keys are spans, which supports
+// lookups of the entries overlapping a span.
+type IntervalCache struct {
+	baseCache
+	entries interval.Tree
+	nextID  uintptr
+}
+
+// NewIntervalCache creates a new IntervalCache.
+func NewIntervalCache(config CacheConfig) *IntervalCache {
+	ic := &IntervalCache{}
+	ic.baseCache = newBaseCache(config, ic)
+	return ic
+}
+
+// NewKey returns a new key for the span [start, end), unique within
+// the cache. If end is empty, the span is the single key start. The
+// span may not otherwise be empty.
+func (ic *IntervalCache) NewKey(start, end []byte) *IntervalKey {
+	if len(end) == 0 {
+		end = append(append([]byte(nil), start...), 0)
+	}
+	ic.nextID++
+	return &IntervalKey{
+		Range: interval.Range{Start: interval.Comparable(start), End: interval.Comparable(end)},
+		id:    ic.nextID,
+	}
+}
+
+func (ic *IntervalCache) get(key interface{}) *CacheEntry {
+	ik := key.(*IntervalKey)
+	for _, e := range ic.entries.Get(ik.Range) {
+		if e.ID() == ik.id {
+			return e.(*CacheEntry)
+		}
+	}
+	return nil
+}
+func (ic *IntervalCache) del(e *CacheEntry) { ic.entries.Delete(e) }
+func (ic *IntervalCache) add(e *CacheEntry) {
+	if err := ic.entries.Insert(e); err != nil {
+		panic(fmt.Sprintf("invalid interval cache key %s: %v", e.Key, err))
+	}
+}
+
+// GetOverlaps returns the entries whose spans overlap [start, end),
+// ordered by span start. If end is empty, the entries containing the
+// key start are returned. The entries aren't marked as recently used.
+func (ic *IntervalCache) GetOverlaps(start, end []byte) []*CacheEntry {
+	if len(end) == 0 {
+		end = append(append([]byte(nil), start...), 0)
+	}
+	var entries []*CacheEntry
+	for _, e := range ic.entries.Get(interval.Range{Start: start, End: end}) {
+		entries = append(entries, e.(*CacheEntry))
+	}
+	return entries
+}
@@ -0,0 +1,282 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import (
+	"reflect"
+	"testing"
+
+	"code.google.com/p/biogo.store/llrb"
+	"github.com/cockroachdb/cockroach/util/metrics"
+)
+
+type simpleStruct struct {
+	int
+	string
+}
+
+type complexStruct struct {
+	int
+	simpleStruct
+}
+
+var getTests = []struct {
+	name       string
+	keyToAdd   interface{}
+	keyToGet   interface{}
+	expectedOk bool
+}{
+	{"string_hit", "myKey", "myKey", true},
+	{"string_miss", "myKey", "nonsense", false},
+	{"simple_struct_hit", simpleStruct{1, "two"}, simpleStruct{1, "two"}, true},
+	{"simeple_struct_miss", simpleStruct{1, "two"}, simpleStruct{0, "noway"}, false},
+	{"complex_struct_hit", complexStruct{1, simpleStruct{2, "three"}},
+		complexStruct{1, simpleStruct{2, "three"}}, true},
+}
+
+func TestCacheGet(t *testing.T) {
+	for _, tt := range getTests {
+		uc := NewUnorderedCache(CacheConfig{})
+		uc.Add(tt.keyToAdd, 1234)
+		val, ok := uc.Get(tt.keyToGet)
+		if ok != tt.expectedOk {
+			t.Fatalf("%s: cache hit = %v; want %v", tt.name, ok, !ok)
+		} else if ok && val != 1234 {
+			t.Fatalf("%s expected get to return 1234 but got %v", tt.name, val)
+		}
+	}
+}
+
+func TestCacheDel(t *testing.T) {
+	var evicted []interface{}
+	uc := NewUnorderedCache(CacheConfig{
+		OnEvicted: func(key, value interface{}) { evicted = append(evicted, key) },
+	})
+	uc.Add("myKey", 1234)
+	if val, ok := uc.Get("myKey"); !ok {
+		t.Fatal("TestCacheDel returned no match")
+	} else if val != 1234 {
+		t.Fatalf("TestCacheDel failed.  Expected %d, got %v", 1234, val)
+	}
+
+	uc.Del("myKey")
+	if _, ok := uc.Get("myKey"); ok {
+		t.Fatal("TestCacheDel returned a removed entry")
+	}
+	if !reflect.DeepEqual(evicted, []interface{}{"myKey"}) {
+		t.Errorf("expected removed entry to be reported as evicted; got %v", evicted)
+	}
+}
+
+// TestCacheMaxEntries verifies that entries are evicted in least
+// recently used order once the cache holds MaxEntries.
+func TestCacheMaxEntries(t *testing.T) {
+	var evicted []interface{}
+	uc := NewUnorderedCache(CacheConfig{
+		MaxEntries: 2,
+		OnEvicted:  func(key, value interface{}) { evicted = append(evicted, key) },
+	})
+	uc.Add("a", 1)
+	uc.Add("b", 2)
+	uc.Get("a")
+	uc.Add("c", 3)
+	if !reflect.DeepEqual(evicted, []interface{}{"b"}) {
+		t.Errorf("expected least recently used entry to be evicted; got %v", evicted)
+	}
+	// Replacing a value doesn't evict anything.
+	uc.Add("c", 4)
+	if v, ok := uc.Get("c"); !ok || v != 4 || uc.Len() != 2 {
+		t.Errorf("expected value to be replaced; got %v, %t with %d entries", v, ok, uc.Len())
+	}
+	uc.Clear()
+	if uc.Len() != 0 || len(evicted) != 3 {
+		t.Errorf("expected cleared cache to evict all entries; got %d entries, evicted %v", uc.Len(), evicted)
+	}
+}
+
+// TestCacheMaxBytes verifies that entries are evicted in least
+// recently used order while their total size exceeds MaxBytes.
+func TestCacheMaxBytes(t *testing.T) {
+	uc := NewUnorderedCache(CacheConfig{
+		MaxBytes: 10,
+		Size:     func(key, value interface{}) int64 { return int64(len(value.(string))) },
+	})
+	uc.Add("a", "1234")
+	uc.Add("b", "1234")
+	if uc.Bytes() != 8 {
+		t.Errorf("expected 8 bytes; got %d", uc.Bytes())
+	}
+	uc.Add("c", "12345")
+	if _, ok := uc.Get("a"); ok || uc.Len() != 2 || uc.Bytes() != 9 {
+		t.Errorf("expected first entry to be evicted; got %d entries of %d bytes", uc.Len(), uc.Bytes())
+	}
+	// Growing an entry's value evicts others.
+	uc.Add("c", "123456789")
+	if _, ok := uc.Get("b"); ok || uc.Len() != 1 || uc.Bytes() != 9 {
+		t.Errorf("expected second entry to be evicted; got %d entries of %d bytes", uc.Len(), uc.Bytes())
+	}
+	// An entry larger than the cache isn't retained.
+	uc.Add("d", "12345678901")
+	if uc.Len() != 0 || uc.Bytes() != 0 {
+		t.Errorf("expected empty cache; got %d entries of %d bytes", uc.Len(), uc.Bytes())
+	}
+}
+
+// TestCacheBudget verifies that entries are reserved from the cache's
+// budget, evicted while the budget can't accommodate new entries, and
+// released when removed.
+func TestCacheBudget(t *testing.T) {
+	parent := NewMemoryBudget("parent", 10)
+	budget := parent.NewChild("cache", 0)
+	uc := NewUnorderedCache(CacheConfig{
+		Size:   func(key, value interface{}) int64 { return int64(len(value.(string))) },
+		Budget: budget,
+	})
+	uc.Add("a", "1234")
+	uc.Add("b", "1234")
+	if budget.Used() != 8 || parent.Used() != 8 {
+		t.Errorf("expected 8 bytes reserved; got %d, %d", budget.Used(), parent.Used())
+	}
+	// Memory reserved elsewhere from the parent leaves less for the
+	// cache, so the least recently used entry is evicted.
+	if err := parent.Reserve(1); err != nil {
+		t.Fatal(err)
+	}
+	uc.Add("c", "12")
+	if _, ok := uc.Get("a"); ok || uc.Len() != 2 || budget.Used() != 6 {
+		t.Errorf("expected first entry to be evicted; got %d entries of %d bytes", uc.Len(), budget.Used())
+	}
+	// An entry the budget can't accommodate isn't cached.
+	uc.Add("d", "1234567890")
+	if uc.Len() != 0 || budget.Used() != 0 || parent.Used() != 1 {
+		t.Errorf("expected empty cache; got %d entries of %d bytes", uc.Len(), budget.Used())
+	}
+	uc.Add("e", "123")
+	uc.Del("e")
+	if budget.Used() != 0 {
+		t.Errorf("expected removed entry to be released; got %d bytes", budget.Used())
+	}
+}
+
+func TestCacheMetrics(t *testing.T) {
+	m := &CacheMetrics{Hits: &metrics.Counter{}, Misses: &metrics.Counter{}}
+	uc := NewUnorderedCache(CacheConfig{Metrics: m})
+	uc.Add("a", 1)
+	uc.Get("a")
+	uc.Get("a")
+	uc.Get("b")
+	if m.Hits.Count() != 2 || m.Misses.Count() != 1 {
+		t.Errorf("expected 2 hits and 1 miss; got %d, %d", m.Hits.Count(), m.Misses.Count())
+	}
+}
+
+type testKey string
+
+func (a testKey) Compare(b llrb.Comparable) int {
+	switch {
+	case a < b.(testKey):
+		return -1
+	case a > b.(testKey):
+		return 1
+	}
+	return 0
+}
+
+func TestOrderedCache(t *testing.T) {
+	oc := NewOrderedCache(CacheConfig{MaxEntries: 3})
+	for _, k := range []string{"d", "b", "a", "c"} {
+		oc.Add(testKey(k), k)
+	}
+	// "d" was the least recently used.
+	if _, ok := oc.Get(testKey("d")); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	if e := oc.Ceil(testKey("bb")); e == nil || e.Key != testKey("c") {
+		t.Errorf("expected ceil of bb to be c; got %+v", e)
+	}
+	if e := oc.Floor(testKey("bb")); e == nil || e.Key != testKey("b") {
+		t.Errorf("expected floor of bb to be b; got %+v", e)
+	}
+	if e := oc.Ceil(testKey("d")); e != nil {
+		t.Errorf("expected no ceil of d; got %+v", e)
+	}
+	var keys []interface{}
+	oc.Do(func(e *CacheEntry) bool {
+		keys = append(keys, e.Key)
+		return false
+	})
+	if !reflect.DeepEqual(keys, []interface{}{testKey("a"), testKey("b"), testKey("c")}) {
+		t.Errorf("expected entries in key order; got %v", keys)
+	}
+	keys = nil
+	oc.DoRange(func(e *CacheEntry) bool {
+		keys = append(keys, e.Key)
+		return false
+	}, testKey("b"), testKey("c"))
+	if !reflect.DeepEqual(keys, []interface{}{testKey("b")}) {
+		t.Errorf("expected entries in [b, c); got %v", keys)
+	}
+	oc.Del(testKey("b"))
+	if e := oc.Floor(testKey("bb")); e == nil || e.Key != testKey("a") {
+		t.Errorf("expected floor of bb to be a after deletion; got %+v", e)
+	}
+}
+
+func TestIntervalCache(t *testing.T) {
+	ic := NewIntervalCache(CacheConfig{MaxEntries: 3})
+	keys := []*IntervalKey{
+		ic.NewKey([]byte("a"), []byte("c")),
+		ic.NewKey([]byte("b"), []byte("d")),
+		ic.NewKey([]byte("b"), []byte("d")),
+		ic.NewKey([]byte("e"), nil),
+	}
+	for i, k := range keys {
+		ic.Add(k, i)
+	}
+	// The first key was the least recently used.
+	if _, ok := ic.Get(keys[0]); ok || ic.Len() != 3 {
+		t.Errorf("expected least recently used entry to be evicted; got %d entries", ic.Len())
+	}
+	for i, k := range keys[1:] {
+		if v, ok := ic.Get(k); !ok || v != i+1 {
+			t.Errorf("expected %s to have value %d; got %v, %t", k, i+1, v, ok)
+		}
+	}
+	testCases := []struct {
+		start, end string
+		expValues  []interface{}
+	}{
+		{"a", "b", nil},
+		{"a", "c", []interface{}{1, 2}},
+		{"c", "e", []interface{}{1, 2}},
+		{"d", "e", nil},
+		{"e", "", []interface{}{3}},
+		{"e\x00", "", nil},
+	}
+	for i, test := range testCases {
+		var values []interface{}
+		for _, e := range ic.GetOverlaps([]byte(test.start), []byte(test.end)) {
+			values = append(values, e.Value)
+		}
+		if !reflect.DeepEqual(values, test.expValues) {
+			t.Errorf("%d: expected overlapping values %v; got %v", i, test.expValues, values)
+		}
+	}
+	ic.Del(keys[1])
+	if overlaps := ic.GetOverlaps([]byte("b"), nil); len(overlaps) != 1 || overlaps[0].Key != keys[2] {
+		t.Errorf("expected only the deleted key's entry to be removed; got %v", overlaps)
+	}
+}
@@ -0,0 +1,347 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// Package interval provides an interval tree keyed by half-open key
+// spans. It's a left-leaning red-black tree ordered by span start, in
+// which every node is augmented with the greatest end of the spans in
+// its subtree, so that the spans overlapping a query span or
+// containing a key (stabbing queries) are found without visiting
+// subtrees which can't contain them.
+package interval
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Comparable is an end of a Range. Ends are ordered like keys, by
+// bytewise comparison.
+type Comparable []byte
+
+// Compare returns a value indicating the sort order relationship
+// between the receiver and the parameter.
+func (c Comparable) Compare(o Comparable) int {
+	return bytes.Compare(c, o)
+}
+
+// A Range is a half-open span of keys [Start, End).
+type Range struct {
+	Start, End Comparable
+}
+
+// Overlaps returns true if the range shares at least one key with o.
+func (r Range) Overlaps(o Range) bool {
+	return r.Start.Compare(o.End) < 0 && o.Start.Compare(r.End) < 0
+}
+
+// Contains returns true if key lies within the range.
+func (r Range) Contains(key Comparable) bool {
+	return r.Start.Compare(key) <= 0 && key.Compare(r.End) < 0
+}
+
+// Interface is implemented by the values stored in a Tree. Values may
+// have identical ranges; their IDs, which must be unique among the
+// values of a tree, distinguish them.
+type Interface interface {
+	Range() Range
+	ID() uintptr
+}
+
+var (
+	// ErrEmptyRange is returned when inserting a value whose range
+	// doesn't contain any keys.
+	ErrEmptyRange = errors.New("interval: empty range")
+)
+
+type color bool
+
+const (
+	red   color = false
+	black color = true
+)
+
+// A node is a node of the tree. maxEnd is the greatest end of the
+// ranges of the values in the subtree rooted at the node.
+type node struct {
+	elem        Interface
+	rng         Range
+	maxEnd      Comparable
+	left, right *node
+	color       color
+}
+
+// Tree is an interval tree. It's not safe for concurrent use.
+type Tree struct {
+	root  *node
+	count int
+}
+
+// Len returns the number of values stored in the tree.
+func (t *Tree) Len() int {
+	return t.count
+}
+
+// Insert inserts e into the tree. If a value with the same range and
+// ID is present, it's replaced. Returns ErrEmptyRange if e's range
+// doesn't contain any keys.
+func (t *Tree) Insert(e Interface) error {
+	r := e.Range()
+	if r.Start.Compare(r.End) >= 0 {
+		return ErrEmptyRange
+	}
+	var d int
+	t.root, d = t.root.insert(e, r)
+	t.count += d
+	t.root.color = black
+	return nil
+}
+
+// Delete removes the value with e's range and ID from the tree, if
+// present.
+func (t *Tree) Delete(e Interface) {
+	if t.root == nil {
+		return
+	}
+	var d int
+	t.root, d = t.root.delete(e, e.Range())
+	t.count += d
+	if t.root != nil {
+		t.root.color = black
+	}
+}
+
+// Get returns the values whose ranges overlap r, ordered by range
+// start.
+func (t *Tree) Get(r Range) []Interface {
+	var matches []Interface
+	t.DoMatching(func(e Interface) bool {
+		matches = append(matches, e)
+		return false
+	}, r)
+	return matches
+}
+
+// Stab returns the values whose ranges contain key, ordered by range
+// start.
+func (t *Tree) Stab(key Comparable) []Interface {
+	// [key, key\x00) contains exactly key.
+	next := make(Comparable, len(key)+1)
+	copy(next, key)
+	return t.Get(Range{Start: key, End: next})
+}
+
+// Do performs fn on all values in the tree, ordered by range start,
+// until fn returns true. Returns whether iteration was stopped by fn.
+func (t *Tree) Do(fn func(e Interface) (done bool)) bool {
+	return t.root.do(fn)
+}
+
+// DoMatching performs fn on the values whose ranges overlap r,
+// ordered by range start, until fn returns true. Returns whether
+// iteration was stopped by fn.
+func (t *Tree) DoMatching(fn func(e Interface) (done bool), r Range) bool {
+	return t.root.doMatching(fn, r)
+}
+
+// compare orders values by range start, then range end, then ID.
+func compare(a Interface, ar Range, b Interface, br Range) int {
+	if c := ar.Start.Compare(br.Start); c != 0 {
+		return c
+	}
+	if c := ar.End.Compare(br.End); c != 0 {
+		return c
+	}
+	switch {
+	case a.ID() < b.ID():
+		return -1
+	case a.ID() > b.ID():
+		return 1
+	}
+	return 0
+}
+
+func (n *node) getColor() color {
+	if n == nil {
+		return black
+	}
+	return n.color
+}
+
+// adjust recomputes the node's maxEnd from its own range and its
+// children's.
+func (n *node) adjust() {
+	n.maxEnd = n.rng.End
+	if n.left != nil && n.left.maxEnd.Compare(n.maxEnd) > 0 {
+		n.maxEnd = n.left.maxEnd
+	}
+	if n.right != nil && n.right.maxEnd.Compare(n.maxEnd) > 0 {
+		n.maxEnd = n.right.maxEnd
+	}
+}
+
+func (n *node) rotateLeft() *node {
+	root := n.right
+	n.right = root.left
+	root.left = n
+	root.color = n.color
+	n.color = red
+	n.adjust()
+	root.adjust()
+	return root
+}
+
+func (n *node) rotateRight() *node {
+	root := n.left
+	n.left = root.right
+	root.right = n
+	root.color = n.color
+	n.color = red
+	n.adjust()
+	root.adjust()
+	return root
+}
+
+func (n *node) flipColors() {
+	n.color = !n.color
+	n.left.color = !n.left.color
+	n.right.color = !n.right.color
+}
+
+// fixUp restores the left-leaning red-black invariants and the node's
+// maxEnd on the way back up from an insertion or deletion.
+func (n *node) fixUp() *node {
+	n.adjust()
+	if n.right.getColor() == red {
+		n = n.rotateLeft()
+	}
+	if n.left.getColor() == red && n.left.left.getColor() == red {
+		n = n.rotateRight()
+	}
+	if n.left.getColor() == red && n.right.getColor() == red {
+		n.flipColors()
+	}
+	return n
+}
+
+func (n *node) moveRedLeft() *node {
+	n.flipColors()
+	if n.right.left.getColor() == red {
+		n.right = n.right.rotateRight()
+		n = n.rotateLeft()
+		n.flipColors()
+	}
+	return n
+}
+
+func (n *node) moveRedRight() *node {
+	n.flipColors()
+	if n.left.left.getColor() == red {
+		n = n.rotateRight()
+		n.flipColors()
+	}
+	return n
+}
+
+func (n *node) insert(e Interface, r Range) (*node, int) {
+	if n == nil {
+		return &node{elem: e, rng: r, maxEnd: r.End}, 1
+	}
+	var d int
+	switch c := compare(e, r, n.elem, n.rng); {
+	case c == 0:
+		n.elem = e
+	case c < 0:
+		n.left, d = n.left.insert(e, r)
+	default:
+		n.right, d = n.right.insert(e, r)
+	}
+	return n.fixUp(), d
+}
+
+func (n *node) min() *node {
+	for ; n.left != nil; n = n.left {
+	}
+	return n
+}
+
+func (n *node) deleteMin() (*node, int) {
+	if n.left == nil {
+		return nil, -1
+	}
+	if n.left.getColor() == black && n.left.left.getColor() == black {
+		n = n.moveRedLeft()
+	}
+	var d int
+	n.left, d = n.left.deleteMin()
+	return n.fixUp(), d
+}
+
+func (n *node) delete(e Interface, r Range) (*node, int) {
+	var d int
+	if compare(e, r, n.elem, n.rng) < 0 {
+		if n.left != nil {
+			if n.left.getColor() == black && n.left.left.getColor() == black {
+				n = n.moveRedLeft()
+			}
+			n.left, d = n.left.delete(e, r)
+		}
+	} else {
+		if n.left.getColor() == red {
+			n = n.rotateRight()
+		}
+		if n.right == nil && compare(e, r, n.elem, n.rng) == 0 {
+			return nil, -1
+		}
+		if n.right != nil {
+			if n.right.getColor() == black && n.right.left.getColor() == black {
+				n = n.moveRedRight()
+			}
+			if compare(e, r, n.elem, n.rng) == 0 {
+				m := n.right.min()
+				n.elem, n.rng = m.elem, m.rng
+				n.right, d = n.right.deleteMin()
+			} else {
+				n.right, d = n.right.delete(e, r)
+			}
+		}
+	}
+	return n.fixUp(), d
+}
+
+func (n *node) do(fn func(e Interface) bool) bool {
+	if n == nil {
+		return false
+	}
+	return n.left.do(fn) || fn(n.elem) || n.right.do(fn)
+}
+
+// doMatching visits the subtree in order, skipping subtrees whose
+// ranges all end at or before r starts, and right subtrees whose
+// ranges all start at or after r ends.
+func (n *node) doMatching(fn func(e Interface) bool, r Range) bool {
+	if n == nil || n.maxEnd.Compare(r.Start) <= 0 {
+		return false
+	}
+	if n.left.doMatching(fn, r) {
+		return true
+	}
+	if n.rng.Start.Compare(r.End) >= 0 {
+		return false
+	}
+	if n.rng.Overlaps(r) && fn(n.elem) {
+		return true
+	}
+	return n.right.doMatching(fn, r)
+}
@@ -0,0 +1,243 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package interval
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testValue is an interval with a unique ID.
+type testValue struct {
+	r  Range
+	id uintptr
+}
+
+func (v *testValue) Range() Range { return v.r }
+func (v *testValue) ID() uintptr  { return v.id }
+
+func (v *testValue) String() string {
+	return fmt.Sprintf("%d:[%q,%q)", v.id, v.r.Start, v.r.End)
+}
+
+func newTestValue(id uintptr, start, end string) *testValue {
+	return &testValue{r: Range{Start: Comparable(start), End: Comparable(end)}, id: id}
+}
+
+// verify checks the red-black invariants of the tree and that each
+// node's maxEnd is the greatest end in its subtree. Returns the black
+// height of the tree.
+func verify(t *testing.T, n *node) int {
+	if n == nil {
+		return 1
+	}
+	if n.right.getColor() == red {
+		t.Fatalf("right-leaning red link at %v", n.elem)
+	}
+	if n.color == red && n.left.getColor() == red {
+		t.Fatalf("consecutive red links at %v", n.elem)
+	}
+	maxEnd := n.rng.End
+	for _, c := range []*node{n.left, n.right} {
+		if c != nil && c.maxEnd.Compare(maxEnd) > 0 {
+			maxEnd = c.maxEnd
+		}
+	}
+	if n.maxEnd.Compare(maxEnd) != 0 {
+		t.Fatalf("node %v has max end %q; expected %q", n.elem, n.maxEnd, maxEnd)
+	}
+	lh, rh := verify(t, n.left), verify(t, n.right)
+	if lh != rh {
+		t.Fatalf("unbalanced black heights %d, %d at %v", lh, rh, n.elem)
+	}
+	if n.color == black {
+		lh++
+	}
+	return lh
+}
+
+func TestTreeGet(t *testing.T) {
+	var tree Tree
+	values := []*testValue{
+		newTestValue(1, "a", "c"),
+		newTestValue(2, "b", "d"),
+		newTestValue(3, "b", "d"), // Same range as 2.
+		newTestValue(4, "e", "f"),
+		newTestValue(5, "a", "z"),
+	}
+	for _, v := range values {
+		if err := tree.Insert(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tree.Len() != len(values) {
+		t.Fatalf("expected %d values; got %d", len(values), tree.Len())
+	}
+	testCases := []struct {
+		start, end string
+		expIDs     []uintptr
+	}{
+		{"a", "b", []uintptr{1, 5}},
+		{"c", "d", []uintptr{5, 2, 3}},
+		{"d", "e", []uintptr{5}},
+		{"0", "a", nil},
+		{"a\x00", "b", []uintptr{1, 5}},
+		{"z", "zz", nil},
+		{"", "\xff", []uintptr{1, 5, 2, 3, 4}},
+	}
+	for i, test := range testCases {
+		var ids []uintptr
+		for _, e := range tree.Get(Range{Start: Comparable(test.start), End: Comparable(test.end)}) {
+			ids = append(ids, e.ID())
+		}
+		if !reflect.DeepEqual(ids, test.expIDs) {
+			t.Errorf("%d: expected %v; got %v", i, test.expIDs, ids)
+		}
+	}
+
+	// Stabbing queries include range starts and exclude range ends.
+	for key, expIDs := range map[string][]uintptr{
+		"a": {1, 5},
+		"c": {5, 2, 3},
+		"f": {5},
+		"z": nil,
+	} {
+		var ids []uintptr
+		for _, e := range tree.Stab(Comparable(key)) {
+			ids = append(ids, e.ID())
+		}
+		if !reflect.DeepEqual(ids, expIDs) {
+			t.Errorf("stab %q: expected %v; got %v", key, expIDs, ids)
+		}
+	}
+
+	// Values with identical ranges are deleted by ID.
+	tree.Delete(values[1])
+	if matches := tree.Stab(Comparable("c")); len(matches) != 2 || matches[1].ID() != 3 {
+		t.Errorf("expected only value 2 to be deleted; got %v", matches)
+	}
+	// Deleting a missing value is a no-op.
+	tree.Delete(values[1])
+	if tree.Len() != len(values)-1 {
+		t.Errorf("expected %d values; got %d", len(values)-1, tree.Len())
+	}
+}
+
+func TestTreeInsertEmptyRange(t *testing.T) {
+	var tree Tree
+	for _, v := range []*testValue{newTestValue(1, "a", "a"), newTestValue(2, "b", "a")} {
+		if err := tree.Insert(v); err != ErrEmptyRange {
+			t.Errorf("expected empty range error inserting %v; got %v", v, err)
+		}
+	}
+	if tree.Len() != 0 {
+		t.Errorf("expected empty tree; got %d values", tree.Len())
+	}
+}
+
+func TestTreeDo(t *testing.T) {
+	var tree Tree
+	for i, s := range []string{"d", "b", "a", "c"} {
+		tree.Insert(newTestValue(uintptr(i), s, s+"\x00"))
+	}
+	var starts []string
+	tree.Do(func(e Interface) bool {
+		starts = append(starts, string(e.Range().Start))
+		return len(starts) == 3
+	})
+	if !reflect.DeepEqual(starts, []string{"a", "b", "c"}) {
+		t.Errorf("expected iteration in order until done; got %v", starts)
+	}
+}
+
+// TestTreeRandom inserts and deletes random ranges, verifying the
+// tree's invariants and comparing the results of overlap and stabbing
+// queries with those of a linear search.
+func TestTreeRandom(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("using seed %d", seed)
+	r := rand.New(rand.NewSource(seed))
+	randKey := func() Comparable {
+		return Comparable(fmt.Sprintf("%02d", r.Intn(50)))
+	}
+	randRange := func() Range {
+		for {
+			start, end := randKey(), randKey()
+			if c := start.Compare(end); c < 0 {
+				return Range{Start: start, End: end}
+			} else if c > 0 {
+				return Range{Start: end, End: start}
+			}
+		}
+	}
+	var tree Tree
+	present := map[uintptr]*testValue{}
+	for i := 0; i < 2000; i++ {
+		if len(present) > 0 && r.Intn(3) == 0 {
+			// Delete a random value.
+			for id, v := range present {
+				tree.Delete(v)
+				delete(present, id)
+				break
+			}
+		} else {
+			v := &testValue{r: randRange(), id: uintptr(i)}
+			if err := tree.Insert(v); err != nil {
+				t.Fatal(err)
+			}
+			present[v.id] = v
+		}
+		verify(t, tree.root)
+		if tree.Len() != len(present) {
+			t.Fatalf("%d: expected %d values; got %d", i, len(present), tree.Len())
+		}
+
+		q := randRange()
+		matches := map[uintptr]bool{}
+		for _, e := range tree.Get(q) {
+			matches[e.ID()] = true
+		}
+		key := randKey()
+		stabbed := map[uintptr]bool{}
+		for _, e := range tree.Stab(key) {
+			stabbed[e.ID()] = true
+		}
+		for id, v := range present {
+			if v.r.Overlaps(q) != matches[id] {
+				t.Fatalf("%d: value %v overlaps %q-%q is %t; tree returned %t", i, v, q.Start, q.End, v.r.Overlaps(q), matches[id])
+			}
+			if v.r.Contains(key) != stabbed[id] {
+				t.Fatalf("%d: value %v contains %q is %t; tree returned %t", i, v, key, v.r.Contains(key), stabbed[id])
+			}
+		}
+		if len(matches) > len(present) || len(stabbed) > len(present) {
+			t.Fatalf("%d: tree returned values which aren't present", i)
+		}
+	}
+}
+
+func BenchmarkTreeInsert(b *testing.B) {
+	var tree Tree
+	r := rand.New(rand.NewSource(0))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := Comparable(fmt.Sprintf("%08d", r.Intn(1e8)))
+		tree.Insert(&testValue{r: Range{Start: start, End: append(start, 'x')}, id: uintptr(i)})
+	}
+}
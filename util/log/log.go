@@ -0,0 +1,180 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// Package log provides leveled logging with structured context. A
+// Logger carries key-value fields identifying the component which
+// logs, such as the node, store and range, and emits them with each
+// line so that the logs of a busy node are attributable. Lines are
+// written via glog.
+//
+// Verbosity may be set per module, in addition to glog's global -v
+// flag, via the -logmodule flag; for example
+// -logmodule=storage=2,multiraft=6.
+package log
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Keys of the fields commonly set in a Logger's context.
+const (
+	NodeID  = "node"
+	StoreID = "store"
+	RangeID = "range"
+	GroupID = "group"
+)
+
+// A Logger emits log lines prefixed with its module and the fields of
+// its context. Loggers are immutable and safe for concurrent use; the
+// zero value logs without prefix.
+type Logger struct {
+	module string
+	prefix string // "[module key=value ...] "
+}
+
+// New returns a Logger for module with an empty context.
+func New(module string) Logger {
+	return Logger{module: module, prefix: "[" + module + "] "}
+}
+
+// With returns a copy of the logger whose context includes the field
+// key with value.
+func (l Logger) With(key string, value interface{}) Logger {
+	field := fmt.Sprintf("%s=%v", key, value)
+	if l.prefix == "" {
+		l.prefix = "[" + field + "] "
+	} else {
+		l.prefix = strings.TrimSuffix(l.prefix, "] ") + " " + field + "] "
+	}
+	return l
+}
+
+// Infof logs to the INFO log.
+func (l Logger) Infof(format string, args ...interface{}) {
+	glog.InfoDepth(1, l.prefix+fmt.Sprintf(format, args...))
+}
+
+// Warningf logs to the WARNING and INFO logs.
+func (l Logger) Warningf(format string, args ...interface{}) {
+	glog.WarningDepth(1, l.prefix+fmt.Sprintf(format, args...))
+}
+
+// Errorf logs to the ERROR, WARNING and INFO logs.
+func (l Logger) Errorf(format string, args ...interface{}) {
+	glog.ErrorDepth(1, l.prefix+fmt.Sprintf(format, args...))
+}
+
+// Fatalf logs to the FATAL, ERROR, WARNING and INFO logs, and exits.
+func (l Logger) Fatalf(format string, args ...interface{}) {
+	glog.FatalDepth(1, l.prefix+fmt.Sprintf(format, args...))
+}
+
+// Verbose is returned by Logger.V. Its Infof method logs only if the
+// requested verbosity is enabled.
+type Verbose struct {
+	l  Logger
+	ok bool
+}
+
+// V returns a Verbose which logs if level is enabled either globally,
+// via glog's -v flag, or for the logger's module.
+func (l Logger) V(level glog.Level) Verbose {
+	return Verbose{l: l, ok: bool(glog.V(level)) || Verbosity(l.module) >= level}
+}
+
+// Enabled returns true if the verbosity is enabled, e.g. to skip
+// computing the arguments of lines which wouldn't be logged.
+func (v Verbose) Enabled() bool {
+	return v.ok
+}
+
+// Infof logs to the INFO log if the verbosity is enabled.
+func (v Verbose) Infof(format string, args ...interface{}) {
+	if v.ok {
+		glog.InfoDepth(1, v.l.prefix+fmt.Sprintf(format, args...))
+	}
+}
+
+// moduleLevels holds the verbosity of each module set via
+// SetVerbosity or the -logmodule flag.
+var moduleLevels = struct {
+	sync.RWMutex
+	levels map[string]glog.Level
+}{levels: map[string]glog.Level{}}
+
+// SetVerbosity sets the verbosity of module.
+func SetVerbosity(module string, level glog.Level) {
+	moduleLevels.Lock()
+	defer moduleLevels.Unlock()
+	moduleLevels.levels[module] = level
+}
+
+// Verbosity returns the verbosity of module, or zero if none was set.
+func Verbosity(module string) glog.Level {
+	moduleLevels.RLock()
+	defer moduleLevels.RUnlock()
+	return moduleLevels.levels[module]
+}
+
+// moduleFlag implements flag.Value for -logmodule.
+type moduleFlag struct{}
+
+// String implements flag.Value.
+func (moduleFlag) String() string {
+	moduleLevels.RLock()
+	defer moduleLevels.RUnlock()
+	var specs []string
+	for module, level := range moduleLevels.levels {
+		specs = append(specs, fmt.Sprintf("%s=%d", module, level))
+	}
+	sort.Strings(specs)
+	return strings.Join(specs, ",")
+}
+
+// Set implements flag.Value. value is a comma-separated list of
+// module=level pairs.
+func (moduleFlag) Set(value string) error {
+	levels := map[string]glog.Level{}
+	for _, spec := range strings.Split(value, ",") {
+		if spec == "" {
+			continue
+		}
+		parts := strings.Split(spec, "=")
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid module verbosity %q; expected <module>=<level>", spec)
+		}
+		level, err := strconv.Atoi(parts[1])
+		if err != nil || level < 0 {
+			return fmt.Errorf("invalid verbosity %q for module %s", parts[1], parts[0])
+		}
+		levels[parts[0]] = glog.Level(level)
+	}
+	for module, level := range levels {
+		SetVerbosity(module, level)
+	}
+	return nil
+}
+
+func init() {
+	flag.Var(moduleFlag{}, "logmodule", "comma-separated list of <module>=<level> "+
+		"settings for module-specific verbosity, e.g. storage=2,multiraft=6")
+}
@@ -0,0 +1,84 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package log
+
+import (
+	"testing"
+
+	"github.com/golang/glog"
+)
+
+// TestLoggerWith verifies that context fields are accumulated in the
+// prefix without affecting the original logger.
+func TestLoggerWith(t *testing.T) {
+	l := New("storage")
+	ls := l.With(NodeID, 1).With(StoreID, 2)
+	lr := ls.With(RangeID, int64(3))
+	testCases := []struct {
+		l      Logger
+		prefix string
+	}{
+		{Logger{}, ""},
+		{Logger{}.With(GroupID, 4), "[group=4] "},
+		{l, "[storage] "},
+		{ls, "[storage node=1 store=2] "},
+		{lr, "[storage node=1 store=2 range=3] "},
+	}
+	for i, test := range testCases {
+		if test.l.prefix != test.prefix {
+			t.Errorf("%d: expected prefix %q; got %q", i, test.prefix, test.l.prefix)
+		}
+	}
+}
+
+// TestModuleVerbosity verifies that per-module verbosity is parsed
+// from the flag value and enables verbose logging of the module only.
+func TestModuleVerbosity(t *testing.T) {
+	var f moduleFlag
+	if err := f.Set("test-a=2,test-b=5"); err != nil {
+		t.Fatal(err)
+	}
+	if s := f.String(); s != "test-a=2,test-b=5" {
+		t.Errorf("unexpected flag value %q", s)
+	}
+	if v := Verbosity("test-a"); v != 2 {
+		t.Errorf("expected verbosity 2; got %d", v)
+	}
+	a, c := New("test-a"), New("test-c")
+	for _, test := range []struct {
+		l     Logger
+		level glog.Level
+		ok    bool
+	}{
+		{a, 1, true},
+		{a, 2, true},
+		{a, 3, false},
+		{c, 1, false},
+	} {
+		if ok := test.l.V(test.level).Enabled(); ok != test.ok {
+			t.Errorf("%s V(%d): expected %t; got %t", test.l.module, test.level, test.ok, ok)
+		}
+	}
+	for _, invalid := range []string{"test", "=1", "test=x", "test=-1", "test=1=2"} {
+		if err := f.Set(invalid); err == nil {
+			t.Errorf("expected error parsing %q", invalid)
+		}
+	}
+	// Invalid values don't partially apply.
+	if err := f.Set("test-d=1,test=x"); err == nil || Verbosity("test-d") != 0 {
+		t.Errorf("expected no verbosity to be set; got %d, %v", Verbosity("test-d"), err)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// Package metrics provides counters, gauges and histograms collected
+// in a Registry. A registry is exported over HTTP either in the
+// Prometheus text exposition format or, in the manner of expvar, as a
+// JSON object keyed by metric name.
+//
+// Metrics are typically registered in package variables of the
+// component which updates them:
+//
+//	var proposals = metrics.DefaultRegistry.Counter("multiraft_proposals")
+//
+// Registering an existing name returns the existing metric, so
+// metrics are shared by all instances of a component within the
+// process.
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Counter is a monotonically increasing count. Counters are safe
+// for concurrent use.
+type Counter struct {
+	count int64
+}
+
+// Inc increments the counter by n.
+func (c *Counter) Inc(n int64) {
+	atomic.AddInt64(&c.count, n)
+}
+
+// Count returns the current count.
+func (c *Counter) Count() int64 {
+	return atomic.LoadInt64(&c.count)
+}
+
+// A Gauge is a value which may go up or down. Gauges are safe for
+// concurrent use.
+type Gauge struct {
+	value int64
+}
+
+// Update sets the gauge to v.
+func (g *Gauge) Update(v int64) {
+	atomic.StoreInt64(&g.value, v)
+}
+
+// Inc adds n, which may be negative, to the gauge.
+func (g *Gauge) Inc(n int64) {
+	atomic.AddInt64(&g.value, n)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// LatencyBuckets are histogram bucket bounds suited to latencies
+// recorded in nanoseconds; they span 10us to ~10s in powers of two.
+var LatencyBuckets = exponentialBuckets(int64(10*time.Microsecond), 2, 21)
+
+// SizeBuckets are histogram bucket bounds suited to counts and sizes,
+// from 1 to ~1M in powers of four.
+var SizeBuckets = exponentialBuckets(1, 4, 11)
+
+// exponentialBuckets returns n bucket bounds, the first of which is
+// start and each subsequent one factor times the previous.
+func exponentialBuckets(start, factor int64, n int) []int64 {
+	bounds := make([]int64, n)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds
+}
+
+// A Histogram counts recorded values in buckets defined by inclusive
+// upper bounds, plus an overflow bucket for values above the last
+// bound. It also tracks the count and sum of all values. Histograms
+// are safe for concurrent use.
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []int64 // Sorted upper bounds of the buckets
+	counts []int64 // Per-bucket counts; len(bounds)+1 with overflow
+	count  int64
+	sum    int64
+}
+
+// NewHistogram returns a histogram with buckets bounded by bounds,
+// which must be sorted in increasing order.
+func NewHistogram(bounds []int64) *Histogram {
+	return &Histogram{
+		bounds: append([]int64(nil), bounds...),
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+// Update records the value v.
+func (h *Histogram) Update(v int64) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return v <= h.bounds[i] })
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+// UpdateSince records the time elapsed since start in nanoseconds.
+func (h *Histogram) UpdateSince(start time.Time) {
+	h.Update(int64(time.Since(start)))
+}
+
+// A Bucket is the number of values recorded in a histogram which are
+// at most UpperBound and above the previous bucket's bound. The
+// overflow bucket is omitted from snapshots; it's implied by Count.
+type Bucket struct {
+	UpperBound int64
+	Count      int64
+}
+
+// A HistogramSnapshot is a point-in-time copy of a histogram.
+type HistogramSnapshot struct {
+	Count   int64
+	Sum     int64
+	Buckets []Bucket
+}
+
+// Snapshot returns a copy of the histogram's current state.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := HistogramSnapshot{Count: h.count, Sum: h.sum, Buckets: make([]Bucket, len(h.bounds))}
+	for i, b := range h.bounds {
+		s.Buckets[i] = Bucket{UpperBound: b, Count: h.counts[i]}
+	}
+	return s
+}
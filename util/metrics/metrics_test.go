@@ -0,0 +1,66 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package metrics
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestCounterAndGauge(t *testing.T) {
+	c := &Counter{}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Inc(2)
+		}()
+	}
+	wg.Wait()
+	if n := c.Count(); n != 20 {
+		t.Errorf("expected count 20; got %d", n)
+	}
+
+	g := &Gauge{}
+	g.Update(5)
+	g.Inc(-7)
+	if v := g.Value(); v != -2 {
+		t.Errorf("expected gauge -2; got %d", v)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]int64{1, 10, 100})
+	for _, v := range []int64{0, 1, 2, 10, 50, 1000} {
+		h.Update(v)
+	}
+	expected := HistogramSnapshot{
+		Count:   6,
+		Sum:     1063,
+		Buckets: []Bucket{{1, 2}, {10, 2}, {100, 1}},
+	}
+	if s := h.Snapshot(); !reflect.DeepEqual(s, expected) {
+		t.Errorf("expected snapshot %+v; got %+v", expected, s)
+	}
+}
+
+func TestExponentialBuckets(t *testing.T) {
+	if b := exponentialBuckets(1, 4, 4); !reflect.DeepEqual(b, []int64{1, 4, 16, 64}) {
+		t.Errorf("unexpected buckets %v", b)
+	}
+}
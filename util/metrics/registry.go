@@ -0,0 +1,178 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultRegistry is the registry used by the components of a node.
+var DefaultRegistry = NewRegistry()
+
+// A Registry is a named collection of metrics. It's safe for
+// concurrent use.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]interface{} // *Counter, *Gauge or *Histogram
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]interface{}{}}
+}
+
+// lookup returns the metric registered under name, creating it with
+// newFn if none is. It panics if the existing metric is of a
+// different type, which is a programming error.
+func (r *Registry) lookup(name string, newFn func() interface{}, kind string) interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.metrics[name]
+	if !ok {
+		m = newFn()
+		r.metrics[name] = m
+	}
+	if metricKind(m) != kind {
+		panic(fmt.Sprintf("metric %q registered as %s; requested %s", name, metricKind(m), kind))
+	}
+	return m
+}
+
+// Counter returns the counter registered under name, registering a
+// new one if necessary.
+func (r *Registry) Counter(name string) *Counter {
+	return r.lookup(name, func() interface{} { return &Counter{} }, "counter").(*Counter)
+}
+
+// Gauge returns the gauge registered under name, registering a new
+// one if necessary.
+func (r *Registry) Gauge(name string) *Gauge {
+	return r.lookup(name, func() interface{} { return &Gauge{} }, "gauge").(*Gauge)
+}
+
+// Histogram returns the histogram registered under name, registering
+// a new one with the supplied bucket bounds if necessary. The bounds
+// of an existing histogram are left unchanged.
+func (r *Registry) Histogram(name string, bounds []int64) *Histogram {
+	return r.lookup(name, func() interface{} { return NewHistogram(bounds) }, "histogram").(*Histogram)
+}
+
+// metricKind returns the Prometheus type name of a metric.
+func metricKind(m interface{}) string {
+	switch m.(type) {
+	case *Counter:
+		return "counter"
+	case *Gauge:
+		return "gauge"
+	case *Histogram:
+		return "histogram"
+	}
+	return "untyped"
+}
+
+// Each invokes fn for each registered metric in order of name.
+func (r *Registry) Each(fn func(name string, metric interface{})) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make(map[string]interface{}, len(r.metrics))
+	for name, m := range r.metrics {
+		metrics[name] = m
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		fn(name, metrics[name])
+	}
+}
+
+// WriteText writes the registry's metrics to w in the Prometheus text
+// exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	var err error
+	printf := func(format string, args ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+	r.Each(func(name string, m interface{}) {
+		printf("# TYPE %s %s\n", name, metricKind(m))
+		switch t := m.(type) {
+		case *Counter:
+			printf("%s %d\n", name, t.Count())
+		case *Gauge:
+			printf("%s %d\n", name, t.Value())
+		case *Histogram:
+			s := t.Snapshot()
+			// Prometheus buckets are cumulative.
+			var cum int64
+			for _, b := range s.Buckets {
+				cum += b.Count
+				printf("%s_bucket{le=\"%d\"} %d\n", name, b.UpperBound, cum)
+			}
+			printf("%s_bucket{le=\"+Inf\"} %d\n", name, s.Count)
+			printf("%s_sum %d\n", name, s.Sum)
+			printf("%s_count %d\n", name, s.Count)
+		}
+	})
+	return err
+}
+
+// MarshalJSON encodes the registry as a JSON object keyed by metric
+// name. Counters and gauges are encoded as numbers and histograms as
+// snapshots.
+func (r *Registry) MarshalJSON() ([]byte, error) {
+	values := map[string]interface{}{}
+	r.Each(func(name string, m interface{}) {
+		switch t := m.(type) {
+		case *Counter:
+			values[name] = t.Count()
+		case *Gauge:
+			values[name] = t.Value()
+		case *Histogram:
+			values[name] = t.Snapshot()
+		}
+	})
+	return json.Marshal(values)
+}
+
+// ServeHTTP exports the registry. Metrics are written in the
+// Prometheus text format unless JSON is requested via the "format=json"
+// query parameter or the Accept header.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.FormValue("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+		b, err := json.Marshal(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := r.WriteText(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
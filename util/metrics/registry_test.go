@@ -0,0 +1,116 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistryLookup(t *testing.T) {
+	r := NewRegistry()
+	if r.Counter("a") != r.Counter("a") {
+		t.Error("expected the same counter on repeated lookup")
+	}
+	if r.Histogram("h", []int64{1}) != r.Histogram("h", []int64{2}) {
+		t.Error("expected the same histogram on repeated lookup")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic on lookup of counter as gauge")
+		}
+	}()
+	r.Gauge("a")
+}
+
+func newTestRegistry() *Registry {
+	r := NewRegistry()
+	r.Counter("requests").Inc(3)
+	r.Gauge("ranges").Update(7)
+	h := r.Histogram("latency", []int64{10, 100})
+	h.Update(5)
+	h.Update(50)
+	h.Update(500)
+	return r
+}
+
+func TestRegistryWriteText(t *testing.T) {
+	var buf bytes.Buffer
+	if err := newTestRegistry().WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# TYPE latency histogram
+latency_bucket{le="10"} 1
+latency_bucket{le="100"} 2
+latency_bucket{le="+Inf"} 3
+latency_sum 555
+latency_count 3
+# TYPE ranges gauge
+ranges 7
+# TYPE requests counter
+requests 3
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func newRequest(t *testing.T, url string, accept string) *http.Request {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	return req
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	r := newTestRegistry()
+
+	// Default is the text format.
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest(t, "http://localhost/", ""))
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte("requests 3\n")) {
+		t.Errorf("unexpected text response %d: %s", w.Code, w.Body.String())
+	}
+
+	for _, req := range []*http.Request{
+		newRequest(t, "http://localhost/?format=json", ""),
+		newRequest(t, "http://localhost/", "application/json"),
+	} {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected JSON content type; got %q", ct)
+		}
+		var values struct {
+			Requests int64
+			Ranges   int64
+			Latency  HistogramSnapshot
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &values); err != nil {
+			t.Fatal(err)
+		}
+		if values.Requests != 3 || values.Ranges != 7 || values.Latency.Count != 3 || values.Latency.Sum != 555 {
+			t.Errorf("unexpected JSON values %+v", values)
+		}
+	}
+}
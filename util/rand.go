@@ -21,17 +21,51 @@ import (
 	crypto_rand "crypto/rand"
 	"encoding/binary"
 	"math/rand"
+	"sync"
 )
 
-// NewPseudoRand returns an instance of math/rand.Rand seeded from crypto/rand
-// so we can easily and cheaply generate unique streams of numbers.
-func NewPseudoRand() *rand.Rand {
+// newSeed returns a seed read from crypto/rand.
+func newSeed() int64 {
 	var seed int64
 	err := binary.Read(crypto_rand.Reader, binary.LittleEndian, &seed)
 	if err != nil {
 		panic(Errorf("could not read from crypto/rand: %s", err))
 	}
-	return rand.New(rand.NewSource(seed))
+	return seed
+}
+
+// NewPseudoRand returns an instance of math/rand.Rand seeded from crypto/rand
+// so we can easily and cheaply generate unique streams of numbers.
+func NewPseudoRand() *rand.Rand {
+	return rand.New(rand.NewSource(newSeed()))
+}
+
+// NewPseudoRandWithSeed is like NewPseudoRand but also returns the
+// seed, so that tests using randomized inputs can log it and a
+// failure can be reproduced via rand.NewSource(seed).
+func NewPseudoRandWithSeed() (*rand.Rand, int64) {
+	seed := newSeed()
+	return rand.New(rand.NewSource(seed)), seed
+}
+
+// A lockedSource is a rand.Source which is safe for concurrent use.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+// Int63 implements rand.Source.
+func (ls *lockedSource) Int63() int64 {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.src.Int63()
+}
+
+// Seed implements rand.Source.
+func (ls *lockedSource) Seed(seed int64) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.src.Seed(seed)
 }
 
 // RandIntInRange returns a value in [min, max)
@@ -40,5 +74,6 @@ func RandIntInRange(r *rand.Rand, min, max int) int {
 }
 
 // CachedRand is a global singleton rand.Rand object cached for
-// one-off purposes to generate random numbers.
-var CachedRand = NewPseudoRand()
+// one-off purposes to generate random numbers. It's safe for
+// concurrent use.
+var CachedRand = rand.New(&lockedSource{src: rand.NewSource(newSeed())})
@@ -17,7 +17,10 @@
 
 package util
 
-import "testing"
+import (
+	"math/rand"
+	"testing"
+)
 
 func TestPseudoRand(t *testing.T) {
 	numbers := make(map[int]bool)
@@ -43,3 +46,13 @@ func TestRandIntInRange(t *testing.T) {
 		}
 	}
 }
+
+func TestPseudoRandWithSeed(t *testing.T) {
+	rand1, seed := NewPseudoRandWithSeed()
+	rand2 := rand.New(rand.NewSource(seed))
+	for i := 0; i < 10; i++ {
+		if a, b := rand1.Int63(), rand2.Int63(); a != b {
+			t.Fatalf("%d: expected generators with seed %d to agree; got %d != %d", i, seed, a, b)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// A RateLimiter is a token bucket which paces work to a rate of
+// tokens per second, such as bytes or operations per second. The
+// bucket holds at most burst tokens, accumulated while the limiter is
+// idle. Work larger than the bucket isn't refused: its tokens are
+// borrowed against the future and later work waits for the debt to
+// be repaid. RateLimiters are safe for concurrent use.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens added per second; zero for no limit
+	burst  float64 // Maximum number of tokens
+	tokens float64 // Available tokens; negative while in debt
+	last   time.Time
+	now    func() time.Time
+}
+
+// NewRateLimiter returns a rate limiter which allows rate tokens per
+// second, with bursts of up to burst tokens. The bucket starts full.
+// A rate of zero doesn't limit work at all.
+func NewRateLimiter(rate, burst float64) *RateLimiter {
+	rl := &RateLimiter{rate: rate, burst: burst, tokens: burst, now: time.Now}
+	rl.last = rl.now()
+	return rl
+}
+
+// SetRate changes the rate at which tokens are added to the bucket.
+func (rl *RateLimiter) SetRate(rate float64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.refillLocked()
+	rl.rate = rate
+}
+
+// refillLocked adds the tokens accumulated since the last refill. The
+// limiter's mutex must be held.
+func (rl *RateLimiter) refillLocked() {
+	now := rl.now()
+	if rl.tokens += now.Sub(rl.last).Seconds() * rl.rate; rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+}
+
+// reserve takes n tokens from the bucket and returns how long the
+// caller must wait before its work may proceed.
+func (rl *RateLimiter) reserve(n float64) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.rate == 0 {
+		return 0
+	}
+	rl.refillLocked()
+	// Work may proceed once any existing debt has been repaid.
+	var wait time.Duration
+	if rl.tokens < 0 {
+		wait = time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+	}
+	rl.tokens -= n
+	return wait
+}
+
+// Wait blocks until work of n tokens may proceed and returns true.
+// If stop is closed first, the tokens are returned to the bucket and
+// Wait returns false.
+func (rl *RateLimiter) Wait(n int64, stop <-chan struct{}) bool {
+	wait := rl.reserve(float64(n))
+	if wait <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(wait):
+		return true
+	case <-stop:
+		rl.mu.Lock()
+		rl.tokens += float64(n)
+		rl.mu.Unlock()
+		return false
+	}
+}
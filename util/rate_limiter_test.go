@@ -0,0 +1,92 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRateLimiterReserve verifies the token accounting of a rate
+// limiter using a manual clock.
+func TestRateLimiterReserve(t *testing.T) {
+	now := time.Unix(0, 0)
+	rl := NewRateLimiter(100, 100)
+	rl.now = func() time.Time { return now }
+	rl.last = now
+
+	// The bucket starts full; work up to its size proceeds at once, as
+	// does work which overdraws it.
+	if wait := rl.reserve(60); wait != 0 {
+		t.Errorf("expected no wait; got %s", wait)
+	}
+	if wait := rl.reserve(90); wait != 0 {
+		t.Errorf("expected no wait for overdraft; got %s", wait)
+	}
+	// Subsequent work waits for the debt of 50 tokens to be repaid.
+	if wait := rl.reserve(10); wait != 500*time.Millisecond {
+		t.Errorf("expected 500ms wait; got %s", wait)
+	}
+	// After a second, the debt of 60 tokens is 40 tokens in credit.
+	now = now.Add(time.Second)
+	if wait := rl.reserve(40); wait != 0 {
+		t.Errorf("expected no wait; got %s", wait)
+	}
+	// The bucket doesn't fill beyond its burst.
+	now = now.Add(time.Hour)
+	rl.reserve(100)
+	rl.reserve(100)
+	if wait := rl.reserve(100); wait != time.Second {
+		t.Errorf("expected 1s wait; got %s", wait)
+	}
+
+	// Doubling the rate halves waits: the debt is now 200 tokens.
+	rl.SetRate(200)
+	if wait := rl.reserve(1); wait != time.Second {
+		t.Errorf("expected 1s wait; got %s", wait)
+	}
+	// A zero rate doesn't limit work.
+	rl.SetRate(0)
+	if wait := rl.reserve(1e6); wait != 0 {
+		t.Errorf("expected no wait; got %s", wait)
+	}
+}
+
+// TestRateLimiterWait verifies that Wait paces work and is abandoned
+// when its stop channel is closed.
+func TestRateLimiterWait(t *testing.T) {
+	rl := NewRateLimiter(1000, 10)
+	stop := make(chan struct{})
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if !rl.Wait(10, stop) {
+			t.Fatal("expected wait to succeed")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("expected work to be paced to at least 20ms; took %s", elapsed)
+	}
+
+	// Overdraw a slow limiter; the next wait would take 100s.
+	rl = NewRateLimiter(1, 1)
+	if !rl.Wait(101, stop) {
+		t.Fatal("expected overdrawing wait to succeed")
+	}
+	close(stop)
+	if rl.Wait(1, stop) {
+		t.Error("expected stopped wait to fail")
+	}
+}
@@ -18,6 +18,7 @@
 package util
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/golang/glog"
@@ -31,26 +32,134 @@ type RetryOptions struct {
 	MaxBackoff  time.Duration // Maximum retry backoff interval
 	Constant    float64       // Default backoff constant
 	MaxAttempts int           // Maximum number of attempts (0 for infinite)
+	MaxDuration time.Duration // Maximum time since the first attempt (0 for infinite)
+	UseJitter   bool          // Randomize each backoff by up to +/-50%
+	Stopper     *Stopper      // Abandons retries once stopped; optional
+}
+
+// A RetryMaxAttemptsError indicates that a retry loop exhausted its
+// maximum number of attempts. LastError is the error returned by the
+// final attempt, if any.
+type RetryMaxAttemptsError struct {
+	MaxAttempts int
+	LastError   error
+}
+
+// Error formats error.
+func (e *RetryMaxAttemptsError) Error() string {
+	if e.LastError != nil {
+		return fmt.Sprintf("exceeded maximum retry attempts: %d: %v", e.MaxAttempts, e.LastError)
+	}
+	return fmt.Sprintf("exceeded maximum retry attempts: %d", e.MaxAttempts)
+}
+
+// A RetryMaxDurationError indicates that a retry loop exceeded its
+// maximum duration. LastError is the error returned by the final
+// attempt, if any.
+type RetryMaxDurationError struct {
+	MaxDuration time.Duration
+	LastError   error
+}
+
+// Error formats error.
+func (e *RetryMaxDurationError) Error() string {
+	if e.LastError != nil {
+		return fmt.Sprintf("exceeded maximum retry duration: %s: %v", e.MaxDuration, e.LastError)
+	}
+	return fmt.Sprintf("exceeded maximum retry duration: %s", e.MaxDuration)
+}
+
+// A RetryStoppedError indicates that a retry loop was abandoned
+// because its stopper was stopped. LastError is the error returned by
+// the final attempt, if any.
+type RetryStoppedError struct {
+	LastError error
+}
+
+// Error formats error.
+func (e *RetryStoppedError) Error() string {
+	if e.LastError != nil {
+		return fmt.Sprintf("retry abandoned on stop: %v", e.LastError)
+	}
+	return "retry abandoned on stop"
 }
 
 // RetryWithBackoff implements retry with exponential backoff using
 // the supplied options as parameters. When fn returns false and the
 // number of retry attempts haven't been exhausted, fn is
 // retried. When fn returns true, retry ends. Returns an error if the
-// maximum number of retries is exceeded or if the fn returns an
-// error.
+// maximum number of retries or the maximum duration is exceeded, if
+// the options' stopper is stopped while backing off, or if the fn
+// returns an error.
 func RetryWithBackoff(opts RetryOptions, fn func() (bool, error)) error {
+	_, err := retryLoop(opts, func() (bool, error) {
+		done, err := fn()
+		return done || err != nil, err
+	})
+	return err
+}
+
+// RetryOnError invokes fn, retrying with exponential backoff as long
+// as it returns a retryable error (see IsRetryable). Returns the
+// number of attempts made and the error returned by the final
+// attempt: nil, a permanent error, or a *RetryMaxAttemptsError,
+// *RetryMaxDurationError or *RetryStoppedError wrapping the last
+// retryable error if retrying ended before the error was resolved.
+func RetryOnError(opts RetryOptions, fn func() error) (int, error) {
+	var lastErr error
+	attempts, err := retryLoop(opts, func() (bool, error) {
+		lastErr = fn()
+		if IsRetryable(lastErr) {
+			glog.Warningf("%s: %v", opts.Tag, lastErr)
+			return false, nil
+		}
+		return true, lastErr
+	})
+	switch t := err.(type) {
+	case *RetryMaxAttemptsError:
+		t.LastError = lastErr
+	case *RetryMaxDurationError:
+		t.LastError = lastErr
+	case *RetryStoppedError:
+		t.LastError = lastErr
+	}
+	return attempts, err
+}
+
+// retryLoop invokes fn until it returns true, backing off between
+// attempts, and returns the number of attempts made and fn's error.
+func retryLoop(opts RetryOptions, fn func() (bool, error)) (int, error) {
 	backoff := opts.Backoff
+	start := time.Now()
+	var stopC <-chan struct{}
+	if opts.Stopper != nil {
+		stopC = opts.Stopper.ShouldStop()
+	}
 	for count := 1; true; count++ {
-		if done, err := fn(); done || err != nil {
-			return err
+		if done, err := fn(); done {
+			return count, err
 		}
 		if opts.MaxAttempts > 0 && count >= opts.MaxAttempts {
-			return Errorf("exceeded maximum retry attempts: %d", opts.MaxAttempts)
+			return count, &RetryMaxAttemptsError{MaxAttempts: opts.MaxAttempts}
+		}
+		wait := backoff
+		if opts.UseJitter {
+			wait = jitter(backoff, opts.MaxBackoff)
+		}
+		// The final attempt is made at the deadline.
+		if opts.MaxDuration > 0 {
+			remaining := opts.MaxDuration - time.Since(start)
+			if remaining <= 0 {
+				return count, &RetryMaxDurationError{MaxDuration: opts.MaxDuration}
+			} else if wait > remaining {
+				wait = remaining
+			}
 		}
-		glog.Infof("%s failed; retrying in %s", opts.Tag, backoff)
+		glog.Infof("%s failed (attempt %d); retrying in %s", opts.Tag, count, wait)
 		select {
-		case <-time.After(backoff):
+		case <-stopC:
+			return count, &RetryStoppedError{}
+		case <-time.After(wait):
 			// Increase backoff.
 			backoff = time.Duration(float64(backoff) * opts.Constant)
 			if backoff > opts.MaxBackoff {
@@ -58,5 +167,16 @@ func RetryWithBackoff(opts RetryOptions, fn func() (bool, error)) error {
 			}
 		}
 	}
-	return nil
+	return 0, nil
+}
+
+// jitter returns a random duration within +/-50% of backoff, capped
+// at max. Jitter keeps clients which failed together from retrying in
+// lockstep.
+func jitter(backoff, max time.Duration) time.Duration {
+	wait := time.Duration(float64(backoff) * (0.5 + CachedRand.Float64()))
+	if wait > max {
+		wait = max
+	}
+	return wait
 }
@@ -24,7 +24,7 @@ import (
 )
 
 func TestRetry(t *testing.T) {
-	opts := RetryOptions{"test", time.Microsecond * 10, time.Second, 2, 10}
+	opts := RetryOptions{Tag: "test", Backoff: time.Microsecond * 10, MaxBackoff: time.Second, Constant: 2, MaxAttempts: 10}
 	var retries int
 	err := RetryWithBackoff(opts, func() (bool, error) {
 		retries++
@@ -42,7 +42,7 @@ func TestRetryExceedsMaxBackoff(t *testing.T) {
 	timer := time.AfterFunc(time.Second, func() {
 		t.Error("max backoff not respected")
 	})
-	opts := RetryOptions{"test", time.Microsecond * 10, time.Microsecond * 10, 1000, 3}
+	opts := RetryOptions{Tag: "test", Backoff: time.Microsecond * 10, MaxBackoff: time.Microsecond * 10, Constant: 1000, MaxAttempts: 3}
 	err := RetryWithBackoff(opts, func() (bool, error) {
 		return false, nil
 	})
@@ -54,7 +54,7 @@ func TestRetryExceedsMaxBackoff(t *testing.T) {
 
 func TestRetryExceedsMaxAttempts(t *testing.T) {
 	var retries int
-	opts := RetryOptions{"test", time.Microsecond * 10, time.Second, 2, 3}
+	opts := RetryOptions{Tag: "test", Backoff: time.Microsecond * 10, MaxBackoff: time.Second, Constant: 2, MaxAttempts: 3}
 	err := RetryWithBackoff(opts, func() (bool, error) {
 		retries++
 		return false, nil
@@ -65,7 +65,7 @@ func TestRetryExceedsMaxAttempts(t *testing.T) {
 }
 
 func TestRetryFunctionReturnsError(t *testing.T) {
-	opts := RetryOptions{"test", time.Microsecond * 10, time.Second, 2, 0 /* indefinite */}
+	opts := RetryOptions{Tag: "test", Backoff: time.Microsecond * 10, MaxBackoff: time.Second, Constant: 2, MaxAttempts: 0 /* indefinite */}
 	err := RetryWithBackoff(opts, func() (bool, error) {
 		return false, fmt.Errorf("something went wrong")
 	})
@@ -73,3 +73,100 @@ func TestRetryFunctionReturnsError(t *testing.T) {
 		t.Error("expected an error")
 	}
 }
+
+func TestRetryExceedsMaxDuration(t *testing.T) {
+	opts := RetryOptions{Tag: "test", Backoff: time.Millisecond, MaxBackoff: time.Second, Constant: 2, MaxDuration: 20 * time.Millisecond}
+	var retries int
+	start := time.Now()
+	err := RetryWithBackoff(opts, func() (bool, error) {
+		retries++
+		return false, nil
+	})
+	if _, ok := err.(*RetryMaxDurationError); !ok {
+		t.Errorf("expected max duration error; got %v", err)
+	}
+	// Backoffs of 1, 2, 4 and 8ms are followed by a final attempt at
+	// the deadline, instead of after a 16ms backoff. Slow scheduling
+	// may skip the final attempt.
+	if retries < 5 || retries > 6 {
+		t.Errorf("expected 5 or 6 attempts; got %d", retries)
+	}
+	if elapsed := time.Since(start); elapsed < opts.MaxDuration || elapsed > time.Second {
+		t.Errorf("expected retries to end after %s; took %s", opts.MaxDuration, elapsed)
+	}
+}
+
+func TestRetryStopped(t *testing.T) {
+	stopper := NewStopper()
+	opts := RetryOptions{Tag: "test", Backoff: time.Hour, MaxBackoff: time.Hour, Constant: 2, Stopper: stopper}
+	lastErr := retryableError{fmt.Errorf("transient")}
+	type result struct {
+		attempts int
+		err      error
+	}
+	resultC := make(chan result)
+	go func() {
+		attempts, err := RetryOnError(opts, func() error {
+			return lastErr
+		})
+		resultC <- result{attempts, err}
+	}()
+	stopper.Stop()
+	r := <-resultC
+	if stopErr, ok := r.err.(*RetryStoppedError); !ok || r.attempts != 1 || stopErr.LastError != lastErr {
+		t.Errorf("expected stopped error wrapping %v after 1 attempt; got %d: %v", lastErr, r.attempts, r.err)
+	}
+}
+
+// retryableError is an error which may be retried.
+type retryableError struct {
+	error
+}
+
+func (r retryableError) CanRetry() bool { return true }
+
+func TestRetryOnError(t *testing.T) {
+	opts := RetryOptions{Tag: "test", Backoff: time.Microsecond * 10, MaxBackoff: time.Second, Constant: 2, MaxAttempts: 5}
+
+	// Retryable errors are retried until success.
+	var calls int
+	attempts, err := RetryOnError(opts, func() error {
+		if calls++; calls < 3 {
+			return retryableError{fmt.Errorf("transient")}
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("expected success after 3 attempts; got %d: %v", attempts, err)
+	}
+
+	// Permanent errors end retries immediately.
+	permErr := fmt.Errorf("permanent")
+	attempts, err = RetryOnError(opts, func() error {
+		return permErr
+	})
+	if err != permErr || attempts != 1 {
+		t.Errorf("expected permanent error after 1 attempt; got %d: %v", attempts, err)
+	}
+
+	// Exhausting the maximum attempts returns the last error.
+	lastErr := retryableError{fmt.Errorf("transient")}
+	attempts, err = RetryOnError(opts, func() error {
+		return lastErr
+	})
+	if maxErr, ok := err.(*RetryMaxAttemptsError); !ok || attempts != 5 || maxErr.LastError != lastErr {
+		t.Errorf("expected max attempts error wrapping %v after 5 attempts; got %d: %v", lastErr, attempts, err)
+	}
+}
+
+func TestRetryJitter(t *testing.T) {
+	backoff := 100 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		if wait := jitter(backoff, time.Second); wait < backoff/2 || wait > backoff*3/2 {
+			t.Errorf("jittered backoff %s outside of [%s, %s]", wait, backoff/2, backoff*3/2)
+		}
+		if wait := jitter(backoff, backoff); wait > backoff {
+			t.Errorf("jittered backoff %s exceeds maximum %s", wait, backoff)
+		}
+	}
+}
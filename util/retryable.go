@@ -21,3 +21,10 @@ package util
 type Retryable interface {
 	CanRetry() bool
 }
+
+// IsRetryable returns true if err implements Retryable and may be
+// retried. Other errors, including nil, are permanent.
+func IsRetryable(err error) bool {
+	retryErr, ok := err.(Retryable)
+	return ok && retryErr.CanRetry()
+}
@@ -0,0 +1,132 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import "sync"
+
+// A Stopper provides a channel-based mechanism to stop an arbitrary
+// number of goroutines in an orderly fashion. Workers are long-running
+// goroutines started with RunWorker, which must exit once the
+// ShouldStop channel is closed. Tasks are short-lived operations
+// bracketed by StartTask and FinishTask, such as commands in flight.
+//
+// Stopping proceeds in two phases. Quiesce drains tasks: no new tasks
+// may be started, and outstanding tasks are waited on. Stop then
+// closes the ShouldStop channel and waits for all workers to exit,
+// after which the IsStopped channel is closed. Because tasks are
+// drained first, workers are still running while the tasks they
+// serve complete.
+type Stopper struct {
+	stopper  chan struct{}  // Closed when workers should stop
+	stopped  chan struct{}  // Closed once all workers have exited
+	stop     sync.WaitGroup // Incremented for outstanding workers
+	mu       sync.Mutex     // Protects the fields below
+	drain    *sync.Cond     // Signaled when a task finishes
+	draining bool           // Set when quiescing; no new tasks start
+	stopping bool           // Set by the first call to Stop; no new workers start
+	numTasks int            // Number of outstanding tasks
+}
+
+// NewStopper returns an instance of Stopper.
+func NewStopper() *Stopper {
+	s := &Stopper{
+		stopper: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	s.drain = sync.NewCond(&s.mu)
+	return s
+}
+
+// RunWorker runs the supplied function as a worker in a goroutine.
+// The function must return once the ShouldStop channel is closed.
+// Workers aren't started once the stopper is stopping: the function
+// isn't run, as Stop may already be waiting for workers to exit.
+func (s *Stopper) RunWorker(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping {
+		return
+	}
+	s.stop.Add(1)
+	go func() {
+		defer s.stop.Done()
+		f()
+	}()
+}
+
+// StartTask adds one to the count of tasks left to drain before
+// workers are stopped. Returns false if the stopper is quiescing, in
+// which case the task must not be started. Every successful call must
+// be matched by a call to FinishTask.
+func (s *Stopper) StartTask() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.numTasks++
+	return true
+}
+
+// FinishTask removes one from the count of tasks left to drain.
+func (s *Stopper) FinishTask() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.numTasks--
+	s.drain.Broadcast()
+}
+
+// ShouldStop returns a channel which is closed when workers should
+// stop.
+func (s *Stopper) ShouldStop() <-chan struct{} {
+	return s.stopper
+}
+
+// IsStopped returns a channel which is closed once all workers have
+// exited after a call to Stop.
+func (s *Stopper) IsStopped() <-chan struct{} {
+	return s.stopped
+}
+
+// Quiesce prevents new tasks from starting and waits for outstanding
+// tasks to finish. Workers keep running.
+func (s *Stopper) Quiesce() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+	for s.numTasks > 0 {
+		s.drain.Wait()
+	}
+}
+
+// Stop quiesces the stopper, signals workers to stop and waits for
+// them to exit. Stop may be called more than once and from multiple
+// goroutines, but not from a worker or task of the stopper, whose
+// completion it awaits.
+func (s *Stopper) Stop() {
+	s.Quiesce()
+	s.mu.Lock()
+	first := !s.stopping
+	s.stopping = true
+	s.mu.Unlock()
+	if !first {
+		<-s.stopped
+		return
+	}
+	close(s.stopper)
+	s.stop.Wait()
+	close(s.stopped)
+}
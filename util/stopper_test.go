@@ -0,0 +1,144 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+// TestStopper verifies that Stop signals workers to stop and waits
+// for them to exit.
+func TestStopper(t *testing.T) {
+	s := NewStopper()
+	running := make(chan struct{})
+	waiting := make(chan struct{})
+	s.RunWorker(func() {
+		<-running
+		<-s.ShouldStop()
+	})
+	go func() {
+		s.Stop()
+		close(waiting)
+	}()
+
+	select {
+	case <-s.ShouldStop():
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("expected stopper to signal workers to stop")
+	}
+	select {
+	case <-waiting:
+		t.Fatal("expected stop to wait for running worker")
+	case <-s.IsStopped():
+		t.Fatal("expected stopper not to be stopped while worker is running")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(running)
+	select {
+	case <-waiting:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("expected stop to return once worker exited")
+	}
+	<-s.IsStopped()
+	// Stop may be called again.
+	s.Stop()
+}
+
+// TestStopperQuiesce verifies that quiescing waits for outstanding
+// tasks while workers keep running, and that no new tasks may start.
+func TestStopperQuiesce(t *testing.T) {
+	s := NewStopper()
+	if !s.StartTask() {
+		t.Fatal("expected task to start")
+	}
+	workerStopped := make(chan struct{})
+	s.RunWorker(func() {
+		<-s.ShouldStop()
+		close(workerStopped)
+	})
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+
+	// Wait for the stopper to begin quiescing.
+	if err := IsTrueWithin(func() bool {
+		if s.StartTask() {
+			s.FinishTask()
+			return false
+		}
+		return true
+	}, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.ShouldStop():
+		t.Fatal("expected workers not to be stopped while tasks are outstanding")
+	case <-stopped:
+		t.Fatal("expected stop to wait for outstanding task")
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.FinishTask()
+	select {
+	case <-stopped:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("expected stop to return once task finished")
+	}
+	select {
+	case <-workerStopped:
+	default:
+		t.Fatal("expected worker to have stopped")
+	}
+}
+
+// TestStopperConcurrentStop verifies that concurrent calls to Stop
+// all return once the workers have exited.
+func TestStopperConcurrentStop(t *testing.T) {
+	s := NewStopper()
+	for i := 0; i < 3; i++ {
+		s.RunWorker(func() { <-s.ShouldStop() })
+	}
+	done := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		go func() {
+			s.Stop()
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-done:
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("expected all calls to stop to return")
+		}
+	}
+}
+
+// TestStopperRunWorkerAfterStop verifies that workers aren't started
+// once the stopper is stopping.
+func TestStopperRunWorkerAfterStop(t *testing.T) {
+	s := NewStopper()
+	s.Stop()
+	ran := make(chan struct{})
+	s.RunWorker(func() { close(ran) })
+	select {
+	case <-ran:
+		t.Fatal("expected worker not to be started by stopped stopper")
+	case <-time.After(10 * time.Millisecond):
+	}
+}